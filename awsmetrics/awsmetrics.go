@@ -0,0 +1,97 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package awsmetrics measures the latency of the requests made with the AWS SDK for Go v2, and sends it as a
+// metric of the current invocation.
+package awsmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	middlewareID = "DatadogRequestDuration"
+	// durationMetric is the distribution of the duration of the SDK operations, in milliseconds
+	durationMetric = "aws.sdk.request.duration"
+)
+
+// AppendMiddleware adds a middleware to apiOptions, such as the APIOptions of an aws.Config, which sends the
+// duration of every operation made by the clients created from them as the aws.sdk.request.duration distribution,
+// in milliseconds. It's tagged with service, operation, status_code, retry_count and the given tags. The duration
+// includes the retries. The metric is sent with the listener of the invocation found in the context passed to
+// each operation, so the middleware does nothing outside of a wrapped handler.
+func AppendMiddleware(apiOptions *[]func(*middleware.Stack) error, tags ...string) {
+	// The tags are copied, as they're kept for every operation made by the clients
+	m := durationMiddleware{tags: append([]string(nil), tags...)}
+	*apiOptions = append(*apiOptions, m.add)
+}
+
+type durationMiddleware struct {
+	tags []string
+}
+
+func (m durationMiddleware) add(stack *middleware.Stack) error {
+	// Added last to the Initialize step, so that the service and operation are in the context, and the duration
+	// covers the serialization, signing and retries of the operation
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(middlewareID, m.handleInitialize), middleware.After)
+}
+
+func (m durationMiddleware) handleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	start := time.Now()
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	duration := time.Since(start)
+
+	tags := make([]string, 0, len(m.tags)+4)
+	tags = append(tags,
+		fmt.Sprintf("service:%s", awsmiddleware.GetServiceID(ctx)),
+		fmt.Sprintf("operation:%s", awsmiddleware.GetOperationName(ctx)),
+		fmt.Sprintf("retry_count:%d", retryCount(metadata)),
+	)
+	if statusCode, ok := getStatusCode(metadata, err); ok {
+		tags = append(tags, fmt.Sprintf("status_code:%d", statusCode))
+	}
+	tags = append(tags, m.tags...)
+	listener.AddDistributionMetric(durationMetric, float64(duration)/float64(time.Millisecond), listener.Now(), false, tags...)
+	return out, metadata, err
+}
+
+// retryCount returns the number of attempts of an operation after the first one
+func retryCount(metadata middleware.Metadata) int {
+	results, ok := retry.GetAttemptResults(metadata)
+	if !ok || len(results.Results) == 0 {
+		return 0
+	}
+	return len(results.Results) - 1
+}
+
+// getStatusCode returns the HTTP status code of the last response to an operation. It returns false when no
+// response was received, for example when the connection failed.
+func getStatusCode(metadata middleware.Metadata, err error) (int, bool) {
+	statusCode := 0
+	if response, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok && response != nil && response.Response != nil {
+		statusCode = response.StatusCode
+	}
+	var responseErr *smithyhttp.ResponseError
+	if statusCode == 0 && errors.As(err, &responseErr) {
+		statusCode = responseErr.HTTPStatusCode()
+	}
+	return statusCode, statusCode > 0
+}
@@ -0,0 +1,184 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package awsmetrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/ddlambdatest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	deleteMessageResponse = `<DeleteMessageResponse><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></DeleteMessageResponse>`
+	errorResponse         = `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>failed</Message></Error><RequestId>1</RequestId></ErrorResponse>`
+)
+
+// stubHTTPClient answers the requests of the SDK with the given status codes in turn, the last one being
+// repeated. A zero status code fails the request without a response.
+type stubHTTPClient struct {
+	statusCodes []int
+	requests    int
+}
+
+func (c *stubHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	statusCode := c.statusCodes[len(c.statusCodes)-1]
+	if c.requests < len(c.statusCodes) {
+		statusCode = c.statusCodes[c.requests]
+	}
+	c.requests++
+	if statusCode == 0 {
+		return nil, errors.New("connection reset by peer")
+	}
+	body := deleteMessageResponse
+	if statusCode >= 300 {
+		code := "InvalidParameterValue"
+		if statusCode >= 500 {
+			code = "InternalError"
+		}
+		body = strings.Replace(errorResponse, "%s", code, 1)
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// noBackoff retries the requests without waiting
+type noBackoff struct{}
+
+func (noBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	return 0, nil
+}
+
+func makeClient(httpClient *stubHTTPClient, tags ...string) *sqs.Client {
+	cfg := aws.Config{}
+	AppendMiddleware(&cfg.APIOptions, tags...)
+	return sqs.New(sqs.Options{
+		Region:           "us-east-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: sqs.EndpointResolverFromURL("https://sqs.us-east-1.amazonaws.com"),
+		HTTPClient:       httpClient,
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = noBackoff{}
+		}),
+		APIOptions: cfg.APIOptions,
+	})
+}
+
+func deleteMessage(ctx context.Context, client *sqs.Client) error {
+	_, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String("https://sqs.us-east-1.amazonaws.com/123456789012/my-queue"),
+		ReceiptHandle: aws.String("AQEBwJnKyrHigUMZj6rYigCgxlaS3SLy0a"),
+	})
+	return err
+}
+
+func TestMiddlewareRecordsDuration(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	client := makeClient(&stubHTTPClient{statusCodes: []int{200}}, "team:orders")
+
+	assert.NoError(t, deleteMessage(rec.Context(), client))
+	rec.FlushNow()
+
+	durations := rec.Distributions("aws.sdk.request.duration")
+	if assert.Len(t, durations, 1) {
+		assert.Len(t, durations[0].Values(), 1)
+		assert.True(t, durations[0].Values()[0] >= 0)
+	}
+	// The tags are normalized like those of any metric
+	rec.AssertTagged(t, "aws.sdk.request.duration", "service:sqs", "operation:deletemessage", "status_code:200", "retry_count:0", "team:orders")
+}
+
+func TestMiddlewareCopiesTags(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	tags := []string{"team:orders"}
+	client := makeClient(&stubHTTPClient{statusCodes: []int{200}}, tags...)
+	tags[0] = "team:mutated"
+
+	assert.NoError(t, deleteMessage(rec.Context(), client))
+	rec.FlushNow()
+
+	rec.AssertTagged(t, "aws.sdk.request.duration", "team:orders")
+}
+
+func TestMiddlewareCountsRetries(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	httpClient := &stubHTTPClient{statusCodes: []int{500, 0, 200}}
+
+	assert.NoError(t, deleteMessage(rec.Context(), makeClient(httpClient)))
+	rec.FlushNow()
+
+	// The operation is measured once, including its retries, with the status code of the last response
+	assert.Equal(t, 3, httpClient.requests)
+	assert.Len(t, rec.Distributions("aws.sdk.request.duration"), 1)
+	rec.AssertTagged(t, "aws.sdk.request.duration", "status_code:200", "retry_count:2")
+}
+
+func TestMiddlewareRecordsFailures(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+
+	assert.Error(t, deleteMessage(rec.Context(), makeClient(&stubHTTPClient{statusCodes: []int{400}})))
+	rec.FlushNow()
+	rec.AssertTagged(t, "aws.sdk.request.duration", "service:sqs", "operation:deletemessage", "status_code:400", "retry_count:0")
+}
+
+func TestMiddlewareWithoutResponse(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	httpClient := &stubHTTPClient{statusCodes: []int{0}}
+
+	assert.Error(t, deleteMessage(rec.Context(), makeClient(httpClient)))
+	rec.FlushNow()
+
+	durations := rec.Distributions("aws.sdk.request.duration")
+	if assert.Len(t, durations, 1) {
+		assert.Contains(t, durations[0].Tags, "retry_count:2")
+		for _, tag := range durations[0].Tags {
+			assert.False(t, strings.HasPrefix(tag, "status_code:"), tag)
+		}
+	}
+}
+
+func TestMiddlewareOutsideInvocation(t *testing.T) {
+	httpClient := &stubHTTPClient{statusCodes: []int{200}}
+
+	assert.NoError(t, deleteMessage(context.Background(), makeClient(httpClient)))
+	assert.Equal(t, 1, httpClient.requests)
+}
+
+func BenchmarkMiddleware(b *testing.B) {
+	rec := ddlambdatest.NewRecorder()
+	m := durationMiddleware{}
+	next := middleware.InitializeHandlerFunc(func(ctx context.Context, in middleware.InitializeInput) (middleware.InitializeOutput, middleware.Metadata, error) {
+		return middleware.InitializeOutput{}, middleware.Metadata{}, nil
+	})
+	for name, ctx := range map[string]context.Context{
+		"OutsideInvocation": context.Background(),
+		"InInvocation":      rec.Context(),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.handleInitialize(ctx, middleware.InitializeInput{}, next)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package awstrace propagates the Datadog trace context of the current invocation through
+// requests made with the AWS SDK for Go v2.
+package awstrace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/trace"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const (
+	middlewareID = "DatadogTraceContextInjection"
+	// datadogAttributeKey is the message attribute, or event detail field, that carries the trace context.
+	datadogAttributeKey = "_datadog"
+	// maxMessageAttributes is the number of message attributes allowed on an SQS or SNS message.
+	maxMessageAttributes = 10
+)
+
+// AppendMiddleware adds a middleware to cfg which injects the trace context of the current invocation into
+// SQS SendMessage/SendMessageBatch, SNS Publish, EventBridge PutEvents and Lambda Invoke requests made by any
+// client created from cfg. The trace context is read from the context passed to each operation.
+func AppendMiddleware(cfg *aws.Config) {
+	cfg.APIOptions = append(cfg.APIOptions, addMiddleware)
+}
+
+// InvokeInput returns a copy of a Lambda Invoke request with the trace headers of the current invocation added to
+// its client context, so that the trace continues in the invoked function. It's meant for clients which aren't
+// created from a config passed to AppendMiddleware. The input is returned unchanged when there's no trace context,
+// or if adding the headers would take its client context over the size allowed by Lambda.
+func InvokeInput(ctx context.Context, input *lambda.InvokeInput) *lambda.InvokeInput {
+	if input == nil {
+		return nil
+	}
+	headers := map[string]string{}
+	trace.InjectTraceHeaders(ctx, headers)
+	if len(headers) == 0 {
+		return input
+	}
+	return injectTraceHeaders(input, headers).(*lambda.InvokeInput)
+}
+
+func addMiddleware(stack *middleware.Stack) error {
+	// The operation input is serialized before the Build step runs, so the trace context is added during the
+	// Initialize step while the input can still be modified.
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(middlewareID, handleInitialize), middleware.After)
+}
+
+func handleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	headers := map[string]string{}
+	trace.InjectTraceHeaders(ctx, headers)
+	if len(headers) > 0 {
+		in.Parameters = injectTraceHeaders(in.Parameters, headers)
+	}
+	return next.HandleInitialize(ctx, in)
+}
+
+// injectTraceHeaders returns a copy of the operation input carrying the trace headers. The caller's input
+// is never modified. Inputs for unsupported operations are returned unchanged.
+func injectTraceHeaders(params interface{}, headers map[string]string) interface{} {
+	switch input := params.(type) {
+	case *sqs.SendMessageInput:
+		newInput := *input
+		newInput.MessageAttributes = withSQSAttribute(input.MessageAttributes, headers)
+		return &newInput
+	case *sqs.SendMessageBatchInput:
+		newInput := *input
+		newInput.Entries = make([]sqstypes.SendMessageBatchRequestEntry, len(input.Entries))
+		for i, entry := range input.Entries {
+			entry.MessageAttributes = withSQSAttribute(entry.MessageAttributes, headers)
+			newInput.Entries[i] = entry
+		}
+		return &newInput
+	case *sns.PublishInput:
+		newInput := *input
+		newInput.MessageAttributes = withSNSAttribute(input.MessageAttributes, headers)
+		return &newInput
+	case *eventbridge.PutEventsInput:
+		newInput := *input
+		newInput.Entries = append(newInput.Entries[:0:0], input.Entries...)
+		for i, entry := range newInput.Entries {
+			newInput.Entries[i].Detail = withEventDetailField(entry.Detail, headers)
+		}
+		return &newInput
+	case *lambda.InvokeInput:
+		newInput := *input
+		newInput.ClientContext = withClientContextCustom(input.ClientContext, headers)
+		return &newInput
+	}
+	return params
+}
+
+func withSQSAttribute(attributes map[string]sqstypes.MessageAttributeValue, headers map[string]string) map[string]sqstypes.MessageAttributeValue {
+	if len(attributes) >= maxMessageAttributes {
+		logger.Debug(fmt.Sprintf("sqs message already has %d message attributes, not injecting trace context", len(attributes)))
+		return attributes
+	}
+	value, err := json.Marshal(headers)
+	if err != nil {
+		return attributes
+	}
+
+	newAttributes := make(map[string]sqstypes.MessageAttributeValue, len(attributes)+1)
+	for k, v := range attributes {
+		newAttributes[k] = v
+	}
+	newAttributes[datadogAttributeKey] = sqstypes.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(string(value)),
+	}
+	return newAttributes
+}
+
+func withSNSAttribute(attributes map[string]snstypes.MessageAttributeValue, headers map[string]string) map[string]snstypes.MessageAttributeValue {
+	if len(attributes) >= maxMessageAttributes {
+		logger.Debug(fmt.Sprintf("sns message already has %d message attributes, not injecting trace context", len(attributes)))
+		return attributes
+	}
+	value, err := json.Marshal(headers)
+	if err != nil {
+		return attributes
+	}
+
+	newAttributes := make(map[string]snstypes.MessageAttributeValue, len(attributes)+1)
+	for k, v := range attributes {
+		newAttributes[k] = v
+	}
+	// SNS string attributes are rewritten when delivered to SQS with raw message delivery enabled,
+	// so the trace context is sent as a binary attribute.
+	newAttributes[datadogAttributeKey] = snstypes.MessageAttributeValue{
+		DataType:    aws.String("Binary"),
+		BinaryValue: value,
+	}
+	return newAttributes
+}
+
+func withEventDetailField(detail *string, headers map[string]string) *string {
+	fields := map[string]json.RawMessage{}
+	if detail != nil && *detail != "" {
+		if err := json.Unmarshal([]byte(*detail), &fields); err != nil {
+			logger.Debug("eventbridge event detail isn't a JSON object, not injecting trace context")
+			return detail
+		}
+	}
+	value, err := json.Marshal(headers)
+	if err != nil {
+		return detail
+	}
+	fields[datadogAttributeKey] = value
+
+	newDetail, err := json.Marshal(fields)
+	if err != nil {
+		return detail
+	}
+	return aws.String(string(newDetail))
+}
+
+func withClientContextCustom(clientContext *string, headers map[string]string) *string {
+	newClientContext, err := trace.AddTraceHeadersToClientContext(aws.ToString(clientContext), headers)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("not injecting trace context into lambda client context: %v", err))
+		return clientContext
+	}
+	return aws.String(newClientContext)
+}
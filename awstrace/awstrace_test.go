@@ -0,0 +1,165 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package awstrace
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+var mockHeaders = map[string]string{
+	"x-datadog-trace-id":  "1231452342",
+	"x-datadog-parent-id": "45678910",
+}
+
+func TestMiddlewareInjectsTraceContext(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	cfg := aws.Config{}
+	AppendMiddleware(&cfg)
+
+	stack := middleware.NewStack("test", smithyhttp.NewStackRequest)
+	for _, fn := range cfg.APIOptions {
+		assert.NoError(t, fn(stack))
+	}
+	var serialized interface{}
+	stack.Serialize.Add(middleware.SerializeMiddlewareFunc("capture", func(ctx context.Context, in middleware.SerializeInput, next middleware.SerializeHandler) (middleware.SerializeOutput, middleware.Metadata, error) {
+		serialized = in.Parameters
+		return middleware.SerializeOutput{}, middleware.Metadata{}, nil
+	}), middleware.After)
+
+	input := &sqs.SendMessageInput{MessageBody: aws.String("hello")}
+	handler := middleware.DecorateHandler(middleware.HandlerFunc(func(ctx context.Context, input interface{}) (interface{}, middleware.Metadata, error) {
+		return nil, middleware.Metadata{}, nil
+	}), stack)
+	_, _, err := handler.Handle(ctx, input)
+	assert.NoError(t, err)
+
+	// The caller's input isn't modified
+	assert.Nil(t, input.MessageAttributes)
+
+	attribute := serialized.(*sqs.SendMessageInput).MessageAttributes[datadogAttributeKey]
+	headers := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(*attribute.StringValue), &headers))
+	assert.Equal(t, strconv.FormatUint(span.Context().TraceID(), 10), headers["x-datadog-trace-id"])
+	assert.Equal(t, strconv.FormatUint(span.Context().SpanID(), 10), headers["x-datadog-parent-id"])
+}
+
+func TestInjectSQSSendMessageBatch(t *testing.T) {
+	input := &sqs.SendMessageBatchInput{
+		Entries: []sqstypes.SendMessageBatchRequestEntry{{Id: aws.String("1")}, {Id: aws.String("2")}},
+	}
+
+	result := injectTraceHeaders(input, mockHeaders).(*sqs.SendMessageBatchInput)
+	for _, entry := range result.Entries {
+		assert.Equal(t, "String", *entry.MessageAttributes[datadogAttributeKey].DataType)
+		assert.JSONEq(t, `{"x-datadog-trace-id":"1231452342","x-datadog-parent-id":"45678910"}`, *entry.MessageAttributes[datadogAttributeKey].StringValue)
+	}
+	assert.Nil(t, input.Entries[0].MessageAttributes)
+}
+
+func TestInjectSQSSkipsWhenAtAttributeLimit(t *testing.T) {
+	attributes := map[string]sqstypes.MessageAttributeValue{}
+	for i := 0; i < maxMessageAttributes; i++ {
+		attributes[fmt.Sprintf("attr-%d", i)] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("v")}
+	}
+	input := &sqs.SendMessageInput{MessageAttributes: attributes}
+
+	result := injectTraceHeaders(input, mockHeaders).(*sqs.SendMessageInput)
+	assert.Len(t, result.MessageAttributes, maxMessageAttributes)
+	assert.NotContains(t, result.MessageAttributes, datadogAttributeKey)
+}
+
+func TestInjectSNSPublish(t *testing.T) {
+	input := &sns.PublishInput{Message: aws.String("hello")}
+
+	result := injectTraceHeaders(input, mockHeaders).(*sns.PublishInput)
+	attribute := result.MessageAttributes[datadogAttributeKey]
+	assert.Equal(t, "Binary", *attribute.DataType)
+	assert.JSONEq(t, `{"x-datadog-trace-id":"1231452342","x-datadog-parent-id":"45678910"}`, string(attribute.BinaryValue))
+}
+
+func TestInjectEventBridgePutEvents(t *testing.T) {
+	input := &eventbridge.PutEventsInput{
+		Entries: []eventbridgetypes.PutEventsRequestEntry{
+			{Detail: aws.String(`{"order":1}`)},
+			{Detail: aws.String(`not json`)},
+		},
+	}
+
+	result := injectTraceHeaders(input, mockHeaders).(*eventbridge.PutEventsInput)
+	assert.JSONEq(t, `{"order":1,"_datadog":{"x-datadog-trace-id":"1231452342","x-datadog-parent-id":"45678910"}}`, *result.Entries[0].Detail)
+	assert.Equal(t, `not json`, *result.Entries[1].Detail)
+	assert.Equal(t, `{"order":1}`, *input.Entries[0].Detail)
+}
+
+func TestInjectLambdaInvoke(t *testing.T) {
+	existing := base64.StdEncoding.EncodeToString([]byte(`{"custom":{"user":"value"},"env":{"a":"b"}}`))
+	input := &lambda.InvokeInput{FunctionName: aws.String("my-function"), ClientContext: aws.String(existing)}
+
+	result := injectTraceHeaders(input, mockHeaders).(*lambda.InvokeInput)
+	decoded, err := base64.StdEncoding.DecodeString(*result.ClientContext)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"custom":{"user":"value","x-datadog-trace-id":"1231452342","x-datadog-parent-id":"45678910"},"env":{"a":"b"}}`, string(decoded))
+}
+
+func TestInvokeInputAddsTraceHeadersToClientContext(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	input := &lambda.InvokeInput{FunctionName: aws.String("my-function")}
+	result := InvokeInput(ctx, input)
+
+	// The caller's input isn't modified
+	assert.Nil(t, input.ClientContext)
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(result.ClientContext))
+	assert.NoError(t, err)
+	clientContext := struct {
+		Custom map[string]string `json:"custom"`
+	}{}
+	assert.NoError(t, json.Unmarshal(decoded, &clientContext))
+	assert.Equal(t, strconv.FormatUint(span.Context().TraceID(), 10), clientContext.Custom["x-datadog-trace-id"])
+	assert.Equal(t, strconv.FormatUint(span.Context().SpanID(), 10), clientContext.Custom["x-datadog-parent-id"])
+	assert.Equal(t, "my-function", aws.ToString(result.FunctionName))
+}
+
+func TestInvokeInputWithoutTraceContext(t *testing.T) {
+	input := &lambda.InvokeInput{FunctionName: aws.String("my-function")}
+	assert.Same(t, input, InvokeInput(context.Background(), input))
+	assert.Nil(t, input.ClientContext)
+	assert.Nil(t, InvokeInput(context.Background(), nil))
+}
+
+func TestInjectUnsupportedOperation(t *testing.T) {
+	input := &sqs.ReceiveMessageInput{}
+	assert.Same(t, input, injectTraceHeaders(input, mockHeaders))
+}
@@ -13,18 +13,124 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
+	"github.com/DataDog/datadog-lambda-go/internal/health"
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
 	"github.com/DataDog/datadog-lambda-go/internal/trace"
 	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
 )
 
 type (
+	// TraceContext is a set of Datadog trace headers, such as x-datadog-trace-id, x-datadog-parent-id
+	// and x-datadog-sampling-priority.
+	TraceContext = trace.TraceContext
+
+	// Scrubber removes sensitive data from a string, returning it unchanged when there is nothing to remove.
+	// Scrub is called for every metric tag, so it should be cheap when there is nothing to remove.
+	Scrubber = scrub.Scrubber
+
+	// Clock provides the current time to timestamp metrics, the tickers which schedule the sending of metrics
+	// batches, the waits between retries, and the bound of the final flush set by MaxFlushDuration. Tests can
+	// replace it with a fake to make timestamps deterministic.
+	Clock = metrics.TimeService
+
+	// MetricsSink describes where metrics are sent: to the Datadog Extension, the Datadog API, the logs for the
+	// Datadog Forwarder, or nowhere. Reason explains why the sink was selected.
+	MetricsSink = metrics.SinkInfo
+
+	// Health tells whether the library is fully operational, or the degraded modes it fell back to since the
+	// container started, such as dropping metrics when no API key is set. Its Warnings list the misuses of the
+	// library detected, such as wrapping the handler twice.
+	Health = health.Status
+
+	// DegradedReason is a stable code identifying a degraded mode
+	DegradedReason = health.Reason
+
+	// MetricsStats counts the metrics handled since the container started: the metrics added, the points
+	// batched, the batches sent to the Datadog API, the failed attempts and retries, and the points dropped by
+	// reason. It also lists the metric names which emitted the most points. It can be marshalled to JSON, for
+	// example to log it at the end of each invocation.
+	MetricsStats = metrics.Stats
+
+	// MetricEmitter is the number of points emitted under a metric name since the container started
+	MetricEmitter = metrics.EmitterCount
+
+	// MetricValue is a point of a distribution metric, with its timestamp
+	MetricValue = metrics.MetricValue
+
+	// APIMetric is a metric of a batch sent to the Datadog API
+	APIMetric = metrics.APIMetric
+
+	// MetricsClient sends batches of metrics in place of the Datadog API, for example to an aggregator. The
+	// batches are built, retried and passed to the additional sinks as they would be for the Datadog API.
+	MetricsClient = metrics.Client
+
+	// MetricsBatchSink receives every batch of metrics after it was sent to the Datadog API, for example to keep a
+	// raw copy of it. Its errors are logged, but neither retried nor counted as failures of the flush.
+	MetricsBatchSink = metrics.BatchSink
+
+	// BackgroundMetrics sends the metrics of a goroutine which runs for the life of the container, independently of
+	// the invocations. Create it with BackgroundEmitter. It flushes on its own ticker and at the end of each
+	// invocation, but nothing is sent while the container is frozen between invocations: the points buffered then
+	// are sent once it's thawed.
+	BackgroundMetrics = metrics.BackgroundEmitter
+
+	// MetricsAPI sends the metrics of an invocation with a common prefix in their names and base tags, for
+	// example to send every metric of a package under its own namespace. Create one with Namespace. It's a value
+	// type, cheap to copy: Namespace and WithTags return new scopes, and leave the one they're called on unchanged.
+	MetricsAPI struct {
+		ctx    context.Context
+		prefix string
+		tags   []string
+	}
+
+	// EventAttributes describes the event of an invocation from an SQS FIFO queue: the MessageGroupID and
+	// MessageDeduplicationID of its first record
+	EventAttributes = eventsource.Details
+
+	// TraceExtractor reads a TraceContext from the raw payload of an invocation. It returns false if the
+	// payload doesn't contain a trace context.
+	TraceExtractor func(ctx context.Context, rawPayload []byte) (TraceContext, bool)
+
+	// RoundTripper is an http.RoundTripper that adds the trace headers of the invocation found in each
+	// request's context to the outgoing request. Headers already set on the request are left untouched.
+	// Requests whose context comes from GuardedContext are refused once their invocation finished. When X-Ray
+	// active tracing is on and DD_MERGE_XRAY_TRACES isn't, the requests already carrying an X-Ray trace header
+	// are left to X-Ray, and aren't given Datadog headers.
+	RoundTripper struct {
+		// Base is the RoundTripper used to send the request. If nil, http.DefaultTransport is used.
+		Base http.RoundTripper
+	}
+
+	// RequestAfterInvocationError is returned by the clients wrapped with WrapClient for a request with a
+	// GuardedContext sent after its invocation finished, when the container may be frozen at any time
+	RequestAfterInvocationError struct {
+		// Method is the method of the request, such as GET
+		Method string
+		// Host is the host the request was sent to
+		Host string
+	}
+
+	// guardedContext keeps the values of the context of an invocation, without its deadline nor its
+	// cancellation, for work which may outlive the invocation
+	guardedContext struct {
+		parent context.Context
+	}
+
 	// Config gives options for how ddlambda should behave
 	Config struct {
 		// APIKey is your Datadog API key. This is used for sending metrics.
@@ -40,15 +146,43 @@ type (
 		// BatchInterval is the period of time which metrics are grouped together for processing to be sent to the API or written to logs.
 		// Any pending metrics are flushed at the end of the lambda.
 		BatchInterval time.Duration
+		// SyncFlushOnly sends metrics to the API once, when the invocation finishes, instead of batching them on a
+		// background goroutine. It lowers the overhead of short invocations, but BatchInterval is ignored, so
+		// long-running invocations should keep the default.
+		SyncFlushOnly bool
+		// DisableFlushJitter flushes metrics every BatchInterval from the start of each invocation. By default,
+		// the first flush of each container comes after a random delay of up to one BatchInterval, and the next
+		// ones after BatchInterval with up to 10% of jitter, so that concurrent executions don't flush together.
+		DisableFlushJitter bool
 		// Site is the host to send metrics to. If empty, this value is read from the 'DD_SITE' environment variable, or if that is empty
 		// will default to 'datadoghq.com'.
 		Site string
 		// DebugLogging will turn on extended debug logging.
 		DebugLogging bool
-		// EnhancedMetrics enables the reporting of enhanced metrics under `aws.lambda.enhanced*` and adds enhanced metric tags
-		EnhancedMetrics bool
+		// Clock is used for metric timestamps and the scheduling of metrics batches. Defaults to the real clock.
+		Clock Clock
+		// MetricsClient receives the batches of metrics in place of the Datadog API and the Datadog Extension.
+		// When it's set, no API key is needed, and neither DD_API_KEY nor DD_KMS_API_KEY is read.
+		MetricsClient MetricsClient
+		// DebugPayloads logs the endpoint, metric and point counts and size of every metrics payload sent to the API,
+		// without turning on debug logging. Set DD_DUMP_PAYLOADS to true to log the first payloads in full.
+		DebugPayloads bool
+		// EnhancedMetrics turns the enhanced metrics under `aws.lambda.enhanced*` on or off, taking precedence over the
+		// 'DD_ENHANCED_METRICS' environment variable when set. Custom metrics are sent either way. Defaults to true.
+		EnhancedMetrics *bool
 		// DDTraceEnabled enables the Datadog tracer.
 		DDTraceEnabled bool
+		// TraceEnabled turns Datadog tracing on or off, taking precedence over DDTraceEnabled and the 'DD_TRACE_ENABLED'
+		// environment variable when set. When it's turned off, the tracer isn't started, trace context isn't extracted
+		// from events and the trace header helpers return empty values. When neither is set, the tracer isn't started
+		// either, but the trace header helpers return the trace context converted from X-Ray.
+		TraceEnabled *bool
+		// Scrubber removes sensitive data, such as email addresses or card numbers, from metric tag values, captured
+		// payloads and error messages before they are sent or logged. MakeScrubber creates a default implementation.
+		Scrubber Scrubber
+		// ScrubPatterns are additional patterns removed by the default Scrubber. Setting them enables the default
+		// Scrubber when Scrubber is nil.
+		ScrubPatterns []*regexp.Regexp
 		// MergeXrayTraces will cause Datadog traces to be merged with traces from AWS X-Ray.
 		MergeXrayTraces bool
 		// HttpClientTimeout specifies a time limit for requests to the API. It defaults to 5s.
@@ -66,6 +200,151 @@ type (
 		// the counter will get totally reset after CircuitBreakerInterval
 		// default: 4
 		CircuitBreakerTotalFailures uint32
+		// RetainRawPayload keeps a copy of the raw payload of every invocation in its context, which can be read
+		// with RawPayload. It's off by default, as the copy doubles the memory used by the payload.
+		RetainRawPayload bool
+		// RawPayloadMaxSize is the size in bytes above which raw payloads aren't retained. It defaults to 256KB.
+		RawPayloadMaxSize int
+		// ExtraListeners are notified of every invocation after the built-in tracing and metrics listeners
+		// start, and before they finish. They're still notified when the built-in listeners couldn't be created.
+		ExtraListeners []HandlerListener
+		// AdditionalSinks receive every batch of metrics sent to the Datadog API, in order, after it was sent.
+		// Batches which couldn't be sent are passed too. MarshalMetricsBatch gives the payload of a batch.
+		AdditionalSinks []MetricsBatchSink
+		// SetMaxMembers is the number of distinct members a Set counts per flush interval. Sets with more
+		// members are tagged with set_saturated:true. It defaults to 1000.
+		SetMaxMembers int
+		// DisableTagNormalization sends metric tags as they are. By default, they're lowercased, the characters
+		// Datadog doesn't allow are replaced with underscores, they're truncated to 200 characters, and the tags
+		// left empty are dropped.
+		DisableTagNormalization bool
+		// PrewarmConnection opens the connection to the Datadog API when the handler is wrapped, during the init
+		// of the function, so that the first flush of a cold container doesn't pay for the TLS handshake. The
+		// prewarm gives up after 1s, and never fails the init.
+		PrewarmConnection bool
+		// LegacyQueryAuth sends the API key in the api_key query parameter of the metrics requests, as previous
+		// versions did, instead of the DD-API-KEY header. Only set it for private intake proxies which don't
+		// read the header, as URLs end up in proxy logs and error messages.
+		LegacyQueryAuth bool
+		// IntakeVersion is the version of the Datadog API the gauges, counts and rates are sent to, "v1" by
+		// default or "v2". The v2 series payload identifies the function by its ARN as the resource of each metric.
+		// Distributions are always sent to the v1 API.
+		IntakeVersion string
+		// FlushConcurrency is the number of requests a flush sends to the Datadog API at the same time, 3 by default.
+		// The requests still pending at the deadline of the invocation are given up on.
+		FlushConcurrency int
+		// AsyncFlushWithExtension hands the metrics to the Datadog Extension at the end of each invocation without
+		// waiting for their delivery, which the Extension completes after the invocation, so that the flush isn't
+		// part of the billed duration. It defaults to true, and is ignored when the Extension isn't installed.
+		AsyncFlushWithExtension *bool
+		// RuntimeTags adds the architecture, runtime and memorysize tags of the container, which tag the enhanced
+		// metrics, to the custom metrics too. Tags of DD_TAGS with the same keys take precedence.
+		RuntimeTags bool
+		// MemoryPressure samples the memory used by the container during invocations. When it reaches
+		// MemoryPressureThreshold of the memory limit, aws.lambda.enhanced.memory_pressure is sent and the metrics
+		// are flushed early, in case the function runs out of memory.
+		MemoryPressure bool
+		// MemoryPressureThreshold is the share of the memory limit, in (0, 1], above which the memory pressure is
+		// reported. It defaults to 0.92.
+		MemoryPressureThreshold float64
+		// ShardedBuffers buffers the metrics sent to the Datadog API in that many shards, each with its own lock,
+		// so that handlers sending metrics from many goroutines at once, such as worker pools, don't contend on a
+		// single buffer. The shards are merged when the metrics are flushed. It's ignored with SyncFlushOnly.
+		ShardedBuffers int
+		// AdaptiveFlush adapts when the metrics sent to the Datadog API are flushed to how many are buffered: they
+		// are flushed as soon as 1000 points are buffered, and the period of the flushes is doubled, up to 4 times
+		// BatchInterval, after each flush of fewer than 10 points. It's ignored with SyncFlushOnly.
+		AdaptiveFlush bool
+		// FlushAtPointCount flushes the metrics sent to the Datadog API as soon as that many points are buffered,
+		// instead of holding bursts until the end of the BatchInterval, which then starts over. With AdaptiveFlush,
+		// the lower of it and 1000 points applies. It's ignored when it's 0 and with SyncFlushOnly.
+		FlushAtPointCount int
+		// AggregationBucket is the width of the buckets of time the counts and gauges sent to the Datadog API are
+		// rolled up into before they're flushed, so that a single point is sent for each bucket, as DogStatsD
+		// does. It defaults to 10 seconds. Distributions keep every point.
+		AggregationBucket time.Duration
+		// MaxFutureSkew is how far in the future of the clock of the container the timestamps of the metrics sent
+		// to the Datadog API can be. Later timestamps, such as those of replayed events when the clock drifted, are
+		// clamped to it, so that the intake doesn't reject the whole batch. It defaults to 10 minutes.
+		MaxFutureSkew time.Duration
+		// RejectMissingTimestamps drops the points sent to the Datadog API without a timestamp, the zero time or the
+		// Unix epoch, and returns an error wrapping ErrInvalidMetric for metrics without any point left. By
+		// default, these points are sent at the time they're added.
+		RejectMissingTimestamps bool
+		// MaxFlushDuration bounds the time the end of an invocation waits for the metrics to be sent to the Datadog
+		// API, including the retries, whatever the time left in the invocation, so that functions with long
+		// timeouts never wait seconds for the metrics. The metrics which aren't sent by then are spilled with
+		// SpillFailedBatches, and dropped otherwise. It defaults to 3 seconds, and a negative duration removes
+		// the bound.
+		MaxFlushDuration time.Duration
+		// MaxRetriesPerInvocation bounds the retries of the metrics which couldn't be sent to the Datadog API, across
+		// all the flushes of an invocation, when ShouldRetryOnFailure is set. Once they're spent, the API is deemed
+		// unreachable, and the next flushes of the invocation spill or drop their metrics without sending them. It's
+		// unbounded by default.
+		MaxRetriesPerInvocation int
+		// MaxRetryTimePerInvocation bounds the time spent retrying like MaxRetriesPerInvocation, including the waits
+		// before the retries. It's unbounded by default.
+		MaxRetryTimePerInvocation time.Duration
+		// MessageGroupTag adds the message_group_id tag, with the message group of the first record, to the
+		// enhanced metrics of invocations by SQS FIFO queues, to spot hot message groups. It's off by default, as
+		// the number of message groups can make the metrics expensive.
+		MessageGroupTag bool
+		// AuthorizerTagKeys are looked up in the authorizer context of API Gateway requests, to tag every metric of
+		// the invocation with them, such as a tenant_id set by a custom authorizer. The context of Lambda
+		// authorizers and the claims of JWT authorizers are supported, for both REST and HTTP APIs. Keys which
+		// aren't found are skipped.
+		AuthorizerTagKeys []string
+		// SpillFailedBatches writes the batches of metrics which couldn't be sent to the Datadog API, after their
+		// retries, to files under /tmp/datadog-lambda-go/spool, and sends them at the start of the next invocations
+		// of the container. It's meant for metrics which mustn't be lost, such as billing counters.
+		SpillFailedBatches bool
+		// SpoolMaxSize is the size in bytes of the spilled batches above which the oldest ones are evicted. It
+		// defaults to 8MB.
+		SpoolMaxSize int64
+		// FailOnInitError panics in WrapHandler when the library can't be initialized, for example when the KMS
+		// encrypted API key can't be decrypted, which fails the init of the function. By default, the error is
+		// logged once, and the handler runs without the library's instrumentation. With FailOnInitError, the
+		// decryption of the API key is waited for in WrapHandler.
+		FailOnInitError bool
+		// FetchResourceTags adds the tags of the function to its enhanced metrics. They're fetched with
+		// lambda:ListTags, once per container, on its first invocation, which needs the lambda:ListTags permission.
+		// The fetch times out after 500ms, and its failures only leave the enhanced metrics without these tags.
+		FetchResourceTags bool
+		// ResourceTagKeys are the keys of the tags of the function added to the enhanced metrics with
+		// FetchResourceTags. When it's empty, every tag is added, except the ones prefixed with aws:.
+		ResourceTagKeys []string
+		// LogTopEmitters logs a datadog.lambda_go.top_emitters line, with the 10 metric names which emitted the
+		// most points since the container started, when Lambda shuts the container down. Like FlushOnTerminate,
+		// it makes Start register the library's SIGTERM hook with the runtime, and only applies to handlers
+		// started with Start.
+		LogTopEmitters bool
+		// FlushOnTerminate makes Start register a SIGTERM hook with the runtime, which flushes the metrics still
+		// buffered when Lambda shuts the container down: those sent after the last invocation ended, and those of
+		// the background emitters. It only applies to handlers started with Start.
+		FlushOnTerminate bool
+
+		// decrypter replaces AWS KMS in tests
+		decrypter metrics.Decrypter
+		// tagFetcher replaces lambda:ListTags in tests
+		tagFetcher metrics.TagFetcher
+		// dryRun is set by InvokeDryRun, whose invocations don't report the startup of a container
+		dryRun bool
+	}
+
+	// HandlerListener is notified at the start and at the end of every invocation of a wrapped handler.
+	// Listeners are started in order, and finished in reverse order. A panic in a listener is recovered and
+	// logged, so that it doesn't prevent the other listeners, such as the metrics flush, from running.
+	HandlerListener interface {
+		// HandlerStarted is called with the payload of the invocation before the handler runs. The returned
+		// context is passed to the next listeners and to the handler.
+		HandlerStarted(ctx context.Context, payload json.RawMessage) context.Context
+		// HandlerFinished is called with the error returned by the handler, if any
+		HandlerFinished(ctx context.Context, err error)
+	}
+
+	// extraListener adapts a HandlerListener to the listeners of the wrapper, which also receive the response
+	extraListener struct {
+		listener HandlerListener
 	}
 )
 
@@ -78,39 +357,267 @@ const (
 	DatadogSiteEnvVar = "DD_SITE"
 	// LogLevelEnvVar is the environment variable that will be used to set the log level.
 	LogLevelEnvVar = "DD_LOG_LEVEL"
+	// LogFormatEnvVar is the environment variable that will be used to set the format of the library's logs, either "text" or "json".
+	LogFormatEnvVar = "DD_LOG_FORMAT"
+	// DumpPayloadsEnvVar is the environment variable that will be used to log the content of the first metrics payloads sent to the API.
+	DumpPayloadsEnvVar = "DD_DUMP_PAYLOADS"
+	// TelemetryEnabledEnvVar is the environment variable that enables the metrics measuring the library's own flushes.
+	TelemetryEnabledEnvVar = "DD_TELEMETRY_ENABLED"
+	// StartupMetricEnabledEnvVar is the environment variable that turns off the startup metric and log line when set to false.
+	StartupMetricEnabledEnvVar = "DD_STARTUP_METRIC_ENABLED"
 	// ShouldUseLogForwarderEnvVar is the environment variable that enables log forwarding of metrics.
 	ShouldUseLogForwarderEnvVar = "DD_FLUSH_TO_LOG"
 	// DatadogTraceEnabledEnvVar is the environment variable that enables Datadog tracing.
 	DatadogTraceEnabledEnvVar = "DD_TRACE_ENABLED"
 	// MergeXrayTracesEnvVar is the environment variable that enables the merging of X-Ray and Datadog traces.
 	MergeXrayTracesEnvVar = "DD_MERGE_XRAY_TRACES"
+	// TraceManagedServicesEnvVar is the environment variable that enables inferred spans for the managed services invoking the function.
+	TraceManagedServicesEnvVar = "DD_TRACE_MANAGED_SERVICES"
+	// TagsEnvVar is the environment variable that sets the global tags added to every metric, separated by commas or spaces.
+	TagsEnvVar = "DD_TAGS"
+	// ServiceEnvVar is the environment variable that sets the service name used to correlate logs and traces.
+	ServiceEnvVar = "DD_SERVICE"
+	// EnvEnvVar is the environment variable that sets the environment used to correlate logs and traces.
+	EnvEnvVar = "DD_ENV"
+	// VersionEnvVar is the environment variable that sets the version used to correlate logs and traces.
+	VersionEnvVar = "DD_VERSION"
+	// PropagationStyleEnvVar is the environment variable that sets the trace propagation styles used for both extraction and injection.
+	PropagationStyleEnvVar = "DD_TRACE_PROPAGATION_STYLE"
+	// PropagationStyleExtractEnvVar is the environment variable that sets the trace propagation styles used for extraction.
+	// It takes precedence over DD_TRACE_PROPAGATION_STYLE.
+	PropagationStyleExtractEnvVar = "DD_TRACE_PROPAGATION_STYLE_EXTRACT"
+	// PropagationStyleInjectEnvVar is the environment variable that sets the trace propagation styles used for injection.
+	// It takes precedence over DD_TRACE_PROPAGATION_STYLE.
+	PropagationStyleInjectEnvVar = "DD_TRACE_PROPAGATION_STYLE_INJECT"
+	// TraceSampleRateEnvVar is the environment variable that sets the rate, between 0 and 1, at which incoming traces without a sampling priority are kept.
+	TraceSampleRateEnvVar = "DD_TRACE_SAMPLE_RATE"
+	// TraceID128BitGenerationEnvVar is the environment variable that makes new traces started by the function use 128 bit trace ids.
+	TraceID128BitGenerationEnvVar = "DD_TRACE_128_BIT_TRACEID_GENERATION"
+	// CaptureLambdaPayloadEnvVar is the environment variable that enables capturing the request and response payloads of invocations.
+	CaptureLambdaPayloadEnvVar = "DD_CAPTURE_LAMBDA_PAYLOAD"
+	// CaptureLambdaPayloadMaxDepthEnvVar is the environment variable that sets the depth below which captured payloads are kept as nested JSON.
+	CaptureLambdaPayloadMaxDepthEnvVar = "DD_CAPTURE_LAMBDA_PAYLOAD_MAX_DEPTH"
+	// CaptureLambdaPayloadObfuscationRegexEnvVar is the environment variable that sets the pattern of the keys redacted from captured payloads.
+	CaptureLambdaPayloadObfuscationRegexEnvVar = "DD_CAPTURE_LAMBDA_PAYLOAD_OBFUSCATION_REGEX"
+	// EnhancedMetricsEnvVar is the environment variable that turns the enhanced metrics on or off.
+	EnhancedMetricsEnvVar = "DD_ENHANCED_METRICS"
 
 	// DefaultSite to send API messages to.
 	DefaultSite = "datadoghq.com"
 	// DefaultEnhancedMetrics enables enhanced metrics by default.
 	DefaultEnhancedMetrics = true
+	// DefaultTraceManagedServices enables inferred spans by default.
+	DefaultTraceManagedServices = true
+	// DefaultTraceSampleRate keeps every incoming trace without a sampling priority by default.
+	DefaultTraceSampleRate = 1.0
+)
+
+const (
+	// SinkExtension means metrics are sent to the Datadog Extension
+	SinkExtension = metrics.SinkExtension
+	// SinkAPI means metrics are sent directly to the Datadog API
+	SinkAPI = metrics.SinkAPI
+	// SinkLogForwarder means metrics are written to the logs, to be sent by the Datadog Forwarder
+	SinkLogForwarder = metrics.SinkLogForwarder
+	// SinkCustom means metrics are sent to a custom client, such as the recorder of the ddlambdatest package
+	SinkCustom = metrics.SinkCustom
+	// SinkDisabled means metrics are dropped, because no way of sending them is configured
+	SinkDisabled = metrics.SinkDisabled
+)
+
+const (
+	// DegradedNoAPIKey means metrics are dropped, as no API key is set and neither the Datadog Extension nor the
+	// log forwarder is used
+	DegradedNoAPIKey = health.ReasonNoAPIKey
+	// DegradedExtensionUnreachable means the Datadog Extension is installed but didn't respond
+	DegradedExtensionUnreachable = health.ReasonExtensionUnreachable
+	// DegradedKMSDecryptFailed means the KMS encrypted API key couldn't be decrypted
+	DegradedKMSDecryptFailed = health.ReasonKMSDecryptFailed
+	// DegradedAPIKeyRejected means the Datadog API rejected the API key
+	DegradedAPIKeyRejected = health.ReasonAPIKeyRejected
+	// DegradedInvalidHandler means the handler wasn't wrapped, as its signature isn't one of a Lambda handler
+	DegradedInvalidHandler = health.ReasonInvalidHandler
+	// DegradedInitFailed means the library couldn't be initialized, so the handler runs without instrumentation
+	DegradedInitFailed = health.ReasonInitFailed
+
+	// WarningWrappedTwice means WrapHandler was called more than once, or a wrapped handler was wrapped again
+	WarningWrappedTwice = health.ReasonWrappedTwice
+	// WarningMetricWithoutWrapper means metrics were sent without the context of a wrapped handler, or by a
+	// function which never wrapped its handler, so they were dropped
+	WarningMetricWithoutWrapper = health.ReasonMetricWithoutWrapper
 )
 
+// requestAfterInvocationMetric counts the requests refused because their invocation finished
+const requestAfterInvocationMetric = "datadog.lambda_go.request_after_invocation"
+
+var (
+	// ErrMetricsDisabled is wrapped by the errors of the metrics which can't be sent, because no way of sending
+	// them is configured, the handler isn't wrapped, or their invocation was torn down
+	ErrMetricsDisabled = metrics.ErrMetricsDisabled
+	// ErrBufferFull is wrapped by the errors of the metrics dropped because too many were buffered
+	ErrBufferFull = metrics.ErrBufferFull
+	// ErrInvalidMetric is wrapped by the errors of the metrics rejected because of their name, value, sample rate or timestamp
+	ErrInvalidMetric = metrics.ErrInvalidMetric
+
+	// errNoMetricsListener is returned for the metrics sent without the metrics listener of an invocation
+	errNoMetricsListener = fmt.Errorf("%w: no metrics listener, is the handler wrapped?", ErrMetricsDisabled)
+)
+
+var (
+	// wrapCount counts the calls to WrapHandler and WrapLambdaHandler, as a function should wrap its handler once
+	wrapCount int32
+	// preInitCheckOnce checks once whether a handler was wrapped after metrics were sent during the init
+	preInitCheckOnce sync.Once
+)
+
+// maxInitDuration is the longest init of a Lambda function, by which the handler is wrapped when it ever is
+const maxInitDuration = 10 * time.Second
+
+// guardedKey marks the contexts derived from GuardedContext
+var guardedKey = new(int)
+
+// makeMetricsListener creates the metrics listener of WrapHandler. Tests replace it to simulate failures.
+var makeMetricsListener = metrics.MakeListener
+
 // WrapHandler is used to instrument your lambda functions.
 // It returns a modified handler that can be passed directly to the lambda. Start function.
+// The handler always runs: when the library can't be initialized, the error is logged once and the handler runs
+// without instrumentation, unless Config.FailOnInitError is set.
 func WrapHandler(handler interface{}, cfg *Config) interface{} {
+	countWrap()
+	return wrapper.WrapHandlerWithListeners(handler, setUp(cfg)...)
+}
+
+// WrapLambdaHandler instruments your lambda functions like WrapHandler, and returns a lambda.Handler to pass to
+// lambda.StartHandler. The response of the handler is marshaled by the wrapper, so that a response which can't be
+// marshaled to JSON is counted in the errors enhanced metric with the tag error_type:marshal_error.
+func WrapLambdaHandler(handler interface{}, cfg *Config) lambda.Handler {
+	countWrap()
+	return wrapper.WrapLambdaHandlerWithListeners(handler, setUp(cfg)...)
+}
 
-	logLevel := os.Getenv(LogLevelEnvVar)
+// countWrap counts a handler being wrapped, and warns once when more than one is. Each wrapped handler has its own
+// listeners, so wrapping twice nests them and flushes twice. A wrapped handler invoked by another one runs without
+// its own listeners.
+func countWrap() {
+	if atomic.AddInt32(&wrapCount, 1) == 2 {
+		health.Warn(health.ReasonWrappedTwice, "WrapHandler was called more than once. Wrap the handler once, where it's passed to lambda.Start, and don't wrap a handler which is already wrapped.")
+	}
+}
+
+// startHandler runs a handler in the Lambda runtime with options, and never returns. Tests replace it to invoke the
+// handler locally.
+var startHandler = lambda.StartWithOptions
+
+// enableSIGTERM is the option which registers callbacks run by the runtime on SIGTERM. Tests replace it to call
+// the callbacks themselves.
+var enableSIGTERM = lambda.WithEnableSIGTERM
+
+// Start wraps the handler like WrapLambdaHandler, and runs it in the Lambda runtime with the options, like
+// lambda.StartWithOptions. It never returns. With Config.FlushOnTerminate or Config.LogTopEmitters, the library's
+// SIGTERM hook is added to the options, which can register their own hooks with lambda.WithEnableSIGTERM too.
+func Start(handler interface{}, cfg *Config, opts ...lambda.Option) {
+	countWrap()
+	listeners := setUp(cfg)
+	wrapped := wrapper.WrapLambdaHandlerWithListeners(handler, listeners...)
+	if cfg != nil && (cfg.FlushOnTerminate || cfg.LogTopEmitters) {
+		// Not appending in place, as the caller may reuse the array of its options
+		opts = append(opts[:len(opts):len(opts)], enableSIGTERM(func() { terminate(listeners) }))
+	}
+	startHandler(wrapped, opts...)
+}
+
+// terminate flushes the metrics still buffered by the listeners of a handler when the container shuts down, and
+// logs the top emitters when they're enabled
+func terminate(listeners []wrapper.HandlerListener) {
+	for _, listener := range listeners {
+		if ml, ok := listener.(*metrics.Listener); ok {
+			ml.Terminate()
+		}
+	}
+}
+
+// setUp configures the logger, and returns the listeners of the wrapped handler
+func setUp(cfg *Config) []wrapper.HandlerListener {
+	env := environment.Snapshot()
+	logLevel := env.Get(LogLevelEnvVar)
 	if strings.EqualFold(logLevel, "debug") || (cfg != nil && cfg.DebugLogging) {
 		logger.SetLogLevel(logger.LevelDebug)
 	}
+	if strings.EqualFold(env.Get(LogFormatEnvVar), "json") {
+		logger.SetFormat(logger.FormatJSON)
+	}
+	logger.SetScrubber(cfg.getScrubber())
 
-	// Wrap the handler with listeners that add instrumentation for traces and metrics.
-	tl := trace.MakeListener(cfg.toTraceConfig())
-	ml := metrics.MakeListener(cfg.toMetricsConfig())
-	return wrapper.WrapHandlerWithListeners(handler, &tl, &ml)
+	listeners, err := makeListeners(cfg)
+	if err != nil {
+		if cfg != nil && cfg.FailOnInitError {
+			panic(fmt.Errorf("ddlambda initialization failed: %v", err))
+		}
+		// An observability problem mustn't become an outage, so the handler runs without instrumentation. The
+		// listeners of the caller are still notified.
+		health.Degrade(health.ReasonInitFailed, err)
+		listeners = makeExtraListeners(cfg)
+	}
+	return listeners
 }
 
-// GetTraceHeaders returns a map containing Datadog trace headers that reflect the
-// current X-Ray subsegment.
-// Deprecated: use native Datadog tracing instead.
+// makeListeners creates the listeners which add instrumentation for traces and metrics. A panic while creating
+// them is returned as an error. With FailOnInitError, it also waits for the initialization steps running in the
+// background, so that their errors fail the init too.
+func makeListeners(cfg *Config) (listeners []wrapper.HandlerListener, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("creating the listeners panicked: %v", r)
+		}
+	}()
+
+	// The metrics listener comes first, so that it finishes last and flushes the metrics sent by the other
+	// listeners.
+	tc := cfg.toTraceConfig()
+	mc := cfg.toMetricsConfig()
+	mc.TraceEnabled = tc.DDTraceEnabled
+	tl := trace.MakeListener(tc)
+	ml := makeMetricsListener(mc)
+	if cfg != nil && cfg.FailOnInitError {
+		if err := ml.WaitForInit(); err != nil {
+			return nil, err
+		}
+	}
+	listeners = []wrapper.HandlerListener{&ml, &tl}
+	if cfg != nil && cfg.RetainRawPayload {
+		// First, so that the raw payload is available to every other listener. It has nothing to do when
+		// finishing, so the metrics listener still finishes last.
+		rl := wrapper.MakeRawPayloadListener(cfg.RawPayloadMaxSize)
+		listeners = append([]wrapper.HandlerListener{&rl}, listeners...)
+	}
+	return append(listeners, makeExtraListeners(cfg)...), nil
+}
+
+// makeExtraListeners adapts the ExtraListeners of cfg to the listeners of the wrapper
+func makeExtraListeners(cfg *Config) []wrapper.HandlerListener {
+	if cfg == nil {
+		return nil
+	}
+	var listeners []wrapper.HandlerListener
+	for _, listener := range cfg.ExtraListeners {
+		listeners = append(listeners, &extraListener{listener: listener})
+	}
+	return listeners
+}
+
+func (l *extraListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	return l.listener.HandlerStarted(ctx, msg)
+}
+
+func (l *extraListener) HandlerFinished(ctx context.Context, response interface{}, err error) {
+	l.listener.HandlerFinished(ctx, err)
+}
+
+// GetTraceHeaders returns a map containing the Datadog trace headers for the current invocation,
+// for use when propagating the trace to other services by hand. The map is empty if no trace context is available.
 func GetTraceHeaders(ctx context.Context) map[string]string {
-	result := trace.ConvertCurrentXrayTraceContext(ctx)
+	result := trace.GetTraceHeaders(ctx)
 	return result
 }
 
@@ -124,10 +631,274 @@ func AddTraceHeaders(ctx context.Context, req *http.Request) {
 	}
 }
 
-// GetContext retrieves the last created lambda context.
-// Only use this if you aren't manually passing context through your call hierarchy.
+// WrapClient returns a shallow copy of the given HTTP client whose every request carries the trace headers of
+// the invocation found in the request's context. The given client isn't modified. If c is nil, a new client is
+// created.
+func WrapClient(c *http.Client) *http.Client {
+	wrapped := &http.Client{}
+	if c != nil {
+		*wrapped = *c
+	}
+	if _, ok := wrapped.Transport.(*RoundTripper); !ok {
+		wrapped.Transport = WrapRoundTripper(wrapped.Transport)
+	}
+	return wrapped
+}
+
+// WrapRoundTripper returns a RoundTripper that adds trace headers to outgoing requests before passing them on to base.
+func WrapRoundTripper(base http.RoundTripper) http.RoundTripper {
+	return &RoundTripper{Base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := rt.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if err := refuseAfterInvocation(req); err != nil {
+		return nil, err
+	}
+
+	if req.Header.Get(trace.XrayTraceHeader) != "" && trace.HeaderOwner(req.Context()) == trace.OwnerXray {
+		// The request was instrumented by the X-Ray SDK, which propagates its trace context
+		return base.RoundTrip(req)
+	}
+
+	headers := map[string]string{}
+	trace.InjectTraceHeaders(req.Context(), headers)
+	if len(headers) > 0 {
+		// A RoundTripper shouldn't modify the request it was given, so add the headers to a copy.
+		req = req.Clone(req.Context())
+		for key, value := range headers {
+			if req.Header.Get(key) == "" {
+				req.Header.Set(key, value)
+			}
+		}
+	}
+	return base.RoundTrip(req)
+}
+
+// GuardedContext returns a context for work which may outlive the invocation of ctx, such as goroutines, instead
+// of context.Background(). It keeps the values of ctx, such as its trace context, but neither its deadline nor its
+// cancellation. Once the invocation finished, the clients wrapped with WrapClient refuse the requests sent with it,
+// or with a context derived from it, with a RequestAfterInvocationError, and count them in the
+// datadog.lambda_go.request_after_invocation metric, as they would fail when the container is frozen.
+func GuardedContext(ctx context.Context) context.Context {
+	return context.WithValue(guardedContext{parent: ctx}, guardedKey, true)
+}
+
+func (guardedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (guardedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (guardedContext) Err() error {
+	return nil
+}
+
+func (c guardedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// refuseAfterInvocation returns a RequestAfterInvocationError for a request with a GuardedContext whose
+// invocation finished, and counts it with the metrics of the next invocation
+func refuseAfterInvocation(req *http.Request) error {
+	ctx := req.Context()
+	if guarded, _ := ctx.Value(guardedKey).(bool); !guarded || !wrapper.InvocationFinished(ctx) {
+		return nil
+	}
+	err := &RequestAfterInvocationError{Method: req.Method, Host: req.URL.Host}
+	logger.Warn(err.Error())
+	if listener := metrics.GetListener(ctx); listener != nil {
+		listener.AddDistributionMetric(requestAfterInvocationMetric, 1, listener.Now(), false, "host:"+req.URL.Host)
+	}
+	return err
+}
+
+func (e *RequestAfterInvocationError) Error() string {
+	return fmt.Sprintf("refused the %s request to %s, as it was sent after its invocation finished", e.Method, e.Host)
+}
+
+// TraceID returns the Datadog trace id of the current invocation, or an empty string if no trace context is available.
+func TraceID(ctx context.Context) string {
+	return trace.GetTraceHeaders(ctx)[trace.TraceIDHeader]
+}
+
+// SpanID returns the id of the current span, which is also the parent id sent to downstream services.
+// It returns an empty string if no trace context is available.
+func SpanID(ctx context.Context) string {
+	return trace.GetTraceHeaders(ctx)[trace.ParentIDHeader]
+}
+
+// LogFields returns the fields used to correlate logs with the trace of the current invocation: dd.trace_id,
+// dd.span_id, dd.service, dd.env and dd.version. Fields which aren't available are set to an empty string.
+func LogFields(ctx context.Context) map[string]string {
+	headers := trace.GetTraceHeaders(ctx)
+	env := environment.Snapshot()
+	return map[string]string{
+		"dd.trace_id": headers[trace.TraceIDHeader],
+		"dd.span_id":  headers[trace.ParentIDHeader],
+		"dd.service":  env.Get(ServiceEnvVar),
+		"dd.env":      env.Get(EnvEnvVar),
+		"dd.version":  env.Get(VersionEnvVar),
+	}
+}
+
+// SinkInfo returns where metrics are sent, and why. It's meant for checking the configuration of a function, for
+// example in smoke tests, and reports the disabled sink until the handler has been wrapped.
+func SinkInfo() MetricsSink {
+	return metrics.GetSinkInfo()
+}
+
+// HealthStatus returns whether the library is fully operational, or the degraded modes it fell back to since the
+// container started. Each degraded mode is logged once with its reason, and counted in the
+// datadog.lambda_go.degraded metric when metrics can still be sent. Smoke tests can check that Operational is
+// true after a deploy.
+func HealthStatus() Health {
+	return health.GetStatus()
+}
+
+// Stats returns the counters of the metrics handled since the container started, for example to check that
+// metrics are flowing in a canary. It returns zero counters when ctx doesn't come from a wrapped handler.
+func Stats(ctx context.Context) MetricsStats {
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		return MetricsStats{}
+	}
+	return listener.Stats()
+}
+
+// AddInvocationTags adds tags to every metric sent during the current invocation, including the enhanced
+// metrics. Tags are merged by key, the part before the first colon: the tags passed to Metric take precedence
+// over the invocation tags, which take precedence over the global tags of DD_TAGS, DD_ENV, DD_SERVICE and
+// DD_VERSION. It does nothing when ctx doesn't come from a wrapped handler.
+func AddInvocationTags(ctx context.Context, tags ...string) {
+	if listener := metrics.GetListener(ctx); listener != nil {
+		listener.AddInvocationTags(tags...)
+	}
+}
+
+// RawPayload returns the raw payload of the current invocation, before it was unmarshalled into the argument
+// of the handler. It's only available when Config.RetainRawPayload is set, and the payload isn't larger than
+// Config.RawPayloadMaxSize. The returned bytes must not be modified.
+func RawPayload(ctx context.Context) ([]byte, bool) {
+	return wrapper.GetRawPayload(ctx)
+}
+
+// EventSource returns the service which sent the event of the current invocation: "sqs", "apigateway", "sns",
+// "kinesis", "eventbridge", "s3", "dynamodb", or "unknown". It's also added to the enhanced metrics as the
+// event_source tag. It returns an empty string when ctx doesn't come from a wrapped handler.
+func EventSource(ctx context.Context) string {
+	source, _ := eventsource.FromContext(ctx)
+	return string(source)
+}
+
+// EventDetails returns the message group and deduplication ID of the first record of the current invocation,
+// when it was invoked by an SQS FIFO queue. It returns false for other events, or when ctx doesn't come from a
+// wrapped handler.
+func EventDetails(ctx context.Context) (EventAttributes, bool) {
+	return eventsource.DetailsFromContext(ctx)
+}
+
+// RemainingTime returns the time left before the deadline of the invocation, for example to decide whether to
+// start another unit of work. The time is read from the Clock of the wrapped handler ctx comes from, and from the
+// real clock for other contexts. It returns zero when ctx has no deadline, or when the deadline has passed.
+func RemainingTime(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	if listener := metrics.GetListener(ctx); listener != nil {
+		now = listener.Now()
+	}
+	if remaining := deadline.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// ContextWithReserve returns a child of ctx whose deadline is the deadline of the invocation minus reserve, for
+// example to bound the calls to downstream services so that the final flush of the metrics still has time to
+// run, and a function which cancels it, like context.WithDeadline. Call it as soon as the work bound by the
+// context is done. It returns ctx unchanged, with a no-op cancel function, when ctx has no deadline, or when
+// reserve isn't positive.
+func ContextWithReserve(ctx context.Context, reserve time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || reserve <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline.Add(-reserve))
+}
+
+// MarshalMetricsBatch marshals a batch of metrics, such as the ones received by the additional sinks, into the
+// payload sent to the Datadog API
+func MarshalMetricsBatch(batch []APIMetric) ([]byte, error) {
+	return metrics.MarshalBatch(batch)
+}
+
+// CanonicalizeMetricsBatch puts a batch of metrics in the stable order the batches sent to the Datadog API are in:
+// the tags of each metric are sorted, its points are ordered by timestamp, and the metrics are sorted. It lets tests
+// compare payloads built from batches of their own with snapshots.
+func CanonicalizeMetricsBatch(batch []APIMetric) {
+	metrics.CanonicalizeBatch(batch)
+}
+
+// MakeScrubber creates a Scrubber which replaces email addresses, card numbers, US social security numbers and
+// the matches of any additional patterns with "[redacted]".
+func MakeScrubber(additional ...*regexp.Regexp) Scrubber {
+	return scrub.MakeRegexScrubber(additional...)
+}
+
+// DisableTracingForInvocation turns off tracing for the rest of the current invocation, for example to keep
+// health check pings out of traces. The spans of the invocation are dropped rather than sent, and the trace header
+// helpers return empty values.
+func DisableTracingForInvocation(ctx context.Context) {
+	trace.DisableForInvocation(ctx)
+}
+
+// RegisterTraceExtractor adds a custom TraceExtractor, which runs before the built-in extraction of the trace
+// context from the event headers. Extractors run in the order they were registered, and the first trace context
+// found is used. A panic inside an extractor is recovered and logged. Extractors must be registered before
+// calling lambda.Start.
+func RegisterTraceExtractor(extractor TraceExtractor) {
+	trace.RegisterExtractor(trace.Extractor(extractor), false)
+}
+
+// RegisterFallbackTraceExtractor adds a custom TraceExtractor, which only runs when the built-in extraction
+// didn't find a trace context in the event headers. Extractors must be registered before calling lambda.Start.
+func RegisterFallbackTraceExtractor(extractor TraceExtractor) {
+	trace.RegisterExtractor(trace.Extractor(extractor), true)
+}
+
+// MarkInitPhase marks the end of a phase of the init of the function, named name, which started where the
+// previous phase ended, or when the library was initialized. Call it from init or main, before lambda.Start, for
+// example after loading the configuration and after connecting to a database. On the first invocation, each phase
+// is sent as the aws.lambda.enhanced.init_phase_duration distribution, in milliseconds, tagged with phase:<name>,
+// and as a span when tracing is enabled. The time from the last phase marked to the first invocation is tagged
+// phase:unmarked. Phases marked once the first invocation started are ignored, and logged at the debug level.
+func MarkInitPhase(name string) {
+	initphase.Mark(name, time.Now())
+}
+
+// ReloadEnvironment reads the environment variables again. The library reads them once, when the process starts,
+// so that every part of it sees the same values for the lifetime of a container. Tests, and functions which set
+// environment variables at runtime on purpose, call it before wrapping the handler which should see the new values.
+// Handlers wrapped before keep the configuration they were wrapped with.
+func ReloadEnvironment() {
+	environment.Reload()
+}
+
+// GetContext retrieves the context of the most recently started invocation which is still in progress.
+// Only use this if you aren't manually passing context through your call hierarchy. When handlers wrapped
+// separately run concurrently, pass their context to MetricWithContext instead.
 func GetContext() context.Context {
-	return wrapper.CurrentContext
+	return wrapper.CurrentContext()
 }
 
 // Distribution sends a distribution metric to Datadog
@@ -136,32 +907,347 @@ func Distribution(metric string, value float64, tags ...string) {
 	Metric(metric, value, tags...)
 }
 
-// Metric sends a distribution metric to DataDog
+// Metric sends a distribution metric to DataDog. Metrics sent by the init code, before the first invocation, are
+// sent with the first invocation.
 func Metric(metric string, value float64, tags ...string) {
-	MetricWithTimestamp(metric, value, time.Now(), tags...)
+	MetricE(metric, value, tags...)
+}
+
+// MetricE sends a distribution metric to DataDog like Metric, and returns an error when it won't be sent: one
+// wrapping ErrMetricsDisabled, ErrBufferFull or ErrInvalidMetric, which can be told apart with errors.Is. A nil
+// error means the metric was buffered, not that it was delivered.
+func MetricE(metric string, value float64, tags ...string) error {
+	// The current context is read once, so that the metric isn't lost when the invocation changes in between
+	ctx := GetContext()
+	if buffered, err := addPreInitMetric(ctx, metric, value, time.Now(), tags); buffered {
+		return err
+	}
+	listener := getMetricsListener(ctx)
+	if listener == nil {
+		return errNoMetricsListener
+	}
+	return listener.AddDistributionMetric(metric, value, listener.Now(), false, tags...)
 }
 
 // MetricWithTimestamp sends a distribution metric to DataDog with a custom timestamp
 func MetricWithTimestamp(metric string, value float64, timestamp time.Time, tags ...string) {
 	ctx := GetContext()
+	if buffered, _ := addPreInitMetric(ctx, metric, value, timestamp, tags); buffered {
+		return
+	}
+	if listener := getMetricsListener(ctx); listener != nil {
+		listener.AddDistributionMetric(metric, value, timestamp, false, tags...)
+	}
+}
+
+// MetricWithContext sends a distribution metric to the listener of the invocation that ctx belongs to. Unlike
+// Metric, it sends the metric to the right listener when handlers wrapped separately run concurrently.
+func MetricWithContext(ctx context.Context, metric string, value float64, tags ...string) {
+	MetricWithContextE(ctx, metric, value, tags...)
+}
+
+// MetricWithContextE sends a distribution metric to the listener of the invocation that ctx belongs to like
+// MetricWithContext, and returns an error when it won't be sent, as MetricE does
+func MetricWithContextE(ctx context.Context, metric string, value float64, tags ...string) error {
+	listener := listenerFromContext(ctx)
+	if listener == nil {
+		return errNoMetricsListener
+	}
+	return listener.AddDistributionMetric(metric, value, listener.Now(), false, tags...)
+}
+
+// BackgroundEmitter creates an emitter for metrics sent outside of the invocations, for example by a goroutine
+// started in init which polls a queue for the life of the container. It's configured like the wrapped handler, and
+// its processor runs continuously: it flushes every BatchInterval, and before the container is frozen at the end
+// of each invocation, waiting up to MaxFlushDuration. Lambda freezes the container between invocations, so no
+// metric can be sent then. The points added before the freeze which weren't flushed are sent once the container
+// is thawed. Close the emitter to stop its processor once the goroutine is done.
+func BackgroundEmitter(cfg *Config) *BackgroundMetrics {
+	return metrics.MakeBackgroundEmitter(cfg.toMetricsConfig())
+}
+
+// Namespace returns a scope which sends the metrics of the invocation that ctx belongs to with prefix before their
+// names. A dot is added between the prefix and the names, unless the prefix already ends with one.
+func Namespace(ctx context.Context, prefix string) MetricsAPI {
+	return MetricsAPI{ctx: ctx}.Namespace(prefix)
+}
+
+// Namespace returns a scope nested in this one, which adds prefix after the prefix of this scope, and keeps its
+// tags
+func (m MetricsAPI) Namespace(prefix string) MetricsAPI {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	m.prefix += prefix
+	return m
+}
+
+// WithTags returns a scope which adds tags after the base tags of this one to every metric it sends
+func (m MetricsAPI) WithTags(tags ...string) MetricsAPI {
+	// The tags are copied even when there are no base tags, as the caller may reuse their array
+	m.tags = append(append(make([]string, 0, len(m.tags)+len(tags)), m.tags...), tags...)
+	return m
+}
+
+// Distribution sends a distribution metric, with the prefix of the scope before its name, and the base tags of
+// the scope before its tags. It returns an error when the metric won't be sent, as MetricE does.
+func (m MetricsAPI) Distribution(metric string, value float64, tags ...string) error {
+	listener := m.listener()
+	if listener == nil {
+		return errNoMetricsListener
+	}
+	return listener.AddDistributionMetric(m.prefix+metric, value, listener.Now(), false, m.mergeTags(tags)...)
+}
+
+// Set counts the distinct members of a set metric, like the Set function, with the prefix and the base tags of
+// the scope. It returns an error when the member won't be sent, as MetricE does.
+func (m MetricsAPI) Set(metric string, member string, tags ...string) error {
+	listener := m.listener()
+	if listener == nil {
+		return errNoMetricsListener
+	}
+	return listener.AddSetMetric(m.prefix+metric, member, listener.Now(), m.mergeTags(tags)...)
+}
+
+// Count adds value to a count metric, like the Count function, with the prefix and the base tags of the scope. It
+// returns an error when the value won't be sent, as MetricE does.
+func (m MetricsAPI) Count(metric string, value float64, tags ...string) error {
+	listener := m.listener()
+	if listener == nil {
+		return errNoMetricsListener
+	}
+	return listener.AddCountMetric(m.prefix+metric, value, listener.Now(), m.mergeTags(tags)...)
+}
+
+// Gauge sets the value of a gauge metric, like the Gauge function, with the prefix and the base tags of the scope.
+// It returns an error when the value won't be sent, as MetricE does.
+func (m MetricsAPI) Gauge(metric string, value float64, tags ...string) error {
+	listener := m.listener()
+	if listener == nil {
+		return errNoMetricsListener
+	}
+	return listener.AddGaugeMetric(m.prefix+metric, value, listener.Now(), m.mergeTags(tags)...)
+}
+
+// listener returns the metrics listener of the invocation of the scope, or nil. The zero MetricsAPI has none.
+func (m MetricsAPI) listener() *metrics.Listener {
+	if m.ctx == nil {
+		logger.Debug("the metrics scope has no context, create it with Namespace")
+		return nil
+	}
+	return listenerFromContext(m.ctx)
+}
+
+// mergeTags returns the base tags of the scope followed by tags. It copies them, so that scopes derived from the
+// same one never share the array of their tags.
+func (m MetricsAPI) mergeTags(tags []string) []string {
+	if len(m.tags) == 0 {
+		return tags
+	}
+	merged := make([]string, 0, len(m.tags)+len(tags))
+	return append(append(merged, m.tags...), tags...)
+}
+
+// MetricValueMs creates a point from a Unix epoch in milliseconds, as found in many event payloads, to send with
+// MetricWithValue. Timestamps after the year 3000 are assumed to be epochs in milliseconds, microseconds or
+// nanoseconds passed as seconds, and converted, but MetricValueMs makes the intent clear.
+func MetricValueMs(ms int64, value float64) MetricValue {
+	return metrics.MetricValueMs(ms, value)
+}
+
+// MetricWithValue sends a point of a distribution metric to DataDog, with its own timestamp
+func MetricWithValue(metric string, point MetricValue, tags ...string) {
+	MetricWithTimestamp(metric, point.Value, point.Timestamp, tags...)
+}
+
+// MetricWithSampleRate sends a point of a distribution metric with a probability of rate, for hot code paths
+// where sending every point would be too costly. The rate must be in (0, 1], other rates are rejected and the
+// metric is dropped. The points kept are sent with their rate, so that the Datadog Extension can correct the
+// estimates of the distribution.
+func MetricWithSampleRate(metric string, value float64, rate float64, tags ...string) {
+	if listener := getMetricsListener(GetContext()); listener != nil {
+		listener.AddSampledDistributionMetric(metric, value, rate, listener.Now(), tags...)
+	}
+}
+
+// Set counts the distinct members of a set metric, such as the IDs of the users served, and sends their number
+// as a gauge every flush interval. Sets can't be sent via the log forwarder.
+func Set(metric string, member string, tags ...string) {
+	if listener := getMetricsListener(GetContext()); listener != nil {
+		listener.AddSetMetric(metric, member, listener.Now(), tags...)
+	}
+}
+
+// Rate adds count to a rate metric, such as the number of requests served, which is sent as a rate per second.
+// The counts are summed until the metrics are flushed, and divided by the time which actually elapsed since the
+// previous flush, including for the first flush of an invocation and for early flushes. With the Datadog
+// Extension, the count is rounded to an integer.
+func Rate(metric string, count float64, tags ...string) {
+	if listener := getMetricsListener(GetContext()); listener != nil {
+		listener.AddRateMetric(metric, count, listener.Now(), tags...)
+	}
+}
+
+// Count adds value to a count metric, such as the number of orders placed. The values sent with the same name and
+// tags within a bucket of Config.AggregationBucket are summed, and sent as a single point. With the Datadog
+// Extension, the value is rounded to an integer. Counts can't be sent via the log forwarder.
+func Count(metric string, value float64, tags ...string) {
+	if listener := getMetricsListener(GetContext()); listener != nil {
+		listener.AddCountMetric(metric, value, listener.Now(), tags...)
+	}
+}
 
+// Gauge sets the value of a gauge metric, such as the depth of a queue. The last value sent with the same name and
+// tags within a bucket of Config.AggregationBucket is sent as a single point. Gauges can't be sent via the log
+// forwarder.
+func Gauge(metric string, value float64, tags ...string) {
+	if listener := getMetricsListener(GetContext()); listener != nil {
+		listener.AddGaugeMetric(metric, value, listener.Now(), tags...)
+	}
+}
+
+// RecordMetrics sends a point of a distribution metric for each record of event, which must be an SQSEvent,
+// KinesisEvent, DynamoDBEvent or SNSEvent of github.com/aws/aws-lambda-go/events, or a pointer to one. valueFn
+// returns the value of a record, and tagFn, which may be nil, its tags. They're passed the record as an
+// events.SQSMessage, events.KinesisEventRecord, events.DynamoDBEventRecord or events.SNSEventRecord. The points of
+// the records with the same tags are sent together, so that their tags are merged and normalized once. An error is
+// returned for other types of events, and when the points won't be sent, as MetricE does.
+func RecordMetrics(ctx context.Context, event interface{}, name string, valueFn func(record interface{}) float64, tagFn func(record interface{}) []string) error {
+	records, err := eventRecords(event)
+	if err != nil {
+		return err
+	}
+	listener := listenerFromContext(ctx)
+	if listener == nil {
+		return errNoMetricsListener
+	}
+
+	type recordGroup struct {
+		tags   []string
+		values []float64
+	}
+	var groups []*recordGroup
+	byTags := map[string]*recordGroup{}
+	for _, record := range records {
+		var tags []string
+		if tagFn != nil {
+			tags = tagFn(record)
+		}
+		// The key tells apart tags which would be joined the same, such as "a,b" and "a", "b"
+		key := fmt.Sprintf("%q", tags)
+		group, ok := byTags[key]
+		if !ok {
+			group = &recordGroup{tags: tags}
+			byTags[key] = group
+			groups = append(groups, group)
+		}
+		group.values = append(group.values, valueFn(record))
+	}
+
+	now := listener.Now()
+	for _, group := range groups {
+		if err := listener.AddDistributionMetrics(name, group.values, now, group.tags...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventRecords returns the records of the events supported by RecordMetrics. Nil events have no records.
+func eventRecords(event interface{}) ([]interface{}, error) {
+	var records []interface{}
+	switch ev := event.(type) {
+	case events.SQSEvent:
+		for _, record := range ev.Records {
+			records = append(records, record)
+		}
+	case events.KinesisEvent:
+		for _, record := range ev.Records {
+			records = append(records, record)
+		}
+	case events.DynamoDBEvent:
+		for _, record := range ev.Records {
+			records = append(records, record)
+		}
+	case events.SNSEvent:
+		for _, record := range ev.Records {
+			records = append(records, record)
+		}
+	case *events.SQSEvent:
+		if ev != nil {
+			return eventRecords(*ev)
+		}
+	case *events.KinesisEvent:
+		if ev != nil {
+			return eventRecords(*ev)
+		}
+	case *events.DynamoDBEvent:
+		if ev != nil {
+			return eventRecords(*ev)
+		}
+	case *events.SNSEvent:
+		if ev != nil {
+			return eventRecords(*ev)
+		}
+	default:
+		return nil, fmt.Errorf("ddlambda: RecordMetrics doesn't support events of type %T", event)
+	}
+	return records, nil
+}
+
+// addPreInitMetric buffers a metric sent before the first invocation, as there's no listener to send it to
+// yet. It returns false when the metric should be sent to the listener of ctx, the current context, and an error
+// when the metric was dropped.
+func addPreInitMetric(ctx context.Context, metric string, value float64, timestamp time.Time, tags []string) (bool, error) {
+	if ctx != nil {
+		return false, nil
+	}
+	if atomic.LoadInt32(&wrapCount) == 0 {
+		preInitCheckOnce.Do(func() {
+			time.AfterFunc(maxInitDuration, checkWrappedAfterInit)
+		})
+	}
+	return metrics.AddPreInitMetric(metric, value, timestamp, tags...)
+}
+
+// checkWrappedAfterInit warns when metrics were sent during the init, but no handler was wrapped by the end of
+// the longest init, as the metrics then wait for an invocation which will never come
+func checkWrappedAfterInit() {
+	if atomic.LoadInt32(&wrapCount) == 0 {
+		health.Warn(health.ReasonMetricWithoutWrapper, fmt.Sprintf("metrics were sent, but no handler was wrapped %s later. They're only sent by the invocations of a handler wrapped with ddlambda.WrapHandler, pass it to lambda.Start.", maxInitDuration))
+	}
+}
+
+// getMetricsListener returns the metrics listener of ctx, the current context, or nil if there isn't one
+func getMetricsListener(ctx context.Context) *metrics.Listener {
 	if ctx == nil {
 		logger.Debug("no context available, did you wrap your handler?")
-		return
+		return nil
 	}
+	return listenerFromContext(ctx)
+}
 
+// listenerFromContext returns the metrics listener of the invocation that ctx belongs to, or nil
+func listenerFromContext(ctx context.Context) *metrics.Listener {
 	listener := metrics.GetListener(ctx)
 
 	if listener == nil {
-		logger.Error(fmt.Errorf("couldn't get metrics listener from current context"))
-		return
+		logger.Debug("couldn't get metrics listener from current context")
+		health.Warn(health.ReasonMetricWithoutWrapper, "metrics were sent with a context which doesn't come from a wrapped handler, so they were dropped. Wrap the handler with ddlambda.WrapHandler, and send the metrics with the context it passes to the handler.")
+		return nil
 	}
-	listener.AddDistributionMetric(metric, value, timestamp, false, tags...)
+	return listener
 }
 
 // InvokeDryRun is a utility to easily run your lambda for testing
 func InvokeDryRun(callback func(ctx context.Context), cfg *Config) (interface{}, error) {
-	wrapped := WrapHandler(callback, cfg)
+	dryRunCfg := &Config{}
+	if cfg != nil {
+		*dryRunCfg = *cfg
+	}
+	dryRunCfg.dryRun = true
+	// Each dry run wraps its callback, which isn't counted as wrapping the handler twice
+	wrapped := wrapper.WrapHandlerWithListeners(callback, setUp(dryRunCfg)...)
 	// Convert the wrapped handler to it's underlying raw handler type
 	handler, ok := wrapped.(func(ctx context.Context, msg json.RawMessage) (interface{}, error))
 	if !ok {
@@ -170,8 +1256,23 @@ func InvokeDryRun(callback func(ctx context.Context), cfg *Config) (interface{},
 	return handler(context.Background(), json.RawMessage("{}"))
 }
 
+// getScrubber returns the configured Scrubber, or nil when scrubbing is disabled.
+func (cfg *Config) getScrubber() Scrubber {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Scrubber != nil {
+		return cfg.Scrubber
+	}
+	if len(cfg.ScrubPatterns) > 0 {
+		return MakeScrubber(cfg.ScrubPatterns...)
+	}
+	return nil
+}
+
 func (cfg *Config) toTraceConfig() trace.Config {
 
+	env := environment.Snapshot()
 	traceConfig := trace.Config{
 		DDTraceEnabled:  false,
 		MergeXrayTraces: false,
@@ -181,18 +1282,109 @@ func (cfg *Config) toTraceConfig() trace.Config {
 		traceConfig.DDTraceEnabled = cfg.DDTraceEnabled
 		traceConfig.MergeXrayTraces = cfg.MergeXrayTraces
 	}
+	traceConfig.Scrubber = cfg.getScrubber()
+	if extension.IsInstalled() {
+		traceConfig.Extension = extension.MakeClient(extension.DefaultURL)
+	}
 
+	// Tracing is only turned off for the invocations when it's disabled explicitly. When DD_TRACE_ENABLED isn't set,
+	// the trace header helpers still return the trace context converted from X-Ray.
 	if !traceConfig.DDTraceEnabled {
-		traceConfig.DDTraceEnabled, _ = strconv.ParseBool(os.Getenv(DatadogTraceEnabledEnvVar))
+		if traceEnabled, err := strconv.ParseBool(env.Get(DatadogTraceEnabledEnvVar)); err == nil {
+			traceConfig.DDTraceEnabled = traceEnabled
+			traceConfig.TracingDisabled = !traceEnabled
+		}
+	}
+
+	if cfg != nil && cfg.TraceEnabled != nil {
+		traceConfig.DDTraceEnabled = *cfg.TraceEnabled
+		traceConfig.TracingDisabled = !*cfg.TraceEnabled
 	}
 
 	if !traceConfig.MergeXrayTraces {
-		traceConfig.MergeXrayTraces, _ = strconv.ParseBool(os.Getenv(MergeXrayTracesEnvVar))
+		traceConfig.MergeXrayTraces = env.Bool(MergeXrayTracesEnvVar)
+	}
+
+	traceConfig.TraceManagedServices = DefaultTraceManagedServices
+	if traceManagedServices, err := strconv.ParseBool(env.Get(TraceManagedServicesEnvVar)); err == nil {
+		traceConfig.TraceManagedServices = traceManagedServices
+	}
+
+	traceConfig.PropagationStyleExtract = getPropagationStylesFromEnv(env, PropagationStyleExtractEnvVar)
+	traceConfig.PropagationStyleInject = getPropagationStylesFromEnv(env, PropagationStyleInjectEnvVar)
+
+	traceConfig.SampleRate = DefaultTraceSampleRate
+	if value := env.Get(TraceSampleRateEnvVar); value != "" {
+		sampleRate, err := strconv.ParseFloat(value, 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			logger.Warn(fmt.Sprintf("%s must be a number between 0 and 1, got %q, using %v", TraceSampleRateEnvVar, value, DefaultTraceSampleRate))
+		} else {
+			traceConfig.SampleRate = sampleRate
+		}
+	}
+
+	traceConfig.TraceID128BitGeneration = env.Bool(TraceID128BitGenerationEnvVar)
+
+	traceConfig.CapturePayload = env.Bool(CaptureLambdaPayloadEnvVar)
+	if value := env.Get(CaptureLambdaPayloadMaxDepthEnvVar); value != "" {
+		maxDepth, err := strconv.Atoi(value)
+		if err != nil || maxDepth <= 0 {
+			logger.Warn(fmt.Sprintf("%s must be a positive integer, got %q, using %d", CaptureLambdaPayloadMaxDepthEnvVar, value, trace.DefaultCapturePayloadMaxDepth))
+		} else {
+			traceConfig.CapturePayloadMaxDepth = maxDepth
+		}
+	}
+	if value := env.Get(CaptureLambdaPayloadObfuscationRegexEnvVar); value != "" {
+		obfuscation, err := regexp.Compile(value)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("%s isn't a valid regular expression, using the default: %v", CaptureLambdaPayloadObfuscationRegexEnvVar, err))
+		} else {
+			traceConfig.CapturePayloadObfuscation = obfuscation
+		}
 	}
 
 	return traceConfig
 }
 
+// getGlobalTags returns the tags added to every metric: the unified service tags set by DD_ENV, DD_SERVICE and
+// DD_VERSION, which take precedence over the tags of DD_TAGS with the same keys.
+func getGlobalTags() []string {
+	env := environment.Snapshot()
+	var unified []string
+	for _, tag := range []struct{ key, envVar string }{{"env", EnvEnvVar}, {"service", ServiceEnvVar}, {"version", VersionEnvVar}} {
+		if value := env.Get(tag.envVar); value != "" {
+			unified = append(unified, fmt.Sprintf("%s:%s", tag.key, value))
+		}
+	}
+	tags := strings.FieldsFunc(env.Get(TagsEnvVar), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	return metrics.MergeTags(unified, tags)
+}
+
+// getPropagationStylesFromEnv reads a list of propagation styles from the given environment variable,
+// falling back to DD_TRACE_PROPAGATION_STYLE and then to the default styles.
+func getPropagationStylesFromEnv(env *environment.Env, envVar string) []trace.PropagationStyle {
+	value := env.Get(envVar)
+	if value == "" {
+		envVar = PropagationStyleEnvVar
+		value = env.Get(envVar)
+	}
+	if value == "" {
+		return trace.DefaultPropagationStyles
+	}
+
+	styles, unknown := trace.ParsePropagationStyles(value)
+	for _, name := range unknown {
+		logger.Warn(fmt.Sprintf("ignoring unknown propagation style %q in %s", name, envVar))
+	}
+	if styles == nil {
+		logger.Warn(fmt.Sprintf("no valid propagation style in %s, using defaults", envVar))
+		return trace.DefaultPropagationStyles
+	}
+	return styles
+}
+
 func (cfg *Config) toMetricsConfig() metrics.Config {
 
 	mc := metrics.Config{
@@ -201,16 +1393,59 @@ func (cfg *Config) toMetricsConfig() metrics.Config {
 
 	if cfg != nil {
 		mc.BatchInterval = cfg.BatchInterval
+		mc.SyncFlushOnly = cfg.SyncFlushOnly
+		mc.DisableFlushJitter = cfg.DisableFlushJitter
 		mc.ShouldRetryOnFailure = cfg.ShouldRetryOnFailure
 		mc.APIKey = cfg.APIKey
 		mc.KMSAPIKey = cfg.KMSAPIKey
 		mc.Site = cfg.Site
 		mc.ShouldUseLogForwarder = cfg.ShouldUseLogForwarder
 		mc.HttpClientTimeout = cfg.HttpClientTimeout
+		mc.DebugPayloads = cfg.DebugPayloads
+		mc.AdditionalSinks = cfg.AdditionalSinks
+		mc.SetMaxMembers = cfg.SetMaxMembers
+		mc.DisableTagNormalization = cfg.DisableTagNormalization
+		mc.PrewarmConnection = cfg.PrewarmConnection
+		mc.LegacyQueryAuth = cfg.LegacyQueryAuth
+		mc.IntakeVersion = cfg.IntakeVersion
+		mc.FlushConcurrency = cfg.FlushConcurrency
+		mc.RuntimeTags = cfg.RuntimeTags
+		mc.MemoryPressure = cfg.MemoryPressure
+		mc.MemoryPressureThreshold = cfg.MemoryPressureThreshold
+		mc.ShardedBuffers = cfg.ShardedBuffers
+		mc.AdaptiveFlush = cfg.AdaptiveFlush
+		mc.FlushAtPointCount = cfg.FlushAtPointCount
+		mc.AggregationBucket = cfg.AggregationBucket
+		mc.MaxFutureSkew = cfg.MaxFutureSkew
+		mc.RejectMissingTimestamps = cfg.RejectMissingTimestamps
+		mc.MaxFlushDuration = cfg.MaxFlushDuration
+		mc.MaxRetriesPerInvocation = cfg.MaxRetriesPerInvocation
+		mc.MaxRetryTimePerInvocation = cfg.MaxRetryTimePerInvocation
+		mc.MessageGroupTag = cfg.MessageGroupTag
+		mc.AuthorizerTagKeys = cfg.AuthorizerTagKeys
+		mc.SpillFailedBatches = cfg.SpillFailedBatches
+		mc.SpoolMaxSize = cfg.SpoolMaxSize
+		mc.FetchResourceTags = cfg.FetchResourceTags
+		mc.ResourceTagKeys = cfg.ResourceTagKeys
+		mc.LogTopEmitters = cfg.LogTopEmitters
+		mc.Decrypter = cfg.decrypter
+		mc.TagFetcher = cfg.tagFetcher
+		mc.TimeService = cfg.Clock
+		mc.Client = cfg.MetricsClient
 	}
+	mc.AsyncFlushWithExtension = cfg == nil || cfg.AsyncFlushWithExtension == nil || *cfg.AsyncFlushWithExtension
+	mc.Scrubber = cfg.getScrubber()
+	env := environment.Snapshot()
+	mc.DumpPayloads = env.Bool(DumpPayloadsEnvVar)
+	mc.Telemetry = env.Bool(TelemetryEnabledEnvVar)
+	mc.StartupMetric = cfg == nil || !cfg.dryRun
+	if startupMetric, err := strconv.ParseBool(env.Get(StartupMetricEnabledEnvVar)); err == nil && !startupMetric {
+		mc.StartupMetric = false
+	}
+	mc.GlobalTags = getGlobalTags()
 
 	if mc.Site == "" {
-		mc.Site = os.Getenv(DatadogSiteEnvVar)
+		mc.Site = env.Get(DatadogSiteEnvVar)
 	}
 	if mc.Site == "" {
 		mc.Site = DefaultSite
@@ -222,27 +1457,29 @@ func (cfg *Config) toMetricsConfig() metrics.Config {
 	}
 
 	if !mc.ShouldUseLogForwarder {
-		shouldUseLogForwarder := os.Getenv(ShouldUseLogForwarderEnvVar)
+		shouldUseLogForwarder := env.Get(ShouldUseLogForwarderEnvVar)
 		mc.ShouldUseLogForwarder = strings.EqualFold(shouldUseLogForwarder, "true")
 	}
 
-	if mc.APIKey == "" {
-		mc.APIKey = os.Getenv(DatadogAPIKeyEnvVar)
-
-	}
-	if mc.KMSAPIKey == "" {
-		mc.KMSAPIKey = os.Getenv(DatadogKMSAPIKeyEnvVar)
-	}
-	if mc.APIKey == "" && mc.KMSAPIKey == "" && !mc.ShouldUseLogForwarder {
-		logger.Error(fmt.Errorf("couldn't read DD_API_KEY or DD_KMS_API_KEY from environment"))
+	// A custom metrics client doesn't need an API key
+	if mc.Client == nil {
+		if mc.APIKey == "" {
+			mc.APIKey = env.Get(DatadogAPIKeyEnvVar)
+		}
+		if mc.KMSAPIKey == "" {
+			mc.KMSAPIKey = env.Get(DatadogKMSAPIKeyEnvVar)
+		}
+		if mc.APIKey == "" && mc.KMSAPIKey == "" && !mc.ShouldUseLogForwarder {
+			logger.Error(fmt.Errorf("couldn't read DD_API_KEY or DD_KMS_API_KEY from environment"))
+		}
 	}
 
-	enhancedMetrics := os.Getenv("DD_ENHANCED_METRICS")
-	if enhancedMetrics == "" {
-		mc.EnhancedMetrics = DefaultEnhancedMetrics
+	mc.EnhancedMetrics = DefaultEnhancedMetrics
+	if enhancedMetrics, err := strconv.ParseBool(env.Get(EnhancedMetricsEnvVar)); err == nil {
+		mc.EnhancedMetrics = enhancedMetrics
 	}
-	if !mc.EnhancedMetrics {
-		mc.EnhancedMetrics = strings.EqualFold(enhancedMetrics, "true")
+	if cfg != nil && cfg.EnhancedMetrics != nil {
+		mc.EnhancedMetrics = *cfg.EnhancedMetrics
 	}
 
 	return mc
@@ -8,14 +8,56 @@
 package ddlambda
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-lambda-go/ddlambdatest"
+	"github.com/DataDog/datadog-lambda-go/internal/health"
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+	"github.com/DataDog/datadog-lambda-go/internal/trace"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+// TestMetricBeforeWrapping must run before the other tests invoke a handler, as only the metrics sent before the
+// first invocation are buffered
+func TestMetricBeforeWrapping(t *testing.T) {
+	initTime := time.Now().Add(-time.Minute)
+	MetricWithTimestamp("init.config_load", 42, initTime, "phase:init")
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {}, &Config{APIKey: "abc-123", Site: server.URL})
+
+	assert.Contains(t, string(body), `"metric":"init.config_load"`)
+	assert.Contains(t, string(body), fmt.Sprintf(`"points":[[%d,[42]]]`, initTime.Unix()))
+}
+
 func TestInvokeDryRun(t *testing.T) {
 	called := false
 	InvokeDryRun(func(ctx context.Context) {
@@ -46,3 +88,1572 @@ func TestMetricsSubmitWithWrapper(t *testing.T) {
 	})
 	assert.True(t, called)
 }
+
+func TestMetricFromGoroutinesAcrossInvocations(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// The goroutines keep sending metrics while the invocations start and finish, which is checked by the race
+	// detector
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					Metric("background.metric", 1, "source:goroutine")
+				}
+			}
+		}()
+	}
+
+	wrapped := WrapHandler(func(ctx context.Context) {
+		Metric("handler.metric", 1)
+		time.Sleep(10 * time.Millisecond)
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+	handler := wrapped.(func(ctx context.Context, msg json.RawMessage) (interface{}, error))
+	for i := 0; i < 2; i++ {
+		_, err := handler(context.Background(), json.RawMessage("{}"))
+		assert.NoError(t, err)
+	}
+	close(stop)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	handled := 0
+	for _, body := range bodies {
+		if strings.Contains(body, `"metric":"handler.metric"`) {
+			handled++
+		}
+	}
+	assert.Equal(t, 2, handled)
+}
+
+func TestBackgroundEmitter(t *testing.T) {
+	background := &ddlambdatest.BatchClient{}
+	emitter := BackgroundEmitter(&Config{MetricsClient: background})
+	defer emitter.Close()
+
+	wrapped := WrapHandler(func(ctx context.Context) {
+		assert.NoError(t, emitter.Distribution("queue.depth", 42, "queue:orders"))
+	}, &Config{MetricsClient: &ddlambdatest.BatchClient{}})
+	handler := wrapped.(func(ctx context.Context, msg json.RawMessage) (interface{}, error))
+	_, err := handler(context.Background(), json.RawMessage("{}"))
+	assert.NoError(t, err)
+
+	// The background metrics were flushed before the invocation ended, to their own client
+	batches := background.Batches()
+	if assert.Len(t, batches, 1) {
+		assert.Equal(t, "queue.depth", batches[0][0].Name)
+		assert.Contains(t, batches[0][0].Tags, "queue:orders")
+	}
+
+	emitter.Close()
+	assert.True(t, errors.Is(emitter.Distribution("queue.depth", 43), ErrMetricsDisabled))
+}
+
+func TestMetricWithSampleRate(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {
+		MetricWithSampleRate("hot-metric", 1, 2, "my:tag")
+		MetricWithSampleRate("sampled-metric", 1, 1, "my:tag")
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+
+	assert.Contains(t, string(body), `"metric":"sampled-metric"`)
+	assert.NotContains(t, string(body), "hot-metric")
+}
+
+func TestRate(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {
+		Rate("requests", 1, "route:/orders")
+		Rate("requests", 2, "route:/orders")
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+
+	// The invocation lasted less than a second, which the counts are divided by
+	assert.Contains(t, strings.Join(bodies, "\n"), `"type":"rate","interval":1,"points":[[`)
+	assert.Contains(t, strings.Join(bodies, "\n"), `,3]]`)
+}
+
+func TestCountAndGauge(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	handler := rec.WrapHandler(func(ctx context.Context) {
+		for i := 0; i < 1000; i++ {
+			Count("orders.placed", 1, "env:prod")
+		}
+		Gauge("queue.depth", 3)
+		Gauge("queue.depth", 7)
+	}).(func(context.Context, json.RawMessage) (interface{}, error))
+	_, err := handler(context.Background(), json.RawMessage("{}"))
+	assert.NoError(t, err)
+
+	// A single point is sent for each bucket
+	placed := rec.Distributions("orders.placed")
+	if assert.Len(t, placed, 1) {
+		assert.Equal(t, []float64{1000}, placed[0].Values())
+		assert.True(t, placed[0].HasTags("env:prod"))
+	}
+	depth := rec.Distributions("queue.depth")
+	if assert.Len(t, depth, 1) {
+		assert.Equal(t, []float64{7}, depth[0].Values())
+	}
+}
+
+func TestMetricWithValueMs(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {
+		MetricWithValue("order.placed", MetricValueMs(1709296215250, 1))
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+
+	assert.Contains(t, string(body), `"points":[[1709296215,[1]]]`)
+}
+
+func TestPropagationStylesDefault(t *testing.T) {
+	traceConfig := (&Config{}).toTraceConfig()
+	assert.Equal(t, trace.DefaultPropagationStyles, traceConfig.PropagationStyleExtract)
+	assert.Equal(t, trace.DefaultPropagationStyles, traceConfig.PropagationStyleInject)
+}
+
+func TestPropagationStylesFromGeneralEnvVar(t *testing.T) {
+	setEnv(PropagationStyleEnvVar, "tracecontext,datadog")
+	defer unsetEnv(PropagationStyleEnvVar)
+
+	traceConfig := (&Config{}).toTraceConfig()
+	expected := []trace.PropagationStyle{trace.PropagationStyleTraceContext, trace.PropagationStyleDatadog}
+	assert.Equal(t, expected, traceConfig.PropagationStyleExtract)
+	assert.Equal(t, expected, traceConfig.PropagationStyleInject)
+}
+
+func TestPropagationStylesSpecificEnvVarsTakePrecedence(t *testing.T) {
+	setEnv(PropagationStyleEnvVar, "datadog")
+	setEnv(PropagationStyleExtractEnvVar, "b3multi,tracecontext")
+	setEnv(PropagationStyleInjectEnvVar, "none")
+	defer unsetEnv(PropagationStyleEnvVar)
+	defer unsetEnv(PropagationStyleExtractEnvVar)
+	defer unsetEnv(PropagationStyleInjectEnvVar)
+
+	traceConfig := (&Config{}).toTraceConfig()
+	assert.Equal(t, []trace.PropagationStyle{trace.PropagationStyleB3Multi, trace.PropagationStyleTraceContext}, traceConfig.PropagationStyleExtract)
+	assert.Equal(t, []trace.PropagationStyle{}, traceConfig.PropagationStyleInject)
+}
+
+func TestPropagationStylesUnknownFallsBackToDefault(t *testing.T) {
+	setEnv(PropagationStyleEnvVar, "jaeger")
+	defer unsetEnv(PropagationStyleEnvVar)
+
+	traceConfig := (&Config{}).toTraceConfig()
+	assert.Equal(t, trace.DefaultPropagationStyles, traceConfig.PropagationStyleExtract)
+}
+
+func TestTraceSampleRate(t *testing.T) {
+	defer unsetEnv(TraceSampleRateEnvVar)
+
+	assert.Equal(t, DefaultTraceSampleRate, (&Config{}).toTraceConfig().SampleRate)
+
+	setEnv(TraceSampleRateEnvVar, "0.25")
+	assert.Equal(t, 0.25, (&Config{}).toTraceConfig().SampleRate)
+
+	setEnv(TraceSampleRateEnvVar, "1.5")
+	assert.Equal(t, DefaultTraceSampleRate, (&Config{}).toTraceConfig().SampleRate)
+
+	setEnv(TraceSampleRateEnvVar, "half")
+	assert.Equal(t, DefaultTraceSampleRate, (&Config{}).toTraceConfig().SampleRate)
+}
+
+func TestTraceEnabledTakesPrecedence(t *testing.T) {
+	setEnv(DatadogTraceEnabledEnvVar, "true")
+	defer unsetEnv(DatadogTraceEnabledEnvVar)
+
+	disabled, enabled := false, true
+	assert.True(t, (&Config{}).toTraceConfig().DDTraceEnabled)
+	assert.False(t, (&Config{TraceEnabled: &disabled}).toTraceConfig().DDTraceEnabled)
+	assert.True(t, (&Config{TraceEnabled: &disabled}).toTraceConfig().TracingDisabled)
+
+	unsetEnv(DatadogTraceEnabledEnvVar)
+	assert.True(t, (&Config{TraceEnabled: &enabled}).toTraceConfig().DDTraceEnabled)
+
+	setEnv(DatadogTraceEnabledEnvVar, "false")
+	assert.True(t, (&Config{}).toTraceConfig().TracingDisabled)
+	assert.False(t, (&Config{TraceEnabled: &enabled}).toTraceConfig().TracingDisabled)
+}
+
+func TestTracingIsOnlyDisabledExplicitly(t *testing.T) {
+	unsetEnv(DatadogTraceEnabledEnvVar)
+
+	// By default the tracer isn't started, but the trace headers are still converted from X-Ray
+	traceConfig := (&Config{}).toTraceConfig()
+	assert.False(t, traceConfig.DDTraceEnabled)
+	assert.False(t, traceConfig.TracingDisabled)
+}
+
+func TestCapturePayloadConfig(t *testing.T) {
+	defer unsetEnv(CaptureLambdaPayloadEnvVar)
+	defer unsetEnv(CaptureLambdaPayloadMaxDepthEnvVar)
+	defer unsetEnv(CaptureLambdaPayloadObfuscationRegexEnvVar)
+
+	traceConfig := (&Config{}).toTraceConfig()
+	assert.False(t, traceConfig.CapturePayload)
+
+	setEnv(CaptureLambdaPayloadEnvVar, "true")
+	setEnv(CaptureLambdaPayloadMaxDepthEnvVar, "3")
+	setEnv(CaptureLambdaPayloadObfuscationRegexEnvVar, "(?i)secret")
+	traceConfig = (&Config{}).toTraceConfig()
+	assert.True(t, traceConfig.CapturePayload)
+	assert.Equal(t, 3, traceConfig.CapturePayloadMaxDepth)
+	assert.Equal(t, "(?i)secret", traceConfig.CapturePayloadObfuscation.String())
+
+	setEnv(CaptureLambdaPayloadMaxDepthEnvVar, "deep")
+	setEnv(CaptureLambdaPayloadObfuscationRegexEnvVar, "(unclosed")
+	traceConfig = (&Config{}).toTraceConfig()
+	assert.Equal(t, 0, traceConfig.CapturePayloadMaxDepth)
+	assert.Nil(t, traceConfig.CapturePayloadObfuscation)
+}
+
+func TestGetTraceHeadersWithoutTraceContext(t *testing.T) {
+	InvokeDryRun(func(ctx context.Context) {
+		assert.Equal(t, map[string]string{}, GetTraceHeaders(ctx))
+	}, nil)
+}
+
+func TestWrapClientInjectsTraceHeaders(t *testing.T) {
+	var receivedHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req = req.WithContext(ctx)
+	_, err := WrapClient(&http.Client{}).Do(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatUint(span.Context().TraceID(), 10), receivedHeaders.Get("x-datadog-trace-id"))
+	assert.Equal(t, strconv.FormatUint(span.Context().SpanID(), 10), receivedHeaders.Get("x-datadog-parent-id"))
+	assert.NotEmpty(t, receivedHeaders.Get("traceparent"))
+	// The original request shouldn't be modified
+	assert.Empty(t, req.Header.Get("x-datadog-trace-id"))
+}
+
+func TestWrapClientDoesNotOverwriteHeaders(t *testing.T) {
+	var receivedHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req = req.WithContext(ctx)
+	req.Header.Set("x-datadog-trace-id", "1234")
+	_, err := WrapClient(nil).Do(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", receivedHeaders.Get("x-datadog-trace-id"))
+	assert.Equal(t, strconv.FormatUint(span.Context().SpanID(), 10), receivedHeaders.Get("x-datadog-parent-id"))
+}
+
+func TestWrapClientWithoutTraceContext(t *testing.T) {
+	var receivedHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	original := &http.Client{Timeout: time.Minute}
+	client := WrapClient(original)
+	assert.Same(t, client.Transport, WrapClient(client).Transport)
+	// The given client is copied, not modified
+	assert.Nil(t, original.Transport)
+	assert.Equal(t, time.Minute, client.Timeout)
+
+	_, err := client.Get(server.URL)
+
+	assert.NoError(t, err)
+	assert.Empty(t, receivedHeaders.Get("x-datadog-trace-id"))
+	assert.Empty(t, receivedHeaders.Get("traceparent"))
+}
+
+func TestWrapClientLeavesXrayRequestsToXray(t *testing.T) {
+	var receivedHeaders []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = append(receivedHeaders, r.Header)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	setEnv("AWS_XRAY_CONTEXT_MISSING", "LOG_ERROR")
+	defer unsetEnv("AWS_XRAY_CONTEXT_MISSING")
+
+	for _, merge := range []bool{false, true} {
+		receivedHeaders = nil
+		InvokeDryRun(func(ctx context.Context) {
+			client := WrapClient(nil)
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			req.Header.Set("X-Amzn-Trace-Id", "Root=1-5e272390-8c398be037738dc042009320;Parent=94ae789b969f1cc5;Sampled=1")
+			client.Do(req)
+			req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			client.Do(req)
+		}, &Config{APIKey: "abc-123", DDTraceEnabled: true, MergeXrayTraces: merge})
+
+		assert.Len(t, receivedHeaders, 2)
+		// Without merging, the request instrumented by X-Ray only carries the X-Ray header
+		assert.Equal(t, merge, receivedHeaders[0].Get("x-datadog-trace-id") != "", "merge %v", merge)
+		assert.NotEmpty(t, receivedHeaders[1].Get("x-datadog-trace-id"), "merge %v", merge)
+	}
+}
+
+func TestGuardedContextRefusesRequestsAfterInvocation(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	client := WrapClient(nil)
+	get := func(ctx context.Context) error {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	rec := ddlambdatest.NewRecorder()
+	var guarded, plain context.Context
+	handler := rec.WrapHandler(func(ctx context.Context) error {
+		guarded = GuardedContext(ctx)
+		plain = ctx
+		// Requests sent during the invocation go through
+		return get(guarded)
+	}).(func(context.Context, json.RawMessage) (interface{}, error))
+	_, err := handler(context.Background(), json.RawMessage("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	// Contexts derived from the guarded context are refused too
+	derived, cancel := context.WithTimeout(guarded, time.Minute)
+	defer cancel()
+	err = get(derived)
+	var refused *RequestAfterInvocationError
+	assert.True(t, errors.As(err, &refused))
+	assert.Equal(t, http.MethodGet, refused.Method)
+	assert.Equal(t, 1, requests)
+	// Requests without the guard aren't refused
+	assert.NoError(t, get(plain))
+	assert.Equal(t, 2, requests)
+
+	// The refused request is counted with the metrics of the next invocation
+	handler(context.Background(), json.RawMessage("{}"))
+	host := strings.TrimPrefix(server.URL, "http://")
+	assert.True(t, rec.AssertTagged(t, requestAfterInvocationMetric, "host:"+host))
+}
+
+func TestGuardedContextKeepsValuesWithoutCancellation(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	cancel()
+
+	guarded := GuardedContext(ctx)
+	assert.Equal(t, "value", guarded.Value(key{}))
+	assert.NoError(t, guarded.Err())
+	assert.Nil(t, guarded.Done())
+	_, ok := guarded.Deadline()
+	assert.False(t, ok)
+}
+
+func TestTraceIDAndSpanIDMatchTraceHeaders(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, strconv.FormatUint(span.Context().TraceID(), 10), TraceID(ctx))
+	assert.Equal(t, headers["x-datadog-trace-id"], TraceID(ctx))
+	assert.Equal(t, strconv.FormatUint(span.Context().SpanID(), 10), SpanID(ctx))
+	assert.Equal(t, headers["x-datadog-parent-id"], SpanID(ctx))
+}
+
+func TestTraceIDAndSpanIDWithoutTraceContext(t *testing.T) {
+	assert.Empty(t, TraceID(context.Background()))
+	assert.Empty(t, SpanID(context.Background()))
+}
+
+func TestLogFields(t *testing.T) {
+	setEnv(ServiceEnvVar, "checkout")
+	setEnv(EnvEnvVar, "prod")
+	setEnv(VersionEnvVar, "1.2.3")
+	defer unsetEnv(ServiceEnvVar)
+	defer unsetEnv(EnvEnvVar)
+	defer unsetEnv(VersionEnvVar)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	assert.Equal(t, map[string]string{
+		"dd.trace_id": strconv.FormatUint(span.Context().TraceID(), 10),
+		"dd.span_id":  strconv.FormatUint(span.Context().SpanID(), 10),
+		"dd.service":  "checkout",
+		"dd.env":      "prod",
+		"dd.version":  "1.2.3",
+	}, LogFields(ctx))
+}
+
+func TestGetScrubber(t *testing.T) {
+	var nilConfig *Config
+	assert.Nil(t, nilConfig.getScrubber())
+	assert.Nil(t, (&Config{}).getScrubber())
+
+	custom := MakeScrubber()
+	assert.Equal(t, custom, (&Config{Scrubber: custom}).getScrubber())
+
+	scrubber := (&Config{ScrubPatterns: []*regexp.Regexp{regexp.MustCompile(`cust-\d+`)}}).getScrubber()
+	assert.NotNil(t, scrubber)
+	assert.Equal(t, "order for [redacted] by [redacted]", scrubber.Scrub("order for cust-42 by bob@example.com"))
+	assert.NotNil(t, (&Config{ScrubPatterns: []*regexp.Regexp{regexp.MustCompile(`x`)}}).toMetricsConfig().Scrubber)
+}
+
+func TestDebugPayloadsConfig(t *testing.T) {
+	defer unsetEnv(DumpPayloadsEnvVar)
+
+	mc := (&Config{DebugPayloads: true}).toMetricsConfig()
+	assert.True(t, mc.DebugPayloads)
+	assert.False(t, mc.DumpPayloads)
+
+	setEnv(DumpPayloadsEnvVar, "true")
+	assert.True(t, (&Config{}).toMetricsConfig().DumpPayloads)
+}
+
+func TestTelemetryConfig(t *testing.T) {
+	defer unsetEnv(TelemetryEnabledEnvVar)
+
+	assert.False(t, (&Config{}).toMetricsConfig().Telemetry)
+	setEnv(TelemetryEnabledEnvVar, "true")
+	assert.True(t, (&Config{}).toMetricsConfig().Telemetry)
+}
+
+func TestStartupMetricConfig(t *testing.T) {
+	defer unsetEnv(StartupMetricEnabledEnvVar)
+
+	assert.True(t, (&Config{}).toMetricsConfig().StartupMetric)
+	assert.True(t, (*Config)(nil).toMetricsConfig().StartupMetric)
+	// Dry runs aren't the startup of a container
+	assert.False(t, (&Config{dryRun: true}).toMetricsConfig().StartupMetric)
+	setEnv(StartupMetricEnabledEnvVar, "false")
+	assert.False(t, (&Config{}).toMetricsConfig().StartupMetric)
+}
+
+func TestIntakeVersionConfig(t *testing.T) {
+	assert.Equal(t, "", (&Config{}).toMetricsConfig().IntakeVersion)
+	assert.Equal(t, "v2", (&Config{IntakeVersion: "v2"}).toMetricsConfig().IntakeVersion)
+}
+
+func TestFlushConcurrencyConfig(t *testing.T) {
+	assert.Equal(t, 0, (&Config{}).toMetricsConfig().FlushConcurrency)
+	assert.Equal(t, 5, (&Config{FlushConcurrency: 5}).toMetricsConfig().FlushConcurrency)
+}
+
+func TestRetryBudgetConfig(t *testing.T) {
+	mc := (&Config{}).toMetricsConfig()
+	assert.Equal(t, 0, mc.MaxRetriesPerInvocation)
+	assert.Equal(t, time.Duration(0), mc.MaxRetryTimePerInvocation)
+
+	mc = (&Config{MaxRetriesPerInvocation: 4, MaxRetryTimePerInvocation: time.Second}).toMetricsConfig()
+	assert.Equal(t, 4, mc.MaxRetriesPerInvocation)
+	assert.Equal(t, time.Second, mc.MaxRetryTimePerInvocation)
+}
+
+func TestEnhancedMetricsConfig(t *testing.T) {
+	defer unsetEnv(EnhancedMetricsEnvVar)
+
+	disabled, enabled := false, true
+	assert.True(t, (*Config)(nil).toMetricsConfig().EnhancedMetrics)
+	assert.True(t, (&Config{}).toMetricsConfig().EnhancedMetrics)
+	assert.False(t, (&Config{EnhancedMetrics: &disabled}).toMetricsConfig().EnhancedMetrics)
+
+	setEnv(EnhancedMetricsEnvVar, "false")
+	assert.False(t, (&Config{}).toMetricsConfig().EnhancedMetrics)
+	// The config takes precedence over the environment
+	assert.True(t, (&Config{EnhancedMetrics: &enabled}).toMetricsConfig().EnhancedMetrics)
+}
+
+func TestRejectMissingTimestampsConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().RejectMissingTimestamps)
+	assert.True(t, (&Config{RejectMissingTimestamps: true}).toMetricsConfig().RejectMissingTimestamps)
+}
+
+func TestSyncFlushOnlyConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().SyncFlushOnly)
+	assert.True(t, (&Config{SyncFlushOnly: true}).toMetricsConfig().SyncFlushOnly)
+}
+
+func TestMetricUsesConfigClock(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	clock := ddlambdatest.NewManualClock(time.Unix(1600000000, 0))
+	InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 100, "my:tag")
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+		Clock:  clock,
+	})
+
+	assert.Contains(t, string(body), `"points":[[1600000000,[100]]]`)
+}
+
+func TestStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	var invocationCtx context.Context
+	InvokeDryRun(func(ctx context.Context) {
+		invocationCtx = ctx
+		Metric("my-metric", 100, "my:tag")
+		Metric("my-metric", 200, "my:tag")
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+
+	stats := Stats(invocationCtx)
+	assert.GreaterOrEqual(t, stats.MetricsAdded, uint64(2))
+	assert.Equal(t, uint64(2), stats.PointsBuffered)
+	assert.Equal(t, uint64(1), stats.BatchesSent)
+	assert.Equal(t, uint64(0), stats.SendFailures)
+
+	payload, err := json.Marshal(stats)
+	assert.NoError(t, err)
+	assert.Contains(t, string(payload), `"batches_sent":1`)
+	assert.Contains(t, string(payload), `"drops":{"cancelled":0,"pending_full":0,"pre_init_full":0,"send_failed":0,"spool_full":0,"spool_expired":0,"flush_capped":0,"missing_timestamp":0}`)
+}
+
+func TestHealthStatus(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {}, &Config{APIKey: "abc-123", Site: server.URL})
+	assert.True(t, HealthStatus().Operational)
+
+	WrapHandler("not a handler", &Config{APIKey: "abc-123", Site: server.URL})
+	assert.False(t, HealthStatus().Operational)
+	assert.Equal(t, []DegradedReason{DegradedInvalidHandler}, HealthStatus().Degraded)
+}
+
+func TestWrappingTwiceWarns(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	defer atomic.StoreInt32(&wrapCount, atomic.LoadInt32(&wrapCount))
+	atomic.StoreInt32(&wrapCount, 0)
+	cfg := &Config{MetricsClient: &ddlambdatest.BatchClient{}}
+
+	WrapHandler(func(ctx context.Context) {}, cfg)
+	assert.Empty(t, HealthStatus().Warnings)
+
+	WrapHandler(func(ctx context.Context) {}, cfg)
+	assert.Equal(t, []DegradedReason{WarningWrappedTwice}, HealthStatus().Warnings)
+	assert.True(t, HealthStatus().Operational)
+}
+
+func TestWrappingTwiceFlushesOnce(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	client := &ddlambdatest.BatchClient{}
+	enhancedMetrics := true
+	cfg := &Config{MetricsClient: client, EnhancedMetrics: &enhancedMetrics}
+
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stdout)
+
+	inner := WrapHandler(func(ctx context.Context) {
+		MetricWithContext(ctx, "orders", 1)
+	}, cfg)
+	outer := WrapHandler(inner, cfg).(func(ctx context.Context, msg json.RawMessage) (interface{}, error))
+	_, err := outer(context.Background(), json.RawMessage("{}"))
+
+	assert.NoError(t, err)
+	assert.Len(t, client.Batches(), 1)
+	assert.Equal(t, 1, strings.Count(output.String(), `"m":"aws.lambda.enhanced.invocations"`))
+	assert.Contains(t, HealthStatus().Warnings, WarningWrappedTwice)
+}
+
+func TestMetricWithoutWrapperWarns(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+
+	err := MetricWithContextE(context.Background(), "orders", 1)
+
+	assert.True(t, errors.Is(err, ErrMetricsDisabled))
+	assert.Equal(t, []DegradedReason{WarningMetricWithoutWrapper}, HealthStatus().Warnings)
+	assert.True(t, HealthStatus().Operational)
+}
+
+func TestMetricsDuringInitWithoutWrapperWarn(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	defer atomic.StoreInt32(&wrapCount, atomic.LoadInt32(&wrapCount))
+
+	atomic.StoreInt32(&wrapCount, 1)
+	checkWrappedAfterInit()
+	assert.Empty(t, HealthStatus().Warnings)
+
+	atomic.StoreInt32(&wrapCount, 0)
+	checkWrappedAfterInit()
+	assert.Equal(t, []DegradedReason{WarningMetricWithoutWrapper}, HealthStatus().Warnings)
+}
+
+type failingDecrypter struct{}
+
+func (d failingDecrypter) Decrypt(ciphertext string) (string, error) {
+	return "", errors.New("AccessDeniedException: the role can't use the key")
+}
+
+func TestWrapHandlerRunsHandlerWhenKMSFails(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	called := false
+	wrapped := WrapHandler(func(ctx context.Context) (string, error) {
+		called = true
+		Metric("my-metric", 1)
+		return "handler result", nil
+	}, &Config{KMSAPIKey: "encrypted", Site: server.URL, decrypter: failingDecrypter{}})
+	result, err := wrapped.(func(context.Context, json.RawMessage) (interface{}, error))(context.Background(), json.RawMessage("{}"))
+
+	assert.True(t, called)
+	assert.NoError(t, err)
+	assert.Equal(t, "handler result", result)
+	// Without the key, the metrics aren't sent to be rejected
+	assert.Equal(t, 0, requests)
+	assert.Equal(t, []DegradedReason{DegradedKMSDecryptFailed}, HealthStatus().Degraded)
+}
+
+func TestMetricsClientConfig(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	setEnv(DatadogAPIKeyEnvVar, "from-env")
+	defer unsetEnv(DatadogAPIKeyEnvVar)
+
+	client := &ddlambdatest.BatchClient{}
+	cfg := &Config{KMSAPIKey: "encrypted", MetricsClient: client, decrypter: failingDecrypter{}}
+	mc := cfg.toMetricsConfig()
+	assert.Same(t, client, mc.Client)
+	assert.Empty(t, mc.APIKey)
+
+	InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1)
+	}, cfg)
+
+	// The batches go to the client, and the KMS key isn't decrypted
+	assert.Len(t, client.Batches(), 1)
+	assert.Empty(t, HealthStatus().Degraded)
+	assert.Equal(t, SinkCustom, SinkInfo().Sink)
+}
+
+func TestWrapHandlerFailOnInitErrorWhenKMSFails(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+
+	assert.PanicsWithError(t, "ddlambda initialization failed: AccessDeniedException: the role can't use the key", func() {
+		WrapHandler(func(ctx context.Context) error { return nil }, &Config{
+			KMSAPIKey:       "encrypted",
+			Site:            "https://api.datadog-lambda-go.invalid",
+			decrypter:       failingDecrypter{},
+			FailOnInitError: true,
+		})
+	})
+}
+
+func TestWrapHandlerRunsHandlerWhenInitPanics(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	defer func(makeListener func(metrics.Config) metrics.Listener) {
+		makeMetricsListener = makeListener
+	}(makeMetricsListener)
+	makeMetricsListener = func(metrics.Config) metrics.Listener {
+		panic("malformed config")
+	}
+
+	wrapped := WrapHandler(func(ctx context.Context) (string, error) {
+		return "handler result", errors.New("handler error")
+	}, &Config{APIKey: "abc-123"})
+	result, err := wrapped.(func(context.Context, json.RawMessage) (interface{}, error))(context.Background(), json.RawMessage("{}"))
+
+	assert.Equal(t, "handler result", result)
+	assert.EqualError(t, err, "handler error")
+	assert.Equal(t, []DegradedReason{DegradedInitFailed}, HealthStatus().Degraded)
+
+	assert.PanicsWithError(t, "ddlambda initialization failed: creating the listeners panicked: malformed config", func() {
+		WrapHandler(func(ctx context.Context) error { return nil }, &Config{APIKey: "abc-123", FailOnInitError: true})
+	})
+}
+
+func TestWrapHandlerKeepsExtraListenersWhenInitPanics(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	defer func(makeListener func(metrics.Config) metrics.Listener) {
+		makeMetricsListener = makeListener
+	}(makeMetricsListener)
+	makeMetricsListener = func(metrics.Config) metrics.Listener {
+		panic("malformed config")
+	}
+
+	audit := &auditListener{}
+	wrapped := WrapHandler(func(ctx context.Context) error {
+		return nil
+	}, &Config{APIKey: "abc-123", ExtraListeners: []HandlerListener{audit}})
+	_, err := wrapped.(func(context.Context, json.RawMessage) (interface{}, error))(context.Background(), json.RawMessage("{}"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"started", "finished"}, audit.events)
+	assert.Equal(t, []DegradedReason{DegradedInitFailed}, HealthStatus().Degraded)
+}
+
+func TestStatsWithoutWrappedHandler(t *testing.T) {
+	assert.Equal(t, MetricsStats{}, Stats(context.Background()))
+}
+
+type auditListener struct {
+	events []string
+	panics bool
+}
+
+func (l *auditListener) HandlerStarted(ctx context.Context, payload json.RawMessage) context.Context {
+	l.events = append(l.events, "started")
+	return ctx
+}
+
+func (l *auditListener) HandlerFinished(ctx context.Context, err error) {
+	l.events = append(l.events, "finished")
+	Metric("audit-metric", 1)
+	if l.panics {
+		panic("audit failed")
+	}
+}
+
+func TestWrapHandlerWithExtraListeners(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	audit := &auditListener{panics: true}
+	InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 100)
+	}, &Config{
+		APIKey:         "abc-123",
+		Site:           server.URL,
+		ExtraListeners: []HandlerListener{audit},
+	})
+
+	assert.Equal(t, []string{"started", "finished"}, audit.events)
+	// The metrics listener finishes after the extra listener panicked, flushing its metric too
+	assert.Contains(t, string(body), `"metric":"my-metric"`)
+	assert.Contains(t, string(body), `"metric":"audit-metric"`)
+}
+
+func TestRawPayload(t *testing.T) {
+	var payload []byte
+	var ok bool
+	handler := func(ctx context.Context, event map[string]string) error {
+		payload, ok = RawPayload(ctx)
+		return nil
+	}
+
+	wrapped := WrapHandler(handler, &Config{RetainRawPayload: true}).(func(context.Context, json.RawMessage) (interface{}, error))
+	_, err := wrapped(context.Background(), json.RawMessage(`{"source":"audit"}`))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, `{"source":"audit"}`, string(payload))
+
+	wrapped = WrapHandler(handler, &Config{}).(func(context.Context, json.RawMessage) (interface{}, error))
+	_, err = wrapped(context.Background(), json.RawMessage(`{"source":"audit"}`))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestEventSource(t *testing.T) {
+	var source string
+	handler := func(ctx context.Context) error {
+		source = EventSource(ctx)
+		return nil
+	}
+	wrapped := WrapHandler(handler, &Config{}).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := wrapped(context.Background(), json.RawMessage(`{"Records":[{"EventSource":"aws:sns","Sns":{}}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "sns", source)
+
+	_, err = wrapped(context.Background(), json.RawMessage(`{"custom":"event"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "unknown", source)
+
+	assert.Equal(t, "", EventSource(context.Background()))
+}
+
+func TestEventDetails(t *testing.T) {
+	var details EventAttributes
+	var ok bool
+	handler := func(ctx context.Context) error {
+		details, ok = EventDetails(ctx)
+		return nil
+	}
+	wrapped := WrapHandler(handler, &Config{}).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	payload, err := ioutil.ReadFile("internal/testdata/sqs-fifo-event.json")
+	assert.NoError(t, err)
+	_, err = wrapped(context.Background(), payload)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "customer-42", details.MessageGroupID)
+	assert.Equal(t, "1eea03c3f7e782c7bdc2f2a917f40389314733ff39f5ab16219580c0109ade98", details.MessageDeduplicationID)
+
+	payload, err = ioutil.ReadFile("internal/testdata/sqs-event.json")
+	assert.NoError(t, err)
+	_, err = wrapped(context.Background(), payload)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok = EventDetails(context.Background())
+	assert.False(t, ok)
+}
+
+func TestAdditionalSinks(t *testing.T) {
+	sink := func(ctx context.Context, batch []APIMetric) error { return nil }
+	assert.Len(t, (&Config{AdditionalSinks: []MetricsBatchSink{sink}}).toMetricsConfig().AdditionalSinks, 1)
+
+	payload, err := MarshalMetricsBatch([]APIMetric{{Name: "orders.processed", MetricType: "distribution", Points: []interface{}{}}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"series":[{"metric":"orders.processed","type":"distribution","points":[],"metadata":{"origin":{"origin_product":1,"origin_sub_product":38,"origin_product_detail":51}}}]}`, string(payload))
+}
+
+func TestWrapHandlerWithoutLambdaContext(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// InvokeDryRun calls the handler with a plain context.Background(), like local integration tests or ECS
+	called := false
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		called = true
+		Metric("orders.processed", 1, "env:test")
+	}, &Config{
+		APIKey:         "abc-123",
+		Site:           server.URL,
+		DDTraceEnabled: true,
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, called)
+	assert.Contains(t, string(body), `"metric":"orders.processed"`)
+	assert.NotContains(t, string(body), `functionname:`)
+}
+
+func TestWrapLambdaHandler(t *testing.T) {
+	handler := WrapLambdaHandler(func(ctx context.Context) (map[string]string, error) {
+		return map[string]string{"status": "ok"}, nil
+	}, &Config{APIKey: "abc-123", DDTraceEnabled: false})
+
+	response, err := handler.Invoke(context.Background(), []byte("{}"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"status":"ok"}`, string(response))
+
+	handler = WrapLambdaHandler(func(ctx context.Context) (chan int, error) {
+		return make(chan int), nil
+	}, &Config{APIKey: "abc-123", DDTraceEnabled: false})
+
+	_, err = handler.Invoke(context.Background(), []byte("{}"))
+	assert.EqualError(t, err, "couldn't marshal the response of type chan int: json: unsupported type: chan int")
+}
+
+func TestStart(t *testing.T) {
+	defer func(start func(interface{}, ...lambda.Option)) {
+		startHandler = start
+	}(startHandler)
+	var started lambda.Handler
+	var options []lambda.Option
+	startHandler = func(handler interface{}, opts ...lambda.Option) {
+		started, options = handler.(lambda.Handler), opts
+	}
+
+	Start(func(ctx context.Context) (string, error) {
+		return "started", nil
+	}, &Config{APIKey: "abc-123", DDTraceEnabled: false}, lambda.WithContext(context.Background()), lambda.WithSetEscapeHTML(false))
+
+	// The options are forwarded to the runtime as they are
+	assert.Len(t, options, 2)
+	response, err := started.Invoke(context.Background(), []byte("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, `"started"`, string(response))
+}
+
+func TestStartWithoutOptions(t *testing.T) {
+	defer func(start func(interface{}, ...lambda.Option)) {
+		startHandler = start
+	}(startHandler)
+	options := []lambda.Option{}
+	startHandler = func(handler interface{}, opts ...lambda.Option) {
+		options = opts
+	}
+
+	Start(func() error { return nil }, &Config{APIKey: "abc-123", DDTraceEnabled: false})
+	assert.Empty(t, options)
+}
+
+func TestStartFlushOnTerminate(t *testing.T) {
+	defer func(start func(interface{}, ...lambda.Option), enable func(...func()) lambda.Option) {
+		startHandler, enableSIGTERM = start, enable
+	}(startHandler, enableSIGTERM)
+	var started lambda.Handler
+	var options []lambda.Option
+	startHandler = func(handler interface{}, opts ...lambda.Option) {
+		started, options = handler.(lambda.Handler), opts
+	}
+	var hooks []func()
+	enableSIGTERM = func(callbacks ...func()) lambda.Option {
+		hooks = append(hooks, callbacks...)
+		return lambda.WithEnableSIGTERM(callbacks...)
+	}
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	var invocationCtx context.Context
+	userOptions := make([]lambda.Option, 1, 2)
+	userOptions[0] = lambda.WithContext(context.Background())
+	Start(func(ctx context.Context) error {
+		invocationCtx = ctx
+		return nil
+	}, &Config{APIKey: "abc-123", Site: server.URL, DDTraceEnabled: false, FlushOnTerminate: true}, userOptions...)
+
+	// The hook is added after the options of the caller, without writing to their array
+	assert.Len(t, options, 2)
+	assert.Nil(t, userOptions[:2][1])
+	if !assert.Len(t, hooks, 1) {
+		return
+	}
+	_, err := started.Invoke(context.Background(), []byte("{}"))
+	assert.NoError(t, err)
+	sent := len(bodies)
+
+	// A metric sent after the invocation ended is flushed when the container shuts down
+	MetricWithContext(invocationCtx, "late.metric", 1)
+	assert.Len(t, bodies, sent)
+	hooks[0]()
+	if assert.Len(t, bodies, sent+1) {
+		assert.Contains(t, bodies[sent], `"metric":"late.metric"`)
+	}
+}
+
+func TestStartLogTopEmitters(t *testing.T) {
+	defer func(start func(interface{}, ...lambda.Option), enable func(...func()) lambda.Option) {
+		startHandler, enableSIGTERM = start, enable
+	}(startHandler, enableSIGTERM)
+	startHandler = func(handler interface{}, opts ...lambda.Option) {}
+	hooks := 0
+	enableSIGTERM = func(callbacks ...func()) lambda.Option {
+		hooks += len(callbacks)
+		return lambda.WithEnableSIGTERM(callbacks...)
+	}
+
+	Start(func() error { return nil }, &Config{MetricsClient: &ddlambdatest.BatchClient{}, DDTraceEnabled: false})
+	assert.Equal(t, 0, hooks)
+	// The top emitters are logged by the SIGTERM hook of the runtime
+	Start(func() error { return nil }, &Config{MetricsClient: &ddlambdatest.BatchClient{}, DDTraceEnabled: false, LogTopEmitters: true})
+	assert.Equal(t, 1, hooks)
+}
+
+func TestGlobalTags(t *testing.T) {
+	defer unsetEnv(TagsEnvVar)
+	defer unsetEnv(EnvEnvVar)
+	defer unsetEnv(VersionEnvVar)
+
+	assert.Empty(t, (&Config{}).toMetricsConfig().GlobalTags)
+
+	setEnv(TagsEnvVar, "env:prod,team:orders owner:alice")
+	setEnv(EnvEnvVar, "staging")
+	setEnv(VersionEnvVar, "1.2.3")
+	assert.Equal(t, []string{"env:staging", "version:1.2.3", "team:orders", "owner:alice"}, (&Config{}).toMetricsConfig().GlobalTags)
+}
+
+func TestEnvironmentIsReadUntilReloaded(t *testing.T) {
+	defer unsetEnv(TagsEnvVar)
+	defer unsetEnv(DatadogSiteEnvVar)
+	setEnv(TagsEnvVar, "team:orders")
+	setEnv(DatadogSiteEnvVar, "datadoghq.eu")
+
+	// Changing the environment at runtime doesn't change the configuration until it's reloaded
+	os.Setenv(TagsEnvVar, "team:payments")
+	os.Setenv(DatadogSiteEnvVar, "us3.datadoghq.com")
+	cfg := (&Config{}).toMetricsConfig()
+	assert.Equal(t, []string{"team:orders"}, cfg.GlobalTags)
+	assert.Equal(t, "https://api.datadoghq.eu/api/v1", cfg.Site)
+
+	ReloadEnvironment()
+	cfg = (&Config{}).toMetricsConfig()
+	assert.Equal(t, []string{"team:payments"}, cfg.GlobalTags)
+	assert.Equal(t, "https://api.us3.datadoghq.com/api/v1", cfg.Site)
+}
+
+func TestTagNormalizationConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().DisableTagNormalization)
+	assert.True(t, (&Config{DisableTagNormalization: true}).toMetricsConfig().DisableTagNormalization)
+}
+
+func TestPrewarmConnectionConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().PrewarmConnection)
+	assert.True(t, (&Config{PrewarmConnection: true}).toMetricsConfig().PrewarmConnection)
+}
+
+func TestShardedBuffersConfig(t *testing.T) {
+	assert.Equal(t, 0, (&Config{}).toMetricsConfig().ShardedBuffers)
+	assert.Equal(t, 16, (&Config{ShardedBuffers: 16}).toMetricsConfig().ShardedBuffers)
+}
+
+func TestAdaptiveFlushConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().AdaptiveFlush)
+	assert.True(t, (&Config{AdaptiveFlush: true}).toMetricsConfig().AdaptiveFlush)
+}
+
+func TestFlushAtPointCountConfig(t *testing.T) {
+	assert.Equal(t, 0, (&Config{}).toMetricsConfig().FlushAtPointCount)
+	assert.Equal(t, 500, (&Config{FlushAtPointCount: 500}).toMetricsConfig().FlushAtPointCount)
+}
+
+func TestAggregationBucketConfig(t *testing.T) {
+	assert.Equal(t, time.Duration(0), (&Config{}).toMetricsConfig().AggregationBucket)
+	assert.Equal(t, time.Minute, (&Config{AggregationBucket: time.Minute}).toMetricsConfig().AggregationBucket)
+}
+
+func TestMaxFutureSkewConfig(t *testing.T) {
+	assert.Equal(t, time.Duration(0), (&Config{}).toMetricsConfig().MaxFutureSkew)
+	assert.Equal(t, time.Minute, (&Config{MaxFutureSkew: time.Minute}).toMetricsConfig().MaxFutureSkew)
+}
+
+func TestMessageGroupTagConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().MessageGroupTag)
+	assert.True(t, (&Config{MessageGroupTag: true}).toMetricsConfig().MessageGroupTag)
+}
+
+func TestAuthorizerTagKeysConfig(t *testing.T) {
+	assert.Empty(t, (&Config{}).toMetricsConfig().AuthorizerTagKeys)
+	assert.Equal(t, []string{"tenant_id"}, (&Config{AuthorizerTagKeys: []string{"tenant_id"}}).toMetricsConfig().AuthorizerTagKeys)
+}
+
+func TestMaxFlushDurationConfig(t *testing.T) {
+	assert.Equal(t, time.Duration(0), (&Config{}).toMetricsConfig().MaxFlushDuration)
+	assert.Equal(t, time.Second, (&Config{MaxFlushDuration: time.Second}).toMetricsConfig().MaxFlushDuration)
+}
+
+func TestLogTopEmittersConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().LogTopEmitters)
+	assert.True(t, (&Config{LogTopEmitters: true}).toMetricsConfig().LogTopEmitters)
+}
+
+func TestFetchResourceTagsConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().FetchResourceTags)
+
+	mc := (&Config{FetchResourceTags: true, ResourceTagKeys: []string{"team"}}).toMetricsConfig()
+	assert.True(t, mc.FetchResourceTags)
+	assert.Equal(t, []string{"team"}, mc.ResourceTagKeys)
+}
+
+func TestSpillFailedBatchesConfig(t *testing.T) {
+	mc := (&Config{}).toMetricsConfig()
+	assert.False(t, mc.SpillFailedBatches)
+	assert.Equal(t, int64(0), mc.SpoolMaxSize)
+
+	mc = (&Config{SpillFailedBatches: true, SpoolMaxSize: 1024}).toMetricsConfig()
+	assert.True(t, mc.SpillFailedBatches)
+	assert.Equal(t, int64(1024), mc.SpoolMaxSize)
+}
+
+func TestMemoryPressureConfig(t *testing.T) {
+	mc := (&Config{MemoryPressure: true, MemoryPressureThreshold: 0.8}).toMetricsConfig()
+	assert.True(t, mc.MemoryPressure)
+	assert.Equal(t, 0.8, mc.MemoryPressureThreshold)
+	assert.False(t, (&Config{}).toMetricsConfig().MemoryPressure)
+}
+
+func TestRuntimeTagsConfig(t *testing.T) {
+	assert.False(t, (&Config{}).toMetricsConfig().RuntimeTags)
+	assert.True(t, (&Config{RuntimeTags: true}).toMetricsConfig().RuntimeTags)
+}
+
+func TestLegacyQueryAuth(t *testing.T) {
+	var query, header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, header = r.URL.RawQuery, r.Header.Get("DD-API-KEY")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1)
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+	assert.Equal(t, "", query)
+	assert.Equal(t, "abc-123", header)
+
+	InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1)
+	}, &Config{APIKey: "abc-123", Site: server.URL, LegacyQueryAuth: true})
+	assert.Equal(t, "api_key=abc-123", query)
+	assert.Equal(t, "", header)
+}
+
+func TestMarkInitPhase(t *testing.T) {
+	initphase.Reset()
+	defer initphase.Reset()
+	MarkInitPhase("load_config")
+
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stdout)
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		MarkInitPhase("too_late")
+	}, &Config{MetricsClient: &ddlambdatest.BatchClient{}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, strings.Count(output.String(), `"phase:load_config"`))
+	assert.Equal(t, 1, strings.Count(output.String(), `"phase:unmarked"`))
+	assert.NotContains(t, output.String(), "too_late")
+}
+
+func TestRemainingTime(t *testing.T) {
+	assert.Zero(t, RemainingTime(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	remaining := RemainingTime(ctx)
+	assert.True(t, remaining > 59*time.Second && remaining <= time.Minute)
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	assert.Zero(t, RemainingTime(expired))
+}
+
+func TestRemainingTimeReadsTheClock(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	clock := rec.Clock()
+	var remaining []time.Duration
+	handler := rec.WrapHandler(func(ctx context.Context) {
+		remaining = append(remaining, RemainingTime(ctx))
+		clock.Advance(20 * time.Second)
+		remaining = append(remaining, RemainingTime(ctx))
+		clock.Advance(time.Minute)
+		remaining = append(remaining, RemainingTime(ctx))
+	}).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(30*time.Second))
+	defer cancel()
+	_, err := handler(ctx, json.RawMessage("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{30 * time.Second, 10 * time.Second, 0}, remaining)
+}
+
+func TestContextWithReserve(t *testing.T) {
+	background := context.Background()
+	unchanged, cancelUnchanged := ContextWithReserve(background, time.Second)
+	assert.Equal(t, background, unchanged)
+	cancelUnchanged()
+
+	ctx, cancel := context.WithTimeout(background, time.Minute)
+	defer cancel()
+	unchanged, cancelUnchanged = ContextWithReserve(ctx, 0)
+	assert.Equal(t, ctx, unchanged)
+	cancelUnchanged()
+
+	deadline, _ := ctx.Deadline()
+	reservedCtx, cancelReserved := ContextWithReserve(ctx, 10*time.Second)
+	reserved, _ := reservedCtx.Deadline()
+	assert.Equal(t, deadline.Add(-10*time.Second), reserved)
+	// Cancelling the reserved context leaves its parent running
+	cancelReserved()
+	assert.Equal(t, context.Canceled, reservedCtx.Err())
+	assert.NoError(t, ctx.Err())
+
+	// A reserve longer than the remaining time gives a context which is already done
+	doneCtx, cancelDone := ContextWithReserve(ctx, 2*time.Minute)
+	defer cancelDone()
+	select {
+	case <-doneCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("the reserved context isn't done")
+	}
+}
+
+func TestAsyncFlushWithExtensionConfig(t *testing.T) {
+	disabled := false
+	assert.True(t, (*Config)(nil).toMetricsConfig().AsyncFlushWithExtension)
+	assert.True(t, (&Config{}).toMetricsConfig().AsyncFlushWithExtension)
+	assert.False(t, (&Config{AsyncFlushWithExtension: &disabled}).toMetricsConfig().AsyncFlushWithExtension)
+}
+
+func TestAddInvocationTags(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	InvokeDryRun(func(ctx context.Context) {
+		AddInvocationTags(ctx, "tenant:acme", "plan:free")
+		Metric("orders.processed", 1, "plan:pro")
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+
+	assert.Contains(t, string(body), `"plan:pro","tenant:acme"]`)
+	assert.NotContains(t, string(body), "plan:free")
+}
+
+func TestConcurrentWrappedHandlers(t *testing.T) {
+	type recordingServer struct {
+		*httptest.Server
+		mu       sync.Mutex
+		requests int
+		body     string
+	}
+	makeServer := func() *recordingServer {
+		s := &recordingServer{}
+		s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			s.mu.Lock()
+			s.requests++
+			s.body += string(body)
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}))
+		return s
+	}
+	serverA, serverB := makeServer(), makeServer()
+	defer serverA.Close()
+	defer serverB.Close()
+
+	// Both invocations send their metric once they're both in progress
+	var started sync.WaitGroup
+	started.Add(2)
+	makeHandler := func(name string, server *recordingServer) func(context.Context, json.RawMessage) (interface{}, error) {
+		wrapped := WrapHandler(func(ctx context.Context) error {
+			started.Done()
+			started.Wait()
+			MetricWithContext(ctx, name+".invocations", 1)
+			return nil
+		}, &Config{APIKey: "abc-123", Site: server.URL})
+		return wrapped.(func(context.Context, json.RawMessage) (interface{}, error))
+	}
+	handlerA := makeHandler("handler-a", serverA)
+	handlerB := makeHandler("handler-b", serverB)
+
+	var finished sync.WaitGroup
+	finished.Add(2)
+	for _, handler := range []func(context.Context, json.RawMessage) (interface{}, error){handlerA, handlerB} {
+		go func(handler func(context.Context, json.RawMessage) (interface{}, error)) {
+			defer finished.Done()
+			_, err := handler(context.Background(), json.RawMessage("{}"))
+			assert.NoError(t, err)
+		}(handler)
+	}
+	finished.Wait()
+
+	assert.Nil(t, GetContext())
+	assert.Equal(t, 1, serverA.requests)
+	assert.Contains(t, serverA.body, `"metric":"handler-a.invocations"`)
+	assert.NotContains(t, serverA.body, "handler-b")
+	assert.Equal(t, 1, serverB.requests)
+	assert.Contains(t, serverB.body, `"metric":"handler-b.invocations"`)
+	assert.NotContains(t, serverB.body, "handler-a")
+}
+
+func TestNamespace(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	ctx := rec.Context()
+
+	orders := Namespace(ctx, "orders")
+	orders.Distribution("processed", 1, "env:prod")
+	Namespace(ctx, "payments.").Distribution("captured", 2)
+	Namespace(ctx, "").Distribution("unprefixed", 3)
+	orders.Set("customers", "customer-42")
+	rec.FlushNow()
+
+	assert.True(t, rec.AssertTagged(t, "orders.processed", "env:prod"))
+	assert.Equal(t, []float64{2}, rec.Distributions("payments.captured")[0].Values())
+	assert.Len(t, rec.Distributions("unprefixed"), 1)
+	assert.True(t, rec.AssertTagged(t, "orders.customers"))
+}
+
+func TestNamespaceNesting(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	ctx := rec.Context()
+
+	orders := Namespace(ctx, "orders").WithTags("team:checkout")
+	refunds := orders.Namespace("refunds").WithTags("kind:partial")
+	refunds.Distribution("issued", 1, "currency:eur")
+	refunds.Count("count", 2, "currency:eur")
+	refunds.Count("count", 3, "currency:eur")
+	refunds.Gauge("pending", 4, "currency:eur")
+	// Deriving a scope leaves its parent unchanged
+	orders.Distribution("processed", 1)
+	rec.FlushNow()
+
+	issued := rec.Distributions("orders.refunds.issued")
+	assert.Len(t, issued, 1)
+	assert.True(t, issued[0].HasTags("team:checkout", "kind:partial", "currency:eur"))
+	processed := rec.Distributions("orders.processed")
+	assert.Len(t, processed, 1)
+	assert.True(t, processed[0].HasTags("team:checkout"))
+	assert.False(t, processed[0].HasTags("kind:partial"))
+	count := rec.Distributions("orders.refunds.count")
+	if assert.Len(t, count, 1) {
+		assert.True(t, count[0].HasTags("team:checkout", "kind:partial", "currency:eur"))
+		assert.Equal(t, []float64{5}, count[0].Values())
+	}
+	pending := rec.Distributions("orders.refunds.pending")
+	if assert.Len(t, pending, 1) {
+		assert.True(t, pending[0].HasTags("team:checkout", "kind:partial", "currency:eur"))
+		assert.Equal(t, []float64{4}, pending[0].Values())
+	}
+}
+
+func TestNamespaceTagsAreNotShared(t *testing.T) {
+	base := Namespace(context.Background(), "orders").WithTags("a:1", "b:2")
+	// Leaves spare capacity after the base tags, which sibling scopes would overwrite if they appended to them
+	base.tags = base.tags[:1]
+	first := base.WithTags("c:3")
+	second := base.WithTags("d:4")
+
+	assert.Equal(t, []string{"a:1", "c:3"}, first.tags)
+	assert.Equal(t, []string{"a:1", "d:4"}, second.tags)
+	assert.Equal(t, []string{"a:1", "c:3", "e:5"}, first.mergeTags([]string{"e:5"}))
+}
+
+func TestMetricTagsAreCopied(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	ctx := rec.Context()
+
+	// The caller reuses its slice for each metric and scope, mutating it once it's passed
+	tags := []string{"tenant:a"}
+	MetricWithContext(ctx, "orders.placed", 1, tags...)
+	tags[0] = "tenant:b"
+	scope := Namespace(ctx, "payments").WithTags(tags...)
+	tags[0] = "tenant:mutated"
+	scope.Distribution("captured", 1)
+	scope.Count("refunded", 1)
+	scope.Gauge("pending", 1)
+	rec.FlushNow()
+
+	assert.True(t, rec.AssertTagged(t, "orders.placed", "tenant:a"))
+	assert.True(t, rec.AssertTagged(t, "payments.captured", "tenant:b"))
+	assert.True(t, rec.AssertTagged(t, "payments.refunded", "tenant:b"))
+	assert.True(t, rec.AssertTagged(t, "payments.pending", "tenant:b"))
+}
+
+func TestNamespaceWithoutContext(t *testing.T) {
+	assert.NotPanics(t, func() {
+		assert.True(t, errors.Is(MetricsAPI{}.Distribution("metric", 1), ErrMetricsDisabled))
+		assert.True(t, errors.Is(Namespace(context.Background(), "orders").Set("metric", "member"), ErrMetricsDisabled))
+		assert.True(t, errors.Is(MetricsAPI{}.Count("metric", 1), ErrMetricsDisabled))
+		assert.True(t, errors.Is(MetricsAPI{}.Gauge("metric", 1), ErrMetricsDisabled))
+	})
+}
+
+func TestRecordMetricsSQS(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: "a", EventSourceARN: "arn:aws:sqs:us-east-1:123456789012:orders"},
+		{MessageId: "2", Body: "bb", EventSourceARN: "arn:aws:sqs:us-east-1:123456789012:orders"},
+		{MessageId: "3", Body: "ccc", EventSourceARN: "arn:aws:sqs:us-east-1:123456789012:refunds"},
+	}}
+
+	err := RecordMetrics(rec.Context(), event, "message.size", func(record interface{}) float64 {
+		return float64(len(record.(events.SQSMessage).Body))
+	}, func(record interface{}) []string {
+		arn := strings.Split(record.(events.SQSMessage).EventSourceARN, ":")
+		return []string{"queue:" + arn[len(arn)-1]}
+	})
+	rec.FlushNow()
+
+	assert.NoError(t, err)
+	// The records with the same tags are sent as one metric
+	distributions := rec.Distributions("message.size")
+	assert.Len(t, distributions, 2)
+	for _, d := range distributions {
+		if d.HasTags("queue:orders") {
+			assert.Equal(t, []float64{1, 2}, d.Values())
+		} else {
+			assert.True(t, d.HasTags("queue:refunds"))
+			assert.Equal(t, []float64{3}, d.Values())
+		}
+	}
+}
+
+func TestRecordMetricsEventTypes(t *testing.T) {
+	for _, event := range []interface{}{
+		events.KinesisEvent{Records: []events.KinesisEventRecord{{EventID: "1"}, {EventID: "2"}}},
+		&events.KinesisEvent{Records: []events.KinesisEventRecord{{EventID: "1"}, {EventID: "2"}}},
+		events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{{EventID: "1"}, {EventID: "2"}}},
+		&events.SNSEvent{Records: []events.SNSEventRecord{{EventSource: "aws:sns"}, {EventSource: "aws:sns"}}},
+		&events.SQSEvent{Records: []events.SQSMessage{{MessageId: "1"}, {MessageId: "2"}}},
+	} {
+		rec := ddlambdatest.NewRecorder()
+		var records []interface{}
+		err := RecordMetrics(rec.Context(), event, "records", func(record interface{}) float64 {
+			records = append(records, record)
+			return 1
+		}, nil)
+		rec.FlushNow()
+
+		assert.NoError(t, err, "%T", event)
+		assert.Len(t, records, 2, "%T", event)
+		distributions := rec.Distributions("records")
+		assert.Len(t, distributions, 1, "%T", event)
+		assert.Equal(t, []float64{1, 1}, distributions[0].Values(), "%T", event)
+	}
+}
+
+func TestRecordMetricsRecordTypes(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	valueFn := func(record interface{}) float64 {
+		switch r := record.(type) {
+		case events.KinesisEventRecord:
+			return float64(len(r.Kinesis.Data))
+		case events.DynamoDBEventRecord:
+			return float64(len(r.Change.Keys))
+		case events.SNSEventRecord:
+			return float64(len(r.SNS.Message))
+		}
+		t.Fatalf("unexpected record of type %T", record)
+		return 0
+	}
+
+	assert.NoError(t, RecordMetrics(rec.Context(), events.KinesisEvent{Records: []events.KinesisEventRecord{{Kinesis: events.KinesisRecord{Data: []byte("abcd")}}}}, "kinesis", valueFn, nil))
+	assert.NoError(t, RecordMetrics(rec.Context(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{{Change: events.DynamoDBStreamRecord{Keys: map[string]events.DynamoDBAttributeValue{"id": events.NewStringAttribute("1")}}}}}, "dynamodb", valueFn, nil))
+	assert.NoError(t, RecordMetrics(rec.Context(), events.SNSEvent{Records: []events.SNSEventRecord{{SNS: events.SNSEntity{Message: "hello"}}}}, "sns", valueFn, nil))
+	rec.FlushNow()
+
+	assert.Equal(t, []float64{4}, rec.Distributions("kinesis")[0].Values())
+	assert.Equal(t, []float64{1}, rec.Distributions("dynamodb")[0].Values())
+	assert.Equal(t, []float64{5}, rec.Distributions("sns")[0].Values())
+}
+
+func TestRecordMetricsUnsupportedEvent(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	valueFn := func(record interface{}) float64 { return 1 }
+
+	err := RecordMetrics(rec.Context(), events.S3Event{}, "records", valueFn, nil)
+	assert.EqualError(t, err, "ddlambda: RecordMetrics doesn't support events of type events.S3Event")
+	assert.Error(t, RecordMetrics(rec.Context(), nil, "records", valueFn, nil))
+	// Nil pointers to supported events have no records
+	assert.NoError(t, RecordMetrics(rec.Context(), (*events.SQSEvent)(nil), "records", valueFn, nil))
+	rec.FlushNow()
+	assert.Len(t, rec.Distributions("records"), 0)
+}
+
+func TestRecordMetricsWithoutListener(t *testing.T) {
+	event := events.SQSEvent{Records: []events.SQSMessage{{MessageId: "1"}}}
+
+	err := RecordMetrics(context.Background(), event, "records", func(record interface{}) float64 { return 1 }, nil)
+
+	assert.True(t, errors.Is(err, ErrMetricsDisabled))
+}
+
+func TestMetricE(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	ctx := rec.Context()
+
+	assert.NoError(t, MetricWithContextE(ctx, "billing.charged", 1))
+	assert.True(t, errors.Is(MetricWithContextE(ctx, "billing.charged", math.NaN()), ErrInvalidMetric))
+	assert.True(t, errors.Is(MetricWithContextE(context.Background(), "billing.charged", 1), ErrMetricsDisabled))
+	assert.NoError(t, Namespace(ctx, "billing").Distribution("refunded", 1))
+	rec.FlushNow()
+
+	assert.Len(t, rec.Distributions("billing.charged"), 1)
+	assert.Len(t, rec.Distributions("billing.refunded"), 1)
+}
+
+// setEnv sets an environment variable, and reloads the environment read by the library
+func setEnv(key, value string) {
+	os.Setenv(key, value)
+	ReloadEnvironment()
+}
+
+// unsetEnv unsets an environment variable, and reloads the environment read by the library
+func unsetEnv(key string) {
+	os.Unsetenv(key)
+	ReloadEnvironment()
+}
@@ -0,0 +1,48 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest
+
+import (
+	"sync"
+
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+)
+
+// BatchClient is a reference implementation of ddlambda.MetricsClient, which records the batches it receives
+// instead of sending them. Set it as Config.MetricsClient to check the batches a function sends, including
+// their retries. Its zero value is ready to use.
+type BatchClient struct {
+	mu      sync.Mutex
+	batches [][]metrics.APIMetric
+	err     error
+}
+
+// SendMetrics records the batch, and returns the error set with FailWith
+func (c *BatchClient) SendMetrics(batch []metrics.APIMetric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches = append(c.batches, batch)
+	return c.err
+}
+
+// FailWith makes the next sends fail with err, until it's called with nil. The failed batches are recorded too.
+func (c *BatchClient) FailWith(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// Batches returns every batch received so far, in order
+func (c *BatchClient) Batches() [][]metrics.APIMetric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	batches := make([][]metrics.APIMetric, len(c.batches))
+	copy(batches, c.batches)
+	return batches
+}
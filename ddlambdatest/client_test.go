@@ -0,0 +1,47 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ddlambda "github.com/DataDog/datadog-lambda-go"
+	"github.com/DataDog/datadog-lambda-go/ddlambdatest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchClientRecordsBatches(t *testing.T) {
+	client := &ddlambdatest.BatchClient{}
+
+	ddlambda.InvokeDryRun(func(ctx context.Context) {
+		ddlambda.Metric("orders.processed", 1, "env:prod")
+	}, &ddlambda.Config{MetricsClient: client})
+
+	batches := client.Batches()
+	assert.Len(t, batches, 1)
+	assert.Equal(t, "orders.processed", batches[0][0].Name)
+	assert.Contains(t, batches[0][0].Tags, "env:prod")
+}
+
+func TestBatchClientFailWith(t *testing.T) {
+	client := &ddlambdatest.BatchClient{}
+	client.FailWith(errors.New("aggregator unavailable"))
+
+	ddlambda.InvokeDryRun(func(ctx context.Context) {
+		ddlambda.Metric("orders.processed", 1)
+	}, &ddlambda.Config{MetricsClient: client, ShouldRetryOnFailure: true})
+
+	// The failed batch is retried like it would be by the Datadog API
+	assert.Greater(t, len(client.Batches()), 1)
+
+	client.FailWith(nil)
+	assert.NoError(t, client.SendMetrics(nil))
+}
@@ -0,0 +1,121 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// ManualClock is a ddlambda.Clock whose time only moves when Set, Advance or Sleep is called. Its tickers
+	// tick when the time moves past their next tick, dropping ticks like a time.Ticker when they aren't read.
+	ManualClock struct {
+		mu      sync.Mutex
+		now     time.Time
+		tickers []*manualTicker
+		timers  []*manualTimer
+	}
+
+	manualTicker struct {
+		c      chan time.Time
+		period time.Duration
+		next   time.Time
+	}
+
+	manualTimer struct {
+		c  chan time.Time
+		at time.Time
+	}
+)
+
+// NewManualClock creates a ManualClock set to start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the time of the clock
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t, without ticking its tickers
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	for _, ticker := range c.tickers {
+		ticker.next = t.Add(ticker.period)
+	}
+}
+
+// Advance moves the clock forward by d, ticking the tickers whose next tick has been reached
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, ticker := range c.tickers {
+		for !ticker.next.After(c.now) {
+			select {
+			case ticker.c <- ticker.next:
+			default:
+			}
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+	c.fireTimers()
+}
+
+// fireTimers sends the time to the channels of After whose time has been reached, and forgets them. It must be
+// called with mu held.
+func (c *ManualClock) fireTimers() {
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+// Sleep advances the clock by d instead of blocking
+func (c *ManualClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// NewTicker creates a ticker which ticks every period of the clock's time. Stopping the ticker has no effect.
+func (c *ManualClock) NewTicker(period time.Duration) *time.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &manualTicker{
+		c:      make(chan time.Time, 1),
+		period: period,
+		next:   c.now.Add(period),
+	}
+	c.tickers = append(c.tickers, ticker)
+	return &time.Ticker{C: ticker.c}
+}
+
+// After returns a channel which receives the clock's time once it has moved forward by d, with Advance or Sleep.
+// Set doesn't fire it. When d isn't positive, the channel receives the time straight away.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &manualTimer{
+		c:  make(chan time.Time, 1),
+		at: c.now.Add(d),
+	}
+	c.timers = append(c.timers, timer)
+	c.fireTimers()
+	return timer.c
+}
@@ -0,0 +1,61 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/ddlambdatest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualClockTicks(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := ddlambdatest.NewManualClock(start)
+	ticker := clock.NewTicker(10 * time.Second)
+
+	clock.Advance(9 * time.Second)
+	assert.Len(t, ticker.C, 0)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(10*time.Second), <-ticker.C)
+
+	// Like a time.Ticker, ticks which aren't read are dropped
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(20*time.Second), <-ticker.C)
+	assert.Len(t, ticker.C, 0)
+	assert.Equal(t, start.Add(40*time.Second), clock.Now())
+}
+
+func TestManualClockSleepAndSet(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := ddlambdatest.NewManualClock(start)
+
+	clock.Sleep(time.Minute)
+	assert.Equal(t, start.Add(time.Minute), clock.Now())
+
+	clock.Set(start)
+	assert.Equal(t, start, clock.Now())
+}
+
+func TestManualClockAfter(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := ddlambdatest.NewManualClock(start)
+	after := clock.After(10 * time.Second)
+
+	clock.Advance(9 * time.Second)
+	assert.Len(t, after, 0)
+
+	clock.Sleep(2 * time.Second)
+	assert.Equal(t, start.Add(11*time.Second), <-after)
+
+	// A duration which isn't positive has already elapsed
+	assert.Equal(t, start.Add(11*time.Second), <-clock.After(0))
+}
@@ -0,0 +1,460 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest
+
+import "encoding/json"
+
+// Fixture is the payload of an invocation by an AWS event source, as the runtime receives it. Pass it to Invoke
+// as the payload, or read it with JSON.
+type Fixture string
+
+// The event source fixtures bundled with the test kit
+const (
+	// APIGatewayRESTEvent is an API Gateway REST API proxy request
+	APIGatewayRESTEvent Fixture = `{
+  "resource": "/users/{id}",
+  "path": "/users/42",
+  "httpMethod": "GET",
+  "headers": {
+    "Host": "abc123.execute-api.us-east-1.amazonaws.com"
+  },
+  "requestContext": {
+    "resourceId": "123456",
+    "resourcePath": "/users/{id}",
+    "httpMethod": "GET",
+    "requestId": "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+    "accountId": "123456789012",
+    "apiId": "abc123",
+    "stage": "prod",
+    "domainName": "abc123.execute-api.us-east-1.amazonaws.com",
+    "requestTimeEpoch": 1428582896000
+  },
+  "body": null
+}`
+
+	// APIGatewayHTTPEvent is an API Gateway HTTP API request
+	APIGatewayHTTPEvent Fixture = `{
+  "version": "2.0",
+  "routeKey": "POST /orders",
+  "rawPath": "/orders",
+  "rawQueryString": "",
+  "headers": {
+    "host": "xyz789.execute-api.eu-west-1.amazonaws.com"
+  },
+  "requestContext": {
+    "accountId": "123456789012",
+    "apiId": "xyz789",
+    "domainName": "xyz789.execute-api.eu-west-1.amazonaws.com",
+    "domainPrefix": "xyz789",
+    "http": {
+      "method": "POST",
+      "path": "/orders",
+      "protocol": "HTTP/1.1",
+      "sourceIp": "127.0.0.1",
+      "userAgent": "curl/7.64.1"
+    },
+    "requestId": "JKJaXmPLvHcESHA=",
+    "routeKey": "POST /orders",
+    "stage": "$default",
+    "time": "09/Apr/2015:12:34:56 +0000",
+    "timeEpoch": 1428582896500
+  },
+  "body": "{}",
+  "isBase64Encoded": false
+}`
+
+	// SQSEvent is a batch of one SQS message
+	SQSEvent Fixture = `{
+  "Records": [
+    {
+      "messageId": "059f36b4-87a3-44ab-83d2-661975830a7d",
+      "receiptHandle": "AQEBwJnKyrHigUMZj6rYigCgxlaS3SLy0a",
+      "body": "test",
+      "attributes": {
+        "ApproximateReceiveCount": "1",
+        "SentTimestamp": "1545082649183",
+        "SenderId": "AIDAIENQZJOLO23YVJ4VO",
+        "ApproximateFirstReceiveTimestamp": "1545082649185"
+      },
+      "messageAttributes": {},
+      "md5OfBody": "098f6bcd4621d373cade4e832627b4f6",
+      "eventSource": "aws:sqs",
+      "eventSourceARN": "arn:aws:sqs:us-east-2:123456789012:my-queue",
+      "awsRegion": "us-east-2"
+    }
+  ]
+}`
+
+	// SQSFIFOEvent is a batch of SQS FIFO messages
+	SQSFIFOEvent Fixture = `{
+  "Records": [
+    {
+      "messageId": "11d6ee51-4cc7-4302-9e22-7cd8afdaadf5",
+      "receiptHandle": "AQEBBX8nesZEXmkhsmZeyIE8iQAMig7qw",
+      "body": "test",
+      "attributes": {
+        "ApproximateReceiveCount": "1",
+        "SentTimestamp": "1573251510774",
+        "SequenceNumber": "18849496460467696128",
+        "MessageGroupId": "customer-42",
+        "SenderId": "AIDAIO23YVJENQZJOL4VO",
+        "MessageDeduplicationId": "1eea03c3f7e782c7bdc2f2a917f40389314733ff39f5ab16219580c0109ade98",
+        "ApproximateFirstReceiveTimestamp": "1573251510774"
+      },
+      "messageAttributes": {},
+      "md5OfBody": "e4e68fb7bd0e697a0ae8f1bb342846b3",
+      "eventSource": "aws:sqs",
+      "eventSourceARN": "arn:aws:sqs:us-east-2:123456789012:my-queue.fifo",
+      "awsRegion": "us-east-2"
+    },
+    {
+      "messageId": "2e1424d4-f796-459a-8184-9c92662be6da",
+      "receiptHandle": "AQEBzWwaftRI0KuVm4tP+/7q1rGgNqicHq",
+      "body": "test",
+      "attributes": {
+        "ApproximateReceiveCount": "1",
+        "SentTimestamp": "1573251510775",
+        "SequenceNumber": "18849496460467696129",
+        "MessageGroupId": "customer-7",
+        "SenderId": "AIDAIO23YVJENQZJOL4VO",
+        "MessageDeduplicationId": "2b8a6c1d35b7e9f2a4c6d8e0f1a3b5c7d9e1f3a5b7c9d1e3f5a7b9c1d3e5f7a9",
+        "ApproximateFirstReceiveTimestamp": "1573251510775"
+      },
+      "messageAttributes": {},
+      "md5OfBody": "e4e68fb7bd0e697a0ae8f1bb342846b3",
+      "eventSource": "aws:sqs",
+      "eventSourceARN": "arn:aws:sqs:us-east-2:123456789012:my-queue.fifo",
+      "awsRegion": "us-east-2"
+    }
+  ]
+}`
+
+	// SNSEvent is an SNS notification
+	SNSEvent Fixture = `{
+  "Records": [
+    {
+      "EventVersion": "1.0",
+      "EventSubscriptionArn": "arn:aws:sns:us-east-1:123456789012:orders:2bcfbf39-05c3-41de-beaa-fcfcc21c8f55",
+      "EventSource": "aws:sns",
+      "Sns": {
+        "SignatureVersion": "1",
+        "Timestamp": "2021-05-20T16:12:50.000Z",
+        "Signature": "EXAMPLE",
+        "SigningCertUrl": "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-EXAMPLE.pem",
+        "MessageId": "95df01b4-ee98-5cb9-9903-4c221d41eb5e",
+        "Message": "{\"orderId\":\"1234\"}",
+        "MessageAttributes": {},
+        "Type": "Notification",
+        "UnsubscribeUrl": "https://sns.us-east-1.amazonaws.com/?Action=Unsubscribe",
+        "TopicArn": "arn:aws:sns:us-east-1:123456789012:orders",
+        "Subject": "Order placed"
+      }
+    }
+  ]
+}`
+
+	// S3Event is an S3 object creation
+	S3Event Fixture = `{
+  "Records": [
+    {
+      "eventVersion": "2.1",
+      "eventSource": "aws:s3",
+      "awsRegion": "us-east-1",
+      "eventTime": "2021-05-20T16:12:50.000Z",
+      "eventName": "ObjectCreated:Put",
+      "userIdentity": {
+        "principalId": "EXAMPLE"
+      },
+      "requestParameters": {
+        "sourceIPAddress": "127.0.0.1"
+      },
+      "responseElements": {
+        "x-amz-request-id": "EXAMPLE123456789",
+        "x-amz-id-2": "EXAMPLE123/5678abcdefghijklambdaisawesome/mnopqrstuvwxyzABCDEFGH"
+      },
+      "s3": {
+        "s3SchemaVersion": "1.0",
+        "configurationId": "orders-upload",
+        "bucket": {
+          "name": "orders-bucket",
+          "ownerIdentity": {
+            "principalId": "EXAMPLE"
+          },
+          "arn": "arn:aws:s3:::orders-bucket"
+        },
+        "object": {
+          "key": "orders/1234.json",
+          "size": 1024,
+          "eTag": "0123456789abcdef0123456789abcdef",
+          "sequencer": "0A1B2C3D4E5F678901"
+        }
+      }
+    }
+  ]
+}`
+
+	// KinesisEvent is a batch of one Kinesis record
+	KinesisEvent Fixture = `{
+  "Records": [
+    {
+      "kinesis": {
+        "kinesisSchemaVersion": "1.0",
+        "partitionKey": "1",
+        "sequenceNumber": "49590338271490256608559692538361571095921575989136588898",
+        "data": "eyJvcmRlcklkIjoiMTIzNCJ9",
+        "approximateArrivalTimestamp": 1621527170.123
+      },
+      "eventSource": "aws:kinesis",
+      "eventVersion": "1.0",
+      "eventID": "shardId-000000000006:49590338271490256608559692538361571095921575989136588898",
+      "eventName": "aws:kinesis:record",
+      "invokeIdentityArn": "arn:aws:iam::123456789012:role/lambda-role",
+      "awsRegion": "us-east-1",
+      "eventSourceARN": "arn:aws:kinesis:us-east-1:123456789012:stream/orders"
+    }
+  ]
+}`
+
+	// DynamoDBEvent is a batch of one DynamoDB stream record
+	DynamoDBEvent Fixture = `{
+  "Records": [
+    {
+      "eventID": "c4ca4238a0b923820dcc509a6f75849b",
+      "eventName": "INSERT",
+      "eventVersion": "1.1",
+      "eventSource": "aws:dynamodb",
+      "awsRegion": "us-east-1",
+      "dynamodb": {
+        "Keys": {
+          "Id": {
+            "N": "101"
+          }
+        },
+        "NewImage": {
+          "Message": {
+            "S": "New item!"
+          },
+          "Id": {
+            "N": "101"
+          }
+        },
+        "ApproximateCreationDateTime": 1621527170,
+        "SequenceNumber": "4421584500000000017450439091",
+        "SizeBytes": 26,
+        "StreamViewType": "NEW_AND_OLD_IMAGES"
+      },
+      "eventSourceARN": "arn:aws:dynamodb:us-east-1:123456789012:table/orders/stream/2021-05-20T16:12:50.000"
+    }
+  ]
+}`
+
+	// EventBridgeEvent is an EventBridge event
+	EventBridgeEvent Fixture = `{
+  "version": "0",
+  "id": "fd6b1f0a-0d7b-4fb4-a3b4-e8e3a4a0f0b1",
+  "detail-type": "OrderPlaced",
+  "source": "com.example.orders",
+  "account": "123456789012",
+  "time": "2021-05-20T16:12:50Z",
+  "region": "us-east-1",
+  "resources": [],
+  "detail": {
+    "orderId": "1234"
+  }
+}`
+
+	// KafkaEvent is a batch of Kafka records
+	KafkaEvent Fixture = `{
+  "eventSource": "aws:kafka",
+  "eventSourceArn": "arn:aws:kafka:us-east-1:123456789012:cluster/vpc-2priv-2pub/751d2973-a626-431c-9d4e-d7975eb44dd7-2",
+  "bootstrapServers": "b-2.demo-cluster-1.a1bcde.c1.kafka.us-east-1.amazonaws.com:9092,b-1.demo-cluster-1.a1bcde.c1.kafka.us-east-1.amazonaws.com:9092",
+  "records": {
+    "orders-0": [
+      {
+        "topic": "orders",
+        "partition": 0,
+        "offset": 15,
+        "timestamp": 1545084650987,
+        "timestampType": "CREATE_TIME",
+        "key": "b3JkZXItNDI=",
+        "value": "eyJvcmRlciI6IDQyfQ==",
+        "headers": [
+          {
+            "x-datadog-trace-id": [
+              49,
+              50,
+              51,
+              49,
+              52,
+              53,
+              50,
+              51,
+              52,
+              50
+            ]
+          },
+          {
+            "x-datadog-parent-id": [
+              52,
+              53,
+              54,
+              55,
+              56,
+              57,
+              49,
+              48
+            ]
+          },
+          {
+            "x-datadog-sampling-priority": [
+              49
+            ]
+          },
+          {
+            "traceparent": [
+              48,
+              48,
+              45,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              52,
+              57,
+              54,
+              54,
+              55,
+              56,
+              98,
+              54,
+              45,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              48,
+              50,
+              98,
+              57,
+              48,
+              49,
+              51,
+              101,
+              45,
+              48,
+              49
+            ]
+          }
+        ]
+      },
+      {
+        "topic": "orders",
+        "partition": 0,
+        "offset": 16,
+        "timestamp": 1545084650988,
+        "timestampType": "CREATE_TIME",
+        "key": "b3JkZXItNDM=",
+        "value": "eyJvcmRlciI6IDQzfQ==",
+        "headers": [
+          {
+            "x-datadog-trace-id": [
+              57,
+              57,
+              57
+            ]
+          },
+          {
+            "x-datadog-parent-id": [
+              56,
+              56,
+              56
+            ]
+          },
+          {
+            "x-datadog-sampling-priority": [
+              49
+            ]
+          }
+        ]
+      }
+    ],
+    "payments-1": [
+      {
+        "topic": "payments",
+        "partition": 1,
+        "offset": 7,
+        "timestamp": 1545084650990,
+        "timestampType": "CREATE_TIME",
+        "key": "cGF5bWVudC0x",
+        "value": "eyJwYXltZW50IjogMX0=",
+        "headers": [
+          {
+            "content-type": [
+              -84,
+              -19,
+              0,
+              5
+            ]
+          }
+        ]
+      }
+    ]
+  }
+}`
+
+	// StepFunctionsEvent is the input of a Step Functions task
+	StepFunctionsEvent Fixture = `{
+  "Execution": {
+    "Id": "arn:aws:states:sa-east-1:425362996713:execution:abhinav-activity-state-machine:72a7ca3e-901c-41bb-b5a3-5f279b92a316",
+    "Input": {},
+    "Name": "72a7ca3e-901c-41bb-b5a3-5f279b92a316",
+    "RoleArn": "arn:aws:iam::425362996713:role/service-role/StepFunctions-abhinav-activity-state-machine-role-22jpbgl6j",
+    "StartTime": "2024-12-04T19:38:04.069Z",
+    "RedriveCount": 0
+  },
+  "State": {
+    "Name": "Lambda Invoke",
+    "EnteredTime": "2024-12-04T19:38:04.118Z",
+    "RetryCount": 0
+  },
+  "StateMachine": {
+    "Id": "arn:aws:states:sa-east-1:425362996713:stateMachine:abhinav-activity-state-machine",
+    "Name": "abhinav-activity-state-machine"
+  }
+}`
+)
+
+// JSON returns the payload of the fixture
+func (f Fixture) JSON() json.RawMessage {
+	return json.RawMessage(f)
+}
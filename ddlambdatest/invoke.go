@@ -0,0 +1,164 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	// defaultInvokeTimeout is the default timeout of Lambda functions
+	defaultInvokeTimeout = 3 * time.Second
+	defaultRequestID     = "8476a536-e9f4-11e8-9739-2dfe598c3fcd"
+	defaultFunctionARN   = "arn:aws:lambda:us-east-1:123456789012:function:ddlambdatest-function"
+)
+
+type (
+	// InvokeResult is the outcome of an invocation run by Invoke
+	InvokeResult struct {
+		// Response is the response of the handler, marshaled to JSON like the runtime does
+		Response json.RawMessage
+		// Err is the error returned by the handler
+		Err error
+		// Metrics are the metrics recorded by the Recorder set with WithRecorder during the invocation
+		Metrics []RecordedMetric
+	}
+
+	// InvokeOption configures an invocation run by Invoke
+	InvokeOption func(*invokeOptions)
+
+	invokeOptions struct {
+		ctx         context.Context
+		timeout     time.Duration
+		requestID   string
+		functionARN string
+		coldStart   *bool
+		recorder    *Recorder
+	}
+)
+
+// Invoke runs an invocation of a handler wrapped with ddlambda.WrapHandler or Recorder.WrapHandler, like the
+// Lambda runtime does: the payload is marshaled to JSON, unless it's a Fixture, a json.RawMessage or a []byte,
+// and the handler is called through the reflection of the aws-lambda-go runtime, with a context holding the request ID
+// and ARN of the invocation and its deadline. The metrics of the invocation are returned when a Recorder is set
+// with WithRecorder. The error of a payload which can't be marshaled is reported to t.
+func Invoke(t TestingT, handler interface{}, payload interface{}, opts ...InvokeOption) InvokeResult {
+	t.Helper()
+	options := invokeOptions{
+		ctx:         context.Background(),
+		timeout:     defaultInvokeTimeout,
+		requestID:   defaultRequestID,
+		functionARN: defaultFunctionARN,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	msg, err := marshalPayload(payload)
+	if err != nil {
+		t.Errorf("couldn't marshal the payload of the invocation: %v", err)
+		return InvokeResult{Err: err}
+	}
+
+	ctx := lambdacontext.NewContext(options.ctx, &lambdacontext.LambdaContext{
+		AwsRequestID:       options.requestID,
+		InvokedFunctionArn: options.functionARN,
+	})
+	ctx, cancel := context.WithTimeout(ctx, options.timeout)
+	defer cancel()
+	if options.coldStart != nil {
+		ctx = wrapper.WithColdStart(ctx, *options.coldStart)
+	}
+
+	var recorded int
+	if options.recorder != nil {
+		recorded = len(options.recorder.Metrics())
+	}
+	lambdaHandler, ok := handler.(lambda.Handler)
+	if !ok {
+		lambdaHandler = lambda.NewHandler(handler)
+	}
+	response, err := lambdaHandler.Invoke(ctx, msg)
+
+	result := InvokeResult{Response: response, Err: err}
+	if options.recorder != nil {
+		result.Metrics = options.recorder.Metrics()[recorded:]
+	}
+	return result
+}
+
+// Decode unmarshals the response of the invocation into v
+func (r InvokeResult) Decode(v interface{}) error {
+	return json.Unmarshal(r.Response, v)
+}
+
+// WithContext sets the context the context of the invocation derives from. It defaults to context.Background().
+func WithContext(ctx context.Context) InvokeOption {
+	return func(options *invokeOptions) {
+		options.ctx = ctx
+	}
+}
+
+// WithTimeout sets the time left before the deadline of the invocation. It defaults to 3 seconds, the default
+// timeout of Lambda functions.
+func WithTimeout(timeout time.Duration) InvokeOption {
+	return func(options *invokeOptions) {
+		options.timeout = timeout
+	}
+}
+
+// WithRequestID sets the AWS request ID of the invocation
+func WithRequestID(requestID string) InvokeOption {
+	return func(options *invokeOptions) {
+		options.requestID = requestID
+	}
+}
+
+// WithFunctionARN sets the ARN the function was invoked with
+func WithFunctionARN(arn string) InvokeOption {
+	return func(options *invokeOptions) {
+		options.functionARN = arn
+	}
+}
+
+// WithColdStart makes the invocation a cold start, or a warm one. By default, the first invocation of each wrapped
+// handler is a cold start, as in a new container.
+func WithColdStart(coldStart bool) InvokeOption {
+	return func(options *invokeOptions) {
+		options.coldStart = &coldStart
+	}
+}
+
+// WithRecorder returns the metrics recorded by r during the invocation in the result. The handler must send its
+// metrics to r, by being wrapped with r.WrapHandler, or with ddlambda.WrapHandler and r.MetricsClient() as
+// Config.MetricsClient.
+func WithRecorder(r *Recorder) InvokeOption {
+	return func(options *invokeOptions) {
+		options.recorder = r
+	}
+}
+
+// marshalPayload marshals the payload of an invocation to JSON, leaving JSON as it is
+func marshalPayload(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case Fixture:
+		return []byte(p), nil
+	case json.RawMessage:
+		return p, nil
+	case []byte:
+		return p, nil
+	default:
+		return json.Marshal(payload)
+	}
+}
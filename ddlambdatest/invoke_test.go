@@ -0,0 +1,125 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	ddlambda "github.com/DataDog/datadog-lambda-go"
+	"github.com/DataDog/datadog-lambda-go/ddlambdatest"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+type orderResponse struct {
+	Processed int    `json:"processed"`
+	RequestID string `json:"request_id"`
+}
+
+func TestInvokeWithFixture(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	handler := rec.WrapHandler(func(ctx context.Context, event events.SQSEvent) (orderResponse, error) {
+		lc, _ := lambdacontext.FromContext(ctx)
+		ddlambda.MetricWithContext(ctx, "orders.processed", float64(len(event.Records)), "queue:my-queue")
+		return orderResponse{Processed: len(event.Records), RequestID: lc.AwsRequestID}, nil
+	})
+
+	result := ddlambdatest.Invoke(t, handler, ddlambdatest.SQSEvent, ddlambdatest.WithRecorder(rec), ddlambdatest.WithRequestID("req-1"))
+
+	assert.NoError(t, result.Err)
+	var response orderResponse
+	assert.NoError(t, result.Decode(&response))
+	assert.Equal(t, orderResponse{Processed: 1, RequestID: "req-1"}, response)
+	assert.Len(t, result.Metrics, 1)
+	assert.Equal(t, "orders.processed", result.Metrics[0].Name)
+	assert.True(t, result.Metrics[0].HasTags("queue:my-queue"))
+}
+
+func TestInvokeWrappedWithDdlambda(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	handler := ddlambda.WrapHandler(func(ctx context.Context, order map[string]string) (string, error) {
+		ddlambda.MetricWithContext(ctx, "orders.placed", 1, "sku:"+order["sku"])
+		return "ok", nil
+	}, &ddlambda.Config{MetricsClient: rec.MetricsClient()})
+
+	first := ddlambdatest.Invoke(t, handler, map[string]string{"sku": "42"}, ddlambdatest.WithRecorder(rec))
+	second := ddlambdatest.Invoke(t, handler, map[string]string{"sku": "43"}, ddlambdatest.WithRecorder(rec))
+
+	assert.Equal(t, json.RawMessage(`"ok"`), first.Response)
+	// Each result only holds the metrics of its invocation
+	assert.Len(t, first.Metrics, 1)
+	assert.True(t, first.Metrics[0].HasTags("sku:42"))
+	assert.Len(t, second.Metrics, 1)
+	assert.True(t, second.Metrics[0].HasTags("sku:43"))
+}
+
+func TestInvokeDeadlineAndError(t *testing.T) {
+	var remaining time.Duration
+	var arn string
+	handler := ddlambdatest.NewRecorder().WrapHandler(func(ctx context.Context) error {
+		remaining = ddlambda.RemainingTime(ctx)
+		lc, _ := lambdacontext.FromContext(ctx)
+		arn = lc.InvokedFunctionArn
+		return errors.New("payment declined")
+	})
+
+	result := ddlambdatest.Invoke(t, handler, nil,
+		ddlambdatest.WithTimeout(time.Minute),
+		ddlambdatest.WithFunctionARN("arn:aws:lambda:eu-west-1:123456789012:function:checkout"))
+
+	assert.EqualError(t, result.Err, "payment declined")
+	assert.Nil(t, result.Metrics)
+	assert.InDelta(t, time.Minute.Seconds(), remaining.Seconds(), 5)
+	assert.Equal(t, "arn:aws:lambda:eu-west-1:123456789012:function:checkout", arn)
+}
+
+func TestInvokeColdStart(t *testing.T) {
+	var coldStarts []bool
+	handler := ddlambdatest.NewRecorder().WrapHandler(func(ctx context.Context) error {
+		coldStart, _ := ctx.Value("cold_start").(bool)
+		coldStarts = append(coldStarts, coldStart)
+		return nil
+	})
+
+	ddlambdatest.Invoke(t, handler, nil)
+	ddlambdatest.Invoke(t, handler, nil)
+	ddlambdatest.Invoke(t, handler, nil, ddlambdatest.WithColdStart(true))
+	ddlambdatest.Invoke(t, ddlambdatest.NewRecorder().WrapHandler(func(ctx context.Context) error {
+		coldStart, _ := ctx.Value("cold_start").(bool)
+		coldStarts = append(coldStarts, coldStart)
+		return nil
+	}), nil, ddlambdatest.WithColdStart(false))
+
+	assert.Equal(t, []bool{true, false, true, false}, coldStarts)
+}
+
+func TestInvokeReportsUnmarshalablePayloads(t *testing.T) {
+	mt := &mockT{}
+	result := ddlambdatest.Invoke(mt, func() {}, math.NaN())
+
+	assert.Error(t, result.Err)
+	assert.Len(t, mt.errors, 1)
+}
+
+func TestFixturesAreJSON(t *testing.T) {
+	for _, fixture := range []ddlambdatest.Fixture{
+		ddlambdatest.APIGatewayRESTEvent, ddlambdatest.APIGatewayHTTPEvent, ddlambdatest.SQSEvent,
+		ddlambdatest.SQSFIFOEvent, ddlambdatest.SNSEvent, ddlambdatest.S3Event, ddlambdatest.KinesisEvent,
+		ddlambdatest.DynamoDBEvent, ddlambdatest.EventBridgeEvent, ddlambdatest.KafkaEvent,
+		ddlambdatest.StepFunctionsEvent,
+	} {
+		assert.True(t, json.Valid(fixture.JSON()))
+	}
+}
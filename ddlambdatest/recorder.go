@@ -0,0 +1,285 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package ddlambdatest records the metrics sent with ddlambda, so that code using them can be unit tested
+// without sending anything to Datadog. Metrics go through the same batching as in a function, and are recorded
+// instead of being sent to the Datadog API.
+package ddlambdatest
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
+)
+
+type (
+	// RecordedMetric is a metric of a batch flushed to the Recorder. Points with the same name and tags sent
+	// before a flush are merged into a single RecordedMetric.
+	RecordedMetric struct {
+		Name   string
+		Tags   []string
+		Points []RecordedPoint
+	}
+
+	// RecordedPoint is a value of a RecordedMetric, with its timestamp truncated to the second
+	RecordedPoint struct {
+		Timestamp time.Time
+		Value     float64
+	}
+
+	// TestingT is the subset of *testing.T used by the assertion helpers
+	TestingT interface {
+		Helper()
+		Errorf(format string, args ...interface{})
+	}
+
+	// Recorder records the metrics sent with ddlambda. Create one with NewRecorder.
+	Recorder struct {
+		mu       sync.Mutex
+		recorded []RecordedMetric
+
+		listener *metrics.Listener
+		clock    *ManualClock
+		// invocationMu guards ctx and started, and serializes the invocations started and finished. It's apart
+		// from mu, which is taken by the flushes of the invocations.
+		invocationMu sync.Mutex
+		ctx          context.Context
+		// started is true while the listener is processing metrics for an invocation
+		started bool
+	}
+
+	// recorderClient receives the batches of metrics in place of the Datadog API
+	recorderClient struct {
+		recorder *Recorder
+	}
+
+	// recorderListener wraps the metrics listener, so that invocations of wrapped handlers don't overlap with
+	// the invocation started by Context
+	recorderListener struct {
+		recorder *Recorder
+	}
+)
+
+// NewRecorder creates a Recorder. Metrics are recorded when they're flushed, which happens at the end of each
+// invocation of a handler wrapped with WrapHandler, or when FlushNow is called. The Recorder's clock starts at
+// the current time, truncated to the second.
+func NewRecorder() *Recorder {
+	r := &Recorder{clock: NewManualClock(time.Now().Truncate(time.Second))}
+	listener := metrics.MakeListener(metrics.Config{
+		Client:      &recorderClient{recorder: r},
+		TimeService: r.clock,
+		// The ticks stay on the clock's intervals, so that tests are deterministic
+		DisableFlushJitter: true,
+	})
+	r.listener = &listener
+	return r
+}
+
+// Context returns a context for calling code which sends metrics without a wrapped handler. It also becomes the
+// context used by ddlambda.Metric, as if an invocation had started. Call FlushNow before inspecting the metrics.
+func (r *Recorder) Context() context.Context {
+	r.invocationMu.Lock()
+	defer r.invocationMu.Unlock()
+	if !r.started {
+		r.start(context.Background(), json.RawMessage("{}"))
+	}
+	wrapper.SetCurrentContext(r.ctx)
+	return r.ctx
+}
+
+// WrapHandler wraps a handler like ddlambda.WrapHandler, except that its metrics are recorded. Tracing is left
+// out. The metrics of each invocation are flushed when it ends.
+func (r *Recorder) WrapHandler(handler interface{}) interface{} {
+	return wrapper.WrapHandlerWithListeners(handler, &recorderListener{recorder: r})
+}
+
+// MetricsClient returns a client which records the batches it receives with r. Set it as the MetricsClient of the
+// Config of ddlambda.WrapHandler to record the metrics of a handler wrapped with the whole library, including its
+// enhanced metrics.
+func (r *Recorder) MetricsClient() metrics.Client {
+	return &recorderClient{recorder: r}
+}
+
+// Clock returns the clock used to timestamp the metrics sent with ddlambda.Metric. Batches are also flushed
+// when advancing it past the batch interval.
+func (r *Recorder) Clock() *ManualClock {
+	return r.clock
+}
+
+// FlushNow sends the metrics batched since the last flush to the Recorder, and waits until they're recorded.
+func (r *Recorder) FlushNow() {
+	r.invocationMu.Lock()
+	defer r.invocationMu.Unlock()
+	if !r.started {
+		return
+	}
+	r.finish(nil)
+	r.start(context.Background(), json.RawMessage("{}"))
+	wrapper.SetCurrentContext(r.ctx)
+}
+
+// Metrics returns every metric recorded so far, in the order they were flushed
+func (r *Recorder) Metrics() []RecordedMetric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recorded := make([]RecordedMetric, len(r.recorded))
+	copy(recorded, r.recorded)
+	return recorded
+}
+
+// Distributions returns the recorded distribution metrics with the given name
+func (r *Recorder) Distributions(name string) []RecordedMetric {
+	distributions := []RecordedMetric{}
+	for _, metric := range r.Metrics() {
+		if metric.Name == name {
+			distributions = append(distributions, metric)
+		}
+	}
+	return distributions
+}
+
+// Reset forgets the metrics recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = nil
+}
+
+// AssertTagged checks that a metric with the given name was recorded with all of the given tags, and reports
+// an error to t otherwise. It returns whether the assertion passed.
+func (r *Recorder) AssertTagged(t TestingT, name string, tags ...string) bool {
+	t.Helper()
+	distributions := r.Distributions(name)
+	if len(distributions) == 0 {
+		t.Errorf("no metric named %q was recorded", name)
+		return false
+	}
+	for _, metric := range distributions {
+		if metric.HasTags(tags...) {
+			return true
+		}
+	}
+	recordedTags := make([]string, len(distributions))
+	for i, metric := range distributions {
+		recordedTags[i] = "[" + strings.Join(metric.Tags, ", ") + "]"
+	}
+	t.Errorf("no metric named %q was recorded with the tags [%s], recorded tags: %s", name, strings.Join(tags, ", "), strings.Join(recordedTags, " "))
+	return false
+}
+
+// HasTags returns whether the metric has all of the given tags
+func (m RecordedMetric) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, metricTag := range m.Tags {
+			if metricTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Values returns the values of the metric's points
+func (m RecordedMetric) Values() []float64 {
+	values := make([]float64, len(m.Points))
+	for i, point := range m.Points {
+		values[i] = point.Value
+	}
+	return values
+}
+
+// start starts an invocation, with invocationMu held
+func (r *Recorder) start(ctx context.Context, msg json.RawMessage) {
+	r.ctx = r.listener.HandlerStarted(ctx, msg)
+	r.started = true
+}
+
+// finish flushes the metrics of the invocation and ends it, with invocationMu held
+func (r *Recorder) finish(err error) {
+	r.listener.HandlerFinished(r.ctx, nil, err)
+	r.started = false
+}
+
+func (r *Recorder) record(apiMetrics []metrics.APIMetric) {
+	recorded := make([]RecordedMetric, 0, len(apiMetrics))
+	for _, apiMetric := range apiMetrics {
+		recorded = append(recorded, toRecordedMetric(apiMetric))
+	}
+	// The batcher iterates over a map, so the metrics are sorted to make the recording deterministic
+	sort.SliceStable(recorded, func(i, j int) bool {
+		if recorded[i].Name != recorded[j].Name {
+			return recorded[i].Name < recorded[j].Name
+		}
+		return strings.Join(recorded[i].Tags, ",") < strings.Join(recorded[j].Tags, ",")
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = append(r.recorded, recorded...)
+}
+
+// toRecordedMetric reads the points of an APIMetric, which are [timestamp, [value]] pairs for distributions, and
+// [timestamp, value] pairs for gauges
+func toRecordedMetric(apiMetric metrics.APIMetric) RecordedMetric {
+	metric := RecordedMetric{
+		Name:   apiMetric.Name,
+		Tags:   append([]string(nil), apiMetric.Tags...),
+		Points: make([]RecordedPoint, 0, len(apiMetric.Points)),
+	}
+	for _, point := range apiMetric.Points {
+		pair, ok := point.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		timestamp, _ := pair[0].(float64)
+		values, ok := pair[1].([]interface{})
+		if !ok {
+			values = []interface{}{pair[1]}
+		}
+		for _, value := range values {
+			if v, ok := value.(float64); ok {
+				metric.Points = append(metric.Points, RecordedPoint{Timestamp: time.Unix(int64(timestamp), 0), Value: v})
+			}
+		}
+	}
+	return metric
+}
+
+func (c *recorderClient) SendMetrics(apiMetrics []metrics.APIMetric) error {
+	c.recorder.record(apiMetrics)
+	return nil
+}
+
+func (l *recorderListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	r := l.recorder
+	r.invocationMu.Lock()
+	defer r.invocationMu.Unlock()
+	if r.started {
+		r.finish(nil)
+	}
+	r.start(ctx, msg)
+	return r.ctx
+}
+
+func (l *recorderListener) HandlerFinished(ctx context.Context, response interface{}, err error) {
+	r := l.recorder
+	r.invocationMu.Lock()
+	defer r.invocationMu.Unlock()
+	r.finish(err)
+}
@@ -0,0 +1,158 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambdatest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	ddlambda "github.com/DataDog/datadog-lambda-go"
+	"github.com/DataDog/datadog-lambda-go/ddlambdatest"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockT struct {
+	errors []string
+}
+
+func (t *mockT) Helper() {}
+
+func (t *mockT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRecorderContext(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	rec.Context()
+
+	timestamp := time.Unix(1600000000, 0)
+	ddlambda.MetricWithTimestamp("orders.processed", 1, timestamp, "env:prod")
+	ddlambda.MetricWithTimestamp("orders.processed", 2, timestamp, "env:prod")
+	ddlambda.MetricWithTimestamp("orders.processed", 3, timestamp, "env:staging")
+	assert.Empty(t, rec.Metrics())
+
+	rec.FlushNow()
+
+	distributions := rec.Distributions("orders.processed")
+	assert.Len(t, distributions, 2)
+	assert.Equal(t, []float64{1, 2}, distributions[0].Values())
+	assert.Equal(t, timestamp, distributions[0].Points[0].Timestamp)
+	assert.True(t, rec.AssertTagged(t, "orders.processed", "env:prod"))
+	assert.True(t, rec.AssertTagged(t, "orders.processed", "env:staging"))
+}
+
+func TestRecorderKeepsRecordingAfterFlush(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	rec.Context()
+
+	ddlambda.Metric("orders.processed", 1)
+	rec.FlushNow()
+	ddlambda.Metric("orders.processed", 2)
+	rec.FlushNow()
+
+	distributions := rec.Distributions("orders.processed")
+	assert.Len(t, distributions, 2)
+	assert.Equal(t, []float64{1}, distributions[0].Values())
+	assert.Equal(t, []float64{2}, distributions[1].Values())
+
+	rec.Reset()
+	assert.Empty(t, rec.Metrics())
+}
+
+func TestRecorderFlushNowConcurrently(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	rec.Context()
+	ddlambda.Metric("orders.processed", 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec.FlushNow()
+			rec.Context()
+		}()
+	}
+	wg.Wait()
+
+	distributions := rec.Distributions("orders.processed")
+	assert.Len(t, distributions, 1)
+	assert.Equal(t, []float64{1}, distributions[0].Values())
+}
+
+func TestRecorderWrapHandler(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+
+	handler := rec.WrapHandler(func(ctx context.Context) error {
+		ddlambda.Metric("orders.processed", 5, "env:prod")
+		return nil
+	}).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := handler(context.Background(), json.RawMessage("{}"))
+	assert.NoError(t, err)
+	_, err = handler(context.Background(), json.RawMessage("{}"))
+	assert.NoError(t, err)
+
+	distributions := rec.Distributions("orders.processed")
+	assert.Len(t, distributions, 2)
+	assert.Equal(t, []float64{5}, distributions[0].Values())
+	rec.AssertTagged(t, "orders.processed", "env:prod")
+}
+
+func TestRecorderSet(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	rec.Context()
+
+	ddlambda.Set("orders.customers", "alice", "env:prod")
+	ddlambda.Set("orders.customers", "bob", "env:prod")
+	ddlambda.Set("orders.customers", "alice", "env:prod")
+	rec.FlushNow()
+
+	recorded := rec.Metrics()
+	assert.Len(t, recorded, 1)
+	assert.Equal(t, "orders.customers", recorded[0].Name)
+	assert.Equal(t, float64(2), recorded[0].Points[0].Value)
+}
+
+func TestRecorderAssertTaggedFailures(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	rec.Context()
+	ddlambda.Metric("orders.processed", 1, "env:staging")
+	rec.FlushNow()
+
+	mt := &mockT{}
+	assert.False(t, rec.AssertTagged(mt, "orders.failed", "env:prod"))
+	assert.False(t, rec.AssertTagged(mt, "orders.processed", "env:prod"))
+
+	assert.Len(t, mt.errors, 2)
+	assert.Equal(t, `no metric named "orders.failed" was recorded`, mt.errors[0])
+	assert.Contains(t, mt.errors[1], `no metric named "orders.processed" was recorded with the tags [env:prod]`)
+	assert.Contains(t, mt.errors[1], "env:staging")
+}
+
+func TestRecorderSinkInfo(t *testing.T) {
+	ddlambdatest.NewRecorder()
+	assert.Equal(t, ddlambda.SinkCustom, ddlambda.SinkInfo().Sink)
+}
+
+func TestRecorderClock(t *testing.T) {
+	rec := ddlambdatest.NewRecorder()
+	timestamp := time.Unix(1600000000, 0)
+	rec.Clock().Set(timestamp)
+	rec.Context()
+
+	ddlambda.Metric("orders.processed", 1)
+	rec.FlushNow()
+
+	assert.Equal(t, timestamp, rec.Distributions("orders.processed")[0].Points[0].Timestamp)
+}
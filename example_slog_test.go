@@ -0,0 +1,58 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda_test
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	ddlambda "github.com/DataDog/datadog-lambda-go"
+)
+
+// correlatingHandler adds the Datadog correlation fields of the invocation to every record.
+type correlatingHandler struct {
+	slog.Handler
+}
+
+func (h correlatingHandler) Handle(ctx context.Context, r slog.Record) error {
+	for key, value := range ddlambda.LogFields(ctx) {
+		if value != "" {
+			r.AddAttrs(slog.String(key, value))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func ExampleLogFields() {
+	os.Setenv("DD_SERVICE", "checkout")
+	// The environment is read once, when the process starts
+	ddlambda.ReloadEnvironment()
+	defer ddlambda.ReloadEnvironment()
+	defer os.Unsetenv("DD_SERVICE")
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Drop the time so the output is stable
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	log := slog.New(correlatingHandler{handler})
+
+	ddlambda.InvokeDryRun(func(ctx context.Context) {
+		log.InfoContext(ctx, "order placed")
+	}, nil)
+	// Output: {"level":"INFO","msg":"order placed","dd.service":"checkout"}
+}
@@ -6,14 +6,20 @@ require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0 // indirect
 	github.com/DataDog/datadog-go v4.4.0+incompatible
 	github.com/Microsoft/go-winio v0.4.19 // indirect
-	github.com/aws/aws-lambda-go v1.25.0
+	github.com/aws/aws-lambda-go v1.34.1
 	github.com/aws/aws-sdk-go v1.40.2
+	github.com/aws/aws-sdk-go-v2 v1.11.0
+	github.com/aws/aws-sdk-go-v2/service/eventbridge v1.9.0
+	github.com/aws/aws-sdk-go-v2/service/lambda v1.9.0
+	github.com/aws/aws-sdk-go-v2/service/sns v1.8.0
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.9.0
 	github.com/aws/aws-xray-sdk-go v1.6.0
-	github.com/cenkalti/backoff v2.1.1+incompatible
+	github.com/aws/smithy-go v1.9.0
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
 	github.com/philhofer/fwd v1.0.0 // indirect
 	github.com/sony/gobreaker v0.4.1
-	github.com/stretchr/testify v1.7.0
+	github.com/stretchr/testify v1.7.2
+	go.uber.org/goleak v1.1.10
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/DataDog/dd-trace-go.v1 v1.30.0
@@ -0,0 +1,69 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package environment captures the environment variables of the process once, when it starts, so that every part
+// of the library reads the same values for the lifetime of a container, even if they're changed at runtime.
+package environment
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Env is a snapshot of the environment variables of the process. It's never modified once captured, so it can be
+// shared by goroutines.
+type Env struct {
+	vars map[string]string
+}
+
+// current holds the *Env returned by Snapshot
+var current atomic.Value
+
+func init() {
+	Reload()
+}
+
+// Snapshot returns the environment captured when the process started, or by the last Reload
+func Snapshot() *Env {
+	return current.Load().(*Env)
+}
+
+// Reload captures the environment again, for the tests and the functions which change environment variables at
+// runtime. The values already read, such as the configuration of a wrapped handler, are kept.
+func Reload() {
+	current.Store(capture(os.Environ()))
+}
+
+func capture(environ []string) *Env {
+	env := &Env{vars: make(map[string]string, len(environ))}
+	for _, entry := range environ {
+		if i := strings.IndexByte(entry, '='); i > 0 {
+			env.vars[entry[:i]] = entry[i+1:]
+		}
+	}
+	return env
+}
+
+// Get returns the value of a variable, or an empty string when it isn't set
+func (e *Env) Get(name string) string {
+	return e.vars[name]
+}
+
+// Lookup returns the value of a variable, and whether it's set
+func (e *Env) Lookup(name string) (string, bool) {
+	value, ok := e.vars[name]
+	return value, ok
+}
+
+// Bool returns the value of a variable parsed as a boolean, and false when it isn't set or isn't a boolean
+func (e *Env) Bool(name string) bool {
+	value, _ := strconv.ParseBool(e.vars[name])
+	return value
+}
@@ -0,0 +1,51 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package environment
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture(t *testing.T) {
+	env := capture([]string{"DD_ENV=prod", "DD_TAGS=a:1,b=2", "DD_EMPTY=", "=C:=C:\\", "MALFORMED"})
+
+	assert.Equal(t, "prod", env.Get("DD_ENV"))
+	assert.Equal(t, "a:1,b=2", env.Get("DD_TAGS"))
+	value, ok := env.Lookup("DD_EMPTY")
+	assert.True(t, ok)
+	assert.Equal(t, "", value)
+	_, ok = env.Lookup("MALFORMED")
+	assert.False(t, ok)
+}
+
+func TestBool(t *testing.T) {
+	env := capture([]string{"A=true", "B=1", "C=yes", "D=FALSE"})
+
+	assert.True(t, env.Bool("A"))
+	assert.True(t, env.Bool("B"))
+	assert.False(t, env.Bool("C"))
+	assert.False(t, env.Bool("D"))
+	assert.False(t, env.Bool("UNSET"))
+}
+
+func TestSnapshotIsKeptUntilReload(t *testing.T) {
+	defer Reload()
+	os.Setenv("DD_ENVIRONMENT_TEST", "before")
+	defer os.Unsetenv("DD_ENVIRONMENT_TEST")
+	Reload()
+
+	os.Setenv("DD_ENVIRONMENT_TEST", "after")
+	assert.Equal(t, "before", Snapshot().Get("DD_ENVIRONMENT_TEST"))
+
+	Reload()
+	assert.Equal(t, "after", Snapshot().Get("DD_ENVIRONMENT_TEST"))
+}
@@ -0,0 +1,80 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package eventsource
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+type (
+	// Details describes the event which invoked a function beyond its Source. They're only detected for events
+	// from SQS FIFO queues, and describe the first record of the event.
+	Details struct {
+		// MessageGroupID is the message group of the first record
+		MessageGroupID string
+		// MessageDeduplicationID is the deduplication ID of the first record
+		MessageDeduplicationID string
+	}
+
+	// sqsRecord holds the parts of the record of an SQS event used for its Details
+	sqsRecord struct {
+		EventSourceARN string `json:"eventSourceARN"`
+		Attributes     struct {
+			MessageGroupID         string `json:"MessageGroupId"`
+			MessageDeduplicationID string `json:"MessageDeduplicationId"`
+		} `json:"attributes"`
+	}
+)
+
+var detailsKey = new(contextKeytype)
+
+// DetectDetails returns the Details of an event from an SQS FIFO queue, and false for other events. Only the
+// first record is unmarshalled.
+func DetectDetails(source Source, payload []byte) (Details, bool) {
+	if source != SQS {
+		return Details{}, false
+	}
+	s := scanner{data: payload}
+	raw := s.firstRecord()
+	if raw == nil {
+		return Details{}, false
+	}
+	record := sqsRecord{}
+	if err := json.Unmarshal(raw, &record); err != nil || !IsFIFOQueueARN(record.EventSourceARN) {
+		return Details{}, false
+	}
+	return Details{
+		MessageGroupID:         record.Attributes.MessageGroupID,
+		MessageDeduplicationID: record.Attributes.MessageDeduplicationID,
+	}, true
+}
+
+// IsFIFOQueueARN returns true for the ARN of an SQS FIFO queue, such as
+// arn:aws:sqs:us-east-2:123456789012:my-queue.fifo
+func IsFIFOQueueARN(arn string) bool {
+	arnSegments := strings.SplitN(arn, ":", 6)
+	if len(arnSegments) < 6 || arnSegments[0] != "arn" || arnSegments[2] != "sqs" {
+		return false
+	}
+	name := arnSegments[5]
+	return len(name) > len(".fifo") && strings.HasSuffix(name, ".fifo")
+}
+
+// WithDetails stores the Details of the event of an invocation in its context
+func WithDetails(ctx context.Context, details Details) context.Context {
+	return context.WithValue(ctx, detailsKey, details)
+}
+
+// DetailsFromContext returns the Details stored in a context, and whether there are any
+func DetailsFromContext(ctx context.Context) (Details, bool) {
+	details, ok := ctx.Value(detailsKey).(Details)
+	return details, ok
+}
@@ -0,0 +1,79 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package eventsource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectDetailsFIFO(t *testing.T) {
+	payload := loadEvent(t, "sqs-fifo-event.json")
+
+	details, ok := DetectDetails(Detect(payload), payload)
+	assert.True(t, ok)
+	// The details are those of the first record
+	assert.Equal(t, Details{
+		MessageGroupID:         "customer-42",
+		MessageDeduplicationID: "1eea03c3f7e782c7bdc2f2a917f40389314733ff39f5ab16219580c0109ade98",
+	}, details)
+}
+
+func TestDetectDetailsOtherEvents(t *testing.T) {
+	for _, filename := range []string{"sqs-event.json", "sns-event.json", "kinesis-event.json", "apig-rest-event.json", "invalid.json"} {
+		payload := loadEvent(t, filename)
+		_, ok := DetectDetails(Detect(payload), payload)
+		assert.False(t, ok, filename)
+	}
+	for _, payload := range []string{
+		``,
+		`{"Records":[]}`,
+		`{"Records":{}}`,
+		`{"Records":[{"eventSourceARN":"arn:aws:sqs:us-east-2:123456789012:my-queue.fifo","attributes":[]}]}`,
+		`{"Records":[{"eventSourceARN":"arn:aws:sqs:us-east-2:123456789012:my-queue.fifo"`,
+	} {
+		_, ok := DetectDetails(SQS, []byte(payload))
+		assert.False(t, ok, payload)
+	}
+}
+
+func TestDetectDetailsStopsAtFirstRecord(t *testing.T) {
+	payload := `{"Records":[{"eventSourceARN":"arn:aws:sqs:us-east-2:123456789012:q.fifo","attributes":{"MessageGroupId":"g"}},{"body":"`
+	details, ok := DetectDetails(SQS, []byte(payload))
+	assert.True(t, ok)
+	assert.Equal(t, "g", details.MessageGroupID)
+}
+
+func TestIsFIFOQueueARN(t *testing.T) {
+	for arn, expected := range map[string]bool{
+		"arn:aws:sqs:us-east-2:123456789012:my-queue.fifo":        true,
+		"arn:aws-cn:sqs:cn-north-1:123456789012:my-queue.fifo":    true,
+		"arn:aws:sqs:us-east-2:123456789012:my-queue":             false,
+		"arn:aws:sqs:us-east-2:123456789012:.fifo":                false,
+		"arn:aws:sns:us-east-2:123456789012:my-topic.fifo":        false,
+		"arn:aws:sqs:us-east-2:my-queue.fifo":                     false,
+		"my-queue.fifo":                                           false,
+		"":                                                        false,
+		"urn:aws:sqs:us-east-2:123456789012:my-queue.fifo":        false,
+		"arn:aws:sqs:us-east-2:123456789012:my-queue.fifo-backup": false,
+	} {
+		assert.Equal(t, expected, IsFIFOQueueARN(arn), arn)
+	}
+}
+
+func TestDetailsContext(t *testing.T) {
+	_, ok := DetailsFromContext(context.Background())
+	assert.False(t, ok)
+
+	details, ok := DetailsFromContext(WithDetails(context.Background(), Details{MessageGroupID: "g"}))
+	assert.True(t, ok)
+	assert.Equal(t, "g", details.MessageGroupID)
+}
@@ -0,0 +1,113 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package eventsource classifies the event which invoked a function by the service which sent it
+package eventsource
+
+import "context"
+
+// Source is the service which sent the event invoking a function
+type Source string
+
+const (
+	// SQS events hold records with the aws:sqs event source
+	SQS Source = "sqs"
+	// APIGateway events are requests to a REST, HTTP or WebSocket API
+	APIGateway Source = "apigateway"
+	// SNS events hold records with the aws:sns event source
+	SNS Source = "sns"
+	// Kinesis events hold records with the aws:kinesis event source
+	Kinesis Source = "kinesis"
+	// EventBridge events have a detail-type and a source
+	EventBridge Source = "eventbridge"
+	// S3 events hold records with the aws:s3 event source
+	S3 Source = "s3"
+	// DynamoDB events hold stream records with the aws:dynamodb event source
+	DynamoDB Source = "dynamodb"
+	// Unknown events don't come from any of the supported services
+	Unknown Source = "unknown"
+)
+
+type contextKeytype int
+
+var sourceKey = new(contextKeytype)
+
+// recordSources maps the event sources of the records of an event to their Source
+var recordSources = map[string]Source{
+	"aws:sqs":      SQS,
+	"aws:sns":      SNS,
+	"aws:kinesis":  Kinesis,
+	"aws:s3":       S3,
+	"aws:dynamodb": DynamoDB,
+}
+
+// Detect classifies an event by its top-level keys, and the event source of its first record if it has
+// records. Values are skipped without being unmarshalled, and the scan stops as soon as the first record's
+// event source is found, so that it stays cheap for big payloads.
+func Detect(payload []byte) Source {
+	s := scanner{data: payload}
+	if !s.consume('{') {
+		return Unknown
+	}
+
+	var hasRequestContext, hasHTTPMethod, hasRouteKey, hasDetailType, hasSource bool
+	for !s.consume('}') {
+		key, ok := s.readString()
+		if !ok || !s.consume(':') {
+			return Unknown
+		}
+		switch string(key) {
+		case "Records":
+			if source, ok := recordSources[string(s.firstRecordEventSource())]; ok {
+				return source
+			}
+			return Unknown
+		case "requestContext":
+			hasRequestContext = true
+		case "httpMethod":
+			hasHTTPMethod = true
+		case "routeKey":
+			hasRouteKey = true
+		case "detail-type":
+			hasDetailType = true
+		case "source":
+			hasSource = true
+		}
+		if !s.skipValue() {
+			return Unknown
+		}
+		s.consume(',')
+	}
+
+	switch {
+	case hasRequestContext && (hasHTTPMethod || hasRouteKey):
+		return APIGateway
+	case hasDetailType && hasSource:
+		return EventBridge
+	}
+	return Unknown
+}
+
+// WithSource stores the event source of an invocation in its context
+func WithSource(ctx context.Context, source Source) context.Context {
+	return context.WithValue(ctx, sourceKey, source)
+}
+
+// FromContext returns the event source stored in a context, and whether there is one
+func FromContext(ctx context.Context) (Source, bool) {
+	source, ok := ctx.Value(sourceKey).(Source)
+	return source, ok
+}
+
+// Get returns the event source stored in a context, or detects it from the payload when there is none
+func Get(ctx context.Context, payload []byte) Source {
+	if source, ok := FromContext(ctx); ok {
+		return source
+	}
+	return Detect(payload)
+}
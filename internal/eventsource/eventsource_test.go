@@ -0,0 +1,98 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package eventsource
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadEvent(t *testing.T, filename string) []byte {
+	payload, err := ioutil.ReadFile("../testdata/" + filename)
+	assert.NoError(t, err)
+	return payload
+}
+
+func TestDetectFixtures(t *testing.T) {
+	fixtures := map[string]Source{
+		"sqs-event.json":                         SQS,
+		"sqs-fifo-event.json":                    SQS,
+		"apig-rest-event.json":                   APIGateway,
+		"apig-event-with-headers.json":           APIGateway,
+		"apig-http-event.json":                   APIGateway,
+		"sns-event.json":                         SNS,
+		"kinesis-event.json":                     Kinesis,
+		"eventbridge-event.json":                 EventBridge,
+		"s3-event.json":                          S3,
+		"dynamodb-event.json":                    DynamoDB,
+		"kafka-event.json":                       Unknown,
+		"step-functions-event.json":              Unknown,
+		"non-proxy-with-headers.json":            Unknown,
+		"invalid.json":                           Unknown,
+		"non-proxy-no-headers.json":              Unknown,
+		"apig-event-no-headers.json":             APIGateway,
+		"non-proxy-with-mixed-case-headers.json": Unknown,
+	}
+	for filename, expected := range fixtures {
+		assert.Equal(t, expected, Detect(loadEvent(t, filename)), filename)
+	}
+}
+
+func TestDetectInvalidPayloads(t *testing.T) {
+	for _, payload := range []string{
+		``,
+		`[]`,
+		`"Records"`,
+		`{`,
+		`{"Records":`,
+		`{"Records":[]}`,
+		`{"Records":[{"eventSource":"aws:unknown"}]}`,
+		`{"Records":[{"eventID":"1"}]}`,
+		`{"requestContext":{"stage":"prod"}`,
+		`{"detail-type":"OrderPlaced"}`,
+		`{"requestContext":{},"httpMethod":"GET"`,
+	} {
+		assert.Equal(t, Unknown, Detect([]byte(payload)), payload)
+	}
+}
+
+func TestDetectSkipsNestedValues(t *testing.T) {
+	// The keys of nested objects, and strings which look like keys, aren't top-level keys
+	assert.Equal(t, Unknown, Detect([]byte(`{"body":{"requestContext":{},"httpMethod":"GET"}}`)))
+	assert.Equal(t, Unknown, Detect([]byte(`{"body":"\"requestContext\":{},\"httpMethod\":\"GET\""}`)))
+	assert.Equal(t, EventBridge, Detect([]byte(` { "detail" : [1, true, null, {"a": [2.5e3]}], "detail-type":"x", "source" : "y" } `)))
+	assert.Equal(t, SQS, Detect([]byte(`{"Records":[{"messageId":"1","attributes":{"a":"}"},"eventSource":"aws:sqs"}]}`)))
+}
+
+func TestDetectStopsAtFirstRecord(t *testing.T) {
+	// The records after the first one aren't scanned, so they can be malformed
+	payload := `{"Records":[{"eventSource":"aws:kinesis"},` + strings.Repeat(`{"data":"`, 1000)
+	assert.Equal(t, Kinesis, Detect([]byte(payload)))
+}
+
+func TestSourceContext(t *testing.T) {
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+
+	source, ok := FromContext(WithSource(context.Background(), SNS))
+	assert.True(t, ok)
+	assert.Equal(t, SNS, source)
+}
+
+func BenchmarkDetectSQS(b *testing.B) {
+	payload, _ := ioutil.ReadFile("../testdata/sqs-event.json")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Detect(payload)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package eventsource
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+type (
+	// KafkaEvent is an MSK or self-managed Kafka event. The events package doesn't expose record headers,
+	// which is where Kafka producers put the trace context.
+	KafkaEvent struct {
+		EventSource string `json:"eventSource"`
+		// Records are grouped by topic and partition
+		Records map[string][]KafkaRecord `json:"records"`
+	}
+
+	// KafkaRecord is a record of a Kafka event
+	KafkaRecord struct {
+		Topic   string                        `json:"topic"`
+		Headers []map[string]KafkaHeaderValue `json:"headers"`
+	}
+
+	// KafkaHeaderValue is the value of a Kafka record header, delivered either as an array of bytes or as
+	// a base64 encoded string.
+	KafkaHeaderValue []byte
+)
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (v *KafkaHeaderValue) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		*v = decoded
+		return nil
+	}
+
+	// Bytes produced by Java clients are signed, so values may be negative
+	var bytes []int
+	if err := json.Unmarshal(data, &bytes); err != nil {
+		return err
+	}
+	*v = make([]byte, len(bytes))
+	for i, b := range bytes {
+		(*v)[i] = byte(b)
+	}
+	return nil
+}
+
+// ParseKafkaEvent unmarshals an MSK or self-managed Kafka event, and returns false for other events.
+func ParseKafkaEvent(payload []byte) (KafkaEvent, bool) {
+	event := KafkaEvent{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return KafkaEvent{}, false
+	}
+	if event.EventSource != "aws:kafka" && event.EventSource != "SelfManagedKafka" {
+		return KafkaEvent{}, false
+	}
+	return event, true
+}
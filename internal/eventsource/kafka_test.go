@@ -0,0 +1,47 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package eventsource
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKafkaEvent(t *testing.T) {
+	event, ok := ParseKafkaEvent(loadEvent(t, "kafka-event.json"))
+	assert.True(t, ok)
+	assert.Equal(t, "aws:kafka", event.EventSource)
+	assert.Equal(t, "orders", event.Records["orders-0"][0].Topic)
+	assert.Equal(t, KafkaHeaderValue("1231452342"), event.Records["orders-0"][0].Headers[0]["x-datadog-trace-id"])
+}
+
+func TestParseKafkaEventOtherEvents(t *testing.T) {
+	for _, payload := range []string{
+		`{"eventSource": "aws:sqs", "records": {"orders-0": [{"topic": "orders"}]}}`,
+		`{"Records": [{"eventSource": "aws:sqs"}]}`,
+		`not json`,
+	} {
+		_, ok := ParseKafkaEvent([]byte(payload))
+		assert.False(t, ok, payload)
+	}
+}
+
+func TestKafkaHeaderValueBase64(t *testing.T) {
+	var value KafkaHeaderValue
+	assert.NoError(t, json.Unmarshal([]byte(`"MTIzMTQ1MjM0Mg=="`), &value))
+	assert.Equal(t, KafkaHeaderValue("1231452342"), value)
+}
+
+func TestKafkaHeaderValueSignedBytes(t *testing.T) {
+	var value KafkaHeaderValue
+	assert.NoError(t, json.Unmarshal([]byte(`[-84, -19, 0, 5]`), &value))
+	assert.Equal(t, KafkaHeaderValue{0xac, 0xed, 0x00, 0x05}, value)
+}
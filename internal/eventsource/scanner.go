@@ -0,0 +1,154 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package eventsource
+
+// scanner walks through a JSON payload without unmarshalling it. Malformed payloads make its methods return
+// false, rather than an error, as they're only classified as unknown events.
+type scanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *scanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips the white space before c, and c itself. It returns false if the next character isn't c.
+func (s *scanner) consume(c byte) bool {
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// readString returns the raw content of the next string, with its escape sequences left as is
+func (s *scanner) readString() ([]byte, bool) {
+	if !s.consume('"') {
+		return nil, false
+	}
+	start := s.pos
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '\\':
+			s.pos += 2
+		case '"':
+			s.pos++
+			return s.data[start : s.pos-1], true
+		default:
+			s.pos++
+		}
+	}
+	return nil, false
+}
+
+// skipValue skips the next value, whatever its type
+func (s *scanner) skipValue() bool {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return false
+	}
+	switch s.data[s.pos] {
+	case '"':
+		_, ok := s.readString()
+		return ok
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case '"':
+				if _, ok := s.readString(); !ok {
+					return false
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			s.pos++
+			if depth == 0 {
+				return true
+			}
+		}
+		return false
+	default:
+		// A number, or true, false or null
+		start := s.pos
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return s.pos > start
+			}
+			s.pos++
+		}
+		return s.pos > start
+	}
+}
+
+// firstRecordEventSource reads the eventSource, or EventSource for SNS, of the first record of the array of
+// records at the current position. It returns nil if there is none.
+func (s *scanner) firstRecordEventSource() []byte {
+	if !s.consume('[') || !s.consume('{') {
+		return nil
+	}
+	for !s.consume('}') {
+		key, ok := s.readString()
+		if !ok || !s.consume(':') {
+			return nil
+		}
+		if k := string(key); k == "eventSource" || k == "EventSource" {
+			value, _ := s.readString()
+			return value
+		}
+		if !s.skipValue() {
+			return nil
+		}
+		s.consume(',')
+	}
+	return nil
+}
+
+// firstRecord returns the raw first record of the array of records of the event at the current position. It
+// returns nil if there is none.
+func (s *scanner) firstRecord() []byte {
+	if !s.consume('{') {
+		return nil
+	}
+	for !s.consume('}') {
+		key, ok := s.readString()
+		if !ok || !s.consume(':') {
+			return nil
+		}
+		if string(key) == "Records" {
+			if !s.consume('[') {
+				return nil
+			}
+			s.skipSpace()
+			start := s.pos
+			if !s.skipValue() {
+				return nil
+			}
+			return s.data[start:s.pos]
+		}
+		if !s.skipValue() {
+			return nil
+		}
+		s.consume(',')
+	}
+	return nil
+}
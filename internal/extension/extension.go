@@ -0,0 +1,140 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+const (
+	// Path is where the Datadog Extension is installed when the function uses its Lambda layer
+	Path = "/opt/extensions/datadog-agent"
+	// DefaultURL is the address the Datadog Extension listens on for requests from the library
+	DefaultURL = "http://localhost:8124"
+
+	startInvocationRoute = "lambda/start-invocation"
+	endInvocationRoute   = "lambda/end-invocation"
+
+	// defaultTimeout keeps the extension from noticeably delaying an invocation when it's slow to respond
+	defaultTimeout = 100 * time.Millisecond
+)
+
+const (
+	traceIDHeader                = "x-datadog-trace-id"
+	parentIDHeader               = "x-datadog-parent-id"
+	spanIDHeader                 = "x-datadog-span-id"
+	samplingPriorityHeader       = "x-datadog-sampling-priority"
+	tagsHeader                   = "x-datadog-tags"
+	invocationErrorHeader        = "x-datadog-invocation-error"
+	invocationErrorMessageHeader = "x-datadog-invocation-error-msg"
+)
+
+// Client notifies the Datadog Extension of the start and end of each invocation, so that it can coordinate
+// tracing and flush its data at the right time. Requests are best effort: failures are logged and ignored.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// IsInstalled returns whether the Datadog Extension is installed alongside the function
+func IsInstalled() bool {
+	_, err := os.Stat(Path)
+	return err == nil
+}
+
+// MakeClient creates a Client for the Datadog Extension listening at baseURL
+func MakeClient(baseURL string) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// StartInvocation sends the invocation's event to the extension. It returns the Datadog trace headers found in
+// the extension's response, which is empty when the extension didn't supply a trace context.
+func (c *Client) StartInvocation(ctx context.Context, event json.RawMessage) map[string]string {
+	headers := map[string]string{}
+
+	resp, err := c.post(ctx, startInvocationRoute, event, nil)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Couldn't notify the Datadog Extension of the invocation start: %v", err))
+		return headers
+	}
+
+	if resp.Get(traceIDHeader) == "" {
+		return headers
+	}
+	for _, key := range []string{traceIDHeader, parentIDHeader, samplingPriorityHeader, tagsHeader} {
+		if value := resp.Get(key); value != "" {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// EndInvocation sends the invocation's response and error to the extension, along with the trace headers of the
+// function execution span, when there is one.
+func (c *Client) EndInvocation(ctx context.Context, response interface{}, err error, traceHeaders map[string]string) {
+	body, marshalErr := json.Marshal(response)
+	if marshalErr != nil {
+		body = []byte("{}")
+	}
+
+	headers := map[string]string{}
+	if traceID := traceHeaders[traceIDHeader]; traceID != "" {
+		headers[traceIDHeader] = traceID
+		headers[spanIDHeader] = traceHeaders[parentIDHeader]
+		if samplingPriority := traceHeaders[samplingPriorityHeader]; samplingPriority != "" {
+			headers[samplingPriorityHeader] = samplingPriority
+		}
+	}
+	if err != nil {
+		headers[invocationErrorHeader] = "true"
+		headers[invocationErrorMessageHeader] = err.Error()
+	}
+
+	if _, err := c.post(ctx, endInvocationRoute, body, headers); err != nil {
+		logger.Debug(fmt.Sprintf("Couldn't notify the Datadog Extension of the invocation end: %v", err))
+	}
+}
+
+// post sends body to the given route of the extension, and returns the headers of a successful response
+func (c *Client) post(ctx context.Context, route string, body []byte, headers map[string]string) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", c.baseURL, route), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused by the next invocation
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.Header, nil
+}
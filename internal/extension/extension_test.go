@@ -0,0 +1,103 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartInvocationReturnsTraceHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(traceIDHeader, "1231452342")
+		w.Header().Set(parentIDHeader, "45678910")
+		w.Header().Set("x-unrelated", "value")
+	}))
+	defer server.Close()
+
+	headers := MakeClient(server.URL).StartInvocation(context.Background(), json.RawMessage("{}"))
+
+	assert.Equal(t, map[string]string{traceIDHeader: "1231452342", parentIDHeader: "45678910"}, headers)
+}
+
+func TestStartInvocationWithoutTraceHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(parentIDHeader, "45678910")
+	}))
+	defer server.Close()
+
+	headers := MakeClient(server.URL).StartInvocation(context.Background(), json.RawMessage("{}"))
+
+	assert.Empty(t, headers)
+}
+
+func TestStartInvocationIgnoresFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(traceIDHeader, "1231452342")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	assert.Empty(t, MakeClient(server.URL).StartInvocation(context.Background(), json.RawMessage("{}")))
+	assert.Empty(t, MakeClient("http://127.0.0.1:1").StartInvocation(context.Background(), json.RawMessage("{}")))
+}
+
+func TestStartInvocationTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+	headers := MakeClient(server.URL).StartInvocation(context.Background(), json.RawMessage("{}"))
+
+	assert.Empty(t, headers)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestEndInvocationSendsError(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/lambda/end-invocation", r.URL.Path)
+		received = r.Header
+	}))
+	defer server.Close()
+
+	traceHeaders := map[string]string{traceIDHeader: "1231452342", parentIDHeader: "45678910", samplingPriorityHeader: "1"}
+	MakeClient(server.URL).EndInvocation(context.Background(), nil, errors.New("something went wrong"), traceHeaders)
+
+	assert.Equal(t, "true", received.Get(invocationErrorHeader))
+	assert.Equal(t, "something went wrong", received.Get(invocationErrorMessageHeader))
+	assert.Equal(t, "1231452342", received.Get(traceIDHeader))
+	assert.Equal(t, "45678910", received.Get(spanIDHeader))
+	assert.Equal(t, "1", received.Get(samplingPriorityHeader))
+}
+
+func TestEndInvocationWithUnmarshalableResponse(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 16)
+		n, _ := r.Body.Read(buf)
+		body = string(buf[:n])
+	}))
+	defer server.Close()
+
+	MakeClient(server.URL).EndInvocation(context.Background(), make(chan int), nil, nil)
+
+	assert.Equal(t, "{}", body)
+}
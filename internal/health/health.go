@@ -0,0 +1,135 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package health records the degraded modes the library falls back to, such as dropping metrics when no API key
+// is set, so that they're reported once instead of failing silently.
+package health
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// Reason is a stable code identifying a degraded mode or a misuse. Reasons are meant to be matched by monitors and smoke
+// tests, so they never change.
+type Reason string
+
+const (
+	// ReasonNoAPIKey means metrics are dropped, as no API key is set and neither the Datadog Extension nor the
+	// log forwarder is used
+	ReasonNoAPIKey Reason = "no_api_key"
+	// ReasonExtensionUnreachable means the Datadog Extension is installed but didn't respond, so metrics are
+	// sent another way, if any
+	ReasonExtensionUnreachable Reason = "extension_unreachable"
+	// ReasonKMSDecryptFailed means the KMS encrypted API key couldn't be decrypted
+	ReasonKMSDecryptFailed Reason = "kms_decrypt_failed"
+	// ReasonAPIKeyRejected means the Datadog API rejected the API key
+	ReasonAPIKeyRejected Reason = "api_key_rejected"
+	// ReasonInvalidHandler means the handler wasn't wrapped, as its signature isn't one of a Lambda handler
+	ReasonInvalidHandler Reason = "invalid_handler"
+	// ReasonInitFailed means the listeners couldn't be initialized, so the handler runs without them
+	ReasonInitFailed Reason = "init_failed"
+
+	// ReasonWrappedTwice means more than one handler was wrapped, or a wrapped handler was wrapped again
+	ReasonWrappedTwice Reason = "wrapped_twice"
+	// ReasonMetricWithoutWrapper means metrics were sent without the listener of a wrapped handler, so they're
+	// dropped
+	ReasonMetricWithoutWrapper Reason = "metric_without_wrapper"
+)
+
+// Status is the health of the library since the container started
+type Status struct {
+	// Operational is true as long as the library didn't enter a degraded mode
+	Operational bool
+	// Degraded lists the reasons of the degraded modes entered, in order
+	Degraded []Reason
+	// Warnings lists the misuses of the library detected, in order. They don't make it less operational, but
+	// may lose or duplicate metrics.
+	Warnings []Reason
+}
+
+var (
+	mu       sync.Mutex
+	degraded []Reason
+	// unreported are the reasons whose metric wasn't sent yet
+	unreported []Reason
+	warnings   []Reason
+)
+
+// Degrade records the transition into a degraded mode. The first time for each reason, it logs a structured
+// error with the reason code and the detail of the failure, and returns true. Later calls with the same reason
+// only return false, so that a failure repeated every invocation isn't logged every invocation.
+func Degrade(reason Reason, detail error) bool {
+	mu.Lock()
+	for _, r := range degraded {
+		if r == reason {
+			mu.Unlock()
+			return false
+		}
+	}
+	degraded = append(degraded, reason)
+	unreported = append(unreported, reason)
+	mu.Unlock()
+
+	logger.ErrorWithFields(fmt.Errorf("entering degraded mode %s: %v", reason, detail), logger.Fields{
+		"reason": string(reason),
+	})
+	return true
+}
+
+// Warn records a misuse of the library, such as wrapping the handler twice. The first time for each reason, it
+// logs a warning with the reason code and how to fix the misuse, and returns true. Later calls with the same
+// reason only return false.
+func Warn(reason Reason, remediation string) bool {
+	mu.Lock()
+	for _, r := range warnings {
+		if r == reason {
+			mu.Unlock()
+			return false
+		}
+	}
+	warnings = append(warnings, reason)
+	mu.Unlock()
+
+	logger.Warn(fmt.Sprintf("%s: %s", reason, remediation))
+	return true
+}
+
+// GetStatus returns the health of the library
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	status := Status{
+		Operational: len(degraded) == 0,
+		Degraded:    append([]Reason{}, degraded...),
+	}
+	if len(warnings) > 0 {
+		status.Warnings = append([]Reason{}, warnings...)
+	}
+	return status
+}
+
+// DrainUnreported returns the reasons entered since the last call, whose metric should be sent
+func DrainUnreported() []Reason {
+	mu.Lock()
+	defer mu.Unlock()
+	reasons := unreported
+	unreported = nil
+	return reasons
+}
+
+// Reset forgets the degraded modes entered and the warnings. It's meant for tests.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	degraded = nil
+	unreported = nil
+	warnings = nil
+}
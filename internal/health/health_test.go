@@ -0,0 +1,66 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package health
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDegradeLogsOncePerReason(t *testing.T) {
+	defer Reset()
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stderr)
+
+	assert.Equal(t, Status{Operational: true, Degraded: []Reason{}}, GetStatus())
+
+	assert.True(t, Degrade(ReasonNoAPIKey, errors.New("no API key is set")))
+	assert.False(t, Degrade(ReasonNoAPIKey, errors.New("no API key is set")))
+	assert.True(t, Degrade(ReasonExtensionUnreachable, errors.New("connection refused")))
+
+	assert.Equal(t, 2, strings.Count(output.String(), "entering degraded mode"))
+	assert.Contains(t, output.String(), `entering degraded mode no_api_key: no API key is set`)
+	assert.Contains(t, output.String(), `"reason":"extension_unreachable"`)
+	assert.Equal(t, Status{Operational: false, Degraded: []Reason{ReasonNoAPIKey, ReasonExtensionUnreachable}}, GetStatus())
+}
+
+func TestDrainUnreported(t *testing.T) {
+	defer Reset()
+	logger.SetOutput(&bytes.Buffer{})
+	defer logger.SetOutput(os.Stderr)
+
+	Degrade(ReasonKMSDecryptFailed, errors.New("access denied"))
+	assert.Equal(t, []Reason{ReasonKMSDecryptFailed}, DrainUnreported())
+	assert.Empty(t, DrainUnreported())
+
+	// A reason already entered isn't reported again
+	Degrade(ReasonKMSDecryptFailed, errors.New("access denied"))
+	assert.Empty(t, DrainUnreported())
+}
+
+func TestWarnLogsOncePerReason(t *testing.T) {
+	defer Reset()
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stderr)
+
+	assert.True(t, Warn(ReasonWrappedTwice, "wrap the handler once"))
+	assert.False(t, Warn(ReasonWrappedTwice, "wrap the handler once"))
+
+	assert.Equal(t, 1, strings.Count(output.String(), "wrapped_twice: wrap the handler once"))
+	// Warnings don't take the library out of operation
+	assert.Equal(t, Status{Operational: true, Degraded: []Reason{}, Warnings: []Reason{ReasonWrappedTwice}}, GetStatus())
+}
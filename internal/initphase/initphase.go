@@ -0,0 +1,118 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package initphase records the phases the init of the function spent its time on, between the boundaries marked
+// by the function, so that they're reported on the first invocation.
+package initphase
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// UnmarkedPhase names the phase from the last boundary marked to the start of the first invocation
+const UnmarkedPhase = "unmarked"
+
+// Phase is a phase of the init, which ended at a boundary marked with Mark, or when the first invocation started
+type Phase struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+type (
+	boundary struct {
+		name string
+		at   time.Time
+	}
+
+	contextKeytype int
+)
+
+var (
+	// packageInitTime approximates when the init of the function started, as the package is initialized before
+	// the packages of the function which import the library
+	packageInitTime = time.Now()
+
+	// mu guards the boundaries and the end of the init
+	mu         sync.Mutex
+	boundaries []boundary
+	// ended is when the first invocation started, and the zero time while the init runs
+	ended time.Time
+
+	// phasesKey is the key of the phases of the init in the context of the invocation which ended it
+	phasesKey = new(contextKeytype)
+)
+
+// PackageInitTime returns when the package was initialized, which is where the first phase starts
+func PackageInitTime() time.Time {
+	return packageInitTime
+}
+
+// Mark records a boundary at, ending the phase named name, which started at the previous boundary or when the
+// package was initialized. The boundaries marked once the first invocation started, or without a name, are ignored
+// and logged, and false is returned.
+func Mark(name string, at time.Time) bool {
+	if name == "" {
+		logger.Debug("ignoring an init phase without a name")
+		return false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !ended.IsZero() {
+		logger.Debug(fmt.Sprintf("ignoring the init phase %q, as it was marked after the first invocation started", name))
+		return false
+	}
+	boundaries = append(boundaries, boundary{name: name, at: at})
+	return true
+}
+
+// End ends the init when the first invocation starts, and returns the phases marked during the init, in order,
+// followed by the unmarked phase until at. It returns nil when no boundary was marked, and once the init already
+// ended, so that the phases are reported by a single invocation.
+func End(at time.Time) []Phase {
+	mu.Lock()
+	defer mu.Unlock()
+	if !ended.IsZero() {
+		return nil
+	}
+	ended = at
+	if len(boundaries) == 0 {
+		return nil
+	}
+	phases := make([]Phase, 0, len(boundaries)+1)
+	start := packageInitTime
+	for _, b := range boundaries {
+		phases = append(phases, Phase{Name: b.name, Start: start, End: b.at})
+		start = b.at
+	}
+	return append(phases, Phase{Name: UnmarkedPhase, Start: start, End: at})
+}
+
+// NewContext returns a context carrying the phases of the init, for the invocation which ended it
+func NewContext(ctx context.Context, phases []Phase) context.Context {
+	return context.WithValue(ctx, phasesKey, phases)
+}
+
+// FromContext returns the phases of the init carried by ctx, which only the invocation which ended it carries
+func FromContext(ctx context.Context) []Phase {
+	phases, _ := ctx.Value(phasesKey).([]Phase)
+	return phases
+}
+
+// Reset forgets the boundaries marked and the end of the init. It's meant for tests.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	boundaries = nil
+	ended = time.Time{}
+}
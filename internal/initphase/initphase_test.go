@@ -0,0 +1,60 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package initphase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndReturnsThePhases(t *testing.T) {
+	defer Reset()
+	start := PackageInitTime()
+
+	assert.True(t, Mark("config", start.Add(40*time.Millisecond)))
+	assert.True(t, Mark("db_connect", start.Add(250*time.Millisecond)))
+
+	assert.Equal(t, []Phase{
+		{Name: "config", Start: start, End: start.Add(40 * time.Millisecond)},
+		{Name: "db_connect", Start: start.Add(40 * time.Millisecond), End: start.Add(250 * time.Millisecond)},
+		{Name: UnmarkedPhase, Start: start.Add(250 * time.Millisecond), End: start.Add(300 * time.Millisecond)},
+	}, End(start.Add(300*time.Millisecond)))
+	// The phases are returned to the invocation which ended the init only
+	assert.Nil(t, End(start.Add(time.Second)))
+}
+
+func TestMarkAfterTheFirstInvocationIsIgnored(t *testing.T) {
+	defer Reset()
+	start := PackageInitTime()
+
+	assert.False(t, Mark("", start))
+	assert.True(t, Mark("config", start.Add(time.Millisecond)))
+	phases := End(start.Add(2 * time.Millisecond))
+	assert.False(t, Mark("late", start.Add(3*time.Millisecond)))
+
+	assert.Len(t, phases, 2)
+	assert.Equal(t, "config", phases[0].Name)
+}
+
+func TestEndWithoutBoundaries(t *testing.T) {
+	defer Reset()
+
+	assert.Nil(t, End(PackageInitTime().Add(time.Second)))
+	assert.False(t, Mark("late", time.Now()))
+}
+
+func TestPhasesContext(t *testing.T) {
+	phases := []Phase{{Name: "config", Start: PackageInitTime(), End: PackageInitTime().Add(time.Millisecond)}}
+
+	assert.Equal(t, phases, FromContext(NewContext(context.Background(), phases)))
+	assert.Nil(t, FromContext(context.Background()))
+}
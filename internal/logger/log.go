@@ -6,6 +6,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
 )
 
 // LogLevel represents the level of logging that should be performed
@@ -18,9 +21,30 @@ const (
 	LevelError LogLevel = iota
 )
 
+// Format represents the format of structured log messages
+type Format int
+
+const (
+	// FormatText prefixes each structured message with the date and time, like the standard log package
+	FormatText Format = iota
+	// FormatJSON writes each structured message as a single line JSON object, with a timestamp field
+	FormatJSON
+)
+
+// Fields are additional details about a structured message, logged under the dd.lambda_go key
+type Fields map[string]interface{}
+
+// timestampFormat is ISO 8601 with milliseconds, which Datadog log pipelines recognise as the log date
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
 var (
 	logLevel           = LevelError
+	format             = FormatText
 	output   io.Writer = os.Stdout
+	scrubber scrub.Scrubber
+	now      = time.Now
+	// credentials masks the credentials in every structured message, even without a scrubber
+	credentials = scrub.MakeCredentialScrubber()
 )
 
 // SetLogLevel set the level of logging for the ddlambda
@@ -28,6 +52,21 @@ func SetLogLevel(ll LogLevel) {
 	logLevel = ll
 }
 
+// SetFormat sets the format of structured log messages. Raw messages are unaffected.
+func SetFormat(f Format) {
+	format = f
+}
+
+// SetScrubber sets the Scrubber applied to the messages of structured logs. Raw messages aren't scrubbed.
+func SetScrubber(s scrub.Scrubber) {
+	scrubber = s
+}
+
+// AddSecret adds a secret, such as the API key, which is masked wherever it appears in structured messages
+func AddSecret(secret string) {
+	credentials.AddSecret(secret)
+}
+
 // SetOutput changes the writer for the logger
 func SetOutput(w io.Writer) {
 	log.SetOutput(w)
@@ -36,41 +75,100 @@ func SetOutput(w io.Writer) {
 
 // Error logs a structured error message to stdout
 func Error(err error) {
+	ErrorWithFields(err, nil)
+}
 
-	type logStructure struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
+// ErrorWithFields logs a structured error message with additional details to stdout
+func ErrorWithFields(err error, fields Fields) {
+	write("error", err.Error(), fields)
+}
 
-	finalMessage := logStructure{
-		Status:  "error",
-		Message: fmt.Sprintf("datadog: %s", err.Error()),
-	}
-	result, _ := json.Marshal(finalMessage)
+// Warn logs a structured warning message to stdout
+func Warn(message string) {
+	write("warning", message, nil)
+}
 
-	log.Println(string(result))
+// InfoWithFields logs a structured informational message with additional details to stdout, regardless of the log level.
+// It's meant for messages the user explicitly asked for.
+func InfoWithFields(message string, fields Fields) {
+	write("info", message, fields)
 }
 
 // Debug logs a structured log message to stdout
 func Debug(message string) {
+	DebugWithFields(message, nil)
+}
+
+// DebugWithFields logs a structured log message with additional details to stdout
+func DebugWithFields(message string, fields Fields) {
 	if logLevel > LevelDebug {
 		return
 	}
+	write("debug", message, fields)
+}
+
+// DebugEnabled returns whether debug messages are logged, so that expensive debug messages can be skipped
+func DebugEnabled() bool {
+	return logLevel <= LevelDebug
+}
+
+// Raw prints a raw message to the logs.
+func Raw(message string) {
+	fmt.Fprintln(output, message)
+}
+
+func write(status, message string, fields Fields) {
 	type logStructure struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
+		Status    string `json:"status"`
+		Message   string `json:"message"`
+		Timestamp string `json:"timestamp,omitempty"`
+		// The fields are namespaced so they don't collide with attributes of the log pipeline
+		Fields Fields `json:"dd.lambda_go,omitempty"`
 	}
+
 	finalMessage := logStructure{
-		Status:  "debug",
-		Message: fmt.Sprintf("datadog: %s", message),
+		Status:  status,
+		Message: fmt.Sprintf("datadog: %s", scrubString(message)),
+		Fields:  scrubFields(fields),
+	}
+	if format == FormatJSON {
+		finalMessage.Timestamp = now().UTC().Format(timestampFormat)
 	}
 
-	result, _ := json.Marshal(finalMessage)
+	result, err := json.Marshal(finalMessage)
+	if err != nil {
+		// A field couldn't be serialized, the message is more useful without its fields than not at all
+		finalMessage.Fields = nil
+		result, _ = json.Marshal(finalMessage)
+	}
 
+	if format == FormatJSON {
+		fmt.Fprintln(log.Writer(), string(result))
+		return
+	}
 	log.Println(string(result))
 }
 
-// Raw prints a raw message to the logs.
-func Raw(message string) {
-	fmt.Fprintln(output, message)
+// scrubFields returns a copy of fields with errors converted to their message, and scrubbed string values
+func scrubFields(fields Fields) Fields {
+	if len(fields) == 0 {
+		return nil
+	}
+	scrubbed := make(Fields, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case error:
+			scrubbed[key] = scrubString(v.Error())
+		case string:
+			scrubbed[key] = scrubString(v)
+		default:
+			scrubbed[key] = value
+		}
+	}
+	return scrubbed
+}
+
+// scrubString applies the scrubber, then masks the credentials
+func scrubString(value string) string {
+	return credentials.Scrub(scrub.String(scrubber, value))
 }
@@ -0,0 +1,118 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
+	"github.com/stretchr/testify/assert"
+)
+
+func captureOutput(f func()) string {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	f()
+	SetOutput(os.Stderr)
+	return buf.String()
+}
+
+func withFormat(f Format) func() {
+	now = func() time.Time { return time.Date(2021, 6, 1, 12, 30, 15, 123000000, time.UTC) }
+	SetFormat(f)
+	return func() {
+		now = time.Now
+		SetFormat(FormatText)
+	}
+}
+
+func TestErrorWithFieldsJSON(t *testing.T) {
+	defer withFormat(FormatJSON)()
+
+	output := captureOutput(func() {
+		ErrorWithFields(errors.New("failed to send metrics"), Fields{
+			"batch_size": 3,
+			"endpoint":   "https://api.datadoghq.com/api/v1/distribution_points",
+			"error":      errors.New("connection refused"),
+		})
+	})
+
+	assert.True(t, strings.HasSuffix(output, "\n"))
+	assert.Equal(t, 1, strings.Count(output, "\n"))
+	assert.JSONEq(t, `{
+		"status": "error",
+		"message": "datadog: failed to send metrics",
+		"timestamp": "2021-06-01T12:30:15.123Z",
+		"dd.lambda_go": {
+			"batch_size": 3,
+			"endpoint": "https://api.datadoghq.com/api/v1/distribution_points",
+			"error": "connection refused"
+		}
+	}`, output)
+}
+
+func TestWarnJSONWithoutFields(t *testing.T) {
+	defer withFormat(FormatJSON)()
+
+	output := captureOutput(func() { Warn("something looks off") })
+
+	assert.JSONEq(t, `{"status": "warning", "message": "datadog: something looks off", "timestamp": "2021-06-01T12:30:15.123Z"}`, output)
+}
+
+func TestErrorText(t *testing.T) {
+	defer withFormat(FormatText)()
+
+	output := captureOutput(func() { Error(errors.New("failed to send metrics")) })
+
+	assert.Regexp(t, regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} {"status":"error","message":"datadog: failed to send metrics"}\n$`), output)
+}
+
+func TestDebugWithFieldsRespectsLogLevel(t *testing.T) {
+	defer withFormat(FormatJSON)()
+
+	output := captureOutput(func() { DebugWithFields("sending metrics", Fields{"batch_size": 1}) })
+	assert.Empty(t, output)
+
+	SetLogLevel(LevelDebug)
+	defer SetLogLevel(LevelError)
+	output = captureOutput(func() { DebugWithFields("sending metrics", Fields{"batch_size": 1}) })
+	assert.Contains(t, output, `"dd.lambda_go":{"batch_size":1}`)
+}
+
+func TestFieldsAreScrubbed(t *testing.T) {
+	defer withFormat(FormatJSON)()
+	SetScrubber(scrub.MakeRegexScrubber())
+	defer SetScrubber(nil)
+
+	output := captureOutput(func() {
+		ErrorWithFields(errors.New("no account for bob@example.com"), Fields{"user": "bob@example.com"})
+	})
+
+	assert.NotContains(t, output, "bob@example.com")
+	assert.Contains(t, output, `"user":"[redacted]"`)
+}
+
+func TestUnserializableFieldsAreDropped(t *testing.T) {
+	defer withFormat(FormatJSON)()
+
+	output := captureOutput(func() { ErrorWithFields(errors.New("failed"), Fields{"channel": make(chan int)}) })
+
+	assert.JSONEq(t, `{"status": "error", "message": "datadog: failed", "timestamp": "2021-06-01T12:30:15.123Z"}`, output)
+}
+
+func TestCredentialsAreMasked(t *testing.T) {
+	AddSecret("0123456789abcdef")
+
+	output := captureOutput(func() {
+		ErrorWithFields(errors.New("invalid key 0123456789abcdef"), Fields{"url": "https://example.com?api_key=fedcba9876543210"})
+	})
+
+	assert.NotContains(t, output, "0123456789ab")
+	assert.NotContains(t, output, "fedcba987654")
+	assert.Contains(t, output, "invalid key ************cdef")
+	assert.Contains(t, output, "api_key=************3210")
+}
@@ -0,0 +1,61 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+const (
+	// adaptiveHighWaterMark is the number of buffered points above which an adaptive processor flushes without
+	// waiting for the next tick
+	adaptiveHighWaterMark = 1000
+	// adaptiveTinyBatch is the number of points below which a batch sent on a tick lengthens the next tick
+	adaptiveTinyBatch = 10
+	// adaptiveMaxIntervalFactor bounds the period of the ticks of an adaptive processor, as a multiple of the
+	// batch interval
+	adaptiveMaxIntervalFactor = 4
+)
+
+// adaptiveFlush adapts when a processor flushes to the number of points it buffers. It flushes as soon as
+// adaptiveHighWaterMark points are buffered, and doubles the period of the ticks, up to adaptiveMaxIntervalFactor
+// times the batch interval, after each tick which sent fewer than adaptiveTinyBatch points. Any other flush goes
+// back to the batch interval. The high-water mark is a flush threshold, so a lower FlushAtPointCount wins.
+type adaptiveFlush struct {
+	batchInterval time.Duration
+	maxInterval   time.Duration
+	interval      time.Duration
+}
+
+func makeAdaptiveFlush(batchInterval time.Duration) *adaptiveFlush {
+	return &adaptiveFlush{
+		batchInterval: batchInterval,
+		maxInterval:   batchInterval * adaptiveMaxIntervalFactor,
+		interval:      batchInterval,
+	}
+}
+
+// flushed returns the period of the next tick when a batch of the given number of points is flushed
+func (a *adaptiveFlush) flushed(points uint64, onTick bool) time.Duration {
+	interval := a.batchInterval
+	if onTick && points < adaptiveTinyBatch {
+		interval = a.interval * 2
+		if interval > a.maxInterval {
+			interval = a.maxInterval
+		}
+	}
+	if interval != a.interval {
+		logger.Debug(fmt.Sprintf("adaptive flush: flushing %d points, next tick in %v instead of %v", points, interval, a.interval))
+		a.interval = interval
+	}
+	return interval
+}
@@ -0,0 +1,105 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeDistribution(name string, points int, now time.Time) *Distribution {
+	d := &Distribution{Name: name}
+	for i := 0; i < points; i++ {
+		d.Values = append(d.Values, MetricValue{Timestamp: now, Value: float64(i)})
+	}
+	return d
+}
+
+func TestAdaptiveFlushIntervals(t *testing.T) {
+	a := makeAdaptiveFlush(time.Second)
+
+	// Tiny batches double the interval, up to its maximum
+	assert.Equal(t, 2*time.Second, a.flushed(0, true))
+	assert.Equal(t, 4*time.Second, a.flushed(adaptiveTinyBatch-1, true))
+	assert.Equal(t, 4*time.Second, a.flushed(1, true))
+	// A larger batch goes back to the batch interval
+	assert.Equal(t, time.Second, a.flushed(adaptiveTinyBatch, true))
+	assert.Equal(t, 2*time.Second, a.flushed(0, true))
+	// So does a flush before the tick
+	assert.Equal(t, time.Second, a.flushed(0, false))
+}
+
+func TestProcessorAdaptsTickPeriods(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{adaptiveFlush: true})
+	pr.StartProcessing()
+	for i := 0; i < 3; i++ {
+		mts.tickerChan <- mts.now
+	}
+	pr.AddMetric(makeDistribution("metric-1", adaptiveTinyBatch, mts.now))
+	waitUntilMetricsReceived(pr)
+	mts.tickerChan <- mts.now
+	<-mc.batches
+	pr.FinishProcessing()
+
+	// The third empty tick doesn't lengthen the period beyond its maximum
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Second}, mts.tickerPeriods)
+}
+
+func TestProcessorAdaptiveFlushAtHighWaterMark(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{adaptiveFlush: true})
+	pr.StartProcessing()
+	pr.AddMetric(makeDistribution("metric-1", adaptiveHighWaterMark, mts.now))
+
+	// No tick is sent, so the batch is only sent because of the number of points
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+	pr.FinishProcessing()
+	assert.Equal(t, uint64(1), pr.Stats().BatchesSent)
+}
+
+func TestShardedProcessorAdaptiveFlushAtHighWaterMark(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{shards: 4, adaptiveFlush: true})
+	pr.StartProcessing()
+	for i := 0; i < adaptiveHighWaterMark; i++ {
+		pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	}
+
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+	pr.FinishProcessing()
+}
+
+func TestSyncProcessorIgnoresAdaptiveFlush(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, adaptiveFlush: true})
+
+	assert.Nil(t, pr.adaptive)
+}
+
+func TestListenerAdaptiveFlush(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, AdaptiveFlush: true})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.NotNil(t, ml.processor.(*processor).adaptive)
+	ml.HandlerFinished(ctx, nil, nil)
+}
@@ -0,0 +1,23 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+// makeBatcher creates an empty batcher for the next batch of the processor
+func (p *processor) makeBatcher() *Batcher {
+	batcher := MakeBatcher(p.batchInterval)
+	// The rates of the next batch are summed from now on
+	batcher.rateStart = p.timeService.Now()
+	if p.bucketWidth > 0 {
+		batcher.bucketWidth = p.bucketWidth
+	}
+	if p.maxFutureSkew > 0 {
+		batcher.maxFutureSkew = p.maxFutureSkew
+	}
+	return batcher
+}
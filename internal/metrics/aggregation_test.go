@@ -0,0 +1,89 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregationBucketAppliesToEveryBatch(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	p := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{shards: 2, aggregationBucket: time.Minute})
+
+	assert.Equal(t, time.Minute, p.batcher.bucketWidth)
+	for i := range p.shards {
+		assert.Equal(t, time.Minute, p.shards[i].batcher.bucketWidth)
+	}
+	assert.Equal(t, time.Minute, p.makeBatcher().bucketWidth)
+
+	p = makeTestProcessor(context.Background(), &mc, &mts, processorOptions{})
+	assert.Equal(t, defaultAggregationBucket, p.makeBatcher().bucketWidth)
+}
+
+func TestProcessorSendsOnePointPerBucket(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: time.Hour})
+	pr.StartProcessing()
+	for i := 0; i < 1000; i++ {
+		c := Count{Name: "requests"}
+		c.AddPoint(mts.Now(), 1)
+		pr.AddMetric(&c)
+	}
+	pr.FinishProcessing()
+
+	sent := <-mc.batches
+	assert.Len(t, sent, 1)
+	assert.Len(t, sent[0].Points, 1)
+	assert.Equal(t, float64(1000), sent[0].Points[0].([]interface{})[1])
+}
+
+func TestAddCountAndGaugeMetrics(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: &mc, TimeService: &mts, DisableFlushJitter: true, SyncFlushOnly: true})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, ml.AddCountMetric("requests", 1, mts.now, "route:/orders"))
+	}
+	assert.NoError(t, ml.AddGaugeMetric("queue_depth", 3, mts.now))
+	assert.NoError(t, ml.AddGaugeMetric("queue_depth", 5, mts.now))
+	assert.True(t, errors.Is(ml.AddCountMetric("requests", math.NaN(), mts.now), ErrInvalidMetric))
+	assert.True(t, errors.Is(ml.AddGaugeMetric("", 1, mts.now), ErrInvalidMetric))
+	ml.HandlerFinished(ctx, nil, nil)
+
+	// Each is sent as a single point at the start of its bucket
+	bucket := float64(mts.now.Truncate(defaultAggregationBucket).Unix())
+	sent := map[string]APIMetric{}
+	for _, m := range <-mc.batches {
+		sent[m.Name] = m
+	}
+	assert.Equal(t, CountType, sent["requests"].MetricType)
+	assert.Contains(t, sent["requests"].Tags, "route:/orders")
+	assert.Equal(t, []interface{}{[]interface{}{bucket, float64(1000)}}, sent["requests"].Points)
+	assert.Equal(t, GaugeType, sent["queue_depth"].MetricType)
+	assert.Equal(t, []interface{}{[]interface{}{bucket, float64(5)}}, sent["queue_depth"].Points)
+}
+
+func TestAddCountAndGaugeMetricsWithLogForwarder(t *testing.T) {
+	ml := MakeListener(Config{ShouldUseLogForwarder: true})
+	assert.True(t, errors.Is(ml.AddCountMetric("requests", 1, time.Now()), ErrMetricsDisabled))
+	assert.True(t, errors.Is(ml.AddGaugeMetric("queue_depth", 1, time.Now()), ErrMetricsDisabled))
+}
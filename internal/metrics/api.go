@@ -12,16 +12,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/health"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 )
 
 type (
-	// Client sends metrics to Datadog
+	// Client sends batches of metrics to Datadog. The APIClient sends them to the Datadog API, and a custom
+	// Client can send them elsewhere, such as to an aggregator. Its errors are retried like the API's.
 	Client interface {
 		SendMetrics(metrics []APIMetric) error
 	}
@@ -29,10 +37,27 @@ type (
 	// APIClient send metrics to Datadog, via the Datadog API
 	APIClient struct {
 		apiKey            string
-		apiKeyDecryptChan <-chan string
-		baseAPIURL        string
-		httpClient        *http.Client
-		context           context.Context
+		apiKeyDecryptChan <-chan decryptResult
+		// decryptErr is the error of the decryption of the KMS API key, once it finished
+		decryptErr    error
+		baseAPIURL    string
+		httpClient    *http.Client
+		context       context.Context
+		debugPayloads bool
+		dumpPayloads  bool
+		// payloadDumps counts the payloads dumped, and is updated atomically as the payloads of a flush are sent
+		// concurrently
+		payloadDumps uint32
+		// mu guards the payload sizes, as the payloads of a flush are sent concurrently
+		mu sync.Mutex
+		// payloadBytes is the size of the payloads of the last call to SendMetrics
+		payloadBytes int
+		// legacyQueryAuth sends the API key in the query string instead of a header
+		legacyQueryAuth bool
+		// intakeVersion is the version of the API the series are sent to
+		intakeVersion string
+		// flushConcurrency is the number of requests of a flush sent at the same time
+		flushConcurrency int
 	}
 
 	// APIClientOptions contains instantiation options from creating an APIClient.
@@ -42,10 +67,26 @@ type (
 		kmsAPIKey         string
 		decrypter         Decrypter
 		httpClientTimeout time.Duration
+		// debugPayloads logs a summary of every payload sent, even when debug logs are disabled
+		debugPayloads bool
+		// dumpPayloads adds the content of the first payloads sent to their summary
+		dumpPayloads bool
+		// legacyQueryAuth sends the API key in the api_key query parameter, for proxies which don't read the
+		// header
+		legacyQueryAuth bool
+		// intakeVersion is the version of the API the series are sent to, intakeV1 or intakeV2
+		intakeVersion string
+		// flushConcurrency is the number of requests of a flush sent at the same time. It defaults to 1.
+		flushConcurrency int
+	}
+
+	decryptResult struct {
+		apiKey string
+		err    error
 	}
 
 	postMetricsModel struct {
-		Series []APIMetric `json:"series"`
+		Series []seriesV1 `json:"series"`
 	}
 )
 
@@ -55,11 +96,17 @@ func MakeAPIClient(ctx context.Context, options APIClientOptions) *APIClient {
 		Timeout: options.httpClientTimeout,
 	}
 	client := &APIClient{
-		apiKey:     options.apiKey,
-		baseAPIURL: options.baseAPIURL,
-		httpClient: httpClient,
-		context:    ctx,
+		apiKey:           options.apiKey,
+		baseAPIURL:       options.baseAPIURL,
+		httpClient:       httpClient,
+		context:          ctx,
+		debugPayloads:    options.debugPayloads,
+		dumpPayloads:     options.dumpPayloads,
+		legacyQueryAuth:  options.legacyQueryAuth,
+		intakeVersion:    options.intakeVersion,
+		flushConcurrency: options.flushConcurrency,
 	}
+	logger.AddSecret(options.apiKey)
 	if len(options.apiKey) == 0 && len(options.kmsAPIKey) != 0 {
 		client.apiKeyDecryptChan = client.decryptAPIKey(options.decrypter, options.kmsAPIKey)
 	}
@@ -70,21 +117,65 @@ func MakeAPIClient(ctx context.Context, options APIClientOptions) *APIClient {
 // SendMetrics posts a batch metrics payload to the Datadog API
 func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
 
-	// If the api key was provided as a kms key, wait for it to finish decrypting
-	if cl.apiKeyDecryptChan != nil {
-		cl.apiKey = <-cl.apiKeyDecryptChan
-		cl.apiKeyDecryptChan = nil
+	// If the api key was provided as a kms key, wait for it to finish decrypting. Without the key, the request
+	// would only be rejected.
+	if err := cl.waitForAPIKey(); err != nil {
+		return fmt.Errorf("Couldn't send metrics without the API key: %v", err)
+	}
+
+	// Distributions have their own endpoint. Other metric types use the "series" endpoint, which takes an
+	// identical payload.
+	var distributions, series []APIMetric
+	for _, metric := range metrics {
+		if metric.MetricType == DistributionType {
+			distributions = append(distributions, metric)
+		} else {
+			series = append(series, metric)
+		}
+	}
+	var payloads []apiPayload
+	if len(distributions) > 0 {
+		payload, err := cl.makePayload("distribution_points", distributions)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
+	}
+	if len(series) > 0 {
+		makePayload := cl.makePayload
+		if cl.intakeVersion == intakeV2 {
+			makePayload = cl.makeSeriesV2Payload
+		}
+		payload, err := makePayload("series", series)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
 	}
 
-	content, err := marshalAPIMetricsModel(metrics)
+	cl.mu.Lock()
+	cl.payloadBytes = 0
+	cl.mu.Unlock()
+	return cl.postAll(payloads)
+}
+
+// makePayload marshals metrics into the payload of an endpoint of the API
+func (cl *APIClient) makePayload(endpoint string, metrics []APIMetric) (apiPayload, error) {
+	content, err := MarshalBatch(metrics)
 	if err != nil {
-		return fmt.Errorf("Couldn't marshal metrics model: %v", err)
+		return apiPayload{}, fmt.Errorf("Couldn't marshal metrics model: %v", err)
 	}
+	return apiPayload{route: cl.makeRoute(endpoint), metrics: metrics, content: content}, nil
+}
+
+// post sends the payload of a batch of metrics to a route of the API
+func (cl *APIClient) post(route string, metrics []APIMetric, content []byte) error {
+	cl.mu.Lock()
+	cl.payloadBytes += len(content)
+	cl.mu.Unlock()
 	body := bytes.NewBuffer(content)
 
-	// For the moment we only support distribution metrics.
-	// Other metric types use the "series" endpoint, which takes an identical payload.
-	req, err := http.NewRequest("POST", cl.makeRoute("distribution_points"), body)
+	req, err := http.NewRequest("POST", route, body)
 	if err != nil {
 		return fmt.Errorf("Couldn't create send metrics request:%v", err)
 	}
@@ -92,13 +183,13 @@ func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
 
 	defer req.Body.Close()
 
-	logger.Debug(fmt.Sprintf("Sending payload with body %s", content))
-
 	cl.addAPICredentials(req)
+	cl.logPayload(req, metrics, content)
 
 	resp, err := cl.httpClient.Do(req)
 
 	if err != nil {
+		logger.DebugWithFields("Failed to send metrics to API", logger.Fields{"endpoint": route, "error": err})
 		return fmt.Errorf("Failed to send metrics to API")
 	}
 	defer resp.Body.Close()
@@ -106,6 +197,7 @@ func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		if resp.StatusCode == 403 {
 			logger.Debug(fmt.Sprintf("authorization failed with api key of length %d characters", len(cl.apiKey)))
+			health.Degrade(health.ReasonAPIKeyRejected, errors.New("the Datadog API rejected the API key"))
 		}
 		bodyBytes, err := ioutil.ReadAll(resp.Body)
 		body := ""
@@ -118,25 +210,110 @@ func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
 	return err
 }
 
-func (cl *APIClient) decryptAPIKey(decrypter Decrypter, kmsAPIKey string) <-chan string {
+// prewarm opens a connection to the API, so that the first flush reuses it instead of paying for the TLS
+// handshake. It sends a HEAD request to the validate endpoint, which doesn't need the API key, and gives up after
+// prewarmTimeout. Its errors are only logged, as the flush opens a connection itself when there's none.
+func (cl *APIClient) prewarm() {
+	ctx, cancel := context.WithTimeout(cl.context, prewarmTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%s/validate", cl.baseAPIURL), nil)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("couldn't create the request prewarming the connection to the API: %v", err))
+		return
+	}
+	start := time.Now()
+	resp, err := cl.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		logger.Debug(fmt.Sprintf("couldn't prewarm the connection to the API: %v", err))
+		return
+	}
+	// The body is drained so that the connection is kept for the next requests
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	logger.Debug(fmt.Sprintf("prewarmed the connection to the API in %v", time.Since(start)))
+}
+
+// lastPayloadSize returns the size of the last payload sent, for the library's telemetry
+func (cl *APIClient) lastPayloadSize() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.payloadBytes
+}
+
+func (cl *APIClient) decryptAPIKey(decrypter Decrypter, kmsAPIKey string) <-chan decryptResult {
 
-	ch := make(chan string)
+	ch := make(chan decryptResult, 1)
 
 	go func() {
+		defer close(ch)
+		// A panic in the decrypter would otherwise crash the function, outside of any handler
+		defer func() {
+			if r := recover(); r != nil {
+				err := fmt.Errorf("the KMS decrypter panicked: %v", r)
+				health.Degrade(health.ReasonKMSDecryptFailed, err)
+				ch <- decryptResult{err: err}
+			}
+		}()
 		result, err := decrypter.Decrypt(kmsAPIKey)
 		if err != nil {
-			logger.Error(fmt.Errorf("Couldn't decrypt api kms key %s", err))
+			health.Degrade(health.ReasonKMSDecryptFailed, fmt.Errorf("Couldn't decrypt api kms key %s", err))
 		}
-		ch <- result
-		close(ch)
+		logger.AddSecret(result)
+		ch <- decryptResult{apiKey: result, err: err}
 	}()
 	return ch
 }
 
+// waitForAPIKey waits for the decryption of the KMS API key, if any, and returns its error
+func (cl *APIClient) waitForAPIKey() error {
+	if cl.apiKeyDecryptChan != nil {
+		result := <-cl.apiKeyDecryptChan
+		cl.apiKey, cl.decryptErr = result.apiKey, result.err
+		cl.apiKeyDecryptChan = nil
+	}
+	return cl.decryptErr
+}
+
+// addAPICredentials sets the API key header. The key is only sent in the query string with legacy query auth, as
+// URLs end up in proxy logs and in the errors of the HTTP client.
 func (cl *APIClient) addAPICredentials(req *http.Request) {
-	query := req.URL.Query()
-	query.Add(apiKeyParam, cl.apiKey)
-	req.URL.RawQuery = query.Encode()
+	if cl.legacyQueryAuth {
+		query := req.URL.Query()
+		query.Add(apiKeyParam, cl.apiKey)
+		req.URL.RawQuery = query.Encode()
+		return
+	}
+	req.Header.Set(apiKeyHeader, cl.apiKey)
+}
+
+// logPayload logs the endpoint, metric and point counts and size of a payload when debug logs or payload debugging
+// are enabled. When payload dumps are enabled, the first payloads are logged in full, with credentials redacted.
+func (cl *APIClient) logPayload(req *http.Request, metrics []APIMetric, content []byte) {
+	if !cl.debugPayloads && !logger.DebugEnabled() {
+		return
+	}
+
+	points := 0
+	for _, metric := range metrics {
+		points += len(metric.Points)
+	}
+	fields := logger.Fields{
+		"endpoint":      redactURL(req.URL),
+		"metric_count":  len(metrics),
+		"point_count":   points,
+		"payload_bytes": len(content),
+	}
+	// The count is checked before it's incremented, so that it can't wrap around
+	if cl.dumpPayloads && atomic.LoadUint32(&cl.payloadDumps) < maxPayloadDumps && atomic.AddUint32(&cl.payloadDumps, 1) <= maxPayloadDumps {
+		fields["headers"] = redactHeaders(req.Header)
+		fields["payload"] = json.RawMessage(content)
+	}
+
+	if cl.debugPayloads {
+		logger.InfoWithFields("Sending metrics payload", fields)
+	} else {
+		logger.DebugWithFields("Sending metrics payload", fields)
+	}
 }
 
 func (cl *APIClient) makeRoute(route string) string {
@@ -145,8 +322,38 @@ func (cl *APIClient) makeRoute(route string) string {
 	return url
 }
 
-func marshalAPIMetricsModel(metrics []APIMetric) ([]byte, error) {
-	pm := postMetricsModel{}
-	pm.Series = metrics
+// MarshalBatch marshals a batch of metrics into the payload sent to the Datadog API, with the metadata identifying
+// them as sent from Lambda
+func MarshalBatch(metrics []APIMetric) ([]byte, error) {
+	pm := postMetricsModel{Series: make([]seriesV1, 0, len(metrics))}
+	for _, metric := range metrics {
+		pm.Series = append(pm.Series, seriesV1{APIMetric: metric, Metadata: originMetadata(metric.Name)})
+	}
 	return json.Marshal(pm)
 }
+
+// redactURL returns the URL with the value of the API key parameter redacted
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	if query.Get(apiKeyParam) != "" {
+		query.Set(apiKeyParam, redactedCredential)
+	}
+	if query.Get(appKeyParam) != "" {
+		query.Set(appKeyParam, redactedCredential)
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// redactHeaders returns the request headers with the values of the credential headers redacted
+func redactHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for key, values := range header {
+		headers[key] = strings.Join(values, ",")
+		if strings.EqualFold(key, apiKeyHeader) || strings.EqualFold(key, appKeyHeader) {
+			headers[key] = redactedCredential
+		}
+	}
+	return headers
+}
@@ -10,11 +10,18 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/health"
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,7 +46,35 @@ func TestAddAPICredentials(t *testing.T) {
 	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: "", apiKey: mockAPIKey})
 	req, _ := http.NewRequest("GET", "http://some-api.com/endpoint", nil)
 	cl.addAPICredentials(req)
+	assert.Equal(t, "http://some-api.com/endpoint", req.URL.String())
+	assert.Equal(t, "12345", req.Header.Get("DD-API-KEY"))
+}
+
+func TestAddAPICredentialsLegacyQueryAuth(t *testing.T) {
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: "", apiKey: mockAPIKey, legacyQueryAuth: true})
+	req, _ := http.NewRequest("GET", "http://some-api.com/endpoint", nil)
+	cl.addAPICredentials(req)
 	assert.Equal(t, "http://some-api.com/endpoint?api_key=12345", req.URL.String())
+	assert.Empty(t, req.Header.Get("DD-API-KEY"))
+}
+
+func TestSendMetricsRetriesSetAPIKeyHeader(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("DD-API-KEY")+" "+r.URL.RawQuery)
+		if len(keys) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+	mts := makeMockTimeService()
+	flushWithSyncProcessor(cl, &mts, true, nil, "metric-1")
+
+	assert.Equal(t, []string{"12345 ", "12345 ", "12345 "}, keys)
 }
 
 func TestSendMetricsSuccess(t *testing.T) {
@@ -50,8 +85,9 @@ func TestSendMetricsSuccess(t *testing.T) {
 		body, _ := ioutil.ReadAll(r.Body)
 		s := string(body)
 
-		assert.Equal(t, "/distribution_points?api_key=12345", r.URL.String())
-		assert.Equal(t, "{\"series\":[{\"metric\":\"metric-1\",\"tags\":[\"a\",\"b\",\"c\"],\"type\":\"distribution\",\"points\":[[1,[2]],[3,[4]],[5,[6]]]}]}", s)
+		assert.Equal(t, "/distribution_points", r.URL.String())
+		assert.Equal(t, "12345", r.Header.Get("DD-API-KEY"))
+		assert.Equal(t, "{\"series\":[{\"metric\":\"metric-1\",\"tags\":[\"a\",\"b\",\"c\"],\"type\":\"distribution\",\"points\":[[1,[2]],[3,[4]],[5,[6]]],\"metadata\":{\"origin\":{\"origin_product\":1,\"origin_sub_product\":38,\"origin_product_detail\":51}}}]}", s)
 
 	}))
 	defer server.Close()
@@ -77,6 +113,37 @@ func TestSendMetricsSuccess(t *testing.T) {
 	assert.True(t, called)
 }
 
+func TestSendMetricsSplitsSeries(t *testing.T) {
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	am := []APIMetric{
+		{
+			Name:       "metric-1",
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(1), []interface{}{float64(2)}}},
+		},
+		{
+			Name:       "users",
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1), float64(3)}},
+		},
+	}
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+	err := cl.SendMetrics(am)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"series\":[{\"metric\":\"metric-1\",\"type\":\"distribution\",\"points\":[[1,[2]]],\"metadata\":{\"origin\":{\"origin_product\":1,\"origin_sub_product\":38,\"origin_product_detail\":51}}}]}", bodies["/distribution_points"])
+	assert.Equal(t, "{\"series\":[{\"metric\":\"users\",\"type\":\"gauge\",\"points\":[[1,3]],\"metadata\":{\"origin\":{\"origin_product\":1,\"origin_sub_product\":38,\"origin_product_detail\":51}}}]}", bodies["/series"])
+	assert.Equal(t, len(bodies["/distribution_points"])+len(bodies["/series"]), cl.lastPayloadSize())
+}
+
 func TestSendMetricsBadRequest(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -85,8 +152,9 @@ func TestSendMetricsBadRequest(t *testing.T) {
 		body, _ := ioutil.ReadAll(r.Body)
 		s := string(body)
 
-		assert.Equal(t, "/distribution_points?api_key=12345", r.URL.String())
-		assert.Equal(t, "{\"series\":[{\"metric\":\"metric-1\",\"tags\":[\"a\",\"b\",\"c\"],\"type\":\"distribution\",\"points\":[[1,[2]],[3,[4]],[5,[6]]]}]}", s)
+		assert.Equal(t, "/distribution_points", r.URL.String())
+		assert.Equal(t, "12345", r.Header.Get("DD-API-KEY"))
+		assert.Equal(t, "{\"series\":[{\"metric\":\"metric-1\",\"tags\":[\"a\",\"b\",\"c\"],\"type\":\"distribution\",\"points\":[[1,[2]],[3,[4]],[5,[6]]],\"metadata\":{\"origin\":{\"origin_product\":1,\"origin_sub_product\":38,\"origin_product_detail\":51}}}]}", s)
 
 	}))
 	defer server.Close()
@@ -144,7 +212,8 @@ func TestDecryptsUsingKMSKey(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
-		assert.Equal(t, "/distribution_points?api_key=mockDecrypted", r.URL.String())
+		assert.Equal(t, "/distribution_points", r.URL.String())
+		assert.Equal(t, "mockDecrypted", r.Header.Get("DD-API-KEY"))
 	}))
 	defer server.Close()
 
@@ -170,3 +239,227 @@ func TestDecryptsUsingKMSKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, called)
 }
+
+func TestSendMetricsWithoutDecryptedAPIKey(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	md := mockDecrypter{returnError: errors.New("access denied")}
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, kmsAPIKey: mockEncryptedAPIKey, decrypter: &md})
+	captureOutput(func() {
+		assert.EqualError(t, cl.waitForAPIKey(), "access denied")
+		assert.Error(t, cl.SendMetrics(makeTestAPIMetrics()))
+	})
+	assert.False(t, called)
+	assert.Equal(t, []health.Reason{health.ReasonKMSDecryptFailed}, health.GetStatus().Degraded)
+}
+
+type panickingDecrypter struct{}
+
+func (d panickingDecrypter) Decrypt(cipherText string) (string, error) {
+	panic("no credentials")
+}
+
+func TestDecryptAPIKeyRecoversPanic(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{kmsAPIKey: mockEncryptedAPIKey, decrypter: panickingDecrypter{}})
+	captureOutput(func() {
+		assert.EqualError(t, cl.waitForAPIKey(), "the KMS decrypter panicked: no credentials")
+	})
+	assert.Equal(t, []health.Reason{health.ReasonKMSDecryptFailed}, health.GetStatus().Degraded)
+}
+
+func TestListenerWaitForInit(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+
+	listener := MakeListener(Config{KMSAPIKey: mockEncryptedAPIKey, Decrypter: &mockDecrypter{returnValue: mockDecryptedAPIKey}})
+	assert.NoError(t, listener.WaitForInit())
+	assert.Equal(t, mockDecryptedAPIKey, listener.apiClient.apiKey)
+
+	listener = MakeListener(Config{KMSAPIKey: mockEncryptedAPIKey, Decrypter: &mockDecrypter{returnError: errors.New("access denied")}})
+	captureOutput(func() {
+		assert.EqualError(t, listener.WaitForInit(), "access denied")
+	})
+}
+
+func makeTestAPIMetrics() []APIMetric {
+	return []APIMetric{
+		{
+			Name:       "metric-1",
+			Tags:       []string{"a"},
+			MetricType: DistributionType,
+			Points: []interface{}{
+				[]interface{}{float64(1), []interface{}{float64(2)}},
+				[]interface{}{float64(3), []interface{}{float64(4)}},
+			},
+		},
+		{
+			Name:       "metric-2",
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(5), []interface{}{float64(6)}}},
+		},
+	}
+}
+
+func TestSendMetricsDebugPayloads(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, debugPayloads: true})
+	output := captureOutput(func() {
+		assert.NoError(t, cl.SendMetrics(makeTestAPIMetrics()))
+	})
+
+	assert.Contains(t, output, `"status":"info"`)
+	assert.Contains(t, output, `"endpoint":"`+server.URL+`/distribution_points"`)
+	assert.Contains(t, output, `"metric_count":2`)
+	assert.Contains(t, output, `"point_count":3`)
+	assert.Contains(t, output, `"payload_bytes":`)
+	assert.NotContains(t, output, `"payload":`)
+	assert.NotContains(t, output, mockAPIKey)
+}
+
+func TestSendMetricsWithoutDebugPayloads(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, dumpPayloads: true})
+	output := captureOutput(func() {
+		assert.NoError(t, cl.SendMetrics(makeTestAPIMetrics()))
+	})
+
+	assert.Empty(t, output)
+	assert.Equal(t, uint32(0), cl.payloadDumps)
+}
+
+func TestSendMetricsDumpPayloadsIsRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, debugPayloads: true, dumpPayloads: true})
+	output := captureOutput(func() {
+		for i := 0; i < maxPayloadDumps+2; i++ {
+			assert.NoError(t, cl.SendMetrics(makeTestAPIMetrics()))
+		}
+	})
+
+	assert.Equal(t, maxPayloadDumps+2, strings.Count(output, `"metric_count":2`))
+	assert.Equal(t, maxPayloadDumps, strings.Count(output, `"payload":{"series":[{"metric":"metric-1"`))
+	assert.NotContains(t, output, mockAPIKey)
+}
+
+func TestSendMetricsDumpPayloadsConcurrently(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, debugPayloads: true, dumpPayloads: true})
+	output := captureOutput(func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 4*maxPayloadDumps; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, cl.SendMetrics(makeTestAPIMetrics()))
+			}()
+		}
+		wg.Wait()
+	})
+
+	assert.Equal(t, maxPayloadDumps, strings.Count(output, `"payload":{"series":[{"metric":"metric-1"`))
+}
+
+func TestSendMetricsDNSFailureDoesNotLeakAPIKey(t *testing.T) {
+	logger.SetLogLevel(logger.LevelDebug)
+	defer logger.SetLogLevel(logger.LevelError)
+	apiKey := "0123456789abcdef0123456789abcdef"
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: "https://api.datadog-lambda-go.invalid/api/v1", apiKey: apiKey, httpClientTimeout: 5 * time.Second})
+	var err error
+	output := captureOutput(func() {
+		err = cl.SendMetrics(makeTestAPIMetrics())
+		logger.Error(err)
+	})
+
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), apiKey[:len(apiKey)-4])
+	assert.Contains(t, output, "api.datadog-lambda-go.invalid")
+	assert.NotContains(t, output, apiKey[:len(apiKey)-4])
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(apiKeyHeader, mockAPIKey)
+
+	assert.Equal(t, map[string]string{"Content-Type": "application/json", "Dd-Api-Key": "redacted"}, redactHeaders(header))
+}
+
+func TestPrewarmReusesConnection(t *testing.T) {
+	var requests []string
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections++
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+	cl.prewarm()
+	err := cl.SendMetrics([]APIMetric{{Name: "metric-1", MetricType: DistributionType}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"HEAD /validate", "POST /distribution_points"}, requests)
+	assert.Equal(t, 1, connections)
+}
+
+func TestPrewarmGivesUp(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, httpClientTimeout: time.Minute})
+	start := time.Now()
+	cl.prewarm()
+
+	assert.Less(t, int64(time.Since(start)), int64(prewarmTimeout+time.Second))
+}
+
+func TestSendMetricsRejectedAPIKeyDegrades(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: "12345"})
+	captureOutput(func() {
+		cl.SendMetrics([]APIMetric{{Name: "my-metric", MetricType: DistributionType}})
+	})
+	assert.Equal(t, []health.Reason{health.ReasonAPIKeyRejected}, health.GetStatus().Degraded)
+}
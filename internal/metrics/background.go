@@ -0,0 +1,204 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// BackgroundEmitter sends the metrics of goroutines which run for the life of the container, independently of
+// the invocations, such as a goroutine started in init which polls a queue. Its processor isn't tied to an
+// invocation: its goroutine survives between invocations, and flushes every BatchInterval. The emitter is
+// also flushed at the end of each invocation, before Lambda freezes the container.
+//
+// Nothing runs while the container is frozen between invocations, so no metric can be sent then. The points
+// added before the freeze which weren't flushed stay buffered, and are sent on the first tick once the
+// container is thawed. A send in flight when the container is frozen may fail once it's thawed, in which
+// case its batch is kept for the next flush.
+type BackgroundEmitter struct {
+	listener *Listener
+	// mu guards closed. The flushes and the metrics hold it for reading, so that Close waits for them.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// errEmitterClosed is returned for the metrics sent to an emitter once it was closed
+var errEmitterClosed = fmt.Errorf("%w: the background emitter was closed", ErrMetricsDisabled)
+
+// backgroundEmitters are the emitters which weren't closed, which are flushed at the end of each invocation
+var backgroundEmitters = struct {
+	mu       sync.Mutex
+	emitters []*BackgroundEmitter
+}{}
+
+// MakeBackgroundEmitter creates an emitter which sends metrics as configured by config, and starts its processor.
+// The options which only make sense for invocations, such as the startup metric, the memory pressure and the
+// retry budget of the invocations, are ignored. The emitter doesn't change the sink reported by SinkInfo.
+func MakeBackgroundEmitter(config Config) *BackgroundEmitter {
+	config.SyncFlushOnly = false
+	config.StartupMetric = false
+	config.LogTopEmitters = false
+	config.MemoryPressure = false
+	config.FetchResourceTags = false
+	// The spool belongs to the listener of the invocations, which drains it
+	config.SpillFailedBatches = false
+	config.MaxRetriesPerInvocation = 0
+	config.MaxRetryTimePerInvocation = 0
+
+	l := makeListener(config, false)
+	if !l.useServerlessAgent && !l.config.ShouldUseLogForwarder && l.sinkInfo.Sink != SinkDisabled {
+		pr := l.newProcessor(context.Background())
+		if p, ok := pr.(*processor); ok {
+			p.waitedFlushChan = make(chan chan struct{})
+		}
+		pr.StartProcessing()
+		l.processor = pr
+	}
+
+	e := &BackgroundEmitter{listener: &l}
+	backgroundEmitters.mu.Lock()
+	backgroundEmitters.emitters = append(backgroundEmitters.emitters, e)
+	backgroundEmitters.mu.Unlock()
+	return e
+}
+
+// Distribution sends a point of a distribution metric, timestamped now. It returns an error wrapping
+// ErrMetricsDisabled, ErrBufferFull or ErrInvalidMetric when the metric won't be sent.
+func (e *BackgroundEmitter) Distribution(metric string, value float64, tags ...string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return errEmitterClosed
+	}
+	return e.listener.AddDistributionMetric(metric, value, e.listener.Now(), false, tags...)
+}
+
+// Set adds a member to a set metric, which counts the distinct members added between two flushes. It returns an
+// error like Distribution.
+func (e *BackgroundEmitter) Set(metric string, member string, tags ...string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return errEmitterClosed
+	}
+	return e.listener.AddSetMetric(metric, member, e.listener.Now(), tags...)
+}
+
+// Flush sends the metrics buffered so far without waiting for the next tick, and waits up to MaxFlushDuration
+// for them to be sent. With the Extension, they're handed to it, and it sends them when it's flushed at the end
+// of the invocation.
+func (e *BackgroundEmitter) Flush() {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	l := e.listener
+	if l.useServerlessAgent {
+		if err := l.statsdClient.Flush(); err != nil {
+			logger.Error(fmt.Errorf("can't flush the DogStatsD client of the background emitter: %s", err))
+		}
+		return
+	}
+	if p, ok := l.processor.(*processor); ok {
+		if !p.flushAndWait(l.config.MaxFlushDuration) {
+			logger.Debug(fmt.Sprintf("the flush of the background metrics took longer than %s, the invocation doesn't wait for it", l.config.MaxFlushDuration))
+		}
+	}
+}
+
+// Close stops the processor of the emitter once its remaining metrics are sent. The metrics sent afterwards are
+// dropped. Closing twice is a no-op.
+func (e *BackgroundEmitter) Close() {
+	backgroundEmitters.mu.Lock()
+	for i, emitter := range backgroundEmitters.emitters {
+		if emitter == e {
+			backgroundEmitters.emitters = append(backgroundEmitters.emitters[:i], backgroundEmitters.emitters[i+1:]...)
+			break
+		}
+	}
+	backgroundEmitters.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	l := e.listener
+	if l.useServerlessAgent {
+		if err := l.statsdClient.Close(); err != nil {
+			logger.Error(fmt.Errorf("can't close the DogStatsD client of the background emitter: %s", err))
+		}
+		return
+	}
+	if l.processor != nil {
+		l.processor.FinishProcessing()
+	}
+}
+
+// Stats returns the counters of the metrics handled by the emitter since it was created
+func (e *BackgroundEmitter) Stats() Stats {
+	return e.listener.Stats()
+}
+
+// flushBackgroundEmitters flushes the emitters which weren't closed, one after the other, so that their metrics
+// are sent before the container is frozen
+func flushBackgroundEmitters() {
+	backgroundEmitters.mu.Lock()
+	emitters := append([]*BackgroundEmitter(nil), backgroundEmitters.emitters...)
+	backgroundEmitters.mu.Unlock()
+	for _, e := range emitters {
+		e.Flush()
+	}
+}
+
+// flushAndWait requests a flush from the processing goroutine, and waits for it to be done. It returns false when
+// it's not done within d, which is unbounded when it's not positive.
+func (p *processor) flushAndWait(d time.Duration) bool {
+	var expired <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	flushed := make(chan struct{})
+	select {
+	case p.waitedFlushChan <- flushed:
+	case <-expired:
+		return false
+	}
+	select {
+	case <-flushed:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+// drainChannel batches the metrics waiting in the metrics channel, without blocking
+func (p *processor) drainChannel() {
+	for {
+		select {
+		case m, ok := <-p.metricsChan:
+			if !ok {
+				// The processing goroutine exits on its next receive
+				return
+			}
+			p.addToBatch(m)
+		default:
+			return
+		}
+	}
+}
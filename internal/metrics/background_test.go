@@ -0,0 +1,116 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestBackgroundEmitter(mc *mockClient, mts *mockTimeService) *BackgroundEmitter {
+	return MakeBackgroundEmitter(Config{Client: mc, TimeService: mts, DisableFlushJitter: true})
+}
+
+func TestBackgroundEmitterFlushesOnItsTicks(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	e := makeTestBackgroundEmitter(&mc, &mts)
+	defer e.Close()
+
+	assert.NoError(t, e.Distribution("queue.depth", 12, "queue:orders"))
+	waitUntilMetricsReceived(e.listener.processor)
+	mts.tickerChan <- mts.now
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "queue.depth", batch[0].Name)
+	assert.Contains(t, batch[0].Tags, "queue:orders")
+	assert.Equal(t, []interface{}{float64(mts.now.Unix()), []interface{}{float64(12)}}, batch[0].Points[0])
+	assert.Equal(t, uint64(1), e.Stats().MetricsAdded)
+}
+
+func TestBackgroundEmitterFlushesAtTheEndOfInvocations(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	e := makeTestBackgroundEmitter(&mc, &mts)
+	defer e.Close()
+	invocationClient := makeMockClient()
+	invocationTime := makeMockTimeService()
+	ml := MakeListener(Config{Client: &invocationClient, TimeService: &invocationTime, DisableFlushJitter: true})
+
+	for i := 0; i < 2; i++ {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+		assert.NoError(t, e.Distribution("queue.depth", float64(i)))
+		ml.HandlerFinished(ctx, nil, nil)
+
+		// The batch was sent before HandlerFinished returned, and the processor survives the invocation
+		select {
+		case batch := <-mc.batches:
+			assert.Len(t, batch, 1)
+			assert.Equal(t, "queue.depth", batch[0].Name)
+		default:
+			assert.Fail(t, "the background metrics weren't flushed at the end of the invocation")
+		}
+		assert.True(t, e.listener.processor.IsProcessing())
+		assert.Len(t, invocationClient.batches, 0)
+	}
+}
+
+func TestBackgroundEmitterFlushIsBounded(t *testing.T) {
+	client := &blockedClient{release: make(chan struct{})}
+	e := MakeBackgroundEmitter(Config{Client: client, MaxFlushDuration: 20 * time.Millisecond})
+	defer e.Close()
+	defer close(client.release)
+
+	assert.NoError(t, e.Distribution("queue.depth", 1))
+	start := time.Now()
+	e.Flush()
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Eventually(t, func() bool { return atomic.LoadUint32(&client.calls) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestBackgroundEmitterClose(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	e := makeTestBackgroundEmitter(&mc, &mts)
+
+	assert.NoError(t, e.Distribution("queue.depth", 3))
+	e.Close()
+	e.Close()
+
+	// The remaining metrics are sent by Close
+	batch := <-mc.batches
+	assert.Equal(t, "queue.depth", batch[0].Name)
+	assert.False(t, e.listener.processor.IsProcessing())
+	assert.True(t, errors.Is(e.Distribution("queue.depth", 4), ErrMetricsDisabled))
+	assert.True(t, errors.Is(e.Set("queue.names", "orders"), ErrMetricsDisabled))
+	backgroundEmitters.mu.Lock()
+	assert.NotContains(t, backgroundEmitters.emitters, e)
+	backgroundEmitters.mu.Unlock()
+	// Closed emitters aren't flushed anymore
+	e.Flush()
+}
+
+func TestBackgroundEmitterKeepsTheSinkInfo(t *testing.T) {
+	setSinkInfo(SinkInfo{Sink: SinkAPI, Reason: "an API key is set"})
+	defer setSinkInfo(SinkInfo{Sink: SinkDisabled, Reason: "no metrics listener has been created"})
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	e := makeTestBackgroundEmitter(&mc, &mts)
+	defer e.Close()
+
+	assert.Equal(t, SinkAPI, GetSinkInfo().Sink)
+	assert.Equal(t, SinkCustom, e.listener.sinkInfo.Sink)
+}
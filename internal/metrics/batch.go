@@ -0,0 +1,120 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+)
+
+type (
+	// batchEvent holds the parts of an SQS, Kinesis or DynamoDB stream event used for the batch metrics
+	batchEvent struct {
+		Records []struct {
+			EventSourceARN string `json:"eventSourceARN"`
+		} `json:"Records"`
+	}
+
+	// batchInfo describes the records of the invocation's event, for the batch metrics
+	batchInfo struct {
+		records int
+		// tag identifies the queue, stream or table the records come from
+		tag string
+	}
+
+	// partialBatchResponse holds the failures of a partial batch response. They're nil if the response isn't
+	// a partial batch response, which is different from a partial batch response without any failure.
+	partialBatchResponse struct {
+		BatchItemFailures *[]json.RawMessage `json:"batchItemFailures"`
+	}
+)
+
+// batchInfoKey is the key used to store the batchInfo of the invocation in a Context object
+var batchInfoKey = new(contextKeytype)
+
+// getBatchInfo counts the records of SQS, Kinesis and DynamoDB stream events. It returns nil for other events.
+func getBatchInfo(ctx context.Context, msg json.RawMessage) *batchInfo {
+	source := eventsource.Get(ctx, msg)
+	if source != eventsource.SQS && source != eventsource.Kinesis && source != eventsource.DynamoDB {
+		return nil
+	}
+	event := batchEvent{}
+	if err := json.Unmarshal(msg, &event); err != nil || len(event.Records) == 0 {
+		return nil
+	}
+	return &batchInfo{
+		records: len(event.Records),
+		tag:     getBatchSourceTag(source, event.Records[0].EventSourceARN),
+	}
+}
+
+// getBatchSourceTag returns the tag naming the queue, stream or table of an event source ARN, such as
+// arn:aws:sqs:us-east-1:123456789012:my-queue, arn:aws:kinesis:us-east-1:123456789012:stream/my-stream or
+// arn:aws:dynamodb:us-east-1:123456789012:table/my-table/stream/2021-05-20T16:12:50.000. It returns an empty
+// string if the ARN is malformed.
+func getBatchSourceTag(source eventsource.Source, arn string) string {
+	arnSegments := strings.SplitN(arn, ":", 6)
+	if len(arnSegments) < 6 {
+		return ""
+	}
+	resource := arnSegments[5]
+	switch source {
+	case eventsource.SQS:
+		return fmt.Sprintf("queuename:%s", resource)
+	case eventsource.Kinesis:
+		if name := strings.TrimPrefix(resource, "stream/"); name != resource {
+			return fmt.Sprintf("streamname:%s", name)
+		}
+	case eventsource.DynamoDB:
+		if name := strings.TrimPrefix(resource, "table/"); name != resource {
+			return fmt.Sprintf("tablename:%s", strings.SplitN(name, "/", 2)[0])
+		}
+	}
+	return ""
+}
+
+// getBatchItemFailures returns the number of failures of a partial batch response, such as an
+// events.SQSEventResponse, and false if the response isn't a partial batch response
+func getBatchItemFailures(response interface{}) (int, bool) {
+	if response == nil {
+		return 0, false
+	}
+	content, err := json.Marshal(response)
+	if err != nil {
+		return 0, false
+	}
+	partial := partialBatchResponse{}
+	if err := json.Unmarshal(content, &partial); err != nil || partial.BatchItemFailures == nil {
+		return 0, false
+	}
+	return len(*partial.BatchItemFailures), true
+}
+
+// submitBatchMetrics sends the number of records of the invocation's event, and the number of them which
+// failed, when the handler returned a partial batch response
+func (l *Listener) submitBatchMetrics(ctx context.Context, response interface{}, err error) {
+	info, ok := ctx.Value(batchInfoKey).(*batchInfo)
+	if !ok || info == nil || err != nil {
+		return
+	}
+	failures, ok := getBatchItemFailures(response)
+	if !ok {
+		return
+	}
+	var tags []string
+	if info.tag != "" {
+		tags = append(tags, info.tag)
+	}
+	l.submitEnhancedMetric("batch_records", float64(info.records), ctx, tags...)
+	l.submitEnhancedMetric("batch_item_failures", float64(failures), ctx, tags...)
+}
@@ -0,0 +1,121 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	// batchItemFailure and sqsEventResponse have the shape of the partial batch responses of aws-lambda-go
+	batchItemFailure struct {
+		ItemIdentifier string `json:"itemIdentifier"`
+	}
+
+	sqsEventResponse struct {
+		BatchItemFailures []batchItemFailure `json:"batchItemFailures"`
+	}
+)
+
+func loadBatchEvent(t *testing.T, filename string) json.RawMessage {
+	payload, err := ioutil.ReadFile("../testdata/" + filename)
+	assert.NoError(t, err)
+	return payload
+}
+
+func TestGetBatchInfo(t *testing.T) {
+	info := getBatchInfo(context.Background(), loadBatchEvent(t, "sqs-event.json"))
+	assert.Equal(t, &batchInfo{records: 1, tag: "queuename:my-queue"}, info)
+
+	info = getBatchInfo(context.Background(), loadBatchEvent(t, "kinesis-event.json"))
+	assert.Equal(t, &batchInfo{records: 1, tag: "streamname:orders"}, info)
+
+	info = getBatchInfo(context.Background(), loadBatchEvent(t, "dynamodb-event.json"))
+	assert.Equal(t, &batchInfo{records: 1, tag: "tablename:orders"}, info)
+
+	assert.Nil(t, getBatchInfo(context.Background(), loadBatchEvent(t, "sns-event.json")))
+	assert.Nil(t, getBatchInfo(context.Background(), loadBatchEvent(t, "apig-rest-event.json")))
+	// The event source stored in the context is used when there is one
+	ctx := eventsource.WithSource(context.Background(), eventsource.Unknown)
+	assert.Nil(t, getBatchInfo(ctx, loadBatchEvent(t, "sqs-event.json")))
+}
+
+func TestGetBatchSourceTag(t *testing.T) {
+	assert.Equal(t, "queuename:my-queue", getBatchSourceTag(eventsource.SQS, "arn:aws:sqs:us-east-1:123456789012:my-queue"))
+	assert.Equal(t, "streamname:my-stream", getBatchSourceTag(eventsource.Kinesis, "arn:aws:kinesis:us-east-1:123456789012:stream/my-stream"))
+	assert.Equal(t, "tablename:my-table", getBatchSourceTag(eventsource.DynamoDB, "arn:aws:dynamodb:us-east-1:123456789012:table/my-table/stream/2021-05-20T16:12:50.000"))
+	assert.Equal(t, "", getBatchSourceTag(eventsource.SQS, "my-queue"))
+	assert.Equal(t, "", getBatchSourceTag(eventsource.Kinesis, "arn:aws:kinesis:us-east-1:123456789012:my-stream"))
+	assert.Equal(t, "", getBatchSourceTag(eventsource.DynamoDB, "arn:aws:dynamodb:us-east-1:123456789012:my-table"))
+}
+
+func TestGetBatchItemFailures(t *testing.T) {
+	failures, ok := getBatchItemFailures(sqsEventResponse{BatchItemFailures: []batchItemFailure{{ItemIdentifier: "1"}, {ItemIdentifier: "2"}}})
+	assert.True(t, ok)
+	assert.Equal(t, 2, failures)
+
+	failures, ok = getBatchItemFailures(&sqsEventResponse{BatchItemFailures: []batchItemFailure{}})
+	assert.True(t, ok)
+	assert.Equal(t, 0, failures)
+
+	failures, ok = getBatchItemFailures(map[string]interface{}{"batchItemFailures": []interface{}{map[string]string{"itemIdentifier": "1"}}})
+	assert.True(t, ok)
+	assert.Equal(t, 1, failures)
+
+	_, ok = getBatchItemFailures(nil)
+	assert.False(t, ok)
+	_, ok = getBatchItemFailures("ok")
+	assert.False(t, ok)
+	_, ok = getBatchItemFailures(map[string]string{"status": "ok"})
+	assert.False(t, ok)
+	// A nil slice marshals to null, which isn't a partial batch response
+	_, ok = getBatchItemFailures(sqsEventResponse{})
+	assert.False(t, ok)
+}
+
+func TestSubmitBatchMetrics(t *testing.T) {
+	ml := MakeListener(Config{EnhancedMetrics: true, ShouldUseLogForwarder: true})
+
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "kinesis-event.json"))
+		ml.HandlerFinished(ctx, sqsEventResponse{BatchItemFailures: []batchItemFailure{{ItemIdentifier: "1"}}}, nil)
+	})
+
+	assert.Contains(t, output, `{"m":"aws.lambda.enhanced.batch_records","v":1,`)
+	assert.Contains(t, output, `{"m":"aws.lambda.enhanced.batch_item_failures","v":1,`)
+	assert.Contains(t, output, `"streamname:orders"`)
+}
+
+func TestSubmitBatchMetricsSkipped(t *testing.T) {
+	ml := MakeListener(Config{EnhancedMetrics: true, ShouldUseLogForwarder: true})
+	response := sqsEventResponse{BatchItemFailures: []batchItemFailure{}}
+
+	output := captureOutput(func() {
+		// Not a partial batch response
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "sqs-event.json"))
+		ml.HandlerFinished(ctx, "ok", nil)
+		// Not a batch event
+		ctx = ml.HandlerStarted(context.Background(), loadBatchEvent(t, "sns-event.json"))
+		ml.HandlerFinished(ctx, response, nil)
+	})
+	assert.NotContains(t, output, "batch_records")
+
+	ml = MakeListener(Config{EnhancedMetrics: false, ShouldUseLogForwarder: true})
+	output = captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "sqs-event.json"))
+		ml.HandlerFinished(ctx, response, nil)
+	})
+	assert.NotContains(t, output, "batch_records")
+}
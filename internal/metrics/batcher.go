@@ -9,7 +9,6 @@
 package metrics
 
 import (
-	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -18,8 +17,16 @@ import (
 type (
 	// Batcher aggregates metrics with common properties,(metric name, tags, type etc)
 	Batcher struct {
-		metrics       map[string]Metric
+		metrics       map[batchMapKey]Metric
 		batchInterval time.Duration
+		// bucketWidth is the width of the buckets counts and gauges are rolled up into
+		bucketWidth time.Duration
+		// maxFutureSkew is how far in the future of the clock of the container the points can be
+		maxFutureSkew time.Duration
+		// rateStart is the time the rates of the batch started being summed, when the previous batch was flushed.
+		// rateEnd is the time of the last attempt to flush the batch.
+		rateStart time.Time
+		rateEnd   time.Time
 	}
 	// BatchKey identifies a batch of metrics
 	BatchKey struct {
@@ -27,54 +34,142 @@ type (
 		name       string
 		tags       []string
 		host       *string
+		// sampleRate keeps the points sampled at different rates in different batches
+		sampleRate float64
+	}
+	// batchMapKey is the comparable form of a BatchKey, with the tags sorted and joined
+	batchMapKey struct {
+		metricType MetricType
+		name       string
+		tags       string
+		host       string
+		hasHost    bool
+		sampleRate float64
+		// bucket is the start of the bucket of a bucketed metric, in nanoseconds since the epoch
+		bucket int64
 	}
 )
 
+// maxStackSortedTags is the number of tags which can be sorted without allocating
+const maxStackSortedTags = 16
+
 // MakeBatcher creates a new batcher object
 func MakeBatcher(batchInterval time.Duration) *Batcher {
 	return &Batcher{
 		batchInterval: batchInterval,
-		metrics:       map[string]Metric{},
+		bucketWidth:   defaultAggregationBucket,
+		maxFutureSkew: defaultMaxFutureSkew,
+		metrics:       map[batchMapKey]Metric{},
 	}
 }
 
-// AddMetric adds a point to a given metric
+// AddMetric adds a point to a given metric. Counts and gauges are rolled up by bucket of time, so that a single
+// point is sent for each bucket, while every point of distributions is kept.
 func (b *Batcher) AddMetric(metric Metric) {
-	sk := b.getStringKey(metric.ToBatchKey())
-	if existing, ok := b.metrics[sk]; ok {
+	key := getMapKey(metric.ToBatchKey())
+	if bucketed, ok := metric.(bucketedMetric); ok {
+		start := bucketed.pointTime().Truncate(b.bucketWidth)
+		bucketed.setBucket(start, b.bucketWidth)
+		key.bucket = start.UnixNano()
+	}
+	if existing, ok := b.metrics[key]; ok {
 		existing.Join(metric)
 	} else {
-		b.metrics[sk] = metric
+		b.metrics[key] = metric
 	}
 }
 
-// ToAPIMetrics converts the current batch of metrics into API metrics
+// PointCount returns the number of points in the current batch
+func (b *Batcher) PointCount() uint64 {
+	count := uint64(0)
+	for _, metric := range b.metrics {
+		count += pointCount(metric)
+	}
+	return count
+}
+
+// ToAPIMetrics converts the current batch of metrics into API metrics, in canonical order
 func (b *Batcher) ToAPIMetrics() []APIMetric {
 
-	ar := []APIMetric{}
+	ar := make([]APIMetric, 0, len(b.metrics))
 	interval := b.batchInterval / time.Second
+	window := b.rateWindow()
 
 	for _, metric := range b.metrics {
+		if rate, ok := metric.(*Rate); ok {
+			rate.window = window
+		}
 		values := metric.ToAPIMetric(interval)
 		for _, val := range values {
 			ar = append(ar, val)
 		}
 	}
+	CanonicalizeBatch(ar)
 	return ar
 }
 
-func (b *Batcher) getStringKey(bk BatchKey) string {
-	tagKey := getTagKey(bk.tags)
+// rateWindow returns the span of time the rates of the batch were summed over, from the flush of the previous
+// batch to the last attempt to flush this one. When it's unknown, or when no time elapsed by the clock, the
+// batch interval is used instead. Windows shorter than a second, the resolution of the intake, count as a
+// second, so that the counts of a short invocation aren't extrapolated to huge rates.
+func (b *Batcher) rateWindow() rateWindow {
+	if b.rateStart.IsZero() || !b.rateEnd.After(b.rateStart) {
+		return rateWindow{start: b.rateStart, width: b.batchInterval}
+	}
+	width := b.rateEnd.Sub(b.rateStart)
+	if width < minRateWindow {
+		width = minRateWindow
+	}
+	return rateWindow{start: b.rateStart, width: width}
+}
 
+func getMapKey(bk BatchKey) batchMapKey {
+	key := batchMapKey{
+		metricType: bk.metricType,
+		name:       bk.name,
+		tags:       getTagKey(bk.tags),
+		sampleRate: bk.sampleRate,
+	}
 	if bk.host != nil {
-		return fmt.Sprintf("(%s)-(%s)-(%s)-(%s)", bk.metricType, bk.name, tagKey, *bk.host)
+		key.host = *bk.host
+		key.hasHost = true
 	}
-	return fmt.Sprintf("(%s)-(%s)-(%s)", bk.metricType, bk.name, tagKey)
+	return key
 }
 
+// getTagKey joins the tags in sorted order, so that the order the tags were given in doesn't matter. It's called
+// for every metric added, so it avoids allocating more than the joined string.
 func getTagKey(tags []string) string {
-	sortedTags := make([]string, len(tags))
-	copy(sortedTags, tags)
-	sort.Strings(sortedTags)
-	return strings.Join(sortedTags, ":")
+	switch len(tags) {
+	case 0:
+		return ""
+	case 1:
+		return tags[0]
+	}
+
+	sortedTags := tags
+	if !sort.StringsAreSorted(tags) {
+		var buf [maxStackSortedTags]string
+		if len(tags) <= len(buf) {
+			sortedTags = buf[:len(tags)]
+		} else {
+			sortedTags = make([]string, len(tags))
+		}
+		copy(sortedTags, tags)
+		sort.Strings(sortedTags)
+	}
+
+	length := len(sortedTags) - 1
+	for _, tag := range sortedTags {
+		length += len(tag)
+	}
+	var builder strings.Builder
+	builder.Grow(length)
+	for i, tag := range sortedTags {
+		if i > 0 {
+			builder.WriteByte(':')
+		}
+		builder.WriteString(tag)
+	}
+	return builder.String()
 }
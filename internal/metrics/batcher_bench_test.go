@@ -0,0 +1,85 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// makeBenchmarkDistributions creates single point distributions like the ones sent by AddDistributionMetric,
+// spread over the given number of tag sets. The tag identifying the set is added after the given tags.
+func makeBenchmarkDistributions(n, tagSets int, tags ...string) []Distribution {
+	tm := time.Now()
+	distributions := make([]Distribution, n)
+	for i := range distributions {
+		distributions[i] = Distribution{
+			Name:   "orders.processed",
+			Tags:   append(append([]string{}, tags...), fmt.Sprintf("shard:%d", i%tagSets)),
+			Values: []MetricValue{{Timestamp: tm, Value: float64(i)}},
+		}
+	}
+	return distributions
+}
+
+func BenchmarkBatcherAddMetricSinglePoint(b *testing.B) {
+	distributions := makeBenchmarkDistributions(b.N, 10, "dd_lambda_layer:datadog-go1.16", "env:prod", "service:orders")
+	batcher := MakeBatcher(defaultBatchInterval)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range distributions {
+		batcher.AddMetric(&distributions[i])
+	}
+}
+
+func BenchmarkBatcherAddMetricUnsortedTags(b *testing.B) {
+	distributions := makeBenchmarkDistributions(b.N, 10, "service:orders", "env:prod", "dd_lambda_layer:datadog-go1.16")
+	batcher := MakeBatcher(defaultBatchInterval)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range distributions {
+		batcher.AddMetric(&distributions[i])
+	}
+}
+
+func BenchmarkBatcherAddMetricWithHost(b *testing.B) {
+	distributions := makeBenchmarkDistributions(b.N, 10, "env:prod")
+	host := "my-host"
+	for i := range distributions {
+		distributions[i].Host = &host
+	}
+	batcher := MakeBatcher(defaultBatchInterval)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range distributions {
+		batcher.AddMetric(&distributions[i])
+	}
+}
+
+func BenchmarkBatcherToAPIMetrics(b *testing.B) {
+	distributions := makeBenchmarkDistributions(1000, 100, "env:prod", "service:orders")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		batcher := MakeBatcher(defaultBatchInterval)
+		for j := range distributions {
+			d := distributions[j]
+			d.Values = append([]MetricValue(nil), d.Values...)
+			batcher.AddMetric(&d)
+		}
+		b.StartTimer()
+		batcher.ToAPIMetrics()
+	}
+}
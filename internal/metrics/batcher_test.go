@@ -59,6 +59,21 @@ func TestGetMetricFailDifferentName(t *testing.T) {
 
 }
 
+func TestGetMetricFailDifferentSampleRate(t *testing.T) {
+	tm := time.Now()
+	batcher := MakeBatcher(10)
+
+	batcher.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: tm, Value: 1}}})
+	batcher.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: tm, Value: 2}}, SampleRate: 0.1})
+	batcher.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: tm, Value: 3}}, SampleRate: 0.1})
+
+	byRate := map[float64]int{}
+	for _, m := range batcher.ToAPIMetrics() {
+		byRate[m.SampleRate] = len(m.Points)
+	}
+	assert.Equal(t, map[float64]int{0: 1, 0.1: 2}, byRate)
+}
+
 func TestGetMetricFailDifferentHost(t *testing.T) {
 	tm := time.Now()
 	batcher := MakeBatcher(10)
@@ -148,3 +163,148 @@ func TestToAPIMetricsSameInterval(t *testing.T) {
 
 	assert.Equal(t, expected, result)
 }
+
+func TestBatcherPointCount(t *testing.T) {
+	tm := time.Now()
+	batcher := MakeBatcher(10)
+	assert.Equal(t, uint64(0), batcher.PointCount())
+
+	for _, value := range []float64{1, 2, 3} {
+		dm := Distribution{Name: "metric-1", Tags: []string{"a"}}
+		dm.AddPoint(tm, value)
+		batcher.AddMetric(&dm)
+	}
+	dm := Distribution{Name: "metric-2", Tags: []string{"a"}}
+	dm.AddPoint(tm, 4)
+	batcher.AddMetric(&dm)
+
+	assert.Equal(t, uint64(4), batcher.PointCount())
+}
+
+func TestSetCountsDistinctMembers(t *testing.T) {
+	tm := time.Now()
+	batcher := MakeBatcher(10)
+
+	for _, member := range []string{"alice", "bob", "alice"} {
+		s := Set{Name: "users", Tags: []string{"a"}}
+		s.AddMember(tm, member)
+		batcher.AddMetric(&s)
+	}
+	s := Set{Name: "users", Tags: []string{"a"}}
+	s.AddPoint(tm, 42)
+	batcher.AddMetric(&s)
+
+	assert.Equal(t, []APIMetric{{
+		Name:       "users",
+		Tags:       []string{"a"},
+		MetricType: GaugeType,
+		Points:     []interface{}{[]interface{}{float64(tm.Unix()), float64(3)}},
+	}}, batcher.ToAPIMetrics())
+}
+
+func TestSetSaturates(t *testing.T) {
+	tm := time.Now()
+	batcher := MakeBatcher(10)
+
+	for _, member := range []string{"alice", "bob", "carol", "alice"} {
+		s := Set{Name: "users", Tags: []string{"a"}, MaxMembers: 2}
+		s.AddMember(tm, member)
+		batcher.AddMetric(&s)
+	}
+
+	apiMetrics := batcher.ToAPIMetrics()
+	assert.Len(t, apiMetrics, 1)
+	assert.Equal(t, []string{"a", setSaturatedTag}, apiMetrics[0].Tags)
+	assert.Equal(t, []interface{}{[]interface{}{float64(tm.Unix()), float64(2)}}, apiMetrics[0].Points)
+}
+
+func TestSetsAndGaugesAreBatchedApart(t *testing.T) {
+	tm := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10)
+
+	s := Set{Name: "users", Tags: []string{"a"}}
+	s.AddMember(tm, "alice")
+	batcher.AddMetric(&s)
+	g := Gauge{Name: "users", Tags: []string{"a"}}
+	g.AddPoint(tm, 42)
+	batcher.AddMetric(&g)
+
+	// Both are sent as gauges, but neither is joined into the other
+	apiMetrics := batcher.ToAPIMetrics()
+	assert.Len(t, apiMetrics, 2)
+	values := []interface{}{apiMetrics[0].Points[0].([]interface{})[1], apiMetrics[1].Points[0].([]interface{})[1]}
+	assert.ElementsMatch(t, []interface{}{float64(1), float64(42)}, values)
+}
+
+func TestCountsAreSummedInTheirBucket(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10)
+
+	for i := 0; i < 1000; i++ {
+		c := Count{Name: "requests", Tags: []string{"a"}}
+		c.AddPoint(start.Add(time.Duration(i)*time.Millisecond), 1)
+		batcher.AddMetric(&c)
+	}
+
+	interval := float64(10)
+	assert.Equal(t, []APIMetric{{
+		Name:       "requests",
+		Tags:       []string{"a"},
+		MetricType: CountType,
+		Interval:   &interval,
+		Points:     []interface{}{[]interface{}{float64(start.Unix()), float64(1000)}},
+	}}, batcher.ToAPIMetrics())
+}
+
+func TestGaugesKeepTheLastValueOfTheirBucket(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10)
+
+	for _, offset := range []int{3, 7, 1} {
+		g := Gauge{Name: "queue_depth", Tags: []string{"a"}}
+		g.AddPoint(start.Add(time.Duration(offset)*time.Second), float64(offset))
+		batcher.AddMetric(&g)
+	}
+
+	apiMetrics := batcher.ToAPIMetrics()
+	assert.Len(t, apiMetrics, 1)
+	assert.Equal(t, GaugeType, apiMetrics[0].MetricType)
+	assert.Equal(t, []interface{}{[]interface{}{float64(start.Unix()), float64(7)}}, apiMetrics[0].Points)
+}
+
+func TestBucketsOfDifferentTimesAreSentApart(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10)
+
+	for _, offset := range []time.Duration{0, 9 * time.Second, 10 * time.Second, 25 * time.Second} {
+		c := Count{Name: "requests"}
+		c.AddPoint(start.Add(offset), 1)
+		batcher.AddMetric(&c)
+	}
+
+	var points []interface{}
+	for _, m := range batcher.ToAPIMetrics() {
+		points = append(points, m.Points...)
+	}
+	assert.Equal(t, []interface{}{
+		[]interface{}{float64(start.Unix()), float64(2)},
+		[]interface{}{float64(start.Unix() + 10), float64(1)},
+		[]interface{}{float64(start.Unix() + 20), float64(1)},
+	}, points)
+}
+
+func TestDistributionsArentBucketed(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10)
+
+	for i := 0; i < 5; i++ {
+		dm := Distribution{Name: "latency"}
+		dm.AddPoint(start.Add(time.Duration(i)*time.Second), float64(i))
+		batcher.AddMetric(&dm)
+	}
+
+	apiMetrics := batcher.ToAPIMetrics()
+	assert.Len(t, apiMetrics, 1)
+	assert.Len(t, apiMetrics[0].Points, 5)
+	assert.Equal(t, uint64(5), batcher.PointCount())
+}
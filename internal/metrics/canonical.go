@@ -0,0 +1,92 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+)
+
+// CanonicalizeBatch puts a batch in a stable order, so that its payload only depends on its metrics: the tags of each
+// metric are sorted, its points are ordered by timestamp, and the metrics are sorted by name, type, host, tags, sample
+// rate and first timestamp, which tells apart the buckets of counts and gauges. The batch is sorted in place, but the
+// tags and points which need reordering are copied first, so the slices they share with other metrics are left
+// untouched.
+func CanonicalizeBatch(batch []APIMetric) {
+	for i := range batch {
+		metric := &batch[i]
+		if !sort.StringsAreSorted(metric.Tags) {
+			tags := append([]string(nil), metric.Tags...)
+			sort.Strings(tags)
+			metric.Tags = tags
+		}
+		if !pointsAreSorted(metric.Points) {
+			points := append([]interface{}(nil), metric.Points...)
+			sort.SliceStable(points, func(i, j int) bool {
+				return pointTimestamp(points[i]) < pointTimestamp(points[j])
+			})
+			metric.Points = points
+		}
+	}
+	sort.SliceStable(batch, func(i, j int) bool {
+		return lessAPIMetric(&batch[i], &batch[j])
+	})
+}
+
+func lessAPIMetric(a, b *APIMetric) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.MetricType != b.MetricType {
+		return a.MetricType < b.MetricType
+	}
+	if hostA, hostB := hostName(a.Host), hostName(b.Host); hostA != hostB {
+		return hostA < hostB
+	}
+	if tagsA, tagsB := strings.Join(a.Tags, ","), strings.Join(b.Tags, ","); tagsA != tagsB {
+		return tagsA < tagsB
+	}
+	if a.SampleRate != b.SampleRate {
+		return a.SampleRate < b.SampleRate
+	}
+	return firstTimestamp(a.Points) < firstTimestamp(b.Points)
+}
+
+func firstTimestamp(points []interface{}) float64 {
+	if len(points) == 0 {
+		return 0
+	}
+	return pointTimestamp(points[0])
+}
+
+func hostName(host *string) string {
+	if host == nil {
+		return ""
+	}
+	return *host
+}
+
+func pointsAreSorted(points []interface{}) bool {
+	for i := 1; i < len(points); i++ {
+		if pointTimestamp(points[i]) < pointTimestamp(points[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// pointTimestamp returns the timestamp of a point, which is the first element of its pair
+func pointTimestamp(point interface{}) float64 {
+	pair, ok := point.([]interface{})
+	if !ok || len(pair) == 0 {
+		return 0
+	}
+	timestamp, _ := pair[0].(float64)
+	return timestamp
+}
@@ -0,0 +1,84 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeBatchSortsTagsAndPoints(t *testing.T) {
+	tags := []string{"env:prod", "a:b"}
+	points := []interface{}{
+		[]interface{}{float64(20), []interface{}{float64(2)}},
+		[]interface{}{float64(10), []interface{}{float64(1)}},
+	}
+	batch := []APIMetric{{Name: "metric-1", Tags: tags, MetricType: DistributionType, Points: points}}
+
+	CanonicalizeBatch(batch)
+
+	assert.Equal(t, []string{"a:b", "env:prod"}, batch[0].Tags)
+	assert.Equal(t, []interface{}{
+		[]interface{}{float64(10), []interface{}{float64(1)}},
+		[]interface{}{float64(20), []interface{}{float64(2)}},
+	}, batch[0].Points)
+	// The slices the metric was built from are left as they were
+	assert.Equal(t, []string{"env:prod", "a:b"}, tags)
+	assert.Equal(t, float64(20), pointTimestamp(points[0]))
+}
+
+func TestCanonicalizeBatchSortsMetrics(t *testing.T) {
+	host := "host-1"
+	batch := []APIMetric{
+		{Name: "metric-2", MetricType: DistributionType},
+		{Name: "metric-1", Tags: []string{"b"}, MetricType: DistributionType},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: GaugeType},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: DistributionType, Host: &host},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: DistributionType, SampleRate: 0.5},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: DistributionType},
+	}
+
+	CanonicalizeBatch(batch)
+
+	assert.Equal(t, []APIMetric{
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: DistributionType},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: DistributionType, SampleRate: 0.5},
+		{Name: "metric-1", Tags: []string{"b"}, MetricType: DistributionType},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: DistributionType, Host: &host},
+		{Name: "metric-1", Tags: []string{"a"}, MetricType: GaugeType},
+		{Name: "metric-2", MetricType: DistributionType},
+	}, batch)
+}
+
+func TestToAPIMetricsIsStable(t *testing.T) {
+	tm := time.Unix(1000, 0)
+	var payloads []string
+	for i := 0; i < 10; i++ {
+		batcher := MakeBatcher(10)
+		for _, name := range []string{"c", "a", "b"} {
+			dm := Distribution{Name: name, Tags: []string{"z", "y"}}
+			dm.AddPoint(tm.Add(time.Second), 2)
+			dm.AddPoint(tm, 1)
+			batcher.AddMetric(&dm)
+		}
+		payload, err := MarshalBatch(batcher.ToAPIMetrics())
+		assert.NoError(t, err)
+		payloads = append(payloads, string(payload))
+	}
+
+	expected := `{"series":[` +
+		`{"metric":"a","tags":["y","z"],"type":"distribution","points":[[1000,[1]],[1001,[2]]],"metadata":{"origin":{"origin_product":1,"origin_sub_product":38,"origin_product_detail":51}}},` +
+		`{"metric":"b","tags":["y","z"],"type":"distribution","points":[[1000,[1]],[1001,[2]]],"metadata":{"origin":{"origin_product":1,"origin_sub_product":38,"origin_product_detail":51}}},` +
+		`{"metric":"c","tags":["y","z"],"type":"distribution","points":[[1000,[1]],[1001,[2]]],"metadata":{"origin":{"origin_product":1,"origin_sub_product":38,"origin_product_detail":51}}}]}`
+	for _, payload := range payloads {
+		assert.Equal(t, expected, payload)
+	}
+}
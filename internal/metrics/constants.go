@@ -13,12 +13,55 @@ import "time"
 const (
 	apiKeyParam                        = "api_key"
 	appKeyParam                        = "application_key"
+	apiKeyHeader                       = "DD-API-KEY"
+	appKeyHeader                       = "DD-APPLICATION-KEY"
+	redactedCredential                 = "redacted"
 	defaultRetryInterval               = time.Millisecond * 250
+	defaultMaxRetries                  = 2
 	defaultBatchInterval               = time.Second * 15
 	defaultHttpClientTimeout           = time.Second * 5
 	defaultCircuitBreakerInterval      = time.Second * 30
 	defaultCircuitBreakerTimeout       = time.Second * 60
 	defaultCircuitBreakerTotalFailures = 4
+	// maxPayloadDumps limits the number of metrics payloads logged per container when payload dumps are enabled
+	maxPayloadDumps = 5
+	// maxPendingMetrics limits the number of metrics sent after their invocation finished, which are kept
+	// for the batch of the next invocation
+	maxPendingMetrics = 1000
+	// maxPreInitMetrics limits the number of metrics sent before the first invocation, which are kept for its
+	// batch
+	maxPreInitMetrics = 1000
+	// defaultSetMaxMembers is the number of distinct members above which a set stops counting
+	defaultSetMaxMembers = 1000
+	// setSaturatedTag is added to the sets which stopped counting because they reached their maximum members
+	setSaturatedTag = "set_saturated:true"
+	// prewarmTimeout caps the time spent opening a connection to the API during init
+	prewarmTimeout = time.Second
+	// memorySampleInterval is the period of the memory sampler during invocations
+	memorySampleInterval = 250 * time.Millisecond
+	// defaultMemoryPressureThreshold is the share of the memory limit above which the memory pressure is reported
+	defaultMemoryPressureThreshold = 0.92
+	// defaultAggregationBucket is the width of the buckets counts and gauges are rolled up into, as in the
+	// DogStatsD aggregator
+	defaultAggregationBucket = 10 * time.Second
+	// defaultMaxFutureSkew is how far in the future of the clock of the container the points can be before
+	// they're clamped
+	defaultMaxFutureSkew = 10 * time.Minute
+	// defaultMaxFlushDuration bounds the time the end of an invocation waits for the metrics to be sent
+	defaultMaxFlushDuration = 3 * time.Second
+	// defaultFlushConcurrency is the number of requests of a flush sent to the API at the same time
+	defaultFlushConcurrency = 3
+	// minRateWindow is the shortest span of time the rates are divided by
+	minRateWindow = time.Second
+	// resourceTagsTimeout bounds the time the first invocation waits for the tags of the function
+	resourceTagsTimeout = 500 * time.Millisecond
+	// degradedMetric is sent once for each degraded mode the library enters, tagged with its reason
+	degradedMetric = "datadog.lambda_go.degraded"
+	// startupMetric is sent on the first invocation of a container, tagged with the version and the features
+	// of the library
+	startupMetric = "datadog.lambda_go.startup"
+	// enhancedMetricsPrefix is the prefix of the names of the enhanced metrics
+	enhancedMetricsPrefix = "aws.lambda.enhanced."
 )
 
 // MetricType enumerates all the available metric types
@@ -28,4 +71,14 @@ const (
 
 	// DistributionType represents a distribution metric
 	DistributionType MetricType = "distribution"
+	// GaugeType represents a gauge metric, sent to the series endpoint
+	GaugeType MetricType = "gauge"
+	// CountType represents a count metric, sent to the series endpoint
+	CountType MetricType = "count"
+	// RateType represents a rate metric, whose value is per second over its interval, sent to the series endpoint
+	RateType MetricType = "rate"
+
+	// setBatchType tells sets apart from gauges in the keys of a batch. Sets are sent as gauges of their number
+	// of members, but a set and a gauge with the same name and tags mustn't be joined.
+	setBatchType MetricType = "set"
 )
@@ -0,0 +1,101 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+type (
+	// EmitterCount is the number of points emitted under a metric name since the container started
+	EmitterCount struct {
+		Name   string `json:"name"`
+		Points uint64 `json:"points"`
+	}
+
+	// emitters counts the points emitted by metric name. The names beyond the first maxEmitterNames are counted
+	// together under otherEmitters, so that a runaway emitter of names doesn't grow the map without bound.
+	emitters struct {
+		mu     sync.RWMutex
+		counts map[string]*uint64
+		other  uint64
+	}
+)
+
+const (
+	// maxEmitterNames is the number of metric names counted on their own
+	maxEmitterNames = 500
+	// otherEmitters is the name of the count of the metric names beyond maxEmitterNames. It isn't a valid metric
+	// name, so it can't be mistaken for one.
+	otherEmitters = "(other)"
+	// topEmittersCount is the number of metric names reported in the stats and at shutdown
+	topEmittersCount = 10
+	// topEmittersMessage is the message of the log line listing the top emitters at shutdown
+	topEmittersMessage = "datadog.lambda_go.top_emitters"
+)
+
+func makeEmitters() *emitters {
+	return &emitters{counts: map[string]*uint64{}}
+}
+
+// add counts a point emitted under a metric name. Names already counted only take a read lock and an atomic add.
+func (e *emitters) add(name string) {
+	e.mu.RLock()
+	count, ok := e.counts[name]
+	e.mu.RUnlock()
+	if !ok {
+		e.mu.Lock()
+		count, ok = e.counts[name]
+		if !ok && len(e.counts) < maxEmitterNames {
+			count = new(uint64)
+			e.counts[name] = count
+			ok = true
+		}
+		e.mu.Unlock()
+	}
+	if !ok {
+		count = &e.other
+	}
+	atomic.AddUint64(count, 1)
+}
+
+// top returns the n metric names which emitted the most points, the most first. The names beyond
+// maxEmitterNames are ranked together as otherEmitters.
+func (e *emitters) top(n int) []EmitterCount {
+	e.mu.RLock()
+	counts := make([]EmitterCount, 0, len(e.counts)+1)
+	for name, count := range e.counts {
+		counts = append(counts, EmitterCount{Name: name, Points: atomic.LoadUint64(count)})
+	}
+	e.mu.RUnlock()
+	if other := atomic.LoadUint64(&e.other); other > 0 {
+		counts = append(counts, EmitterCount{Name: otherEmitters, Points: other})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Points != counts[j].Points {
+			return counts[i].Points > counts[j].Points
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// logTop logs the metric names which emitted the most points since the container started
+func (e *emitters) logTop() {
+	logger.InfoWithFields(topEmittersMessage, logger.Fields{
+		"top_emitters": e.top(topEmittersCount),
+	})
+}
@@ -0,0 +1,105 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmittersRankNamesByPoints(t *testing.T) {
+	e := makeEmitters()
+	for i := 0; i < 3; i++ {
+		e.add("orders.created")
+	}
+	e.add("orders.shipped")
+	e.add("orders.cancelled")
+
+	assert.Equal(t, []EmitterCount{{Name: "orders.created", Points: 3}, {Name: "orders.cancelled", Points: 1}}, e.top(2))
+	assert.Len(t, e.top(10), 3)
+}
+
+func TestEmittersAreBounded(t *testing.T) {
+	e := makeEmitters()
+	for i := 0; i < maxEmitterNames+20; i++ {
+		e.add(fmt.Sprintf("metric-%d", i))
+	}
+	e.add("metric-0")
+	for i := 0; i < 5; i++ {
+		e.add("runaway")
+	}
+
+	assert.Len(t, e.counts, maxEmitterNames)
+	// The names seen after the map was full are counted together
+	assert.Equal(t, []EmitterCount{{Name: otherEmitters, Points: 25}, {Name: "metric-0", Points: 2}}, e.top(2))
+}
+
+func TestEmittersConcurrentAdds(t *testing.T) {
+	e := makeEmitters()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e.add("shared")
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, []EmitterCount{{Name: "shared", Points: 800}}, e.top(10))
+}
+
+func TestStatsReportTopEmitters(t *testing.T) {
+	ml := MakeListener(Config{})
+	ml.AddDistributionMetric("latency", 1, time.Now(), false)
+	ml.AddDistributionMetric("latency", 2, time.Now(), false)
+	ml.AddSetMetric("users", "alice", time.Now())
+
+	stats := ml.Stats()
+	assert.Equal(t, []EmitterCount{{Name: "latency", Points: 2}, {Name: "users", Points: 1}}, stats.TopEmitters)
+
+	payload, err := json.Marshal(stats)
+	assert.NoError(t, err)
+	assert.Contains(t, string(payload), `"top_emitters":[{"name":"latency","points":2},{"name":"users","points":1}]`)
+}
+
+func TestTopEmittersAreLoggedOnTerminate(t *testing.T) {
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stdout)
+
+	ml := MakeListener(Config{LogTopEmitters: true})
+	ml.AddDistributionMetric("orders.created", 1, time.Now(), false)
+	assert.NotContains(t, output.String(), topEmittersMessage)
+
+	ml.Terminate()
+	assert.Contains(t, output.String(), topEmittersMessage)
+	assert.Contains(t, output.String(), `"top_emitters":[{"name":"orders.created","points":1}]`)
+}
+
+func TestTopEmittersAreOnlyLoggedWhenEnabled(t *testing.T) {
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stdout)
+
+	ml := MakeListener(Config{})
+	ml.AddDistributionMetric("orders.created", 1, time.Now(), false)
+	ml.Terminate()
+	assert.NotContains(t, output.String(), topEmittersMessage)
+}
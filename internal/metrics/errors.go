@@ -0,0 +1,37 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrMetricsDisabled is returned for metrics which can't be sent, because no way of sending them is
+	// configured, the handler isn't wrapped, or the invocation they were sent to was torn down
+	ErrMetricsDisabled = errors.New("metrics are disabled")
+	// ErrBufferFull is returned for metrics dropped because too many were buffered
+	ErrBufferFull = errors.New("the metrics buffer is full")
+	// ErrInvalidMetric is returned for metrics rejected because of their name, value, sample rate or timestamp
+	ErrInvalidMetric = errors.New("invalid metric")
+)
+
+// validateMetric rejects metrics without a name, and values which can't be encoded in the JSON of a batch,
+// which would fail as a whole
+func validateMetric(metric string, value float64) error {
+	if metric == "" {
+		return fmt.Errorf("%w: the metric has no name", ErrInvalidMetric)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%w: the value of metric %q is %v", ErrInvalidMetric, metric, value)
+	}
+	return nil
+}
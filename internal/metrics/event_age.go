@@ -0,0 +1,122 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+)
+
+// ageEvent holds the parts of an SQS, Kinesis, DynamoDB stream or EventBridge event used for the event age
+type ageEvent struct {
+	Records []struct {
+		EventSourceARN string `json:"eventSourceARN"`
+		Attributes     struct {
+			// SentTimestamp is the time the message was sent to the queue, in milliseconds since the epoch
+			SentTimestamp string `json:"SentTimestamp"`
+		} `json:"attributes"`
+		Kinesis struct {
+			// ApproximateArrivalTimestamp is the time the record reached the stream, in seconds since the epoch
+			ApproximateArrivalTimestamp float64 `json:"approximateArrivalTimestamp"`
+		} `json:"kinesis"`
+		DynamoDB struct {
+			// ApproximateCreationDateTime is the time the change was made to the table, in seconds since the epoch
+			ApproximateCreationDateTime float64 `json:"ApproximateCreationDateTime"`
+		} `json:"dynamodb"`
+	} `json:"Records"`
+	Source string `json:"source"`
+	Time   string `json:"time"`
+}
+
+// getEventTime returns the time of the oldest record of SQS, Kinesis and DynamoDB stream events, or the time of
+// EventBridge events, with the tag naming their queue, stream, table or EventBridge source. It returns false for
+// other events and for events without a time.
+func getEventTime(source eventsource.Source, msg json.RawMessage) (time.Time, string, bool) {
+	if source != eventsource.SQS && source != eventsource.Kinesis && source != eventsource.DynamoDB &&
+		source != eventsource.EventBridge {
+		return time.Time{}, "", false
+	}
+	event := ageEvent{}
+	if err := json.Unmarshal(msg, &event); err != nil {
+		return time.Time{}, "", false
+	}
+
+	if source == eventsource.EventBridge {
+		eventTime, err := time.Parse(time.RFC3339, event.Time)
+		if err != nil {
+			return time.Time{}, "", false
+		}
+		tag := ""
+		if event.Source != "" {
+			tag = fmt.Sprintf("eventbridge_source:%s", event.Source)
+		}
+		return eventTime, tag, true
+	}
+
+	oldest := time.Time{}
+	for _, record := range event.Records {
+		recordTime := time.Time{}
+		switch source {
+		case eventsource.SQS:
+			if sent, err := strconv.ParseInt(record.Attributes.SentTimestamp, 10, 64); err == nil && sent > 0 {
+				recordTime = time.Unix(0, sent*int64(time.Millisecond))
+			}
+		case eventsource.Kinesis:
+			recordTime = secondsToTime(record.Kinesis.ApproximateArrivalTimestamp)
+		case eventsource.DynamoDB:
+			recordTime = secondsToTime(record.DynamoDB.ApproximateCreationDateTime)
+		}
+		if !recordTime.IsZero() && (oldest.IsZero() || recordTime.Before(oldest)) {
+			oldest = recordTime
+		}
+	}
+	if oldest.IsZero() {
+		return time.Time{}, "", false
+	}
+	return oldest, getBatchSourceTag(source, event.Records[0].EventSourceARN), true
+}
+
+// secondsToTime converts a time in seconds since the epoch, with a fractional part, to a time rounded to the
+// millisecond, the precision of the event sources. It returns the zero time for values which aren't positive.
+func secondsToTime(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(math.Round(seconds*1000))*int64(time.Millisecond))
+}
+
+// submitEventAge sends the time from the oldest record of the invocation's event to now, in milliseconds.
+// Ages which are negative, as the clock of the container is behind the clock of the event source, are sent as 0.
+func (l *Listener) submitEventAge(ctx context.Context, msg json.RawMessage) {
+	if !l.enhancedEnabled() {
+		return
+	}
+	source := eventsource.Get(ctx, msg)
+	eventTime, tag, ok := getEventTime(source, msg)
+	if !ok {
+		return
+	}
+	age := l.timeService.Now().Sub(eventTime)
+	if age < 0 {
+		atomic.AddUint64(&l.stats.EventAgesClamped, 1)
+		age = 0
+	}
+	tags := []string{fmt.Sprintf("event_source:%s", source)}
+	if tag != "" {
+		tags = append(tags, tag)
+	}
+	l.submitEnhancedMetric("event_age", milliseconds(age), ctx, tags...)
+}
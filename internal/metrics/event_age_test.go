@@ -0,0 +1,109 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEventTime(t *testing.T) {
+	for _, test := range []struct {
+		filename string
+		source   eventsource.Source
+		time     time.Time
+		tag      string
+	}{
+		{"sqs-event.json", eventsource.SQS, time.Unix(0, 1545082649183*int64(time.Millisecond)), "queuename:my-queue"},
+		{"kinesis-event.json", eventsource.Kinesis, time.Unix(1621527170, 123000000), "streamname:orders"},
+		{"dynamodb-event.json", eventsource.DynamoDB, time.Unix(1621527170, 0), "tablename:orders"},
+		{"eventbridge-event.json", eventsource.EventBridge, time.Date(2021, 5, 20, 16, 12, 50, 0, time.UTC), "eventbridge_source:com.example.orders"},
+	} {
+		eventTime, tag, ok := getEventTime(test.source, loadBatchEvent(t, test.filename))
+		assert.True(t, ok, test.filename)
+		assert.WithinDuration(t, test.time, eventTime, time.Millisecond, test.filename)
+		assert.Equal(t, test.tag, tag, test.filename)
+	}
+}
+
+func TestGetEventTimeOfOldestRecord(t *testing.T) {
+	event := json.RawMessage(`{"Records":[
+		{"eventSource":"aws:sqs","eventSourceARN":"arn:aws:sqs:us-east-1:123456789012:orders","attributes":{"SentTimestamp":"1700000002000"}},
+		{"eventSource":"aws:sqs","eventSourceARN":"arn:aws:sqs:us-east-1:123456789012:orders","attributes":{"SentTimestamp":"1700000000000"}},
+		{"eventSource":"aws:sqs","eventSourceARN":"arn:aws:sqs:us-east-1:123456789012:orders","attributes":{"SentTimestamp":"malformed"}}
+	]}`)
+
+	eventTime, _, ok := getEventTime(eventsource.SQS, event)
+
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1700000000, 0), eventTime)
+}
+
+func TestGetEventTimeSkipped(t *testing.T) {
+	_, _, ok := getEventTime(eventsource.SNS, loadBatchEvent(t, "sns-event.json"))
+	assert.False(t, ok)
+
+	_, _, ok = getEventTime(eventsource.SQS, json.RawMessage(`{"Records":[{"eventSource":"aws:sqs","attributes":{}}]}`))
+	assert.False(t, ok)
+
+	_, _, ok = getEventTime(eventsource.EventBridge, json.RawMessage(`{"source":"orders","detail-type":"placed","time":"yesterday"}`))
+	assert.False(t, ok)
+}
+
+func TestSubmitEventAge(t *testing.T) {
+	mts := makeMockTimeService()
+	mts.now = time.Unix(1621527172, 623000000)
+	ml := MakeListener(Config{EnhancedMetrics: true, ShouldUseLogForwarder: true, TimeService: &mts})
+
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "kinesis-event.json"))
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+
+	assert.Contains(t, output, `{"m":"aws.lambda.enhanced.event_age","v":2500,`)
+	assert.Contains(t, output, `"event_source:kinesis"`)
+	assert.Contains(t, output, `"streamname:orders"`)
+	assert.Equal(t, uint64(0), ml.Stats().EventAgesClamped)
+}
+
+func TestSubmitEventAgeClampsNegativeAges(t *testing.T) {
+	mts := makeMockTimeService()
+	// The clock of the container is behind the clock of the stream
+	mts.now = time.Unix(1621527169, 0)
+	ml := MakeListener(Config{EnhancedMetrics: true, ShouldUseLogForwarder: true, TimeService: &mts})
+
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "dynamodb-event.json"))
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+
+	assert.Contains(t, output, `{"m":"aws.lambda.enhanced.event_age","v":0,`)
+	assert.Equal(t, uint64(1), ml.Stats().EventAgesClamped)
+}
+
+func TestSubmitEventAgeSkipped(t *testing.T) {
+	ml := MakeListener(Config{EnhancedMetrics: true, ShouldUseLogForwarder: true})
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "sns-event.json"))
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+	assert.NotContains(t, output, "event_age")
+
+	ml = MakeListener(Config{EnhancedMetrics: false, ShouldUseLogForwarder: true})
+	output = captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), loadBatchEvent(t, "sqs-event.json"))
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+	assert.NotContains(t, output, "event_age")
+}
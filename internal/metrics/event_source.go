@@ -0,0 +1,113 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+)
+
+// eventSourceTagsKey is the key used to store the tags describing the invocation's event source in a Context object
+var eventSourceTagsKey = new(contextKeytype)
+
+// getEventSourceTags returns the enhanced metrics tags describing the event which invoked the function. Kafka
+// events are tagged with the topics of their records.
+func getEventSourceTags(msg json.RawMessage) []string {
+	event, ok := eventsource.ParseKafkaEvent(msg)
+	if !ok {
+		return nil
+	}
+
+	topics := map[string]bool{}
+	for _, records := range event.Records {
+		for _, record := range records {
+			if record.Topic != "" {
+				topics[record.Topic] = true
+			}
+		}
+	}
+	tags := make([]string, 0, len(topics))
+	for topic := range topics {
+		tags = append(tags, fmt.Sprintf("kafka_topic:%s", topic))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// appendMessageGroupTag adds the message_group_id tag of events from SQS FIFO queues to the event source tags
+func appendMessageGroupTag(ctx context.Context, tags []string) []string {
+	if details, ok := eventsource.DetailsFromContext(ctx); ok && details.MessageGroupID != "" {
+		tags = append(tags, fmt.Sprintf("message_group_id:%s", details.MessageGroupID))
+	}
+	return tags
+}
+
+// apiGatewayAuthorizerEvent holds the authorizer context of a request to a REST or HTTP API
+type apiGatewayAuthorizerEvent struct {
+	RequestContext struct {
+		Authorizer map[string]json.RawMessage `json:"authorizer"`
+	} `json:"requestContext"`
+}
+
+// getAuthorizerTags returns a key:value tag for each of keys found in the authorizer context of an API Gateway
+// request. Keys are looked up in the context of a Lambda authorizer, which is flattened into the authorizer of
+// REST APIs and nested under lambda for HTTP APIs, then in the claims of JWT and Cognito authorizers. Keys which
+// aren't found, or whose value isn't a string, a number or a boolean, are skipped.
+func getAuthorizerTags(msg json.RawMessage, keys []string) []string {
+	event := apiGatewayAuthorizerEvent{}
+	if err := json.Unmarshal(msg, &event); err != nil || len(event.RequestContext.Authorizer) == 0 {
+		return nil
+	}
+	authorizer := event.RequestContext.Authorizer
+	layouts := []map[string]json.RawMessage{
+		authorizer,
+		nestedObject(authorizer, "lambda"),
+		nestedObject(nestedObject(authorizer, "jwt"), "claims"),
+		nestedObject(authorizer, "claims"),
+	}
+
+	tags := []string{}
+	for _, key := range keys {
+		for _, layout := range layouts {
+			if value, ok := scalarString(layout[key]); ok {
+				tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// nestedObject returns the object under key, or nil when there's none
+func nestedObject(object map[string]json.RawMessage, key string) map[string]json.RawMessage {
+	nested := map[string]json.RawMessage{}
+	if raw, ok := object[key]; !ok || json.Unmarshal(raw, &nested) != nil {
+		return nil
+	}
+	return nested
+}
+
+// scalarString formats a JSON string, number or boolean as a tag value
+func scalarString(raw json.RawMessage) (string, bool) {
+	var value interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil {
+		return "", false
+	}
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case float64, bool:
+		return string(raw), true
+	}
+	return "", false
+}
@@ -0,0 +1,54 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// finishWithin finishes the processor, and returns once it's finished or when the max flush duration elapsed on
+// the processor's TimeService, whichever comes first. When the flush is cut short, the send in flight carries on in
+// the background without retries, and the points it can't send are spilled or dropped like those of a failed
+// batch. Once the handler returns, Lambda may freeze the container while that goroutine is still sending: it then
+// resumes with the next invocation, whose flush doesn't wait for it, and its request may have timed out by then.
+func (p *processor) finishWithin(d time.Duration) {
+	if p.flushCapped() {
+		// The processor was already cut short, and its goroutine is still sending
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		p.finish()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-p.timeService.After(d):
+		atomic.StoreUint32(&p.capped, 1)
+		atomic.AddUint64(&p.stats.FlushesCapped, 1)
+		logger.Debug(fmt.Sprintf("the flush of the metrics took longer than %s, the invocation doesn't wait for it", d))
+	}
+}
+
+// flushCapped tells whether FinishProcessing stopped waiting for the flush
+func (p *processor) flushCapped() bool {
+	return atomic.LoadUint32(&p.capped) == 1
+}
+
+// dropReason returns the counter of the points which couldn't be sent nor spilled
+func (p *processor) dropReason() *uint64 {
+	if p.flushCapped() {
+		return &p.stats.Drops.FlushCapped
+	}
+	return &p.stats.Drops.SendFailed
+}
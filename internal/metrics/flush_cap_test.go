@@ -0,0 +1,143 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockedClient blocks every send until it's released, and then fails it
+type blockedClient struct {
+	release chan struct{}
+	calls   uint32
+}
+
+func (c *blockedClient) SendMetrics(mts []APIMetric) error {
+	atomic.AddUint32(&c.calls, 1)
+	<-c.release
+	return errors.New("the intake timed out")
+}
+
+const flushCapTolerance = 250 * time.Millisecond
+
+func invokeWithSlowFlush(ml *Listener, mts *mockTimeService) time.Duration {
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	ml.AddDistributionMetric("metric-1", 1, mts.now, false)
+	start := time.Now()
+	ml.HandlerFinished(ctx, nil, nil)
+	return time.Since(start)
+}
+
+func waitUntilFlushed(t *testing.T, ml *Listener) {
+	assert.Eventually(t, func() bool { return !ml.processor.IsProcessing() }, time.Second, time.Millisecond)
+}
+
+func TestMaxFlushDurationBoundsTheFinish(t *testing.T) {
+	client := &blockedClient{release: make(chan struct{})}
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: client, TimeService: &mts, DisableFlushJitter: true, ShouldRetryOnFailure: true, MaxFlushDuration: 100 * time.Millisecond})
+
+	elapsed := invokeWithSlowFlush(&ml, &mts)
+
+	assert.True(t, elapsed >= 100*time.Millisecond, "the finish returned after %s", elapsed)
+	assert.True(t, elapsed < 100*time.Millisecond+flushCapTolerance, "the finish returned after %s", elapsed)
+	assert.Equal(t, uint64(1), ml.Stats().FlushesCapped)
+
+	// The send in flight fails once the invocation stopped waiting for it, and isn't retried
+	close(client.release)
+	waitUntilFlushed(t, &ml)
+	stats := ml.Stats()
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&client.calls))
+	assert.Equal(t, uint64(0), stats.Retries)
+	// Every point buffered by the invocation was in the batch cut short
+	assert.Equal(t, stats.PointsBuffered, stats.Drops.FlushCapped)
+	assert.Equal(t, uint64(0), stats.Drops.SendFailed)
+	assert.Equal(t, uint64(1), stats.Deliveries.Failed)
+}
+
+func TestMaxFlushDurationElapsesOnTheTimeService(t *testing.T) {
+	client := &blockedClient{release: make(chan struct{})}
+	mts := makeMockTimeService()
+	// The time service says the hour elapsed straight away
+	mts.afterChan = make(chan time.Time, 1)
+	mts.afterChan <- mts.now.Add(time.Hour)
+	ml := MakeListener(Config{Client: client, TimeService: &mts, DisableFlushJitter: true, MaxFlushDuration: time.Hour})
+
+	elapsed := invokeWithSlowFlush(&ml, &mts)
+
+	assert.True(t, elapsed < flushCapTolerance, "the finish returned after %s", elapsed)
+	assert.Equal(t, uint64(1), ml.Stats().FlushesCapped)
+	close(client.release)
+	waitUntilFlushed(t, &ml)
+}
+
+func TestMaxFlushDurationSpillsTheUnsentMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	client := &blockedClient{release: make(chan struct{})}
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: client, TimeService: &mts, DisableFlushJitter: true, ShouldRetryOnFailure: true, MaxFlushDuration: 50 * time.Millisecond, SpillFailedBatches: true, SpoolDir: dir})
+
+	invokeWithSlowFlush(&ml, &mts)
+	close(client.release)
+	waitUntilFlushed(t, &ml)
+
+	stats := ml.Stats()
+	assert.Equal(t, uint64(1), stats.FlushesCapped)
+	assert.Equal(t, stats.PointsBuffered, stats.PointsSpilled)
+	assert.Equal(t, uint64(0), stats.Drops.FlushCapped)
+}
+
+func TestMaxFlushDurationIsDefault(t *testing.T) {
+	ml := MakeListener(Config{})
+	assert.Equal(t, defaultMaxFlushDuration, ml.config.MaxFlushDuration)
+
+	ml = MakeListener(Config{MaxFlushDuration: -1})
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, time.Duration(0), ml.processor.(*processor).maxFlushDuration)
+	ml.HandlerFinished(ctx, nil, nil)
+}
+
+func TestFinishWithinTheMaxFlushDuration(t *testing.T) {
+	client := makeMockClient()
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: &client, TimeService: &mts, DisableFlushJitter: true, MaxFlushDuration: time.Minute})
+
+	invokeWithSlowFlush(&ml, &mts)
+
+	assert.Len(t, client.batches, 1)
+	assert.False(t, ml.processor.IsProcessing())
+	assert.Equal(t, uint64(0), ml.Stats().FlushesCapped)
+}
+
+func TestFinishingACappedProcessorDoesntWait(t *testing.T) {
+	client := &blockedClient{release: make(chan struct{})}
+	mts := makeMockTimeService()
+	pr := makeTestProcessor(context.Background(), client, &mts, processorOptions{batchInterval: time.Hour, circuitBreakerTotalFailures: 1, maxFlushDuration: 10 * time.Millisecond})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+
+	pr.FinishProcessing()
+	start := time.Now()
+	pr.FinishProcessing()
+	assert.True(t, time.Since(start) < 10*time.Millisecond)
+
+	close(client.release)
+	assert.Eventually(t, func() bool { return !pr.IsProcessing() }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,81 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// apiPayload is one of the requests a flush sends to the API. The points of each metric keep their order within
+// a payload, while the payloads are sent in any order.
+type apiPayload struct {
+	route   string
+	metrics []APIMetric
+	content []byte
+}
+
+// postAll sends the payloads of a flush with at most flushConcurrency requests in flight. The payloads which
+// haven't started when the context of the client is done, at the deadline of the invocation or when the flush is
+// cut short, are given up on. The errors of the payloads which couldn't be sent are combined.
+func (cl *APIClient) postAll(payloads []apiPayload) error {
+	workers := cl.flushConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(payloads) {
+		workers = len(payloads)
+	}
+
+	next := make(chan int, len(payloads))
+	for i := range payloads {
+		next <- i
+	}
+	close(next)
+
+	errs := make([]error, len(payloads))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := cl.context.Err(); err != nil {
+					errs[i] = fmt.Errorf("Gave up sending metrics to API: %v", err)
+					continue
+				}
+				errs[i] = cl.post(payloads[i].route, payloads[i].metrics, payloads[i].content)
+			}
+		}()
+	}
+	wg.Wait()
+	return combineErrors(errs)
+}
+
+// combineErrors returns the only error of a list, or an error listing them when there are several
+func combineErrors(errs []error) error {
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	}
+	messages := make([]string, len(failed))
+	for i, err := range failed {
+		messages[i] = err.Error()
+	}
+	return fmt.Errorf("%d of %d payloads failed: %s", len(failed), len(errs), strings.Join(messages, "; "))
+}
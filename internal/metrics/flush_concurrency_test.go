@@ -0,0 +1,126 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestPayloads(serverURL string, n int) []apiPayload {
+	payloads := make([]apiPayload, n)
+	for i := range payloads {
+		payloads[i] = apiPayload{
+			route:   fmt.Sprintf("%s/chunk/%d", serverURL, i),
+			metrics: []APIMetric{{Name: "metric-name"}},
+			content: []byte(`{"series":[]}`),
+		}
+	}
+	return payloads
+}
+
+func TestPostAllCapsConcurrency(t *testing.T) {
+	var inFlight, maxInFlight, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, flushConcurrency: 3})
+	err := cl.postAll(makeTestPayloads(server.URL, 10))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxInFlight))
+}
+
+func TestPostAllSequentialByDefault(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if current := atomic.AddInt32(&inFlight, 1); current > atomic.LoadInt32(&maxInFlight) {
+			atomic.StoreInt32(&maxInFlight, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+	err := cl.postAll(makeTestPayloads(server.URL, 3))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxInFlight))
+}
+
+func TestPostAllCombinesErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunk/1" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, flushConcurrency: 3})
+	err := cl.postAll(makeTestPayloads(server.URL, 3))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 3 payloads failed")
+	assert.Contains(t, err.Error(), "403")
+}
+
+func TestPostAllReturnsSingleErrorAsIs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, flushConcurrency: 3})
+	err := cl.postAll(makeTestPayloads(server.URL, 1))
+
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "payloads failed")
+}
+
+func TestPostAllGivesUpAfterDeadline(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cl := MakeAPIClient(ctx, APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, flushConcurrency: 3})
+	err := cl.postAll(makeTestPayloads(server.URL, 10))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "10 of 10 payloads failed")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,60 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// flushThreshold counts the points buffered by a processor since its last flush, so that it flushes as soon as
+// they reach a number of points instead of waiting for the next tick
+type flushThreshold struct {
+	// buffered counts the points added since the last flush. It's updated atomically, as sharded processors
+	// add points from the goroutines of the handler.
+	buffered uint64
+	points   uint64
+}
+
+// setFlushThreshold makes the processor flush as soon as the given number of points is buffered. The lowest
+// threshold set wins, and 0 leaves it unchanged.
+func (p *processor) setFlushThreshold(points uint64) {
+	if points == 0 {
+		return
+	}
+	if p.threshold == nil {
+		p.threshold = &flushThreshold{points: points}
+	} else if points < p.threshold.points {
+		p.threshold.points = points
+	}
+}
+
+// add counts points added to the buffer, and returns true when they reach the threshold, once per flush
+func (f *flushThreshold) add(points uint64) bool {
+	buffered := atomic.AddUint64(&f.buffered, points)
+	if buffered >= f.points && buffered-points < f.points {
+		logger.Debug(fmt.Sprintf("flush threshold: %d points buffered, flushing before the next tick", buffered))
+		return true
+	}
+	return false
+}
+
+// reached returns whether the points buffered since the last flush still reach the threshold. A flush requested
+// when they reached it is skipped when a tick flushed them first.
+func (f *flushThreshold) reached() bool {
+	return atomic.LoadUint64(&f.buffered) >= f.points
+}
+
+// flushed resets the count of buffered points when they're flushed. Points added while the batch is sent are
+// counted in the next one.
+func (f *flushThreshold) flushed() {
+	atomic.StoreUint64(&f.buffered, 0)
+}
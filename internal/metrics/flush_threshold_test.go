@@ -0,0 +1,145 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushThresholdAddReachesThresholdOnce(t *testing.T) {
+	f := &flushThreshold{points: 10}
+
+	assert.False(t, f.add(9))
+	assert.False(t, f.reached())
+	assert.True(t, f.add(1))
+	assert.True(t, f.reached())
+	assert.False(t, f.add(1))
+
+	f.flushed()
+	assert.False(t, f.reached())
+	assert.True(t, f.add(10))
+}
+
+func TestFlushThresholdKeepsTheLowest(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{adaptiveFlush: true, flushThreshold: 500})
+	assert.Equal(t, uint64(500), pr.threshold.points)
+
+	pr = makeTestProcessor(context.Background(), &mc, &mts, processorOptions{adaptiveFlush: true, flushThreshold: 5000})
+	assert.Equal(t, uint64(adaptiveHighWaterMark), pr.threshold.points)
+	pr = makeTestProcessor(context.Background(), &mc, &mts, processorOptions{adaptiveFlush: true})
+	assert.Equal(t, uint64(adaptiveHighWaterMark), pr.threshold.points)
+}
+
+func TestProcessorFlushesAtThreshold(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{flushThreshold: 10})
+	pr.StartProcessing()
+	pr.AddMetric(makeDistribution("metric-1", 9, mts.now))
+	pr.AddMetric(makeDistribution("metric-2", 1, mts.now))
+
+	// No tick is sent, so the batch is only sent because of the number of points
+	batch := <-mc.batches
+	assert.Len(t, batch, 2)
+	pr.FinishProcessing()
+	assert.Equal(t, uint64(1), pr.Stats().BatchesSent)
+	// The ticks start over after the flush
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, mts.tickerPeriods)
+}
+
+func TestProcessorTickResetsThreshold(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{flushThreshold: 10})
+	pr.StartProcessing()
+	pr.AddMetric(makeDistribution("metric-1", 9, mts.now))
+	waitUntilMetricsReceived(pr)
+	mts.tickerChan <- mts.now
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+
+	// The points sent by the tick don't count towards the next threshold
+	pr.AddMetric(makeDistribution("metric-2", 9, mts.now))
+	waitUntilMetricsReceived(pr)
+	select {
+	case <-mc.batches:
+		assert.Fail(t, "the batch was sent before reaching the threshold")
+	default:
+	}
+	pr.AddMetric(makeDistribution("metric-3", 1, mts.now))
+	assert.Len(t, <-mc.batches, 2)
+	pr.FinishProcessing()
+	assert.Equal(t, uint64(2), pr.Stats().BatchesSent)
+}
+
+func TestShardedProcessorFlushesAtThreshold(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{shards: 4, flushThreshold: 10})
+	pr.StartProcessing()
+	for i := 0; i < 10; i++ {
+		pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	}
+
+	batch := <-mc.batches
+	assert.Equal(t, "metric-1", batch[0].Name)
+	assert.Len(t, batch[0].Points, 10)
+	pr.FinishProcessing()
+	assert.Equal(t, uint64(1), pr.Stats().BatchesSent)
+}
+
+func TestShardedProcessorSkipsThresholdFlushAfterTick(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	p := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{shards: 4, flushThreshold: 10})
+	// The threshold is reached, then the points are sent as by a tick before the request is handled
+	for i := 0; i < 10; i++ {
+		p.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	}
+	assert.Len(t, p.thresholdChan, 1)
+	p.drainShards()
+	p.threshold.flushed()
+	p.sendBatch(false)
+	<-mc.batches
+
+	p.StartProcessing()
+	p.FinishProcessing()
+	// The pending request neither flushed again nor started the ticks over
+	assert.Equal(t, uint64(1), p.Stats().BatchesSent)
+	assert.Equal(t, []time.Duration{time.Second}, mts.tickerPeriods)
+}
+
+func TestSyncProcessorIgnoresFlushThreshold(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, flushThreshold: 10})
+
+	assert.Nil(t, pr.threshold)
+}
+
+func TestListenerFlushAtPointCount(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, FlushAtPointCount: 100})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.Equal(t, uint64(100), ml.processor.(*processor).threshold.points)
+	ml.HandlerFinished(ctx, nil, nil)
+}
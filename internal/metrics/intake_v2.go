@@ -0,0 +1,142 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	// intakeV1 sends the series to the series endpoint of the v1 API. It's the default.
+	intakeV1 = "v1"
+	// intakeV2 sends the series to the series endpoint of the v2 API, with the function as their resource.
+	// Distributions are still sent to the v1 API, as the v2 API only takes them as sketches.
+	intakeV2 = "v2"
+
+	// lambdaResourceType is the type of the resource of the function in the v2 payloads
+	lambdaResourceType = "lambda"
+	hostResourceType   = "host"
+)
+
+type (
+	// seriesV2Payload is the payload of the series endpoint of the v2 API
+	seriesV2Payload struct {
+		Series []seriesV2 `json:"series"`
+	}
+
+	// seriesV2 is a metric of a v2 series payload. Its host, if any, is one of its resources.
+	seriesV2 struct {
+		Metric    string         `json:"metric"`
+		Type      int            `json:"type"`
+		Points    []pointV2      `json:"points"`
+		Tags      []string       `json:"tags,omitempty"`
+		Resources []resourceV2   `json:"resources,omitempty"`
+		Interval  int64          `json:"interval,omitempty"`
+		Metadata  seriesMetadata `json:"metadata"`
+	}
+
+	pointV2 struct {
+		Timestamp int64   `json:"timestamp"`
+		Value     float64 `json:"value"`
+	}
+
+	resourceV2 struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+)
+
+// seriesV2Types maps the metric types to their value in the v2 API
+var seriesV2Types = map[MetricType]int{
+	CountType: 1,
+	RateType:  2,
+	GaugeType: 3,
+}
+
+// validIntakeVersion returns the intake version to use for a configured one, which defaults to intakeV1
+func validIntakeVersion(version string) (string, error) {
+	switch strings.ToLower(version) {
+	case "", intakeV1:
+		return intakeV1, nil
+	case intakeV2:
+		return intakeV2, nil
+	}
+	return intakeV1, fmt.Errorf("unknown intake version %q, the metrics are sent to the %s API", version, intakeV1)
+}
+
+// makeSeriesV2Payload marshals series into the payload of an endpoint of the v2 API
+func (cl *APIClient) makeSeriesV2Payload(endpoint string, metrics []APIMetric) (apiPayload, error) {
+	function, hasFunction := cl.functionResource()
+	content, err := marshalSeriesV2(metrics, function, hasFunction)
+	if err != nil {
+		return apiPayload{}, fmt.Errorf("Couldn't marshal metrics model: %v", err)
+	}
+	return apiPayload{route: cl.makeV2Route(endpoint), metrics: metrics, content: content}, nil
+}
+
+// makeV2Route returns the URL of an endpoint of the v2 API, next to the v1 API of the base URL
+func (cl *APIClient) makeV2Route(route string) string {
+	return fmt.Sprintf("%s/v2/%s", strings.TrimSuffix(cl.baseAPIURL, "/v1"), route)
+}
+
+// functionResource returns the resource of the function of the current invocation, and false outside of one
+func (cl *APIClient) functionResource() (resourceV2, bool) {
+	lambdaCtx, ok := lambdacontext.FromContext(cl.context)
+	if !ok || lambdaCtx.InvokedFunctionArn == "" {
+		return resourceV2{}, false
+	}
+	return resourceV2{Name: unqualifiedARN(lambdaCtx.InvokedFunctionArn), Type: lambdaResourceType}, true
+}
+
+// marshalSeriesV2 marshals series into the payload of the v2 API, with the function as a resource of each of them
+func marshalSeriesV2(metrics []APIMetric, function resourceV2, hasFunction bool) ([]byte, error) {
+	payload := seriesV2Payload{Series: make([]seriesV2, 0, len(metrics))}
+	for _, metric := range metrics {
+		series := seriesV2{
+			Metric:   metric.Name,
+			Type:     seriesV2Types[metric.MetricType],
+			Points:   make([]pointV2, 0, len(metric.Points)),
+			Tags:     metric.Tags,
+			Metadata: originMetadata(metric.Name),
+		}
+		for _, point := range metric.Points {
+			p, ok := toPointV2(point)
+			if !ok {
+				return nil, fmt.Errorf("metric %s has a point which isn't a timestamp and a value: %v", metric.Name, point)
+			}
+			series.Points = append(series.Points, p)
+		}
+		if hasFunction {
+			series.Resources = append(series.Resources, function)
+		}
+		if metric.Host != nil {
+			series.Resources = append(series.Resources, resourceV2{Name: *metric.Host, Type: hostResourceType})
+		}
+		if metric.Interval != nil {
+			series.Interval = int64(*metric.Interval)
+		}
+		payload.Series = append(payload.Series, series)
+	}
+	return json.Marshal(payload)
+}
+
+// toPointV2 converts a point of a series of the v1 API, a timestamp and a value, to a point of the v2 API
+func toPointV2(point interface{}) (pointV2, bool) {
+	p, ok := point.([]interface{})
+	if !ok || len(p) != 2 {
+		return pointV2{}, false
+	}
+	timestamp, timestampOK := p[0].(float64)
+	value, valueOK := p[1].(float64)
+	return pointV2{Timestamp: int64(timestamp), Value: value}, timestampOK && valueOK
+}
@@ -0,0 +1,120 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+const functionARN = "arn:aws:lambda:us-east-1:123456789012:function:orders"
+
+// seriesV2Batch is the batch the golden v2 payload is marshalled from
+func seriesV2Batch() []APIMetric {
+	host := "worker-1"
+	interval := float64(10)
+	return []APIMetric{
+		{
+			Name:       "queue.depth",
+			Host:       &host,
+			Tags:       []string{"env:prod", "queue:orders"},
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1700000000), float64(42)}},
+		},
+		{
+			Name:       "orders.placed",
+			Tags:       []string{"env:prod"},
+			MetricType: CountType,
+			Points: []interface{}{
+				[]interface{}{float64(1700000000), float64(3)},
+				[]interface{}{float64(1700000010), float64(5)},
+			},
+		},
+		{
+			Name:       "orders.rate",
+			MetricType: RateType,
+			Interval:   &interval,
+			Points:     []interface{}{[]interface{}{float64(1700000000), 0.5}},
+		},
+	}
+}
+
+func loadGolden(t *testing.T, filename string) string {
+	golden, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	return string(golden)
+}
+
+func TestMarshalSeriesV2Golden(t *testing.T) {
+	function := resourceV2{Name: functionARN, Type: lambdaResourceType}
+
+	payload, err := marshalSeriesV2(seriesV2Batch(), function, true)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, loadGolden(t, "testdata/series_v2.json"), string(payload))
+}
+
+func TestMarshalSeriesV2WithoutFunction(t *testing.T) {
+	payload, err := marshalSeriesV2(seriesV2Batch()[1:2], resourceV2{}, false)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"series":[{"metric":"orders.placed","type":1,"points":[{"timestamp":1700000000,"value":3},{"timestamp":1700000010,"value":5}],"tags":["env:prod"],"metadata":{"origin":{"origin_product":1,"origin_sub_product":38,"origin_product_detail":51}}}]}`, string(payload))
+}
+
+func TestMarshalSeriesV2RejectsMalformedPoints(t *testing.T) {
+	batch := []APIMetric{{Name: "orders.placed", MetricType: CountType, Points: []interface{}{[]interface{}{float64(1)}}}}
+
+	_, err := marshalSeriesV2(batch, resourceV2{}, false)
+
+	assert.Error(t, err)
+}
+
+func TestSendMetricsIntakeV2(t *testing.T) {
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	// The function's ARN is the one it was invoked with, without its alias
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{InvokedFunctionArn: functionARN + ":live"})
+	batch := append(seriesV2Batch(), APIMetric{
+		Name:       "latency",
+		MetricType: DistributionType,
+		Points:     []interface{}{[]interface{}{float64(1700000000), []interface{}{float64(1)}}},
+	})
+
+	cl := MakeAPIClient(ctx, APIClientOptions{baseAPIURL: server.URL + "/api/v1", apiKey: mockAPIKey, intakeVersion: intakeV2})
+	err := cl.SendMetrics(batch)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, loadGolden(t, "testdata/series_v2.json"), bodies["/api/v2/series"])
+	// Distributions stay on the v1 API
+	assert.Contains(t, bodies["/api/v1/distribution_points"], `"metric":"latency"`)
+	assert.Len(t, bodies, 2)
+}
+
+func TestValidIntakeVersion(t *testing.T) {
+	for version, expected := range map[string]string{"": intakeV1, "v1": intakeV1, "v2": intakeV2, "V2": intakeV2} {
+		actual, err := validIntakeVersion(version)
+		assert.NoError(t, err, version)
+		assert.Equal(t, expected, actual, version)
+	}
+
+	actual, err := validIntakeVersion("v3")
+	assert.Error(t, err)
+	assert.Equal(t, intakeV1, actual)
+}
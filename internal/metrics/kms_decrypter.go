@@ -10,8 +10,8 @@ package metrics
 import (
 	"encoding/base64"
 	"fmt"
-	"os"
 
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
@@ -59,12 +59,16 @@ func decryptKMS(kmsClient kmsiface.KMSAPI, ciphertext string) (string, error) {
 	// is added. We need to try decrypting the API key both with and without the encryption context.
 
 	// Try without encryption context, in case API key was encrypted using the AWS CLI
-	functionName := os.Getenv(functionNameEnvVar)
+	functionName := environment.Snapshot().Get(functionNameEnvVar)
 	params := &kms.DecryptInput{
 		CiphertextBlob: decodedBytes,
 	}
 	response, err := kmsClient.Decrypt(params)
 
+	if err != nil && functionName == "" {
+		// Outside of Lambda, there is no function name to use as the encryption context
+		return "", fmt.Errorf("Failed to decrypt ciphertext with kms: %v", err)
+	}
 	if err != nil {
 		logger.Debug("Failed to decrypt ciphertext without encryption context, retrying with encryption context")
 		// Try with encryption context, in case API key was encrypted using the AWS Console
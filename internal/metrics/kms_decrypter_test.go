@@ -11,6 +11,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/stretchr/testify/assert"
@@ -65,8 +66,10 @@ func (mockKMSClientNoEncryptionContext) Decrypt(params *kms.DecryptInput) (*kms.
 }
 
 func TestDecryptKMSWithEncryptionContext(t *testing.T) {
+	defer environment.Reload()
 	os.Setenv(functionNameEnvVar, mockFunctionName)
 	defer os.Setenv(functionNameEnvVar, "")
+	environment.Reload()
 
 	client := mockKMSClientWithEncryptionContext{}
 	result, _ := decryptKMS(client, mockEncryptedAPIKeyBase64)
@@ -11,28 +11,70 @@ package metrics
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
 
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
+	"github.com/DataDog/datadog-lambda-go/internal/health"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
 	"github.com/DataDog/datadog-lambda-go/internal/version"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
 )
 
 type (
 	// Listener implements wrapper.HandlerListener, injecting metrics into the context
 	Listener struct {
 		apiClient          *APIClient
+		client             Client
+		timeService        TimeService
 		statsdClient       *statsd.Client
 		config             *Config
-		processor          Processor
 		useServerlessAgent bool
+		sinkInfo           SinkInfo
+
+		// mu guards the processor and the pending metrics, as metrics can be sent from goroutines which
+		// outlive their invocation
+		mu        sync.Mutex
+		processor Processor
+		// pending holds the metrics sent after the processor was finished, until the next invocation starts
+		pending []Metric
+		// stats is shared by the processors of the listener, so that it counts since the container started
+		stats *Stats
+		// telemetry measures the flushes of the listener when the library's telemetry is enabled. It's nil
+		// otherwise.
+		telemetry *Telemetry
+		// invocationTags are added to the metrics of the current invocation. They're guarded by mu.
+		invocationTags []string
+		// normalizeTag normalizes each tag as they're merged. It's nil when tag normalization is disabled.
+		normalizeTag func(tag string) string
+		// random decides which points of sampled metrics are kept
+		random func() float64
+		// agentURL is the address of the Serverless Agent
+		agentURL string
+		// memorySampler reports the memory pressure during invocations. It's nil unless enabled.
+		memorySampler *memorySampler
+		// spool keeps the batches which couldn't be sent for the next invocations. It's nil unless enabled.
+		spool *spool
+		// resourceTags adds the tags of the function to the enhanced metrics. It's nil unless enabled.
+		resourceTags *resourceTags
+		// emitters counts the points emitted by metric name
+		emitters *emitters
+		// startup reports the startup metric on the first invocation. It's nil unless enabled.
+		startup *sync.Once
 	}
 
 	// Config gives options for how the listener should work
@@ -48,6 +90,122 @@ type (
 		CircuitBreakerInterval      time.Duration
 		CircuitBreakerTimeout       time.Duration
 		CircuitBreakerTotalFailures uint32
+		// Scrubber removes sensitive data from the values of metric tags. It may be nil.
+		Scrubber scrub.Scrubber
+		// DebugPayloads logs a summary of every payload sent to the API, even when debug logs are disabled
+		DebugPayloads bool
+		// DumpPayloads adds the content of the first payloads sent to the API to their summary
+		DumpPayloads bool
+		// LegacyQueryAuth sends the API key in the api_key query parameter instead of the DD-API-KEY header
+		LegacyQueryAuth bool
+		// IntakeVersion is the version of the API the series are sent to, "v1" or "v2". It defaults to "v1".
+		// Distributions are always sent to the v1 API.
+		IntakeVersion string
+		// FlushConcurrency is the number of requests of a flush sent to the API at the same time. It defaults to 3.
+		FlushConcurrency int
+		// AsyncFlushWithExtension hands the metrics to the Serverless Agent at the end of each invocation without
+		// waiting for their delivery. It's ignored when the metrics aren't sent to the Agent.
+		AsyncFlushWithExtension bool
+		// Client receives the batches of metrics instead of the Datadog API, for example to record them in tests
+		Client Client
+		// TimeService timestamps metrics, creates the ticker which schedules the sending of batches, and waits
+		// between retries. It defaults to the real clock.
+		TimeService TimeService
+		// SyncFlushOnly sends the metrics of an invocation once it finishes, without a processing goroutine
+		SyncFlushOnly bool
+		// Telemetry sends the duration, payload size and retries of the library's flushes as distributions
+		Telemetry bool
+		// AdditionalSinks receive every batch sent to the Datadog API, after it was sent
+		AdditionalSinks []BatchSink
+		// SetMaxMembers is the number of distinct members above which a set stops counting, to bound its memory
+		SetMaxMembers int
+		// DisableFlushJitter ticks every BatchInterval from the start of each invocation, instead of spreading
+		// the ticks of the containers of a deployment
+		DisableFlushJitter bool
+		// GlobalTags are added to every metric, such as the tags of DD_TAGS and the unified service tags. The tags
+		// of a metric and of its invocation take precedence over them.
+		GlobalTags []string
+		// DisableTagNormalization sends tags as they are, instead of lowercasing them, replacing the characters
+		// Datadog doesn't allow with underscores, and truncating them to 200 characters
+		DisableTagNormalization bool
+		// PrewarmConnection opens the connection to the API when the listener is created, during the init of the
+		// function, so that the first flush doesn't pay for the TLS handshake
+		PrewarmConnection bool
+		// RuntimeTags adds the architecture, runtime and memorysize tags of the container to every metric, as
+		// they're added to the enhanced metrics
+		RuntimeTags bool
+		// MemoryPressure samples the memory used by the container during invocations, and when it reaches
+		// MemoryPressureThreshold of the memory limit, reports it and flushes the metrics early
+		MemoryPressure bool
+		// MemoryPressureThreshold is the share of the memory limit, in (0, 1], above which the memory pressure is
+		// reported. It defaults to 0.92.
+		MemoryPressureThreshold float64
+		// ShardedBuffers buffers the metrics of each invocation in that many shards, each with its own lock,
+		// instead of a single channel, so that handlers sending metrics from many goroutines don't contend on
+		// it. It's ignored with SyncFlushOnly.
+		ShardedBuffers int
+		// AdaptiveFlush flushes the metrics as soon as many points are buffered, and lengthens the period of the
+		// ticks, up to 4 times the BatchInterval, while the batches are tiny. It's ignored with SyncFlushOnly.
+		AdaptiveFlush bool
+		// FlushAtPointCount flushes the metrics as soon as that many points are buffered, without waiting for the
+		// next tick, which starts over. It's ignored when it's 0 and with SyncFlushOnly.
+		FlushAtPointCount int
+		// AggregationBucket is the width of the buckets of time counts and gauges are rolled up into before they're
+		// flushed, so that a single point is sent for each bucket. It defaults to 10 seconds. Distributions aren't
+		// rolled up.
+		AggregationBucket time.Duration
+		// MaxFutureSkew is how far in the future of the clock of the container the timestamps of the points can
+		// be. Later timestamps are clamped to it, so that the intake doesn't reject their batch. It defaults to
+		// 10 minutes.
+		MaxFutureSkew time.Duration
+		// MaxFlushDuration bounds the time the end of an invocation waits for the metrics to be sent to the API,
+		// including the retries, whatever the time left in the invocation. The metrics which aren't sent by then
+		// are spilled when SpillFailedBatches is set, and dropped otherwise. It defaults to 3 seconds, and a
+		// negative duration removes the bound.
+		MaxFlushDuration time.Duration
+		// MaxRetriesPerInvocation bounds the retries of the batches which couldn't be sent, across the flushes of
+		// an invocation. Once they're spent, the next flushes of the invocation give up on their batch without
+		// sending it. It's unbounded when it's 0.
+		MaxRetriesPerInvocation int
+		// MaxRetryTimePerInvocation bounds the time spent retrying like MaxRetriesPerInvocation, including the
+		// waits before the retries. It's unbounded when it's 0.
+		MaxRetryTimePerInvocation time.Duration
+		// MessageGroupTag adds the message_group_id tag to the enhanced metrics of invocations by SQS FIFO
+		// queues, with the message group of the first record
+		MessageGroupTag bool
+		// AuthorizerTagKeys are looked up in the authorizer context of API Gateway requests, and added as
+		// invocation tags to the metrics of the invocation when they're found
+		AuthorizerTagKeys []string
+		// SpillFailedBatches writes the batches which couldn't be sent, after their retries, to files in SpoolDir,
+		// and sends them at the start of the next invocations of the container
+		SpillFailedBatches bool
+		// SpoolDir is the directory of the spilled batches. It defaults to /tmp/datadog-lambda-go/spool.
+		SpoolDir string
+		// SpoolMaxSize is the size of the spilled batches, in bytes, above which the oldest ones are evicted. It
+		// defaults to 8 MiB.
+		SpoolMaxSize int64
+		// Decrypter decrypts the KMSAPIKey. It defaults to AWS KMS.
+		Decrypter Decrypter
+		// FetchResourceTags adds the tags of the function, fetched once per container with lambda:ListTags, to the
+		// enhanced metrics. The fetch is bounded by a short timeout, and its failures leave the metrics without
+		// them.
+		FetchResourceTags bool
+		// ResourceTagKeys are the keys of the tags of the function added to the enhanced metrics. Every tag is added
+		// when it's empty, except the tags of AWS.
+		ResourceTagKeys []string
+		// TagFetcher fetches the tags of the function. It defaults to lambda:ListTags.
+		TagFetcher TagFetcher
+		// LogTopEmitters logs the metric names which emitted the most points when Terminate is called, as the
+		// container shuts down
+		LogTopEmitters bool
+		// StartupMetric sends the datadog.lambda_go.startup metric, and logs the same details, on the first
+		// invocation
+		StartupMetric bool
+		// TraceEnabled tells the startup metric whether the function is traced
+		TraceEnabled bool
+		// RejectMissingTimestamps drops the points without a timestamp, instead of sending them at the time
+		// they're added
+		RejectMissingTimestamps bool
 	}
 
 	logMetric struct {
@@ -67,13 +225,42 @@ const (
 
 // MakeListener initializes a new metrics lambda listener
 func MakeListener(config Config) Listener {
+	return makeListener(config, true)
+}
+
+// makeListener initializes a listener. Its sink is reported as the sink of the container when reportSink is set.
+func makeListener(config Config, reportSink bool) Listener {
+	decrypter := config.Decrypter
+	if decrypter == nil {
+		decrypter = MakeKMSDecrypter()
+	}
+	if config.Client != nil {
+		// The batches go to the custom client, so there's no API key to resolve nor logs to write them to
+		config.APIKey = ""
+		config.KMSAPIKey = ""
+		config.ShouldUseLogForwarder = false
+	}
+
+	intakeVersion, err := validIntakeVersion(config.IntakeVersion)
+	if err != nil {
+		logger.Warn(err.Error())
+	}
+
+	if config.FlushConcurrency <= 0 {
+		config.FlushConcurrency = defaultFlushConcurrency
+	}
 
 	apiClient := MakeAPIClient(context.Background(), APIClientOptions{
 		baseAPIURL:        config.Site,
 		apiKey:            config.APIKey,
-		decrypter:         MakeKMSDecrypter(),
+		decrypter:         decrypter,
 		kmsAPIKey:         config.KMSAPIKey,
 		httpClientTimeout: config.HttpClientTimeout,
+		debugPayloads:     config.DebugPayloads,
+		dumpPayloads:      config.DumpPayloads,
+		legacyQueryAuth:   config.LegacyQueryAuth,
+		intakeVersion:     intakeVersion,
+		flushConcurrency:  config.FlushConcurrency,
 	})
 	if config.HttpClientTimeout <= 0 {
 		config.HttpClientTimeout = defaultHttpClientTimeout
@@ -87,178 +274,841 @@ func MakeListener(config Config) Listener {
 	if config.CircuitBreakerTotalFailures <= 0 {
 		config.CircuitBreakerTotalFailures = defaultCircuitBreakerTotalFailures
 	}
+	if config.MaxFlushDuration == 0 {
+		config.MaxFlushDuration = defaultMaxFlushDuration
+	}
 	if config.BatchInterval <= 0 {
 		config.BatchInterval = defaultBatchInterval
 	}
+	if config.SetMaxMembers <= 0 {
+		config.SetMaxMembers = defaultSetMaxMembers
+	}
 
 	var statsdClient *statsd.Client
-	// immediate call to the Agent, if not a 200, fallback to API
-	// TODO(remy): we may want to use an environment var to force the use of the
-	// Agent instead of using this "discovery" implementation.
-	if isServerlessAgentRunning() {
-		var err error
-		if statsdClient, err = statsd.New("127.0.0.1:8125"); err != nil {
-			statsdClient = nil // force nil if an error occurred during statsd client init
+	// The Serverless Agent is only probed when the Datadog Extension is installed, to avoid paying for a
+	// request timeout on every cold start of functions without it.
+	var agentErr error
+	agentInstalled := config.Client == nil && extension.IsInstalled()
+	if agentInstalled {
+		if agentErr = probeServerlessAgent(extension.DefaultURL); agentErr == nil {
+			if statsdClient, agentErr = statsd.New("127.0.0.1:8125"); agentErr != nil {
+				statsdClient = nil // force nil if an error occurred during statsd client init
+			}
 		}
 	}
 
+	sinkInfo := selectSink(config, agentInstalled, statsdClient != nil, agentErr)
+	logger.DebugWithFields(fmt.Sprintf("Sending metrics to the %s sink: %s", sinkInfo.Sink, sinkInfo.Reason), logger.Fields{
+		"sink": string(sinkInfo.Sink),
+	})
+	if reportSink {
+		setSinkInfo(sinkInfo)
+	}
+	if agentInstalled && agentErr != nil {
+		health.Degrade(health.ReasonExtensionUnreachable, fmt.Errorf("the Datadog Extension is installed but can't be used: %v", agentErr))
+	}
+	if sinkInfo.Sink == SinkDisabled {
+		health.Degrade(health.ReasonNoAPIKey, fmt.Errorf("metrics won't be sent: %s", sinkInfo.Reason))
+	}
+	if config.PrewarmConnection && sinkInfo.Sink == SinkAPI {
+		// The API key may still be decrypting, concurrently, as the prewarm doesn't need it
+		apiClient.prewarm()
+	}
+
+	var client Client = apiClient
+	if config.Client != nil {
+		client = config.Client
+	}
+	timeService := config.TimeService
+	if timeService == nil {
+		timeService = MakeTimeService()
+	}
+	if !config.DisableFlushJitter {
+		timeService = MakeJitteredTimeService(timeService, nil)
+	}
+
+	var telemetry *Telemetry
+	if config.Telemetry {
+		telemetry = MakeTelemetry()
+	}
+
+	// The tags are scrubbed before they're merged, so that the scrubber sees them before normalization
+	config.GlobalTags = scrub.Tags(config.Scrubber, config.GlobalTags)
+	if config.RuntimeTags {
+		config.GlobalTags = appendRuntimeTags(config.GlobalTags, getRuntimeTags())
+	}
+	stats := &Stats{}
+	var normalizeTag func(string) string
+	if !config.DisableTagNormalization {
+		normalizeTag = makeTagNormalizer(stats).normalize
+	} else {
+		config.GlobalTags = sanitizeTags(config.GlobalTags)
+	}
+
+	var sampler *memorySampler
+	if config.MemoryPressure {
+		if config.MemoryPressureThreshold <= 0 || config.MemoryPressureThreshold > 1 {
+			config.MemoryPressureThreshold = defaultMemoryPressureThreshold
+		}
+		if lambdacontext.MemoryLimitInMB > 0 {
+			limit := uint64(lambdacontext.MemoryLimitInMB) * 1024 * 1024
+			sampler = makeMemorySampler(memorySampleInterval, config.MemoryPressureThreshold, limit, readMemoryUsage)
+		} else {
+			logger.Debug("the memory limit is unknown, as AWS_LAMBDA_FUNCTION_MEMORY_SIZE isn't set, so the memory pressure won't be sampled")
+		}
+	}
+
+	var sp *spool
+	if config.SpillFailedBatches {
+		sp = makeSpool(config.SpoolDir, config.SpoolMaxSize)
+	}
+
+	var rt *resourceTags
+	if config.FetchResourceTags && config.EnhancedMetrics {
+		rt = makeResourceTags(config.TagFetcher, config.ResourceTagKeys)
+	}
+
+	em := makeEmitters()
+
+	var startup *sync.Once
+	if config.StartupMetric {
+		startup = &sync.Once{}
+	}
+
 	return Listener{
 		apiClient:          apiClient,
+		client:             client,
+		timeService:        timeService,
 		config:             &config,
 		useServerlessAgent: statsdClient != nil,
 		statsdClient:       statsdClient,
-		processor:          nil,
+		sinkInfo:           sinkInfo,
+		stats:              stats,
+		telemetry:          telemetry,
+		normalizeTag:       normalizeTag,
+		random:             rand.Float64,
+		agentURL:           extension.DefaultURL,
+		memorySampler:      sampler,
+		spool:              sp,
+		resourceTags:       rt,
+		emitters:           em,
+		startup:            startup,
 	}
 }
 
+// WaitForInit waits for the initialization steps of the listener running in the background, such as the
+// decryption of the KMS API key, and returns their error. Without an error, there's nothing left to wait for.
+func (l *Listener) WaitForInit() error {
+	if l.sinkInfo.Sink != SinkAPI || l.config.Client != nil {
+		return nil
+	}
+	return l.apiClient.waitForAPIKey()
+}
+
 // HandlerStarted adds metrics service to the context
 func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
-	if l.apiClient.apiKey == "" && l.config.KMSAPIKey == "" && !l.config.ShouldUseLogForwarder {
-		logger.Error(fmt.Errorf("datadog api key isn't set, won't be able to send metrics"))
+	l.mu.Lock()
+	if l.processor != nil && l.processor.IsProcessing() {
+		// HandlerFinished was skipped for the previous invocation, probably because its handler panicked.
+		// Finish its processor so that its goroutine and ticker don't outlive it.
+		l.processor.FinishProcessing()
 	}
 
-	ts := MakeTimeService()
-	pr := MakeProcessor(ctx, l.apiClient, ts, l.config.BatchInterval, l.config.ShouldRetryOnFailure, l.config.CircuitBreakerInterval, l.config.CircuitBreakerTimeout, l.config.CircuitBreakerTotalFailures)
+	var pr Processor
+	if !l.useServerlessAgent {
+		// The Agent batches the metrics itself, so the processor would only keep running while the sandbox is
+		// frozen
+		pr = l.newProcessor(ctx)
+		// Metrics sent after the previous invocation finished go in the batch of this one. There are fewer of
+		// them than the processor can buffer, so this doesn't block.
+		for _, m := range l.pending {
+			pr.AddMetric(m)
+		}
+		l.pending = nil
+	}
 	l.processor = pr
+	l.invocationTags = nil
+	l.mu.Unlock()
 
 	ctx = AddListener(ctx, l)
+	if len(l.config.AuthorizerTagKeys) > 0 && eventsource.Get(ctx, msg) == eventsource.APIGateway {
+		l.AddInvocationTags(getAuthorizerTags(msg, l.config.AuthorizerTagKeys)...)
+	}
+	eventSourceTags := getEventSourceTags(msg)
+	if l.config.MessageGroupTag {
+		eventSourceTags = appendMessageGroupTag(ctx, eventSourceTags)
+	}
+	ctx = context.WithValue(ctx, eventSourceTagsKey, eventSourceTags)
+	if l.resourceTags != nil {
+		ctx = context.WithValue(ctx, resourceTagsKey, l.resourceTags.get(ctx))
+	}
+	if l.enhancedEnabled() {
+		ctx = context.WithValue(ctx, batchInfoKey, getBatchInfo(ctx, msg))
+		ctx = measureInitDuration(ctx)
+	}
 	// Setting the context on the client will mean that future requests will be cancelled correctly
 	// if the lambda times out.
 	l.apiClient.context = ctx
 
-	pr.StartProcessing()
+	if pr != nil {
+		pr.StartProcessing()
+	}
+	l.addPreInitMetrics()
+	l.submitDegradedMetrics()
+	if l.startup != nil {
+		l.startup.Do(l.reportStartup)
+	}
 	l.submitEnhancedMetrics("invocations", ctx)
+	l.submitEventAge(ctx, msg)
+	l.submitInitPhases(ctx)
+	if l.memorySampler != nil {
+		l.memorySampler.start(func(utilization float64) {
+			l.reportMemoryPressure(ctx, utilization)
+		})
+	}
 
 	return ctx
 }
 
+// newProcessor makes a processor sending the metrics of the listener, configured by its Config
+func (l *Listener) newProcessor(ctx context.Context) Processor {
+	opts := processorOptions{
+		client:                      l.client,
+		timeService:                 l.timeService,
+		batchInterval:               l.config.BatchInterval,
+		shouldRetryOnFail:           l.config.ShouldRetryOnFailure,
+		circuitBreakerInterval:      l.config.CircuitBreakerInterval,
+		circuitBreakerTimeout:       l.config.CircuitBreakerTimeout,
+		circuitBreakerTotalFailures: l.config.CircuitBreakerTotalFailures,
+		stats:                       l.stats,
+		telemetry:                   l.telemetry,
+		sinks:                       l.config.AdditionalSinks,
+		syncFlushOnly:               l.config.SyncFlushOnly,
+		shards:                      l.config.ShardedBuffers,
+		adaptiveFlush:               l.config.AdaptiveFlush,
+		aggregationBucket:           l.config.AggregationBucket,
+		maxFutureSkew:               l.config.MaxFutureSkew,
+		maxRetries:                  l.config.MaxRetriesPerInvocation,
+		maxRetryDuration:            l.config.MaxRetryTimePerInvocation,
+		rejectMissingTimestamps:     l.config.RejectMissingTimestamps,
+		spool:                       l.spool,
+	}
+	if l.config.FlushAtPointCount > 0 {
+		opts.flushThreshold = uint64(l.config.FlushAtPointCount)
+	}
+	if l.config.MaxFlushDuration > 0 {
+		// A negative duration removes the bound
+		opts.maxFlushDuration = l.config.MaxFlushDuration
+	}
+	return makeProcessor(ctx, opts)
+}
+
+// addPreInitMetrics adds the metrics sent before the first invocation to the batch of the invocation, with
+// their original timestamps
+func (l *Listener) addPreInitMetrics() {
+	metrics, dropped := initQueue.drain()
+	atomic.AddUint64(&l.stats.Drops.PreInitFull, dropped)
+	for _, m := range metrics {
+		l.AddDistributionMetric(m.name, m.value, m.timestamp, false, m.tags...)
+	}
+}
+
 // HandlerFinished implemented as part of the wrapper.HandlerListener interface
-func (l *Listener) HandlerFinished(ctx context.Context, err error) {
+func (l *Listener) HandlerFinished(ctx context.Context, response interface{}, err error) {
+	peakMemory := uint64(0)
+	if l.memorySampler != nil {
+		peakMemory = l.memorySampler.stopSampling()
+	}
+	// Degraded modes entered during the invocation are reported with its metrics
+	l.submitDegradedMetrics()
+	l.submitBatchMetrics(ctx, response, err)
+	// The background metrics are flushed first, so that the Extension sends them with those of the invocation
+	flushBackgroundEmitters()
+
 	if l.useServerlessAgent {
 		// use the agent
+		// the measures of the previous flush ride on this one
+		for _, d := range l.telemetry.drain() {
+			for _, v := range d.Values {
+				l.statsdClient.Distribution(d.Name, v.Value, d.Tags, 1)
+			}
+		}
+		start := l.timeService.Now()
+		success := true
 		// flush the metrics from the DogStatsD client to the Agent
 		if l.statsdClient != nil {
 			if err := l.statsdClient.Flush(); err != nil {
+				success = false
 				logger.Error(fmt.Errorf("can't flush the DogStatsD client: %s", err))
 			}
 		}
-		// send a message to the Agent to flush the metrics
-		if err := flushServerlessAgent(); err != nil {
-			logger.Error(fmt.Errorf("error while flushing the metrics: %s", err))
+		// With an async flush, the Agent outlives the invocation and delivers the metrics on its own, so only their
+		// handoff to the DogStatsD client is waited for
+		if !l.config.AsyncFlushWithExtension {
+			// send a message to the Agent to flush the metrics, and wait for their delivery
+			if err := flushServerlessAgent(l.agentURL); err != nil {
+				success = false
+				logger.Error(fmt.Errorf("error while flushing the metrics: %s", err))
+			}
 		}
+		// The payload sizes and retries are handled by the Agent
+		l.telemetry.recordFlush(start, l.timeService.Now().Sub(start), -1, -1, success)
 	} else {
 		// use the api
-		if l.processor != nil {
+		l.mu.Lock()
+		pr := l.processor
+		l.mu.Unlock()
+		if pr != nil {
 			if err != nil {
-				l.submitEnhancedMetrics("errors", ctx)
+				l.submitErrorMetrics(ctx, err)
 			}
-			l.processor.FinishProcessing()
+			// The durations are only sent here, as the Extension measures them itself
+			l.submitRuntimeDuration(ctx)
+			l.submitReportEstimates(ctx, peakMemory)
+			pr.FinishProcessing()
+			l.submitPostRuntimeDuration(ctx)
 		}
 	}
 }
 
-// AddDistributionMetric sends a distribution metric
-func (l *Listener) AddDistributionMetric(metric string, value float64, timestamp time.Time, forceLogForwarder bool, tags ...string) {
+// Terminate flushes the metrics still buffered when the container shuts down: those of the background emitters,
+// and those sent after the last invocation finished, which would otherwise wait for an invocation which never
+// comes. With LogTopEmitters, it logs the metric names which emitted the most points first. It's meant to be
+// called by the SIGTERM hook of the runtime, once no invocation runs anymore.
+func (l *Listener) Terminate() {
+	if l.config.LogTopEmitters {
+		l.emitters.logTop()
+	}
+	flushBackgroundEmitters()
+	if l.useServerlessAgent {
+		if err := l.statsdClient.Flush(); err != nil {
+			logger.Error(fmt.Errorf("can't flush the DogStatsD client: %s", err))
+		}
+		return
+	}
 
-	// We add our own runtime tag to the metric for version tracking
-	tags = append(tags, getRuntimeTag())
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	pr := l.newProcessor(context.Background())
+	pr.StartProcessing()
+	for _, m := range pending {
+		pr.AddMetric(m)
+	}
+	pr.FinishProcessing()
+}
+
+// submitDegradedMetrics sends a degraded metric, tagged with the reason, for each degraded mode entered since
+// they were last sent. They're left out when they can't reach Datadog, as the degraded mode was logged anyway.
+func (l *Listener) submitDegradedMetrics() {
+	for _, reason := range health.DrainUnreported() {
+		if !l.canReportDegraded(reason) {
+			continue
+		}
+		l.AddDistributionMetric(degradedMetric, 1, l.timeService.Now(), false, fmt.Sprintf("reason:%s", reason))
+	}
+}
+
+// canReportDegraded tells whether the sink of the listener still works in a degraded mode
+func (l *Listener) canReportDegraded(reason health.Reason) bool {
+	switch l.sinkInfo.Sink {
+	case SinkDisabled:
+		return false
+	case SinkAPI:
+		return reason != health.ReasonKMSDecryptFailed && reason != health.ReasonAPIKeyRejected
+	}
+	return true
+}
 
+// reportMemoryPressure sends the memory pressure, as a percentage of the memory limit, and flushes the metrics
+// sent so far, in case the container runs out of memory before the end of the invocation
+func (l *Listener) reportMemoryPressure(ctx context.Context, utilization float64) {
+	logger.Debug(fmt.Sprintf("the memory used reached %.1f%% of the limit, flushing the metrics early", utilization*100))
+	l.submitEnhancedMetric("memory_pressure", utilization*100, ctx)
 	if l.useServerlessAgent {
-		l.statsdClient.Distribution(metric, value, tags, 1)
+		// The metrics buffered by the DogStatsD client are sent to the Agent
+		if err := l.statsdClient.Flush(); err != nil {
+			logger.Error(fmt.Errorf("can't flush the DogStatsD client: %s", err))
+		}
 		return
 	}
+	l.mu.Lock()
+	pr := l.processor
+	l.mu.Unlock()
+	if pr != nil {
+		pr.Flush()
+	}
+}
+
+// AddInvocationTags adds tags to the metrics sent during the current invocation. They take precedence over the
+// global tags, and the tags of each metric take precedence over them.
+func (l *Listener) AddInvocationTags(tags ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tags = scrub.Tags(l.config.Scrubber, tags)
+	if l.normalizeTag == nil {
+		tags = sanitizeTags(tags)
+	}
+	l.invocationTags = append(l.invocationTags[:len(l.invocationTags):len(l.invocationTags)], tags...)
+}
+
+// mergeTags merges the scrubbed tags of a metric with the tags of the invocation and the global tags, and
+// normalizes them in the same pass, once when the metric is added
+func (l *Listener) mergeTags(tags []string) []string {
+	l.mu.Lock()
+	invocationTags := l.invocationTags
+	l.mu.Unlock()
+	if l.normalizeTag == nil {
+		// The tags which aren't normalized are still sanitized, the invocation and global tags as they're added
+		tags = sanitizeTags(tags)
+	}
+	return mergeTags(l.normalizeTag, tags, invocationTags, l.config.GlobalTags)
+}
+
+// metricTags returns the tags a metric is sent with: its scrubbed tags, merged with the invocation and global
+// tags, followed by the runtime tag. The result never shares the array of tags, which callers may reuse for their
+// next metrics while the metric waits to be flushed. mergeTags limits the capacity of the tags it doesn't copy,
+// so appending the runtime tag copies them.
+func (l *Listener) metricTags(tags []string) []string {
+	// We add our own runtime tag to the metric for version tracking
+	return append(l.mergeTags(scrub.Tags(l.config.Scrubber, tags)), getRuntimeTag())
+}
+
+// AddDistributionMetric sends a distribution metric. It returns an error wrapping ErrMetricsDisabled,
+// ErrBufferFull or ErrInvalidMetric when the metric won't be sent.
+func (l *Listener) AddDistributionMetric(metric string, value float64, timestamp time.Time, forceLogForwarder bool, tags ...string) error {
+	return l.addDistributionMetric(metric, []float64{value}, 1, timestamp, forceLogForwarder, tags)
+}
+
+// AddDistributionMetrics sends several points of a distribution metric with the same tags at once, which merges
+// and normalizes the tags once for all of them. It returns an error like AddDistributionMetric, and no point is
+// sent when one of the values is invalid.
+func (l *Listener) AddDistributionMetrics(metric string, values []float64, timestamp time.Time, tags ...string) error {
+	return l.addDistributionMetric(metric, values, 1, timestamp, false, tags)
+}
+
+// AddSampledDistributionMetric sends a point of a distribution metric with a probability of sampleRate, which
+// must be in (0, 1]. The rate is sent with the points kept, so that the Extension can correct the estimates of
+// the distribution. Metrics with an invalid rate are rejected and counted in Stats.InvalidSampleRates.
+func (l *Listener) AddSampledDistributionMetric(metric string, value float64, sampleRate float64, timestamp time.Time, tags ...string) error {
+	if !(sampleRate > 0 && sampleRate <= 1) {
+		atomic.AddUint64(&l.stats.InvalidSampleRates, 1)
+		err := fmt.Errorf("%w: rejected metric %q, as its sample rate %v isn't in (0, 1]", ErrInvalidMetric, metric, sampleRate)
+		logger.Error(err)
+		return err
+	}
+	return l.addDistributionMetric(metric, []float64{value}, sampleRate, timestamp, false, tags)
+}
+
+func (l *Listener) addDistributionMetric(metric string, values []float64, sampleRate float64, timestamp time.Time, forceLogForwarder bool, tags []string) error {
+	metric = sanitize(metric)
+	for _, value := range values {
+		if err := validateMetric(metric, value); err != nil {
+			logger.Error(err)
+			return err
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&l.stats.MetricsAdded, uint64(len(values)))
+	l.emitters.add(metric)
+	timestamp = normalizeTimestamp(metric, timestamp)
+	tags = l.metricTags(tags)
+
+	if l.useServerlessAgent {
+		// The statsd client samples the points itself
+		for _, value := range values {
+			if err := l.statsdClient.Distribution(metric, value, tags, sampleRate); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if sampleRate < 1 && l.random() >= sampleRate {
+		return nil
+	}
 
 	if l.config.ShouldUseLogForwarder || forceLogForwarder {
 		logger.Debug("sending metric via log forwarder")
 		unixTime := timestamp.Unix()
-		lm := logMetric{
-			MetricName: metric,
-			Value:      value,
-			Timestamp:  unixTime,
-			Tags:       tags,
-		}
-		result, err := json.Marshal(lm)
-		if err != nil {
-			logger.Error(fmt.Errorf("failed to marshall metric for log forwarder with error %v", err))
-			return
+		for _, value := range values {
+			lm := logMetric{
+				MetricName: metric,
+				Value:      value,
+				Timestamp:  unixTime,
+				Tags:       tags,
+			}
+			result, err := json.Marshal(lm)
+			if err != nil {
+				err = fmt.Errorf("failed to marshall metric for log forwarder with error %w", err)
+				logger.Error(err)
+				return err
+			}
+			payload := string(result)
+			logger.Raw(payload)
 		}
-		payload := string(result)
-		logger.Raw(payload)
-		return
+		return nil
+	}
+	if l.sinkInfo.Sink == SinkDisabled {
+		return fmt.Errorf("%w: %s", ErrMetricsDisabled, l.sinkInfo.Reason)
 	}
 	m := Distribution{
 		Name:   metric,
 		Tags:   tags,
-		Values: []MetricValue{},
+		Values: make([]MetricValue, 0, len(values)),
+	}
+	if sampleRate < 1 {
+		m.SampleRate = sampleRate
+	}
+	for _, value := range values {
+		m.AddPoint(timestamp, value)
+	}
+	if logger.DebugEnabled() {
+		if len(values) == 1 {
+			logger.Debug(fmt.Sprintf("adding metric \"%s\", with value %f", metric, values[0]))
+		} else {
+			logger.Debug(fmt.Sprintf("adding metric \"%s\", with %d values", metric, len(values)))
+		}
+	}
+	return l.addMetric(&m)
+}
+
+// AddSetMetric adds a member to a set, which counts the distinct members added during a flush interval. It
+// returns an error wrapping ErrMetricsDisabled, ErrBufferFull or ErrInvalidMetric when the member won't be sent.
+func (l *Listener) AddSetMetric(metric string, member string, timestamp time.Time, tags ...string) error {
+	metric = sanitize(metric)
+	if metric == "" {
+		return fmt.Errorf("%w: the metric has no name", ErrInvalidMetric)
+	}
+
+	atomic.AddUint64(&l.stats.MetricsAdded, 1)
+	l.emitters.add(metric)
+	tags = l.metricTags(tags)
+
+	if l.useServerlessAgent {
+		return l.statsdClient.Set(metric, member, tags, 1)
+	}
+
+	if l.config.ShouldUseLogForwarder {
+		// The members would have to be counted across the log lines of every invocation
+		setUnsupportedWarning.Do(func() {
+			logger.Warn("set metrics can't be sent via the log forwarder, they are dropped")
+		})
+		return fmt.Errorf("%w: set metrics can't be sent via the log forwarder", ErrMetricsDisabled)
+	}
+	if l.sinkInfo.Sink == SinkDisabled {
+		return fmt.Errorf("%w: %s", ErrMetricsDisabled, l.sinkInfo.Reason)
+	}
+	s := Set{
+		Name:       metric,
+		Tags:       tags,
+		MaxMembers: l.config.SetMaxMembers,
+	}
+	s.AddMember(timestamp, member)
+	return l.addMetric(&s)
+}
+
+// setUnsupportedWarning warns once per container that sets are dropped by the log forwarder
+var setUnsupportedWarning sync.Once
+
+// AddRateMetric adds a count to a rate, which sums the counts until the next flush, and sends them per second
+// over the time which actually elapsed since the previous flush. With the Extension, the count is sent as a
+// DogStatsD count, rounded to an integer, which the Agent sends as a rate. It returns an error wrapping
+// ErrMetricsDisabled, ErrBufferFull or ErrInvalidMetric when the count won't be sent.
+func (l *Listener) AddRateMetric(metric string, count float64, timestamp time.Time, tags ...string) error {
+	metric = sanitize(metric)
+	if err := validateMetric(metric, count); err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	atomic.AddUint64(&l.stats.MetricsAdded, 1)
+	l.emitters.add(metric)
+	timestamp = normalizeTimestamp(metric, timestamp)
+	tags = l.metricTags(tags)
+
+	if l.useServerlessAgent {
+		return l.statsdClient.Count(metric, int64(math.Round(count)), tags, 1)
+	}
+
+	if l.config.ShouldUseLogForwarder {
+		// The counts would have to be summed across the log lines of every invocation
+		rateUnsupportedWarning.Do(func() {
+			logger.Warn("rate metrics can't be sent via the log forwarder, they are dropped")
+		})
+		return fmt.Errorf("%w: rate metrics can't be sent via the log forwarder", ErrMetricsDisabled)
+	}
+	if l.sinkInfo.Sink == SinkDisabled {
+		return fmt.Errorf("%w: %s", ErrMetricsDisabled, l.sinkInfo.Reason)
+	}
+	r := Rate{
+		Name: metric,
+		Tags: tags,
+	}
+	r.AddPoint(timestamp, count)
+	return l.addMetric(&r)
+}
+
+// rateUnsupportedWarning warns once per container that rates are dropped by the log forwarder
+var rateUnsupportedWarning sync.Once
+
+// AddCountMetric adds value to a count, which sums the values sent with the same name and tags within a bucket of
+// Config.AggregationBucket, and sends them as a single point. With the Extension, the value is sent as a
+// DogStatsD count, rounded to an integer. It returns an error wrapping ErrMetricsDisabled, ErrBufferFull or
+// ErrInvalidMetric when the value won't be sent.
+func (l *Listener) AddCountMetric(metric string, value float64, timestamp time.Time, tags ...string) error {
+	return l.addBucketedMetric(CountType, metric, value, timestamp, tags)
+}
+
+// AddGaugeMetric sets the value of a gauge, which keeps the last value sent with the same name and tags within a
+// bucket of Config.AggregationBucket, and sends it as a single point. It returns an error like AddCountMetric.
+func (l *Listener) AddGaugeMetric(metric string, value float64, timestamp time.Time, tags ...string) error {
+	return l.addBucketedMetric(GaugeType, metric, value, timestamp, tags)
+}
+
+// addBucketedMetric sends a point of a count or a gauge, which the batcher rolls up by bucket of time
+func (l *Listener) addBucketedMetric(metricType MetricType, metric string, value float64, timestamp time.Time, tags []string) error {
+	metric = sanitize(metric)
+	if err := validateMetric(metric, value); err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	atomic.AddUint64(&l.stats.MetricsAdded, 1)
+	l.emitters.add(metric)
+	timestamp = normalizeTimestamp(metric, timestamp)
+	tags = l.metricTags(tags)
+
+	if l.useServerlessAgent {
+		if metricType == CountType {
+			return l.statsdClient.Count(metric, int64(math.Round(value)), tags, 1)
+		}
+		return l.statsdClient.Gauge(metric, value, tags, 1)
+	}
+
+	if l.config.ShouldUseLogForwarder {
+		// The values would have to be rolled up across the log lines of every invocation
+		bucketedUnsupportedWarnings[metricType].Do(func() {
+			logger.Warn(fmt.Sprintf("%s metrics can't be sent via the log forwarder, they are dropped", metricType))
+		})
+		return fmt.Errorf("%w: %s metrics can't be sent via the log forwarder", ErrMetricsDisabled, metricType)
+	}
+	if l.sinkInfo.Sink == SinkDisabled {
+		return fmt.Errorf("%w: %s", ErrMetricsDisabled, l.sinkInfo.Reason)
+	}
+	var m Metric
+	if metricType == CountType {
+		m = &Count{Name: metric, Tags: tags}
+	} else {
+		m = &Gauge{Name: metric, Tags: tags}
 	}
 	m.AddPoint(timestamp, value)
-	logger.Debug(fmt.Sprintf("adding metric \"%s\", with value %f", metric, value))
-	l.processor.AddMetric(&m)
+	return l.addMetric(m)
+}
+
+// bucketedUnsupportedWarnings warn once per container that counts and gauges are dropped by the log forwarder
+var bucketedUnsupportedWarnings = map[MetricType]*sync.Once{
+	CountType: {},
+	GaugeType: {},
+}
+
+// addMetric sends a metric to the current processor. Metrics sent after it was finished, by a goroutine which
+// outlived its invocation, are kept for the next invocation of a warm container. Metrics sent after it was
+// torn down by the cancellation of its context, or when too many are pending, are dropped and counted, and an
+// error is returned.
+func (l *Listener) addMetric(m Metric) error {
+	l.mu.Lock()
+	pr := l.processor
+	l.mu.Unlock()
+
+	err := errProcessorFinished
+	if pr != nil {
+		// Not holding the lock, as the processor blocks when its channel is full
+		err = pr.AddMetric(m)
+	}
+	if err == nil || errors.Is(err, ErrInvalidMetric) {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == errProcessorFinished && len(l.pending) < maxPendingMetrics {
+		l.pending = append(l.pending, m)
+		return nil
+	}
+	reason := "pending_full"
+	if err == errProcessorCancelled {
+		reason = "cancelled"
+		atomic.AddUint64(&l.stats.Drops.Cancelled, pointCount(m))
+		err = fmt.Errorf("%w: %v", ErrMetricsDisabled, err)
+	} else {
+		atomic.AddUint64(&l.stats.Drops.PendingFull, pointCount(m))
+		err = fmt.Errorf("%w: too many metrics were sent after their invocation ended", ErrBufferFull)
+	}
+	if logger.DebugEnabled() {
+		logger.DebugWithFields("dropped a metric sent after its invocation ended", logger.Fields{
+			"reason": reason,
+		})
+	}
+	return err
+}
+
+// Stats returns the counters of the metrics handled since the container started, with the metric names which
+// emitted the most points
+func (l *Listener) Stats() Stats {
+	stats := l.stats.snapshot()
+	stats.TopEmitters = l.emitters.top(topEmittersCount)
+	l.mu.Lock()
+	if p, ok := l.processor.(*processor); ok {
+		stats.ChannelHighWaterMark = p.channelHighWaterMark()
+	}
+	l.mu.Unlock()
+	return stats
 }
 
+// Now returns the current time according to the listener's TimeService, for timestamping metrics
+func (l *Listener) Now() time.Time {
+	return l.timeService.Now()
+}
+
+// runtimeTag is computed once, since it's added to every metric
+var runtimeTag = fmt.Sprintf("dd_lambda_layer:datadog-%s", runtime.Version())
+
 func getRuntimeTag() string {
-	v := runtime.Version()
-	return fmt.Sprintf("dd_lambda_layer:datadog-%s", v)
+	return runtimeTag
 }
 
-func (l *Listener) submitEnhancedMetrics(metricName string, ctx context.Context) {
-	if l.config.EnhancedMetrics {
-		tags := getEnhancedMetricsTags(ctx)
-		l.AddDistributionMetric(fmt.Sprintf("aws.lambda.enhanced.%s", metricName), 1, time.Now(), true, tags...)
+func (l *Listener) submitEnhancedMetrics(metricName string, ctx context.Context, extraTags ...string) {
+	l.submitEnhancedMetric(metricName, 1, ctx, extraTags...)
+}
+
+// submitEnhancedMetric sends a value of an enhanced metric, tagged with the enhanced metrics tags. Every enhanced
+// metric is sent through it, so that none is sent when the enhanced metrics are off.
+func (l *Listener) submitEnhancedMetric(metricName string, value float64, ctx context.Context, extraTags ...string) {
+	if l.enhancedEnabled() {
+		tags := append(getEnhancedMetricsTags(ctx), extraTags...)
+		l.AddDistributionMetric(enhancedMetricsPrefix+metricName, value, l.timeService.Now(), true, tags...)
 	}
 }
 
-func getEnhancedMetricsTags(ctx context.Context) []string {
-	isColdStart := ctx.Value("cold_start")
+// enhancedEnabled returns whether the enhanced metrics are sent. Custom metrics are sent either way.
+func (l *Listener) enhancedEnabled() bool {
+	return l.config.EnhancedMetrics
+}
 
-	if lc, ok := lambdacontext.FromContext(ctx); ok {
-		// ex: arn:aws:lambda:us-east-1:123497558138:function:golang-layer:alias
-		splitArn := strings.Split(lc.InvokedFunctionArn, ":")
+// submitRuntimeDuration sends the time the handler ran, without the time spent by the library, in milliseconds
+func (l *Listener) submitRuntimeDuration(ctx context.Context) {
+	if start, end, ok := wrapper.GetHandlerTiming(ctx); ok {
+		l.submitEnhancedMetric("runtime_duration", milliseconds(end.Sub(start)), ctx)
+	}
+}
 
-		// malformed arn string
-		if len(splitArn) < 5 {
-			logger.Debug("malformed arn string in the LambdaContext")
-			return []string{}
-		}
+// submitPostRuntimeDuration sends the time the library spent finishing the invocation after the handler
+// returned, including the flush of the metrics, in milliseconds. Enhanced metrics are written to the logs, so it
+// can be sent after the flush.
+func (l *Listener) submitPostRuntimeDuration(ctx context.Context) {
+	if _, end, ok := wrapper.GetHandlerTiming(ctx); ok {
+		l.submitEnhancedMetric("post_runtime_duration", milliseconds(time.Since(end)), ctx)
+	}
+}
 
-		var alias string
-		var executedVersion string
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
 
-		functionName := fmt.Sprintf("functionname:%s", lambdacontext.FunctionName)
-		region := fmt.Sprintf("region:%s", splitArn[3])
-		accountId := fmt.Sprintf("account_id:%s", splitArn[4])
-		memorySize := fmt.Sprintf("memorysize:%d", lambdacontext.MemoryLimitInMB)
-		coldStart := fmt.Sprintf("cold_start:%t", isColdStart.(bool))
-		resource := fmt.Sprintf("resource:%s", lambdacontext.FunctionName)
-		datadogLambda := fmt.Sprintf("datadog_lambda:v%s", version.DDLambdaVersion)
+// submitErrorMetrics sends the enhanced metric of an invocation which returned an error. Invocations which ran
+// out of time or were cancelled are counted as timeouts, tagged with the reason, rather than as errors of the
+// handler. Responses which couldn't be marshaled are tagged as such.
+func (l *Listener) submitErrorMetrics(ctx context.Context, err error) {
+	var marshalErr *wrapper.MarshalError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		l.submitEnhancedMetrics("timeouts", ctx, "error_type:deadline_exceeded")
+	case errors.Is(err, context.Canceled):
+		l.submitEnhancedMetrics("timeouts", ctx, "error_type:canceled")
+	case errors.As(err, &marshalErr):
+		l.submitEnhancedMetrics("errors", ctx, "error_type:marshal_error")
+	default:
+		l.submitEnhancedMetrics("errors", ctx)
+	}
+}
 
-		tags := []string{functionName, region, accountId, memorySize, coldStart, datadogLambda}
+// getEnhancedMetricsTags returns the tags of the enhanced metrics of an invocation. Outside of Lambda, for
+// example in local integration tests, there is no Lambda context and no tag is returned. Tags whose value isn't
+// available, such as the function name when AWS_LAMBDA_FUNCTION_NAME isn't set, are omitted rather than empty.
+func getEnhancedMetricsTags(ctx context.Context) []string {
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		logger.Debug("could not retrieve the LambdaContext from Context")
+		return []string{}
+	}
 
-		// Check if our slice contains an alias or version
-		if len(splitArn) > 7 {
-			alias = splitArn[7]
+	tags := []string{fmt.Sprintf("datadog_lambda:v%s", version.DDLambdaVersion)}
+	if lambdacontext.FunctionName != "" {
+		tags = append(tags, fmt.Sprintf("functionname:%s", lambdacontext.FunctionName))
+	}
+	if lambdacontext.MemoryLimitInMB > 0 {
+		tags = append(tags, fmt.Sprintf("memorysize:%d", lambdacontext.MemoryLimitInMB))
+	}
+	runtimeTags := getRuntimeTags()
+	if runtimeTags.architecture != "" {
+		tags = append(tags, runtimeTags.architecture)
+	}
+	if runtimeTags.runtime != "" {
+		tags = append(tags, runtimeTags.runtime)
+	}
+	if isColdStart, ok := ctx.Value("cold_start").(bool); ok {
+		tags = append(tags, fmt.Sprintf("cold_start:%t", isColdStart))
+	}
+
+	// ex: arn:aws:lambda:us-east-1:123497558138:function:golang-layer:alias
+	splitArn := strings.Split(lc.InvokedFunctionArn, ":")
+	if len(splitArn) < 5 {
+		logger.Debug("malformed arn string in the LambdaContext")
+	} else {
+		if region := splitArn[3]; region != "" {
+			tags = append(tags, fmt.Sprintf("region:%s", region))
+		}
+		if accountID := splitArn[4]; accountID != "" {
+			tags = append(tags, fmt.Sprintf("account_id:%s", accountID))
+		}
+	}
 
-			// If we have an alias...
-			switch alias != "" {
+	if lambdacontext.FunctionName != "" {
+		resource := fmt.Sprintf("resource:%s", lambdacontext.FunctionName)
+		// Check if our slice contains an alias or version
+		if len(splitArn) > 7 && splitArn[7] != "" {
+			alias := splitArn[7]
+			switch {
 			// If the alias is $Latest, drop the $ for ddog tag conventio
 			case strings.HasPrefix(alias, "$"):
 				alias = strings.TrimPrefix(alias, "$")
 			// If this is not a version number, we will have an alias and executed version
-			case isNotNumeric(alias):
-				executedVersion = fmt.Sprintf("executedversion:%s", lambdacontext.FunctionVersion)
-				tags = append(tags, executedVersion)
+			case isNotNumeric(alias) && lambdacontext.FunctionVersion != "":
+				tags = append(tags, fmt.Sprintf("executedversion:%s", lambdacontext.FunctionVersion))
 			}
-
 			resource = fmt.Sprintf("resource:%s:%s", lambdacontext.FunctionName, alias)
 		}
-
 		tags = append(tags, resource)
+	}
 
-		return tags
+	if eventSourceTags, ok := ctx.Value(eventSourceTagsKey).([]string); ok {
+		tags = append(tags, eventSourceTags...)
+	}
+	if resourceTags, ok := ctx.Value(resourceTagsKey).([]string); ok {
+		tags = append(tags, resourceTags...)
+	}
+	if source, ok := eventsource.FromContext(ctx); ok {
+		tags = append(tags, fmt.Sprintf("event_source:%s", source))
 	}
 
-	logger.Debug("could not retrieve the LambdaContext from Context")
-	return []string{}
+	return tags
 }
 
 func isNotNumeric(s string) bool {
@@ -266,27 +1116,36 @@ func isNotNumeric(s string) bool {
 	return err != nil
 }
 
-func isServerlessAgentRunning() bool {
+// probeServerlessAgent checks that the Serverless Agent responds to its hello endpoint
+func probeServerlessAgent(agentURL string) error {
 	client := &http.Client{Timeout: AgentCallTimeout}
-	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8124/lambda/hello", nil)
-	if response, err := client.Do(req); err == nil && response.StatusCode == 200 {
-		logger.Debug("Will use the Serverless Agent")
-		return true
+	req, _ := http.NewRequest(http.MethodGet, agentURL+"/lambda/hello", nil)
+	response, err := client.Do(req)
+	if err != nil {
+		return err
 	}
-	logger.Debug("Will use the API")
-	return false
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("the Agent didn't return HTTP 200: %s", response.Status)
+	}
+	return nil
 }
 
-func flushServerlessAgent() error {
+// flushServerlessAgent asks the Serverless Agent to flush its metrics, and waits for them to be delivered
+func flushServerlessAgent(agentURL string) error {
 	client := &http.Client{Timeout: AgentCallTimeout}
-	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8124/lambda/flush", nil)
-	if response, err := client.Do(req); err != nil {
+	flushURL := agentURL + "/lambda/flush"
+	req, _ := http.NewRequest(http.MethodGet, flushURL, nil)
+	response, err := client.Do(req)
+	if err != nil {
 		err := fmt.Errorf("was not able to reach the Agent to flush: %s", err)
-		logger.Error(err)
+		logger.ErrorWithFields(err, logger.Fields{"endpoint": flushURL})
 		return err
-	} else if response.StatusCode != 200 {
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
 		err := fmt.Errorf("the Agent didn't returned HTTP 200: %s", response.Status)
-		logger.Error(err)
+		logger.ErrorWithFields(err, logger.Fields{"endpoint": flushURL, "status_code": response.StatusCode})
 		return err
 	}
 	return nil
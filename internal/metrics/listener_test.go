@@ -13,15 +13,25 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/DataDog/datadog-lambda-go/internal/health"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
 	"github.com/DataDog/datadog-lambda-go/internal/version"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 
 	"github.com/stretchr/testify/assert"
@@ -40,21 +50,161 @@ func TestHandlerAddsItselfToContext(t *testing.T) {
 	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
 	pr := GetListener(ctx)
 	assert.NotNil(t, pr)
+	listener.HandlerFinished(ctx, nil, nil)
 }
 
 func TestHandlerFinishesProcessing(t *testing.T) {
 	listener := MakeListener(Config{})
 	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
 
-	listener.HandlerFinished(ctx, nil)
+	listener.HandlerFinished(ctx, nil, nil)
 	assert.False(t, listener.processor.IsProcessing())
 }
 
+func TestHandlerStartedFinishesSkippedInvocation(t *testing.T) {
+	listener := MakeListener(Config{})
+	listener.HandlerStarted(context.Background(), json.RawMessage{})
+	skipped := listener.processor
+
+	// HandlerFinished isn't called, as when the handler panics
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.False(t, skipped.IsProcessing())
+
+	listener.HandlerFinished(ctx, nil, nil)
+	assert.False(t, listener.processor.IsProcessing())
+}
+
+// addLateMetric sends a metric 50ms after being called, like a goroutine outliving its invocation, and
+// returns a channel closed once it was sent
+func addLateMetric(listener *Listener) chan struct{} {
+	sent := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listener.AddDistributionMetric("late-metric", 1, time.Now(), false)
+		close(sent)
+	}()
+	return sent
+}
+
+func TestAddDistributionMetricAfterHandlerFinished(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	sent := addLateMetric(&listener)
+	listener.HandlerFinished(ctx, nil, nil)
+	<-sent
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+
+	// The late metric is sent with the batch of the next invocation
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "late-metric", batch[0].Name)
+	assert.Equal(t, DropStats{}, listener.Stats().Drops)
+}
+
+func TestAddDistributionMetricAfterProcessorTornDown(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = listener.HandlerStarted(ctx, json.RawMessage{})
+	sent := addLateMetric(&listener)
+	// The invocation times out, tearing down the processor without flushing
+	cancel()
+	<-sent
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.Equal(t, DropStats{Cancelled: 1}, listener.Stats().Drops)
+
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.HandlerFinished(ctx, nil, nil)
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+}
+
+func TestAddDistributionMetricPendingIsBounded(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.HandlerFinished(ctx, nil, nil)
+	for i := 0; i < maxPendingMetrics+10; i++ {
+		err := listener.AddDistributionMetric("late-metric", float64(i), time.Now(), false)
+		if i < maxPendingMetrics {
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, errors.Is(err, ErrBufferFull))
+		}
+	}
+
+	assert.Len(t, listener.pending, maxPendingMetrics)
+	assert.Equal(t, DropStats{PendingFull: 10}, listener.Stats().Drops)
+}
+
+func TestTerminateFlushesPendingMetrics(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.HandlerFinished(ctx, nil, nil)
+	assert.NoError(t, listener.AddDistributionMetric("late-metric", 1, time.Now(), false))
+
+	// The container shuts down before another invocation could send the late metric
+	listener.Terminate()
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "late-metric", batch[0].Name)
+	assert.Empty(t, listener.pending)
+
+	// Nothing is left to send
+	listener.Terminate()
+	assert.Len(t, mc.batches, 0)
+}
+
+func TestAddMetricReturnsWhyItWontBeSent(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+
+	assert.NoError(t, listener.AddDistributionMetric("my-metric", 1, time.Now(), false))
+	assert.NoError(t, listener.AddSetMetric("my-set", "member", time.Now()))
+	captureOutput(func() {
+		assert.True(t, errors.Is(listener.AddDistributionMetric("", 1, time.Now(), false), ErrInvalidMetric))
+		assert.True(t, errors.Is(listener.AddDistributionMetric("my-metric", math.NaN(), time.Now(), false), ErrInvalidMetric))
+		assert.True(t, errors.Is(listener.AddDistributionMetric("my-metric", math.Inf(1), time.Now(), false), ErrInvalidMetric))
+		assert.True(t, errors.Is(listener.AddSampledDistributionMetric("my-metric", 1, 2, time.Now()), ErrInvalidMetric))
+	})
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 2)
+
+	listener.sinkInfo = SinkInfo{Sink: SinkDisabled, Reason: "no API key is set"}
+	assert.True(t, errors.Is(listener.AddDistributionMetric("my-metric", 1, time.Now(), false), ErrMetricsDisabled))
+	assert.True(t, errors.Is(listener.AddSetMetric("my-set", "member", time.Now()), ErrMetricsDisabled))
+}
+
+func TestAddDistributionMetricBeforeHandlerStarted(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	listener.AddDistributionMetric("early-metric", 1, time.Now(), false)
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Equal(t, "early-metric", batch[0].Name)
+}
+
 func TestAddDistributionMetricWithAPI(t *testing.T) {
 
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/distribution_points?api_key=12345", r.URL.String())
+		assert.Equal(t, "/distribution_points", r.URL.String())
+		assert.Equal(t, "12345", r.Header.Get("DD-API-KEY"))
 		called = true
 		w.WriteHeader(http.StatusCreated)
 	}))
@@ -63,10 +213,68 @@ func TestAddDistributionMetricWithAPI(t *testing.T) {
 	listener := MakeListener(Config{APIKey: "12345", Site: server.URL})
 	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
 	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "tag:a", "tag:b")
-	listener.HandlerFinished(ctx, nil)
+	listener.HandlerFinished(ctx, nil, nil)
 	assert.True(t, called)
 }
 
+func TestAddDistributionMetricMergesTags(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, GlobalTags: []string{"env:prod", "service:api"}})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddInvocationTags("env:staging", "team:orders")
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "env:dev")
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Equal(t, []string{getRuntimeTag(), "env:dev", "service:api", "team:orders"}, batch[0].Tags)
+
+	// The invocation tags are reset when the next invocation starts
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch = <-mc.batches
+	assert.Equal(t, []string{getRuntimeTag(), "env:prod", "service:api"}, batch[0].Tags)
+}
+
+func TestAddSetMetric(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, SetMaxMembers: 2})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	now := time.Now()
+	listener.AddSetMetric("users", "alice", now, "env:prod")
+	listener.AddSetMetric("users", "bob", now, "env:prod")
+	listener.AddSetMetric("users", "carol", now, "env:prod")
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, GaugeType, batch[0].MetricType)
+	assert.Equal(t, []string{getRuntimeTag(), "env:prod", setSaturatedTag}, batch[0].Tags)
+	assert.Equal(t, []interface{}{[]interface{}{float64(now.Unix()), float64(2)}}, batch[0].Points)
+}
+
+func TestAddSetMetricWithLogForwarder(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	output := captureOutput(func() {
+		listener.AddSetMetric("users", "alice", time.Now())
+	})
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.NotContains(t, output, `"m":"users"`)
+}
+
+func TestListenerJittersTicks(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true})
+	_, jittered := listener.timeService.(tickJitterer)
+	assert.True(t, jittered)
+
+	listener = MakeListener(Config{ShouldUseLogForwarder: true, DisableFlushJitter: true})
+	_, jittered = listener.timeService.(tickJitterer)
+	assert.False(t, jittered)
+}
+
 func TestAddDistributionMetricWithLogForwarder(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -78,7 +286,7 @@ func TestAddDistributionMetricWithLogForwarder(t *testing.T) {
 	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, ShouldUseLogForwarder: true})
 	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
 	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "tag:a", "tag:b")
-	listener.HandlerFinished(ctx, nil)
+	listener.HandlerFinished(ctx, nil, nil)
 	assert.False(t, called)
 }
 func TestAddDistributionMetricWithForceLogForwarder(t *testing.T) {
@@ -92,11 +300,29 @@ func TestAddDistributionMetricWithForceLogForwarder(t *testing.T) {
 	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, ShouldUseLogForwarder: false})
 	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
 	listener.AddDistributionMetric("the-metric", 2, time.Now(), true, "tag:a", "tag:b")
-	listener.HandlerFinished(ctx, nil)
+	listener.HandlerFinished(ctx, nil, nil)
 	assert.False(t, called)
 }
 
+func TestMakeListenerPrewarmsConnection(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	MakeListener(Config{APIKey: "12345", Site: server.URL, PrewarmConnection: true})
+	assert.Equal(t, []string{"HEAD /validate"}, requests)
+
+	// Only the API sink is prewarmed, and only when asked to
+	requests = nil
+	MakeListener(Config{APIKey: "12345", Site: server.URL})
+	MakeListener(Config{APIKey: "12345", Site: server.URL, PrewarmConnection: true, ShouldUseLogForwarder: true})
+	assert.Empty(t, requests)
+}
+
 func TestGetEnhancedMetricsTags(t *testing.T) {
+	defer setRuntimeTags(runtimeTags{architecture: "architecture:arm64", runtime: "runtime:provided.al2", memorySize: "memorysize:256"})()
 	ctx := context.WithValue(context.Background(), "cold_start", false)
 
 	lambdacontext.MemoryLimitInMB = 256
@@ -106,10 +332,11 @@ func TestGetEnhancedMetricsTags(t *testing.T) {
 	}
 	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc))
 
-	assert.ElementsMatch(t, tags, []string{"functionname:go-lambda-test", "region:us-east-1", "memorysize:256", "cold_start:false", "account_id:123497558138", "resource:go-lambda-test:Latest", "datadog_lambda:v" + version.DDLambdaVersion})
+	assert.ElementsMatch(t, tags, []string{"functionname:go-lambda-test", "region:us-east-1", "memorysize:256", "architecture:arm64", "runtime:provided.al2", "cold_start:false", "account_id:123497558138", "resource:go-lambda-test:Latest", "datadog_lambda:v" + version.DDLambdaVersion})
 }
 
 func TestGetEnhancedMetricsTagsWithAlias(t *testing.T) {
+	defer setRuntimeTags(runtimeTags{})()
 	ctx := context.WithValue(context.Background(), "cold_start", false)
 
 	lambdacontext.MemoryLimitInMB = 256
@@ -130,6 +357,28 @@ func TestGetEnhancedMetricsTagsNoLambdaContext(t *testing.T) {
 	assert.Empty(t, tags)
 }
 
+func TestGetEnhancedMetricsTagsOmitsMissingValues(t *testing.T) {
+	defer setRuntimeTags(runtimeTags{})()
+	defer func(functionName string, memorySize int) {
+		lambdacontext.FunctionName = functionName
+		lambdacontext.MemoryLimitInMB = memorySize
+	}(lambdacontext.FunctionName, lambdacontext.MemoryLimitInMB)
+	lambdacontext.FunctionName = ""
+	lambdacontext.MemoryLimitInMB = 0
+
+	// Without the cold_start value set by the wrapper, nor the environment variables of the Lambda runtime
+	lc := &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:my-alias",
+	}
+	tags := getEnhancedMetricsTags(lambdacontext.NewContext(context.Background(), lc))
+	assert.ElementsMatch(t, []string{"region:us-east-1", "account_id:123497558138", "datadog_lambda:v" + version.DDLambdaVersion}, tags)
+
+	// A malformed ARN only omits the tags read from it
+	lc.InvokedFunctionArn = "go-lambda-test"
+	tags = getEnhancedMetricsTags(lambdacontext.NewContext(context.Background(), lc))
+	assert.Equal(t, []string{"datadog_lambda:v" + version.DDLambdaVersion}, tags)
+}
+
 func TestSubmitEnhancedMetrics(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -148,7 +397,7 @@ func TestSubmitEnhancedMetrics(t *testing.T) {
 
 	output := captureOutput(func() {
 		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
-		ml.HandlerFinished(ctx, nil)
+		ml.HandlerFinished(ctx, nil, nil)
 	})
 
 	assert.False(t, called)
@@ -175,7 +424,7 @@ func TestDoNotSubmitEnhancedMetrics(t *testing.T) {
 
 	output := captureOutput(func() {
 		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
-		ml.HandlerFinished(ctx, nil)
+		ml.HandlerFinished(ctx, nil, nil)
 	})
 
 	assert.False(t, called)
@@ -205,10 +454,602 @@ func TestSubmitEnhancedMetricsOnlyErrors(t *testing.T) {
 		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
 		ml.config.EnhancedMetrics = true
 		err := errors.New("something went wrong")
-		ml.HandlerFinished(ctx, err)
+		ml.HandlerFinished(ctx, nil, err)
 	})
 
 	assert.False(t, called)
 	expected := "{\"m\":\"aws.lambda.enhanced.errors\",\"v\":1,"
 	assert.True(t, strings.Contains(output, expected))
 }
+
+func TestSubmitEnhancedMetricsTimeouts(t *testing.T) {
+	for err, errorType := range map[error]string{
+		fmt.Errorf("querying orders: %w", context.DeadlineExceeded): "error_type:deadline_exceeded",
+		context.Canceled: "error_type:canceled",
+	} {
+		ml := MakeListener(Config{APIKey: "abc-123", EnhancedMetrics: true, ShouldUseLogForwarder: true})
+		output := captureOutput(func() {
+			ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+			ml.HandlerFinished(ctx, nil, err)
+		})
+
+		assert.Contains(t, output, `{"m":"aws.lambda.enhanced.timeouts","v":1,`)
+		assert.Contains(t, output, errorType)
+		// A timeout isn't also counted as an error of the handler
+		assert.NotContains(t, output, "aws.lambda.enhanced.errors")
+	}
+}
+
+func TestSubmitEnhancedMetricsMarshalError(t *testing.T) {
+	ml := MakeListener(Config{APIKey: "abc-123", EnhancedMetrics: true, ShouldUseLogForwarder: true})
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+		ml.HandlerFinished(ctx, nil, &wrapper.MarshalError{TypeName: "chan int", Err: errors.New("unsupported type")})
+	})
+
+	assert.Contains(t, output, `{"m":"aws.lambda.enhanced.errors","v":1,`)
+	assert.Contains(t, output, "error_type:marshal_error")
+}
+
+func TestMakeListenerWithoutAPIKeyDegrades(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+
+	output := captureOutput(func() {
+		MakeListener(Config{})
+		MakeListener(Config{})
+	})
+	assert.Equal(t, []health.Reason{health.ReasonNoAPIKey}, health.GetStatus().Degraded)
+	assert.Equal(t, 1, strings.Count(output, "entering degraded mode no_api_key"))
+}
+
+func TestSubmitDegradedMetrics(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc})
+
+	captureOutput(func() {
+		health.Degrade(health.ReasonExtensionUnreachable, errors.New("connection refused"))
+	})
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+	ml.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, degradedMetric, batch[0].Name)
+	assert.Contains(t, batch[0].Tags, "reason:extension_unreachable")
+
+	// Each degraded mode is only reported once
+	ctx = ml.HandlerStarted(context.Background(), json.RawMessage{})
+	ml.HandlerFinished(ctx, nil, nil)
+	assert.Len(t, mc.batches, 0)
+}
+
+func TestSubmitDegradedMetricsSkipsFailedAPICredentials(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	ml := MakeListener(Config{APIKey: "12345", Site: server.URL})
+
+	captureOutput(func() {
+		health.Degrade(health.ReasonKMSDecryptFailed, errors.New("access denied"))
+		health.Degrade(health.ReasonExtensionUnreachable, errors.New("connection refused"))
+	})
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+	ml.HandlerFinished(ctx, nil, nil)
+
+	// The API can't be reached without credentials, so there's no point sending their failure there
+	assert.Contains(t, string(body), "reason:extension_unreachable")
+	assert.NotContains(t, string(body), "kms_decrypt_failed")
+}
+
+func TestSubmitEnhancedMetricsDurations(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, EnhancedMetrics: true})
+	handler := wrapper.WrapHandlerWithListeners(func(ctx context.Context) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}, &ml).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"}
+	output := captureOutput(func() {
+		handler(lambdacontext.NewContext(context.Background(), lc), nil)
+	})
+
+	var runtimeDuration, postRuntimeDuration logMetric
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var lm logMetric
+		json.Unmarshal([]byte(line), &lm)
+		switch lm.MetricName {
+		case "aws.lambda.enhanced.runtime_duration":
+			runtimeDuration = lm
+		case "aws.lambda.enhanced.post_runtime_duration":
+			postRuntimeDuration = lm
+		}
+	}
+	assert.GreaterOrEqual(t, runtimeDuration.Value, float64(10))
+	assert.Contains(t, runtimeDuration.Tags, "cold_start:true")
+	assert.Greater(t, postRuntimeDuration.Value, float64(0))
+}
+
+// loggedMetricNames returns the names of the metrics written to the logs
+func loggedMetricNames(output string) map[string]bool {
+	names := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var lm logMetric
+		if json.Unmarshal([]byte(line), &lm) == nil && lm.MetricName != "" {
+			names[lm.MetricName] = true
+		}
+	}
+	return names
+}
+
+func TestEnhancedMetricsSwitch(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		event    string
+		response interface{}
+		err      error
+		metrics  []string
+	}{
+		{"success", "{}", nil, nil, []string{"invocations", "runtime_duration", "post_runtime_duration", "billed_duration", "max_memory_used", "init_duration", "memory_pressure"}},
+		{"error", "{}", nil, errors.New("something went wrong"), []string{"invocations", "errors"}},
+		{"timeout", "{}", nil, context.DeadlineExceeded, []string{"invocations", "timeouts"}},
+		{"batch", string(loadBatchEvent(t, "kinesis-event.json")), sqsEventResponse{BatchItemFailures: []batchItemFailure{}}, nil, []string{"batch_records", "batch_item_failures", "event_age"}},
+	} {
+		for _, enabled := range []bool{true, false} {
+			atomic.StoreInt32(&initDurationMeasured, 0)
+			mc := makeMockClient()
+			ml := MakeListener(Config{Client: &mc, EnhancedMetrics: enabled})
+			var samples int32
+			ml.memorySampler = makeMemorySampler(time.Millisecond, 0.5, 100, func() uint64 {
+				atomic.AddInt32(&samples, 1)
+				return 99
+			})
+			handler := wrapper.WrapHandlerWithListeners(func(ctx context.Context, ev json.RawMessage) (interface{}, error) {
+				// The memory pressure is reported by the first sample, before the second one is read
+				for atomic.LoadInt32(&samples) < 2 {
+					time.Sleep(time.Millisecond)
+				}
+				ml.AddDistributionMetric("orders", 1, time.Now(), true)
+				return test.response, test.err
+			}, &ml).(func(context.Context, json.RawMessage) (interface{}, error))
+
+			output := captureOutput(func() {
+				handler(context.Background(), json.RawMessage(test.event))
+			})
+
+			names := loggedMetricNames(output)
+			// Custom metrics are sent whether the enhanced metrics are on or off
+			assert.True(t, names["orders"], test.name)
+			if enabled {
+				for _, metric := range test.metrics {
+					assert.True(t, names[enhancedMetricsPrefix+metric], "%s: %s", test.name, metric)
+				}
+				continue
+			}
+			for name := range names {
+				assert.False(t, strings.HasPrefix(name, enhancedMetricsPrefix), "%s: %s", test.name, name)
+			}
+		}
+	}
+	atomic.StoreInt32(&initDurationMeasured, 1)
+}
+
+// makeFakeExtensionListener creates a listener sending its metrics to a fake Serverless Agent, which counts the
+// flush requests and receives the DogStatsD packets
+func makeFakeExtensionListener(t *testing.T, config Config) (*Listener, *int, net.PacketConn, func()) {
+	flushes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/lambda/flush" {
+			flushes++
+		}
+	}))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	statsdClient, err := statsd.New(conn.LocalAddr().String())
+	assert.NoError(t, err)
+
+	listener := MakeListener(config)
+	listener.useServerlessAgent = true
+	listener.statsdClient = statsdClient
+	listener.agentURL = server.URL
+	return &listener, &flushes, conn, func() {
+		statsdClient.Close()
+		server.Close()
+		conn.Close()
+	}
+}
+
+func TestHandlerFinishedWithExtension(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		listener, flushes, conn, closeExtension := makeFakeExtensionListener(t, Config{AsyncFlushWithExtension: async})
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("the-metric", 2, time.Now(), false)
+		listener.HandlerFinished(ctx, nil, nil)
+
+		// The metrics are handed to the Agent either way
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Contains(t, string(buf[:n]), "the-metric:2|d")
+		// The flush of the Agent is only waited for by the synchronous flush
+		if async {
+			assert.Equal(t, 0, *flushes)
+		} else {
+			assert.Equal(t, 1, *flushes)
+		}
+		closeExtension()
+	}
+}
+
+func TestGetEnhancedMetricsTagsWithEventSourceTags(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "cold_start", false)
+	ctx = context.WithValue(ctx, eventSourceTagsKey, []string{"kafka_topic:orders"})
+
+	lambdacontext.MemoryLimitInMB = 256
+	lambdacontext.FunctionName = "go-lambda-test"
+	lc := &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test",
+	}
+	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc))
+
+	assert.Contains(t, tags, "kafka_topic:orders")
+}
+
+func TestGetEnhancedMetricsTagsWithEventSource(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "cold_start", false)
+	ctx = eventsource.WithSource(ctx, eventsource.SQS)
+
+	lambdacontext.MemoryLimitInMB = 256
+	lambdacontext.FunctionName = "go-lambda-test"
+	lc := &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test",
+	}
+	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc))
+
+	assert.Contains(t, tags, "event_source:sqs")
+}
+
+func TestGetEventSourceTagsKafka(t *testing.T) {
+	raw, err := ioutil.ReadFile("../testdata/kafka-event.json")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"kafka_topic:orders", "kafka_topic:payments"}, getEventSourceTags(raw))
+}
+
+func TestMessageGroupTag(t *testing.T) {
+	raw, err := ioutil.ReadFile("../testdata/sqs-fifo-event.json")
+	assert.NoError(t, err)
+	details, _ := eventsource.DetectDetails(eventsource.SQS, raw)
+	ctx := eventsource.WithDetails(context.Background(), details)
+
+	for messageGroupTag, expected := range map[bool][]string{
+		true:  {"message_group_id:customer-42"},
+		false: nil,
+	} {
+		ml := MakeListener(Config{APIKey: "abc-123", ShouldUseLogForwarder: true, MessageGroupTag: messageGroupTag})
+		invocationCtx := ml.HandlerStarted(ctx, raw)
+		assert.Equal(t, expected, invocationCtx.Value(eventSourceTagsKey))
+		ml.HandlerFinished(invocationCtx, nil, nil)
+	}
+}
+
+func TestAppendMessageGroupTagWithoutDetails(t *testing.T) {
+	assert.Empty(t, appendMessageGroupTag(context.Background(), nil))
+	// Records without a message group aren't tagged with an empty one
+	ctx := eventsource.WithDetails(context.Background(), eventsource.Details{MessageDeduplicationID: "abc"})
+	assert.Empty(t, appendMessageGroupTag(ctx, nil))
+}
+
+func TestGetAuthorizerTagsRestAPI(t *testing.T) {
+	raw, err := ioutil.ReadFile("../testdata/apig-rest-authorizer-event.json")
+	assert.NoError(t, err)
+
+	// The context of the Lambda authorizer is flattened into the authorizer
+	tags := getAuthorizerTags(raw, []string{"tenant_id", "plan", "seats", "missing"})
+	assert.Equal(t, []string{"tenant_id:acme", "plan:Gold", "seats:25"}, tags)
+}
+
+func TestGetAuthorizerTagsHTTPAPI(t *testing.T) {
+	raw, err := ioutil.ReadFile("../testdata/apig-http-jwt-authorizer-event.json")
+	assert.NoError(t, err)
+
+	// JWT claims are nested under jwt.claims, and arrays such as the scopes are skipped
+	tags := getAuthorizerTags(raw, []string{"tenant_id", "email_verified", "scopes"})
+	assert.Equal(t, []string{"tenant_id:acme", "email_verified:true"}, tags)
+}
+
+func TestGetAuthorizerTagsLayouts(t *testing.T) {
+	for name, event := range map[string]string{
+		"http lambda authorizer": `{"requestContext": {"authorizer": {"lambda": {"tenant_id": "acme"}}}}`,
+		"rest cognito claims":    `{"requestContext": {"authorizer": {"claims": {"tenant_id": "acme"}}}}`,
+	} {
+		assert.Equal(t, []string{"tenant_id:acme"}, getAuthorizerTags(json.RawMessage(event), []string{"tenant_id"}), name)
+	}
+	assert.Empty(t, getAuthorizerTags(json.RawMessage(`{"requestContext": {}}`), []string{"tenant_id"}))
+	assert.Empty(t, getAuthorizerTags(json.RawMessage(`{"requestContext": {"authorizer": {"tenant_id": null}}}`), []string{"tenant_id"}))
+	assert.Empty(t, getAuthorizerTags(json.RawMessage{}, []string{"tenant_id"}))
+}
+
+func TestAuthorizerTagKeys(t *testing.T) {
+	raw, err := ioutil.ReadFile("../testdata/apig-rest-authorizer-event.json")
+	assert.NoError(t, err)
+
+	ml := MakeListener(Config{APIKey: "abc-123", ShouldUseLogForwarder: true, AuthorizerTagKeys: []string{"tenant_id", "plan"}})
+	ctx := ml.HandlerStarted(context.Background(), raw)
+	// The invocation tags are normalized like the other tags
+	assert.Equal(t, []string{"tenant_id:acme", "plan:gold"}, ml.mergeTags(nil))
+	ml.HandlerFinished(ctx, nil, nil)
+
+	// Only API Gateway events are looked up
+	sqsRaw, err := ioutil.ReadFile("../testdata/sqs-event.json")
+	assert.NoError(t, err)
+	ctx = ml.HandlerStarted(context.Background(), sqsRaw)
+	assert.Empty(t, ml.mergeTags(nil))
+	ml.HandlerFinished(ctx, nil, nil)
+}
+
+func TestGetEventSourceTagsOtherEvents(t *testing.T) {
+	assert.Empty(t, getEventSourceTags(json.RawMessage(`{"Records": [{"eventSource": "aws:sqs"}]}`)))
+	assert.Empty(t, getEventSourceTags(json.RawMessage{}))
+}
+
+func TestAddDistributionMetricScrubsTags(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true, Scrubber: scrub.MakeRegexScrubber(), DisableTagNormalization: true})
+
+	output := captureOutput(func() {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "user:bob@example.com", "tag:a")
+		listener.HandlerFinished(ctx, nil, nil)
+	})
+
+	assert.Contains(t, output, `"user:[redacted]"`)
+	assert.Contains(t, output, `"tag:a"`)
+	assert.NotContains(t, output, "bob@example.com")
+}
+
+func TestAddDistributionMetricNormalizesTags(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, Scrubber: scrub.MakeRegexScrubber(), GlobalTags: []string{"Team:Orders"}})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddInvocationTags("user:bob@example.com")
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "env:prod", "Region:EU West", "!!!")
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	// The tags are scrubbed before they're normalized, and the tags left empty are dropped
+	assert.Equal(t, []string{getRuntimeTag(), "env:prod", "region:eu_west", "team:orders", "user:_redacted_"}, batch[0].Tags)
+	assert.Equal(t, uint64(4), listener.Stats().TagsNormalized)
+}
+
+func TestAddDistributionMetricLogsNormalizedTagsOnce(t *testing.T) {
+	logger.SetLogLevel(logger.LevelDebug)
+	defer logger.SetLogLevel(logger.LevelError)
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+
+	output := captureOutput(func() {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("the-metric", 1, time.Now(), false, "Env:Prod")
+		listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "Env:Prod")
+		listener.HandlerFinished(ctx, nil, nil)
+	})
+	<-mc.batches
+
+	assert.Equal(t, 1, strings.Count(output, "normalized a metric tag"))
+	assert.Equal(t, uint64(2), listener.Stats().TagsNormalized)
+}
+
+func TestAddSampledDistributionMetric(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	randoms := []float64{0.05, 0.5, 0.09}
+	listener.random = func() float64 {
+		r := randoms[0]
+		randoms = randoms[1:]
+		return r
+	}
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	for i := 0; i < 3; i++ {
+		listener.AddSampledDistributionMetric("the-metric", float64(i), 0.1, time.Now())
+	}
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Len(t, batch[0].Points, 2)
+	assert.Equal(t, 0.1, batch[0].SampleRate)
+}
+
+func TestAddSampledDistributionMetricRejectsInvalidRates(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	for _, rate := range []float64{0, -0.5, 1.5, math.NaN()} {
+		listener.AddSampledDistributionMetric("the-metric", 1, rate, time.Now())
+	}
+	listener.AddSampledDistributionMetric("the-metric", 1, 1, time.Now())
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch[0].Points, 1)
+	// Points sent at a rate of 1 aren't sampled
+	assert.Zero(t, batch[0].SampleRate)
+	assert.Equal(t, uint64(4), listener.Stats().InvalidSampleRates)
+	assert.Equal(t, uint64(1), listener.Stats().MetricsAdded)
+}
+
+func TestHandlerStartedAddsPreInitMetrics(t *testing.T) {
+	initQueue = &preInitQueue{}
+	initTime := time.Unix(1600000000, 0)
+	for i := 0; i < maxPreInitMetrics+1; i++ {
+		buffered, err := AddPreInitMetric("init.metric", float64(i), initTime, "phase:init")
+		assert.True(t, buffered)
+		if i < maxPreInitMetrics {
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, errors.Is(err, ErrBufferFull))
+		}
+	}
+
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	// Once the first invocation started, metrics are sent to its listener
+	buffered, err := AddPreInitMetric("init.metric", 1, initTime)
+	assert.False(t, buffered)
+	assert.NoError(t, err)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, []string{getRuntimeTag(), "phase:init"}, batch[0].Tags)
+	assert.Len(t, batch[0].Points, maxPreInitMetrics)
+	assert.Equal(t, []interface{}{float64(initTime.Unix()), []interface{}{float64(0)}}, batch[0].Points[0])
+	assert.Equal(t, uint64(1), listener.Stats().Drops.PreInitFull)
+}
+
+func TestPreInitMetricsDontShareCallerTags(t *testing.T) {
+	initQueue = &preInitQueue{}
+	tags := []string{"phase:init"}
+	AddPreInitMetric("init.metric", 1, time.Unix(1600000000, 0), tags...)
+	// The caller reuses its slice before the first invocation
+	tags[0] = "phase:mutated"
+
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, []string{getRuntimeTag(), "phase:init"}, batch[0].Tags)
+}
+
+func TestAddDistributionMetricWithoutTagNormalization(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, DisableTagNormalization: true})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "Region:EU West")
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Equal(t, []string{"Region:EU West", getRuntimeTag()}, batch[0].Tags)
+	assert.Equal(t, uint64(0), listener.Stats().TagsNormalized)
+}
+
+func TestAddDistributionMetrics(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	err := listener.AddDistributionMetrics("the-metric", []float64{1, 2, 3}, time.Now(), "env:prod")
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.NoError(t, err)
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Len(t, batch[0].Points, 3)
+	assert.Equal(t, uint64(3), listener.Stats().MetricsAdded)
+}
+
+func TestAddDistributionMetricsRejectsInvalidValue(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	err := listener.AddDistributionMetrics("the-metric", []float64{1, math.NaN()}, time.Now())
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.True(t, errors.Is(err, ErrInvalidMetric))
+	assert.Equal(t, uint64(0), listener.Stats().MetricsAdded)
+}
+
+func TestAddDistributionMetricsViaLogForwarder(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true})
+
+	output := captureOutput(func() {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetrics("the-metric", []float64{1, 2}, time.Now())
+		listener.HandlerFinished(ctx, nil, nil)
+	})
+
+	assert.Equal(t, 2, strings.Count(output, `"m":"the-metric"`))
+}
+
+func TestAddedMetricsDontShareCallerSlices(t *testing.T) {
+	for _, disableTagNormalization := range []bool{false, true} {
+		mc := makeMockClient()
+		listener := MakeListener(Config{Client: &mc, DisableTagNormalization: disableTagNormalization})
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		// The caller reuses its slices for each metric, mutating them once the metric is added
+		tags := make([]string, 1, 4)
+		values := []float64{1, 2}
+		tags[0] = "tenant:a"
+		listener.AddDistributionMetric("latency", 1, time.Now(), false, tags...)
+		tags[0] = "tenant:b"
+		listener.AddDistributionMetrics("sizes", values, time.Now(), tags...)
+		values[0] = 100
+		tags[0] = "tenant:c"
+		listener.AddRateMetric("requests", 1, time.Now(), tags...)
+		tags[0] = "tenant:d"
+		listener.AddSetMetric("users", "user-1", time.Now(), tags...)
+		tags[0] = "tenant:mutated"
+		listener.HandlerFinished(ctx, nil, nil)
+
+		batch := <-mc.batches
+		tagsByName := map[string][]string{}
+		for _, metric := range batch {
+			tagsByName[metric.Name] = metric.Tags
+			if metric.Name == "sizes" {
+				assert.Equal(t, []interface{}{float64(1)}, metric.Points[0].([]interface{})[1])
+			}
+		}
+		assert.Contains(t, tagsByName["latency"], "tenant:a")
+		assert.Contains(t, tagsByName["sizes"], "tenant:b")
+		assert.Contains(t, tagsByName["requests"], "tenant:c")
+		assert.Contains(t, tagsByName["users"], "tenant:d")
+	}
+}
+
+func TestAddDistributionMetricSanitizesWithoutTagNormalization(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, DisableTagNormalization: true, GlobalTags: []string{"team:\x00orders"}})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddInvocationTags("user:\x1bbob")
+	listener.AddDistributionMetric("the-\nmetric\xff", 2, time.Now(), false, "Region:EU\tWest", "\x07")
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Equal(t, "the-metric", batch[0].Name)
+	assert.ElementsMatch(t, []string{"Region:EUWest", "user:bob", "team:orders", getRuntimeTag()}, batch[0].Tags)
+}
+
+func TestAddDistributionMetricRejectsNameOfControlCharacters(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	err := listener.AddDistributionMetric("\r\n", 2, time.Now(), false)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.True(t, errors.Is(err, ErrInvalidMetric))
+}
+
+func TestHandlerFinishedSyncFlushOnly(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, SyncFlushOnly: true})
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 1, time.Now(), false)
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	assert.Equal(t, "the-metric", (<-mc.batches)[0].Name)
+}
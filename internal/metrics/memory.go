@@ -0,0 +1,144 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memorySampler compares the memory used by the container with its limit while an invocation is in progress, so
+// that the risk of running out of memory is reported before the runtime is killed. It only ticks between start
+// and stop, so that it doesn't use CPU while the container is frozen between invocations.
+type memorySampler struct {
+	interval  time.Duration
+	threshold float64
+	limit     uint64
+	// readUsage returns the memory used by the container, in bytes
+	readUsage func() uint64
+
+	mu   sync.Mutex
+	stop chan struct{}
+	// done receives the peak memory usage of the invocation when the sampling goroutine exits
+	done chan uint64
+}
+
+func makeMemorySampler(interval time.Duration, threshold float64, limit uint64, readUsage func() uint64) *memorySampler {
+	return &memorySampler{
+		interval:  interval,
+		threshold: threshold,
+		limit:     limit,
+		readUsage: readUsage,
+	}
+}
+
+// start samples the memory until stop is called. onPressure is called with the utilization of the memory, as a
+// share of the limit, the first time it reaches the threshold.
+func (s *memorySampler) start(onPressure func(utilization float64)) {
+	s.stopSampling()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop = make(chan struct{})
+	s.done = make(chan uint64, 1)
+	go s.sample(s.stop, s.done, onPressure)
+}
+
+// stopSampling stops the sampling goroutine and waits for it to exit. It returns the peak memory usage sampled
+// since start, in bytes. Stopping twice is a no-op, which returns 0.
+func (s *memorySampler) stopSampling() uint64 {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	if stop == nil {
+		return 0
+	}
+	close(stop)
+	return <-done
+}
+
+func (s *memorySampler) sample(stop <-chan struct{}, done chan<- uint64, onPressure func(utilization float64)) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	peak := uint64(0)
+	reported := false
+	for {
+		select {
+		case <-stop:
+			// A last sample covers the end of the invocation, and invocations shorter than the interval
+			if usage := s.readUsage(); usage > peak {
+				peak = usage
+			}
+			done <- peak
+			return
+		case <-ticker.C:
+			usage := s.readUsage()
+			if usage > peak {
+				peak = usage
+			}
+			utilization := float64(usage) / float64(s.limit)
+			if !reported && utilization >= s.threshold {
+				onPressure(utilization)
+				// The pressure is reported once per invocation, but the peak is still measured
+				reported = true
+			}
+		}
+	}
+}
+
+// readMemoryUsage returns the largest of the memory obtained from the OS by the Go runtime, and of the memory
+// used by the container according to its cgroup or, when it's not available, the resident set of the process.
+func readMemoryUsage() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	usage := stats.Sys
+	resident, ok := readCgroupMemory()
+	if !ok {
+		resident, ok = readResidentSetSize()
+	}
+	if ok && resident > usage {
+		usage = resident
+	}
+	return usage
+}
+
+// readCgroupMemory reads the memory usage of the cgroup v2 or v1 of the container
+func readCgroupMemory() (uint64, bool) {
+	for _, path := range []string{"/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory/memory.usage_in_bytes"} {
+		if content, err := ioutil.ReadFile(path); err == nil {
+			if usage, err := strconv.ParseUint(string(bytes.TrimSpace(content)), 10, 64); err == nil {
+				return usage, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// readResidentSetSize reads the resident set of the process from procfs, where it's the second field of statm,
+// in pages
+func readResidentSetSize() (uint64, bool) {
+	content, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := bytes.Fields(content)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * uint64(os.Getpagesize()), true
+}
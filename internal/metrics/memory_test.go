@@ -0,0 +1,132 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySamplerReportsPressureOnce(t *testing.T) {
+	sampler := makeMemorySampler(time.Millisecond, 0.92, 100, func() uint64 { return 95 })
+	reports := make(chan float64, 10)
+
+	sampler.start(func(utilization float64) { reports <- utilization })
+	assert.Equal(t, 0.95, <-reports)
+	time.Sleep(10 * time.Millisecond)
+	sampler.stopSampling()
+	assert.Len(t, reports, 0)
+
+	// Each invocation reports its pressure
+	sampler.start(func(utilization float64) { reports <- utilization })
+	assert.Equal(t, 0.95, <-reports)
+	sampler.stopSampling()
+}
+
+func TestMemorySamplerStopsBetweenInvocations(t *testing.T) {
+	var samples int32
+	sampler := makeMemorySampler(time.Millisecond, 0.92, 100, func() uint64 {
+		atomic.AddInt32(&samples, 1)
+		return 50
+	})
+
+	sampler.start(func(float64) { t.Error("the memory pressure was reported below the threshold") })
+	for atomic.LoadInt32(&samples) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sampler.stopSampling()
+	sampler.stopSampling()
+
+	stopped := atomic.LoadInt32(&samples)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&samples))
+}
+
+func TestReadMemoryUsage(t *testing.T) {
+	assert.Greater(t, readMemoryUsage(), uint64(0))
+}
+
+func TestMakeListenerMemoryPressure(t *testing.T) {
+	defer func(memorySize int) {
+		lambdacontext.MemoryLimitInMB = memorySize
+	}(lambdacontext.MemoryLimitInMB)
+	lambdacontext.MemoryLimitInMB = 128
+
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, MemoryPressure: true})
+	assert.Equal(t, defaultMemoryPressureThreshold, listener.memorySampler.threshold)
+	assert.Equal(t, uint64(128*1024*1024), listener.memorySampler.limit)
+
+	listener = MakeListener(Config{Client: &mc, MemoryPressure: true, MemoryPressureThreshold: 0.8})
+	assert.Equal(t, 0.8, listener.memorySampler.threshold)
+
+	listener = MakeListener(Config{Client: &mc})
+	assert.Nil(t, listener.memorySampler)
+
+	// Without a memory limit, there's nothing to compare with
+	lambdacontext.MemoryLimitInMB = 0
+	listener = MakeListener(Config{Client: &mc, MemoryPressure: true})
+	assert.Nil(t, listener.memorySampler)
+}
+
+func TestMemoryPressureFlushesEarly(t *testing.T) {
+	flushed := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flushed <- struct{}{}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, BatchInterval: time.Hour, EnhancedMetrics: true})
+	var usage uint64
+	listener.memorySampler = makeMemorySampler(time.Millisecond, 0.92, 100, func() uint64 { return atomic.LoadUint64(&usage) })
+
+	ctx := listener.HandlerStarted(context.Background(), []byte("{}"))
+	listener.AddDistributionMetric("my-metric", 1, time.Now(), false)
+	atomic.StoreUint64(&usage, 99)
+	// The batch is sent long before the end of the batch interval
+	<-flushed
+	listener.HandlerFinished(ctx, nil, nil)
+	assert.Nil(t, listener.memorySampler.stop)
+}
+
+func TestMemorySamplerPeak(t *testing.T) {
+	var usage uint64
+	sampler := makeMemorySampler(time.Millisecond, 0.92, 100, func() uint64 {
+		return atomic.AddUint64(&usage, 10) % 60
+	})
+
+	sampler.start(func(float64) { t.Error("the memory pressure was reported below the threshold") })
+	for atomic.LoadUint64(&usage) < 100 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, uint64(50), sampler.stopSampling())
+	assert.Equal(t, uint64(0), sampler.stopSampling())
+}
+
+func TestMemorySamplerKeepsSamplingAfterPressure(t *testing.T) {
+	var usage uint64 = 90
+	sampler := makeMemorySampler(time.Millisecond, 0.92, 100, func() uint64 {
+		return atomic.AddUint64(&usage, 5)
+	})
+	reports := make(chan float64, 10)
+
+	sampler.start(func(utilization float64) { reports <- utilization })
+	<-reports
+	peak := sampler.stopSampling()
+	assert.Equal(t, atomic.LoadUint64(&usage), peak)
+	assert.Len(t, reports, 0)
+}
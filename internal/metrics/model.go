@@ -9,6 +9,7 @@
 package metrics
 
 import (
+	"strconv"
 	"time"
 )
 
@@ -29,6 +30,8 @@ type (
 		MetricType MetricType    `json:"type"`
 		Interval   *float64      `json:"interval,omitempty"`
 		Points     []interface{} `json:"points"`
+		// SampleRate is the rate the points were sampled at, when they were sampled
+		SampleRate float64 `json:"sample_rate,omitempty"`
 	}
 
 	// MetricValue represents a datapoint for a metric
@@ -43,6 +46,77 @@ type (
 		Tags   []string
 		Host   *string
 		Values []MetricValue
+		// SampleRate is the rate the points were sampled at. Zero means they weren't sampled.
+		SampleRate float64
+	}
+
+	// Set counts the distinct members added during a flush interval, and is sent as a gauge of their number.
+	// Once it holds MaxMembers members, it stops counting, and is tagged as saturated.
+	Set struct {
+		Name string
+		Tags []string
+		Host *string
+		// Timestamp is the time the first member was added
+		Timestamp time.Time
+		// MaxMembers bounds the memory used by the set. It defaults to 1000 when zero.
+		MaxMembers int
+		members    map[string]struct{}
+		saturated  bool
+	}
+
+	// Count sums the values sent with the same name and tags within an aggregation bucket
+	Count struct {
+		Name      string
+		Tags      []string
+		Host      *string
+		Timestamp time.Time
+		Value     float64
+		bucket    bucket
+	}
+
+	// Gauge keeps the last value sent with the same name and tags within an aggregation bucket
+	Gauge struct {
+		Name      string
+		Tags      []string
+		Host      *string
+		Timestamp time.Time
+		Value     float64
+		bucket    bucket
+	}
+
+	// Rate sums the values sent with the same name and tags until the batch is flushed, and is sent as their rate
+	// per second over the time which actually elapsed since the previous flush
+	Rate struct {
+		Name string
+		Tags []string
+		Host *string
+		// Timestamp is the time of the first value
+		Timestamp time.Time
+		Value     float64
+		window    rateWindow
+	}
+
+	// rateWindow is the span of time the values of a rate were summed over
+	rateWindow struct {
+		start time.Time
+		width time.Duration
+	}
+
+	// bucketedMetric is a metric whose points are rolled up by the batcher into buckets of time, so that chatty
+	// metrics send a single point per bucket. Distributions aren't bucketed, as every point counts in their
+	// percentiles.
+	bucketedMetric interface {
+		Metric
+		// pointTime returns the time of the metric's point, which decides its bucket
+		pointTime() time.Time
+		// setBucket records the bucket the metric was rolled up into
+		setBucket(start time.Time, width time.Duration)
+	}
+
+	// bucket is the time span a bucketed metric was rolled up into
+	bucket struct {
+		start time.Time
+		width time.Duration
 	}
 )
 
@@ -58,6 +132,7 @@ func (d *Distribution) ToBatchKey() BatchKey {
 		host:       d.Host,
 		tags:       d.Tags,
 		metricType: DistributionType,
+		sampleRate: d.SampleRate,
 	}
 }
 
@@ -91,6 +166,223 @@ func (d *Distribution) ToAPIMetric(interval time.Duration) []APIMetric {
 			MetricType: DistributionType,
 			Points:     points,
 			Interval:   nil,
+			SampleRate: d.SampleRate,
+		},
+	}
+}
+
+// AddPoint adds a numeric member to the set
+func (s *Set) AddPoint(timestamp time.Time, value float64) {
+	s.AddMember(timestamp, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// AddMember adds a member to the set, unless it already holds it or is saturated
+func (s *Set) AddMember(timestamp time.Time, member string) {
+	if s.members == nil {
+		s.members = map[string]struct{}{}
+	}
+	if s.Timestamp.IsZero() || timestamp.Before(s.Timestamp) {
+		s.Timestamp = timestamp
+	}
+	if _, ok := s.members[member]; ok {
+		return
+	}
+	maxMembers := s.MaxMembers
+	if maxMembers <= 0 {
+		maxMembers = defaultSetMaxMembers
+	}
+	if len(s.members) >= maxMembers {
+		s.saturated = true
+		return
+	}
+	s.members[member] = struct{}{}
+}
+
+// ToBatchKey returns a key that can be used to batch the metric
+func (s *Set) ToBatchKey() BatchKey {
+	return BatchKey{
+		name:       s.Name,
+		host:       s.Host,
+		tags:       s.Tags,
+		metricType: setBatchType,
+	}
+}
+
+// Join adds the members of another set to this one
+func (s *Set) Join(metric Metric) {
+	otherSet, ok := metric.(*Set)
+	if !ok {
+		return
+	}
+	for member := range otherSet.members {
+		s.AddMember(otherSet.Timestamp, member)
+	}
+	s.saturated = s.saturated || otherSet.saturated
+}
+
+// ToAPIMetric converts a set into a gauge of its number of members, at the time its first member was added
+func (s *Set) ToAPIMetric(interval time.Duration) []APIMetric {
+	tags := s.Tags
+	if s.saturated {
+		tags = append(append(make([]string, 0, len(s.Tags)+1), s.Tags...), setSaturatedTag)
+	}
+	return []APIMetric{
+		{
+			Name:       s.Name,
+			Host:       s.Host,
+			Tags:       tags,
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(s.Timestamp.Unix()), float64(len(s.members))}},
 		},
 	}
 }
+
+// AddPoint adds a value to the count
+func (c *Count) AddPoint(timestamp time.Time, value float64) {
+	if c.Timestamp.IsZero() || timestamp.Before(c.Timestamp) {
+		c.Timestamp = timestamp
+	}
+	c.Value += value
+}
+
+// ToBatchKey returns a key that can be used to batch the metric
+func (c *Count) ToBatchKey() BatchKey {
+	return BatchKey{
+		name:       c.Name,
+		host:       c.Host,
+		tags:       c.Tags,
+		metricType: CountType,
+	}
+}
+
+// Join adds the value of another count to this one
+func (c *Count) Join(metric Metric) {
+	otherCount, ok := metric.(*Count)
+	if !ok {
+		return
+	}
+	c.AddPoint(otherCount.Timestamp, otherCount.Value)
+}
+
+// ToAPIMetric converts a count into a single point at the start of its bucket
+func (c *Count) ToAPIMetric(interval time.Duration) []APIMetric {
+	return []APIMetric{c.bucket.toAPIMetric(c.Name, c.Host, c.Tags, CountType, c.Timestamp, c.Value)}
+}
+
+func (c *Count) pointTime() time.Time {
+	return c.Timestamp
+}
+
+func (c *Count) setBucket(start time.Time, width time.Duration) {
+	c.bucket = bucket{start: start, width: width}
+}
+
+// AddPoint sets the value of the gauge, unless it already holds a later value
+func (g *Gauge) AddPoint(timestamp time.Time, value float64) {
+	if g.Timestamp.IsZero() || !timestamp.Before(g.Timestamp) {
+		g.Timestamp = timestamp
+		g.Value = value
+	}
+}
+
+// ToBatchKey returns a key that can be used to batch the metric
+func (g *Gauge) ToBatchKey() BatchKey {
+	return BatchKey{
+		name:       g.Name,
+		host:       g.Host,
+		tags:       g.Tags,
+		metricType: GaugeType,
+	}
+}
+
+// Join keeps the latest value of this gauge and another one
+func (g *Gauge) Join(metric Metric) {
+	otherGauge, ok := metric.(*Gauge)
+	if !ok {
+		return
+	}
+	g.AddPoint(otherGauge.Timestamp, otherGauge.Value)
+}
+
+// ToAPIMetric converts a gauge into a single point at the start of its bucket
+func (g *Gauge) ToAPIMetric(interval time.Duration) []APIMetric {
+	return []APIMetric{g.bucket.toAPIMetric(g.Name, g.Host, g.Tags, GaugeType, g.Timestamp, g.Value)}
+}
+
+func (g *Gauge) pointTime() time.Time {
+	return g.Timestamp
+}
+
+func (g *Gauge) setBucket(start time.Time, width time.Duration) {
+	g.bucket = bucket{start: start, width: width}
+}
+
+// AddPoint adds a value to the rate
+func (r *Rate) AddPoint(timestamp time.Time, value float64) {
+	if r.Timestamp.IsZero() || timestamp.Before(r.Timestamp) {
+		r.Timestamp = timestamp
+	}
+	r.Value += value
+}
+
+// ToBatchKey returns a key that can be used to batch the metric
+func (r *Rate) ToBatchKey() BatchKey {
+	return BatchKey{
+		name:       r.Name,
+		host:       r.Host,
+		tags:       r.Tags,
+		metricType: RateType,
+	}
+}
+
+// Join adds the values of another rate to this one
+func (r *Rate) Join(metric Metric) {
+	otherRate, ok := metric.(*Rate)
+	if !ok {
+		return
+	}
+	r.AddPoint(otherRate.Timestamp, otherRate.Value)
+}
+
+// ToAPIMetric converts a rate into a single point at the start of the window its values were summed over, with
+// their sum divided by the width of the window, which is sent as interval. A rate which wasn't batched is sent at
+// the time of its first value, over a second.
+func (r *Rate) ToAPIMetric(interval time.Duration) []APIMetric {
+	timestamp := r.window.start
+	if timestamp.IsZero() {
+		timestamp = r.Timestamp
+	}
+	width := r.window.width
+	if width <= 0 {
+		width = time.Second
+	}
+	seconds := width.Seconds()
+	return []APIMetric{
+		{
+			Name:       r.Name,
+			Host:       r.Host,
+			Tags:       r.Tags,
+			MetricType: RateType,
+			Interval:   &seconds,
+			Points:     []interface{}{[]interface{}{float64(timestamp.Unix()), r.Value / seconds}},
+		},
+	}
+}
+
+// toAPIMetric converts the value of a bucketed metric into a point at the start of its bucket, with the width of
+// the bucket as interval. A metric which wasn't batched keeps the time of its point.
+func (b bucket) toAPIMetric(name string, host *string, tags []string, metricType MetricType, timestamp time.Time, value float64) APIMetric {
+	metric := APIMetric{
+		Name:       name,
+		Host:       host,
+		Tags:       tags,
+		MetricType: metricType,
+	}
+	if !b.start.IsZero() {
+		timestamp = b.start
+		interval := b.width.Seconds()
+		metric.Interval = &interval
+	}
+	metric.Points = []interface{}{[]interface{}{float64(timestamp.Unix()), value}}
+	return metric
+}
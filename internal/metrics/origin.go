@@ -0,0 +1,59 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import "strings"
+
+// The origin codes identify the series sent from Lambda functions to the intake. They're the codes the libraries of
+// the other Lambda runtimes send.
+const (
+	// originProductServerless is the product of the series sent by the serverless integrations
+	originProductServerless = 1
+	// originCategoryLambda is the category of the series sent from Lambda functions
+	originCategoryLambda = 38
+	// originServiceCustom is the service of the metrics sent by the function
+	originServiceCustom = 51
+	// originServiceEnhanced is the service of the enhanced metrics, under aws.lambda.enhanced
+	originServiceEnhanced = 52
+)
+
+type (
+	// seriesMetadata is the metadata of a series sent to the API
+	seriesMetadata struct {
+		Origin seriesOrigin `json:"origin"`
+	}
+
+	// seriesOrigin identifies the integration which sent a series
+	seriesOrigin struct {
+		Product       int `json:"origin_product"`
+		SubProduct    int `json:"origin_sub_product"`
+		ProductDetail int `json:"origin_product_detail"`
+	}
+
+	// seriesV1 is a metric of a payload of the v1 API, with its metadata. The metadata isn't part of APIMetric, so
+	// that the additional sinks and the tests don't see it.
+	seriesV1 struct {
+		APIMetric
+		Metadata seriesMetadata `json:"metadata"`
+	}
+)
+
+// originMetadata returns the metadata of a series sent from Lambda, whose service depends on whether it's an
+// enhanced metric
+func originMetadata(name string) seriesMetadata {
+	service := originServiceCustom
+	if strings.HasPrefix(name, enhancedMetricsPrefix) {
+		service = originServiceEnhanced
+	}
+	return seriesMetadata{Origin: seriesOrigin{
+		Product:       originProductServerless,
+		SubProduct:    originCategoryLambda,
+		ProductDetail: service,
+	}}
+}
@@ -0,0 +1,45 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalBatchGolden(t *testing.T) {
+	batch := []APIMetric{
+		{
+			Name:       "orders.latency",
+			Tags:       []string{"env:prod"},
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(1700000000), []interface{}{12.5, float64(40)}}},
+		},
+		{
+			Name:       "aws.lambda.enhanced.invocations",
+			Tags:       []string{"functionname:orders"},
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(1700000000), []interface{}{float64(1)}}},
+		},
+	}
+
+	payload, err := MarshalBatch(batch)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, loadGolden(t, "testdata/series_v1.json"), string(payload))
+}
+
+func TestOriginMetadata(t *testing.T) {
+	custom := originMetadata("orders.placed")
+	assert.Equal(t, seriesOrigin{Product: 1, SubProduct: 38, ProductDetail: 51}, custom.Origin)
+
+	enhanced := originMetadata("aws.lambda.enhanced.errors")
+	assert.Equal(t, seriesOrigin{Product: 1, SubProduct: 38, ProductDetail: 52}, enhanced.Origin)
+}
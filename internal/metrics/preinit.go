@@ -0,0 +1,76 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	// preInitMetric is a distribution metric sent by the init code of the function, before its first invocation
+	preInitMetric struct {
+		name      string
+		value     float64
+		timestamp time.Time
+		tags      []string
+	}
+
+	// preInitQueue buffers the metrics sent before the first invocation, when there's no processor to send them
+	// to yet. They're drained into the processor of the first invocation.
+	preInitQueue struct {
+		mu      sync.Mutex
+		metrics []preInitMetric
+		// dropped counts the points sent when the queue was full
+		dropped uint64
+		// drained is set once the first invocation started, after which metrics aren't buffered anymore
+		drained bool
+	}
+)
+
+var initQueue = &preInitQueue{}
+
+// AddPreInitMetric buffers a distribution metric sent before the first invocation, such as a measure of the
+// work done by the init code, keeping its timestamp. It returns false once the first invocation started, as
+// the metrics should then be sent to the listener of the invocation. The first 1000 metrics are buffered, the
+// next ones are dropped, with an error wrapping ErrBufferFull.
+func AddPreInitMetric(metric string, value float64, timestamp time.Time, tags ...string) (bool, error) {
+	// The tags are copied, as the caller may reuse their array before the first invocation
+	return initQueue.add(preInitMetric{name: metric, value: value, timestamp: timestamp, tags: append([]string(nil), tags...)})
+}
+
+func (q *preInitQueue) add(m preInitMetric) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.drained {
+		return false, nil
+	}
+	m.name = sanitize(m.name)
+	if err := validateMetric(m.name, m.value); err != nil {
+		return true, err
+	}
+	if len(q.metrics) >= maxPreInitMetrics {
+		q.dropped++
+		return true, fmt.Errorf("%w: more than %d metrics were sent before the first invocation", ErrBufferFull, maxPreInitMetrics)
+	}
+	q.metrics = append(q.metrics, m)
+	return true, nil
+}
+
+// drain returns the buffered metrics and the number of metrics dropped, and stops buffering
+func (q *preInitQueue) drain() ([]preInitMetric, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	metrics, dropped := q.metrics, q.dropped
+	q.metrics = nil
+	q.dropped = 0
+	q.drained = true
+	return metrics, dropped
+}
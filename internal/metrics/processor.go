@@ -10,60 +10,230 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
-	"github.com/cenkalti/backoff"
 	"github.com/sony/gobreaker"
 )
 
 type (
 	// Processor is used to batch metrics on a background thread, and send them on to a client periodically.
 	Processor interface {
-		// AddMetric sends a metric to the agent
-		AddMetric(metric Metric)
+		// AddMetric sends a metric to the agent. It returns errProcessorFinished or errProcessorCancelled,
+		// without adding the metric, once the processor was finished or its context cancelled.
+		AddMetric(metric Metric) error
 		// StartProcessing begins processing metrics asynchronously
 		StartProcessing()
 		// FinishProcessing shuts down the agent, and tries to flush any remaining metrics
 		FinishProcessing()
 		// Whether the processor is still processing
 		IsProcessing() bool
+		// Stats returns the counters shared by the processors of the listener since the container started
+		Stats() Stats
+		// Flush sends the metrics batched so far without waiting for the next tick, for example before the
+		// container runs out of memory. Sync processors send them before returning, the others don't wait for the send.
+		Flush()
+	}
+
+	// BatchSink receives every batch of metrics after it was sent to the Datadog API, for example to keep a raw
+	// copy of it. Its errors are logged, but neither retried nor counted as failures of the flush.
+	BatchSink func(ctx context.Context, batch []APIMetric) error
+
+	// processorOptions configures a processor. The options left to their zero value are disabled, except for the
+	// circuit breaker, whose settings are passed to gobreaker as they are.
+	processorOptions struct {
+		client        Client
+		timeService   TimeService
+		batchInterval time.Duration
+		// shouldRetryOnFail retries the failed sends of a flush, with a backoff
+		shouldRetryOnFail           bool
+		circuitBreakerInterval      time.Duration
+		circuitBreakerTimeout       time.Duration
+		circuitBreakerTotalFailures uint32
+		// stats receives the counters of the processor, which are shared by the processors of a listener
+		stats *Stats
+		// telemetry measures the flushes when the library's telemetry is enabled. It may be nil.
+		telemetry *Telemetry
+		// sinks receive every batch after it was sent, in order
+		sinks []BatchSink
+		// syncFlushOnly batches the metrics as they're added, and sends them once when processing finishes. It
+		// doesn't start a goroutine nor a ticker, which makes it cheaper for short invocations. The options which
+		// flush before the processor finishes, the adaptive flush and the flush threshold, are then ignored.
+		syncFlushOnly bool
+		// shards buffers the metrics in that many shards, each with its own lock, instead of a single channel.
+		// The shards are drained into the batch by the processing goroutine before each flush. It's meant for
+		// handlers sending metrics from many goroutines at once, and is ignored with syncFlushOnly.
+		shards int
+		// adaptiveFlush adapts when the processor flushes to the number of points it buffers
+		adaptiveFlush bool
+		// flushThreshold flushes as soon as that many points are buffered. With adaptiveFlush, the lowest
+		// threshold wins.
+		flushThreshold uint64
+		// aggregationBucket is the width of the buckets counts and gauges are rolled up into, when it isn't the
+		// default
+		aggregationBucket time.Duration
+		// maxFutureSkew is how far in the future of the clock of the container the points can be, when it isn't
+		// the default
+		maxFutureSkew time.Duration
+		// maxFlushDuration bounds the time FinishProcessing waits for the last flush, including its retries,
+		// whatever the time left in the invocation
+		maxFlushDuration time.Duration
+		// maxRetries and maxRetryDuration bound the retries of the flushes of the processor
+		maxRetries       int
+		maxRetryDuration time.Duration
+		// rejectMissingTimestamps drops the points without a timestamp, instead of sending them at the time
+		// they're added
+		rejectMissingTimestamps bool
+		// spool keeps the batches which couldn't be sent, and is drained before the first flush
+		spool *spool
 	}
 
 	processor struct {
-		context           context.Context
-		metricsChan       chan Metric
-		timeService       TimeService
-		waitGroup         sync.WaitGroup
-		batchInterval     time.Duration
+		context       context.Context
+		metricsChan   chan Metric
+		timeService   TimeService
+		waitGroup     sync.WaitGroup
+		batchInterval time.Duration
+		// bucketWidth is the width of the buckets counts and gauges are rolled up into, when it isn't the default
+		bucketWidth time.Duration
+		// maxFutureSkew is how far in the future of the clock the points can be, when it isn't the default
+		maxFutureSkew time.Duration
+		// maxFlushDuration bounds the time FinishProcessing waits for the last flush. It's unbounded when it's 0.
+		maxFlushDuration time.Duration
+		// rejectMissingTimestamps drops the points without a timestamp, instead of sending them at the time
+		// they're added
+		rejectMissingTimestamps bool
+		// retryBudget bounds the retries of the flushes of the invocation. It's nil when they're unbounded.
+		retryBudget *retryBudget
+		// capped is set to 1 once FinishProcessing stopped waiting for the last flush, which then isn't retried
+		capped            uint32
 		client            Client
 		batcher           *Batcher
 		shouldRetryOnFail bool
-		isProcessing      bool
 		breaker           *gobreaker.CircuitBreaker
+		stats             *Stats
+		// telemetry measures the flushes when the library's telemetry is enabled. It may be nil.
+		telemetry *Telemetry
+		// sinks receive every batch after it was sent, in order
+		sinks []BatchSink
+		// flushChan requests a flush from the processing goroutine before the next tick
+		flushChan chan struct{}
+		// waitedFlushChan requests a flush like flushChan, and the channel received is closed once it's done. It's
+		// nil unless the processor runs in the background.
+		waitedFlushChan chan chan struct{}
+		// adaptive adapts the flushes to the number of points buffered. It's nil unless adaptive flush is enabled.
+		adaptive *adaptiveFlush
+		// threshold flushes the batch as soon as enough points are buffered. It's nil unless a flush threshold
+		// or adaptive flush is enabled.
+		threshold *flushThreshold
+		// thresholdChan requests a flush from the processing goroutine when a shard reaches the threshold
+		thresholdChan chan struct{}
+		// spool keeps the batches which couldn't be sent for the next invocations. It's nil unless spilling is
+		// enabled.
+		spool *spool
+		// saturation tracks the occupancy of the metrics channel. It's nil when metrics aren't buffered in it.
+		saturation *saturation
+		// shards buffer the metrics instead of the metrics channel, when the processor is sharded
+		shards    []metricShard
+		nextShard uint32
+		// flushBytes is the size of the payload of the current flush, or -1 when the client doesn't know it
+		flushBytes int
+		// failedAttempts counts the failed attempts to send the batch kept in the batcher for a retry, to tell
+		// the batches sent on their first attempt from those sent after retries
+		failedAttempts int
+		// mu guards isProcessing, which is cleared by the processing goroutine when it exits
+		mu           sync.Mutex
+		isProcessing bool
+		// finishMu guards finished, so that metrics are never sent on the closed metrics channel. In sync mode,
+		// it also guards the batcher.
+		finishMu sync.RWMutex
+		finished bool
+		// syncFlushOnly is true when metrics are batched by AddMetric, and only sent by FinishProcessing,
+		// without a processing goroutine
+		syncFlushOnly bool
 	}
 )
 
-// MakeProcessor creates a new metrics context
-func MakeProcessor(ctx context.Context, client Client, timeService TimeService, batchInterval time.Duration, shouldRetryOnFail bool, circuitBreakerInterval time.Duration, circuitBreakerTimeout time.Duration, circuitBreakerTotalFailures uint32) Processor {
-	batcher := MakeBatcher(batchInterval)
+// The outcomes of the delivery of a batch, as tagged in the telemetry
+const (
+	deliveryFirstTry = "first_try"
+	deliveryRetried  = "retried"
+	deliveryFailed   = "failed"
+)
+
+var (
+	errProcessorFinished  = errors.New("the metrics processor was finished")
+	errProcessorCancelled = errors.New("the context of the metrics processor was cancelled")
+)
+
+// makeProcessor creates a new metrics context configured by opts. Its counters are added to opts.stats, its
+// flushes are measured by opts.telemetry, which may be nil, and its batches are passed to the additional sinks once
+// sent.
+func makeProcessor(ctx context.Context, opts processorOptions) *processor {
+	batcher := MakeBatcher(opts.batchInterval)
+	// The rates of the first batch are summed from the start of the invocation
+	batcher.rateStart = opts.timeService.Now()
 
-	breaker := MakeCircuitBreaker(circuitBreakerInterval, circuitBreakerTimeout, circuitBreakerTotalFailures)
+	breaker := MakeCircuitBreaker(opts.circuitBreakerInterval, opts.circuitBreakerTimeout, opts.circuitBreakerTotalFailures)
 
-	return &processor{
-		context:           ctx,
-		metricsChan:       make(chan Metric, 2000),
-		batchInterval:     batchInterval,
-		waitGroup:         sync.WaitGroup{},
-		client:            client,
-		batcher:           batcher,
-		shouldRetryOnFail: shouldRetryOnFail,
-		timeService:       timeService,
-		isProcessing:      false,
-		breaker:           breaker,
+	p := &processor{
+		context:                 ctx,
+		batchInterval:           opts.batchInterval,
+		waitGroup:               sync.WaitGroup{},
+		client:                  opts.client,
+		batcher:                 batcher,
+		shouldRetryOnFail:       opts.shouldRetryOnFail,
+		timeService:             opts.timeService,
+		isProcessing:            false,
+		breaker:                 breaker,
+		stats:                   opts.stats,
+		telemetry:               opts.telemetry,
+		sinks:                   opts.sinks,
+		flushChan:               make(chan struct{}, 1),
+		thresholdChan:           make(chan struct{}, 1),
+		maxFlushDuration:        opts.maxFlushDuration,
+		rejectMissingTimestamps: opts.rejectMissingTimestamps,
+		spool:                   opts.spool,
+		syncFlushOnly:           opts.syncFlushOnly,
+	}
+	// Sync processors batch the metrics as they're added, so they have neither a buffer nor flushes of their own
+	if !opts.syncFlushOnly {
+		if opts.shards > 0 {
+			// Nothing is sent on the channel, which is only closed to finish the processing goroutine
+			p.metricsChan = make(chan Metric)
+			p.shards = make([]metricShard, opts.shards)
+			for i := range p.shards {
+				p.shards[i].batcher = MakeBatcher(opts.batchInterval)
+			}
+		} else {
+			p.metricsChan = make(chan Metric, 2000)
+			p.saturation = &saturation{start: opts.timeService.Now()}
+		}
+		if opts.adaptiveFlush {
+			p.adaptive = makeAdaptiveFlush(opts.batchInterval)
+			p.setFlushThreshold(adaptiveHighWaterMark)
+		}
+		p.setFlushThreshold(opts.flushThreshold)
+	}
+	if opts.aggregationBucket > 0 {
+		p.bucketWidth = opts.aggregationBucket
+		p.batcher.bucketWidth = opts.aggregationBucket
+		for i := range p.shards {
+			p.shards[i].batcher.bucketWidth = opts.aggregationBucket
+		}
 	}
+	if opts.maxFutureSkew > 0 {
+		p.maxFutureSkew = opts.maxFutureSkew
+		p.batcher.maxFutureSkew = opts.maxFutureSkew
+	}
+	if opts.maxRetries > 0 || opts.maxRetryDuration > 0 {
+		p.retryBudget = &retryBudget{maxRetries: opts.maxRetries, maxDuration: opts.maxRetryDuration}
+	}
+	return p
 }
 
 func MakeCircuitBreaker(circuitBreakerInterval time.Duration, circuitBreakerTimeout time.Duration, circuitBreakerTotalFailures uint32) *gobreaker.CircuitBreaker {
@@ -80,42 +250,176 @@ func MakeCircuitBreaker(circuitBreakerInterval time.Duration, circuitBreakerTime
 	return gobreaker.NewCircuitBreaker(st)
 }
 
-func (p *processor) AddMetric(metric Metric) {
+func (p *processor) AddMetric(metric Metric) error {
+	if err := p.fixMissingTimestamps(metric); err != nil {
+		return err
+	}
+	if p.syncFlushOnly {
+		return p.addMetricSync(metric)
+	}
+	p.finishMu.RLock()
+	defer p.finishMu.RUnlock()
+	if p.finished {
+		return errProcessorFinished
+	}
+	if p.context.Err() != nil {
+		return errProcessorCancelled
+	}
+	if len(p.shards) > 0 {
+		p.addMetricSharded(metric)
+		return nil
+	}
 	// We use a large buffer in the metrics channel, to make this operation non-blocking.
-	// However, if the channel does fill up, this will become a blocking operation.
-	p.metricsChan <- metric
+	// However, if the channel does fill up, this will become a blocking operation, until the
+	// context is cancelled and nothing reads from the channel anymore.
+	select {
+	case p.metricsChan <- metric:
+		if p.saturation != nil {
+			atomic.AddUint64(&p.saturation.added, pointCount(metric))
+		}
+		return nil
+	case <-p.context.Done():
+		return errProcessorCancelled
+	}
+}
+
+func (p *processor) addMetricSync(metric Metric) error {
+	p.finishMu.Lock()
+	defer p.finishMu.Unlock()
+	if p.finished {
+		return errProcessorFinished
+	}
+	if p.context.Err() != nil {
+		return errProcessorCancelled
+	}
+	p.addToBatch(metric)
+	return nil
 }
 
 func (p *processor) StartProcessing() {
-	if !p.isProcessing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.isProcessing && p.context.Err() == nil {
 		p.isProcessing = true
+		if p.syncFlushOnly {
+			return
+		}
 		p.waitGroup.Add(1)
 		go p.processMetrics()
 	}
-
 }
 
 func (p *processor) FinishProcessing() {
-	if !p.isProcessing {
-		p.StartProcessing()
+	if p.maxFlushDuration > 0 {
+		p.finishWithin(p.maxFlushDuration)
+		return
+	}
+	p.finish()
+}
+
+// finish sends the remaining metrics, and returns once they're sent or given up on
+func (p *processor) finish() {
+	if p.syncFlushOnly {
+		p.finishSync()
+		return
+	}
+	// Makes sure the remaining metrics are flushed, unless the context was cancelled
+	p.StartProcessing()
+	// Closes the metrics channel, and waits for the last send to complete. Finishing twice is a no-op.
+	p.finishMu.Lock()
+	if !p.finished {
+		p.finished = true
+		close(p.metricsChan)
 	}
-	// Closes the metrics channel, and waits for the last send to complete
-	close(p.metricsChan)
+	p.finishMu.Unlock()
 	p.waitGroup.Wait()
 }
 
+// finishSync sends the metrics batched since the processor started, unless its context was cancelled
+func (p *processor) finishSync() {
+	p.finishMu.Lock()
+	defer p.finishMu.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	if p.context.Err() == nil {
+		if p.spool != nil {
+			p.drainSpool()
+		}
+		p.sendBatch(true)
+	}
+	p.countUnsentPoints()
+
+	p.mu.Lock()
+	p.isProcessing = false
+	p.mu.Unlock()
+}
+
+func (p *processor) Flush() {
+	if p.syncFlushOnly {
+		// Without a processing goroutine, the batch is sent before returning
+		p.finishMu.Lock()
+		defer p.finishMu.Unlock()
+		if !p.finished && p.context.Err() == nil {
+			p.sendBatch(false)
+		}
+		return
+	}
+	select {
+	case p.flushChan <- struct{}{}:
+	default:
+		// A flush is already pending
+	}
+}
+
 func (p *processor) IsProcessing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.isProcessing
 }
 
+func (p *processor) Stats() Stats {
+	stats := p.stats.snapshot()
+	stats.ChannelHighWaterMark = p.channelHighWaterMark()
+	return stats
+}
+
 func (p *processor) processMetrics() {
 
-	ticker := p.timeService.NewTicker(p.batchInterval)
+	// The ticks are jittered when the time service supports it, in which case every tick has its own ticker
+	jitterer, jittered := p.timeService.(tickJitterer)
+	period := p.batchInterval
+	if jittered {
+		period = jitterer.tickPeriod(p.batchInterval, true)
+	}
+	// interval is the period of the ticks before jitter, which adaptive processors change after each flush
+	interval := p.batchInterval
+	ticker := p.timeService.NewTicker(period)
+	// Deferred so that the ticker and the wait group are released on every exit path
+	defer func() {
+		ticker.Stop()
+		p.drainShards()
+		p.countUnsentPoints()
+		p.mu.Lock()
+		p.isProcessing = false
+		p.mu.Unlock()
+		p.waitGroup.Done()
+	}()
+
+	if p.spool != nil {
+		p.drainSpool()
+	}
 
 	doneChan := p.context.Done()
 	shouldExit := false
 	for !shouldExit {
 		shouldSendBatch := false
+		ticked := false
+		// A flush at the threshold starts the ticks over, so that the next tick doesn't send a tiny batch
+		thresholdReached := false
+		// flushed is closed once the flush requested by flushAndWait is done
+		var flushed chan struct{}
 		// Batches metrics until timeout is reached
 		select {
 		case <-doneChan:
@@ -127,11 +431,32 @@ func (p *processor) processMetrics() {
 				shouldSendBatch = true
 				shouldExit = true
 			} else {
-				p.batcher.AddMetric(m)
+				p.addToBatch(m)
+				if p.saturation != nil {
+					p.sampleSaturation()
+				}
+				if p.threshold != nil && p.threshold.add(pointCount(m)) {
+					shouldSendBatch = true
+					thresholdReached = true
+				}
+			}
+		case <-p.flushChan:
+			// A flush was requested before the next tick, which keeps its schedule unless the flushes are adaptive
+			shouldSendBatch = true
+		case flushed = <-p.waitedFlushChan:
+			// The metrics added before the flush was requested are sent with it
+			p.drainChannel()
+			shouldSendBatch = true
+		case <-p.thresholdChan:
+			// The points which reached the threshold may have been sent by a tick since the flush was requested
+			if p.threshold.reached() {
+				shouldSendBatch = true
+				thresholdReached = true
 			}
 		case <-ticker.C:
 			// We are ready to send a batch to our backend
 			shouldSendBatch = true
+			ticked = true
 		}
 		// Since the go select statement picks randomly if multiple values are available, it's possible the done channel was
 		// closed, but another channel was selected instead. We double check the done channel, to make sure this isn't he case.
@@ -144,46 +469,191 @@ func (p *processor) processMetrics() {
 		}
 
 		if shouldSendBatch {
-			_, err := p.breaker.Execute(func() (interface{}, error) {
-				if shouldExit && p.shouldRetryOnFail {
-					// If we are shutting down, and we just failed to send our last batch, do a retry
-					bo := backoff.WithMaxRetries(backoff.NewConstantBackOff(defaultRetryInterval), 2)
-					err := backoff.Retry(p.sendMetricsBatch, bo)
-					if err != nil {
-						return nil, fmt.Errorf("after retry: %v", err)
-					}
-				} else {
-					err := p.sendMetricsBatch()
-					if err != nil {
-						return nil, fmt.Errorf("with no retry: %v", err)
-					}
+			p.drainShards()
+			if p.threshold != nil {
+				p.threshold.flushed()
+			}
+			// Every jittered tick has its own period, and adaptive processors may change the interval
+			restartTicker := (ticked && jittered) || thresholdReached
+			if p.adaptive != nil && !shouldExit {
+				if next := p.adaptive.flushed(p.batcher.PointCount(), ticked); next != interval {
+					interval = next
+					restartTicker = true
+				}
+			}
+			if restartTicker {
+				period = interval
+				if jittered {
+					period = jitterer.tickPeriod(interval, false)
 				}
-				return nil, nil
-			})
-			if err != nil {
-				logger.Error(fmt.Errorf("failed to flush metrics to datadog API: %v", err))
+				ticker.Stop()
+				ticker = p.timeService.NewTicker(period)
 			}
+			p.sendBatch(shouldExit)
+		}
+		if flushed != nil {
+			close(flushed)
 		}
 	}
-	ticker.Stop()
-	p.isProcessing = false
-	p.waitGroup.Done()
+}
+
+// sendBatch sends the current batch through the circuit breaker. The last batch is retried on failure when
+// retries are enabled. When telemetry is enabled, the measures of the previous flush are added to the batch, and
+// the measures of this one are kept for the next. They're only sent along other metrics, so that they never
+// cause a flush of their own.
+func (p *processor) sendBatch(isLast bool) {
+	// The rates are divided by the time which actually elapsed, which is shorter than the batch interval for
+	// early flushes, and longer for a batch kept for a retry
+	p.batcher.rateEnd = p.timeService.Now()
+	measured := p.telemetry != nil && len(p.batcher.metrics) > 0
+	var start time.Time
+	var retries uint64
+	if measured {
+		for _, m := range p.telemetry.drain() {
+			p.addToBatch(m)
+		}
+		start = p.timeService.Now()
+		retries = atomic.LoadUint64(&p.stats.Retries)
+		p.flushBytes = -1
+	}
+	var batch []APIMetric
+	if len(p.sinks) > 0 {
+		batch = p.batcher.ToAPIMetrics()
+	}
+
+	var err error
+	if p.retryBudget.exhausted() {
+		// The previous flushes spent the retries of the invocation, so the API is most likely unreachable
+		err = p.failFast()
+	} else {
+		_, err = p.breaker.Execute(func() (interface{}, error) {
+			if isLast && p.shouldRetryOnFail {
+				// If we are shutting down, and we just failed to send our last batch, do a retry
+				err := p.sendMetricsBatchWithRetry()
+				if err != nil {
+					return nil, fmt.Errorf("after retry: %v", err)
+				}
+			} else {
+				err := p.sendMetricsBatch()
+				if err != nil {
+					return nil, fmt.Errorf("with no retry: %v", err)
+				}
+			}
+			return nil, nil
+		})
+	}
+	if err != nil {
+		logger.ErrorWithFields(fmt.Errorf("failed to flush metrics to datadog API: %v", err), logger.Fields{
+			"retry_on_failure": p.shouldRetryOnFail,
+		})
+	}
+
+	if measured {
+		retries = atomic.LoadUint64(&p.stats.Retries) - retries
+		p.telemetry.recordFlush(start, p.timeService.Now().Sub(start), p.flushBytes, int(retries), err == nil)
+	}
+	// The sinks receive each batch once, when it leaves the batcher. A batch kept for a retry is passed when it
+	// leaves it, and the last batch is passed even if it couldn't be sent.
+	if len(batch) > 0 && (isLast || len(p.batcher.metrics) == 0) {
+		p.sendToSinks(batch)
+	}
+}
+
+// sendToSinks passes a batch to the additional sinks, in order. Their errors and panics are logged, so that
+// they never fail the flush nor prevent the next sinks from running.
+func (p *processor) sendToSinks(batch []APIMetric) {
+	for i, sink := range p.sinks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error(fmt.Errorf("additional metrics sink %d panicked: %v", i, r))
+				}
+			}()
+			if err := sink(p.context, batch); err != nil {
+				logger.Error(fmt.Errorf("additional metrics sink %d failed: %v", i, err))
+			}
+		}()
+	}
+}
+
+// sendMetricsBatchWithRetry sends the current batch, retrying after a constant interval when it fails, as long as
+// the retry budget of the invocation allows
+func (p *processor) sendMetricsBatchWithRetry() error {
+	err := p.sendMetricsBatch()
+	for retry := 0; err != nil && retry < defaultMaxRetries && !p.flushCapped() && !p.retryBudget.exhausted(); retry++ {
+		p.timeService.Sleep(defaultRetryInterval)
+		p.retryBudget.waited(defaultRetryInterval)
+		atomic.AddUint64(&p.stats.Retries, 1)
+		err = p.sendMetricsBatch()
+	}
+	return err
 }
 
 func (p *processor) sendMetricsBatch() error {
 	mts := p.batcher.ToAPIMetrics()
 	if len(mts) > 0 {
 		oldBatcher := p.batcher
-		p.batcher = MakeBatcher(p.batchInterval)
+		p.batcher = p.makeBatcher()
 
+		start := p.timeService.Now()
 		err := p.client.SendMetrics(mts)
+		if p.failedAttempts > 0 {
+			p.retryBudget.retried(p.timeService.Now().Sub(start))
+		}
+		if sizer, ok := p.client.(payloadSizer); ok {
+			p.flushBytes = sizer.lastPayloadSize()
+		}
 		if err != nil {
+			atomic.AddUint64(&p.stats.SendFailures, 1)
 			if p.shouldRetryOnFail {
 				// If we want to retry on error, keep the metrics in the batcher until they are sent correctly.
 				p.batcher = oldBatcher
+				p.failedAttempts++
+			} else {
+				p.recordDelivery(deliveryFailed)
+				p.spillOrDrop(mts)
 			}
 			return err
 		}
+		atomic.AddUint64(&p.stats.BatchesSent, 1)
+		if p.saturation != nil {
+			p.saturation.flushed += apiPointCount(mts)
+		}
+		if p.failedAttempts > 0 {
+			p.recordDelivery(deliveryRetried)
+		} else {
+			p.recordDelivery(deliveryFirstTry)
+		}
 	}
 	return nil
 }
+
+// recordDelivery counts the outcome of the delivery of the current batch, once it's sent or given up on
+func (p *processor) recordDelivery(delivery string) {
+	p.failedAttempts = 0
+	switch delivery {
+	case deliveryFirstTry:
+		atomic.AddUint64(&p.stats.Deliveries.FirstTry, 1)
+	case deliveryRetried:
+		atomic.AddUint64(&p.stats.Deliveries.Retried, 1)
+	case deliveryFailed:
+		atomic.AddUint64(&p.stats.Deliveries.Failed, 1)
+	}
+	p.telemetry.recordDelivery(p.timeService.Now(), delivery)
+}
+
+// countUnsentPoints counts the points left in the batcher when the processor exits as dropped. They're left
+// when the context was cancelled, or when the last batch couldn't be sent despite the retries or before the max
+// flush duration, in which case they're spilled when spilling is enabled.
+func (p *processor) countUnsentPoints() {
+	if len(p.batcher.metrics) == 0 {
+		return
+	}
+	mts := p.batcher.ToAPIMetrics()
+	if p.context.Err() != nil && !p.flushCapped() {
+		atomic.AddUint64(&p.stats.Drops.Cancelled, apiPointCount(mts))
+	} else {
+		p.recordDelivery(deliveryFailed)
+		p.spillOrDrop(mts)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardClient drops the batches it receives, so that benchmarks only measure the processor
+type discardClient struct{}
+
+func (c *discardClient) SendMetrics(mts []APIMetric) error {
+	return nil
+}
+
+// benchmarkInvocation runs the processor of a short invocation sending a few metrics
+func benchmarkInvocation(b *testing.B, opts processorOptions) {
+	client := &discardClient{}
+	timeService := MakeTimeService()
+	now := time.Now()
+	tags := []string{"env:prod", "service:orders"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pr := makeTestProcessor(context.Background(), client, timeService, opts)
+		pr.StartProcessing()
+		for j := 0; j < 5; j++ {
+			pr.AddMetric(&Distribution{Name: "orders.processed", Tags: tags, Values: []MetricValue{{Timestamp: now, Value: 1}}})
+		}
+		pr.FinishProcessing()
+	}
+}
+
+func BenchmarkProcessorInvocationAsync(b *testing.B) {
+	benchmarkInvocation(b, processorOptions{batchInterval: defaultBatchInterval})
+}
+
+func BenchmarkProcessorInvocationSyncFlushOnly(b *testing.B) {
+	benchmarkInvocation(b, processorOptions{batchInterval: defaultBatchInterval, syncFlushOnly: true})
+}
+
+// benchmarkConcurrentAdds measures 64 goroutines adding 10k points each to the processor of an invocation
+func benchmarkConcurrentAdds(b *testing.B, opts processorOptions) {
+	client := &discardClient{}
+	timeService := MakeTimeService()
+	now := time.Now()
+	tags := []string{"env:prod", "service:orders"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pr := makeTestProcessor(context.Background(), client, timeService, opts)
+		pr.StartProcessing()
+		var wg sync.WaitGroup
+		for g := 0; g < 64; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10000; j++ {
+					pr.AddMetric(&Distribution{Name: "orders.processed", Tags: tags, Values: []MetricValue{{Timestamp: now, Value: 1}}})
+				}
+			}()
+		}
+		wg.Wait()
+		pr.FinishProcessing()
+	}
+}
+
+func BenchmarkProcessorConcurrentAddsChannel(b *testing.B) {
+	benchmarkConcurrentAdds(b, processorOptions{batchInterval: defaultBatchInterval})
+}
+
+func BenchmarkProcessorConcurrentAddsSharded(b *testing.B) {
+	benchmarkConcurrentAdds(b, processorOptions{batchInterval: defaultBatchInterval, shards: 64})
+}
@@ -10,12 +10,17 @@ package metrics
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"math"
+	"math/rand"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
 )
 
 type (
@@ -26,8 +31,14 @@ type (
 	}
 
 	mockTimeService struct {
-		now        time.Time
-		tickerChan chan time.Time
+		// nowMu guards now, which the tests change while the processing goroutine reads it
+		nowMu         *sync.Mutex
+		now           time.Time
+		tickerChan    chan time.Time
+		sleeps        []time.Duration
+		tickerPeriods []time.Duration
+		// afterChan, when set, is returned by After instead of a channel of the wall clock
+		afterChan chan time.Time
 	}
 )
 
@@ -40,27 +51,97 @@ func makeMockClient() mockClient {
 
 func makeMockTimeService() mockTimeService {
 	return mockTimeService{
+		nowMu:      &sync.Mutex{},
 		now:        time.Now(),
 		tickerChan: make(chan time.Time),
 	}
 }
 
+// makeTestProcessor makes a processor sending to client on the clock of ts, configured by opts. The options left
+// to their zero value default to a batch interval of a second, a circuit breaker which never opens, and stats of
+// their own.
+func makeTestProcessor(ctx context.Context, client Client, ts TimeService, opts processorOptions) *processor {
+	opts.client = client
+	opts.timeService = ts
+	if opts.batchInterval == 0 {
+		opts.batchInterval = time.Second
+	}
+	if opts.circuitBreakerTotalFailures == 0 {
+		opts.circuitBreakerTotalFailures = math.MaxUint32
+	}
+	opts.circuitBreakerInterval = time.Hour * 1000
+	opts.circuitBreakerTimeout = time.Hour * 1000
+	if opts.stats == nil {
+		opts.stats = &Stats{}
+	}
+	return makeProcessor(ctx, opts)
+}
+
 func (mc *mockClient) SendMetrics(mts []APIMetric) error {
 	mc.sendMetricsCalledCount++
+	// Read before sending the batch, as the test may change it once the batch is received
+	err := mc.err
 	mc.batches <- mts
-	return mc.err
+	return err
 }
 
 func (ts *mockTimeService) NewTicker(duration time.Duration) *time.Ticker {
+	ts.tickerPeriods = append(ts.tickerPeriods, duration)
 	return &time.Ticker{
 		C: ts.tickerChan,
 	}
 }
 
 func (ts *mockTimeService) Now() time.Time {
+	ts.nowMu.Lock()
+	defer ts.nowMu.Unlock()
 	return ts.now
 }
 
+func (ts *mockTimeService) setNow(now time.Time) {
+	ts.nowMu.Lock()
+	defer ts.nowMu.Unlock()
+	ts.now = now
+}
+
+func (ts *mockTimeService) Sleep(duration time.Duration) {
+	ts.sleeps = append(ts.sleeps, duration)
+}
+
+func (ts *mockTimeService) After(duration time.Duration) <-chan time.Time {
+	if ts.afterChan != nil {
+		return ts.afterChan
+	}
+	return time.After(duration)
+}
+
+// waitUntilMetricsReceived returns once the processing goroutine has received every metric added so far. As
+// each metric is batched before the goroutine selects again, a tick sent afterwards flushes all of them.
+func waitUntilMetricsReceived(pr Processor) {
+	for len(pr.(*processor).metricsChan) > 0 {
+		runtime.Gosched()
+	}
+}
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestNoProcessorRunsBetweenInvocationsWithExtension(t *testing.T) {
+	listener, _, _, closeExtension := makeFakeExtensionListener(t, Config{AsyncFlushWithExtension: true})
+	defer closeExtension()
+	// The DogStatsD client runs for the life of the container
+	running := goleak.IgnoreCurrent()
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	// Nothing the invocation started runs while the sandbox is frozen
+	goleak.VerifyNone(t, running)
+	assert.Nil(t, listener.processor)
+}
+
 func TestProcessorBatches(t *testing.T) {
 	mc := makeMockClient()
 	mts := makeMockTimeService()
@@ -68,7 +149,7 @@ func TestProcessorBatches(t *testing.T) {
 	mts.now, _ = time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 	nowUnix := float64(mts.now.Unix())
 
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, false, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	processor := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000})
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -112,9 +193,9 @@ func TestProcessorBatchesPerTick(t *testing.T) {
 	firstTimeUnix := float64(firstTime.Unix())
 	secondTime, _ := time.Parse(time.RFC3339, "2007-01-02T15:04:05Z")
 	secondTimeUnix := float64(secondTime.Unix())
-	mts.now = firstTime
+	mts.setNow(firstTime)
 
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, false, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	processor := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000})
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -142,12 +223,11 @@ func TestProcessorBatchesPerTick(t *testing.T) {
 	processor.AddMetric(&d1)
 	processor.AddMetric(&d2)
 
-	// This wait is necessary to make sure both metrics have been added to the batch
-	<-time.Tick(time.Millisecond * 10)
+	waitUntilMetricsReceived(processor)
 	// Sending time to the ticker channel will flush the batch.
 	mts.tickerChan <- firstTime
 	firstBatch := <-mc.batches
-	mts.now = secondTime
+	mts.setNow(secondTime)
 
 	processor.AddMetric(&d3)
 	processor.AddMetric(&d4)
@@ -189,7 +269,7 @@ func TestProcessorPerformsRetry(t *testing.T) {
 	mts.now, _ = time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 
 	shouldRetry := true
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, shouldRetry, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	processor := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000, shouldRetryOnFail: shouldRetry})
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -204,6 +284,14 @@ func TestProcessorPerformsRetry(t *testing.T) {
 	processor.FinishProcessing()
 
 	assert.Equal(t, 3, mc.sendMetricsCalledCount)
+	assert.Equal(t, []time.Duration{defaultRetryInterval, defaultRetryInterval}, mts.sleeps)
+	assert.Equal(t, Stats{
+		PointsBuffered: 3,
+		SendFailures:   3,
+		Retries:        2,
+		Deliveries:     DeliveryStats{Failed: 1},
+		Drops:          DropStats{SendFailed: 3},
+	}, processor.Stats())
 }
 
 func TestProcessorCancelsWithContext(t *testing.T) {
@@ -214,7 +302,7 @@ func TestProcessorCancelsWithContext(t *testing.T) {
 
 	shouldRetry := true
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	processor := MakeProcessor(ctx, &mc, &mts, 1000, shouldRetry, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	processor := makeTestProcessor(ctx, &mc, &mts, processorOptions{batchInterval: 1000, shouldRetryOnFail: shouldRetry})
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -225,11 +313,149 @@ func TestProcessorCancelsWithContext(t *testing.T) {
 	processor.AddMetric(&d1)
 	// After calling cancelFunc, no metrics should be processed/sent
 	cancelFunc()
-	//<-time.Tick(time.Millisecond * 100)
 
 	processor.FinishProcessing()
 
 	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+	assert.Equal(t, uint64(0), processor.Stats().BatchesSent)
+}
+
+func TestProcessorStatsCountsCancelledPoints(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	stats := &Stats{}
+	pr := makeTestProcessor(ctx, &mc, &mts, processorOptions{batchInterval: 1000, stats: stats})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}, {Timestamp: mts.now, Value: 2}}})
+	waitUntilMetricsReceived(pr)
+
+	cancelFunc()
+	pr.FinishProcessing()
+
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+	assert.Equal(t, Stats{PointsBuffered: 2, Drops: DropStats{Cancelled: 2}}, *stats)
+}
+
+func TestProcessorStatsCountsBatches(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	stats := &Stats{}
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000, stats: stats})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	waitUntilMetricsReceived(pr)
+	mts.tickerChan <- mts.now
+	<-mc.batches
+
+	mc.err = errors.New("Some error")
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	pr.FinishProcessing()
+
+	assert.Equal(t, Stats{
+		PointsBuffered: 2,
+		BatchesSent:    1,
+		SendFailures:   1,
+		Deliveries:     DeliveryStats{FirstTry: 1, Failed: 1},
+		Drops:          DropStats{SendFailed: 1},
+	}, pr.Stats())
+}
+
+func TestProcessorStatsCountsRetriedDeliveries(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	telemetry := MakeTelemetry()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000, shouldRetryOnFail: true, telemetry: telemetry})
+	pr.StartProcessing()
+	mc.err = errors.New("Some error")
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	waitUntilMetricsReceived(pr)
+	mts.tickerChan <- mts.now
+	<-mc.batches
+
+	// The batch kept for a retry is sent by the next flush
+	mc.err = nil
+	mts.tickerChan <- mts.now
+	<-mc.batches
+	pr.FinishProcessing()
+
+	stats := pr.Stats()
+	assert.Equal(t, uint64(1), stats.SendFailures)
+	assert.Equal(t, DeliveryStats{Retried: 1}, stats.Deliveries)
+	deliveries := []string{}
+	for _, d := range telemetry.drain() {
+		if d.Name == flushBatchesMetric {
+			deliveries = append(deliveries, d.Tags[0])
+		}
+	}
+	assert.Equal(t, []string{"delivery:retried"}, deliveries)
+}
+
+func TestProcessorExitsOnCancelWhileProcessing(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	pr := makeTestProcessor(ctx, &mc, &mts, processorOptions{batchInterval: 1000})
+	pr.StartProcessing()
+	assert.True(t, pr.IsProcessing())
+
+	cancelFunc()
+	pr.waitGroup.Wait()
+	assert.False(t, pr.IsProcessing())
+
+	// Finishing after the goroutine exited doesn't start it again, or hang
+	pr.FinishProcessing()
+	pr.FinishProcessing()
+	assert.False(t, pr.IsProcessing())
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+}
+
+func TestProcessorAddMetricDoesntBlockAfterCancel(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	pr := makeTestProcessor(ctx, &mc, &mts, processorOptions{batchInterval: 1000})
+
+	d1 := Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}}
+	// Fills the channel, so that the next metric blocks, as nothing is processing it
+	for i := 0; i < cap(pr.metricsChan); i++ {
+		pr.AddMetric(&d1)
+	}
+	added := make(chan struct{})
+	var err error
+	go func() {
+		err = pr.AddMetric(&d1)
+		close(added)
+	}()
+
+	cancelFunc()
+	<-added
+	assert.Equal(t, errProcessorCancelled, err)
+	assert.Equal(t, errProcessorCancelled, pr.AddMetric(&d1))
+	pr.FinishProcessing()
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+}
+
+func TestProcessorFinishProcessingTwice(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+
+	pr.FinishProcessing()
+	pr.FinishProcessing()
+
+	assert.False(t, pr.IsProcessing())
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	// Adding a metric after finishing doesn't panic on the closed channel
+	assert.Equal(t, errProcessorFinished, pr.AddMetric(&Distribution{Name: "metric-2"}))
 }
 
 func TestProcessorBatchesWithOpeningCircuitBreaker(t *testing.T) {
@@ -240,7 +466,7 @@ func TestProcessorBatchesWithOpeningCircuitBreaker(t *testing.T) {
 
 	// Will open the circuit breaker at number of total failures > 1
 	circuitBreakerTotalFailures := uint32(1)
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, false, time.Hour*1000, time.Hour*1000, circuitBreakerTotalFailures)
+	processor := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000, circuitBreakerTotalFailures: circuitBreakerTotalFailures})
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -257,3 +483,231 @@ func TestProcessorBatchesWithOpeningCircuitBreaker(t *testing.T) {
 	// It should have retried 3 times, but circuit breaker opened at the second time
 	assert.Equal(t, 1, mc.sendMetricsCalledCount)
 }
+
+func TestSyncProcessorSendsOnFinish(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	mts.now, _ = time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
+	nowUnix := float64(mts.now.Unix())
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000})
+	pr.StartProcessing()
+	assert.True(t, pr.IsProcessing())
+	assert.Nil(t, pr.metricsChan)
+
+	pr.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a"}, Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a"}, Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+
+	pr.FinishProcessing()
+	pr.FinishProcessing()
+
+	assert.False(t, pr.IsProcessing())
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	assert.Equal(t, []APIMetric{{
+		Name:       "metric-1",
+		Tags:       []string{"a"},
+		MetricType: DistributionType,
+		Points: []interface{}{
+			[]interface{}{nowUnix, []interface{}{float64(1)}},
+			[]interface{}{nowUnix, []interface{}{float64(2)}},
+		},
+	}}, <-mc.batches)
+	assert.Equal(t, errProcessorFinished, pr.AddMetric(&Distribution{Name: "metric-2"}))
+	assert.Equal(t, Stats{PointsBuffered: 2, BatchesSent: 1, Deliveries: DeliveryStats{FirstTry: 1}}, pr.Stats())
+}
+
+func TestProcessorFlushesBeforeTick(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	waitUntilMetricsReceived(pr)
+
+	// No tick is sent, so the batch is only sent because of the flush
+	pr.Flush()
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+
+	pr.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	pr.FinishProcessing()
+	assert.Equal(t, "metric-2", (<-mc.batches)[0].Name)
+	assert.Equal(t, uint64(2), pr.Stats().BatchesSent)
+}
+
+func TestSyncProcessorFlushes(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.Flush()
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+
+	// Once finished, there's nothing left to flush
+	pr.FinishProcessing()
+	pr.Flush()
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+}
+
+func TestSyncProcessorPerformsRetry(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	mc.err = errors.New("Some error")
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: true})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.FinishProcessing()
+
+	assert.Equal(t, 3, mc.sendMetricsCalledCount)
+	assert.Equal(t, []time.Duration{defaultRetryInterval, defaultRetryInterval}, mts.sleeps)
+	assert.Equal(t, DropStats{SendFailed: 1}, pr.Stats().Drops)
+}
+
+func TestSyncProcessorCancelsWithContext(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	pr := makeTestProcessor(ctx, &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+
+	cancelFunc()
+	assert.Equal(t, errProcessorCancelled, pr.AddMetric(&Distribution{Name: "metric-1"}))
+	pr.FinishProcessing()
+
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+	assert.Equal(t, DropStats{Cancelled: 1}, pr.Stats().Drops)
+}
+
+func TestProcessorSendsToSinksInOrder(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	calls := []string{}
+	var received []APIMetric
+	sinks := []BatchSink{
+		func(ctx context.Context, batch []APIMetric) error {
+			calls = append(calls, "failing")
+			return errors.New("firehose unavailable")
+		},
+		func(ctx context.Context, batch []APIMetric) error {
+			calls = append(calls, "panicking")
+			panic("boom")
+		},
+		func(ctx context.Context, batch []APIMetric) error {
+			calls = append(calls, "recording")
+			received = batch
+			return nil
+		},
+	}
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, sinks: sinks})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.FinishProcessing()
+
+	assert.Equal(t, []string{"failing", "panicking", "recording"}, calls)
+	assert.Equal(t, <-mc.batches, received)
+	// The errors of the sinks don't fail the flush
+	assert.Equal(t, Stats{PointsBuffered: 1, BatchesSent: 1, Deliveries: DeliveryStats{FirstTry: 1}}, pr.Stats())
+}
+
+func TestProcessorSendsToSinksWhenSendFails(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("Some error")
+	mts := makeMockTimeService()
+	calls := 0
+	sink := func(ctx context.Context, batch []APIMetric) error {
+		calls++
+		assert.Len(t, batch, 1)
+		return nil
+	}
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, sinks: []BatchSink{sink}})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.FinishProcessing()
+
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	assert.Equal(t, 1, calls)
+}
+
+func TestProcessorSendsRetriedBatchToSinksOnce(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("Some error")
+	mts := makeMockTimeService()
+	batches := make(chan []APIMetric, 10)
+	sink := func(ctx context.Context, batch []APIMetric) error {
+		batches <- batch
+		return nil
+	}
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: 1000, shouldRetryOnFail: true, sinks: []BatchSink{sink}})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	waitUntilMetricsReceived(pr)
+
+	// The failed batch is kept for the next flush, without being passed to the sinks
+	mts.tickerChan <- mts.now
+	<-mc.batches
+	mc.err = nil
+	mts.tickerChan <- mts.now
+	sent := <-mc.batches
+	pr.FinishProcessing()
+
+	assert.Equal(t, sent, <-batches)
+	assert.Empty(t, batches)
+}
+
+func TestJitteredTimeServiceTickPeriods(t *testing.T) {
+	mts := makeMockTimeService()
+	ts := MakeJitteredTimeService(&mts, rand.New(rand.NewSource(1))).(tickJitterer)
+	phase := rand.New(rand.NewSource(1)).Float64()
+
+	// The delay before the first tick is drawn once per container
+	first := ts.tickPeriod(time.Second, true)
+	assert.Equal(t, time.Duration((1-phase)*float64(time.Second)), first)
+	assert.Equal(t, first, ts.tickPeriod(time.Second, true))
+
+	for i := 0; i < 100; i++ {
+		period := ts.tickPeriod(time.Second, false)
+		assert.True(t, period >= 900*time.Millisecond && period <= 1100*time.Millisecond, "period %v", period)
+	}
+}
+
+func TestProcessorJittersTicks(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	ts := MakeJitteredTimeService(&mts, rand.New(rand.NewSource(1)))
+
+	pr := makeTestProcessor(context.Background(), &mc, ts, processorOptions{})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	waitUntilMetricsReceived(pr)
+	mts.tickerChan <- mts.now
+	<-mc.batches
+	pr.FinishProcessing()
+
+	// Each tick has its own ticker, with a jittered period
+	assert.Len(t, mts.tickerPeriods, 2)
+	assert.Equal(t, ts.(tickJitterer).tickPeriod(time.Second, true), mts.tickerPeriods[0])
+	assert.NotEqual(t, time.Second, mts.tickerPeriods[1])
+	assert.InDelta(t, float64(time.Second), float64(mts.tickerPeriods[1]), 0.1*float64(time.Second))
+}
+
+func TestProcessorTicksWithoutJitter(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{})
+	pr.StartProcessing()
+	mts.tickerChan <- mts.now
+	pr.FinishProcessing()
+
+	assert.Equal(t, []time.Duration{time.Second}, mts.tickerPeriods)
+}
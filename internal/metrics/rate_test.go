@@ -0,0 +1,135 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rateAPIMetric(name string, timestamp time.Time, value float64, interval float64) APIMetric {
+	return APIMetric{
+		Name:       name,
+		MetricType: RateType,
+		Interval:   &interval,
+		Points:     []interface{}{[]interface{}{float64(timestamp.Unix()), value}},
+	}
+}
+
+func TestRateToAPIMetric(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	r := Rate{Name: "requests"}
+	r.AddPoint(now.Add(time.Second), 4)
+	r.AddPoint(now, 6)
+
+	// Without a window, the sum is sent per second at the time of the first value
+	assert.Equal(t, []APIMetric{rateAPIMetric("requests", now, 10, 1)}, r.ToAPIMetric(0))
+
+	r.window = rateWindow{start: now, width: 4 * time.Second}
+	assert.Equal(t, []APIMetric{rateAPIMetric("requests", now, 2.5, 4)}, r.ToAPIMetric(0))
+}
+
+func TestBatcherJoinsRates(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10 * time.Second)
+	batcher.rateStart = start
+	batcher.rateEnd = start.Add(5 * time.Second)
+
+	batcher.AddMetric(&Rate{Name: "requests", Tags: []string{"a"}, Timestamp: start, Value: 10})
+	batcher.AddMetric(&Rate{Name: "requests", Tags: []string{"a"}, Timestamp: start.Add(3 * time.Second), Value: 5})
+	batcher.AddMetric(&Rate{Name: "requests", Tags: []string{"b"}, Timestamp: start, Value: 1})
+
+	batch := batcher.ToAPIMetrics()
+	assert.Len(t, batch, 2)
+	assert.Equal(t, []interface{}{[]interface{}{float64(start.Unix()), float64(3)}}, batch[0].Points)
+	assert.Equal(t, 5.0, *batch[0].Interval)
+	assert.Equal(t, []interface{}{[]interface{}{float64(start.Unix()), 0.2}}, batch[1].Points)
+}
+
+func TestRatesAreDividedByTheElapsedTime(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	start := time.Unix(1600000000, 0)
+	mts.setNow(start)
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 10 * time.Second})
+	pr.StartProcessing()
+
+	// The first flush divides by the time since the processor started, and the early flush by less than the
+	// batch interval
+	pr.AddMetric(&Rate{Name: "requests", Timestamp: start, Value: 12})
+	pr.AddMetric(&Rate{Name: "requests", Timestamp: start.Add(time.Second), Value: 8})
+	mts.setNow(start.Add(4 * time.Second))
+	pr.Flush()
+	assert.Equal(t, []APIMetric{rateAPIMetric("requests", start, 5, 4)}, <-mc.batches)
+
+	// The next batch starts at the previous flush
+	pr.AddMetric(&Rate{Name: "requests", Timestamp: start.Add(5 * time.Second), Value: 6})
+	mts.setNow(start.Add(7 * time.Second))
+	pr.FinishProcessing()
+	assert.Equal(t, []APIMetric{rateAPIMetric("requests", start.Add(4*time.Second), 2, 3)}, <-mc.batches)
+}
+
+func TestRatesOverLessThanASecond(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10 * time.Second)
+	batcher.rateStart = start
+	batcher.rateEnd = start.Add(200 * time.Millisecond)
+	batcher.AddMetric(&Rate{Name: "requests", Timestamp: start, Value: 3})
+
+	assert.Equal(t, []APIMetric{rateAPIMetric("requests", start, 3, 1)}, batcher.ToAPIMetrics())
+}
+
+func TestRatesWithoutElapsedTimeUseTheBatchInterval(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	start := time.Unix(1600000000, 0)
+	mts.setNow(start)
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 10 * time.Second})
+	pr.StartProcessing()
+
+	pr.AddMetric(&Rate{Name: "requests", Timestamp: start, Value: 20})
+	pr.FinishProcessing()
+
+	assert.Equal(t, []APIMetric{rateAPIMetric("requests", start, 2, 10)}, <-mc.batches)
+}
+
+func TestAddRateMetric(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: &mc, TimeService: &mts, DisableFlushJitter: true, SyncFlushOnly: true})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.NoError(t, ml.AddRateMetric("requests", 3, mts.now, "route:/orders"))
+	assert.True(t, errors.Is(ml.AddRateMetric("requests", math.NaN(), mts.now), ErrInvalidMetric))
+	ml.HandlerFinished(ctx, nil, nil)
+
+	var rate *APIMetric
+	for _, m := range <-mc.batches {
+		if m.Name == "requests" {
+			m := m
+			rate = &m
+		}
+	}
+	if assert.NotNil(t, rate) {
+		assert.Equal(t, RateType, rate.MetricType)
+		assert.Contains(t, rate.Tags, "route:/orders")
+	}
+}
+
+func TestAddRateMetricWithLogForwarder(t *testing.T) {
+	ml := MakeListener(Config{ShouldUseLogForwarder: true})
+	err := ml.AddRateMetric("requests", 1, time.Now())
+	assert.True(t, errors.Is(err, ErrMetricsDisabled))
+}
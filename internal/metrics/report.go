@@ -0,0 +1,68 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
+)
+
+// estimateTag tags the enhanced metrics which approximate the REPORT line of an invocation, so that they aren't
+// mistaken for the durations and memory reported by Lambda to CloudWatch
+const estimateTag = "estimate:true"
+
+var (
+	// initDurationMeasured is set once the init duration was measured, so that it's reported once per container
+	// even when several handlers are wrapped
+	initDurationMeasured int32
+	// initDurationKey is the key used to store the init duration of the cold start invocation in a Context object
+	initDurationKey = new(contextKeytype)
+)
+
+// measureInitDuration stores the time from the init of the package to the start of the cold start invocation in
+// ctx, to report it when the invocation finishes
+func measureInitDuration(ctx context.Context) context.Context {
+	if coldStart, _ := ctx.Value("cold_start").(bool); !coldStart {
+		return ctx
+	}
+	if !atomic.CompareAndSwapInt32(&initDurationMeasured, 0, 1) {
+		return ctx
+	}
+	return context.WithValue(ctx, initDurationKey, time.Since(initphase.PackageInitTime()))
+}
+
+// submitReportEstimates sends estimates of the billed duration, the peak memory used, in MB, and the init
+// duration of the cold start invocation, as found in the REPORT line which can't be read from the function.
+// peakMemory is 0 when the memory isn't sampled.
+func (l *Listener) submitReportEstimates(ctx context.Context, peakMemory uint64) {
+	if start, end, ok := wrapper.GetHandlerTiming(ctx); ok {
+		// Lambda bills the duration rounded up to the millisecond
+		l.submitEnhancedMetric("billed_duration", math.Ceil(milliseconds(end.Sub(start))), ctx, estimateTag)
+	}
+	if peakMemory > 0 {
+		l.submitEnhancedMetric("max_memory_used", math.Ceil(float64(peakMemory)/(1024*1024)), ctx, estimateTag)
+	}
+	if initDuration, ok := ctx.Value(initDurationKey).(time.Duration); ok {
+		l.submitEnhancedMetric("init_duration", milliseconds(initDuration), ctx, estimateTag)
+	}
+}
+
+// submitInitPhases sends the duration of each phase of the init marked with MarkInitPhase, in milliseconds, tagged
+// with the name of the phase, on the invocation which ended the init. The time from the last phase marked to the
+// invocation is tagged phase:unmarked. Nothing is sent when no phase was marked.
+func (l *Listener) submitInitPhases(ctx context.Context) {
+	for _, phase := range initphase.FromContext(ctx) {
+		l.submitEnhancedMetric("init_phase_duration", milliseconds(phase.End.Sub(phase.Start)), ctx, "phase:"+phase.Name)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// invokeForReportEstimates runs one invocation of handler, and returns the report estimates it sent by name
+func invokeForReportEstimates(handler func(context.Context, json.RawMessage) (interface{}, error)) map[string]logMetric {
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"}
+	output := captureOutput(func() {
+		handler(lambdacontext.NewContext(context.Background(), lc), nil)
+	})
+	estimates := map[string]logMetric{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var lm logMetric
+		json.Unmarshal([]byte(line), &lm)
+		for _, tag := range lm.Tags {
+			if tag == estimateTag {
+				estimates[strings.TrimPrefix(lm.MetricName, "aws.lambda.enhanced.")] = lm
+			}
+		}
+	}
+	return estimates
+}
+
+func TestSubmitReportEstimates(t *testing.T) {
+	atomic.StoreInt32(&initDurationMeasured, 0)
+	defer atomic.StoreInt32(&initDurationMeasured, 1)
+
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, EnhancedMetrics: true})
+	ml.memorySampler = makeMemorySampler(time.Millisecond, 1, 128*1024*1024, func() uint64 { return 50*1024*1024 + 1 })
+	handler := wrapper.WrapHandlerWithListeners(func(ctx context.Context) error {
+		time.Sleep(2 * time.Millisecond)
+		return nil
+	}, &ml).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	estimates := invokeForReportEstimates(handler)
+	assert.GreaterOrEqual(t, estimates["billed_duration"].Value, float64(2))
+	// The durations are billed by the millisecond
+	assert.Equal(t, float64(int64(estimates["billed_duration"].Value)), estimates["billed_duration"].Value)
+	assert.Equal(t, float64(51), estimates["max_memory_used"].Value)
+	assert.Greater(t, estimates["init_duration"].Value, float64(0))
+	assert.Contains(t, estimates["init_duration"].Tags, "cold_start:true")
+
+	// The init duration is only reported by the cold start invocation
+	estimates = invokeForReportEstimates(handler)
+	assert.Contains(t, estimates, "billed_duration")
+	assert.Contains(t, estimates, "max_memory_used")
+	assert.NotContains(t, estimates, "init_duration")
+}
+
+func TestSubmitReportEstimatesWithoutMemorySampler(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, EnhancedMetrics: true})
+	handler := wrapper.WrapHandlerWithListeners(func(ctx context.Context) error {
+		return nil
+	}, &ml).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	estimates := invokeForReportEstimates(handler)
+	assert.Contains(t, estimates, "billed_duration")
+	assert.NotContains(t, estimates, "max_memory_used")
+}
+
+func TestMeasureInitDurationOncePerContainer(t *testing.T) {
+	atomic.StoreInt32(&initDurationMeasured, 0)
+	defer atomic.StoreInt32(&initDurationMeasured, 1)
+
+	warm := measureInitDuration(context.WithValue(context.Background(), "cold_start", false))
+	assert.Nil(t, warm.Value(initDurationKey))
+
+	// Handlers wrapped separately each have a cold start, but the container has a single init
+	cold := context.WithValue(context.Background(), "cold_start", true)
+	assert.NotNil(t, measureInitDuration(cold).Value(initDurationKey))
+	assert.Nil(t, measureInitDuration(cold).Value(initDurationKey))
+}
+
+func TestSubmitInitPhases(t *testing.T) {
+	// The invocations of the previous tests ended the init
+	initphase.Reset()
+	defer initphase.Reset()
+	start := initphase.PackageInitTime()
+	initphase.Mark("config", start.Add(time.Millisecond))
+	initphase.Mark("db_connect", start.Add(3*time.Millisecond))
+
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, EnhancedMetrics: true})
+	handler := wrapper.WrapHandlerWithListeners(func(ctx context.Context) error {
+		// The first invocation started, so this phase is ignored
+		initphase.Mark("late", time.Now())
+		return nil
+	}, &ml).(func(context.Context, json.RawMessage) (interface{}, error))
+	invoke := func() map[string]float64 {
+		output := captureOutput(func() {
+			handler(context.Background(), nil)
+		})
+		phases := map[string]float64{}
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			var lm logMetric
+			json.Unmarshal([]byte(line), &lm)
+			if lm.MetricName != "aws.lambda.enhanced.init_phase_duration" {
+				continue
+			}
+			for _, tag := range lm.Tags {
+				if strings.HasPrefix(tag, "phase:") {
+					phases[strings.TrimPrefix(tag, "phase:")] = lm.Value
+				}
+			}
+		}
+		return phases
+	}
+
+	phases := invoke()
+	assert.Len(t, phases, 3)
+	assert.Equal(t, float64(1), phases["config"])
+	assert.Equal(t, float64(2), phases["db_connect"])
+	assert.Contains(t, phases, initphase.UnmarkedPhase)
+
+	// The phases are only reported by the cold start invocation
+	assert.Empty(t, invoke())
+}
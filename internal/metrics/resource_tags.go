@@ -0,0 +1,120 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+type (
+	// TagFetcher fetches the tags of a Lambda function, given its unqualified ARN
+	TagFetcher interface {
+		FetchTags(ctx context.Context, functionARN string) (map[string]string, error)
+	}
+
+	lambdaTagFetcher struct {
+		client lambdaiface.LambdaAPI
+	}
+
+	// resourceTags fetches the tags of the function once per container, on its first invocation, as the ARN of
+	// the function is only known from the context of an invocation
+	resourceTags struct {
+		once    sync.Once
+		fetcher TagFetcher
+		keys    []string
+		tags    []string
+	}
+)
+
+// resourceTagsKey is the key of the resource tags added to the enhanced metrics of an invocation
+var resourceTagsKey = new(contextKeytype)
+
+// MakeLambdaTagFetcher creates a TagFetcher which calls lambda:ListTags
+func MakeLambdaTagFetcher() TagFetcher {
+	return &lambdaTagFetcher{
+		client: lambda.New(session.New(nil)),
+	}
+}
+
+func (f *lambdaTagFetcher) FetchTags(ctx context.Context, functionARN string) (map[string]string, error) {
+	output, err := f.client.ListTagsWithContext(ctx, &lambda.ListTagsInput{Resource: aws.String(functionARN)})
+	if err != nil {
+		return nil, err
+	}
+	return aws.StringValueMap(output.Tags), nil
+}
+
+func makeResourceTags(fetcher TagFetcher, keys []string) *resourceTags {
+	if fetcher == nil {
+		fetcher = MakeLambdaTagFetcher()
+	}
+	return &resourceTags{fetcher: fetcher, keys: keys}
+}
+
+// get returns the resource tags of the function, fetching them on the first call. Failures, such as a missing IAM
+// permission, are only logged in debug, and leave the enhanced metrics without resource tags.
+func (r *resourceTags) get(ctx context.Context) []string {
+	r.once.Do(func() {
+		lc, ok := lambdacontext.FromContext(ctx)
+		if !ok {
+			logger.Debug("the resource tags aren't fetched, as the ARN of the function is unknown")
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, resourceTagsTimeout)
+		defer cancel()
+		tags, err := r.fetcher.FetchTags(ctx, unqualifiedARN(lc.InvokedFunctionArn))
+		if err != nil {
+			logger.Debug(fmt.Sprintf("couldn't fetch the resource tags of the function, the enhanced metrics are sent without them: %v", err))
+			return
+		}
+		r.tags = selectResourceTags(tags, r.keys)
+	})
+	return r.tags
+}
+
+// selectResourceTags formats the tags whose keys are in the allow-list, sorted by key. Without an allow-list,
+// every tag is selected, except the ones AWS adds, prefixed with aws:.
+func selectResourceTags(tags map[string]string, keys []string) []string {
+	selected := []string{}
+	if len(keys) > 0 {
+		for _, key := range keys {
+			if value, ok := tags[key]; ok {
+				selected = append(selected, fmt.Sprintf("%s:%s", key, value))
+			}
+		}
+		return selected
+	}
+	for key, value := range tags {
+		if !strings.HasPrefix(key, "aws:") {
+			selected = append(selected, fmt.Sprintf("%s:%s", key, value))
+		}
+	}
+	sort.Strings(selected)
+	return selected
+}
+
+// unqualifiedARN removes the version or alias from the ARN of a function, as the tags belong to the function
+func unqualifiedARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) > 7 {
+		parts = parts[:7]
+	}
+	return strings.Join(parts, ":")
+}
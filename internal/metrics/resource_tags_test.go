@@ -0,0 +1,106 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTagFetcher struct {
+	tags  map[string]string
+	err   error
+	calls int
+	arn   string
+}
+
+func (f *mockTagFetcher) FetchTags(ctx context.Context, functionARN string) (map[string]string, error) {
+	f.calls++
+	f.arn = functionARN
+	return f.tags, f.err
+}
+
+func invokeWithResourceTags(fetcher TagFetcher, keys []string) string {
+	ml := MakeListener(Config{
+		APIKey:            "abc-123",
+		EnhancedMetrics:   true,
+		FetchResourceTags: true,
+		ResourceTagKeys:   keys,
+		TagFetcher:        fetcher,
+	})
+	lc := &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:my-alias",
+	}
+	ctx := lambdacontext.NewContext(context.WithValue(context.Background(), "cold_start", false), lc)
+	return captureOutput(func() {
+		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+}
+
+func TestResourceTagsAreAddedToEnhancedMetrics(t *testing.T) {
+	fetcher := &mockTagFetcher{tags: map[string]string{"team": "serverless", "service": "checkout", "cost-center": "42"}}
+
+	output := invokeWithResourceTags(fetcher, []string{"team", "service"})
+
+	assert.Contains(t, output, "aws.lambda.enhanced.invocations")
+	assert.Contains(t, output, "team:serverless")
+	assert.Contains(t, output, "service:checkout")
+	assert.NotContains(t, output, "cost-center:42")
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test", fetcher.arn)
+}
+
+func TestResourceTagsFailureAddsNoTags(t *testing.T) {
+	fetcher := &mockTagFetcher{err: errors.New("AccessDeniedException")}
+
+	output := invokeWithResourceTags(fetcher, nil)
+
+	assert.Contains(t, output, "aws.lambda.enhanced.invocations")
+	assert.Equal(t, 1, fetcher.calls)
+}
+
+func TestResourceTagsAreFetchedOnce(t *testing.T) {
+	fetcher := &mockTagFetcher{tags: map[string]string{"team": "serverless"}}
+	rt := makeResourceTags(fetcher, nil)
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"}
+	ctx := lambdacontext.NewContext(context.Background(), lc)
+
+	assert.Equal(t, []string{"team:serverless"}, rt.get(ctx))
+	assert.Equal(t, []string{"team:serverless"}, rt.get(ctx))
+	assert.Equal(t, 1, fetcher.calls)
+}
+
+func TestResourceTagsNeedTheLambdaContext(t *testing.T) {
+	fetcher := &mockTagFetcher{tags: map[string]string{"team": "serverless"}}
+	rt := makeResourceTags(fetcher, nil)
+
+	assert.Empty(t, rt.get(context.Background()))
+	assert.Equal(t, 0, fetcher.calls)
+}
+
+func TestSelectResourceTags(t *testing.T) {
+	tags := map[string]string{"team": "serverless", "env": "prod", "aws:cloudformation:stack-name": "stack"}
+
+	assert.Equal(t, []string{"env:prod", "team:serverless"}, selectResourceTags(tags, nil))
+	assert.Equal(t, []string{"team:serverless"}, selectResourceTags(tags, []string{"team", "missing"}))
+	assert.Equal(t, []string{"aws:cloudformation:stack-name:stack"}, selectResourceTags(tags, []string{"aws:cloudformation:stack-name"}))
+}
+
+func TestUnqualifiedARN(t *testing.T) {
+	unqualified := "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"
+
+	assert.Equal(t, unqualified, unqualifiedARN(unqualified))
+	assert.Equal(t, unqualified, unqualifiedARN(unqualified+":my-alias"))
+	assert.Equal(t, unqualified, unqualifiedARN(unqualified+":3"))
+}
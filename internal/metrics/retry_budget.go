@@ -0,0 +1,67 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudget bounds the retries of the flushes of an invocation, so that when the API is unreachable, each flush
+// doesn't wait for retries of its own. A retry is a send of a batch which failed before, either by the retries of
+// the last flush or by the next flush for a batch kept after a failure. The budget is held by the processor, so a
+// new one starts with each invocation.
+type retryBudget struct {
+	// maxRetries bounds the number of retries. It's unbounded when it's 0.
+	maxRetries int
+	// maxDuration bounds the time spent retrying, including the waits before the retries. It's unbounded when it's 0.
+	maxDuration time.Duration
+	retries     int
+	spent       time.Duration
+}
+
+var errRetryBudgetExhausted = errors.New("the retries of the invocation were exhausted, the batch wasn't sent")
+
+// exhausted tells whether the flushes should stop sending batches. A nil budget is never exhausted.
+func (b *retryBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+	return (b.maxRetries > 0 && b.retries >= b.maxRetries) || (b.maxDuration > 0 && b.spent >= b.maxDuration)
+}
+
+// retried records a retry which took d
+func (b *retryBudget) retried(d time.Duration) {
+	if b != nil {
+		b.retries++
+		b.spent += d
+	}
+}
+
+// waited records the time waited before a retry
+func (b *retryBudget) waited(d time.Duration) {
+	if b != nil {
+		b.spent += d
+	}
+}
+
+// failFast gives up on the current batch without sending it, once the retry budget is exhausted. The batch is
+// spilled or dropped like a batch which couldn't be sent.
+func (p *processor) failFast() error {
+	mts := p.batcher.ToAPIMetrics()
+	if len(mts) == 0 {
+		return nil
+	}
+	p.batcher = p.makeBatcher()
+	atomic.AddUint64(&p.stats.FlushesFailedFast, 1)
+	p.recordDelivery(deliveryFailed)
+	p.spillOrDrop(mts)
+	return errRetryBudgetExhausted
+}
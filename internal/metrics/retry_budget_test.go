@@ -0,0 +1,123 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudgetFailsFastOnceSpent(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	mc.err = errors.New("Some error")
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: true, maxRetries: 1})
+	pr.StartProcessing()
+
+	// The first flush fails, and its batch is retried by the second, which spends the budget
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.Flush()
+	pr.Flush()
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+
+	// The next flushes give up on their batch without sending it
+	pr.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	pr.Flush()
+	pr.AddMetric(&Distribution{Name: "metric-3", Values: []MetricValue{{Timestamp: mts.now, Value: 3}}})
+	pr.FinishProcessing()
+
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+	assert.Empty(t, mts.sleeps)
+	stats := pr.Stats()
+	assert.Equal(t, uint64(2), stats.FlushesFailedFast)
+	assert.Equal(t, uint64(2), stats.SendFailures)
+	assert.Equal(t, DeliveryStats{Failed: 2}, stats.Deliveries)
+	assert.Equal(t, uint64(3), stats.Drops.SendFailed)
+}
+
+func TestRetryBudgetBoundsRetriesOfLastFlush(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	mc.err = errors.New("Some error")
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: true, maxRetries: 1})
+	pr.StartProcessing()
+
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.FinishProcessing()
+
+	// Without a budget, the last flush is retried twice
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+	assert.Equal(t, []time.Duration{defaultRetryInterval}, mts.sleeps)
+	assert.Equal(t, uint64(1), pr.Stats().Retries)
+}
+
+func TestRetryBudgetBoundsRetryTime(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	mc.err = errors.New("Some error")
+	// The wait before the first retry spends most of the budget, and the retry itself the rest
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: true, maxRetryDuration: defaultRetryInterval})
+	pr.StartProcessing()
+
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	pr.FinishProcessing()
+
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+	assert.Equal(t, []time.Duration{defaultRetryInterval}, mts.sleeps)
+}
+
+func TestRetryBudgetDoesntFailFastAfterSuccess(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: true, maxRetries: 1})
+	pr.StartProcessing()
+
+	for i := 0; i < 3; i++ {
+		pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+		pr.Flush()
+	}
+	pr.FinishProcessing()
+
+	assert.Equal(t, 3, mc.sendMetricsCalledCount)
+	assert.Equal(t, uint64(0), pr.Stats().FlushesFailedFast)
+}
+
+func TestRetryBudgetResetsWithInvocation(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("Some error")
+	ml := MakeListener(Config{Client: &mc, SyncFlushOnly: true, ShouldRetryOnFailure: true, MaxRetriesPerInvocation: 1})
+
+	for i := 0; i < 2; i++ {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+		ml.AddDistributionMetric("metric-1", 1, time.Now(), false)
+		ml.HandlerFinished(ctx, nil, nil)
+	}
+
+	// Each invocation sends its batch and retries it once
+	assert.Equal(t, 4, mc.sendMetricsCalledCount)
+	assert.Equal(t, uint64(0), ml.Stats().FlushesFailedFast)
+}
+
+func TestRetryBudgetUnbounded(t *testing.T) {
+	var budget *retryBudget
+	budget.retried(time.Hour)
+	assert.False(t, budget.exhausted())
+
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: true})
+	pr.StartProcessing()
+	assert.Nil(t, pr.retryBudget)
+	pr.FinishProcessing()
+}
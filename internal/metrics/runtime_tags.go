@@ -0,0 +1,111 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
+)
+
+// runtimeTags describe the container running the function. They don't change during its lifetime, so they're
+// computed once. A tag whose value isn't available is empty.
+type runtimeTags struct {
+	architecture string
+	runtime      string
+	memorySize   string
+}
+
+var (
+	runtimeTagsOnce    sync.Once
+	currentRuntimeTags runtimeTags
+)
+
+// getRuntimeTags returns the runtime tags of the container, computing them the first time
+func getRuntimeTags() runtimeTags {
+	runtimeTagsOnce.Do(func() {
+		currentRuntimeTags = makeRuntimeTags(runtime.GOARCH, environment.Snapshot().Get, ioutil.ReadFile)
+	})
+	return currentRuntimeTags
+}
+
+func makeRuntimeTags(goarch string, getenv func(string) string, readFile func(string) ([]byte, error)) runtimeTags {
+	tags := runtimeTags{}
+	// Lambda names the architectures x86_64 and arm64
+	switch goarch {
+	case "amd64":
+		tags.architecture = "architecture:x86_64"
+	case "":
+	default:
+		tags.architecture = fmt.Sprintf("architecture:%s", goarch)
+	}
+	if name := detectRuntime(getenv, readFile); name != "" {
+		tags.runtime = fmt.Sprintf("runtime:%s", name)
+	}
+	if memorySize := getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"); memorySize != "" {
+		tags.memorySize = fmt.Sprintf("memorysize:%s", memorySize)
+	}
+	return tags
+}
+
+// detectRuntime returns the name of the Lambda runtime, such as go1.x. AWS_EXECUTION_ENV isn't set by the
+// OS-only runtimes, which are told apart by the release of their Amazon Linux.
+func detectRuntime(getenv func(string) string, readFile func(string) ([]byte, error)) string {
+	if executionEnv := getenv("AWS_EXECUTION_ENV"); executionEnv != "" {
+		return strings.TrimPrefix(executionEnv, "AWS_Lambda_")
+	}
+	if getenv("AWS_LAMBDA_RUNTIME_API") == "" {
+		// Not running in Lambda
+		return ""
+	}
+	release, err := readFile("/etc/system-release")
+	if err != nil {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(string(release), "Amazon Linux release 2023"):
+		return "provided.al2023"
+	case strings.HasPrefix(string(release), "Amazon Linux release 2"):
+		return "provided.al2"
+	}
+	return ""
+}
+
+// all returns the tags which are available
+func (t runtimeTags) all() []string {
+	tags := []string{}
+	for _, tag := range []string{t.architecture, t.runtime, t.memorySize} {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// appendRuntimeTags returns a copy of globalTags with the runtime tags whose key isn't already set in them
+func appendRuntimeTags(globalTags []string, runtimeTags runtimeTags) []string {
+	keys := map[string]struct{}{}
+	for _, tag := range globalTags {
+		if key, ok := tagKey(tag); ok {
+			keys[key] = struct{}{}
+		}
+	}
+	tags := append([]string{}, globalTags...)
+	for _, tag := range runtimeTags.all() {
+		key, _ := tagKey(tag)
+		if _, ok := keys[key]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
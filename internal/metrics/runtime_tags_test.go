@@ -0,0 +1,85 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setRuntimeTags replaces the runtime tags of the container, and returns a function restoring them
+func setRuntimeTags(tags runtimeTags) func() {
+	previous := getRuntimeTags()
+	currentRuntimeTags = tags
+	return func() {
+		currentRuntimeTags = previous
+	}
+}
+
+func makeEnv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func readRelease(release string) func(string) ([]byte, error) {
+	return func(string) ([]byte, error) {
+		if release == "" {
+			return nil, errors.New("no such file or directory")
+		}
+		return []byte(release), nil
+	}
+}
+
+func TestMakeRuntimeTags(t *testing.T) {
+	tags := makeRuntimeTags("amd64", makeEnv(map[string]string{
+		"AWS_EXECUTION_ENV":               "AWS_Lambda_go1.x",
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "1024",
+	}), readRelease(""))
+	assert.Equal(t, []string{"architecture:x86_64", "runtime:go1.x", "memorysize:1024"}, tags.all())
+
+	tags = makeRuntimeTags("arm64", makeEnv(nil), readRelease(""))
+	assert.Equal(t, []string{"architecture:arm64"}, tags.all())
+}
+
+func TestMakeRuntimeTagsDetectsOSOnlyRuntimes(t *testing.T) {
+	env := makeEnv(map[string]string{"AWS_LAMBDA_RUNTIME_API": "127.0.0.1:9001"})
+
+	tags := makeRuntimeTags("arm64", env, readRelease("Amazon Linux release 2 (Karoo)\n"))
+	assert.Equal(t, "runtime:provided.al2", tags.runtime)
+	tags = makeRuntimeTags("arm64", env, readRelease("Amazon Linux release 2023.3.20240219 (Amazon Linux)\n"))
+	assert.Equal(t, "runtime:provided.al2023", tags.runtime)
+	tags = makeRuntimeTags("arm64", env, readRelease(""))
+	assert.Equal(t, "", tags.runtime)
+
+	// Outside of Lambda, the release of the host isn't a runtime
+	tags = makeRuntimeTags("arm64", makeEnv(nil), readRelease("Amazon Linux release 2 (Karoo)\n"))
+	assert.Equal(t, "", tags.runtime)
+}
+
+func TestAppendRuntimeTags(t *testing.T) {
+	runtimeTags := runtimeTags{architecture: "architecture:arm64", runtime: "runtime:go1.x", memorySize: "memorysize:512"}
+	globalTags := []string{"env:prod", "memorysize:large"}
+
+	tags := appendRuntimeTags(globalTags, runtimeTags)
+	assert.Equal(t, []string{"env:prod", "memorysize:large", "architecture:arm64", "runtime:go1.x"}, tags)
+	assert.Equal(t, []string{"env:prod", "memorysize:large"}, globalTags)
+}
+
+func TestRuntimeTagsAddedToCustomMetrics(t *testing.T) {
+	defer setRuntimeTags(runtimeTags{architecture: "architecture:arm64", memorySize: "memorysize:512"})()
+
+	listener := MakeListener(Config{RuntimeTags: true, GlobalTags: []string{"env:prod"}})
+	assert.Equal(t, []string{"env:prod", "architecture:arm64", "memorysize:512"}, listener.config.GlobalTags)
+
+	listener = MakeListener(Config{GlobalTags: []string{"env:prod"}})
+	assert.Equal(t, []string{"env:prod"}, listener.config.GlobalTags)
+}
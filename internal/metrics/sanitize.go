@@ -0,0 +1,72 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitize removes the control characters and the invalid UTF-8 sequences of a metric name or tag, as a single
+// one makes the intake reject the whole batch. Metric names are always sanitized, and tags are when they aren't
+// normalized, as NormalizeTag already replaces those characters.
+func sanitize(s string) string {
+	if isSanitized(s) {
+		return s
+	}
+	var builder strings.Builder
+	builder.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !(r == utf8.RuneError && size == 1) && !unicode.IsControl(r) {
+			builder.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return builder.String()
+}
+
+// isSanitized returns true for strings which sanitize leaves unchanged, without allocating
+func isSanitized(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == 0x7f {
+			return false
+		} else if c >= utf8.RuneSelf {
+			// Only strings with multibyte characters are decoded
+			for _, r := range s[i:] {
+				if r == utf8.RuneError || unicode.IsControl(r) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return true
+}
+
+// sanitizeTags sanitizes tags, dropping the ones left empty. It returns the tags themselves when there's nothing
+// to remove.
+func sanitizeTags(tags []string) []string {
+	clean := 0
+	for clean < len(tags) && isSanitized(tags[clean]) {
+		clean++
+	}
+	if clean == len(tags) {
+		return tags
+	}
+	sanitized := make([]string, clean, len(tags))
+	copy(sanitized, tags)
+	for _, tag := range tags[clean:] {
+		if tag = sanitize(tag); tag != "" {
+			sanitized = append(sanitized, tag)
+		}
+	}
+	return sanitized
+}
@@ -0,0 +1,77 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+)
+
+var fuzzSeeds = []string{
+	"orders.placed",
+	"Region:EU West",
+	"région:île-de-france",
+	"user:\x1bbob",
+	"orders\x00\r\n.placed\x7f",
+	"caf\xc3",
+	"\xff\xfe\xfd",
+	"emoji:\U0001F600",
+	"line separator\u0085",
+}
+
+// assertJSONSafe fails when the output of a normalization isn't valid UTF-8, has control bytes, or isn't
+// marshalled and unmarshalled back as it is
+func assertJSONSafe(t *testing.T, input, output string) {
+	if !utf8.ValidString(output) {
+		t.Fatalf("%q: output %q isn't valid UTF-8", input, output)
+	}
+	for i := 0; i < len(output); i++ {
+		if output[i] < 0x20 || output[i] == 0x7f {
+			t.Fatalf("%q: output %q has the control byte %#x", input, output, output[i])
+		}
+	}
+	marshalled, err := json.Marshal(output)
+	if err != nil {
+		t.Fatalf("%q: output %q can't be marshalled: %v", input, output, err)
+	}
+	var unmarshalled string
+	if err := json.Unmarshal(marshalled, &unmarshalled); err != nil || unmarshalled != output {
+		t.Fatalf("%q: output %q isn't unmarshalled as it is: %q, %v", input, output, unmarshalled, err)
+	}
+}
+
+func FuzzSanitize(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		output := sanitize(input)
+		assertJSONSafe(t, input, output)
+		if sanitize(output) != output {
+			t.Fatalf("%q: sanitizing %q again changes it", input, output)
+		}
+	})
+}
+
+func FuzzNormalizeTag(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		output := NormalizeTag(input)
+		assertJSONSafe(t, input, output)
+		if NormalizeTag(output) != output {
+			t.Fatalf("%q: normalizing %q again changes it", input, output)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitize(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":                        "",
+		"orders.placed":           "orders.placed",
+		"région:île-de-france":    "région:île-de-france",
+		"orders\x00.placed":       "orders.placed",
+		"orders\r\n.placed\x7f":   "orders.placed",
+		"orders\u0085.placed":     "orders.placed",
+		"orders\xff\xfe.placed":   "orders.placed",
+		"caf\xc3":                 "caf",
+		"\x01\x02\x03":            "",
+		"emoji:\U0001F600\x1b[0m": "emoji:\U0001F600[0m",
+	} {
+		assert.Equal(t, expected, sanitize(input), "%q", input)
+		assert.Equal(t, input == expected, isSanitized(input), "%q", input)
+	}
+	// Valid replacement characters are kept, although they make the string go through the slow path
+	assert.Equal(t, "replacement:\uFFFD", sanitize("replacement:\uFFFD"))
+}
+
+func TestSanitizeTags(t *testing.T) {
+	tags := []string{"env:prod", "team:orders"}
+	sanitized := sanitizeTags(tags)
+	assert.Equal(t, tags, sanitized)
+	// Clean tags aren't copied
+	assert.Equal(t, &tags[0], &sanitized[0])
+
+	assert.Equal(t, []string{"env:prod", "user:bob"}, sanitizeTags([]string{"env:prod", "\x00", "user:\x1bbob"}))
+	assert.Nil(t, sanitizeTags(nil))
+}
+
+func TestSanitizeDoesNotAllocateForCleanStrings(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		sanitize("orders.placed")
+		sanitize("région:île-de-france")
+		sanitizeTags([]string{"env:prod", "team:orders"})
+	})
+	assert.Equal(t, float64(0), allocs)
+}
@@ -0,0 +1,79 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// saturationThreshold is the share of the metrics channel above which it's saturated
+const saturationThreshold = 0.8
+
+// saturationWarned is set to 1 once the saturation of the metrics channel was logged, so that it's logged once
+// per container
+var saturationWarned uint32
+
+// saturation tracks the occupancy of the metrics channel of a processor, to warn when metrics are added faster
+// than they're flushed, before AddMetric starts blocking on the full channel and the points of cancelled
+// invocations are dropped
+type saturation struct {
+	// highWater is the most metrics waiting in the channel since the processor started. It's read atomically by
+	// Stats.
+	highWater uint64
+	// added counts the points sent on the channel, from the goroutines of the handler
+	added uint64
+	// flushed counts the points sent to the API, by the processing goroutine
+	flushed uint64
+	start   time.Time
+	// since is when the channel became saturated, and the zero time while it isn't. It's only used by the
+	// processing goroutine.
+	since time.Time
+}
+
+// sampleSaturation records the occupancy of the metrics channel, as seen by the processing goroutine, and warns
+// once the channel stayed saturated for longer than the batch interval
+func (p *processor) sampleSaturation() {
+	s := p.saturation
+	occupancy := uint64(len(p.metricsChan))
+	if occupancy > atomic.LoadUint64(&s.highWater) {
+		atomic.StoreUint64(&s.highWater, occupancy)
+	}
+	if float64(occupancy) < saturationThreshold*float64(cap(p.metricsChan)) {
+		s.since = time.Time{}
+		return
+	}
+	now := p.timeService.Now()
+	if s.since.IsZero() {
+		s.since = now
+		return
+	}
+	if now.Sub(s.since) <= p.batchInterval || !atomic.CompareAndSwapUint32(&saturationWarned, 0, 1) {
+		return
+	}
+	elapsed := now.Sub(s.start).Seconds()
+	logger.Warn(fmt.Sprintf("the metrics buffer has been more than %.0f%% full for %s: %d of %d metrics are waiting to be flushed. "+
+		"Metrics are added at %.0f points/s and flushed at %.0f points/s, so adding metrics will block once it's full. "+
+		"Set Config.ShardedBuffers to buffer them without a channel, flush more often with Config.FlushAtPointCount, "+
+		"or send fewer metrics, for example by aggregating values in the handler. This is logged once per container.",
+		saturationThreshold*100, now.Sub(s.since).Round(time.Millisecond), occupancy, cap(p.metricsChan),
+		float64(atomic.LoadUint64(&s.added))/elapsed, float64(s.flushed)/elapsed))
+}
+
+// channelHighWaterMark returns the most metrics waiting in the metrics channel since the processor started, or 0
+// when the processor doesn't buffer metrics in a channel
+func (p *processor) channelHighWaterMark() uint64 {
+	if p.saturation == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&p.saturation.highWater)
+}
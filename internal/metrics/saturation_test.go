@@ -0,0 +1,118 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func addGauges(p *processor, count int) {
+	for i := 0; i < count; i++ {
+		p.AddMetric(&Gauge{Name: "queue.depth", Timestamp: time.Unix(1700000000, 0), Value: float64(i)})
+	}
+}
+
+func TestChannelHighWaterMark(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	p := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{})
+	// The metrics channel holds 10 metrics
+	p.metricsChan = make(chan Metric, 10)
+
+	// The metrics added before the processing starts wait in the channel
+	addGauges(p, 6)
+	p.StartProcessing()
+	p.FinishProcessing()
+
+	// The first metric was read from the channel when its occupancy was sampled
+	assert.Equal(t, uint64(5), p.Stats().ChannelHighWaterMark)
+	assert.Equal(t, uint64(6), atomic.LoadUint64(&p.saturation.added))
+}
+
+func TestSaturationWarnsOnce(t *testing.T) {
+	atomic.StoreUint32(&saturationWarned, 0)
+	defer atomic.StoreUint32(&saturationWarned, 0)
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	p := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{})
+	// The metrics channel holds 10 metrics
+	p.metricsChan = make(chan Metric, 10)
+	addGauges(p, 9)
+
+	output := captureOutput(func() {
+		p.sampleSaturation()
+		// Saturated for the batch interval only
+		mts.setNow(mts.Now().Add(time.Second))
+		p.sampleSaturation()
+	})
+	assert.Empty(t, output)
+
+	output = captureOutput(func() {
+		mts.setNow(mts.Now().Add(time.Millisecond))
+		p.sampleSaturation()
+		mts.setNow(mts.Now().Add(time.Second))
+		p.sampleSaturation()
+	})
+	assert.Equal(t, 1, strings.Count(output, "the metrics buffer has been more than 80% full for 1.001s: 9 of 10 metrics"))
+	assert.Contains(t, output, "Config.ShardedBuffers")
+	assert.Equal(t, uint64(9), p.channelHighWaterMark())
+}
+
+func TestSaturationStartsOverBelowThreshold(t *testing.T) {
+	atomic.StoreUint32(&saturationWarned, 0)
+	defer atomic.StoreUint32(&saturationWarned, 0)
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	p := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{})
+	// The metrics channel holds 10 metrics
+	p.metricsChan = make(chan Metric, 10)
+
+	output := captureOutput(func() {
+		addGauges(p, 8)
+		p.sampleSaturation()
+		// The channel is drained below the threshold before the batch interval elapsed
+		for i := 0; i < 4; i++ {
+			<-p.metricsChan
+		}
+		p.sampleSaturation()
+		addGauges(p, 4)
+		mts.setNow(mts.Now().Add(2 * time.Second))
+		p.sampleSaturation()
+	})
+
+	assert.Empty(t, output)
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&saturationWarned))
+}
+
+func TestChannelHighWaterMarkStartsOverEachInvocation(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, uint64(0), ml.Stats().ChannelHighWaterMark)
+	atomic.StoreUint64(&ml.processor.(*processor).saturation.highWater, 1500)
+	assert.Equal(t, uint64(1500), ml.Stats().ChannelHighWaterMark)
+	ml.HandlerFinished(ctx, nil, nil)
+
+	ctx = ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, uint64(0), ml.Stats().ChannelHighWaterMark)
+	ml.HandlerFinished(ctx, nil, nil)
+
+	ml = MakeListener(Config{Client: &mc, SyncFlushOnly: true})
+	ctx = ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, uint64(0), ml.Stats().ChannelHighWaterMark)
+	ml.HandlerFinished(ctx, nil, nil)
+}
@@ -0,0 +1,54 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// metricShard batches the metrics added by some of the goroutines of an invocation, so that the goroutines
+// sending metrics concurrently don't all contend on the metrics channel, nor wait for a single goroutine to batch
+// their metrics
+type metricShard struct {
+	mu      sync.Mutex
+	batcher *Batcher
+	// The padding keeps the shards on different cache lines, so that locking one doesn't slow down the others
+	_ [48]byte
+}
+
+// addMetricSharded batches a metric in the next shard, in turn. It's called with the read lock of finishMu held.
+func (p *processor) addMetricSharded(metric Metric) {
+	i := atomic.AddUint32(&p.nextShard, 1) % uint32(len(p.shards))
+	shard := &p.shards[i]
+	shard.mu.Lock()
+	shard.batcher.AddMetric(metric)
+	shard.mu.Unlock()
+	if p.threshold != nil && p.threshold.add(pointCount(metric)) {
+		select {
+		case p.thresholdChan <- struct{}{}:
+		default:
+			// A flush at the threshold is already pending
+		}
+	}
+}
+
+// drainShards merges the batches of the shards into the batcher. It's called by the processing goroutine.
+func (p *processor) drainShards() {
+	for i := range p.shards {
+		shard := &p.shards[i]
+		shard.mu.Lock()
+		metrics := shard.batcher.metrics
+		shard.batcher.metrics = map[batchMapKey]Metric{}
+		shard.mu.Unlock()
+		for _, m := range metrics {
+			p.addToBatch(m)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addConcurrently adds the points of a few metrics to a processor from several goroutines at once
+func addConcurrently(pr Processor, goroutines int, points int) {
+	now := time.Unix(1600000000, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < points; i++ {
+				pr.AddMetric(&Distribution{
+					Name:   fmt.Sprintf("metric-%d", i%3),
+					Tags:   []string{fmt.Sprintf("worker:%d", g%2)},
+					Values: []MetricValue{{Timestamp: now, Value: float64(g*points + i)}},
+				})
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// flushedValues returns the values of the points received by the client, by metric name and tags, in
+// increasing order, as the order of the points depends on the scheduling of the goroutines
+func flushedValues(mc *mockClient) map[string][]float64 {
+	values := map[string][]float64{}
+	for len(mc.batches) > 0 {
+		for _, m := range <-mc.batches {
+			key := m.Name + "|" + strings.Join(m.Tags, ",")
+			for _, point := range m.Points {
+				for _, value := range point.([]interface{})[1].([]interface{}) {
+					values[key] = append(values[key], value.(float64))
+				}
+			}
+		}
+	}
+	for _, v := range values {
+		sort.Float64s(v)
+	}
+	return values
+}
+
+func TestShardedProcessorMatchesChannelProcessor(t *testing.T) {
+	channelClient := makeMockClient()
+	mts := makeMockTimeService()
+	channelProcessor := makeTestProcessor(context.Background(), &channelClient, &mts, processorOptions{batchInterval: 1000})
+	channelProcessor.StartProcessing()
+	addConcurrently(channelProcessor, 8, 200)
+	channelProcessor.FinishProcessing()
+
+	shardedClient := makeMockClient()
+	shardedProcessor := makeTestProcessor(context.Background(), &shardedClient, &mts, processorOptions{shards: 4, batchInterval: 1000})
+	shardedProcessor.StartProcessing()
+	addConcurrently(shardedProcessor, 8, 200)
+	shardedProcessor.FinishProcessing()
+
+	expected := flushedValues(&channelClient)
+	assert.Len(t, expected, 6)
+	assert.Equal(t, expected, flushedValues(&shardedClient))
+	channelStats := channelProcessor.Stats()
+	// Sharded processors don't buffer the metrics in a channel
+	channelStats.ChannelHighWaterMark = 0
+	assert.Equal(t, channelStats, shardedProcessor.Stats())
+	assert.Equal(t, uint64(1600), shardedProcessor.Stats().PointsBuffered)
+}
+
+func TestShardedProcessorFlushesOnTick(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{shards: 4, batchInterval: 1000})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	mts.tickerChan <- time.Now()
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+
+	pr.FinishProcessing()
+	assert.Equal(t, errProcessorFinished, pr.AddMetric(&Distribution{Name: "metric-2"}))
+}
+
+func TestShardedProcessorCountsCancelledPoints(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pr := makeTestProcessor(ctx, &mc, &mts, processorOptions{shards: 4, batchInterval: 1000})
+	pr.StartProcessing()
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	cancel()
+	pr.FinishProcessing()
+
+	assert.Equal(t, uint64(1), pr.Stats().Drops.Cancelled)
+	assert.Len(t, mc.batches, 0)
+}
+
+func TestHandlerStartedMakesShardedProcessor(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc, ShardedBuffers: 8})
+	ctx := listener.HandlerStarted(context.Background(), []byte("{}"))
+	assert.Len(t, listener.processor.(*processor).shards, 8)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	// Without a processing goroutine, there's nothing to contend on
+	listener = MakeListener(Config{Client: &mc, ShardedBuffers: 8, SyncFlushOnly: true})
+	ctx = listener.HandlerStarted(context.Background(), []byte("{}"))
+	assert.Len(t, listener.processor.(*processor).shards, 0)
+	listener.HandlerFinished(ctx, nil, nil)
+}
@@ -0,0 +1,79 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Sink identifies where the listener sends metrics
+type Sink string
+
+const (
+	// SinkExtension sends metrics to the Datadog Extension over DogStatsD
+	SinkExtension Sink = "extension"
+	// SinkAPI sends metrics directly to the Datadog API
+	SinkAPI Sink = "api"
+	// SinkLogForwarder writes metrics to the logs, to be sent by the Datadog Forwarder
+	SinkLogForwarder Sink = "log-forwarder"
+	// SinkCustom sends metrics to a custom Client, such as the recorder of the ddlambdatest package
+	SinkCustom Sink = "custom"
+	// SinkDisabled drops metrics, because no way of sending them is configured
+	SinkDisabled Sink = "disabled"
+)
+
+// SinkInfo describes the Sink selected by the listener, and why it was selected
+type SinkInfo struct {
+	Sink   Sink
+	Reason string
+}
+
+var (
+	sinkInfoMu sync.Mutex
+	// currentSinkInfo is the SinkInfo of the most recently created listener
+	currentSinkInfo = SinkInfo{Sink: SinkDisabled, Reason: "no metrics listener has been created"}
+)
+
+// GetSinkInfo returns the SinkInfo of the most recently created listener
+func GetSinkInfo() SinkInfo {
+	sinkInfoMu.Lock()
+	defer sinkInfoMu.Unlock()
+	return currentSinkInfo
+}
+
+func setSinkInfo(sinkInfo SinkInfo) {
+	sinkInfoMu.Lock()
+	defer sinkInfoMu.Unlock()
+	currentSinkInfo = sinkInfo
+}
+
+// selectSink decides where metrics are sent. agentErr is the reason the Serverless Agent couldn't be used
+// when it's installed but not running.
+func selectSink(config Config, agentInstalled, agentRunning bool, agentErr error) SinkInfo {
+	if config.Client != nil {
+		return SinkInfo{Sink: SinkCustom, Reason: "a custom metrics client is set"}
+	}
+	if agentRunning {
+		return SinkInfo{Sink: SinkExtension, Reason: "the Datadog Extension is installed and responded to the hello request"}
+	}
+
+	reason := "the Datadog Extension isn't installed"
+	if agentInstalled {
+		reason = fmt.Sprintf("the Datadog Extension is installed but can't be used (%v)", agentErr)
+	}
+
+	if config.ShouldUseLogForwarder {
+		return SinkInfo{Sink: SinkLogForwarder, Reason: reason + " and flushing metrics to the logs is enabled"}
+	}
+	if config.APIKey != "" || config.KMSAPIKey != "" {
+		return SinkInfo{Sink: SinkAPI, Reason: reason + " and an API key is set"}
+	}
+	return SinkInfo{Sink: SinkDisabled, Reason: reason + ", no API key is set and flushing metrics to the logs is disabled"}
+}
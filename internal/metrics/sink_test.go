@@ -0,0 +1,47 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectSinkExtension(t *testing.T) {
+	sinkInfo := selectSink(Config{ShouldUseLogForwarder: true}, true, true, nil)
+	assert.Equal(t, SinkExtension, sinkInfo.Sink)
+}
+
+func TestSelectSinkLogForwarder(t *testing.T) {
+	sinkInfo := selectSink(Config{APIKey: "abc-123", ShouldUseLogForwarder: true}, false, false, nil)
+	assert.Equal(t, SinkLogForwarder, sinkInfo.Sink)
+	assert.Contains(t, sinkInfo.Reason, "isn't installed")
+}
+
+func TestSelectSinkAPI(t *testing.T) {
+	assert.Equal(t, SinkAPI, selectSink(Config{APIKey: "abc-123"}, false, false, nil).Sink)
+	assert.Equal(t, SinkAPI, selectSink(Config{KMSAPIKey: "encrypted"}, false, false, nil).Sink)
+}
+
+func TestSelectSinkDisabled(t *testing.T) {
+	sinkInfo := selectSink(Config{}, true, false, errors.New("connection refused"))
+	assert.Equal(t, SinkDisabled, sinkInfo.Sink)
+	assert.Contains(t, sinkInfo.Reason, "installed but can't be used (connection refused)")
+}
+
+func TestMakeListenerRecordsSinkInfo(t *testing.T) {
+	listener := MakeListener(Config{APIKey: "abc-123"})
+	assert.Equal(t, SinkAPI, listener.sinkInfo.Sink)
+	assert.Equal(t, listener.sinkInfo, GetSinkInfo())
+
+	MakeListener(Config{ShouldUseLogForwarder: true})
+	assert.Equal(t, SinkLogForwarder, GetSinkInfo().Sink)
+}
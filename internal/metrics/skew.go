@@ -0,0 +1,92 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// futureSkewOnce logs the first point clamped because of its timestamp, so that replayed events don't flood the
+// logs
+var futureSkewOnce sync.Once
+
+// futureClamper is a metric whose timestamps can be clamped
+type futureClamper interface {
+	// clampFuture moves the timestamps after the limit back to it, and returns the number of points moved
+	clampFuture(limit time.Time) uint64
+}
+
+// clampFuture moves the timestamps of a metric which are more than the max future skew after now back to that
+// limit, and returns the number of points moved. Events replayed to a container whose clock drifted can carry
+// timestamps in its future, and the intake rejects the whole batch for a single point too far in the future.
+func (b *Batcher) clampFuture(metric Metric, now time.Time) uint64 {
+	clamper, ok := metric.(futureClamper)
+	if !ok {
+		return 0
+	}
+	limit := now.Add(b.maxFutureSkew)
+	clamped := clamper.clampFuture(limit)
+	if clamped > 0 {
+		futureSkewOnce.Do(func() {
+			logger.Warn(fmt.Sprintf("metric %s has points more than %s after the clock of the container, they're sent at %s. This is logged once per container.",
+				metric.ToBatchKey().name, b.maxFutureSkew, limit.UTC().Format(time.RFC3339)))
+		})
+	}
+	return clamped
+}
+
+// addToBatch clamps the timestamps of a metric, and adds it to the batch. It's called by the processing
+// goroutine, or by the handler with a processor which only flushes when it finishes.
+func (p *processor) addToBatch(metric Metric) {
+	if clamped := p.batcher.clampFuture(metric, p.timeService.Now()); clamped > 0 {
+		atomic.AddUint64(&p.stats.PointsClamped, clamped)
+	}
+	p.batcher.AddMetric(metric)
+	atomic.AddUint64(&p.stats.PointsBuffered, pointCount(metric))
+}
+
+func (d *Distribution) clampFuture(limit time.Time) uint64 {
+	clamped := uint64(0)
+	for i := range d.Values {
+		if d.Values[i].Timestamp.After(limit) {
+			d.Values[i].Timestamp = limit
+			clamped++
+		}
+	}
+	return clamped
+}
+
+func (s *Set) clampFuture(limit time.Time) uint64 {
+	return clampTimestamp(&s.Timestamp, limit)
+}
+
+func (c *Count) clampFuture(limit time.Time) uint64 {
+	return clampTimestamp(&c.Timestamp, limit)
+}
+
+func (g *Gauge) clampFuture(limit time.Time) uint64 {
+	return clampTimestamp(&g.Timestamp, limit)
+}
+
+func (r *Rate) clampFuture(limit time.Time) uint64 {
+	return clampTimestamp(&r.Timestamp, limit)
+}
+
+func clampTimestamp(timestamp *time.Time, limit time.Time) uint64 {
+	if timestamp.After(limit) {
+		*timestamp = limit
+		return 1
+	}
+	return 0
+}
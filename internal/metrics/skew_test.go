@@ -0,0 +1,69 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcherClampsFuturePoints(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	batcher := MakeBatcher(10)
+
+	dm := Distribution{Name: "latency"}
+	dm.AddPoint(now.Add(time.Minute), 1)
+	dm.AddPoint(now.Add(time.Hour), 2)
+	dm.AddPoint(now.Add(2*time.Hour), 3)
+	c := Count{Name: "requests"}
+	c.AddPoint(now.Add(time.Hour), 1)
+
+	var clamped uint64
+	captureOutput(func() {
+		clamped = batcher.clampFuture(&dm, now) + batcher.clampFuture(&c, now)
+	})
+
+	limit := now.Add(defaultMaxFutureSkew)
+	assert.Equal(t, uint64(3), clamped)
+	assert.Equal(t, now.Add(time.Minute), dm.Values[0].Timestamp)
+	assert.Equal(t, limit, dm.Values[1].Timestamp)
+	assert.Equal(t, limit, dm.Values[2].Timestamp)
+	assert.Equal(t, limit, c.Timestamp)
+}
+
+func TestProcessorClampsFuturePoints(t *testing.T) {
+	futureSkewOnce = sync.Once{}
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	stats := &Stats{}
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: time.Hour, stats: stats, maxFutureSkew: time.Minute})
+	output := captureOutput(func() {
+		pr.StartProcessing()
+		for _, offset := range []time.Duration{0, 2 * time.Minute, time.Hour} {
+			dm := Distribution{Name: "latency"}
+			dm.AddPoint(mts.Now().Add(offset), 1)
+			pr.AddMetric(&dm)
+		}
+		pr.FinishProcessing()
+	})
+
+	batch := <-mc.batches
+	limit := float64(mts.Now().Add(time.Minute).Unix())
+	assert.Equal(t, limit, batch[0].Points[1].([]interface{})[0])
+	assert.Equal(t, limit, batch[0].Points[2].([]interface{})[0])
+	assert.Equal(t, uint64(2), stats.snapshot().PointsClamped)
+	// The first clamped point is logged once per container
+	assert.Equal(t, 1, strings.Count(output, "after the clock of the container"))
+}
@@ -0,0 +1,240 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+const (
+	// defaultSpoolDir is the directory of the batches spilled when they couldn't be sent
+	defaultSpoolDir = "/tmp/datadog-lambda-go/spool"
+	// defaultSpoolMaxSize is the default size of the spool, in bytes
+	defaultSpoolMaxSize = 8 * 1024 * 1024
+	// spoolMaxPointAge is how old a point can be to be accepted by the intake. Older spilled points are dropped
+	// instead of being sent.
+	spoolMaxPointAge = time.Hour
+	spoolFileSuffix  = ".json"
+)
+
+// spool keeps the batches which couldn't be sent in files, so that they're sent by the next invocations of the
+// container. Each batch is a file named after the time it was spilled, a sequence number and its number of
+// points, so that the oldest batches are drained and evicted first.
+type spool struct {
+	dir     string
+	maxSize int64
+	// mu serializes the writes, so that the evictions see every file. Files are claimed by renaming them before
+	// they're drained, so that the spools of concurrent listeners never drain the same batch.
+	mu  sync.Mutex
+	seq uint64
+}
+
+func makeSpool(dir string, maxSize int64) *spool {
+	if dir == "" {
+		dir = defaultSpoolDir
+	}
+	if maxSize <= 0 {
+		maxSize = defaultSpoolMaxSize
+	}
+	return &spool{dir: dir, maxSize: maxSize}
+}
+
+// spoolFile is a batch spilled in the spool
+type spoolFile struct {
+	name   string
+	size   int64
+	points uint64
+}
+
+// write spills a batch, evicting the oldest batches when the spool would grow larger than its maximum size. It
+// returns the number of points evicted.
+func (s *spool) write(batch []APIMetric, now time.Time) (uint64, error) {
+	content, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(content)) > s.maxSize {
+		return 0, fmt.Errorf("the batch of %d bytes is larger than the spool", len(content))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return 0, err
+	}
+	files, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(content))
+	for _, file := range files {
+		size += file.size
+	}
+	evicted := uint64(0)
+	for len(files) > 0 && size > s.maxSize {
+		if err := os.Remove(filepath.Join(s.dir, files[0].name)); err == nil {
+			evicted += files[0].points
+		}
+		size -= files[0].size
+		files = files[1:]
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d-%d%s", now.UnixNano(), s.seq%1000000, apiPointCount(batch), spoolFileSuffix)
+	// Written under another name, then renamed, so that a batch is never drained half written
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		os.Remove(tmpPath)
+		return evicted, err
+	}
+	return evicted, os.Rename(tmpPath, filepath.Join(s.dir, name))
+}
+
+// list returns the batches in the spool, oldest first
+func (s *spool) list() ([]spoolFile, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := []spoolFile{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolFileSuffix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(name, spoolFileSuffix), "-")
+		if len(parts) != 3 {
+			continue
+		}
+		points, _ := strconv.ParseUint(parts[2], 10, 64)
+		files = append(files, spoolFile{name: name, size: entry.Size(), points: points})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// drain sends the batches of the spool with send, oldest first, and removes them once sent. The points which
+// are too old to be accepted by the intake are left out. It stops at the first batch which can't be sent, which
+// is left in the spool. It returns the number of points sent, and of points left out.
+func (s *spool) drain(now time.Time, send func(batch []APIMetric) error) (uint64, uint64, error) {
+	files, err := s.list()
+	if err != nil {
+		return 0, 0, err
+	}
+	oldest := float64(now.Add(-spoolMaxPointAge).Unix())
+	sent, expired := uint64(0), uint64(0)
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.name)
+		claimedPath := path + ".claimed"
+		if err := os.Rename(path, claimedPath); err != nil {
+			// Claimed by another listener, or evicted
+			continue
+		}
+		batch := []APIMetric{}
+		content, err := ioutil.ReadFile(claimedPath)
+		if err == nil {
+			err = json.Unmarshal(content, &batch)
+		}
+		if err != nil {
+			logger.Error(fmt.Errorf("couldn't read the spilled metrics of %s: %v", file.name, err))
+			os.Remove(claimedPath)
+			expired += file.points
+			continue
+		}
+		batch, dropped := withoutPointsBefore(batch, oldest)
+		expired += dropped
+		if len(batch) > 0 {
+			if err := send(batch); err != nil {
+				// Released, so that it's sent by a later invocation
+				os.Rename(claimedPath, path)
+				return sent, expired, err
+			}
+			sent += apiPointCount(batch)
+		}
+		os.Remove(claimedPath)
+	}
+	return sent, expired, nil
+}
+
+// withoutPointsBefore removes the points of a batch whose timestamp is before oldest, and the metrics left
+// without points. It returns the number of points removed.
+func withoutPointsBefore(batch []APIMetric, oldest float64) ([]APIMetric, uint64) {
+	kept := batch[:0]
+	dropped := uint64(0)
+	for _, metric := range batch {
+		points := metric.Points[:0]
+		for _, point := range metric.Points {
+			if values, ok := point.([]interface{}); ok && len(values) > 0 {
+				if timestamp, ok := values[0].(float64); ok && timestamp < oldest {
+					dropped++
+					continue
+				}
+			}
+			points = append(points, point)
+		}
+		if len(points) > 0 {
+			metric.Points = points
+			kept = append(kept, metric)
+		}
+	}
+	return kept, dropped
+}
+
+// spillOrDrop spills the batch of points which couldn't be sent, or counts them as dropped when there is no
+// spool or it can't be written
+func (p *processor) spillOrDrop(batch []APIMetric) {
+	points := apiPointCount(batch)
+	if p.spool != nil {
+		evicted, err := p.spool.write(batch, p.timeService.Now())
+		atomic.AddUint64(&p.stats.Drops.SpoolFull, evicted)
+		if err == nil {
+			atomic.AddUint64(&p.stats.PointsSpilled, points)
+			return
+		}
+		logger.Error(fmt.Errorf("couldn't spill the metrics which couldn't be sent: %v", err))
+	}
+	atomic.AddUint64(p.dropReason(), points)
+}
+
+// drainSpool sends the batches spilled by previous invocations, oldest first. It's called before the first
+// flush of the processor, by the goroutine which sends its batches, so that the spilled batches are never sent
+// concurrently with the batches of the invocation. It stops at the first batch which still can't be sent.
+func (p *processor) drainSpool() {
+	sent, expired, err := p.spool.drain(p.timeService.Now(), func(batch []APIMetric) error {
+		if err := p.client.SendMetrics(batch); err != nil {
+			atomic.AddUint64(&p.stats.SendFailures, 1)
+			return err
+		}
+		atomic.AddUint64(&p.stats.BatchesSent, 1)
+		// The spilled batch failed before, so it's only delivered now
+		atomic.AddUint64(&p.stats.Deliveries.Retried, 1)
+		p.telemetry.recordDelivery(p.timeService.Now(), deliveryRetried)
+		return nil
+	})
+	atomic.AddUint64(&p.stats.PointsUnspilled, sent)
+	atomic.AddUint64(&p.stats.Drops.SpoolExpired, expired)
+	if err != nil {
+		logger.Error(fmt.Errorf("failed to send the spilled metrics: %v", err))
+	}
+}
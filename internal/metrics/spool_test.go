@@ -0,0 +1,275 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyClient fails to send the batches while failing is set, and keeps the ones it sent
+type flakyClient struct {
+	mu      sync.Mutex
+	failing bool
+	sent    [][]APIMetric
+}
+
+func (c *flakyClient) SendMetrics(mts []APIMetric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failing {
+		return errors.New("the intake is unavailable")
+	}
+	c.sent = append(c.sent, mts)
+	return nil
+}
+
+func (c *flakyClient) setFailing(failing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failing = failing
+}
+
+func (c *flakyClient) sentNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := []string{}
+	for _, batch := range c.sent {
+		for _, m := range batch {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+func makeTestSpool(t *testing.T, maxSize int64) (*spool, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	return makeSpool(dir, maxSize), func() { os.RemoveAll(dir) }
+}
+
+func makeAPIMetric(name string, timestamps ...time.Time) APIMetric {
+	points := []interface{}{}
+	for _, timestamp := range timestamps {
+		points = append(points, []interface{}{float64(timestamp.Unix()), []interface{}{float64(1)}})
+	}
+	return APIMetric{Name: name, MetricType: DistributionType, Tags: []string{"env:test"}, Points: points}
+}
+
+func drainNames(t *testing.T, s *spool, now time.Time) []string {
+	names := []string{}
+	_, _, err := s.drain(now, func(batch []APIMetric) error {
+		for _, m := range batch {
+			names = append(names, m.Name)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	return names
+}
+
+func TestSpoolDrainsOldestFirst(t *testing.T) {
+	s, cleanup := makeTestSpool(t, 0)
+	defer cleanup()
+	now := time.Now()
+
+	for _, name := range []string{"metric-1", "metric-2", "metric-3"} {
+		evicted, err := s.write([]APIMetric{makeAPIMetric(name, now)}, now)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), evicted)
+	}
+
+	assert.Equal(t, []string{"metric-1", "metric-2", "metric-3"}, drainNames(t, s, now))
+	// The batches are removed once sent
+	assert.Empty(t, drainNames(t, s, now))
+	files, err := ioutil.ReadDir(s.dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	s, cleanup := makeTestSpool(t, 0)
+	defer cleanup()
+	now := time.Now()
+	interval := float64(10)
+	batch := []APIMetric{
+		{Name: "metric-1", MetricType: DistributionType, Tags: []string{"a:b"}, Points: []interface{}{[]interface{}{float64(now.Unix()), []interface{}{float64(1), float64(2)}}}, SampleRate: 0.5},
+		{Name: "metric-2", MetricType: GaugeType, Interval: &interval, Points: []interface{}{[]interface{}{float64(now.Unix()), float64(3)}}},
+	}
+	_, err := s.write(batch, now)
+	assert.NoError(t, err)
+
+	var drained []APIMetric
+	sent, expired, err := s.drain(now, func(b []APIMetric) error {
+		drained = b
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), sent)
+	assert.Equal(t, uint64(0), expired)
+	assert.Equal(t, batch, drained)
+}
+
+func TestSpoolEvictsOldestBatches(t *testing.T) {
+	batch := []APIMetric{makeAPIMetric("metric-1", time.Now(), time.Now())}
+	content, _ := json.Marshal(batch)
+	s, cleanup := makeTestSpool(t, int64(2*len(content)))
+	defer cleanup()
+	now := time.Now()
+
+	for _, name := range []string{"metric-1", "metric-2", "metric-3"} {
+		evicted, err := s.write([]APIMetric{makeAPIMetric(name, now, now)}, now)
+		assert.NoError(t, err)
+		if name == "metric-3" {
+			assert.Equal(t, uint64(2), evicted)
+		}
+	}
+
+	assert.Equal(t, []string{"metric-2", "metric-3"}, drainNames(t, s, now))
+}
+
+func TestSpoolRejectsBatchLargerThanSpool(t *testing.T) {
+	s, cleanup := makeTestSpool(t, 10)
+	defer cleanup()
+
+	_, err := s.write([]APIMetric{makeAPIMetric("metric-1", time.Now())}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestSpoolDrainDropsExpiredPoints(t *testing.T) {
+	s, cleanup := makeTestSpool(t, 0)
+	defer cleanup()
+	now := time.Now()
+	old := now.Add(-spoolMaxPointAge - time.Minute)
+
+	_, err := s.write([]APIMetric{makeAPIMetric("metric-1", old, now), makeAPIMetric("metric-2", old)}, old)
+	assert.NoError(t, err)
+	_, err = s.write([]APIMetric{makeAPIMetric("metric-3", old)}, old)
+	assert.NoError(t, err)
+
+	var drained [][]APIMetric
+	sent, expired, err := s.drain(now, func(batch []APIMetric) error {
+		drained = append(drained, batch)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), sent)
+	assert.Equal(t, uint64(3), expired)
+	// Batches left without any point aren't sent
+	if assert.Len(t, drained, 1) {
+		assert.Equal(t, []APIMetric{makeAPIMetric("metric-1", now)}, drained[0])
+	}
+}
+
+func TestSpoolDrainStopsAtFailure(t *testing.T) {
+	s, cleanup := makeTestSpool(t, 0)
+	defer cleanup()
+	now := time.Now()
+	for _, name := range []string{"metric-1", "metric-2", "metric-3"} {
+		_, err := s.write([]APIMetric{makeAPIMetric(name, now)}, now)
+		assert.NoError(t, err)
+	}
+
+	attempts := 0
+	sent, _, err := s.drain(now, func(batch []APIMetric) error {
+		attempts++
+		if batch[0].Name == "metric-2" {
+			return errors.New("the intake is unavailable")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, uint64(1), sent)
+
+	// The batch which couldn't be sent is left in the spool, in its place
+	assert.Equal(t, []string{"metric-2", "metric-3"}, drainNames(t, s, now))
+}
+
+func TestSpoolConcurrentDrains(t *testing.T) {
+	s, cleanup := makeTestSpool(t, 0)
+	defer cleanup()
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		_, err := s.write([]APIMetric{makeAPIMetric("metric", now)}, now)
+		assert.NoError(t, err)
+	}
+
+	// The spools of two listeners drain the same directory, and each batch is sent once
+	other := makeSpool(s.dir, 0)
+	var wg sync.WaitGroup
+	sent := make([]uint64, 2)
+	for i, sp := range []*spool{s, other} {
+		wg.Add(1)
+		go func(i int, sp *spool) {
+			defer wg.Done()
+			sent[i], _, _ = sp.drain(now, func(batch []APIMetric) error { return nil })
+		}(i, sp)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(50), sent[0]+sent[1])
+}
+
+func TestListenerSpillsAcrossInvocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	client := &flakyClient{failing: true}
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: client, TimeService: &mts, DisableFlushJitter: true, ShouldRetryOnFailure: true, SpillFailedBatches: true, SpoolDir: dir})
+
+	invoke := func(metric string) {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+		ml.AddDistributionMetric(metric, 1, mts.now, false)
+		ml.HandlerFinished(ctx, nil, nil)
+	}
+
+	// The batch of the first invocation can't be sent despite the retries, and is spilled
+	invoke("metric-1")
+	assert.Empty(t, client.sentNames())
+	assert.Equal(t, uint64(1), ml.Stats().PointsSpilled)
+
+	// The second invocation can't send the spilled batch either, which is kept, nor its own
+	invoke("metric-2")
+	assert.Empty(t, client.sentNames())
+	assert.Equal(t, uint64(2), ml.Stats().PointsSpilled)
+
+	// The third invocation sends the spilled batches, oldest first, before its own
+	client.setFailing(false)
+	invoke("metric-3")
+	assert.Equal(t, []string{"metric-1", "metric-2", "metric-3"}, client.sentNames())
+
+	stats := ml.Stats()
+	assert.Equal(t, uint64(2), stats.PointsUnspilled)
+	assert.Equal(t, uint64(3), stats.BatchesSent)
+	assert.Equal(t, uint64(0), stats.Drops.SendFailed)
+	// The spilled batches were given up on by their invocation, and delivered by a later one
+	assert.Equal(t, DeliveryStats{FirstTry: 1, Retried: 2, Failed: 2}, stats.Deliveries)
+}
+
+func TestListenerWithoutSpillDropsFailedBatches(t *testing.T) {
+	client := &flakyClient{failing: true}
+	mts := makeMockTimeService()
+	ml := MakeListener(Config{Client: client, TimeService: &mts, DisableFlushJitter: true})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	ml.AddDistributionMetric("metric-1", 1, mts.now, false)
+	ml.HandlerFinished(ctx, nil, nil)
+
+	assert.Equal(t, uint64(0), ml.Stats().PointsSpilled)
+	assert.Equal(t, uint64(1), ml.Stats().Drops.SendFailed)
+}
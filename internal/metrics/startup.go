@@ -0,0 +1,41 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/version"
+)
+
+// startupTags describe the version of the library and the features the listener runs with
+func (l *Listener) startupTags() []string {
+	return []string{
+		fmt.Sprintf("version:%s", version.DDLambdaVersion),
+		fmt.Sprintf("sink:%s", l.sinkInfo.Sink),
+		fmt.Sprintf("tracing_enabled:%t", l.config.TraceEnabled),
+		fmt.Sprintf("enhanced_metrics:%t", l.enhancedEnabled()),
+	}
+}
+
+// reportStartup sends the startup metric, and logs the same details as one structured line, so that they're
+// known even when metrics can't be sent. A custom client, such as the ones tests record metrics with, only gets
+// the metrics of the function.
+func (l *Listener) reportStartup() {
+	if l.sinkInfo.Sink != SinkCustom {
+		l.AddDistributionMetric(startupMetric, 1, l.timeService.Now(), false, l.startupTags()...)
+	}
+	logger.InfoWithFields(startupMetric, logger.Fields{
+		"version":          version.DDLambdaVersion,
+		"sink":             string(l.sinkInfo.Sink),
+		"tracing_enabled":  l.config.TraceEnabled,
+		"enhanced_metrics": l.enhancedEnabled(),
+	})
+}
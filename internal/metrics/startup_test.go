@@ -0,0 +1,81 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-lambda-go/internal/version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartupMetricOnFirstInvocation(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	ml := MakeListener(Config{APIKey: "12345", Site: server.URL, StartupMetric: true, TraceEnabled: true})
+
+	output := captureOutput(func() {
+		for i := 0; i < 2; i++ {
+			ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+			ml.HandlerFinished(ctx, nil, nil)
+		}
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, bodies, 1)
+	assert.Contains(t, bodies[0], startupMetric)
+	for _, tag := range []string{"version:" + version.DDLambdaVersion, "sink:api", "tracing_enabled:true", "enhanced_metrics:false"} {
+		assert.Contains(t, bodies[0], tag)
+	}
+	assert.Equal(t, 1, strings.Count(output, startupMetric))
+	assert.Contains(t, output, `"sink":"api"`)
+	assert.Contains(t, output, `"tracing_enabled":true`)
+}
+
+func TestStartupMetricIsOnlyLoggedWithCustomClient(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, StartupMetric: true})
+
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+
+	assert.Len(t, mc.batches, 0)
+	assert.Contains(t, output, startupMetric)
+	assert.Contains(t, output, `"sink":"custom"`)
+}
+
+func TestStartupMetricDisabled(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc})
+
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+		ml.HandlerFinished(ctx, nil, nil)
+	})
+
+	assert.NotContains(t, output, startupMetric)
+}
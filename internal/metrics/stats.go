@@ -0,0 +1,145 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import "sync/atomic"
+
+type (
+	// Stats counts the metrics handled since the container started. MetricsAdded counts the metrics sent
+	// to every sink, while the other counters only concern the metrics sent to the Datadog API.
+	Stats struct {
+		// MetricsAdded counts the metrics sent with AddDistributionMetric, including the enhanced metrics
+		MetricsAdded uint64 `json:"metrics_added"`
+		// PointsBuffered counts the points added to the batches of the processor
+		PointsBuffered uint64 `json:"points_buffered"`
+		// BatchesSent counts the batches successfully sent to the API
+		BatchesSent uint64 `json:"batches_sent"`
+		// SendFailures counts the failed attempts to send a batch, including retries
+		SendFailures uint64 `json:"send_failures"`
+		// Retries counts the attempts to send a batch again after a failure
+		Retries uint64 `json:"retries"`
+		// TagsNormalized counts the tags modified or dropped by the tag normalization
+		TagsNormalized uint64 `json:"tags_normalized"`
+		// InvalidSampleRates counts the metrics rejected because their sample rate wasn't in (0, 1]
+		InvalidSampleRates uint64 `json:"invalid_sample_rates"`
+		// PointsClamped counts the points whose timestamp was moved back to the max future skew after the clock
+		// of the container
+		PointsClamped uint64 `json:"points_clamped"`
+		// PointsTimestamped counts the points added without a timestamp, which were given the time they were added
+		PointsTimestamped uint64 `json:"points_timestamped"`
+		// PointsSpilled counts the points of the batches written to the spool, as they couldn't be sent
+		PointsSpilled uint64 `json:"points_spilled"`
+		// PointsUnspilled counts the spilled points sent by a later invocation
+		PointsUnspilled uint64 `json:"points_unspilled"`
+		// FlushesCapped counts the invocations which stopped waiting for their last flush after the max flush
+		// duration
+		FlushesCapped uint64 `json:"flushes_capped"`
+		// FlushesFailedFast counts the flushes which gave up on their batch without sending it, as the previous
+		// flushes of the invocation exhausted its retry budget
+		FlushesFailedFast uint64 `json:"flushes_failed_fast"`
+		// EventAgesClamped counts the event ages sent as 0 as the event was more recent than the clock of the
+		// container
+		EventAgesClamped uint64 `json:"event_ages_clamped"`
+		// ChannelHighWaterMark is the most metrics waiting in the buffer of the current invocation to be batched.
+		// It starts over with each invocation, and stays 0 with Config.SyncFlushOnly or Config.ShardedBuffers.
+		ChannelHighWaterMark uint64 `json:"channel_high_water_mark"`
+		// Deliveries counts the batches by the outcome of their delivery to the API
+		Deliveries DeliveryStats `json:"deliveries"`
+		// Drops counts the points which were never sent, by reason
+		Drops DropStats `json:"drops"`
+		// TopEmitters are the metric names which emitted the most points, across every sink, the most first
+		TopEmitters []EmitterCount `json:"top_emitters,omitempty"`
+	}
+
+	// DeliveryStats counts the batches by the outcome of their delivery to the API, to tell a flaky intake which
+	// eventually received every batch from one which lost some
+	DeliveryStats struct {
+		// FirstTry counts the batches sent on their first attempt
+		FirstTry uint64 `json:"first_try"`
+		// Retried counts the batches sent after failed attempts, including the spilled batches sent by a later
+		// invocation
+		Retried uint64 `json:"retried"`
+		// Failed counts the batches given up on after their failed attempts, whose points were spilled or dropped
+		Failed uint64 `json:"failed"`
+	}
+
+	// DropStats counts the points which were never sent, by reason
+	DropStats struct {
+		// Cancelled counts the points sent after the processor was torn down by the cancellation of its
+		// context, or still batched when that happened
+		Cancelled uint64 `json:"cancelled"`
+		// PendingFull counts the points sent after their invocation finished, when too many were pending
+		PendingFull uint64 `json:"pending_full"`
+		// PreInitFull counts the points sent before the first invocation, when too many were buffered
+		PreInitFull uint64 `json:"pre_init_full"`
+		// SendFailed counts the points of batches which couldn't be sent to the API, nor spilled
+		SendFailed uint64 `json:"send_failed"`
+		// SpoolFull counts the spilled points evicted to make room for newer batches
+		SpoolFull uint64 `json:"spool_full"`
+		// SpoolExpired counts the spilled points too old to be accepted by the intake when they were drained
+		SpoolExpired uint64 `json:"spool_expired"`
+		// FlushCapped counts the points of the flushes cut short by the max flush duration which couldn't be sent
+		// nor spilled
+		FlushCapped uint64 `json:"flush_capped"`
+		// MissingTimestamp counts the points rejected because they had no timestamp
+		MissingTimestamp uint64 `json:"missing_timestamp"`
+	}
+)
+
+// snapshot reads the counters atomically, as they're updated by the processing goroutines
+func (s *Stats) snapshot() Stats {
+	return Stats{
+		MetricsAdded:       atomic.LoadUint64(&s.MetricsAdded),
+		PointsBuffered:     atomic.LoadUint64(&s.PointsBuffered),
+		BatchesSent:        atomic.LoadUint64(&s.BatchesSent),
+		SendFailures:       atomic.LoadUint64(&s.SendFailures),
+		Retries:            atomic.LoadUint64(&s.Retries),
+		TagsNormalized:     atomic.LoadUint64(&s.TagsNormalized),
+		InvalidSampleRates: atomic.LoadUint64(&s.InvalidSampleRates),
+		PointsClamped:      atomic.LoadUint64(&s.PointsClamped),
+		PointsTimestamped:  atomic.LoadUint64(&s.PointsTimestamped),
+		PointsSpilled:      atomic.LoadUint64(&s.PointsSpilled),
+		PointsUnspilled:    atomic.LoadUint64(&s.PointsUnspilled),
+		FlushesCapped:      atomic.LoadUint64(&s.FlushesCapped),
+		FlushesFailedFast:  atomic.LoadUint64(&s.FlushesFailedFast),
+		EventAgesClamped:   atomic.LoadUint64(&s.EventAgesClamped),
+		Deliveries: DeliveryStats{
+			FirstTry: atomic.LoadUint64(&s.Deliveries.FirstTry),
+			Retried:  atomic.LoadUint64(&s.Deliveries.Retried),
+			Failed:   atomic.LoadUint64(&s.Deliveries.Failed),
+		},
+		Drops: DropStats{
+			Cancelled:        atomic.LoadUint64(&s.Drops.Cancelled),
+			PendingFull:      atomic.LoadUint64(&s.Drops.PendingFull),
+			PreInitFull:      atomic.LoadUint64(&s.Drops.PreInitFull),
+			SendFailed:       atomic.LoadUint64(&s.Drops.SendFailed),
+			SpoolFull:        atomic.LoadUint64(&s.Drops.SpoolFull),
+			SpoolExpired:     atomic.LoadUint64(&s.Drops.SpoolExpired),
+			FlushCapped:      atomic.LoadUint64(&s.Drops.FlushCapped),
+			MissingTimestamp: atomic.LoadUint64(&s.Drops.MissingTimestamp),
+		},
+	}
+}
+
+// pointCount returns the number of points of a metric
+func pointCount(m Metric) uint64 {
+	if d, ok := m.(*Distribution); ok {
+		return uint64(len(d.Values))
+	}
+	return 1
+}
+
+// apiPointCount returns the number of points of metrics converted for the API
+func apiPointCount(mts []APIMetric) uint64 {
+	count := uint64(0)
+	for _, m := range mts {
+		count += uint64(len(m.Points))
+	}
+	return count
+}
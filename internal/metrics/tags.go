@@ -0,0 +1,199 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// tagNormalizer normalizes the tags of the metrics of a listener. It counts the modified tags, and logs each
+// distinct offending tag once per container.
+type tagNormalizer struct {
+	stats *Stats
+	// mu guards logged, the offending tags already logged
+	mu     sync.Mutex
+	logged map[string]struct{}
+}
+
+const (
+	// maxTagLength is the number of characters above which Datadog truncates tags
+	maxTagLength = 200
+	// maxLoggedTags bounds the number of distinct offending tags remembered to log each of them once
+	maxLoggedTags = 1000
+)
+
+// MergeTags merges levels of tags, from the highest precedence to the lowest: the tags of a metric, the tags of
+// its invocation, and the global tags. A tag key, the part before the first colon, set at one level hides the
+// tags with the same key at the lower levels, so that a metric sent with env:dev isn't also tagged with the
+// env:prod of DD_TAGS. Tags with the same key at the same level are all kept, and bare tags without a colon are
+// always kept.
+func MergeTags(levels ...[]string) []string {
+	return mergeTags(nil, levels...)
+}
+
+// mergeTags merges levels of tags like MergeTags. When normalize isn't nil, each tag is normalized in the same
+// pass, before its key is read, and dropped if its normalized form is empty.
+func mergeTags(normalize func(tag string) string, levels ...[]string) []string {
+	nonEmpty := 0
+	var only []string
+	for _, level := range levels {
+		if len(level) > 0 {
+			nonEmpty++
+			only = level
+		}
+	}
+	if nonEmpty <= 1 && (normalize == nil || allNormalized(only)) {
+		// Nothing to merge, which is the common case of metrics without invocation nor global tags. The capacity
+		// is limited, so that appending to the result never writes to the shared global or invocation tags.
+		return only[:len(only):len(only)]
+	}
+
+	length := 0
+	for _, level := range levels {
+		length += len(level)
+	}
+	merged := make([]string, 0, length)
+	// keys holds the keys set by the higher levels
+	keys := map[string]struct{}{}
+	for _, level := range levels {
+		levelStart := len(merged)
+		for _, tag := range level {
+			if normalize != nil {
+				if tag = normalize(tag); tag == "" {
+					continue
+				}
+			}
+			key, ok := tagKey(tag)
+			if !ok {
+				merged = append(merged, tag)
+				continue
+			}
+			if _, hidden := keys[key]; hidden {
+				continue
+			}
+			merged = append(merged, tag)
+		}
+		// The keys of this level hide the lower levels only once the whole level was added
+		for _, tag := range merged[levelStart:] {
+			if key, ok := tagKey(tag); ok {
+				keys[key] = struct{}{}
+			}
+		}
+	}
+	return merged
+}
+
+// tagKey returns the part of a tag before its first colon, and false for bare tags without a colon
+func tagKey(tag string) (string, bool) {
+	i := strings.IndexByte(tag, ':')
+	if i < 0 {
+		return "", false
+	}
+	return tag[:i], true
+}
+
+// NormalizeTag applies the constraints of Datadog to a tag: it's lowercased, the characters other than letters,
+// digits, underscores, minuses, colons, periods and slashes are replaced with underscores, and it's truncated to
+// 200 characters. It returns an empty string for tags left without a letter or digit, which should be dropped.
+func NormalizeTag(tag string) string {
+	if isNormalized(tag) {
+		return tag
+	}
+	var builder strings.Builder
+	builder.Grow(len(tag))
+	length := 0
+	meaningful := false
+	for _, r := range tag {
+		if length == maxTagLength {
+			break
+		}
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			meaningful = true
+			builder.WriteRune(unicode.ToLower(r))
+		case r == '_' || r == '-' || r == ':' || r == '.' || r == '/':
+			builder.WriteRune(r)
+		default:
+			builder.WriteByte('_')
+		}
+		length++
+	}
+	if !meaningful {
+		return ""
+	}
+	return builder.String()
+}
+
+// isNormalized returns true for tags which NormalizeTag leaves unchanged, without allocating. Only ASCII tags
+// are checked, as the others are rare.
+func isNormalized(tag string) bool {
+	if len(tag) > maxTagLength {
+		// Longer ASCII tags have too many characters
+		return false
+	}
+	meaningful := false
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case 'a' <= c && c <= 'z' || '0' <= c && c <= '9':
+			meaningful = true
+		case c == '_' || c == '-' || c == ':' || c == '.' || c == '/':
+		default:
+			return false
+		}
+	}
+	return meaningful
+}
+
+// allNormalized returns true when NormalizeTag leaves all the tags unchanged
+func allNormalized(tags []string) bool {
+	for _, tag := range tags {
+		if !isNormalized(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func makeTagNormalizer(stats *Stats) *tagNormalizer {
+	return &tagNormalizer{stats: stats, logged: map[string]struct{}{}}
+}
+
+// normalize returns the normalized form of a tag, or an empty string if it should be dropped
+func (n *tagNormalizer) normalize(tag string) string {
+	normalized := NormalizeTag(tag)
+	if normalized == tag {
+		return tag
+	}
+	atomic.AddUint64(&n.stats.TagsNormalized, 1)
+	if !logger.DebugEnabled() {
+		return normalized
+	}
+
+	n.mu.Lock()
+	_, seen := n.logged[tag]
+	if !seen && len(n.logged) < maxLoggedTags {
+		n.logged[tag] = struct{}{}
+	} else {
+		seen = true
+	}
+	n.mu.Unlock()
+	if !seen {
+		logger.DebugWithFields("normalized a metric tag which doesn't meet the constraints of Datadog", logger.Fields{
+			"tag":        tag,
+			"normalized": normalized,
+		})
+	}
+	return normalized
+}
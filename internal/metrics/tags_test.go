@@ -0,0 +1,72 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeTagsPrecedence(t *testing.T) {
+	metricTags := []string{"env:dev"}
+	invocationTags := []string{"env:staging", "team:orders"}
+	globalTags := []string{"env:prod", "team:platform", "service:api"}
+
+	assert.Equal(t, []string{"env:dev", "team:orders", "service:api"}, MergeTags(metricTags, invocationTags, globalTags))
+	assert.Equal(t, []string{"env:staging", "team:orders", "service:api"}, MergeTags(nil, invocationTags, globalTags))
+	assert.Equal(t, []string{"env:dev", "team:platform", "service:api"}, MergeTags(metricTags, nil, globalTags))
+}
+
+func TestMergeTagsKeepsValuesOfTheSameLevel(t *testing.T) {
+	// Multiple values of a key at the same level are kept, and all of them hide the lower levels
+	merged := MergeTags([]string{"team:a", "team:b"}, []string{"team:c"}, nil)
+	assert.Equal(t, []string{"team:a", "team:b"}, merged)
+}
+
+func TestMergeTagsKeepsBareTags(t *testing.T) {
+	merged := MergeTags([]string{"canary", "url:https://example.com:8080"}, nil, []string{"canary", "url:https://other", "beta"})
+	assert.Equal(t, []string{"canary", "url:https://example.com:8080", "canary", "beta"}, merged)
+}
+
+func TestMergeTagsSingleLevel(t *testing.T) {
+	globalTags := make([]string, 1, 4)
+	globalTags[0] = "env:prod"
+
+	merged := MergeTags(nil, nil, globalTags)
+	assert.Equal(t, []string{"env:prod"}, merged)
+	// Appending to the result doesn't write to the global tags
+	merged = append(merged, "dd_lambda_layer:test")
+	assert.Equal(t, "env:prod", globalTags[:2][0])
+	assert.Equal(t, "", globalTags[:2][1])
+
+	assert.Empty(t, MergeTags(nil, nil, nil))
+}
+
+func TestNormalizeTag(t *testing.T) {
+	assert.Equal(t, "env:prod", NormalizeTag("env:prod"))
+	assert.Equal(t, "env:prod", NormalizeTag("Env:PROD"))
+	assert.Equal(t, "region:eu_west", NormalizeTag("region:eu west"))
+	assert.Equal(t, "user:bob_example.com", NormalizeTag("user:bob@example.com"))
+	assert.Equal(t, "path:/a/b-c_d", NormalizeTag("path:/a/b-c_d"))
+	assert.Equal(t, "city:zürich", NormalizeTag("city:Zürich"))
+	assert.Equal(t, "", NormalizeTag("!!!"))
+	assert.Equal(t, "", NormalizeTag(":"))
+	assert.Equal(t, "", NormalizeTag(""))
+
+	long := NormalizeTag("key:" + strings.Repeat("é", 300))
+	assert.Equal(t, maxTagLength, utf8.RuneCountInString(long))
+}
+
+func TestMergeTagsNormalizesBeforeReadingKeys(t *testing.T) {
+	merged := mergeTags(NormalizeTag, []string{"Env:Dev", "!!!"}, nil, []string{"env:prod", "team:a"})
+	assert.Equal(t, []string{"env:dev", "team:a"}, merged)
+}
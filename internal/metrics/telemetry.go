@@ -0,0 +1,93 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	flushDurationMetric = "datadog.lambda_go.flush.duration"
+	flushBytesMetric    = "datadog.lambda_go.flush.bytes"
+	flushRetriesMetric  = "datadog.lambda_go.flush.retries"
+	flushBatchesMetric  = "datadog.lambda_go.flush.batches"
+)
+
+type (
+	// Telemetry measures the flushes of metrics done by the library. The measures of a flush are sent with the
+	// next one, so that sending them never triggers a flush of their own. A nil Telemetry measures nothing.
+	Telemetry struct {
+		mu      sync.Mutex
+		pending []*Distribution
+	}
+
+	// payloadSizer is implemented by clients which know the size of the last payload they sent
+	payloadSizer interface {
+		lastPayloadSize() int
+	}
+)
+
+// MakeTelemetry creates a Telemetry, shared by the processors of a listener
+func MakeTelemetry() *Telemetry {
+	return &Telemetry{}
+}
+
+// recordFlush keeps the measures of a flush until the next one. A negative size or number of retries is
+// unknown, and isn't sent.
+func (t *Telemetry) recordFlush(timestamp time.Time, duration time.Duration, bytes int, retries int, success bool) {
+	if t == nil {
+		return
+	}
+	outcome := "outcome:success"
+	if !success {
+		outcome = "outcome:failure"
+	}
+	tags := []string{outcome, getRuntimeTag()}
+	measure := func(name string, value float64) *Distribution {
+		d := &Distribution{Name: name, Tags: tags}
+		d.AddPoint(timestamp, value)
+		return d
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, measure(flushDurationMetric, duration.Seconds()))
+	if bytes >= 0 {
+		t.pending = append(t.pending, measure(flushBytesMetric, float64(bytes)))
+	}
+	if retries >= 0 {
+		t.pending = append(t.pending, measure(flushRetriesMetric, float64(retries)))
+	}
+}
+
+// recordDelivery counts a batch by the outcome of its delivery, such as first_try, until the next flush
+func (t *Telemetry) recordDelivery(timestamp time.Time, delivery string) {
+	if t == nil {
+		return
+	}
+	d := &Distribution{Name: flushBatchesMetric, Tags: []string{"delivery:" + delivery, getRuntimeTag()}}
+	d.AddPoint(timestamp, 1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, d)
+}
+
+// drain returns the measures kept since the last flush, and forgets them
+func (t *Telemetry) drain() []*Distribution {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.pending
+	t.pending = nil
+	return pending
+}
@@ -0,0 +1,107 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sizedMockClient is a mockClient which knows the size of its payloads, like the APIClient
+type sizedMockClient struct {
+	mockClient
+}
+
+func (mc *sizedMockClient) lastPayloadSize() int {
+	return 42
+}
+
+// apiMetricsByName indexes a batch by metric name
+func apiMetricsByName(batch []APIMetric) map[string]APIMetric {
+	byName := map[string]APIMetric{}
+	for _, m := range batch {
+		byName[m.Name] = m
+	}
+	return byName
+}
+
+// flushWithSyncProcessor sends a batch with the given metrics through a new sync processor
+func flushWithSyncProcessor(mc Client, mts *mockTimeService, shouldRetry bool, telemetry *Telemetry, metrics ...string) {
+	pr := makeTestProcessor(context.Background(), mc, mts, processorOptions{syncFlushOnly: true, batchInterval: 1000, shouldRetryOnFail: shouldRetry, telemetry: telemetry})
+	pr.StartProcessing()
+	for _, name := range metrics {
+		pr.AddMetric(&Distribution{Name: name, Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	}
+	pr.FinishProcessing()
+}
+
+func TestTelemetryRecordFlush(t *testing.T) {
+	telemetry := MakeTelemetry()
+	now := time.Now()
+
+	telemetry.recordFlush(now, 2*time.Second, -1, 1, false)
+	pending := telemetry.drain()
+	assert.Len(t, pending, 2)
+	assert.Equal(t, flushDurationMetric, pending[0].Name)
+	assert.Equal(t, []MetricValue{{Timestamp: now, Value: 2}}, pending[0].Values)
+	assert.Equal(t, []string{"outcome:failure", getRuntimeTag()}, pending[0].Tags)
+	assert.Equal(t, flushRetriesMetric, pending[1].Name)
+	assert.Empty(t, telemetry.drain())
+
+	// A nil Telemetry measures nothing
+	var disabled *Telemetry
+	disabled.recordFlush(now, time.Second, 10, 0, true)
+	assert.Empty(t, disabled.drain())
+}
+
+func TestProcessorTelemetryRidesOnNextFlush(t *testing.T) {
+	mc := &sizedMockClient{makeMockClient()}
+	mts := makeMockTimeService()
+	telemetry := MakeTelemetry()
+
+	flushWithSyncProcessor(mc, &mts, false, telemetry, "metric-1")
+	assert.Len(t, <-mc.batches, 1)
+
+	// Without other metrics, the measures wait for the next flush instead of causing one
+	flushWithSyncProcessor(mc, &mts, false, telemetry)
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+
+	flushWithSyncProcessor(mc, &mts, false, telemetry, "metric-2")
+	batch := apiMetricsByName(<-mc.batches)
+	assert.Len(t, batch, 5)
+	assert.Contains(t, batch, "metric-2")
+	assert.Equal(t, []string{getRuntimeTag(), "delivery:first_try"}, batch[flushBatchesMetric].Tags)
+	assert.Equal(t, []string{getRuntimeTag(), "outcome:success"}, batch[flushDurationMetric].Tags)
+	assert.Equal(t, []interface{}{[]interface{}{float64(mts.now.Unix()), []interface{}{float64(42)}}}, batch[flushBytesMetric].Points)
+	assert.Equal(t, []interface{}{[]interface{}{float64(mts.now.Unix()), []interface{}{float64(0)}}}, batch[flushRetriesMetric].Points)
+}
+
+func TestProcessorTelemetryCountsRetries(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("Some error")
+	mts := makeMockTimeService()
+	telemetry := MakeTelemetry()
+
+	flushWithSyncProcessor(&mc, &mts, true, telemetry, "metric-1")
+	assert.Equal(t, 3, mc.sendMetricsCalledCount)
+
+	pending := telemetry.drain()
+	// The mock client doesn't know the size of its payloads
+	assert.Len(t, pending, 3)
+	assert.Equal(t, flushRetriesMetric, pending[1].Name)
+	assert.Equal(t, float64(2), pending[1].Values[0].Value)
+	assert.Equal(t, []string{"outcome:failure", getRuntimeTag()}, pending[1].Tags)
+	// The batch is given up on once its retries failed
+	assert.Equal(t, flushBatchesMetric, pending[2].Name)
+	assert.Equal(t, []string{"delivery:failed", getRuntimeTag()}, pending[2].Tags)
+}
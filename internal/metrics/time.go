@@ -8,19 +8,45 @@
 
 package metrics
 
-import "time"
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
 
 type (
 	//TimeService wraps common time related operations
 	TimeService interface {
 		NewTicker(duration time.Duration) *time.Ticker
 		Now() time.Time
+		Sleep(duration time.Duration)
+		// After returns a channel which receives the time once duration has elapsed, like time.After
+		After(duration time.Duration) <-chan time.Time
 	}
 
 	timeService struct {
 	}
+
+	// jitteredTimeService spreads the ticks of the processors, so that the containers of a deployment don't
+	// flush at the same time
+	jitteredTimeService struct {
+		TimeService
+		// mu guards rand, which isn't safe for concurrent use
+		mu   sync.Mutex
+		rand *rand.Rand
+		// phase is drawn once per container, and sets the delay before the first tick of each processor
+		phase float64
+	}
+
+	// tickJitterer is implemented by time services which choose the period of each tick of the processors
+	tickJitterer interface {
+		tickPeriod(interval time.Duration, first bool) time.Duration
+	}
 )
 
+// tickJitterRatio is the largest difference between the period of a tick after the first one and the interval
+const tickJitterRatio = 0.1
+
 // MakeTimeService creates a new time service
 func MakeTimeService() TimeService {
 	return &timeService{}
@@ -33,3 +59,38 @@ func (ts *timeService) NewTicker(duration time.Duration) *time.Ticker {
 func (ts *timeService) Now() time.Time {
 	return time.Now()
 }
+
+func (ts *timeService) Sleep(duration time.Duration) {
+	time.Sleep(duration)
+}
+
+func (ts *timeService) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+// MakeJitteredTimeService wraps a TimeService so that the first tick of each processor comes after a delay drawn
+// once, uniformly over one interval, and the next ones after the interval with up to 10% of jitter either way.
+// The ticks are drawn from rng, which defaults to a source seeded with the current time.
+func MakeJitteredTimeService(ts TimeService, rng *rand.Rand) TimeService {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &jitteredTimeService{TimeService: ts, rand: rng, phase: rng.Float64()}
+}
+
+func (ts *jitteredTimeService) tickPeriod(interval time.Duration, first bool) time.Duration {
+	var period time.Duration
+	if first {
+		period = time.Duration((1 - ts.phase) * float64(interval))
+	} else {
+		ts.mu.Lock()
+		jitter := (ts.rand.Float64()*2 - 1) * tickJitterRatio
+		ts.mu.Unlock()
+		period = time.Duration((1 + jitter) * float64(interval))
+	}
+	if period <= 0 {
+		// Tickers can't have a zero period
+		return interval
+	}
+	return period
+}
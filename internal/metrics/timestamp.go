@@ -0,0 +1,168 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// maxPlausibleUnix is the first second of the year 3000. Timestamps after it come from epochs in milliseconds,
+// microseconds or nanoseconds which were passed as seconds, such as time.Unix(millis, 0).
+var maxPlausibleUnix = time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// implausibleTimestampOnce logs the first implausible timestamp, so that a handler passing them on every
+// invocation doesn't flood the logs
+var implausibleTimestampOnce sync.Once
+
+// missingTimestampOnce logs the first metric with a point without a timestamp
+var missingTimestampOnce sync.Once
+
+// MetricValueMs creates a point from a Unix epoch in milliseconds, as found in many event payloads
+func MetricValueMs(ms int64, value float64) MetricValue {
+	return MetricValue{Timestamp: time.Unix(0, ms*int64(time.Millisecond)), Value: value}
+}
+
+// normalizeTimestamp converts a timestamp after the year 3000 back to a plausible one, assuming its seconds are
+// actually milliseconds, microseconds or nanoseconds, whichever brings it before the year 3000. The intake
+// would drop the points otherwise.
+func normalizeTimestamp(metric string, timestamp time.Time) time.Time {
+	epoch := timestamp.Unix()
+	if epoch <= maxPlausibleUnix {
+		return timestamp
+	}
+	unit, nanosPerUnit := "milliseconds", int64(time.Millisecond)
+	switch {
+	case epoch > maxPlausibleUnix*1000000:
+		unit, nanosPerUnit = "nanoseconds", int64(time.Nanosecond)
+	case epoch > maxPlausibleUnix*1000:
+		unit, nanosPerUnit = "microseconds", int64(time.Microsecond)
+	}
+	normalized := time.Unix(0, epoch*nanosPerUnit)
+	implausibleTimestampOnce.Do(func() {
+		logger.Warn(fmt.Sprintf("the timestamp of metric %s is in the year %d, so it's read as a Unix epoch in %s, %s. Use MetricValueMs or time.Unix(0, nanoseconds) for epochs which aren't in seconds.",
+			metric, timestamp.Year(), unit, normalized.UTC().Format(time.RFC3339)))
+	})
+	return normalized
+}
+
+// timestamper is a metric whose points can be missing their timestamp
+type timestamper interface {
+	// stampMissing sets the missing timestamps to now, and returns the number of points changed
+	stampMissing(now time.Time) uint64
+	// dropMissing removes the points without a timestamp. It returns the number of points removed, and
+	// whether the metric has points left.
+	dropMissing() (dropped uint64, left bool)
+}
+
+// isMissingTimestamp tells whether a timestamp was left unset, either as the zero time or as the Unix epoch,
+// which the intake drops
+func isMissingTimestamp(timestamp time.Time) bool {
+	return timestamp.IsZero() || timestamp.Unix() == 0
+}
+
+// fixMissingTimestamps gives the points of a metric without a timestamp the current time, or drops them when the
+// processor rejects them. It returns an error wrapping ErrInvalidMetric when no point is left.
+func (p *processor) fixMissingTimestamps(metric Metric) error {
+	t, ok := metric.(timestamper)
+	if !ok {
+		return nil
+	}
+	if p.rejectMissingTimestamps {
+		dropped, left := t.dropMissing()
+		atomic.AddUint64(&p.stats.Drops.MissingTimestamp, dropped)
+		if !left {
+			return fmt.Errorf("%w: metric %s has no timestamp", ErrInvalidMetric, metric.ToBatchKey().name)
+		}
+		return nil
+	}
+	if stamped := t.stampMissing(p.timeService.Now()); stamped > 0 {
+		atomic.AddUint64(&p.stats.PointsTimestamped, stamped)
+		missingTimestampOnce.Do(func() {
+			logger.Debug(fmt.Sprintf("metric %s has points without a timestamp, they're sent at the time they were added. This is logged once per container.",
+				metric.ToBatchKey().name))
+		})
+	}
+	return nil
+}
+
+func (d *Distribution) stampMissing(now time.Time) uint64 {
+	stamped := uint64(0)
+	for i := range d.Values {
+		if isMissingTimestamp(d.Values[i].Timestamp) {
+			d.Values[i].Timestamp = now
+			stamped++
+		}
+	}
+	return stamped
+}
+
+func (d *Distribution) dropMissing() (uint64, bool) {
+	values := d.Values[:0]
+	for _, value := range d.Values {
+		if !isMissingTimestamp(value.Timestamp) {
+			values = append(values, value)
+		}
+	}
+	dropped := uint64(len(d.Values) - len(values))
+	d.Values = values
+	return dropped, len(values) > 0
+}
+
+func (s *Set) stampMissing(now time.Time) uint64 {
+	return stampTimestamp(&s.Timestamp, now)
+}
+
+func (s *Set) dropMissing() (uint64, bool) {
+	return dropTimestamp(s.Timestamp)
+}
+
+func (c *Count) stampMissing(now time.Time) uint64 {
+	return stampTimestamp(&c.Timestamp, now)
+}
+
+func (c *Count) dropMissing() (uint64, bool) {
+	return dropTimestamp(c.Timestamp)
+}
+
+func (g *Gauge) stampMissing(now time.Time) uint64 {
+	return stampTimestamp(&g.Timestamp, now)
+}
+
+func (g *Gauge) dropMissing() (uint64, bool) {
+	return dropTimestamp(g.Timestamp)
+}
+
+func (r *Rate) stampMissing(now time.Time) uint64 {
+	return stampTimestamp(&r.Timestamp, now)
+}
+
+func (r *Rate) dropMissing() (uint64, bool) {
+	return dropTimestamp(r.Timestamp)
+}
+
+func stampTimestamp(timestamp *time.Time, now time.Time) uint64 {
+	if isMissingTimestamp(*timestamp) {
+		*timestamp = now
+		return 1
+	}
+	return 0
+}
+
+// dropTimestamp drops the point of a metric with a single timestamp when it's missing
+func dropTimestamp(timestamp time.Time) (uint64, bool) {
+	if isMissingTimestamp(timestamp) {
+		return 1, false
+	}
+	return 0, true
+}
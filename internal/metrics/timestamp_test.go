@@ -0,0 +1,140 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTimestamp(t *testing.T) {
+	implausibleTimestampOnce = sync.Once{}
+	expected := time.Date(2024, time.March, 1, 12, 30, 15, 250000000, time.UTC)
+
+	// Seconds are kept as they are, with their fraction
+	assert.True(t, expected.Equal(normalizeTimestamp("my-metric", expected)))
+
+	var output string
+	for _, timestamp := range []time.Time{
+		time.Unix(expected.UnixNano()/int64(time.Millisecond), 0),
+		time.Unix(expected.UnixNano()/int64(time.Microsecond), 0),
+		time.Unix(expected.UnixNano(), 0),
+	} {
+		output += captureOutput(func() {
+			assert.True(t, expected.Equal(normalizeTimestamp("my-metric", timestamp)), timestamp.Unix())
+		})
+	}
+
+	// Only the first implausible timestamp is logged
+	assert.Equal(t, 1, strings.Count(output, "the timestamp of metric my-metric"))
+	assert.Contains(t, output, "read as a Unix epoch in milliseconds, 2024-03-01T12:30:15Z")
+}
+
+func TestNormalizeTimestampKeepsPlausibleFutures(t *testing.T) {
+	future := time.Date(2999, time.December, 31, 0, 0, 0, 0, time.UTC)
+	assert.True(t, future.Equal(normalizeTimestamp("my-metric", future)))
+}
+
+func TestMetricValueMs(t *testing.T) {
+	point := MetricValueMs(1709296215250, 3)
+	assert.Equal(t, 3.0, point.Value)
+	assert.True(t, time.Date(2024, time.March, 1, 12, 30, 15, 250000000, time.UTC).Equal(point.Timestamp))
+}
+
+func TestAddDistributionMetricNormalizesTimestamp(t *testing.T) {
+	mc := makeMockClient()
+	listener := MakeListener(Config{Client: &mc})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	captureOutput(func() {
+		listener.AddDistributionMetric("my-metric", 1, time.Unix(1709296215250, 0), false)
+	})
+	listener.HandlerFinished(ctx, nil, nil)
+
+	batch := <-mc.batches
+	assert.Equal(t, float64(1709296215), batch[0].Points[0].([]interface{})[0])
+}
+
+func TestProcessorStampsMissingTimestamps(t *testing.T) {
+	missingTimestampOnce = sync.Once{}
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	stats := &Stats{}
+	stamped := time.Unix(1600000000, 0)
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: time.Hour, stats: stats})
+	pr.StartProcessing()
+	dm := Distribution{Name: "latency", Values: []MetricValue{
+		{Value: 1},
+		{Timestamp: stamped, Value: 2},
+		{Timestamp: time.Unix(0, 0), Value: 3},
+	}}
+	assert.NoError(t, pr.AddMetric(&dm))
+	assert.NoError(t, pr.AddMetric(&Count{Name: "requests", Value: 1}))
+	pr.FinishProcessing()
+
+	batch := <-mc.batches
+	now := float64(mts.Now().Unix())
+	for _, metric := range batch {
+		if metric.MetricType == DistributionType {
+			var timestamps []float64
+			for _, point := range metric.Points {
+				timestamps = append(timestamps, point.([]interface{})[0].(float64))
+			}
+			assert.ElementsMatch(t, []float64{now, float64(stamped.Unix()), now}, timestamps)
+		} else {
+			// The count is rolled up into the bucket of the time it was added
+			assert.InDelta(t, now, metric.Points[0].([]interface{})[0], defaultAggregationBucket.Seconds())
+		}
+	}
+	assert.Len(t, batch, 2)
+	assert.Equal(t, uint64(3), stats.snapshot().PointsTimestamped)
+	assert.Equal(t, uint64(0), stats.snapshot().Drops.MissingTimestamp)
+}
+
+func TestProcessorRejectsMissingTimestamps(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	stats := &Stats{}
+	stamped := time.Unix(1600000000, 0)
+
+	pr := makeTestProcessor(context.Background(), &mc, &mts, processorOptions{batchInterval: time.Hour, stats: stats, rejectMissingTimestamps: true})
+	pr.StartProcessing()
+	dm := Distribution{Name: "latency", Values: []MetricValue{{Value: 1}, {Timestamp: stamped, Value: 2}, {Value: 3}}}
+	assert.NoError(t, pr.AddMetric(&dm))
+	err := pr.AddMetric(&Gauge{Name: "queue.depth", Value: 1})
+	pr.FinishProcessing()
+
+	assert.True(t, errors.Is(err, ErrInvalidMetric))
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, []interface{}{[]interface{}{float64(stamped.Unix()), []interface{}{float64(2)}}}, batch[0].Points)
+	assert.Equal(t, uint64(3), stats.snapshot().Drops.MissingTimestamp)
+	assert.Equal(t, uint64(0), stats.snapshot().PointsTimestamped)
+}
+
+func TestListenerReturnsMissingTimestampRejection(t *testing.T) {
+	mc := makeMockClient()
+	ml := MakeListener(Config{Client: &mc, RejectMissingTimestamps: true})
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+
+	err := ml.AddDistributionMetric("latency", 1, time.Time{}, false)
+	ml.HandlerFinished(ctx, nil, nil)
+
+	assert.True(t, errors.Is(err, ErrInvalidMetric))
+	// The rejected metric isn't kept as pending either
+	assert.Equal(t, uint64(0), ml.Stats().Drops.PendingFull)
+	assert.Equal(t, uint64(1), ml.Stats().Drops.MissingTimestamp)
+}
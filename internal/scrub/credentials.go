@@ -0,0 +1,92 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package scrub
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// visibleCredentialSuffix is the number of characters of a credential left visible, to tell keys apart
+const visibleCredentialSuffix = 4
+
+type (
+	// CredentialScrubber masks credentials: the secrets it was given wherever they appear, and the values of
+	// the query parameters and headers which carry Datadog credentials. It's always applied to the logs,
+	// whether or not a Scrubber was configured.
+	CredentialScrubber struct {
+		mu      sync.RWMutex
+		secrets []string
+	}
+)
+
+var credentialPatterns = []*regexp.Regexp{
+	// URL query parameters, such as ?api_key=...
+	regexp.MustCompile(`(?i)((?:api_key|application_key)=)([^&\s"']+)`),
+	// Headers, as written by Go or in JSON, such as DD-API-KEY:[...] or "Authorization":"Bearer ..."
+	regexp.MustCompile(`(?i)((?:dd-api-key|dd-application-key|authorization)["']?\s*[:=]\s*\[?["']?(?:bearer\s+)?)([^\s"'\],]+)`),
+}
+
+// MakeCredentialScrubber creates a CredentialScrubber without secrets
+func MakeCredentialScrubber() *CredentialScrubber {
+	return &CredentialScrubber{}
+}
+
+// AddSecret adds a secret, such as an API key, to mask wherever it appears
+func (s *CredentialScrubber) AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, known := range s.secrets {
+		if known == secret {
+			return
+		}
+	}
+	s.secrets = append(s.secrets, secret)
+}
+
+// Scrub implements Scrubber.
+func (s *CredentialScrubber) Scrub(value string) string {
+	s.mu.RLock()
+	for _, secret := range s.secrets {
+		if strings.Contains(value, secret) {
+			value = strings.Replace(value, secret, MaskCredential(secret), -1)
+		}
+	}
+	s.mu.RUnlock()
+
+	if !mayContainCredential(value) {
+		return value
+	}
+	for _, pattern := range credentialPatterns {
+		value = pattern.ReplaceAllStringFunc(value, func(match string) string {
+			parts := pattern.FindStringSubmatch(match)
+			return parts[1] + MaskCredential(parts[2])
+		})
+	}
+	return value
+}
+
+// MaskCredential replaces all but the last 4 characters of a credential with asterisks. Credentials of 8
+// characters or less are masked entirely.
+func MaskCredential(credential string) string {
+	if len(credential) <= 2*visibleCredentialSuffix {
+		return strings.Repeat("*", len(credential))
+	}
+	return strings.Repeat("*", len(credential)-visibleCredentialSuffix) + credential[len(credential)-visibleCredentialSuffix:]
+}
+
+// mayContainCredential rules out most strings before the credential patterns run
+func mayContainCredential(value string) bool {
+	lower := strings.ToLower(value)
+	return strings.Contains(lower, "_key=") || strings.Contains(lower, "-key") || strings.Contains(lower, "authorization")
+}
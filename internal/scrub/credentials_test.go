@@ -0,0 +1,44 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package scrub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskCredential(t *testing.T) {
+	assert.Equal(t, "****************cdef", MaskCredential("0123456789abcdefcdef"))
+	assert.Equal(t, "********", MaskCredential("abcd1234"))
+	assert.Equal(t, "", MaskCredential(""))
+}
+
+func TestCredentialScrubberSecrets(t *testing.T) {
+	s := MakeCredentialScrubber()
+	s.AddSecret("")
+	s.AddSecret("0123456789abcdef")
+	s.AddSecret("0123456789abcdef")
+
+	assert.Equal(t, "key ************cdef rejected", s.Scrub("key 0123456789abcdef rejected"))
+	assert.Equal(t, "nothing to hide", s.Scrub("nothing to hide"))
+}
+
+func TestCredentialScrubberPatterns(t *testing.T) {
+	s := MakeCredentialScrubber()
+
+	assert.Equal(t,
+		`Post "https://api.datadoghq.com/api/v1/series?api_key=************cdef&x=1": no such host`,
+		s.Scrub(`Post "https://api.datadoghq.com/api/v1/series?api_key=0123456789abcdef&x=1": no such host`))
+	assert.Equal(t, "application_key=********", s.Scrub("application_key=abcd1234"))
+	assert.Equal(t, "map[Dd-Api-Key:[************cdef]]", s.Scrub("map[Dd-Api-Key:[0123456789abcdef]]"))
+	assert.Equal(t, `{"DD-API-KEY":"************cdef"}`, s.Scrub(`{"DD-API-KEY":"0123456789abcdef"}`))
+	assert.Equal(t, "Authorization: Bearer ************cdef", s.Scrub("Authorization: Bearer 0123456789abcdef"))
+	assert.Equal(t, "the api-key-rotation job ran", s.Scrub("the api-key-rotation job ran"))
+}
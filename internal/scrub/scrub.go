@@ -0,0 +1,152 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package scrub removes sensitive data from the strings the library sends or logs.
+package scrub
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces every match of a scrubbing pattern.
+const Redacted = "[redacted]"
+
+type (
+	// Scrubber removes sensitive data from a string, returning it unchanged when there is nothing to remove.
+	Scrubber interface {
+		Scrub(value string) string
+	}
+
+	// RegexScrubber replaces the matches of a set of patterns.
+	RegexScrubber struct {
+		rules []rule
+	}
+
+	rule struct {
+		pattern *regexp.Regexp
+		// mayMatch is a cheap test which rules out most strings before the pattern runs
+		mayMatch func(value string) bool
+	}
+)
+
+var defaultRules = []rule{
+	// Email addresses
+	{
+		pattern:  regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+		mayMatch: func(value string) bool { return strings.IndexByte(value, '@') >= 0 },
+	},
+	// Card numbers, of 13 to 19 digits optionally grouped with spaces or dashes
+	{
+		pattern:  regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+		mayMatch: func(value string) bool { return longestDigitRun(value) >= 13 },
+	},
+	// US social security numbers
+	{
+		pattern:  regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		mayMatch: hasSSNShape,
+	},
+}
+
+// MakeRegexScrubber creates a RegexScrubber for email addresses, card numbers and US social security numbers,
+// along with any additional patterns.
+func MakeRegexScrubber(additional ...*regexp.Regexp) *RegexScrubber {
+	rules := make([]rule, 0, len(defaultRules)+len(additional))
+	rules = append(rules, defaultRules...)
+	for _, pattern := range additional {
+		if pattern != nil {
+			rules = append(rules, rule{pattern: pattern})
+		}
+	}
+	return &RegexScrubber{rules: rules}
+}
+
+// Scrub implements Scrubber.
+func (s *RegexScrubber) Scrub(value string) string {
+	for _, r := range s.rules {
+		if r.mayMatch != nil && !r.mayMatch(value) {
+			continue
+		}
+		value = r.pattern.ReplaceAllLiteralString(value, Redacted)
+	}
+	return value
+}
+
+// String scrubs value with scrubber, which may be nil.
+func String(scrubber Scrubber, value string) string {
+	if scrubber == nil {
+		return value
+	}
+	return scrubber.Scrub(value)
+}
+
+// Tags scrubs the values of tags of the form "key:value", returning the original slice when nothing changed.
+func Tags(scrubber Scrubber, tags []string) []string {
+	if scrubber == nil {
+		return tags
+	}
+	var scrubbed []string
+	for i, tag := range tags {
+		key, value := "", tag
+		if sep := strings.IndexByte(tag, ':'); sep >= 0 {
+			key, value = tag[:sep+1], tag[sep+1:]
+		}
+		newValue := scrubber.Scrub(value)
+		if newValue == value {
+			continue
+		}
+		if scrubbed == nil {
+			scrubbed = make([]string, len(tags))
+			copy(scrubbed, tags)
+		}
+		scrubbed[i] = key + newValue
+	}
+	if scrubbed == nil {
+		return tags
+	}
+	return scrubbed
+}
+
+// longestDigitRun returns the largest number of digits found in a row, allowing a single space or dash
+// between two digits.
+func longestDigitRun(value string) int {
+	longest, run := 0, 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case isDigit(value[i]):
+			run++
+			if run > longest {
+				longest = run
+			}
+		case (value[i] == ' ' || value[i] == '-') && run > 0 && i+1 < len(value) && isDigit(value[i+1]):
+			// A separator inside a group of digits doesn't end the run
+		default:
+			run = 0
+		}
+	}
+	return longest
+}
+
+// hasSSNShape returns true if value contains digits laid out as ddd-dd-dddd.
+func hasSSNShape(value string) bool {
+	for i := 0; i+11 <= len(value); i++ {
+		if value[i+3] != '-' || value[i+6] != '-' {
+			continue
+		}
+		shape := value[i : i+11]
+		if isDigit(shape[0]) && isDigit(shape[1]) && isDigit(shape[2]) && isDigit(shape[4]) && isDigit(shape[5]) &&
+			isDigit(shape[7]) && isDigit(shape[8]) && isDigit(shape[9]) && isDigit(shape[10]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,114 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package scrub
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrubDefaultPatterns(t *testing.T) {
+	s := MakeRegexScrubber()
+
+	assert.Equal(t, "contact [redacted] for access", s.Scrub("contact jane.doe+ops@example.co.uk for access"))
+	assert.Equal(t, "card [redacted] declined", s.Scrub("card 4111 1111 1111 1111 declined"))
+	assert.Equal(t, "card [redacted] declined", s.Scrub("card 4111-1111-1111-1111 declined"))
+	assert.Equal(t, "card [redacted] declined", s.Scrub("card 378282246310005 declined"))
+	assert.Equal(t, "ssn [redacted]", s.Scrub("ssn 078-05-1120"))
+}
+
+func TestScrubLeavesOtherValues(t *testing.T) {
+	s := MakeRegexScrubber()
+
+	for _, value := range []string{
+		"",
+		"functionname:my-function",
+		"order 123456789012 shipped",
+		"2021-06-01T12:00:00Z",
+		"user@localhost",
+		"arn:aws:lambda:us-east-1:123456789012:function:my-function",
+	} {
+		assert.Equal(t, value, s.Scrub(value))
+	}
+}
+
+func TestScrubAdditionalPatterns(t *testing.T) {
+	s := MakeRegexScrubber(regexp.MustCompile(`acct-\d+`), nil)
+
+	assert.Equal(t, "account [redacted] of [redacted]", s.Scrub("account acct-42 of bob@example.com"))
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "bob@example.com", String(nil, "bob@example.com"))
+	assert.Equal(t, "[redacted]", String(MakeRegexScrubber(), "bob@example.com"))
+}
+
+func TestTags(t *testing.T) {
+	s := MakeRegexScrubber()
+
+	tags := []string{"env:prod", "user:bob@example.com", "card:4111111111111111", "bob@example.com"}
+	assert.Equal(t, []string{"env:prod", "user:[redacted]", "card:[redacted]", "[redacted]"}, Tags(s, tags))
+	// The tags passed in are left untouched
+	assert.Equal(t, "user:bob@example.com", tags[1])
+
+	clean := []string{"env:prod", "service:checkout"}
+	assert.Equal(t, &clean[0], &Tags(s, clean)[0])
+	assert.Equal(t, &tags[0], &Tags(nil, tags)[0])
+}
+
+func BenchmarkScrubNoMatch(b *testing.B) {
+	s := MakeRegexScrubber()
+	value := "functionname:my-function"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Scrub(value)
+	}
+}
+
+func BenchmarkScrubNoMatchWithDigits(b *testing.B) {
+	s := MakeRegexScrubber()
+	value := "arn:aws:lambda:us-east-1:123456789012:function:my-function"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Scrub(value)
+	}
+}
+
+func BenchmarkScrubMatch(b *testing.B) {
+	s := MakeRegexScrubber()
+	value := "user:jane.doe@example.com"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Scrub(value)
+	}
+}
+
+func BenchmarkTagsNoMatch(b *testing.B) {
+	s := MakeRegexScrubber()
+	tags := []string{"functionname:my-function", "region:us-east-1", "account_id:123456789012", "memorysize:256", "cold_start:false"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Tags(s, tags)
+	}
+}
+
+func TestLongestDigitRun(t *testing.T) {
+	assert.Equal(t, 0, longestDigitRun("no digits"))
+	assert.Equal(t, 16, longestDigitRun("4111 1111-1111 1111"))
+	assert.Equal(t, 12, longestDigitRun("arn:aws:lambda:us-east-1:123456789012:function"))
+	assert.Equal(t, 2, longestDigitRun("12  34"))
+}
+
+func TestHasSSNShape(t *testing.T) {
+	assert.True(t, hasSSNShape("ssn 078-05-1120"))
+	assert.False(t, hasSSNShape("2021-06-01"))
+	assert.False(t, hasSSNShape("078-05-112"))
+}
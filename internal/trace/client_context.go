@@ -0,0 +1,68 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// maxClientContextLength is the maximum size of the base64 encoded client context of a Lambda invocation
+const maxClientContextLength = 3583
+
+// AddTraceHeadersToClientContext returns the base64 encoded client context of a Lambda invocation with the
+// trace headers added to its custom map. Values already in the custom map are kept. An error is returned if
+// the client context isn't base64 encoded JSON, or if adding the headers would make it too large.
+func AddTraceHeadersToClientContext(clientContext string, headers map[string]string) (string, error) {
+	fields := map[string]interface{}{}
+	if clientContext != "" {
+		decoded, err := base64.StdEncoding.DecodeString(clientContext)
+		if err == nil {
+			err = json.Unmarshal(decoded, &fields)
+		}
+		if err != nil {
+			return "", fmt.Errorf("client context isn't base64 encoded JSON")
+		}
+	}
+
+	custom, ok := fields["custom"].(map[string]interface{})
+	if !ok {
+		custom = map[string]interface{}{}
+	}
+	for k, v := range headers {
+		if _, exists := custom[k]; !exists {
+			custom[k] = v
+		}
+	}
+	fields["custom"] = custom
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	newClientContext := base64.StdEncoding.EncodeToString(encoded)
+	if len(newClientContext) > maxClientContextLength {
+		return "", fmt.Errorf("client context would be %d bytes, over the limit of %d", len(newClientContext), maxClientContextLength)
+	}
+	return newClientContext, nil
+}
+
+// getTraceContextFromClientContext extracts the trace context that a calling function added to the custom
+// map of the invocation's client context.
+func getTraceContextFromClientContext(ctx context.Context, propagator Propagator) (TraceContext, bool) {
+	lambdaCtx, ok := lambdacontext.FromContext(ctx)
+	if !ok || len(lambdaCtx.ClientContext.Custom) == 0 {
+		return nil, false
+	}
+	return propagator.Extract(lambdaCtx.ClientContext.Custom)
+}
@@ -0,0 +1,73 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+var mockClientContextHeaders = map[string]string{
+	TraceIDHeader:          "1231452342",
+	ParentIDHeader:         "45678910",
+	samplingPriorityHeader: "2",
+}
+
+func TestAddTraceHeadersToClientContext(t *testing.T) {
+	existing := base64.StdEncoding.EncodeToString([]byte(`{"custom":{"user":"value","x-datadog-trace-id":"1"},"env":{"a":"b"}}`))
+
+	clientContext, err := AddTraceHeadersToClientContext(existing, mockClientContextHeaders)
+	assert.NoError(t, err)
+	decoded, _ := base64.StdEncoding.DecodeString(clientContext)
+	assert.JSONEq(t, `{"custom":{"user":"value","x-datadog-trace-id":"1","x-datadog-parent-id":"45678910","x-datadog-sampling-priority":"2"},"env":{"a":"b"}}`, string(decoded))
+
+	clientContext, err = AddTraceHeadersToClientContext("", mockClientContextHeaders)
+	assert.NoError(t, err)
+	decoded, _ = base64.StdEncoding.DecodeString(clientContext)
+	assert.JSONEq(t, `{"custom":{"x-datadog-trace-id":"1231452342","x-datadog-parent-id":"45678910","x-datadog-sampling-priority":"2"}}`, string(decoded))
+}
+
+func TestAddTraceHeadersToClientContextInvalid(t *testing.T) {
+	_, err := AddTraceHeadersToClientContext("not base64!", mockClientContextHeaders)
+	assert.Error(t, err)
+}
+
+func TestAddTraceHeadersToClientContextTooLarge(t *testing.T) {
+	fields, _ := json.Marshal(map[string]interface{}{"custom": map[string]string{"big": strings.Repeat("a", 2600)}})
+	existing := base64.StdEncoding.EncodeToString(fields)
+	assert.True(t, len(existing) <= maxClientContextLength)
+
+	_, err := AddTraceHeadersToClientContext(existing, mockClientContextHeaders)
+	assert.Error(t, err)
+}
+
+func TestGetDatadogTraceContextFromClientContext(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		ClientContext: lambdacontext.ClientContext{Custom: mockClientContextHeaders},
+	})
+
+	traceCtx, ok := getDatadogTraceContextFromEvent(ctx, json.RawMessage(`{"order": 42}`), MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext(mockClientContextHeaders), traceCtx)
+
+	// Headers in the event take precedence over the client context
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+	ctx = lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		ClientContext: lambdacontext.ClientContext{Custom: map[string]string{TraceIDHeader: "1", ParentIDHeader: "2"}},
+	})
+	traceCtx, ok = getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", traceCtx[TraceIDHeader])
+}
@@ -9,11 +9,24 @@
 package trace
 
 const (
-	traceIDHeader          = "x-datadog-trace-id"
-	parentIDHeader         = "x-datadog-parent-id"
+	// TraceIDHeader is the header carrying the Datadog trace id of a request
+	TraceIDHeader = "x-datadog-trace-id"
+	// ParentIDHeader is the header carrying the id of the span which sent a request
+	ParentIDHeader         = "x-datadog-parent-id"
 	samplingPriorityHeader = "x-datadog-sampling-priority"
+	tagsHeader             = "x-datadog-tags"
+	traceparentHeader      = "traceparent"
+	tracestateHeader       = "tracestate"
+	b3TraceIDHeader        = "x-b3-traceid"
+	b3SpanIDHeader         = "x-b3-spanid"
+	b3SampledHeader        = "x-b3-sampled"
+	b3FlagsHeader          = "x-b3-flags"
+	b3Header               = "b3"
 )
 
+// traceIDHighTag is the propagated tag holding the upper 64 bits of a 128 bit trace id, as 16 hex characters
+const traceIDHighTag = "_dd.p.tid"
+
 const (
 	userReject = "-1"
 	autoReject = "0"
@@ -21,8 +34,23 @@ const (
 	userKeep   = "2"
 )
 
+// xrayTraceEnvVar is the environment variable the Lambda runtime sets to the X-Ray trace header of the current invocation
+const xrayTraceEnvVar = "_X_AMZN_TRACE_ID"
+
+// XrayTraceHeader is the header carrying the X-Ray trace context of a request
+const XrayTraceHeader = "X-Amzn-Trace-Id"
+
+// mergeXrayTracesEnvVar is the environment variable enabling the merging of X-Ray and Datadog traces
+const mergeXrayTracesEnvVar = "DD_MERGE_XRAY_TRACES"
+
 const (
 	xraySubsegmentName      = "datadog-metadata"
 	xraySubsegmentKey       = "trace"
 	xraySubsegmentNamespace = "datadog"
 )
+
+const (
+	xrayDaemonAddressEnvVar  = "AWS_XRAY_DAEMON_ADDRESS"
+	defaultXrayDaemonAddress = "127.0.0.1:2000"
+	xrayDaemonHeader         = `{"format": "json", "version": 1}`
+)
@@ -9,24 +9,32 @@
 package trace
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/aws/aws-xray-sdk-go/header"
 	"github.com/aws/aws-xray-sdk-go/xray"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 type (
 	eventWithHeaders struct {
 		Headers map[string]string `json:"headers"`
+		// MultiValueHeaders are sent by API Gateway REST APIs, sometimes without Headers
+		MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
 	}
 
 	// TraceContext is map of headers containing a Datadog trace context
@@ -38,20 +46,56 @@ type contextKeytype int
 // traceContextKey is the key used to store a TraceContext in a Context object
 var traceContextKey = new(contextKeytype)
 
+// propagatorKey is the key used to store the invocation's Propagator in a Context object
+var propagatorKey = new(contextKeytype)
+
+// extensionTraceContextKey is the key used to store the TraceContext supplied by the Datadog Extension in a Context object
+var extensionTraceContextKey = new(contextKeytype)
+
+// tracingStateKey is the key used to store the invocation's tracingState in a Context object
+var tracingStateKey = new(contextKeytype)
+
+// tracingState records whether the current invocation is traced, and its spans. It's shared by pointer, so that
+// disabling tracing during the invocation is seen by every context derived from the handler's context. It's
+// scoped to the invocation, so that the invocations of handlers wrapped separately don't share spans.
+type tracingState struct {
+	// disabled is set to 1 when the invocation isn't traced. It's read and written atomically, as the handler
+	// may disable tracing from any goroutine.
+	disabled uint32
+	// functionExecutionSpan is the top-level span representing the current Lambda function execution
+	functionExecutionSpan ddtrace.Span
+	// inferredSpan represents the managed service which invoked the function, and is the parent of the function
+	// execution span
+	inferredSpan *inferredSpan
+	// requestPayload is the captured request payload, when payload capture is enabled
+	requestPayload string
+	// headerOwner propagates the trace context of the requests carrying an X-Ray trace header
+	headerOwner Owner
+}
+
 var datadogTraceContextFromEvent TraceContext
 
 // contextWithRootTraceContext uses the incoming event and context object payloads to determine
-// the root TraceContext and then adds that TraceContext to the context object.
-func contextWithRootTraceContext(ctx context.Context, ev json.RawMessage, mergeXrayTraces bool) (context.Context, error) {
-	datadogTraceContext, gotDatadogTraceContext := getDatadogTraceContextFromEvent(ctx, ev)
+// the root TraceContext and then adds that TraceContext to the context object. When the incoming trace context
+// has no sampling priority, one is generated from sampleRate.
+func contextWithRootTraceContext(ctx context.Context, ev json.RawMessage, mergeXrayTraces bool, propagator Propagator, sampleRate float64) (context.Context, error) {
+	datadogTraceContext, gotDatadogTraceContext := getDatadogTraceContextFromEvent(ctx, ev, propagator)
+	if gotDatadogTraceContext {
+		datadogTraceContext = withSamplingPriority(datadogTraceContext, sampleRate)
+	}
 
 	xrayTraceContext, errGettingXrayContext := convertXrayTraceContextFromLambdaContext(ctx)
 	if errGettingXrayContext != nil {
 		logger.Error(fmt.Errorf("Couldn't convert X-Ray trace context: %v", errGettingXrayContext))
 	}
 
-	if gotDatadogTraceContext && errGettingXrayContext == nil {
-		createDummySubsegmentForXrayConverter(ctx, datadogTraceContext)
+	if mergeXrayTraces && gotDatadogTraceContext && errGettingXrayContext == nil {
+		// Sending the subsegment is best effort, it must never affect the invocation
+		if xrayHeader := getXrayTraceHeaderFromContext(ctx); xrayHeader.SamplingDecision == header.Sampled {
+			if err := sendXraySubsegment(xrayHeader, datadogTraceContext); err != nil {
+				logger.Debug(fmt.Sprintf("Couldn't send Datadog metadata to X-Ray: %v", err))
+			}
+		}
 	}
 
 	if !mergeXrayTraces {
@@ -66,18 +110,96 @@ func contextWithRootTraceContext(ctx context.Context, ev json.RawMessage, mergeX
 
 	logger.Debug("Using merged Datadog/X-Ray trace context")
 	mergedTraceContext := TraceContext{}
-	mergedTraceContext[traceIDHeader] = datadogTraceContext[traceIDHeader]
+	mergedTraceContext[TraceIDHeader] = datadogTraceContext[TraceIDHeader]
 	mergedTraceContext[samplingPriorityHeader] = datadogTraceContext[samplingPriorityHeader]
-	mergedTraceContext[parentIDHeader] = xrayTraceContext[parentIDHeader]
+	mergedTraceContext[ParentIDHeader] = xrayTraceContext[ParentIDHeader]
+	setTraceIDHigh(mergedTraceContext, getTraceIDHigh(datadogTraceContext))
 	return context.WithValue(ctx, traceContextKey, mergedTraceContext), nil
 }
 
+// GetTraceHeaders returns the Datadog trace headers for the current invocation. The headers come from the
+// active span when Datadog tracing is enabled, otherwise from the root trace context of the invocation, which
+// may have been extracted from the event or converted from X-Ray. An empty TraceContext is returned when no trace
+// context is available.
+func GetTraceHeaders(ctx context.Context) TraceContext {
+	if isTracingDisabled(ctx) {
+		return TraceContext{}
+	}
+
+	rootTraceContext, _ := ctx.Value(traceContextKey).(TraceContext)
+
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		spanCtx := span.Context()
+		traceCtx := TraceContext{
+			TraceIDHeader:  strconv.FormatUint(spanCtx.TraceID(), 10),
+			ParentIDHeader: strconv.FormatUint(spanCtx.SpanID(), 10),
+		}
+		carrier := tracer.TextMapCarrier{}
+		if err := spanContextPropagator.Inject(spanCtx, carrier); err == nil && carrier[samplingPriorityHeader] != "" {
+			traceCtx[samplingPriorityHeader] = carrier[samplingPriorityHeader]
+		} else if samplingPriority, ok := rootTraceContext[samplingPriorityHeader]; ok {
+			traceCtx[samplingPriorityHeader] = samplingPriority
+		}
+		// The span belongs to the root trace, so it shares the upper 64 bits of its trace id
+		setTraceIDHigh(traceCtx, getTraceIDHigh(rootTraceContext))
+		return traceCtx
+	}
+
+	if rootTraceContext[TraceIDHeader] != "" {
+		traceCtx := TraceContext{}
+		for _, key := range []string{TraceIDHeader, ParentIDHeader, samplingPriorityHeader, tagsHeader} {
+			if value, ok := rootTraceContext[key]; ok {
+				traceCtx[key] = value
+			}
+		}
+		return traceCtx
+	}
+
+	if xrayTraceContext, err := convertXrayTraceContextFromLambdaContext(ctx); err == nil {
+		return xrayTraceContext
+	}
+	return TraceContext{}
+}
+
+// InjectTraceHeaders writes the trace headers for the current invocation into headers, once for every
+// propagation style configured for injection.
+func InjectTraceHeaders(ctx context.Context, headers map[string]string) {
+	propagator, ok := ctx.Value(propagatorKey).(Propagator)
+	if !ok {
+		propagator = MakePropagator(nil, nil)
+	}
+	propagator.Inject(GetTraceHeaders(ctx), headers)
+}
+
+// DisableForInvocation turns off tracing for the rest of the invocation. The function execution span, and the
+// inferred span if there is one, are already started, so the trace is marked as rejected to make sure it's dropped.
+func DisableForInvocation(ctx context.Context) {
+	state, ok := ctx.Value(tracingStateKey).(*tracingState)
+	if !ok || !atomic.CompareAndSwapUint32(&state.disabled, 0, 1) {
+		return
+	}
+
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		span.SetTag(ext.SamplingPriority, ext.PriorityUserReject)
+	}
+	logger.Debug("Tracing disabled for this invocation")
+}
+
+// isTracingDisabled returns true when the invocation in ctx isn't traced
+func isTracingDisabled(ctx context.Context) bool {
+	state, ok := ctx.Value(tracingStateKey).(*tracingState)
+	return ok && atomic.LoadUint32(&state.disabled) == 1
+}
+
 // ConvertCurrentXrayTraceContext returns the current X-Ray trace context converted to Datadog headers, taking into account
 // the current subsegment. It is designed for sending Datadog trace headers from functions instrumented with the X-Ray SDK.
 func ConvertCurrentXrayTraceContext(ctx context.Context) TraceContext {
+	if isTracingDisabled(ctx) {
+		return map[string]string{}
+	}
 	if xrayTraceContext, err := convertXrayTraceContextFromLambdaContext(ctx); err == nil {
 		// If there is an active X-Ray segment, use it as the parent
-		parentID := xrayTraceContext[parentIDHeader]
+		parentID := xrayTraceContext[ParentIDHeader]
 		segment := xray.GetSegment(ctx)
 		if segment != nil {
 			newParentID, err := convertXRayEntityIDToDatadogParentID(segment.ID)
@@ -87,75 +209,88 @@ func ConvertCurrentXrayTraceContext(ctx context.Context) TraceContext {
 		}
 
 		newTraceContext := map[string]string{}
-		newTraceContext[traceIDHeader] = xrayTraceContext[traceIDHeader]
+		newTraceContext[TraceIDHeader] = xrayTraceContext[TraceIDHeader]
 		newTraceContext[samplingPriorityHeader] = xrayTraceContext[samplingPriorityHeader]
-		newTraceContext[parentIDHeader] = parentID
+		newTraceContext[ParentIDHeader] = parentID
 
 		return newTraceContext
 	}
 	return map[string]string{}
 }
 
-// createDummySubsegmentForXrayConverter creates a dummy X-Ray subsegment containing Datadog trace context metadata.
-// This metadata is used by the Datadog X-Ray converter to parent the X-Ray trace under the Datadog trace.
-// This subsegment will be dropped by the X-Ray converter and will not appear in Datadog.
-func createDummySubsegmentForXrayConverter(ctx context.Context, traceCtx TraceContext) error {
-	_, segment := xray.BeginSubsegment(ctx, xraySubsegmentName)
-
-	traceID := traceCtx[traceIDHeader]
-	parentID := traceCtx[parentIDHeader]
-	sampled := traceCtx[samplingPriorityHeader]
-	metadata := map[string]string{
-		"trace-id":          traceID,
-		"parent-id":         parentID,
-		"sampling-priority": sampled,
+// getDatadogTraceContextFromEvent extracts the Datadog trace context from an incoming Lambda event payload.
+// Custom extractors registered to run first are tried before the built-in sources: the event headers, the Step
+// Functions context object, Kafka record headers and the client context of direct invocations. The remaining
+// custom extractors are tried if nothing was found.
+func getDatadogTraceContextFromEvent(ctx context.Context, ev json.RawMessage, propagator Propagator) (TraceContext, bool) {
+	if traceCtx, ok := runExtractors(ctx, extractorsBeforeBuiltins, ev); ok {
+		return traceCtx, true
 	}
 
-	err := segment.AddMetadataToNamespace(xraySubsegmentNamespace, xraySubsegmentKey, metadata)
-	if err != nil {
-		return fmt.Errorf("couldn't save trace context to XRay: %v", err)
+	// The extension's trace context takes precedence over the built-in extraction, so that the function's
+	// spans join the same trace as the ones created by the extension
+	if traceCtx, ok := ctx.Value(extensionTraceContextKey).(TraceContext); ok && traceCtx[TraceIDHeader] != "" {
+		return traceCtx, true
 	}
-	segment.Close(nil)
-	return nil
-}
 
-// getDatadogTraceContextFromEvent extracts the Datadog trace context from an incoming Lambda event payload
-// and creates a dummy X-Ray subsegment containing this information
-func getDatadogTraceContextFromEvent(ctx context.Context, ev json.RawMessage) (TraceContext, bool) {
-	eh := eventWithHeaders{}
+	if eh, ok := sniffHeaders(bytes.NewReader(ev)); ok {
+		if traceCtx, ok := propagator.Extract(eh.lowercaseHeaders()); ok {
+			return traceCtx, true
+		}
+	}
 
-	traceCtx := map[string]string{}
+	// API Gateway and Function URL events can carry a large body, which isn't parsed for the trace contexts
+	// other kinds of events have
+	if eventsource.Get(ctx, ev) != eventsource.APIGateway {
+		if traceCtx, ok := extractStepFunctionsTraceContext(ev); ok {
+			return traceCtx, true
+		}
 
-	err := json.Unmarshal(ev, &eh)
-	if err != nil {
-		return traceCtx, false
+		if traceCtx, ok := extractKafkaTraceContext(ev, propagator); ok {
+			return traceCtx, true
+		}
 	}
 
-	lowercaseHeaders := map[string]string{}
-	for k, v := range eh.Headers {
-		lowercaseHeaders[strings.ToLower(k)] = v
+	if traceCtx, ok := getTraceContextFromClientContext(ctx, propagator); ok {
+		return traceCtx, true
 	}
 
-	traceID, ok := lowercaseHeaders[traceIDHeader]
-	if !ok {
-		return traceCtx, false
+	if traceCtx, ok := runExtractors(ctx, extractorsAfterBuiltins, ev); ok {
+		return traceCtx, true
 	}
+	return map[string]string{}, false
+}
 
-	parentID, ok := lowercaseHeaders[parentIDHeader]
-	if !ok {
-		return traceCtx, false
+// lowercaseHeaders merges the headers and the multi-value headers of an event, keyed by their lowercase names.
+// For a header sent several times, the first value is used, which is only in the multi-value headers as API
+// Gateway puts the last one in the headers. Names differing only by their case are resolved in sorted order, so
+// that the result doesn't depend on the order of the map.
+func (eh eventWithHeaders) lowercaseHeaders() map[string]string {
+	headers := map[string]string{}
+	multiValueNames := make([]string, 0, len(eh.MultiValueHeaders))
+	for name := range eh.MultiValueHeaders {
+		multiValueNames = append(multiValueNames, name)
 	}
-
-	samplingPriority, ok := lowercaseHeaders[samplingPriorityHeader]
-	if !ok {
-		return traceCtx, false
+	sort.Strings(multiValueNames)
+	for _, name := range multiValueNames {
+		lowercaseName := strings.ToLower(name)
+		if _, ok := headers[lowercaseName]; !ok && len(eh.MultiValueHeaders[name]) > 0 {
+			headers[lowercaseName] = eh.MultiValueHeaders[name][0]
+		}
 	}
 
-	traceCtx[samplingPriorityHeader] = samplingPriority
-	traceCtx[traceIDHeader] = traceID
-	traceCtx[parentIDHeader] = parentID
-
-	return traceCtx, true
+	names := make([]string, 0, len(eh.Headers))
+	for name := range eh.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lowercaseName := strings.ToLower(name)
+		if _, ok := headers[lowercaseName]; !ok {
+			headers[lowercaseName] = eh.Headers[name]
+		}
+	}
+	return headers
 }
 
 func convertXrayTraceContextFromLambdaContext(ctx context.Context) (TraceContext, error) {
@@ -176,15 +311,17 @@ func convertXrayTraceContextFromLambdaContext(ctx context.Context) (TraceContext
 	}
 	samplingPriority := convertXRaySamplingDecision(header.SamplingDecision)
 
-	traceCtx[traceIDHeader] = traceID
-	traceCtx[parentIDHeader] = parentID
+	traceCtx[TraceIDHeader] = traceID
+	traceCtx[ParentIDHeader] = parentID
 	traceCtx[samplingPriorityHeader] = samplingPriority
 	return traceCtx, nil
 }
 
 // getXrayTraceHeaderFromContext is used to extract xray segment metadata from the lambda context object.
 // By default, the context object won't have any Segment, (xray.GetSegment(ctx) will return nil). However it
-// will have the "LambdaTraceHeader" object, which contains the traceID/parentID/sampling info.
+// will have the "LambdaTraceHeader" object, which contains the traceID/parentID/sampling info. If the context
+// doesn't have it, the _X_AMZN_TRACE_ID environment variable set by the Lambda runtime is used instead. It's read
+// from the live environment, as the runtime sets it for each invocation.
 func getXrayTraceHeaderFromContext(ctx context.Context) *header.Header {
 	var traceHeader string
 
@@ -192,6 +329,9 @@ func getXrayTraceHeaderFromContext(ctx context.Context) *header.Header {
 		traceHeader = traceHeaderValue.(string)
 		return header.FromString(traceHeader)
 	}
+	if traceHeader = os.Getenv(xrayTraceEnvVar); traceHeader != "" {
+		return header.FromString(traceHeader)
+	}
 	return nil
 }
 
@@ -250,7 +390,7 @@ func convertXRaySamplingDecision(decision header.SamplingDecision) string {
 
 // ConvertTraceContextToSpanContext converts a TraceContext object to a SpanContext that can be used by dd-trace.
 func ConvertTraceContextToSpanContext(traceCtx TraceContext) (ddtrace.SpanContext, error) {
-	spanCtx, err := propagator.Extract(tracer.TextMapCarrier(traceCtx))
+	spanCtx, err := spanContextPropagator.Extract(tracer.TextMapCarrier(traceCtx))
 
 	if err != nil {
 		logger.Debug("Could not convert TraceContext to a SpanContext (most likely TraceContext was empty)")
@@ -260,9 +400,9 @@ func ConvertTraceContextToSpanContext(traceCtx TraceContext) (ddtrace.SpanContex
 	return spanCtx, nil
 }
 
-// propagator is able to extract a SpanContext object from a TraceContext object
-var propagator = tracer.NewPropagator(&tracer.PropagatorConfig{
-	TraceHeader:    traceIDHeader,
-	ParentHeader:   parentIDHeader,
+// spanContextPropagator is able to extract a SpanContext object from a TraceContext object
+var spanContextPropagator = tracer.NewPropagator(&tracer.PropagatorConfig{
+	TraceHeader:    TraceIDHeader,
+	ParentHeader:   ParentIDHeader,
 	PriorityHeader: samplingPriorityHeader,
 })
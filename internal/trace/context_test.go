@@ -12,6 +12,8 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
 
 	"github.com/aws/aws-xray-sdk-go/header"
@@ -19,6 +21,8 @@ import (
 	"github.com/aws/aws-xray-sdk-go/xray"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 const (
@@ -58,12 +62,12 @@ func TestGetDatadogTraceContextForTraceMetadataNonProxyEvent(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
 
-	headers, ok := getDatadogTraceContextFromEvent(ctx, *ev)
+	headers, ok := getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
 	assert.True(t, ok)
 
 	expected := TraceContext{
-		traceIDHeader:          "1231452342",
-		parentIDHeader:         "45678910",
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
 		samplingPriorityHeader: "2",
 	}
 	assert.Equal(t, expected, headers)
@@ -73,22 +77,69 @@ func TestGetDatadogTraceContextForTraceMetadataWithMixedCaseHeaders(t *testing.T
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/non-proxy-with-mixed-case-headers.json")
 
-	headers, ok := getDatadogTraceContextFromEvent(ctx, *ev)
+	headers, ok := getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
 	assert.True(t, ok)
 
 	expected := TraceContext{
-		traceIDHeader:          "1231452342",
-		parentIDHeader:         "45678910",
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
 		samplingPriorityHeader: "2",
 	}
 	assert.Equal(t, expected, headers)
 }
 
+func TestGetDatadogTraceContextFromMultiValueHeadersOnly(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+	ev := loadRawJSON(t, "../testdata/apig-rest-event-multi-value-headers.json")
+
+	headers, ok := getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+
+	expected := TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	}
+	assert.Equal(t, expected, headers)
+}
+
+func TestGetDatadogTraceContextFromDuplicatedHeaders(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+	ev := loadRawJSON(t, "../testdata/apig-rest-event-duplicated-headers.json")
+
+	headers, ok := getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+
+	// The first values come from the multi-value headers, and the headers fill in the others
+	expected := TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	}
+	assert.Equal(t, expected, headers)
+}
+
+func TestEventLowercaseHeadersIsDeterministic(t *testing.T) {
+	eh := eventWithHeaders{
+		Headers: map[string]string{
+			"x-datadog-trace-id": "2",
+			"X-Datadog-Trace-Id": "1",
+			"X-DATADOG-TRACE-ID": "0",
+		},
+		MultiValueHeaders: map[string][]string{
+			"X-Datadog-Parent-Id": {},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, map[string]string{"x-datadog-trace-id": "0"}, eh.lowercaseHeaders())
+	}
+}
+
 func TestGetDatadogTraceContextForInvalidData(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/invalid.json")
 
-	_, ok := getDatadogTraceContextFromEvent(ctx, *ev)
+	_, ok := getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
 	assert.False(t, ok)
 }
 
@@ -96,7 +147,7 @@ func TestGetDatadogTraceContextForMissingData(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/non-proxy-no-headers.json")
 
-	_, ok := getDatadogTraceContextFromEvent(ctx, *ev)
+	_, ok := getDatadogTraceContextFromEvent(ctx, *ev, MakePropagator(nil, nil))
 	assert.False(t, ok)
 }
 
@@ -154,15 +205,15 @@ func TestXrayTraceContextWithSegment(t *testing.T) {
 	headers, err := convertXrayTraceContextFromLambdaContext(ctx)
 	assert.NoError(t, err)
 	assert.Equal(t, "2", headers[samplingPriorityHeader])
-	assert.NotNil(t, headers[traceIDHeader])
-	assert.NotNil(t, headers[parentIDHeader])
+	assert.NotNil(t, headers[TraceIDHeader])
+	assert.NotNil(t, headers[ParentIDHeader])
 }
 
 func TestContextWithRootTraceContextNoDatadogContext(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-no-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false, MakePropagator(nil, nil), 1)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{}
@@ -173,12 +224,12 @@ func TestContextWithRootTraceContextWithDatadogContext(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false, MakePropagator(nil, nil), 1)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{
-		traceIDHeader:          "1231452342",
-		parentIDHeader:         "45678910",
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
 		samplingPriorityHeader: "2",
 	}
 	assert.Equal(t, expected, traceContext)
@@ -188,12 +239,12 @@ func TestContextWithRootTraceContextMergeXrayTracesNoDatadogContext(t *testing.T
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-no-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true, MakePropagator(nil, nil), 1)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{
-		traceIDHeader:          convertedXRayTraceID,
-		parentIDHeader:         convertedXRayEntityID,
+		TraceIDHeader:          convertedXRayTraceID,
+		ParentIDHeader:         convertedXRayEntityID,
 		samplingPriorityHeader: "2",
 	}
 	assert.Equal(t, expected, traceContext)
@@ -203,13 +254,129 @@ func TestContextWithRootTraceContextMergeXrayTracesWithDatadogContext(t *testing
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true, MakePropagator(nil, nil), 1)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{
-		traceIDHeader:          "1231452342",
-		parentIDHeader:         convertedXRayEntityID,
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         convertedXRayEntityID,
 		samplingPriorityHeader: "2",
 	}
 	assert.Equal(t, expected, traceContext)
 }
+
+func TestGetTraceHeadersFromSpan(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := context.WithValue(context.Background(), traceContextKey, TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	})
+	span, ctx := tracer.StartSpanFromContext(ctx, "aws.lambda")
+	defer span.Finish()
+
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          strconv.FormatUint(span.Context().TraceID(), 10),
+		ParentIDHeader:         strconv.FormatUint(span.Context().SpanID(), 10),
+		samplingPriorityHeader: "2",
+	}, headers)
+	assert.Equal(t, headers, GetTraceHeaders(ctx))
+}
+
+func TestGetTraceHeadersFromRootTraceContext(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+	ctx = context.WithValue(ctx, traceContextKey, TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	})
+
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	}, headers)
+}
+
+func TestGetTraceHeadersFromXray(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          convertedXRayTraceID,
+		ParentIDHeader:         convertedXRayEntityID,
+		samplingPriorityHeader: "2",
+	}, headers)
+}
+
+func TestGetTraceHeadersNoTraceContext(t *testing.T) {
+	headers := GetTraceHeaders(context.Background())
+	assert.Equal(t, TraceContext{}, headers)
+}
+
+func TestInjectTraceHeadersUsesContextPropagator(t *testing.T) {
+	ctx := context.WithValue(context.Background(), traceContextKey, TraceContext{
+		TraceIDHeader:          "43981",
+		ParentIDHeader:         "61185",
+		samplingPriorityHeader: "1",
+	})
+	ctx = context.WithValue(ctx, propagatorKey, MakePropagator(nil, []PropagationStyle{PropagationStyleB3}))
+
+	headers := map[string]string{}
+	InjectTraceHeaders(ctx, headers)
+	assert.Equal(t, map[string]string{b3Header: "000000000000abcd-000000000000ef01-1"}, headers)
+}
+
+func TestXrayTraceContextFromEnvironment(t *testing.T) {
+	os.Setenv(xrayTraceEnvVar, "Root=1-5e272390-8c398be037738dc042009320;Parent=94ae789b969f1cc5;Sampled=1")
+	defer os.Unsetenv(xrayTraceEnvVar)
+
+	// Same vectors as the other Datadog Lambda runtimes
+	headers, err := convertXrayTraceContextFromLambdaContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "3995693151288333088",
+		ParentIDHeader:         "10713633173203262661",
+		samplingPriorityHeader: userKeep,
+	}, headers)
+}
+
+func TestXrayTraceContextPrefersLambdaContext(t *testing.T) {
+	os.Setenv(xrayTraceEnvVar, "Root=1-5e272390-8c398be037738dc042009320;Parent=94ae789b969f1cc5;Sampled=1")
+	defer os.Unsetenv(xrayTraceEnvVar)
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, false)
+
+	headers, err := convertXrayTraceContextFromLambdaContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          convertedXRayTraceID,
+		ParentIDHeader:         convertedXRayEntityID,
+		samplingPriorityHeader: userReject,
+	}, headers)
+}
+
+func TestConvertXRayTraceIDClearsHighBit(t *testing.T) {
+	output, err := convertXRayTraceIDToDatadogTraceID("1-5e272390-8c398be0b7738dc042009320")
+	assert.NoError(t, err)
+	assert.Equal(t, "3995693151288333088", output)
+}
+
+func TestContextWithRootTraceContextMergeXrayTracesFromEnvironment(t *testing.T) {
+	os.Setenv(xrayTraceEnvVar, "Root=1-5e272390-8c398be037738dc042009320;Parent=94ae789b969f1cc5;Sampled=1")
+	defer os.Unsetenv(xrayTraceEnvVar)
+	ev := loadRawJSON(t, "../testdata/apig-event-no-headers.json")
+
+	newCTX, _ := contextWithRootTraceContext(context.Background(), *ev, true, MakePropagator(nil, nil), 1)
+
+	expected := TraceContext{
+		TraceIDHeader:          "3995693151288333088",
+		ParentIDHeader:         "10713633173203262661",
+		samplingPriorityHeader: userKeep,
+	}
+	assert.Equal(t, expected, newCTX.Value(traceContextKey))
+	assert.Equal(t, expected, GetTraceHeaders(newCTX))
+}
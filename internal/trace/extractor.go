@@ -0,0 +1,65 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// Extractor reads a TraceContext from the raw payload of an invocation. It returns false if the payload
+// doesn't contain a trace context it recognises.
+type Extractor func(ctx context.Context, payload []byte) (TraceContext, bool)
+
+var (
+	// extractorsBeforeBuiltins run before the trace context is extracted from the event headers
+	extractorsBeforeBuiltins []Extractor
+	// extractorsAfterBuiltins run when no trace context could be extracted from the event headers
+	extractorsAfterBuiltins []Extractor
+)
+
+// RegisterExtractor adds a custom Extractor, which runs either before or after the built-in extraction from
+// the event headers. Extractors aren't safe to register concurrently with invocations, so they should be
+// registered before the Lambda starts.
+func RegisterExtractor(extractor Extractor, runAfterBuiltins bool) {
+	if runAfterBuiltins {
+		extractorsAfterBuiltins = append(extractorsAfterBuiltins, extractor)
+	} else {
+		extractorsBeforeBuiltins = append(extractorsBeforeBuiltins, extractor)
+	}
+}
+
+// runExtractors returns the TraceContext from the first extractor that finds one
+func runExtractors(ctx context.Context, extractors []Extractor, payload []byte) (TraceContext, bool) {
+	for _, extractor := range extractors {
+		if traceCtx, ok := runExtractor(ctx, extractor, payload); ok {
+			return traceCtx, true
+		}
+	}
+	return nil, false
+}
+
+// runExtractor calls a custom extractor, making sure a panic doesn't kill the invocation
+func runExtractor(ctx context.Context, extractor Extractor, payload []byte) (traceCtx TraceContext, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(fmt.Errorf("custom trace extractor panicked: %v", r))
+			traceCtx, ok = nil, false
+		}
+	}()
+
+	traceCtx, ok = extractor(ctx, payload)
+	if ok && traceCtx[TraceIDHeader] == "" {
+		logger.Debug("custom trace extractor returned a trace context without a trace id, ignoring it")
+		return nil, false
+	}
+	return traceCtx, ok
+}
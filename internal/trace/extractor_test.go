@@ -0,0 +1,74 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func resetExtractors() {
+	extractorsBeforeBuiltins = nil
+	extractorsAfterBuiltins = nil
+}
+
+func mockExtractor(traceID string) Extractor {
+	return func(ctx context.Context, payload []byte) (TraceContext, bool) {
+		return TraceContext{TraceIDHeader: traceID, ParentIDHeader: "1"}, true
+	}
+}
+
+func TestCustomExtractorRunsBeforeBuiltins(t *testing.T) {
+	defer resetExtractors()
+	RegisterExtractor(mockExtractor("42"), false)
+
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+	traceCtx, ok := getDatadogTraceContextFromEvent(context.Background(), *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "42", traceCtx[TraceIDHeader])
+}
+
+func TestFallbackExtractorRunsOnlyWhenBuiltinsFail(t *testing.T) {
+	defer resetExtractors()
+	RegisterExtractor(mockExtractor("42"), true)
+
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+	traceCtx, ok := getDatadogTraceContextFromEvent(context.Background(), *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", traceCtx[TraceIDHeader])
+
+	traceCtx, ok = getDatadogTraceContextFromEvent(context.Background(), json.RawMessage(`"not an object"`), MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "42", traceCtx[TraceIDHeader])
+}
+
+func TestCustomExtractorPanicIsRecovered(t *testing.T) {
+	defer resetExtractors()
+	RegisterExtractor(func(ctx context.Context, payload []byte) (TraceContext, bool) {
+		panic("boom")
+	}, false)
+	RegisterExtractor(mockExtractor("42"), false)
+
+	traceCtx, ok := getDatadogTraceContextFromEvent(context.Background(), json.RawMessage(`{}`), MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "42", traceCtx[TraceIDHeader])
+}
+
+func TestCustomExtractorWithoutTraceIDIsIgnored(t *testing.T) {
+	defer resetExtractors()
+	RegisterExtractor(func(ctx context.Context, payload []byte) (TraceContext, bool) {
+		return TraceContext{}, true
+	}, false)
+
+	_, ok := getDatadogTraceContextFromEvent(context.Background(), json.RawMessage(`{}`), MakePropagator(nil, nil))
+	assert.False(t, ok)
+}
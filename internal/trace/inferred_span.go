@@ -0,0 +1,156 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+type (
+	// inferredSpanEvent holds just enough of an event payload to tell which managed service invoked the function
+	inferredSpanEvent struct {
+		Version        string `json:"version"`
+		HTTPMethod     string `json:"httpMethod"`
+		RequestContext struct {
+			Stage string `json:"stage"`
+			HTTP  struct {
+				Method string `json:"method"`
+			} `json:"http"`
+		} `json:"requestContext"`
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+
+	// inferredSpan represents the managed service which invoked the function
+	inferredSpan struct {
+		span ddtrace.Span
+		// isAsync is true when the service doesn't wait for the function to complete, in which case
+		// the span is finished as soon as the function starts.
+		isAsync bool
+	}
+)
+
+// startInferredSpan starts a span representing the API Gateway or SQS resource that invoked the function,
+// using the timing data in the event payload. parent sets the parent of the span, or its id when it's the root span
+// of a trace generated for the invocation. It returns nil if the event doesn't come from a supported service.
+func startInferredSpan(ev json.RawMessage, parent ddtrace.StartSpanOption) *inferredSpan {
+	probe := inferredSpanEvent{}
+	if err := json.Unmarshal(ev, &probe); err != nil {
+		return nil
+	}
+
+	switch {
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs":
+		sqsEvent := events.SQSEvent{}
+		if err := json.Unmarshal(ev, &sqsEvent); err != nil {
+			return nil
+		}
+		return startSQSInferredSpan(sqsEvent, parent)
+	case probe.Version == "2.0" && probe.RequestContext.HTTP.Method != "":
+		httpEvent := events.APIGatewayV2HTTPRequest{}
+		if err := json.Unmarshal(ev, &httpEvent); err != nil {
+			return nil
+		}
+		return startHTTPAPIInferredSpan(httpEvent, parent)
+	case probe.HTTPMethod != "" && probe.RequestContext.Stage != "":
+		restEvent := events.APIGatewayProxyRequest{}
+		if err := json.Unmarshal(ev, &restEvent); err != nil {
+			return nil
+		}
+		return startRESTAPIInferredSpan(restEvent, parent)
+	}
+	return nil
+}
+
+func startRESTAPIInferredSpan(ev events.APIGatewayProxyRequest, parent ddtrace.StartSpanOption) *inferredSpan {
+	rc := ev.RequestContext
+	span := tracer.StartSpan(
+		"aws.apigateway",
+		parent,
+		tracer.StartTime(time.Unix(0, rc.RequestTimeEpoch*int64(time.Millisecond))),
+		tracer.ServiceName(rc.DomainName),
+		tracer.ResourceName(fmt.Sprintf("%s %s", ev.HTTPMethod, ev.Resource)),
+		tracer.SpanType("http"),
+		tracer.Tag("operation_name", "aws.apigateway.rest"),
+		tracer.Tag("http.url", rc.DomainName+ev.Path),
+		tracer.Tag("endpoint", ev.Path),
+		tracer.Tag("http.method", ev.HTTPMethod),
+		tracer.Tag("resource_names", ev.Resource),
+		tracer.Tag("request_id", rc.RequestID),
+		tracer.Tag("apiid", rc.APIID),
+		tracer.Tag("apiname", rc.APIID),
+		tracer.Tag("stage", rc.Stage),
+		tracer.Tag("_inferred_span.tag_source", "self"),
+		tracer.Tag("_inferred_span.synchronicity", "sync"),
+	)
+	return &inferredSpan{span: span, isAsync: false}
+}
+
+func startHTTPAPIInferredSpan(ev events.APIGatewayV2HTTPRequest, parent ddtrace.StartSpanOption) *inferredSpan {
+	rc := ev.RequestContext
+	resource := ev.RouteKey
+	if resource == "" || resource == "$default" {
+		resource = fmt.Sprintf("%s %s", rc.HTTP.Method, ev.RawPath)
+	}
+	span := tracer.StartSpan(
+		"aws.httpapi",
+		parent,
+		tracer.StartTime(time.Unix(0, rc.TimeEpoch*int64(time.Millisecond))),
+		tracer.ServiceName(rc.DomainName),
+		tracer.ResourceName(resource),
+		tracer.SpanType("http"),
+		tracer.Tag("operation_name", "aws.httpapi"),
+		tracer.Tag("http.url", rc.DomainName+ev.RawPath),
+		tracer.Tag("endpoint", ev.RawPath),
+		tracer.Tag("http.method", rc.HTTP.Method),
+		tracer.Tag("resource_names", resource),
+		tracer.Tag("request_id", rc.RequestID),
+		tracer.Tag("apiid", rc.APIID),
+		tracer.Tag("apiname", rc.APIID),
+		tracer.Tag("stage", rc.Stage),
+		tracer.Tag("_inferred_span.tag_source", "self"),
+		tracer.Tag("_inferred_span.synchronicity", "sync"),
+	)
+	return &inferredSpan{span: span, isAsync: false}
+}
+
+func startSQSInferredSpan(ev events.SQSEvent, parent ddtrace.StartSpanOption) *inferredSpan {
+	record := ev.Records[0]
+	// ex: arn:aws:sqs:us-east-2:123456789012:my-queue
+	arnSegments := strings.Split(record.EventSourceARN, ":")
+	queueName := arnSegments[len(arnSegments)-1]
+
+	opts := []ddtrace.StartSpanOption{
+		parent,
+		tracer.ServiceName("sqs"),
+		tracer.ResourceName(queueName),
+		tracer.SpanType("web"),
+		tracer.Tag("operation_name", "aws.sqs"),
+		tracer.Tag("resource_names", queueName),
+		tracer.Tag("queuename", queueName),
+		tracer.Tag("event_source_arn", record.EventSourceARN),
+		tracer.Tag("receipt_handle", record.ReceiptHandle),
+		tracer.Tag("sender_id", record.Attributes["SenderId"]),
+		tracer.Tag("_inferred_span.tag_source", "self"),
+		tracer.Tag("_inferred_span.synchronicity", "async"),
+	}
+	if sentTimestamp, err := strconv.ParseInt(record.Attributes["SentTimestamp"], 10, 64); err == nil {
+		opts = append(opts, tracer.StartTime(time.Unix(0, sentTimestamp*int64(time.Millisecond))))
+	}
+	return &inferredSpan{span: tracer.StartSpan("aws.sqs", opts...), isAsync: true}
+}
@@ -0,0 +1,134 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+func TestStartInferredSpanRESTAPI(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ev := loadRawJSON(t, "../testdata/apig-rest-event.json")
+	inferred := startInferredSpan(*ev, tracer.ChildOf(nil))
+	assert.NotNil(t, inferred)
+	assert.False(t, inferred.isAsync)
+	inferred.span.Finish()
+
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, "aws.apigateway", span.OperationName())
+	assert.Equal(t, "GET /users/{id}", span.Tag("resource.name"))
+	assert.Equal(t, "abc123.execute-api.us-east-1.amazonaws.com", span.Tag("service.name"))
+	assert.Equal(t, "abc123.execute-api.us-east-1.amazonaws.com/users/42", span.Tag("http.url"))
+	assert.Equal(t, "GET", span.Tag("http.method"))
+	assert.Equal(t, "prod", span.Tag("stage"))
+	assert.Equal(t, "sync", span.Tag("_inferred_span.synchronicity"))
+	assert.Equal(t, time.Unix(1428582896, 0), span.StartTime())
+}
+
+func TestStartInferredSpanHTTPAPI(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ev := loadRawJSON(t, "../testdata/apig-http-event.json")
+	inferred := startInferredSpan(*ev, tracer.ChildOf(nil))
+	assert.NotNil(t, inferred)
+	assert.False(t, inferred.isAsync)
+	inferred.span.Finish()
+
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, "aws.httpapi", span.OperationName())
+	assert.Equal(t, "POST /orders", span.Tag("resource.name"))
+	assert.Equal(t, "xyz789.execute-api.eu-west-1.amazonaws.com", span.Tag("service.name"))
+	assert.Equal(t, "POST", span.Tag("http.method"))
+	assert.Equal(t, time.Unix(1428582896, 500*int64(time.Millisecond)), span.StartTime())
+}
+
+func TestStartInferredSpanSQS(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ev := loadRawJSON(t, "../testdata/sqs-event.json")
+	inferred := startInferredSpan(*ev, tracer.ChildOf(nil))
+	assert.NotNil(t, inferred)
+	assert.True(t, inferred.isAsync)
+	inferred.span.Finish()
+
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, "aws.sqs", span.OperationName())
+	assert.Equal(t, "my-queue", span.Tag("resource.name"))
+	assert.Equal(t, "sqs", span.Tag("service.name"))
+	assert.Equal(t, "arn:aws:sqs:us-east-2:123456789012:my-queue", span.Tag("event_source_arn"))
+	assert.Equal(t, "AIDAIENQZJOLO23YVJ4VO", span.Tag("sender_id"))
+	assert.Equal(t, "async", span.Tag("_inferred_span.synchronicity"))
+	assert.Equal(t, time.Unix(1545082649, 183*int64(time.Millisecond)), span.StartTime())
+}
+
+func TestStartInferredSpanUnsupportedEvent(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ev := loadRawJSON(t, "../testdata/non-proxy-with-headers.json")
+	assert.Nil(t, startInferredSpan(*ev, tracer.ChildOf(nil)))
+	assert.Nil(t, startInferredSpan(json.RawMessage("not json"), tracer.ChildOf(nil)))
+	assert.Empty(t, mt.OpenSpans())
+}
+
+func TestHandlerStartedParentsFunctionSpanToInferredSpan(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, traceManagedServices: true, propagator: MakePropagator(nil, nil)}
+	ev := loadRawJSON(t, "../testdata/apig-rest-event.json")
+	ctx = listener.HandlerStarted(ctx, *ev)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 2)
+	functionSpan, inferredSpan := spans[0], spans[1]
+	assert.Equal(t, "aws.lambda", functionSpan.OperationName())
+	assert.Equal(t, "aws.apigateway", inferredSpan.OperationName())
+	assert.Equal(t, inferredSpan.SpanID(), functionSpan.ParentID())
+	assert.Equal(t, inferredSpan.TraceID(), functionSpan.TraceID())
+}
+
+func TestHandlerStartedWithoutManagedServices(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, traceManagedServices: false, propagator: MakePropagator(nil, nil)}
+	ev := loadRawJSON(t, "../testdata/sqs-event.json")
+	ctx = listener.HandlerStarted(ctx, *ev)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "aws.lambda", spans[0].OperationName())
+}
@@ -0,0 +1,31 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// createInitPhaseSpans adds a span for each phase of the init marked with MarkInitPhase, as children of the function
+// execution span of the invocation which ended the init, with the times the phases started and ended
+func createInitPhaseSpans(ctx context.Context, parent tracer.Span) {
+	for _, phase := range initphase.FromContext(ctx) {
+		span := tracer.StartSpan("aws.lambda.init_phase",
+			tracer.SpanType("serverless"),
+			tracer.ChildOf(parent.Context()),
+			tracer.StartTime(phase.Start),
+			tracer.ResourceName(phase.Name),
+			tracer.Tag("phase", phase.Name),
+		)
+		span.Finish(tracer.FinishTime(phase.End))
+	}
+}
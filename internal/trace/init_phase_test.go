@@ -0,0 +1,55 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+)
+
+func TestInitPhaseSpans(t *testing.T) {
+	start := initphase.PackageInitTime()
+	phases := []initphase.Phase{
+		{Name: "config", Start: start, End: start.Add(40 * time.Millisecond)},
+		{Name: initphase.UnmarkedPhase, Start: start.Add(40 * time.Millisecond), End: start.Add(100 * time.Millisecond)},
+	}
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil)}
+	invoke := func(phases []initphase.Phase) {
+		ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+		ctx = initphase.NewContext(ctx, phases)
+		ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+		listener.HandlerFinished(ctx, nil, nil)
+	}
+
+	invoke(phases)
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 3)
+	spanned := []initphase.Phase{}
+	for _, span := range spans[:2] {
+		assert.Equal(t, "aws.lambda.init_phase", span.OperationName())
+		assert.Equal(t, spans[2].SpanID(), span.ParentID())
+		spanned = append(spanned, initphase.Phase{Name: span.Tag("phase").(string), Start: span.StartTime(), End: span.FinishTime()})
+	}
+	assert.Equal(t, phases, spanned)
+
+	// The other invocations don't carry the phases
+	mt.Reset()
+	invoke(nil)
+	assert.Len(t, mt.FinishedSpans(), 1)
+}
@@ -0,0 +1,44 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+)
+
+// extractKafkaTraceContext reads the trace context from the headers of the first record of a Kafka event.
+// Records are grouped by topic and partition, so the groups are sorted to make the choice of record stable.
+func extractKafkaTraceContext(ev json.RawMessage, propagator Propagator) (TraceContext, bool) {
+	event, ok := eventsource.ParseKafkaEvent(ev)
+	if !ok {
+		return nil, false
+	}
+
+	keys := make([]string, 0, len(event.Records))
+	for key, records := range event.Records {
+		if len(records) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, false
+	}
+	sort.Strings(keys)
+
+	headers := map[string]string{}
+	for _, header := range event.Records[keys[0]][0].Headers {
+		for key, value := range header {
+			headers[key] = string(value)
+		}
+	}
+	return propagator.Extract(headers)
+}
@@ -0,0 +1,74 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractKafkaTraceContext(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/kafka-event.json")
+
+	traceCtx, ok := extractKafkaTraceContext(*ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: autoKeep,
+	}, traceCtx)
+}
+
+func TestExtractKafkaTraceContextW3C(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/kafka-event.json")
+
+	traceCtx, ok := extractKafkaTraceContext(*ev, MakePropagator([]PropagationStyle{PropagationStyleTraceContext}, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", traceCtx[TraceIDHeader])
+	assert.Equal(t, "45678910", traceCtx[ParentIDHeader])
+}
+
+func TestExtractKafkaTraceContextBase64Headers(t *testing.T) {
+	ev := json.RawMessage(`{
+		"eventSource": "SelfManagedKafka",
+		"records": {"orders-0": [{"topic": "orders", "headers": [
+			{"x-datadog-trace-id": "MTIzMTQ1MjM0Mg=="},
+			{"x-datadog-parent-id": "NDU2Nzg5MTA="},
+			{"x-datadog-sampling-priority": "Mg=="}
+		]}]}
+	}`)
+
+	traceCtx, ok := extractKafkaTraceContext(ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", traceCtx[TraceIDHeader])
+	assert.Equal(t, userKeep, traceCtx[samplingPriorityHeader])
+}
+
+func TestExtractKafkaTraceContextNoTraceHeaders(t *testing.T) {
+	for _, ev := range []string{
+		`{"eventSource": "aws:kafka", "records": {"payments-1": [{"topic": "payments", "headers": [{"content-type": [-84, -19, 0, 5]}]}]}}`,
+		`{"eventSource": "aws:kafka", "records": {}}`,
+		`{"eventSource": "aws:sqs", "records": {"orders-0": [{"headers": [{"x-datadog-trace-id": "MTIzMTQ1MjM0Mg=="}, {"x-datadog-parent-id": "NDU2Nzg5MTA="}]}]}}`,
+		`not json`,
+	} {
+		_, ok := extractKafkaTraceContext(json.RawMessage(ev), MakePropagator(nil, nil))
+		assert.False(t, ok, ev)
+	}
+}
+
+func TestGetDatadogTraceContextFromKafkaEvent(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/kafka-event.json")
+
+	traceCtx, ok := getDatadogTraceContextFromEvent(context.Background(), *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", traceCtx[TraceIDHeader])
+}
@@ -10,11 +10,21 @@ package trace
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
 	"github.com/DataDog/datadog-lambda-go/internal/version"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
@@ -24,67 +34,199 @@ import (
 type (
 	// Listener creates a function execution span and injects it into the context
 	Listener struct {
-		ddTraceEnabled  bool
-		mergeXrayTraces bool
+		ddTraceEnabled          bool
+		tracingDisabled         bool
+		mergeXrayTraces         bool
+		traceManagedServices    bool
+		propagator              Propagator
+		sampleRate              float64
+		traceID128BitGeneration bool
+		payloadCapture          *payloadCapture
+		scrubber                scrub.Scrubber
+		extension               *extension.Client
 	}
 
 	// Config gives options for how the Listener should work
 	Config struct {
-		DDTraceEnabled  bool
-		MergeXrayTraces bool
+		DDTraceEnabled          bool
+		MergeXrayTraces         bool
+		TraceManagedServices    bool
+		PropagationStyleExtract []PropagationStyle
+		PropagationStyleInject  []PropagationStyle
+		// TracingDisabled is set when tracing was turned off explicitly. The trace header helpers then return empty
+		// values, instead of the trace context converted from X-Ray.
+		TracingDisabled bool
+		// SampleRate is used to make a sampling decision for incoming traces without a sampling priority
+		SampleRate float64
+		// TraceID128BitGeneration makes the root traces started by the function use 128 bit trace ids
+		TraceID128BitGeneration bool
+		// CapturePayload records the invocation's request and response payloads on the function execution span,
+		// or in the logs when Datadog tracing is disabled.
+		CapturePayload bool
+		// CapturePayloadMaxDepth is the depth below which captured payloads are kept as nested JSON
+		CapturePayloadMaxDepth int
+		// CapturePayloadObfuscation matches the keys whose values are redacted from captured payloads
+		CapturePayloadObfuscation *regexp.Regexp
+		// Scrubber removes sensitive data from captured payloads and error messages. It may be nil.
+		Scrubber scrub.Scrubber
+		// Extension is notified of the start and end of each invocation. It's nil when the Datadog Extension
+		// isn't installed.
+		Extension *extension.Client
 	}
 )
 
-// The function execution span is the top-level span representing the current Lambda function execution
-var functionExecutionSpan ddtrace.Span
-
-var tracerInitialized = false
+var (
+	// tracerMu guards tracerInitialized, as the tracer is started once per process by the first listener
+	tracerMu          sync.Mutex
+	tracerInitialized = false
+)
 
-// MakeListener initializes a new trace lambda Listener
+// MakeListener initializes a new trace lambda Listener. When Datadog tracing is enabled, the tracer is
+// started straight away so that its setup cost is paid during the function's init phase.
 func MakeListener(config Config) Listener {
+	if config.DDTraceEnabled {
+		startTracer()
+		if !config.MergeXrayTraces && XrayActive() {
+			warnXrayConflict()
+		}
+	}
+
+	var capture *payloadCapture
+	if config.CapturePayload {
+		capture = makePayloadCapture(config.CapturePayloadMaxDepth, config.CapturePayloadObfuscation, config.Scrubber)
+	}
 
 	return Listener{
-		ddTraceEnabled:  config.DDTraceEnabled,
-		mergeXrayTraces: config.MergeXrayTraces,
+		ddTraceEnabled:          config.DDTraceEnabled,
+		tracingDisabled:         config.TracingDisabled,
+		mergeXrayTraces:         config.MergeXrayTraces,
+		traceManagedServices:    config.TraceManagedServices,
+		propagator:              MakePropagator(config.PropagationStyleExtract, config.PropagationStyleInject),
+		sampleRate:              config.SampleRate,
+		traceID128BitGeneration: config.TraceID128BitGeneration,
+		payloadCapture:          capture,
+		scrubber:                config.Scrubber,
+		extension:               config.Extension,
 	}
 }
 
 // HandlerStarted sets up tracing and starts the function execution span if Datadog tracing is enabled
 func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	state := &tracingState{
+		headerOwner: ChooseOwners(XrayActive(), l.ddTraceEnabled, l.mergeXrayTraces).Headers,
+	}
+	if l.tracingDisabled {
+		state.disabled = 1
+	}
+	ctx = context.WithValue(ctx, propagatorKey, l.propagator)
+	ctx = context.WithValue(ctx, tracingStateKey, state)
+
+	if l.payloadCapture != nil {
+		state.requestPayload = l.payloadCapture.captureRaw(msg)
+	}
+
+	if l.extension != nil {
+		if extensionTraceContext := l.extension.StartInvocation(ctx, msg); len(extensionTraceContext) > 0 {
+			ctx = context.WithValue(ctx, extensionTraceContextKey, TraceContext(extensionTraceContext))
+		}
+	}
+
 	if !l.ddTraceEnabled {
 		return ctx
 	}
 
-	ctx, _ = contextWithRootTraceContext(ctx, msg, l.mergeXrayTraces)
+	ctx, _ = contextWithRootTraceContext(ctx, msg, l.mergeXrayTraces, l.propagator, l.sampleRate)
 
-	if !tracerInitialized {
-		tracer.Start(
-			tracer.WithService("aws.lambda"),
-			tracer.WithLambdaMode(true),
-			tracer.WithGlobalTag("_dd.origin", "lambda"),
-		)
-		tracerInitialized = true
+	rootTraceContext, _ := ctx.Value(traceContextKey).(TraceContext)
+	if rootTraceContext[TraceIDHeader] == "" {
+		// The function starts a new trace. Its id is generated once, before the handler runs, so that the
+		// spans, the logs and the headers injected into requests all carry the same one.
+		rootTraceContext = generateRootTraceContext(l.traceID128BitGeneration, time.Now())
+		ctx = context.WithValue(ctx, traceContextKey, rootTraceContext)
+	}
+
+	// Only API Gateway and SQS events have an inferred span, so other events aren't unmarshalled
+	if source := eventsource.Get(ctx, msg); l.traceManagedServices && (source == eventsource.APIGateway || source == eventsource.SQS) {
+		rootSpanContext, _ := ConvertTraceContextToSpanContext(rootTraceContext)
+		state.inferredSpan = startInferredSpan(msg, childOf(rootSpanContext, generatedTraceID(rootTraceContext)))
 	}
 
-	functionExecutionSpan = startFunctionExecutionSpan(ctx, l.mergeXrayTraces)
+	state.functionExecutionSpan = startFunctionExecutionSpan(ctx, l.mergeXrayTraces, state.inferredSpan)
+	createInitPhaseSpans(ctx, state.functionExecutionSpan)
+
+	if traceIDHigh := getTraceIDHigh(rootTraceContext); traceIDHigh != 0 {
+		tagTraceIDHigh(state.functionExecutionSpan, traceIDHigh)
+		if state.inferredSpan != nil {
+			tagTraceIDHigh(state.inferredSpan.span, traceIDHigh)
+		}
+	}
+
+	if state.inferredSpan != nil && state.inferredSpan.isAsync {
+		state.inferredSpan.span.Finish()
+	}
 
 	// Add the span to the context so the user can create child spans
-	ctx = tracer.ContextWithSpan(ctx, functionExecutionSpan)
+	ctx = tracer.ContextWithSpan(ctx, state.functionExecutionSpan)
 
 	return ctx
 }
 
 // HandlerFinished ends the function execution span and stops the tracer
-func (l *Listener) HandlerFinished(ctx context.Context, err error) {
-	if functionExecutionSpan != nil {
-		functionExecutionSpan.Finish(tracer.WithError(err))
+func (l *Listener) HandlerFinished(ctx context.Context, response interface{}, err error) {
+	state, ok := ctx.Value(tracingStateKey).(*tracingState)
+	if !ok {
+		// HandlerStarted didn't run to completion
+		state = &tracingState{}
+	}
+	if l.payloadCapture != nil {
+		responsePayload := l.payloadCapture.capture(response)
+		if l.ddTraceEnabled && state.functionExecutionSpan != nil {
+			state.functionExecutionSpan.SetTag(requestPayloadTag, state.requestPayload)
+			state.functionExecutionSpan.SetTag(responsePayloadTag, responsePayload)
+		} else {
+			logPayloads(ctx, state.requestPayload, responsePayload)
+		}
+	}
+	err = scrubError(l.scrubber, err)
+	if state.functionExecutionSpan != nil {
+		state.functionExecutionSpan.Finish(tracer.WithError(err))
+	}
+	if state.inferredSpan != nil && !state.inferredSpan.isAsync {
+		state.inferredSpan.span.Finish(tracer.WithError(err))
+	}
+	if l.extension != nil {
+		l.extension.EndInvocation(ctx, response, err, GetTraceHeaders(ctx))
 	}
 	tracer.Flush()
 }
 
+// startTracer starts the Datadog tracer, once per process. Traces are sent to the Datadog Extension when it
+// is installed, and otherwise written to the logs to be picked up by the Datadog Forwarder.
+func startTracer() {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	if tracerInitialized {
+		return
+	}
+	useExtension := extension.IsInstalled()
+	if useExtension {
+		logger.Debug("Sending traces to the Datadog Extension")
+	} else {
+		logger.Debug("Datadog Extension not found, writing traces to the logs")
+	}
+
+	tracer.Start(
+		tracer.WithService("aws.lambda"),
+		tracer.WithLambdaMode(!useExtension),
+		tracer.WithGlobalTag("_dd.origin", "lambda"),
+	)
+	tracerInitialized = true
+}
+
 // startFunctionExecutionSpan starts a span that represents the current Lambda function execution
-// and returns the span so that it can be finished when the function execution is complete
-func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool) tracer.Span {
+// and returns the span so that it can be finished when the function execution is complete.
+// If an inferred span was started, it becomes the parent of the function execution span.
+func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool, inferred *inferredSpan) tracer.Span {
 	// Extract information from context
 	lambdaCtx, _ := lambdacontext.FromContext(ctx)
 	rootTraceContext, ok := ctx.Value(traceContextKey).(TraceContext)
@@ -92,8 +234,10 @@ func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool) trace
 		logger.Error(fmt.Errorf("Error extracting trace context from context object"))
 	}
 
-	functionArn := lambdaCtx.InvokedFunctionArn
-	functionArn = strings.ToLower(functionArn)
+	var functionArn string
+	if lambdaCtx != nil {
+		functionArn = strings.ToLower(lambdaCtx.InvokedFunctionArn)
+	}
 	functionArn, functionVersion := separateVersionFromFunctionArn(functionArn)
 
 	// Set the root trace context as the parent of the function execution span
@@ -102,22 +246,42 @@ func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool) trace
 	if err == nil {
 		parentSpanContext = convertedSpanContext
 	}
+	isParentFromXray := parentSpanContext != nil && mergeXrayTraces
+	if inferred != nil {
+		parentSpanContext = inferred.span.Context()
+	}
 
-	span := tracer.StartSpan(
-		"aws.lambda", // This operation name will be replaced with the value of the service tag by the Forwarder
+	// Outside of Lambda, for example in local integration tests, the Lambda context and the function name may be
+	// missing. Their tags are omitted rather than empty.
+	opts := []ddtrace.StartSpanOption{
 		tracer.SpanType("serverless"),
-		tracer.ChildOf(parentSpanContext),
-		tracer.ResourceName(lambdacontext.FunctionName),
-		tracer.Tag("cold_start", ctx.Value("cold_start")),
-		tracer.Tag("function_arn", functionArn),
-		tracer.Tag("function_version", functionVersion),
-		tracer.Tag("request_id", lambdaCtx.AwsRequestID),
-		tracer.Tag("resource_names", lambdacontext.FunctionName),
+		childOf(parentSpanContext, generatedTraceID(rootTraceContext)),
 		tracer.Tag("datadog_lambda", version.DDLambdaVersion),
 		tracer.Tag("dd_trace", version.DDTraceVersion),
-	)
+	}
+	if coldStart, ok := ctx.Value("cold_start").(bool); ok {
+		opts = append(opts, tracer.Tag("cold_start", coldStart))
+	}
+	if functionName := lambdacontext.FunctionName; functionName != "" {
+		opts = append(opts,
+			tracer.ResourceName(functionName),
+			tracer.Tag("functionname", strings.ToLower(functionName)),
+			tracer.Tag("resource_names", functionName),
+		)
+	}
+	if functionArn != "" {
+		opts = append(opts,
+			tracer.Tag("function_arn", functionArn),
+			tracer.Tag("function_version", functionVersion),
+		)
+	}
+	if lambdaCtx != nil && lambdaCtx.AwsRequestID != "" {
+		opts = append(opts, tracer.Tag("request_id", lambdaCtx.AwsRequestID))
+	}
+	// This operation name will be replaced with the value of the service tag by the Forwarder
+	span := tracer.StartSpan("aws.lambda", opts...)
 
-	if parentSpanContext != nil && mergeXrayTraces {
+	if isParentFromXray {
 		// This tag will cause the Forwarder to drop the span (to avoid redundancy with X-Ray)
 		span.SetTag("_dd.parent_source", "xray")
 	}
@@ -125,6 +289,79 @@ func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool) trace
 	return span
 }
 
+// scrubError returns an error with a scrubbed message, so that sensitive data in the handler's error doesn't
+// reach the span. The original error is returned when there is nothing to scrub.
+func scrubError(scrubber scrub.Scrubber, err error) error {
+	if err == nil || scrubber == nil {
+		return err
+	}
+	message := err.Error()
+	if scrubbed := scrubber.Scrub(message); scrubbed != message {
+		return errors.New(scrubbed)
+	}
+	return err
+}
+
+// generateTraceIDHigh returns the upper 64 bits of a new 128 bit trace id, which hold the trace's start time
+// in seconds followed by 32 zero bits.
+func generateTraceIDHigh(now time.Time) uint64 {
+	return uint64(now.Unix()) << 32
+}
+
+// generateRootTraceContext returns the root trace context of an invocation which starts a new trace. Its trace id
+// is drawn from crypto/rand, with the upper 64 bits of a 128 bit trace id when traceID128Bit is set. It has no
+// parent id, as the first span of the invocation is the root span of the trace.
+func generateRootTraceContext(traceID128Bit bool, now time.Time) TraceContext {
+	traceCtx := TraceContext{}
+	if traceID, err := randomID(); err == nil {
+		traceCtx[TraceIDHeader] = strconv.FormatUint(traceID, 10)
+	} else {
+		// The tracer generates the trace id with the root span instead
+		logger.Debug(fmt.Sprintf("Couldn't generate a trace id: %v", err))
+	}
+	if traceID128Bit {
+		setTraceIDHigh(traceCtx, generateTraceIDHigh(now))
+	}
+	return traceCtx
+}
+
+// randomID returns a random non-zero 63 bit id, in the range of the ids generated by the tracer
+func randomID() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint64(b[:]) >> 1; id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// generatedTraceID returns the trace id of a root trace context generated by generateRootTraceContext, and 0 for
+// the trace contexts which continue an upstream trace
+func generatedTraceID(traceCtx TraceContext) uint64 {
+	if traceCtx[ParentIDHeader] != "" {
+		return 0
+	}
+	traceID, _ := strconv.ParseUint(traceCtx[TraceIDHeader], 10, 64)
+	return traceID
+}
+
+// childOf makes a span the child of parent. Without a parent, the span is the root span of its trace, and takes
+// the generated trace id as its id, since the tracer gives the trace of a root span the id of the span.
+func childOf(parent ddtrace.SpanContext, generatedTraceID uint64) ddtrace.StartSpanOption {
+	if parent == nil && generatedTraceID != 0 {
+		return tracer.WithSpanID(generatedTraceID)
+	}
+	return tracer.ChildOf(parent)
+}
+
+// tagTraceIDHigh records the upper 64 bits of the trace id on a span, so the full 128 bit id is reported.
+func tagTraceIDHigh(span ddtrace.Span, traceIDHigh uint64) {
+	span.SetTag(traceIDHighTag, fmt.Sprintf("%016x", traceIDHigh))
+}
+
 func separateVersionFromFunctionArn(functionArn string) (arnWithoutVersion string, functionVersion string) {
 	arnSegments := strings.Split(functionArn, ":")
 	if cap(arnSegments) < 7 {
@@ -10,11 +10,20 @@ package trace
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 func TestSeparateVersionFromFunctionArnWithVersion(t *testing.T) {
@@ -48,13 +57,13 @@ func TestSeparateVersionFromFunctionArnEmptyString(t *testing.T) {
 }
 
 var traceContextFromXray = TraceContext{
-	traceIDHeader:  "1231452342",
-	parentIDHeader: "45678910",
+	TraceIDHeader:  "1231452342",
+	ParentIDHeader: "45678910",
 }
 
 var traceContextFromEvent = TraceContext{
-	traceIDHeader:  "1231452342",
-	parentIDHeader: "45678910",
+	TraceIDHeader:  "1231452342",
+	ParentIDHeader: "45678910",
 }
 
 var mockLambdaContext = lambdacontext.LambdaContext{
@@ -73,7 +82,7 @@ func TestStartFunctionExecutionSpanFromXrayWithMergeEnabled(t *testing.T) {
 	mt := mocktracer.Start()
 	defer mt.Stop()
 
-	span := startFunctionExecutionSpan(ctx, true)
+	span := startFunctionExecutionSpan(ctx, true, nil)
 	span.Finish()
 	finishedSpan := mt.FinishedSpans()[0]
 
@@ -86,10 +95,29 @@ func TestStartFunctionExecutionSpanFromXrayWithMergeEnabled(t *testing.T) {
 	assert.Equal(t, "abcdefgh-1234-5678-1234-abcdefghijkl", finishedSpan.Tag("request_id"))
 	assert.Equal(t, "MockFunctionName", finishedSpan.Tag("resource.name"))
 	assert.Equal(t, "MockFunctionName", finishedSpan.Tag("resource_names"))
+	assert.Equal(t, "mockfunctionname", finishedSpan.Tag("functionname"))
 	assert.Equal(t, "serverless", finishedSpan.Tag("span.type"))
 	assert.Equal(t, "xray", finishedSpan.Tag("_dd.parent_source"))
 }
 
+func TestStartFunctionExecutionSpanWithoutLambdaContext(t *testing.T) {
+	defer func(functionName string) { lambdacontext.FunctionName = functionName }(lambdacontext.FunctionName)
+	lambdacontext.FunctionName = ""
+	ctx := context.WithValue(context.Background(), traceContextKey, traceContextFromEvent)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span := startFunctionExecutionSpan(ctx, false, nil)
+	span.Finish()
+	finishedSpan := mt.FinishedSpans()[0]
+
+	assert.Equal(t, "aws.lambda", finishedSpan.OperationName())
+	for _, tag := range []string{"cold_start", "function_arn", "function_version", "request_id", "functionname", "resource_names"} {
+		assert.Nil(t, finishedSpan.Tag(tag), tag)
+	}
+}
+
 func TestStartFunctionExecutionSpanFromXrayWithMergeDisabled(t *testing.T) {
 	ctx := context.Background()
 
@@ -101,7 +129,7 @@ func TestStartFunctionExecutionSpanFromXrayWithMergeDisabled(t *testing.T) {
 	mt := mocktracer.Start()
 	defer mt.Stop()
 
-	span := startFunctionExecutionSpan(ctx, false)
+	span := startFunctionExecutionSpan(ctx, false, nil)
 	span.Finish()
 	finishedSpan := mt.FinishedSpans()[0]
 
@@ -119,7 +147,7 @@ func TestStartFunctionExecutionSpanFromEventWithMergeEnabled(t *testing.T) {
 	mt := mocktracer.Start()
 	defer mt.Stop()
 
-	span := startFunctionExecutionSpan(ctx, true)
+	span := startFunctionExecutionSpan(ctx, true, nil)
 	span.Finish()
 	finishedSpan := mt.FinishedSpans()[0]
 
@@ -137,9 +165,325 @@ func TestStartFunctionExecutionSpanFromEventWithMergeDisabled(t *testing.T) {
 	mt := mocktracer.Start()
 	defer mt.Stop()
 
-	span := startFunctionExecutionSpan(ctx, false)
+	span := startFunctionExecutionSpan(ctx, false, nil)
 	span.Finish()
 	finishedSpan := mt.FinishedSpans()[0]
 
 	assert.Equal(t, nil, finishedSpan.Tag("_dd.parent_source"))
 }
+
+func TestHandlerStartedSpanMatchesTraceHeaders(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil)}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+
+	span, ok := tracer.SpanFromContext(ctx)
+	assert.True(t, ok)
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, strconv.FormatUint(span.Context().TraceID(), 10), headers[TraceIDHeader])
+	assert.Equal(t, strconv.FormatUint(span.Context().SpanID(), 10), headers[ParentIDHeader])
+
+	listener.HandlerFinished(ctx, nil, nil)
+	finishedSpans := mt.FinishedSpans()
+	assert.Len(t, finishedSpans, 1)
+	assert.Equal(t, "aws.lambda", finishedSpans[0].OperationName())
+	assert.Equal(t, false, finishedSpans[0].Tag("cold_start"))
+}
+
+func TestHandlerStartedTracingDisabled(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := MakeListener(Config{DDTraceEnabled: false})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage("{}"))
+
+	_, ok := tracer.SpanFromContext(ctx)
+	assert.False(t, ok)
+	assert.False(t, tracerInitialized)
+}
+
+func TestHandlerStartedGenerates128BitTraceID(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil), traceID128BitGeneration: true}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+	traceIDHigh := getTraceIDHigh(GetTraceHeaders(ctx))
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.NotZero(t, traceIDHigh)
+	assert.Zero(t, traceIDHigh&0xffffffff)
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, fmt.Sprintf("%016x", traceIDHigh), span.Tag(traceIDHighTag))
+	assert.Equal(t, span.TraceID(), span.SpanID())
+}
+
+func TestHandlerStartedGeneratesRootTraceContext(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil)}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+
+	rootTraceContext, _ := ctx.Value(traceContextKey).(TraceContext)
+	traceID := rootTraceContext[TraceIDHeader]
+	assert.NotEmpty(t, traceID)
+	assert.NotContains(t, rootTraceContext, ParentIDHeader)
+
+	// The headers are the same however many goroutines of the handler read them
+	traceIDs := make(chan string, 10)
+	for i := 0; i < cap(traceIDs); i++ {
+		go func() {
+			traceIDs <- GetTraceHeaders(ctx)[TraceIDHeader]
+		}()
+	}
+	for i := 0; i < cap(traceIDs); i++ {
+		assert.Equal(t, traceID, <-traceIDs)
+	}
+	listener.HandlerFinished(ctx, nil, nil)
+
+	// The function execution span is the root span of the generated trace
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, traceID, strconv.FormatUint(span.TraceID(), 10))
+	assert.Zero(t, span.ParentID())
+}
+
+func TestHandlerStartedGeneratesRootTraceContextWithInferredSpan(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, traceManagedServices: true, propagator: MakePropagator(nil, nil)}
+	ev := loadRawJSON(t, "../testdata/apig-rest-event.json")
+	ctx = listener.HandlerStarted(ctx, *ev)
+	traceID := GetTraceHeaders(ctx)[TraceIDHeader]
+	listener.HandlerFinished(ctx, nil, nil)
+
+	// The inferred span is the root span of the generated trace, and the parent of the function execution span
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 2)
+	functionSpan, inferredSpan := spans[0], spans[1]
+	assert.Equal(t, traceID, strconv.FormatUint(inferredSpan.TraceID(), 10))
+	assert.Zero(t, inferredSpan.ParentID())
+	assert.Equal(t, inferredSpan.SpanID(), functionSpan.ParentID())
+	assert.Equal(t, traceID, strconv.FormatUint(functionSpan.TraceID(), 10))
+}
+
+func TestHandlerStartedGeneratesDistinctTraceIDs(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil)}
+	traceIDs := map[string]struct{}{}
+	for i := 0; i < 5; i++ {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage("{}"))
+		traceIDs[GetTraceHeaders(ctx)[TraceIDHeader]] = struct{}{}
+		listener.HandlerFinished(ctx, nil, nil)
+	}
+
+	assert.Len(t, traceIDs, 5)
+}
+
+func TestHandlerStartedKeepsUpstream128BitTraceID(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil), traceID128BitGeneration: true}
+	ev := json.RawMessage(`{"headers": {"traceparent": "00-463ac35c9f6413ad48485a3953bb6124-0020000000000001-01"}}`)
+	ctx = listener.HandlerStarted(ctx, ev)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, "463ac35c9f6413ad", span.Tag(traceIDHighTag))
+}
+
+func TestHandlerStartedWithout128BitTraceIDGeneration(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil)}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+	assert.NotContains(t, GetTraceHeaders(ctx), tagsHeader)
+	listener.HandlerFinished(ctx, nil, nil)
+
+	assert.Nil(t, mt.FinishedSpans()[0].Tag(traceIDHighTag))
+}
+
+func TestHandlerStartedWithTracingDisabled(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: false, tracingDisabled: true, propagator: MakePropagator(nil, nil)}
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+	ctx = listener.HandlerStarted(ctx, *ev)
+
+	assert.Nil(t, ctx.Value(traceContextKey))
+	assert.Equal(t, TraceContext{}, GetTraceHeaders(ctx))
+	assert.Equal(t, TraceContext{}, ConvertCurrentXrayTraceContext(ctx))
+	headers := map[string]string{}
+	InjectTraceHeaders(ctx, headers)
+	assert.Empty(t, headers)
+
+	listener.HandlerFinished(ctx, nil, nil)
+	assert.Empty(t, mt.FinishedSpans())
+}
+
+func TestHandlerStartedWithDefaultConfig(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+
+	// Tracing isn't disabled explicitly, so the trace context of the invocation is converted from X-Ray
+	listener := MakeListener(Config{})
+	ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+
+	xrayTraceContext, err := convertXrayTraceContextFromLambdaContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, xrayTraceContext, GetTraceHeaders(ctx))
+	assert.NotEmpty(t, ConvertCurrentXrayTraceContext(ctx)[TraceIDHeader])
+	listener.HandlerFinished(ctx, nil, nil)
+}
+
+func TestDisableForInvocation(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil)}
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+	ctx = listener.HandlerStarted(ctx, *ev)
+	assert.NotEmpty(t, GetTraceHeaders(ctx)[TraceIDHeader])
+
+	DisableForInvocation(ctx)
+	assert.Equal(t, TraceContext{}, GetTraceHeaders(ctx))
+	listener.HandlerFinished(ctx, nil, nil)
+
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, -1, span.Tag("sampling.priority"))
+
+	// The next invocation is traced again
+	ctx = lambdacontext.NewContext(context.WithValue(context.Background(), "cold_start", false), &mockLambdaContext)
+	ctx = listener.HandlerStarted(ctx, *ev)
+	assert.NotEmpty(t, GetTraceHeaders(ctx)[TraceIDHeader])
+	listener.HandlerFinished(ctx, nil, nil)
+}
+
+func TestDisableForInvocationOutsideHandler(t *testing.T) {
+	// Without an invocation in the context there is nothing to disable
+	DisableForInvocation(context.Background())
+	assert.False(t, isTracingDisabled(context.Background()))
+}
+
+// fakeExtension records the requests the listener sends to the Datadog Extension
+type fakeExtension struct {
+	routes  []string
+	bodies  []string
+	headers []http.Header
+}
+
+func (fe *fakeExtension) start(t *testing.T, startHeaders map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		fe.routes = append(fe.routes, r.URL.Path)
+		fe.bodies = append(fe.bodies, string(body))
+		fe.headers = append(fe.headers, r.Header)
+		if r.URL.Path == "/lambda/start-invocation" {
+			for key, value := range startHeaders {
+				w.Header().Set(key, value)
+			}
+		}
+	}))
+}
+
+func TestHandlerNotifiesExtension(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	fe := fakeExtension{}
+	server := fe.start(t, map[string]string{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: userKeep,
+	})
+	defer server.Close()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil), extension: extension.MakeClient(server.URL)}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage(`{"key": "value"}`))
+	rootTraceContext, _ := ctx.Value(traceContextKey).(TraceContext)
+	headers := GetTraceHeaders(ctx)
+	listener.HandlerFinished(ctx, map[string]int{"statusCode": 200}, nil)
+
+	assert.Equal(t, []string{"/lambda/start-invocation", "/lambda/end-invocation"}, fe.routes)
+	assert.Equal(t, `{"key": "value"}`, fe.bodies[0])
+	assert.Equal(t, `{"statusCode":200}`, fe.bodies[1])
+	assert.Equal(t, "1231452342", rootTraceContext[TraceIDHeader])
+	assert.Equal(t, "45678910", rootTraceContext[ParentIDHeader])
+	assert.Equal(t, userKeep, rootTraceContext[samplingPriorityHeader])
+	assert.Equal(t, headers[TraceIDHeader], fe.headers[1].Get(TraceIDHeader))
+	assert.Equal(t, headers[ParentIDHeader], fe.headers[1].Get("x-datadog-span-id"))
+	assert.Empty(t, fe.headers[1].Get("x-datadog-invocation-error"))
+}
+
+func TestHandlerNotifiesExtensionOfError(t *testing.T) {
+	fe := fakeExtension{}
+	server := fe.start(t, nil)
+	defer server.Close()
+
+	listener := MakeListener(Config{DDTraceEnabled: false, Extension: extension.MakeClient(server.URL)})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	listener.HandlerFinished(ctx, nil, errors.New("something went wrong"))
+
+	assert.Equal(t, []string{"/lambda/start-invocation", "/lambda/end-invocation"}, fe.routes)
+	assert.Equal(t, "true", fe.headers[1].Get("x-datadog-invocation-error"))
+	assert.Equal(t, "something went wrong", fe.headers[1].Get("x-datadog-invocation-error-msg"))
+	assert.Empty(t, fe.headers[1].Get(TraceIDHeader))
+}
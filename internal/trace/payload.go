@@ -0,0 +1,152 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	// DefaultCapturePayloadMaxDepth is the depth below which captured payloads are kept as nested JSON.
+	DefaultCapturePayloadMaxDepth = 10
+	// DefaultCapturePayloadObfuscationPattern matches the keys whose values are redacted from captured payloads.
+	DefaultCapturePayloadObfuscationPattern = `(?i)(authorization|password|token)`
+
+	// maxCapturedPayloadLength is the size at which a captured payload is truncated
+	maxCapturedPayloadLength = 5000
+	redactedValue            = "redacted"
+	requestPayloadTag        = "function.request"
+	responsePayloadTag       = "function.response"
+)
+
+// payloadCapture serializes invocation payloads for debugging, without the values of sensitive keys.
+type payloadCapture struct {
+	maxDepth    int
+	obfuscation *regexp.Regexp
+	scrubber    scrub.Scrubber
+}
+
+// makePayloadCapture creates a payloadCapture, using the defaults for a zero max depth or a nil pattern.
+// The scrubber, which may be nil, is applied to every value left after redaction.
+func makePayloadCapture(maxDepth int, obfuscation *regexp.Regexp, scrubber scrub.Scrubber) *payloadCapture {
+	if maxDepth <= 0 {
+		maxDepth = DefaultCapturePayloadMaxDepth
+	}
+	if obfuscation == nil {
+		obfuscation = regexp.MustCompile(DefaultCapturePayloadObfuscationPattern)
+	}
+	return &payloadCapture{maxDepth: maxDepth, obfuscation: obfuscation, scrubber: scrubber}
+}
+
+// captureRaw returns the JSON payload with sensitive values redacted, nesting limited to the max depth,
+// and truncated to the max length.
+func (c *payloadCapture) captureRaw(payload json.RawMessage) string {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		// Not JSON, so there are no keys to redact
+		return truncatePayload(scrub.String(c.scrubber, string(payload)))
+	}
+
+	encoded, err := json.Marshal(c.sanitize(value, 1))
+	if err != nil {
+		return ""
+	}
+	return truncatePayload(string(encoded))
+}
+
+// capture serializes a value returned by the handler to JSON, then captures it like a raw payload.
+func (c *payloadCapture) capture(response interface{}) string {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("couldn't serialize the response payload: %v", err))
+		return ""
+	}
+	return c.captureRaw(encoded)
+}
+
+// sanitize redacts the values of sensitive keys at every level. Objects and arrays nested deeper than the max
+// depth are replaced with their redacted JSON string.
+func (c *payloadCapture) sanitize(value interface{}, depth int) interface{} {
+	var sanitized interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		sanitizedMap := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			if c.obfuscation.MatchString(key) {
+				sanitizedMap[key] = redactedValue
+			} else {
+				sanitizedMap[key] = c.sanitize(child, depth+1)
+			}
+		}
+		sanitized = sanitizedMap
+	case []interface{}:
+		sanitizedSlice := make([]interface{}, len(v))
+		for i, child := range v {
+			sanitizedSlice[i] = c.sanitize(child, depth+1)
+		}
+		sanitized = sanitizedSlice
+	case string:
+		return scrub.String(c.scrubber, v)
+	case json.Number:
+		// A scrubbed number isn't a number anymore, so it's kept as a string
+		if scrubbed := scrub.String(c.scrubber, v.String()); scrubbed != v.String() {
+			return scrubbed
+		}
+		return v
+	default:
+		return value
+	}
+
+	if depth == c.maxDepth+1 {
+		encoded, _ := json.Marshal(sanitized)
+		return string(encoded)
+	}
+	return sanitized
+}
+
+// truncatePayload cuts a payload longer than maxCapturedPayloadLength bytes. The cut backs up to the start of a
+// rune, so that a multi-byte character isn't split into invalid UTF-8.
+func truncatePayload(payload string) string {
+	if len(payload) <= maxCapturedPayloadLength {
+		return payload
+	}
+	end := maxCapturedPayloadLength
+	for end > 0 && !utf8.RuneStart(payload[end]) {
+		end--
+	}
+	return payload[:end] + "..."
+}
+
+// logPayloads writes the captured payloads of an invocation as a single structured log line, for when
+// there is no span to attach them to.
+func logPayloads(ctx context.Context, request string, response string) {
+	entry := map[string]string{
+		requestPayloadTag:  request,
+		responsePayloadTag: response,
+	}
+	if lambdaCtx, ok := lambdacontext.FromContext(ctx); ok {
+		entry["request_id"] = lambdaCtx.AwsRequestID
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	logger.Raw(string(encoded))
+}
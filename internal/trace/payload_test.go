@@ -0,0 +1,178 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/scrub"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+)
+
+func TestCaptureRedactsDefaultKeys(t *testing.T) {
+	capture := makePayloadCapture(0, nil, nil)
+
+	payload := capture.captureRaw(json.RawMessage(`{
+		"headers": {"Authorization": "Bearer abc", "X-Api-Token": "def", "Accept": "*/*"},
+		"user": {"name": "jane", "password": "hunter2"},
+		"access_token": "ghi",
+		"amount": 12.50
+	}`))
+
+	assert.JSONEq(t, `{
+		"headers": {"Authorization": "redacted", "X-Api-Token": "redacted", "Accept": "*/*"},
+		"user": {"name": "jane", "password": "redacted"},
+		"access_token": "redacted",
+		"amount": 12.50
+	}`, payload)
+}
+
+func TestCaptureRedactsInsideArrays(t *testing.T) {
+	capture := makePayloadCapture(0, nil, nil)
+
+	payload := capture.captureRaw(json.RawMessage(`{"Records": [{"password": "a"}, {"password": "b", "id": 1}]}`))
+
+	assert.JSONEq(t, `{"Records": [{"password": "redacted"}, {"password": "redacted", "id": 1}]}`, payload)
+}
+
+func TestCaptureRedactsWholeSensitiveObjects(t *testing.T) {
+	capture := makePayloadCapture(0, nil, nil)
+
+	payload := capture.captureRaw(json.RawMessage(`{"token": {"value": "abc", "expires": 3600}}`))
+
+	assert.JSONEq(t, `{"token": "redacted"}`, payload)
+}
+
+func TestCaptureWithCustomObfuscation(t *testing.T) {
+	capture := makePayloadCapture(0, regexp.MustCompile(`^ssn$`), nil)
+
+	payload := capture.captureRaw(json.RawMessage(`{"ssn": "123-45-6789", "password": "hunter2"}`))
+
+	assert.JSONEq(t, `{"ssn": "redacted", "password": "hunter2"}`, payload)
+}
+
+func TestCaptureLimitsDepth(t *testing.T) {
+	capture := makePayloadCapture(2, nil, nil)
+
+	payload := capture.captureRaw(json.RawMessage(`{"a": {"b": {"c": {"password": "hunter2", "d": 1}}}, "e": [[1, 2]]}`))
+
+	// Values nested deeper than the max depth become JSON strings, still redacted
+	assert.JSONEq(t, `{"a": {"b": "{\"c\":{\"d\":1,\"password\":\"redacted\"}}"}, "e": ["[1,2]"]}`, payload)
+}
+
+func TestCaptureTruncates(t *testing.T) {
+	capture := makePayloadCapture(0, nil, nil)
+
+	payload := capture.capture(map[string]string{"body": strings.Repeat("a", 2*maxCapturedPayloadLength)})
+
+	assert.Len(t, payload, maxCapturedPayloadLength+len("..."))
+	assert.True(t, strings.HasSuffix(payload, "..."))
+}
+
+func TestTruncatePayloadKeepsRunesWhole(t *testing.T) {
+	// The limit falls in the middle of the 3 bytes of the last character
+	payload := strings.Repeat("a", maxCapturedPayloadLength-1) + "€"
+
+	truncated := truncatePayload(payload)
+
+	assert.True(t, utf8.ValidString(truncated))
+	assert.Equal(t, strings.Repeat("a", maxCapturedPayloadLength-1)+"...", truncated)
+}
+
+func TestCaptureNonJSONPayload(t *testing.T) {
+	capture := makePayloadCapture(0, nil, nil)
+
+	assert.Equal(t, "not json", capture.captureRaw(json.RawMessage("not json")))
+	assert.Equal(t, `"ok"`, capture.capture("ok"))
+	assert.Equal(t, "null", capture.capture(nil))
+}
+
+func TestHandlerFinishedTagsPayloads(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil), payloadCapture: makePayloadCapture(0, nil, nil)}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage(`{"user": "jane", "password": "hunter2"}`))
+	listener.HandlerFinished(ctx, map[string]string{"token": "abc", "status": "ok"}, nil)
+
+	span := mt.FinishedSpans()[0]
+	assert.JSONEq(t, `{"user": "jane", "password": "redacted"}`, span.Tag(requestPayloadTag).(string))
+	assert.JSONEq(t, `{"token": "redacted", "status": "ok"}`, span.Tag(responsePayloadTag).(string))
+}
+
+func TestHandlerFinishedLogsPayloadsWithoutTracing(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stderr)
+
+	listener := Listener{ddTraceEnabled: false, propagator: MakePropagator(nil, nil), payloadCapture: makePayloadCapture(0, nil, nil)}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage(`{"password": "hunter2"}`))
+	listener.HandlerFinished(ctx, 5, nil)
+
+	entry := map[string]string{}
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &entry))
+	assert.Equal(t, map[string]string{
+		"function.request":  `{"password":"redacted"}`,
+		"function.response": "5",
+		"request_id":        mockLambdaContext.AwsRequestID,
+	}, entry)
+}
+
+func TestCaptureScrubsValues(t *testing.T) {
+	capture := makePayloadCapture(0, nil, scrub.MakeRegexScrubber())
+
+	payload := capture.captureRaw(json.RawMessage(`{"email": "bob@example.com", "card": 4111111111111111, "count": 3}`))
+
+	assert.JSONEq(t, `{"email": "[redacted]", "card": "[redacted]", "count": 3}`, payload)
+	assert.Equal(t, "[redacted] signed up", capture.captureRaw(json.RawMessage("bob@example.com signed up")))
+}
+
+func TestHandlerFinishedScrubsError(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{ddTraceEnabled: true, propagator: MakePropagator(nil, nil), scrubber: scrub.MakeRegexScrubber()}
+	ctx = listener.HandlerStarted(ctx, json.RawMessage("{}"))
+	listener.HandlerFinished(ctx, nil, errors.New("no account for bob@example.com"))
+
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, "no account for [redacted]", span.Tag("error").(error).Error())
+}
+
+func TestScrubError(t *testing.T) {
+	err := errors.New("nothing sensitive")
+	assert.Same(t, err, scrubError(scrub.MakeRegexScrubber(), err))
+	assert.Same(t, err, scrubError(nil, err))
+	assert.Nil(t, scrubError(scrub.MakeRegexScrubber(), nil))
+}
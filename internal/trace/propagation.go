@@ -0,0 +1,333 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+)
+
+// PropagationStyle is a header format used to carry trace context between services.
+type PropagationStyle string
+
+const (
+	// PropagationStyleDatadog uses the x-datadog-* headers.
+	PropagationStyleDatadog PropagationStyle = "datadog"
+	// PropagationStyleTraceContext uses the W3C traceparent and tracestate headers.
+	PropagationStyleTraceContext PropagationStyle = "tracecontext"
+	// PropagationStyleB3Multi uses the x-b3-* headers.
+	PropagationStyleB3Multi PropagationStyle = "b3multi"
+	// PropagationStyleB3 uses the single b3 header.
+	PropagationStyleB3 PropagationStyle = "b3"
+	// PropagationStyleNone disables propagation.
+	PropagationStyleNone PropagationStyle = "none"
+)
+
+// DefaultPropagationStyles are used for extraction and injection when no styles are configured.
+var DefaultPropagationStyles = []PropagationStyle{PropagationStyleDatadog, PropagationStyleTraceContext}
+
+type (
+	// Propagator extracts and injects a TraceContext using an ordered list of propagation styles.
+	// Extraction tries each style in order and returns the first match, while injection writes
+	// headers for every style.
+	Propagator struct {
+		extract []PropagationStyle
+		inject  []PropagationStyle
+	}
+)
+
+// ParsePropagationStyles parses a comma separated list of propagation style names, such as
+// "datadog,tracecontext". Names are case insensitive and duplicates are dropped. It returns the
+// recognised styles in order, along with any names it didn't recognise. If the list only contains
+// "none", an empty non-nil slice is returned. If no valid style was found, nil is returned.
+func ParsePropagationStyles(value string) ([]PropagationStyle, []string) {
+	var styles []PropagationStyle
+	var unknown []string
+	seen := map[PropagationStyle]bool{}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		var style PropagationStyle
+		switch name {
+		case "datadog":
+			style = PropagationStyleDatadog
+		case "tracecontext":
+			style = PropagationStyleTraceContext
+		case "b3multi":
+			style = PropagationStyleB3Multi
+		case "b3", "b3 single header":
+			style = PropagationStyleB3
+		case "none":
+			if styles == nil {
+				styles = []PropagationStyle{}
+			}
+			continue
+		default:
+			unknown = append(unknown, name)
+			continue
+		}
+		if !seen[style] {
+			seen[style] = true
+			styles = append(styles, style)
+		}
+	}
+	return styles, unknown
+}
+
+// MakePropagator creates a Propagator with the given extraction and injection styles.
+// A nil list of styles falls back to DefaultPropagationStyles.
+func MakePropagator(extract []PropagationStyle, inject []PropagationStyle) Propagator {
+	if extract == nil {
+		extract = DefaultPropagationStyles
+	}
+	if inject == nil {
+		inject = DefaultPropagationStyles
+	}
+	return Propagator{
+		extract: extract,
+		inject:  inject,
+	}
+}
+
+// Extract reads a TraceContext from a set of headers. Header names are matched case insensitively.
+func (p Propagator) Extract(headers map[string]string) (TraceContext, bool) {
+	lowercaseHeaders := map[string]string{}
+	for k, v := range headers {
+		lowercaseHeaders[strings.ToLower(k)] = v
+	}
+
+	for _, style := range p.extract {
+		var traceCtx Context
+		var err error
+		switch style {
+		case PropagationStyleDatadog:
+			traceCtx, err = ParseDatadogHeaders(lowercaseHeaders)
+		case PropagationStyleTraceContext:
+			traceCtx, err = ParseTraceparent(lowercaseHeaders[traceparentHeader], lowercaseHeaders[tracestateHeader])
+		case PropagationStyleB3Multi:
+			traceCtx, err = extractB3Multi(lowercaseHeaders)
+		case PropagationStyleB3:
+			traceCtx, err = extractB3(lowercaseHeaders)
+		default:
+			continue
+		}
+		if err == nil {
+			return traceCtx.DatadogHeaders(), true
+		}
+	}
+	return TraceContext{}, false
+}
+
+// Inject writes the TraceContext into headers, once for every configured injection style. Nothing is written
+// when the TraceContext isn't valid.
+func (p Propagator) Inject(headers TraceContext, into map[string]string) {
+	traceCtx, err := ParseDatadogHeaders(headers)
+	if err != nil {
+		return
+	}
+	for _, style := range p.inject {
+		switch style {
+		case PropagationStyleDatadog:
+			for key, value := range traceCtx.DatadogHeaders() {
+				into[key] = value
+			}
+		case PropagationStyleTraceContext:
+			into[traceparentHeader] = traceCtx.Traceparent()
+			if tracestate := traceCtx.Tracestate(); tracestate != "" {
+				into[tracestateHeader] = tracestate
+			}
+		case PropagationStyleB3Multi:
+			injectB3Multi(traceCtx, into)
+		case PropagationStyleB3:
+			injectB3(traceCtx, into)
+		}
+	}
+}
+
+func getTracestatePriority(tracestate string) (int, bool) {
+	for _, member := range strings.Split(tracestate, ",") {
+		member = strings.TrimSpace(member)
+		if !strings.HasPrefix(member, "dd=") {
+			continue
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(member, "dd="), ";") {
+			if strings.HasPrefix(field, "s:") {
+				priority, err := strconv.Atoi(strings.TrimPrefix(field, "s:"))
+				return priority, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+func extractB3Multi(headers map[string]string) (Context, error) {
+	var c Context
+	var err error
+	if c.TraceIDUpper, c.TraceID, err = parseB3TraceID(headers[b3TraceIDHeader]); err != nil {
+		return Context{}, err
+	}
+	if c.ParentID, err = parseHexID(headers[b3SpanIDHeader]); err != nil {
+		return Context{}, err
+	}
+	if err := c.Validate(); err != nil {
+		return Context{}, err
+	}
+	if headers[b3FlagsHeader] == "1" {
+		c.SamplingPriority, c.HasSamplingPriority = ext.PriorityUserKeep, true
+	} else {
+		c.SamplingPriority, c.HasSamplingPriority = convertB3SamplingState(headers[b3SampledHeader])
+	}
+	return c, nil
+}
+
+func injectB3Multi(traceCtx Context, headers map[string]string) {
+	headers[b3TraceIDHeader] = formatB3TraceID(traceCtx.TraceIDUpper, traceCtx.TraceID)
+	headers[b3SpanIDHeader] = fmt.Sprintf("%016x", traceCtx.ParentID)
+	if traceCtx.HasSamplingPriority {
+		headers[b3SampledHeader] = formatB3SamplingState(traceCtx.SamplingPriority)
+	}
+}
+
+// extractB3 reads a single b3 header, of the form "{trace id}-{span id}-{sampling state}-{parent span id}",
+// where the last two fields are optional.
+func extractB3(headers map[string]string) (Context, error) {
+	parts := strings.Split(strings.TrimSpace(headers[b3Header]), "-")
+	if len(parts) < 2 {
+		return Context{}, fmt.Errorf("b3 header should have a trace id and a span id")
+	}
+	var c Context
+	var err error
+	if c.TraceIDUpper, c.TraceID, err = parseB3TraceID(parts[0]); err != nil {
+		return Context{}, err
+	}
+	if c.ParentID, err = parseHexID(parts[1]); err != nil {
+		return Context{}, err
+	}
+	if err := c.Validate(); err != nil {
+		return Context{}, err
+	}
+	if len(parts) > 2 {
+		c.SamplingPriority, c.HasSamplingPriority = convertB3SamplingState(parts[2])
+	}
+	return c, nil
+}
+
+func injectB3(traceCtx Context, headers map[string]string) {
+	value := fmt.Sprintf("%s-%016x", formatB3TraceID(traceCtx.TraceIDUpper, traceCtx.TraceID), traceCtx.ParentID)
+	if traceCtx.HasSamplingPriority {
+		value = fmt.Sprintf("%s-%s", value, formatB3SamplingState(traceCtx.SamplingPriority))
+	}
+	headers[b3Header] = value
+}
+
+// parseB3TraceID parses a 64 or 128 bit b3 trace id, returning its upper and lower 64 bits.
+func parseB3TraceID(traceID string) (uint64, uint64, error) {
+	if len(traceID) != 16 && len(traceID) != 32 {
+		return 0, 0, fmt.Errorf("b3 trace id should be 64 or 128 bits")
+	}
+	var high uint64
+	if len(traceID) == 32 {
+		var err error
+		if high, err = parseHexID(traceID[:16]); err != nil {
+			return 0, 0, err
+		}
+	}
+	low, err := parseHexID(traceID[len(traceID)-16:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if high == 0 && low == 0 {
+		return 0, 0, fmt.Errorf("b3 trace id can't be zero")
+	}
+	return high, low, nil
+}
+
+// formatB3TraceID only writes a 128 bit trace id when the upper 64 bits are set, so that 64 bit ids are
+// understood by services which don't support 128 bit ids.
+func formatB3TraceID(high uint64, low uint64) string {
+	if high == 0 {
+		return fmt.Sprintf("%016x", low)
+	}
+	return fmt.Sprintf("%016x%016x", high, low)
+}
+
+func convertB3SamplingState(state string) (int, bool) {
+	switch strings.ToLower(state) {
+	case "d":
+		return ext.PriorityUserKeep, true
+	case "1", "true":
+		return ext.PriorityAutoKeep, true
+	case "0", "false":
+		return ext.PriorityAutoReject, true
+	}
+	return 0, false
+}
+
+func formatB3SamplingState(priority int) string {
+	if priority > 0 {
+		return "1"
+	}
+	return "0"
+}
+
+func parseHexID(id string) (uint64, error) {
+	if len(id) != 16 {
+		return 0, fmt.Errorf("expected 16 hex characters, got %d", len(id))
+	}
+	return strconv.ParseUint(id, 16, 64)
+}
+
+func getSamplingPriority(traceCtx TraceContext) (int, bool) {
+	samplingPriority, ok := traceCtx[samplingPriorityHeader]
+	if !ok {
+		return 0, false
+	}
+	priority, err := strconv.Atoi(samplingPriority)
+	return priority, err == nil
+}
+
+// getTraceIDHigh returns the upper 64 bits of the trace id, which are carried by the _dd.p.tid tag of the
+// x-datadog-tags header. It returns 0 for 64 bit trace ids.
+func getTraceIDHigh(traceCtx TraceContext) uint64 {
+	for _, tag := range strings.Split(traceCtx[tagsHeader], ",") {
+		if strings.HasPrefix(tag, traceIDHighTag+"=") {
+			high, err := parseHexID(strings.TrimPrefix(tag, traceIDHighTag+"="))
+			if err != nil {
+				return 0
+			}
+			return high
+		}
+	}
+	return 0
+}
+
+// setTraceIDHigh sets the upper 64 bits of the trace id in the x-datadog-tags header, keeping any other
+// propagated tags. Setting it to 0 removes the tag.
+func setTraceIDHigh(traceCtx TraceContext, high uint64) {
+	var tags []string
+	for _, tag := range strings.Split(traceCtx[tagsHeader], ",") {
+		if tag != "" && !strings.HasPrefix(tag, traceIDHighTag+"=") {
+			tags = append(tags, tag)
+		}
+	}
+	if high != 0 {
+		tags = append(tags, fmt.Sprintf("%s=%016x", traceIDHighTag, high))
+	}
+	if len(tags) == 0 {
+		delete(traceCtx, tagsHeader)
+		return
+	}
+	traceCtx[tagsHeader] = strings.Join(tags, ",")
+}
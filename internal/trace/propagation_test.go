@@ -0,0 +1,258 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePropagationStyles(t *testing.T) {
+	styles, unknown := ParsePropagationStyles("Datadog, tracecontext,b3multi,b3 single header,datadog")
+	assert.Equal(t, []PropagationStyle{PropagationStyleDatadog, PropagationStyleTraceContext, PropagationStyleB3Multi, PropagationStyleB3}, styles)
+	assert.Empty(t, unknown)
+}
+
+func TestParsePropagationStylesUnknown(t *testing.T) {
+	styles, unknown := ParsePropagationStyles("jaeger,datadog,xray")
+	assert.Equal(t, []PropagationStyle{PropagationStyleDatadog}, styles)
+	assert.Equal(t, []string{"jaeger", "xray"}, unknown)
+}
+
+func TestParsePropagationStylesNoValidStyle(t *testing.T) {
+	styles, unknown := ParsePropagationStyles("jaeger")
+	assert.Nil(t, styles)
+	assert.Equal(t, []string{"jaeger"}, unknown)
+}
+
+func TestParsePropagationStylesNone(t *testing.T) {
+	styles, unknown := ParsePropagationStyles("none")
+	assert.NotNil(t, styles)
+	assert.Empty(t, styles)
+	assert.Empty(t, unknown)
+}
+
+func TestExtractUsesFirstMatchingStyle(t *testing.T) {
+	headers := map[string]string{
+		"X-Datadog-Trace-Id":          "1231452342",
+		"X-Datadog-Parent-Id":         "45678910",
+		"X-Datadog-Sampling-Priority": "2",
+		"traceparent":                 "00-0000000000000000000000000000abcd-000000000000ef01-01",
+	}
+
+	p := MakePropagator([]PropagationStyle{PropagationStyleTraceContext, PropagationStyleDatadog}, nil)
+	traceCtx, ok := p.Extract(headers)
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "43981",
+		ParentIDHeader:         "61185",
+		samplingPriorityHeader: autoKeep,
+	}, traceCtx)
+
+	p = MakePropagator([]PropagationStyle{PropagationStyleDatadog, PropagationStyleTraceContext}, nil)
+	traceCtx, ok = p.Extract(headers)
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", traceCtx[TraceIDHeader])
+}
+
+func TestExtractFallsThroughToLaterStyle(t *testing.T) {
+	headers := map[string]string{
+		"x-b3-traceid": "463ac35c9f6413ad48485a3953bb6124",
+		"x-b3-spanid":  "0020000000000001",
+		"x-b3-sampled": "1",
+	}
+
+	p := MakePropagator([]PropagationStyle{PropagationStyleDatadog, PropagationStyleB3Multi}, nil)
+	traceCtx, ok := p.Extract(headers)
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "5208512171318403364",
+		ParentIDHeader:         "9007199254740993",
+		samplingPriorityHeader: autoKeep,
+		tagsHeader:             "_dd.p.tid=463ac35c9f6413ad",
+	}, traceCtx)
+}
+
+func TestExtractNoStyles(t *testing.T) {
+	headers := map[string]string{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	}
+
+	p := MakePropagator([]PropagationStyle{}, nil)
+	_, ok := p.Extract(headers)
+	assert.False(t, ok)
+}
+
+func TestExtractTraceContextUsesTracestatePriority(t *testing.T) {
+	headers := map[string]string{
+		"traceparent": "00-0000000000000000000000000000abcd-000000000000ef01-01",
+		"tracestate":  "foo=bar,dd=s:2;o:rum",
+	}
+
+	traceCtx, err := ParseTraceparent(headers["traceparent"], headers["tracestate"])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, traceCtx.SamplingPriority)
+}
+
+func TestExtractTraceContextInvalid(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"00-00000000000000000000000000000000-000000000000ef01-01",
+		"00-0000000000000000000000000000abcd-0000000000000000-01",
+		"ff-0000000000000000000000000000abcd-000000000000ef01-01",
+		"00-abcd-000000000000ef01-01",
+		"00-0000000000000000000000000000zzzz-000000000000ef01-01",
+	} {
+		_, err := ParseTraceparent(traceparent, "")
+		assert.Error(t, err, traceparent)
+	}
+}
+
+func TestExtractB3SingleHeader(t *testing.T) {
+	traceCtx, err := extractB3(map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-d-05e3ac9a4f6e3b90"})
+	assert.NoError(t, err)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "7277407061855694839",
+		ParentIDHeader:         "16453819474850114513",
+		samplingPriorityHeader: userKeep,
+		tagsHeader:             "_dd.p.tid=80f198ee56343ba8",
+	}, traceCtx.DatadogHeaders())
+
+	_, err = extractB3(map[string]string{"b3": "0"})
+	assert.Error(t, err)
+}
+
+func TestInjectAllStyles(t *testing.T) {
+	traceCtx := TraceContext{
+		TraceIDHeader:          "43981",
+		ParentIDHeader:         "61185",
+		samplingPriorityHeader: userKeep,
+	}
+	p := MakePropagator(nil, []PropagationStyle{PropagationStyleDatadog, PropagationStyleTraceContext, PropagationStyleB3Multi, PropagationStyleB3})
+
+	headers := map[string]string{}
+	p.Inject(traceCtx, headers)
+
+	assert.Equal(t, map[string]string{
+		TraceIDHeader:          "43981",
+		ParentIDHeader:         "61185",
+		samplingPriorityHeader: "2",
+		traceparentHeader:      "00-0000000000000000000000000000abcd-000000000000ef01-01",
+		tracestateHeader:       "dd=s:2",
+		b3TraceIDHeader:        "000000000000abcd",
+		b3SpanIDHeader:         "000000000000ef01",
+		b3SampledHeader:        "1",
+		b3Header:               "000000000000abcd-000000000000ef01-1",
+	}, headers)
+}
+
+func TestInjectThenExtractRoundTrips(t *testing.T) {
+	traceCtx := TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: userReject,
+	}
+	for _, style := range []PropagationStyle{PropagationStyleDatadog, PropagationStyleTraceContext} {
+		p := MakePropagator([]PropagationStyle{style}, []PropagationStyle{style})
+		headers := map[string]string{}
+		p.Inject(traceCtx, headers)
+		extracted, ok := p.Extract(headers)
+		assert.True(t, ok)
+		assert.Equal(t, traceCtx, extracted, string(style))
+	}
+}
+
+func TestInjectEmptyTraceContext(t *testing.T) {
+	headers := map[string]string{}
+	MakePropagator(nil, nil).Inject(TraceContext{}, headers)
+	assert.Empty(t, headers)
+}
+
+func TestExtractDatadog128BitTraceID(t *testing.T) {
+	headers := map[string]string{
+		"x-datadog-trace-id":          "5208512171318403364",
+		"x-datadog-parent-id":         "9007199254740993",
+		"x-datadog-sampling-priority": "1",
+		"x-datadog-tags":              "_dd.p.dm=-0,_dd.p.tid=463ac35c9f6413ad",
+	}
+
+	traceCtx, err := ParseDatadogHeaders(headers)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x463ac35c9f6413ad), traceCtx.TraceIDUpper)
+	assert.Equal(t, "_dd.p.dm=-0,_dd.p.tid=463ac35c9f6413ad", traceCtx.DatadogHeaders()[tagsHeader])
+}
+
+func TestTraceIDHigh(t *testing.T) {
+	traceCtx := TraceContext{tagsHeader: "_dd.p.dm=-0"}
+	assert.Equal(t, uint64(0), getTraceIDHigh(traceCtx))
+
+	setTraceIDHigh(traceCtx, 0x463ac35c9f6413ad)
+	assert.Equal(t, "_dd.p.dm=-0,_dd.p.tid=463ac35c9f6413ad", traceCtx[tagsHeader])
+	assert.Equal(t, uint64(0x463ac35c9f6413ad), getTraceIDHigh(traceCtx))
+
+	setTraceIDHigh(traceCtx, 0x6564000000000000)
+	assert.Equal(t, "_dd.p.dm=-0,_dd.p.tid=6564000000000000", traceCtx[tagsHeader])
+
+	setTraceIDHigh(traceCtx, 0)
+	assert.Equal(t, "_dd.p.dm=-0", traceCtx[tagsHeader])
+
+	traceCtx = TraceContext{tagsHeader: "_dd.p.tid=463ac35c9f6413ad"}
+	setTraceIDHigh(traceCtx, 0)
+	assert.NotContains(t, traceCtx, tagsHeader)
+
+	assert.Equal(t, uint64(0), getTraceIDHigh(TraceContext{tagsHeader: "_dd.p.tid=notahexvalue!"}))
+}
+
+func TestTraceContextAndDatadog128BitRoundTrip(t *testing.T) {
+	traceparent := "00-463ac35c9f6413ad48485a3953bb6124-0020000000000001-01"
+	w3c := MakePropagator([]PropagationStyle{PropagationStyleTraceContext}, []PropagationStyle{PropagationStyleTraceContext})
+	datadog := MakePropagator([]PropagationStyle{PropagationStyleDatadog}, []PropagationStyle{PropagationStyleDatadog})
+
+	// W3C -> Datadog keeps the lower 64 bits in the trace id header and the upper 64 bits in the tags
+	traceCtx, ok := w3c.Extract(map[string]string{"traceparent": traceparent})
+	assert.True(t, ok)
+	datadogHeaders := map[string]string{}
+	datadog.Inject(traceCtx, datadogHeaders)
+	assert.Equal(t, "5208512171318403364", datadogHeaders[TraceIDHeader])
+	assert.Equal(t, "_dd.p.tid=463ac35c9f6413ad", datadogHeaders[tagsHeader])
+
+	// Datadog -> W3C restores the full 128 bit trace id
+	traceCtx, ok = datadog.Extract(datadogHeaders)
+	assert.True(t, ok)
+	w3cHeaders := map[string]string{}
+	w3c.Inject(traceCtx, w3cHeaders)
+	assert.Equal(t, traceparent, w3cHeaders[traceparentHeader])
+}
+
+func TestB3128BitRoundTrip(t *testing.T) {
+	for _, style := range []PropagationStyle{PropagationStyleB3Multi, PropagationStyleB3} {
+		p := MakePropagator([]PropagationStyle{style}, []PropagationStyle{style})
+		traceCtx := TraceContext{
+			TraceIDHeader:          "5208512171318403364",
+			ParentIDHeader:         "9007199254740993",
+			samplingPriorityHeader: autoKeep,
+			tagsHeader:             "_dd.p.tid=463ac35c9f6413ad",
+		}
+		headers := map[string]string{}
+		p.Inject(traceCtx, headers)
+		extracted, ok := p.Extract(headers)
+		assert.True(t, ok)
+		assert.Equal(t, traceCtx, extracted, string(style))
+	}
+
+	headers := map[string]string{}
+	MakePropagator(nil, []PropagationStyle{PropagationStyleB3}).Inject(TraceContext{
+		TraceIDHeader:  "5208512171318403364",
+		ParentIDHeader: "9007199254740993",
+	}, headers)
+	assert.Equal(t, "48485a3953bb6124-0020000000000001", headers[b3Header])
+}
@@ -0,0 +1,51 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"math"
+	"strconv"
+)
+
+// knuthFactor is the multiplier the tracer uses to hash trace ids when sampling by rate
+const knuthFactor = uint64(1111111111111111111)
+
+// sampledByRate decides deterministically whether a trace is kept for the given sample rate, the same way
+// as the tracer, so that every service sampling a trace at the same rate makes the same decision.
+func sampledByRate(traceID uint64, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return traceID*knuthFactor < uint64(rate*math.MaxUint64)
+}
+
+// withSamplingPriority returns the trace context unchanged when it carries a valid sampling priority, which
+// is the decision made upstream. Otherwise it returns a copy with a priority generated from the sample rate.
+func withSamplingPriority(traceCtx TraceContext, sampleRate float64) TraceContext {
+	if _, ok := getSamplingPriority(traceCtx); ok {
+		return traceCtx
+	}
+	traceID, err := strconv.ParseUint(traceCtx[TraceIDHeader], 10, 64)
+	if err != nil {
+		return traceCtx
+	}
+
+	newTraceCtx := TraceContext{}
+	for key, value := range traceCtx {
+		newTraceCtx[key] = value
+	}
+	newTraceCtx[samplingPriorityHeader] = autoReject
+	if sampledByRate(traceID, sampleRate) {
+		newTraceCtx[samplingPriorityHeader] = autoKeep
+	}
+	return newTraceCtx
+}
@@ -0,0 +1,84 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSamplingPriorityPassthrough(t *testing.T) {
+	for _, priority := range []string{userReject, autoReject, autoKeep, userKeep} {
+		ev := json.RawMessage(`{"headers": {"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910", "x-datadog-sampling-priority": "` + priority + `"}}`)
+
+		// A sample rate of 0 would reject every trace, so the upstream priority must win
+		ctx, _ := contextWithRootTraceContext(context.Background(), ev, false, MakePropagator(nil, nil), 0)
+		assert.Equal(t, priority, GetTraceHeaders(ctx)[samplingPriorityHeader], priority)
+
+		headers := map[string]string{}
+		InjectTraceHeaders(ctx, headers)
+		assert.Equal(t, priority, headers[samplingPriorityHeader], priority)
+		assert.Equal(t, "1231452342", headers[TraceIDHeader], priority)
+	}
+}
+
+func TestSamplingPriorityGeneratedWhenMissing(t *testing.T) {
+	ev := json.RawMessage(`{"headers": {"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910"}}`)
+
+	ctx, _ := contextWithRootTraceContext(context.Background(), ev, false, MakePropagator(nil, nil), 1)
+	assert.Equal(t, autoKeep, GetTraceHeaders(ctx)[samplingPriorityHeader])
+
+	ctx, _ = contextWithRootTraceContext(context.Background(), ev, false, MakePropagator(nil, nil), 0)
+	assert.Equal(t, autoReject, GetTraceHeaders(ctx)[samplingPriorityHeader])
+}
+
+func TestSamplingPriorityGeneratedWhenInvalid(t *testing.T) {
+	traceCtx := TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "keep",
+	}
+	assert.Equal(t, autoKeep, withSamplingPriority(traceCtx, 1)[samplingPriorityHeader])
+	// The trace context passed in is left untouched
+	assert.Equal(t, "keep", traceCtx[samplingPriorityHeader])
+}
+
+func TestSampledByRateIsDeterministic(t *testing.T) {
+	for _, traceID := range []uint64{1, 1231452342, 3995693151288333088} {
+		assert.Equal(t, sampledByRate(traceID, 0.5), sampledByRate(traceID, 0.5))
+	}
+	assert.True(t, sampledByRate(1231452342, 1))
+	assert.False(t, sampledByRate(1231452342, 0))
+}
+
+func TestGeneratedSamplingPriorityDistribution(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	const total = 10000
+
+	for _, rate := range []float64{0.1, 0.5, 0.9} {
+		kept := 0
+		for i := 0; i < total; i++ {
+			traceCtx := withSamplingPriority(TraceContext{
+				TraceIDHeader:  strconv.FormatUint(random.Uint64()>>1, 10),
+				ParentIDHeader: "1",
+			}, rate)
+			if traceCtx[samplingPriorityHeader] == autoKeep {
+				kept++
+			} else {
+				assert.Equal(t, autoReject, traceCtx[samplingPriorityHeader])
+			}
+		}
+		assert.InDelta(t, rate, float64(kept)/total, 0.02, "rate %v", rate)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// maxSniffedPayloadSize is how much of an event payload is read to find its headers. API Gateway and Function URL
+// events put their headers before the body, so it's enough to find them in events with a body of any size.
+const maxSniffedPayloadSize = 128 * 1024
+
+// sniffHeaders decodes the headers and multi-value headers of an event from the top-level keys of its payload,
+// reading at most maxSniffedPayloadSize bytes of it. The values of the other keys are skipped token by token
+// without being kept, and reading stops as soon as the headers are found, so that a large body is neither copied
+// nor parsed. It returns false when no headers were found.
+func sniffHeaders(r io.Reader) (eventWithHeaders, bool) {
+	eh := eventWithHeaders{}
+	decoder := json.NewDecoder(io.LimitReader(r, maxSniffedPayloadSize))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return eh, false
+	}
+
+	var foundHeaders, foundMultiValueHeaders bool
+	for decoder.More() && !(foundHeaders && foundMultiValueHeaders) {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch token.(string) {
+		case "headers":
+			foundHeaders = decoder.Decode(&eh.Headers) == nil
+			if !foundHeaders {
+				return eh, foundMultiValueHeaders
+			}
+		case "multiValueHeaders":
+			foundMultiValueHeaders = decoder.Decode(&eh.MultiValueHeaders) == nil
+			if !foundMultiValueHeaders {
+				return eh, foundHeaders
+			}
+		case "body":
+			// The headers come before the body, which is the part of the payload that can be large
+			if foundHeaders || foundMultiValueHeaders {
+				return eh, true
+			}
+			fallthrough
+		default:
+			if skipValue(decoder) != nil {
+				return eh, foundHeaders || foundMultiValueHeaders
+			}
+		}
+	}
+	return eh, foundHeaders || foundMultiValueHeaders
+}
+
+// skipValue reads the next value of a decoder, whatever its type, without decoding it
+func skipValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
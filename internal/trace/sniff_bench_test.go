@@ -0,0 +1,70 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// largeEventSize is the size of the body of the benchmarked events, just below the 6MB limit of a synchronous
+// invocation payload
+const largeEventSize = 6<<20 - 1024
+
+// BenchmarkSniffHeadersLargePayload allocates the same whatever the size of the body, as at most
+// maxSniffedPayloadSize bytes of the payload are read
+func BenchmarkSniffHeadersLargePayload(b *testing.B) {
+	ev := makeFunctionURLEvent(largeEventSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sniffHeaders(bytes.NewReader(ev))
+	}
+}
+
+// BenchmarkSniffHeadersLargeValueFirst is the worst case, where a large value comes before the headers, and the
+// payload is read up to the limit
+func BenchmarkSniffHeadersLargeValueFirst(b *testing.B) {
+	ev := []byte(fmt.Sprintf(`{"data":"%s","headers":{}}`, strings.Repeat("a", largeEventSize)))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sniffHeaders(bytes.NewReader(ev))
+	}
+}
+
+// BenchmarkUnmarshalHeadersLargePayload is the full decoding of the payload sniffHeaders replaces, for comparison
+func BenchmarkUnmarshalHeadersLargePayload(b *testing.B) {
+	ev := makeFunctionURLEvent(largeEventSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		eh := eventWithHeaders{}
+		json.Unmarshal(ev, &eh)
+	}
+}
+
+func BenchmarkGetDatadogTraceContextLargePayload(b *testing.B) {
+	ctx := context.Background()
+	ev := makeFunctionURLEvent(largeEventSize)
+	propagator := MakePropagator(nil, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getDatadogTraceContextFromEvent(ctx, ev, propagator)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+// makeFunctionURLEvent returns a Function URL event with a trace context in its headers, and a body of the given size
+func makeFunctionURLEvent(bodySize int) []byte {
+	return []byte(fmt.Sprintf(`{
+  "version": "2.0",
+  "routeKey": "$default",
+  "rawPath": "/upload",
+  "headers": {"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910", "x-datadog-sampling-priority": "2"},
+  "requestContext": {"http": {"method": "POST", "path": "/upload"}, "timeEpoch": 1428582896500},
+  "body": "%s",
+  "isBase64Encoded": false
+}`, strings.Repeat("a", bodySize)))
+}
+
+func TestSniffHeadersMatchesUnmarshal(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/apig-event-with-headers.json",
+		"../testdata/apig-rest-event-duplicated-headers.json",
+		"../testdata/apig-rest-event-multi-value-headers.json",
+		"../testdata/non-proxy-with-mixed-case-headers.json",
+	} {
+		ev := loadRawJSON(t, filename)
+		expected := eventWithHeaders{}
+		assert.NoError(t, json.Unmarshal(*ev, &expected))
+
+		eh, ok := sniffHeaders(bytes.NewReader(*ev))
+		assert.True(t, ok, filename)
+		assert.Equal(t, expected, eh, filename)
+	}
+}
+
+func TestSniffHeadersWithoutHeaders(t *testing.T) {
+	for _, payload := range []string{
+		`{"detail-type":"Order Placed","source":"orders","detail":{"headers":{"x-datadog-trace-id":"1"}}}`,
+		`["headers"]`,
+		`{"tag-left-open": [`,
+		``,
+	} {
+		_, ok := sniffHeaders(strings.NewReader(payload))
+		assert.False(t, ok, payload)
+	}
+}
+
+func TestSniffHeadersStopsBeforeLargeBody(t *testing.T) {
+	reader := &countingReader{r: bytes.NewReader(makeFunctionURLEvent(6 << 20))}
+
+	eh, ok := sniffHeaders(reader)
+
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", eh.Headers["x-datadog-trace-id"])
+	assert.LessOrEqual(t, reader.read, maxSniffedPayloadSize)
+}
+
+func TestSniffHeadersReadsAtMostTheLimit(t *testing.T) {
+	// Headers after a large value aren't found, as the payload is only read up to the limit
+	payload := fmt.Sprintf(`{"data":"%s","headers":{"x-datadog-trace-id":"1"}}`, strings.Repeat("a", 2*maxSniffedPayloadSize))
+	reader := &countingReader{r: strings.NewReader(payload)}
+
+	_, ok := sniffHeaders(reader)
+
+	assert.False(t, ok)
+	assert.Equal(t, maxSniffedPayloadSize, reader.read)
+}
+
+func TestGetDatadogTraceContextFromLargeFunctionURLEvent(t *testing.T) {
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+
+	headers, ok := getDatadogTraceContextFromEvent(ctx, makeFunctionURLEvent(6<<20), MakePropagator(nil, nil))
+
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	}, headers)
+}
@@ -0,0 +1,66 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// stepFunctionsEvent is the payload of a Lambda task whose state machine definition passes on the context
+// object, with "Execution.$": "$$.Execution", "State.$": "$$.State" and "StateMachine.$": "$$.StateMachine".
+type stepFunctionsEvent struct {
+	Execution *struct {
+		ID string `json:"Id"`
+	} `json:"Execution"`
+	State *struct {
+		Name        string `json:"Name"`
+		EnteredTime string `json:"EnteredTime"`
+	} `json:"State"`
+	StateMachine *struct {
+		ID string `json:"Id"`
+	} `json:"StateMachine"`
+}
+
+// extractStepFunctionsTraceContext derives a trace context from the Step Functions context object in the
+// event. The ids are hashed from the execution and state, the same way as the other Datadog runtimes, so that
+// every task of an execution belongs to the same trace, with the state as its parent.
+func extractStepFunctionsTraceContext(ev json.RawMessage) (TraceContext, bool) {
+	sfnEvent := stepFunctionsEvent{}
+	if err := json.Unmarshal(ev, &sfnEvent); err != nil {
+		return nil, false
+	}
+	if sfnEvent.Execution == nil || sfnEvent.State == nil || sfnEvent.StateMachine == nil || sfnEvent.Execution.ID == "" {
+		return nil, false
+	}
+
+	executionHash := sha256.Sum256([]byte(sfnEvent.Execution.ID))
+	stateHash := sha256.Sum256([]byte(fmt.Sprintf("%s#%s#%s", sfnEvent.Execution.ID, sfnEvent.State.Name, sfnEvent.State.EnteredTime)))
+
+	traceCtx := TraceContext{
+		TraceIDHeader:          strconv.FormatUint(positiveUint64(executionHash[8:16]), 10),
+		ParentIDHeader:         strconv.FormatUint(positiveUint64(stateHash[0:8]), 10),
+		samplingPriorityHeader: autoKeep,
+	}
+	setTraceIDHigh(traceCtx, positiveUint64(executionHash[0:8]))
+	return traceCtx, true
+}
+
+// positiveUint64 reads 8 bytes of a hash as an id, clearing the top bit so the id fits in a signed 64 bit
+// integer. Ids can't be zero, so a zero value becomes 1.
+func positiveUint64(b []byte) uint64 {
+	id := binary.BigEndian.Uint64(b) &^ (1 << 63)
+	if id == 0 {
+		return 1
+	}
+	return id
+}
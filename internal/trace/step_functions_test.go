@@ -0,0 +1,56 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractStepFunctionsTraceContext(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/step-functions-event.json")
+
+	traceCtx, ok := extractStepFunctionsTraceContext(*ev)
+	assert.True(t, ok)
+	// Same ids as the other Datadog runtimes derive for this execution and state
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "435175499815315247",
+		ParentIDHeader:         "3929055471293792800",
+		samplingPriorityHeader: autoKeep,
+		tagsHeader:             "_dd.p.tid=3e7a89d1b7310603",
+	}, traceCtx)
+}
+
+func TestExtractStepFunctionsTraceContextNotStepFunctions(t *testing.T) {
+	for _, ev := range []string{
+		`{}`,
+		`not json`,
+		`{"Execution": {"Id": "arn:aws:states:sa-east-1:425362996713:execution:machine:id"}, "State": {"Name": "Lambda Invoke"}}`,
+		`{"Execution": {}, "State": {}, "StateMachine": {}}`,
+	} {
+		_, ok := extractStepFunctionsTraceContext(json.RawMessage(ev))
+		assert.False(t, ok, ev)
+	}
+}
+
+func TestGetDatadogTraceContextFromStepFunctionsEvent(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/step-functions-event.json")
+
+	traceCtx, ok := getDatadogTraceContextFromEvent(context.Background(), *ev, MakePropagator(nil, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "435175499815315247", traceCtx[TraceIDHeader])
+}
+
+func TestPositiveUint64(t *testing.T) {
+	assert.Equal(t, uint64(0x7fffffffffffffff), positiveUint64([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	assert.Equal(t, uint64(1), positiveUint64([]byte{0x80, 0, 0, 0, 0, 0, 0, 0}))
+}
@@ -0,0 +1,177 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// originHeader carries the product which started the trace, such as synthetics
+const originHeader = "x-datadog-origin"
+
+// Context is the typed form of a TraceContext. The propagation styles extract it from, and inject it into, the
+// headers of their format, while TraceContext remains the set of Datadog headers exchanged with the extractors.
+type Context struct {
+	TraceID  uint64
+	ParentID uint64
+	// TraceIDUpper holds the upper 64 bits of a 128 bit trace id. It's 0 for 64 bit trace ids.
+	TraceIDUpper     uint64
+	SamplingPriority int
+	// HasSamplingPriority is false when the upstream service didn't make a sampling decision
+	HasSamplingPriority bool
+	Origin              string
+	// Tags are the propagated tags, such as _dd.p.dm, other than the upper bits of the trace id
+	Tags map[string]string
+}
+
+// Validate returns an error if the trace id or the parent id is zero
+func (c Context) Validate() error {
+	if c.TraceID == 0 && c.TraceIDUpper == 0 {
+		return errors.New("trace id can't be zero")
+	}
+	if c.ParentID == 0 {
+		return errors.New("parent id can't be zero")
+	}
+	return nil
+}
+
+// ParseDatadogHeaders reads a Context from the x-datadog-* headers, whose names must be lowercase. The trace id
+// and the parent id are required, and the sampling priority, the origin and the propagated tags are optional.
+// An invalid _dd.p.tid tag is dropped, as the lower 64 bits of the trace id are enough to continue the trace.
+func ParseDatadogHeaders(headers map[string]string) (Context, error) {
+	var c Context
+	var err error
+	if c.TraceID, err = strconv.ParseUint(headers[TraceIDHeader], 10, 64); err != nil {
+		return Context{}, fmt.Errorf("invalid trace id: %v", err)
+	}
+	if c.ParentID, err = strconv.ParseUint(headers[ParentIDHeader], 10, 64); err != nil {
+		return Context{}, fmt.Errorf("invalid parent id: %v", err)
+	}
+	if samplingPriority, ok := headers[samplingPriorityHeader]; ok {
+		if c.SamplingPriority, err = strconv.Atoi(samplingPriority); err != nil {
+			return Context{}, fmt.Errorf("invalid sampling priority: %v", err)
+		}
+		c.HasSamplingPriority = true
+	}
+	c.Origin = headers[originHeader]
+	for _, tag := range strings.Split(headers[tagsHeader], ",") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		if parts[0] == traceIDHighTag {
+			c.TraceIDUpper, _ = parseHexID(parts[1])
+			continue
+		}
+		if c.Tags == nil {
+			c.Tags = map[string]string{}
+		}
+		c.Tags[parts[0]] = parts[1]
+	}
+	if err := c.Validate(); err != nil {
+		return Context{}, err
+	}
+	return c, nil
+}
+
+// DatadogHeaders formats the Context as x-datadog-* headers. The propagated tags are sorted by key, followed by
+// the upper bits of the trace id.
+func (c Context) DatadogHeaders() TraceContext {
+	headers := TraceContext{
+		TraceIDHeader:  strconv.FormatUint(c.TraceID, 10),
+		ParentIDHeader: strconv.FormatUint(c.ParentID, 10),
+	}
+	if c.HasSamplingPriority {
+		headers[samplingPriorityHeader] = strconv.Itoa(c.SamplingPriority)
+	}
+	if c.Origin != "" {
+		headers[originHeader] = c.Origin
+	}
+	keys := make([]string, 0, len(c.Tags))
+	for key := range c.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys)+1)
+	for _, key := range keys {
+		tags = append(tags, key+"="+c.Tags[key])
+	}
+	if c.TraceIDUpper != 0 {
+		tags = append(tags, fmt.Sprintf("%s=%016x", traceIDHighTag, c.TraceIDUpper))
+	}
+	if len(tags) > 0 {
+		headers[tagsHeader] = strings.Join(tags, ",")
+	}
+	return headers
+}
+
+// ParseTraceparent reads a Context from a W3C traceparent header, of the form
+// "{version}-{128 bit trace id}-{64 bit parent id}-{flags}". The sampled flag gives the sampling priority, unless
+// the dd member of tracestate carries an exact priority which agrees with it.
+func ParseTraceparent(traceparent string, tracestate string) (Context, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return Context{}, errors.New("traceparent should have a version and 3 fields")
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return Context{}, errors.New("traceparent fields have the wrong length")
+	}
+	var c Context
+	var err error
+	if c.TraceIDUpper, err = parseHexID(parts[1][:16]); err != nil {
+		return Context{}, fmt.Errorf("invalid trace id: %v", err)
+	}
+	if c.TraceID, err = parseHexID(parts[1][16:]); err != nil {
+		return Context{}, fmt.Errorf("invalid trace id: %v", err)
+	}
+	if c.ParentID, err = parseHexID(parts[2]); err != nil {
+		return Context{}, fmt.Errorf("invalid parent id: %v", err)
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return Context{}, fmt.Errorf("invalid flags: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return Context{}, err
+	}
+
+	sampled := flags&0x1 == 1
+	c.HasSamplingPriority = true
+	c.SamplingPriority = 0
+	if sampled {
+		c.SamplingPriority = 1
+	}
+	if priority, ok := getTracestatePriority(tracestate); ok && (priority > 0) == sampled {
+		c.SamplingPriority = priority
+	}
+	return c, nil
+}
+
+// Traceparent formats the Context as a W3C traceparent header. The sampled flag is set for positive sampling
+// priorities.
+func (c Context) Traceparent() string {
+	flags := 0
+	if c.HasSamplingPriority && c.SamplingPriority > 0 {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%016x%016x-%016x-%02x", c.TraceIDUpper, c.TraceID, c.ParentID, flags)
+}
+
+// Tracestate formats the sampling priority of the Context as the dd member of a W3C tracestate header. It returns
+// an empty string without a sampling priority.
+func (c Context) Tracestate() string {
+	if !c.HasSamplingPriority {
+		return ""
+	}
+	return fmt.Sprintf("dd=s:%d", c.SamplingPriority)
+}
@@ -0,0 +1,169 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDatadogHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected Context
+	}{
+		{
+			name:     "ids only",
+			headers:  map[string]string{TraceIDHeader: "1231452342", ParentIDHeader: "45678910"},
+			expected: Context{TraceID: 1231452342, ParentID: 45678910},
+		},
+		{
+			name: "all fields",
+			headers: map[string]string{
+				TraceIDHeader:          "5208512171318403364",
+				ParentIDHeader:         "9007199254740993",
+				samplingPriorityHeader: "-1",
+				originHeader:           "synthetics",
+				tagsHeader:             "_dd.p.dm=-4,_dd.p.tid=463ac35c9f6413ad,_dd.p.usr=abc=",
+			},
+			expected: Context{
+				TraceID:             5208512171318403364,
+				ParentID:            9007199254740993,
+				TraceIDUpper:        0x463ac35c9f6413ad,
+				SamplingPriority:    -1,
+				HasSamplingPriority: true,
+				Origin:              "synthetics",
+				Tags:                map[string]string{"_dd.p.dm": "-4", "_dd.p.usr": "abc="},
+			},
+		},
+		{
+			name:     "invalid upper bits are dropped",
+			headers:  map[string]string{TraceIDHeader: "1", ParentIDHeader: "2", tagsHeader: "_dd.p.tid=xyz,broken"},
+			expected: Context{TraceID: 1, ParentID: 2},
+		},
+	}
+	for _, test := range tests {
+		c, err := ParseDatadogHeaders(test.headers)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, c, test.name)
+	}
+}
+
+func TestParseDatadogHeadersInvalid(t *testing.T) {
+	for name, headers := range map[string]map[string]string{
+		"empty":                     {},
+		"no parent id":              {TraceIDHeader: "1"},
+		"zero trace id":             {TraceIDHeader: "0", ParentIDHeader: "2"},
+		"zero parent id":            {TraceIDHeader: "1", ParentIDHeader: "0"},
+		"negative trace id":         {TraceIDHeader: "-1", ParentIDHeader: "2"},
+		"trace id overflow":         {TraceIDHeader: "18446744073709551616", ParentIDHeader: "2"},
+		"non numeric parent id":     {TraceIDHeader: "1", ParentIDHeader: "abc"},
+		"non numeric sampling prio": {TraceIDHeader: "1", ParentIDHeader: "2", samplingPriorityHeader: "keep"},
+	} {
+		_, err := ParseDatadogHeaders(headers)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		tracestate  string
+		expected    Context
+	}{
+		{
+			traceparent: "00-0000000000000000000000000000abcd-000000000000ef01-01",
+			expected:    Context{TraceID: 0xabcd, ParentID: 0xef01, SamplingPriority: 1, HasSamplingPriority: true},
+		},
+		{
+			traceparent: "00-0000000000000000000000000000abcd-000000000000ef01-00",
+			expected:    Context{TraceID: 0xabcd, ParentID: 0xef01, SamplingPriority: 0, HasSamplingPriority: true},
+		},
+		{
+			traceparent: "00-463ac35c9f6413ad48485a3953bb6124-0020000000000001-01",
+			tracestate:  "foo=bar,dd=s:2;o:rum",
+			expected: Context{TraceID: 0x48485a3953bb6124, ParentID: 0x0020000000000001, TraceIDUpper: 0x463ac35c9f6413ad,
+				SamplingPriority: 2, HasSamplingPriority: true},
+		},
+		{
+			// A tracestate priority which disagrees with the sampled flag is ignored
+			traceparent: "00-0000000000000000000000000000abcd-000000000000ef01-00",
+			tracestate:  "dd=s:2",
+			expected:    Context{TraceID: 0xabcd, ParentID: 0xef01, SamplingPriority: 0, HasSamplingPriority: true},
+		},
+		{
+			// Only the upper bits of the trace id are set
+			traceparent: "01-463ac35c9f6413ad0000000000000000-0020000000000001-01-extra",
+			expected: Context{ParentID: 0x0020000000000001, TraceIDUpper: 0x463ac35c9f6413ad,
+				SamplingPriority: 1, HasSamplingPriority: true},
+		},
+	}
+	for _, test := range tests {
+		c, err := ParseTraceparent(test.traceparent, test.tracestate)
+		assert.NoError(t, err, test.traceparent)
+		assert.Equal(t, test.expected, c, test.traceparent)
+	}
+}
+
+func TestDatadogHeadersRoundTrip(t *testing.T) {
+	for _, headers := range []TraceContext{
+		{TraceIDHeader: "1", ParentIDHeader: "2"},
+		{TraceIDHeader: "1231452342", ParentIDHeader: "45678910", samplingPriorityHeader: "2"},
+		{TraceIDHeader: "18446744073709551615", ParentIDHeader: "18446744073709551615", samplingPriorityHeader: "-1"},
+		{TraceIDHeader: "5208512171318403364", ParentIDHeader: "9007199254740993", samplingPriorityHeader: "0",
+			originHeader: "synthetics", tagsHeader: "_dd.p.dm=-4,_dd.p.usr=abc,_dd.p.tid=463ac35c9f6413ad"},
+	} {
+		c, err := ParseDatadogHeaders(headers)
+		assert.NoError(t, err)
+		assert.Equal(t, headers, c.DatadogHeaders())
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, test := range []struct{ traceparent, tracestate string }{
+		{"00-0000000000000000000000000000abcd-000000000000ef01-01", "dd=s:1"},
+		{"00-0000000000000000000000000000abcd-000000000000ef01-00", "dd=s:0"},
+		{"00-463ac35c9f6413ad48485a3953bb6124-0020000000000001-01", "dd=s:2"},
+		{"00-ffffffffffffffffffffffffffffffff-ffffffffffffffff-00", "dd=s:-1"},
+	} {
+		c, err := ParseTraceparent(test.traceparent, test.tracestate)
+		assert.NoError(t, err, test.traceparent)
+		assert.Equal(t, test.traceparent, c.Traceparent())
+		assert.Equal(t, test.tracestate, c.Tracestate())
+	}
+}
+
+func TestContextConvertsBetweenFormats(t *testing.T) {
+	c, err := ParseTraceparent("00-463ac35c9f6413ad48485a3953bb6124-0020000000000001-01", "dd=s:2")
+	assert.NoError(t, err)
+	headers := c.DatadogHeaders()
+	assert.Equal(t, TraceContext{
+		TraceIDHeader:          "5208512171318403364",
+		ParentIDHeader:         "9007199254740993",
+		samplingPriorityHeader: "2",
+		tagsHeader:             "_dd.p.tid=463ac35c9f6413ad",
+	}, headers)
+
+	c, err = ParseDatadogHeaders(headers)
+	assert.NoError(t, err)
+	assert.Equal(t, "00-463ac35c9f6413ad48485a3953bb6124-0020000000000001-01", c.Traceparent())
+}
+
+func TestContextWithoutSamplingPriority(t *testing.T) {
+	c := Context{TraceID: 1, ParentID: 2}
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, "00-00000000000000000000000000000001-0000000000000002-00", c.Traceparent())
+	assert.Empty(t, c.Tracestate())
+	assert.NotContains(t, c.DatadogHeaders(), samplingPriorityHeader)
+
+	assert.Error(t, Context{ParentID: 2}.Validate())
+	assert.Error(t, Context{TraceID: 1}.Validate())
+}
@@ -0,0 +1,98 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
+)
+
+type (
+	// xraySubsegment is the document sent to the X-Ray daemon for a subsegment.
+	// See https://docs.aws.amazon.com/xray/latest/devguide/xray-api-segmentdocuments.html
+	xraySubsegment struct {
+		ID        string                                  `json:"id"`
+		TraceID   string                                  `json:"trace_id"`
+		ParentID  string                                  `json:"parent_id"`
+		Name      string                                  `json:"name"`
+		StartTime float64                                 `json:"start_time"`
+		EndTime   float64                                 `json:"end_time"`
+		Type      string                                  `json:"type"`
+		Metadata  map[string]map[string]map[string]string `json:"metadata"`
+	}
+)
+
+// sendXraySubsegment writes a subsegment containing the Datadog trace context directly to the X-Ray daemon
+// over UDP. The X-Ray converter uses this metadata to parent the X-Ray trace under the Datadog trace.
+func sendXraySubsegment(xrayHeader *header.Header, traceCtx TraceContext) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("couldn't generate subsegment id: %v", err)
+	}
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+
+	subsegment := xraySubsegment{
+		ID:        hex.EncodeToString(id),
+		TraceID:   xrayHeader.TraceID,
+		ParentID:  xrayHeader.ParentID,
+		Name:      xraySubsegmentName,
+		StartTime: now,
+		EndTime:   now,
+		Type:      "subsegment",
+		Metadata: map[string]map[string]map[string]string{
+			xraySubsegmentNamespace: {
+				xraySubsegmentKey: {
+					"trace-id":          traceCtx[TraceIDHeader],
+					"parent-id":         traceCtx[ParentIDHeader],
+					"sampling-priority": traceCtx[samplingPriorityHeader],
+				},
+			},
+		},
+	}
+	document, err := json.Marshal(subsegment)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal subsegment: %v", err)
+	}
+
+	conn, err := net.Dial("udp", getXrayDaemonAddress())
+	if err != nil {
+		return fmt.Errorf("couldn't connect to the X-Ray daemon: %v", err)
+	}
+	defer conn.Close()
+
+	message := fmt.Sprintf("%s\n%s", xrayDaemonHeader, document)
+	if _, err = conn.Write([]byte(message)); err != nil {
+		return fmt.Errorf("couldn't send subsegment to the X-Ray daemon: %v", err)
+	}
+	return nil
+}
+
+// getXrayDaemonAddress reads the UDP address of the X-Ray daemon from AWS_XRAY_DAEMON_ADDRESS, which is
+// either a single "host:port" or a pair of addresses in the form "tcp:host:port udp:host:port".
+func getXrayDaemonAddress() string {
+	address := strings.TrimSpace(environment.Snapshot().Get(xrayDaemonAddressEnvVar))
+	if address == "" {
+		return defaultXrayDaemonAddress
+	}
+	for _, part := range strings.Fields(address) {
+		if strings.HasPrefix(part, "udp:") {
+			return strings.TrimPrefix(part, "udp:")
+		}
+	}
+	return address
+}
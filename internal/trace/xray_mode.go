@@ -0,0 +1,93 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// Owner is the instrumentation in charge of a tracing signal
+type Owner string
+
+const (
+	// OwnerNone means that the signal isn't produced
+	OwnerNone Owner = "none"
+	// OwnerDatadog means that the signal is produced by the Datadog tracer
+	OwnerDatadog Owner = "datadog"
+	// OwnerXray means that the signal is produced by AWS X-Ray
+	OwnerXray Owner = "xray"
+)
+
+// Owners gives the instrumentation in charge of each tracing signal, so that X-Ray and Datadog don't both
+// instrument the same calls.
+type Owners struct {
+	// Spans is the instrumentation tracing the invocation. When it's Datadog and X-Ray traces are merged, the
+	// function execution span continues the X-Ray trace.
+	Spans Owner
+	// Headers is the instrumentation propagating the trace context of the outgoing requests which already
+	// carry an X-Ray trace header. The other requests get Datadog headers.
+	Headers Owner
+}
+
+// xrayContextMissingEnvVar is set by the Lambda runtime when X-Ray active tracing is enabled
+const xrayContextMissingEnvVar = "AWS_XRAY_CONTEXT_MISSING"
+
+// XrayActive reports whether X-Ray active tracing is enabled for the function. The trace header is read from the
+// live environment, as the runtime sets it for each invocation.
+func XrayActive() bool {
+	return environment.Snapshot().Get(xrayContextMissingEnvVar) != "" || os.Getenv(xrayTraceEnvVar) != ""
+}
+
+// ChooseOwners picks the owner of each tracing signal:
+//
+//	X-Ray   Datadog  merge   spans    headers
+//	off     off      -       none     datadog
+//	off     on       -       datadog  datadog
+//	on      off      -       xray     xray
+//	on      on       on      datadog  datadog
+//	on      on       off     datadog  xray
+//
+// In the last case, both X-Ray and Datadog trace the function, and the requests instrumented by the X-Ray SDK
+// aren't given Datadog headers on top of the X-Ray ones.
+func ChooseOwners(xrayActive, ddTraceEnabled, mergeXrayTraces bool) Owners {
+	switch {
+	case !xrayActive && !ddTraceEnabled:
+		return Owners{Spans: OwnerNone, Headers: OwnerDatadog}
+	case !xrayActive:
+		return Owners{Spans: OwnerDatadog, Headers: OwnerDatadog}
+	case !ddTraceEnabled:
+		return Owners{Spans: OwnerXray, Headers: OwnerXray}
+	case mergeXrayTraces:
+		return Owners{Spans: OwnerDatadog, Headers: OwnerDatadog}
+	default:
+		return Owners{Spans: OwnerDatadog, Headers: OwnerXray}
+	}
+}
+
+// HeaderOwner returns the owner of the trace headers of the requests carrying an X-Ray trace header, for the
+// invocation of ctx. Outside of an invocation, Datadog headers are always added.
+func HeaderOwner(ctx context.Context) Owner {
+	state, ok := ctx.Value(tracingStateKey).(*tracingState)
+	if !ok || state.headerOwner == "" {
+		return OwnerDatadog
+	}
+	return state.headerOwner
+}
+
+// warnXrayConflict warns that X-Ray and Datadog both trace the function without their traces being merged
+func warnXrayConflict() {
+	logger.Warn(fmt.Sprintf("Both AWS X-Ray active tracing and Datadog tracing are enabled, but %s isn't set: "+
+		"the traces are kept apart, and requests already carrying an X-Ray trace header aren't given Datadog "+
+		"headers. Set %s to true to merge the traces.", mergeXrayTracesEnvVar, mergeXrayTracesEnvVar))
+}
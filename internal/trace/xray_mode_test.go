@@ -0,0 +1,78 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/DataDog/datadog-lambda-go/internal/environment"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXrayActive(t *testing.T) {
+	unsetEnv(xrayContextMissingEnvVar)
+	os.Unsetenv(xrayTraceEnvVar)
+	assert.False(t, XrayActive())
+
+	setEnv(xrayContextMissingEnvVar, "LOG_ERROR")
+	assert.True(t, XrayActive())
+	unsetEnv(xrayContextMissingEnvVar)
+
+	os.Setenv(xrayTraceEnvVar, "Root=1-5e272390-8c398be037738dc042009320;Parent=94ae789b969f1cc5;Sampled=1")
+	defer os.Unsetenv(xrayTraceEnvVar)
+	assert.True(t, XrayActive())
+}
+
+func TestChooseOwners(t *testing.T) {
+	tests := []struct {
+		xrayActive, ddTraceEnabled, merge bool
+		expected                          Owners
+	}{
+		{false, false, false, Owners{Spans: OwnerNone, Headers: OwnerDatadog}},
+		{false, true, false, Owners{Spans: OwnerDatadog, Headers: OwnerDatadog}},
+		{false, true, true, Owners{Spans: OwnerDatadog, Headers: OwnerDatadog}},
+		{true, false, false, Owners{Spans: OwnerXray, Headers: OwnerXray}},
+		{true, false, true, Owners{Spans: OwnerXray, Headers: OwnerXray}},
+		{true, true, true, Owners{Spans: OwnerDatadog, Headers: OwnerDatadog}},
+		{true, true, false, Owners{Spans: OwnerDatadog, Headers: OwnerXray}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ChooseOwners(test.xrayActive, test.ddTraceEnabled, test.merge),
+			"xray %v, datadog %v, merge %v", test.xrayActive, test.ddTraceEnabled, test.merge)
+	}
+}
+
+func TestHandlerStartedSetsHeaderOwner(t *testing.T) {
+	assert.Equal(t, OwnerDatadog, HeaderOwner(context.Background()))
+
+	listener := Listener{ddTraceEnabled: false, propagator: MakePropagator(nil, nil)}
+	unsetEnv(xrayContextMissingEnvVar)
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, OwnerDatadog, HeaderOwner(ctx))
+
+	setEnv(xrayContextMissingEnvVar, "LOG_ERROR")
+	defer unsetEnv(xrayContextMissingEnvVar)
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, OwnerXray, HeaderOwner(ctx))
+}
+
+// setEnv sets an environment variable, and reloads the snapshot of the environment
+func setEnv(key, value string) {
+	os.Setenv(key, value)
+	environment.Reload()
+}
+
+// unsetEnv unsets an environment variable, and reloads the snapshot of the environment
+func unsetEnv(key string) {
+	os.Unsetenv(key)
+	environment.Reload()
+}
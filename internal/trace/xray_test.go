@@ -0,0 +1,127 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenForXraySubsegment(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	setEnv(xrayDaemonAddressEnvVar, conn.LocalAddr().String())
+	return conn
+}
+
+func readXraySubsegment(t *testing.T, conn net.PacketConn) (string, bool) {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+func TestSendXraySubsegment(t *testing.T) {
+	conn := listenForXraySubsegment(t)
+	defer conn.Close()
+	defer unsetEnv(xrayDaemonAddressEnvVar)
+
+	xrayHeader := &header.Header{TraceID: mockXRayTraceID, ParentID: mockXRayEntityID, SamplingDecision: header.Sampled}
+	err := sendXraySubsegment(xrayHeader, TraceContext{
+		TraceIDHeader:          "1231452342",
+		ParentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	})
+	assert.NoError(t, err)
+
+	message, ok := readXraySubsegment(t, conn)
+	assert.True(t, ok)
+	parts := strings.SplitN(message, "\n", 2)
+	assert.Equal(t, `{"format": "json", "version": 1}`, parts[0])
+
+	document := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(parts[1]), &document))
+	assert.Len(t, document["id"], 16)
+	assert.Equal(t, mockXRayTraceID, document["trace_id"])
+	assert.Equal(t, mockXRayEntityID, document["parent_id"])
+	assert.Equal(t, "datadog-metadata", document["name"])
+	assert.Equal(t, "subsegment", document["type"])
+	assert.Equal(t, document["start_time"], document["end_time"])
+	assert.Equal(t, map[string]interface{}{
+		"datadog": map[string]interface{}{
+			"trace": map[string]interface{}{
+				"trace-id":          "1231452342",
+				"parent-id":         "45678910",
+				"sampling-priority": "2",
+			},
+		},
+	}, document["metadata"])
+}
+
+func TestSendXraySubsegmentNoDaemon(t *testing.T) {
+	setEnv(xrayDaemonAddressEnvVar, "not-an-address")
+	defer unsetEnv(xrayDaemonAddressEnvVar)
+
+	xrayHeader := &header.Header{TraceID: mockXRayTraceID, ParentID: mockXRayEntityID, SamplingDecision: header.Sampled}
+	err := sendXraySubsegment(xrayHeader, TraceContext{})
+	assert.Error(t, err)
+}
+
+func TestGetXrayDaemonAddress(t *testing.T) {
+	defer unsetEnv(xrayDaemonAddressEnvVar)
+
+	unsetEnv(xrayDaemonAddressEnvVar)
+	assert.Equal(t, "127.0.0.1:2000", getXrayDaemonAddress())
+
+	setEnv(xrayDaemonAddressEnvVar, "169.254.79.129:2000")
+	assert.Equal(t, "169.254.79.129:2000", getXrayDaemonAddress())
+
+	setEnv(xrayDaemonAddressEnvVar, "tcp:127.0.0.1:2000 udp:127.0.0.2:2001")
+	assert.Equal(t, "127.0.0.2:2001", getXrayDaemonAddress())
+}
+
+func TestContextWithRootTraceContextSendsSubsegmentOnlyWhenMerging(t *testing.T) {
+	conn := listenForXraySubsegment(t)
+	defer conn.Close()
+	defer unsetEnv(xrayDaemonAddressEnvVar)
+
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+
+	contextWithRootTraceContext(ctx, *ev, false, MakePropagator(nil, nil), 1)
+	_, ok := readXraySubsegment(t, conn)
+	assert.False(t, ok)
+
+	contextWithRootTraceContext(ctx, *ev, true, MakePropagator(nil, nil), 1)
+	_, ok = readXraySubsegment(t, conn)
+	assert.True(t, ok)
+}
+
+func TestContextWithRootTraceContextSkipsSubsegmentWhenNotSampled(t *testing.T) {
+	conn := listenForXraySubsegment(t)
+	defer conn.Close()
+	defer unsetEnv(xrayDaemonAddressEnvVar)
+
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, false)
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+
+	contextWithRootTraceContext(ctx, *ev, true, MakePropagator(nil, nil), 1)
+	_, ok := readXraySubsegment(t, conn)
+	assert.False(t, ok)
+}
@@ -0,0 +1,45 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// invocationState records whether an invocation finished, so that the work it started, such as goroutines, can
+// tell when it outlived the invocation
+type invocationState struct {
+	finished int32
+}
+
+var invocationStateKey = new(contextKeytype)
+
+// withInvocationState adds the state of an invocation in progress to the context
+func withInvocationState(ctx context.Context) (context.Context, *invocationState) {
+	state := &invocationState{}
+	return context.WithValue(ctx, invocationStateKey, state), state
+}
+
+func (s *invocationState) finish() {
+	atomic.StoreInt32(&s.finished, 1)
+}
+
+// invokedByWrappedHandler returns whether ctx belongs to an invocation of a wrapped handler still in progress
+func invokedByWrappedHandler(ctx context.Context) bool {
+	state, ok := ctx.Value(invocationStateKey).(*invocationState)
+	return ok && atomic.LoadInt32(&state.finished) == 0
+}
+
+// InvocationFinished returns whether the invocation that ctx belongs to finished, once its listeners finished.
+// It returns false when ctx doesn't come from a wrapped handler.
+func InvocationFinished(ctx context.Context) bool {
+	state, ok := ctx.Value(invocationStateKey).(*invocationState)
+	return ok && atomic.LoadInt32(&state.finished) == 1
+}
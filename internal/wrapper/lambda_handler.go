@@ -0,0 +1,74 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/DataDog/datadog-lambda-go/internal/health"
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// MarshalError is returned when the response of a handler can't be marshaled to JSON, for example when it holds
+// a channel or a NaN float
+type MarshalError struct {
+	// TypeName is the type of the response which couldn't be marshaled
+	TypeName string
+	Err      error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("couldn't marshal the response of type %s: %v", e.TypeName, e.Err)
+}
+
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
+// lambdaHandler is a lambda.Handler which marshals the response of the wrapped handler itself
+type lambdaHandler struct {
+	*wrappedHandler
+}
+
+// WrapLambdaHandlerWithListeners wraps a lambda handler like WrapHandlerWithListeners, and returns it as a
+// lambda.Handler. The response is marshaled by the wrapper rather than by the AWS SDK, so that a response which
+// can't be marshaled is reported to the listeners as a MarshalError.
+func WrapLambdaHandlerWithListeners(handler interface{}, listeners ...HandlerListener) lambda.Handler {
+	err := validateHandler(handler)
+	if err != nil {
+		// This wasn't a valid handler function, pass back to AWS SDK to let it handle the error.
+		health.Degrade(health.ReasonInvalidHandler, fmt.Errorf("handler function was in format ddlambda doesn't recognize: %v", err))
+		return lambda.NewHandler(handler)
+	}
+	return lambdaHandler{&wrappedHandler{handler: handler, listeners: listeners}}
+}
+
+// Invoke runs one invocation of the handler, and returns its marshaled response
+func (h lambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	result, err := h.invoke(ctx, payload, true)
+	if err != nil {
+		return nil, err
+	}
+	return result.(json.RawMessage), nil
+}
+
+// marshalHandlerResponse marshals the response of a handler to a json.RawMessage, returning a MarshalError when it
+// fails
+func marshalHandlerResponse(response interface{}) (interface{}, error) {
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		typeName := fmt.Sprintf("%T", response)
+		logger.Debug(fmt.Sprintf("couldn't marshal the response of type %s: %v", typeName, err))
+		return nil, &MarshalError{TypeName: typeName, Err: err}
+	}
+	return json.RawMessage(responseBytes), nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockRatio struct {
+	Value float64 `json:"value"`
+}
+
+func TestWrapLambdaHandlerMarshalsResponse(t *testing.T) {
+	mhl := mockHandlerListener{}
+	handler := WrapLambdaHandlerWithListeners(func(ctx context.Context, ev mockNonProxyEvent) (mockNonProxyEvent, error) {
+		return ev, nil
+	}, &mhl)
+
+	response, err := handler.Invoke(context.Background(), []byte(`{"fake-id":"abc"}`))
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"my-custom-event":null,"fake-id":"abc"}`, string(response))
+	assert.Equal(t, json.RawMessage(response), mhl.outputResponse)
+	assert.NoError(t, mhl.outputErr)
+}
+
+func TestWrapLambdaHandlerMarshalError(t *testing.T) {
+	for name, result := range map[string]interface{}{
+		"chan int":          make(chan int),
+		"wrapper.mockRatio": mockRatio{Value: math.NaN()},
+	} {
+		mhl := mockHandlerListener{}
+		handler := WrapLambdaHandlerWithListeners(func() (interface{}, error) {
+			return result, nil
+		}, &mhl)
+
+		response, err := handler.Invoke(context.Background(), []byte("{}"))
+
+		assert.Nil(t, response)
+		var marshalErr *MarshalError
+		if assert.True(t, errors.As(err, &marshalErr)) {
+			assert.Equal(t, name, marshalErr.TypeName)
+		}
+		// The listeners are finished with the error, so that it's counted
+		assert.Equal(t, err, mhl.outputErr)
+		assert.Nil(t, mhl.outputResponse)
+	}
+}
+
+func TestWrapLambdaHandlerKeepsHandlerError(t *testing.T) {
+	mhl := mockHandlerListener{}
+	handlerErr := errors.New("something went wrong")
+	handler := WrapLambdaHandlerWithListeners(func() (chan int, error) {
+		return make(chan int), handlerErr
+	}, &mhl)
+
+	_, err := handler.Invoke(context.Background(), []byte("{}"))
+
+	// The response isn't marshaled when the handler failed
+	assert.Equal(t, handlerErr, err)
+	assert.Equal(t, handlerErr, mhl.outputErr)
+}
+
+func TestWrapLambdaHandlerInvalidHandler(t *testing.T) {
+	handler := WrapLambdaHandlerWithListeners(1)
+
+	_, err := handler.Invoke(context.Background(), []byte("{}"))
+	assert.Error(t, err)
+}
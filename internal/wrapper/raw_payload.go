@@ -0,0 +1,61 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// DefaultRawPayloadMaxSize is the size in bytes above which raw payloads aren't retained, unless configured otherwise
+const DefaultRawPayloadMaxSize = 256 * 1024
+
+type (
+	contextKeytype int
+
+	// RawPayloadListener retains a copy of the raw payload of every invocation in its context, so that it can
+	// be read by the handler with GetRawPayload
+	RawPayloadListener struct {
+		maxSize int
+	}
+)
+
+var rawPayloadKey = new(contextKeytype)
+
+// MakeRawPayloadListener creates a RawPayloadListener. Payloads larger than maxSize bytes aren't retained, as
+// the copy doubles the memory they use. A maxSize of 0 uses DefaultRawPayloadMaxSize.
+func MakeRawPayloadListener(maxSize int) RawPayloadListener {
+	if maxSize <= 0 {
+		maxSize = DefaultRawPayloadMaxSize
+	}
+	return RawPayloadListener{maxSize: maxSize}
+}
+
+// HandlerStarted adds a copy of the raw payload to the context
+func (l *RawPayloadListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	if len(msg) > l.maxSize {
+		logger.Debug(fmt.Sprintf("not retaining the raw payload of %d bytes, larger than the maximum of %d bytes", len(msg), l.maxSize))
+		return ctx
+	}
+	payload := make([]byte, len(msg))
+	copy(payload, msg)
+	return context.WithValue(ctx, rawPayloadKey, payload)
+}
+
+// HandlerFinished implemented as part of the HandlerListener interface
+func (l *RawPayloadListener) HandlerFinished(ctx context.Context, response interface{}, err error) {}
+
+// GetRawPayload returns the raw payload retained by a RawPayloadListener, and whether there is one
+func GetRawPayload(ctx context.Context) ([]byte, bool) {
+	payload, ok := ctx.Value(rawPayloadKey).([]byte)
+	return payload, ok
+}
@@ -0,0 +1,53 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawPayloadListenerRetainsCopy(t *testing.T) {
+	listener := MakeRawPayloadListener(0)
+	msg := json.RawMessage(`{"key":"value"}`)
+
+	ctx := listener.HandlerStarted(context.Background(), msg)
+	msg[2] = 'K'
+
+	payload, ok := GetRawPayload(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, `{"key":"value"}`, string(payload))
+}
+
+func TestRawPayloadListenerMaxSize(t *testing.T) {
+	listener := MakeRawPayloadListener(10)
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage(`{"key":"value"}`))
+	_, ok := GetRawPayload(ctx)
+	assert.False(t, ok)
+
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage(`{"k":"v"}`))
+	payload, ok := GetRawPayload(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, `{"k":"v"}`, string(payload))
+}
+
+func TestMakeRawPayloadListenerDefaultMaxSize(t *testing.T) {
+	listener := MakeRawPayloadListener(0)
+	assert.Equal(t, DefaultRawPayloadMaxSize, listener.maxSize)
+}
+
+func TestGetRawPayloadWithoutListener(t *testing.T) {
+	payload, ok := GetRawPayload(context.Background())
+	assert.False(t, ok)
+	assert.Nil(t, payload)
+}
@@ -0,0 +1,39 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"time"
+)
+
+// handlerTiming records when the handler of an invocation started and returned. The times are read with
+// time.Now, so their differences use the monotonic clock.
+type handlerTiming struct {
+	start time.Time
+	end   time.Time
+}
+
+var handlerTimingKey = new(contextKeytype)
+
+// withHandlerTiming adds an empty handlerTiming to the context, filled once the handler ran
+func withHandlerTiming(ctx context.Context) (context.Context, *handlerTiming) {
+	timing := &handlerTiming{}
+	return context.WithValue(ctx, handlerTimingKey, timing), timing
+}
+
+// GetHandlerTiming returns when the handler of the invocation started and returned, without the time spent in
+// the listeners. It returns false until the handler returned, or when ctx doesn't come from a wrapped handler.
+func GetHandlerTiming(ctx context.Context) (start time.Time, end time.Time, ok bool) {
+	timing, ok := ctx.Value(handlerTimingKey).(*handlerTiming)
+	if !ok || timing.end.IsZero() {
+		return time.Time{}, time.Time{}, false
+	}
+	return timing.start, timing.end, true
+}
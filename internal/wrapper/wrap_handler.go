@@ -14,48 +14,199 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/DataDog/datadog-lambda-go/internal/health"
+	"github.com/DataDog/datadog-lambda-go/internal/initphase"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 )
 
 var (
-	// CurrentContext is the last create lambda context object.
-	CurrentContext context.Context
+	// contextMu serializes the changes of currentContexts
+	contextMu sync.Mutex
+	// currentContexts holds the *contextSnapshot of the invocations in progress. It's replaced rather than
+	// modified, so that CurrentContext reads a consistent snapshot without locking, however many goroutines
+	// send metrics while invocations start and finish.
+	currentContexts atomic.Value
 )
 
+// contextSnapshot is an immutable view of the contexts of the invocations in progress
+type contextSnapshot struct {
+	// active are the contexts of the invocations in progress, in the order they started. Handlers wrapped
+	// separately can be invoked concurrently in the same process.
+	active []context.Context
+	// fallback is the current context when no invocation is in progress
+	fallback context.Context
+}
+
 type (
 	// HandlerListener is a point where listener logic can be injected into a handler
 	HandlerListener interface {
 		HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context
-		HandlerFinished(ctx context.Context, err error)
+		HandlerFinished(ctx context.Context, response interface{}, err error)
 	}
 )
 
 // WrapHandlerWithListeners wraps a lambda handler, and calls listeners before and after every invocation.
+// Listeners are started in order, and finished in reverse order. A panic in a listener is recovered and logged,
+// so that it doesn't prevent the other listeners from running.
 func WrapHandlerWithListeners(handler interface{}, listeners ...HandlerListener) interface{} {
 	err := validateHandler(handler)
 	if err != nil {
 		// This wasn't a valid handler function, pass back to AWS SDK to let it handle the error.
-		logger.Error(fmt.Errorf("handler function was in format ddlambda doesn't recognize: %v", err))
+		health.Degrade(health.ReasonInvalidHandler, fmt.Errorf("handler function was in format ddlambda doesn't recognize: %v", err))
 		return handler
 	}
-	coldStart := true
+	h := &wrappedHandler{handler: handler, listeners: listeners}
 
 	// Return custom handler, to be called once per invocation
 	return func(ctx context.Context, msg json.RawMessage) (interface{}, error) {
-		ctx = context.WithValue(ctx, "cold_start", coldStart)
-		for _, listener := range listeners {
-			ctx = listener.HandlerStarted(ctx, msg)
-		}
-		CurrentContext = ctx
-		result, err := callHandler(ctx, msg, handler)
-		for _, listener := range listeners {
-			listener.HandlerFinished(ctx, err)
+		return h.invoke(ctx, msg, false)
+	}
+}
+
+// wrappedHandler calls the listeners around every invocation of a handler
+type wrappedHandler struct {
+	handler   interface{}
+	listeners []HandlerListener
+	invoked   int32
+}
+
+// invoke runs one invocation of the handler. With marshalResponse, the response is marshaled before the listeners
+// finish, so that they get the marshaled response, or the MarshalError when it can't be marshaled.
+func (h *wrappedHandler) invoke(ctx context.Context, msg json.RawMessage, marshalResponse bool) (interface{}, error) {
+	if invokedByWrappedHandler(ctx) {
+		// The listeners of the outer handler already instrument the invocation, running them again would
+		// nest them, and flush the metrics twice
+		health.Warn(health.ReasonWrappedTwice, "a wrapped handler was invoked by another wrapped handler, which happens when a handler is wrapped twice. Wrap it once, it runs without the listeners of the inner wrapper.")
+		result, err := callHandler(ctx, msg, h.handler)
+		if marshalResponse && err == nil {
+			result, err = marshalHandlerResponse(result)
 		}
-		coldStart = false
-		CurrentContext = nil
 		return result, err
 	}
+	coldStart := atomic.CompareAndSwapInt32(&h.invoked, 0, 1)
+	if forced, ok := ctx.Value(coldStartKey).(bool); ok {
+		coldStart = forced
+	}
+	ctx = context.WithValue(ctx, "cold_start", coldStart)
+	if coldStart {
+		// The phases of the init marked from now on are ignored
+		if phases := initphase.End(time.Now()); len(phases) > 0 {
+			ctx = initphase.NewContext(ctx, phases)
+		}
+	}
+	// The event source is detected once, and shared by the listeners and the handler
+	source := eventsource.Detect(msg)
+	ctx = eventsource.WithSource(ctx, source)
+	if details, ok := eventsource.DetectDetails(source, msg); ok {
+		ctx = eventsource.WithDetails(ctx, details)
+	}
+	ctx, timing := withHandlerTiming(ctx)
+	ctx, state := withInvocationState(ctx)
+	for _, listener := range h.listeners {
+		ctx = startListener(ctx, listener, msg)
+	}
+	startContext(ctx)
+	timing.start = time.Now()
+	result, err := callHandler(ctx, msg, h.handler)
+	timing.end = time.Now()
+	if marshalResponse && err == nil {
+		result, err = marshalHandlerResponse(result)
+	}
+	for i := len(h.listeners) - 1; i >= 0; i-- {
+		finishListener(ctx, h.listeners[i], result, err)
+	}
+	state.finish()
+	finishContext(ctx)
+	return result, err
+}
+
+// coldStartKey overrides whether an invocation is a cold start, for the invocations simulated by tests
+var coldStartKey = new(contextKeytype)
+
+// WithColdStart makes the invocation of a wrapped handler with ctx a cold start, or a warm one, regardless of the
+// invocations of the handler before it
+func WithColdStart(ctx context.Context, coldStart bool) context.Context {
+	return context.WithValue(ctx, coldStartKey, coldStart)
+}
+
+// CurrentContext returns the context of the most recently started invocation which is still in progress. When
+// no invocation is in progress, it returns the context set with SetCurrentContext, or nil.
+func CurrentContext() context.Context {
+	snapshot := loadContexts()
+	if len(snapshot.active) > 0 {
+		return snapshot.active[len(snapshot.active)-1]
+	}
+	return snapshot.fallback
+}
+
+// SetCurrentContext sets the context returned by CurrentContext when no invocation is in progress
+func SetCurrentContext(ctx context.Context) {
+	updateContexts(func(snapshot *contextSnapshot) {
+		snapshot.fallback = ctx
+	})
+}
+
+func startContext(ctx context.Context) {
+	updateContexts(func(snapshot *contextSnapshot) {
+		snapshot.active = append(snapshot.active, ctx)
+	})
+}
+
+// finishContext removes the context of a finished invocation, so that the current context goes back to another
+// invocation still in progress
+func finishContext(ctx context.Context) {
+	updateContexts(func(snapshot *contextSnapshot) {
+		for i := len(snapshot.active) - 1; i >= 0; i-- {
+			if snapshot.active[i] == ctx {
+				snapshot.active = append(snapshot.active[:i], snapshot.active[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func loadContexts() *contextSnapshot {
+	if snapshot, ok := currentContexts.Load().(*contextSnapshot); ok {
+		return snapshot
+	}
+	return &contextSnapshot{}
+}
+
+// updateContexts applies update to a copy of the current snapshot, and publishes the copy
+func updateContexts(update func(snapshot *contextSnapshot)) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	current := loadContexts()
+	snapshot := &contextSnapshot{
+		active:   append([]context.Context(nil), current.active...),
+		fallback: current.fallback,
+	}
+	update(snapshot)
+	currentContexts.Store(snapshot)
+}
+
+// startListener calls HandlerStarted, returning the context unchanged if the listener panics
+func startListener(ctx context.Context, listener HandlerListener, msg json.RawMessage) (result context.Context) {
+	result = ctx
+	defer recoverListenerPanic(listener, "HandlerStarted")
+	return listener.HandlerStarted(ctx, msg)
+}
+
+// finishListener calls HandlerFinished, recovering from a panic in the listener
+func finishListener(ctx context.Context, listener HandlerListener, response interface{}, err error) {
+	defer recoverListenerPanic(listener, "HandlerFinished")
+	listener.HandlerFinished(ctx, response, err)
+}
+
+func recoverListenerPanic(listener HandlerListener, method string) {
+	if r := recover(); r != nil {
+		logger.Error(fmt.Errorf("%s of listener %T panicked: %v", method, listener, r))
+	}
 }
 
 func validateHandler(handler interface{}) error {
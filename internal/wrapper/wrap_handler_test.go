@@ -15,16 +15,21 @@ import (
 	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/eventsource"
+	"github.com/DataDog/datadog-lambda-go/internal/health"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/stretchr/testify/assert"
 )
 
 type (
 	mockHandlerListener struct {
-		inputCTX  context.Context
-		inputMSG  json.RawMessage
-		outputCTX context.Context
+		inputCTX       context.Context
+		inputMSG       json.RawMessage
+		outputCTX      context.Context
+		outputResponse interface{}
+		outputErr      error
 	}
 
 	mockNonProxyEvent struct {
@@ -39,8 +44,10 @@ func (mhl *mockHandlerListener) HandlerStarted(ctx context.Context, msg json.Raw
 	return ctx
 }
 
-func (mhl *mockHandlerListener) HandlerFinished(ctx context.Context, err error) {
+func (mhl *mockHandlerListener) HandlerFinished(ctx context.Context, response interface{}, err error) {
 	mhl.outputCTX = ctx
+	mhl.outputResponse = response
+	mhl.outputErr = err
 }
 
 func runHandlerWithJSON(t *testing.T, filename string, handler interface{}) (*mockHandlerListener, interface{}, error) {
@@ -138,11 +145,14 @@ func TestWrapHandlerAPIGEvent(t *testing.T) {
 		return 5, nil
 	}
 
-	_, response, err := runHandlerWithJSON(t, "../testdata/apig-event-no-headers.json", handler)
+	mhl, response, err := runHandlerWithJSON(t, "../testdata/apig-event-no-headers.json", handler)
 
 	assert.True(t, called)
 	assert.NoError(t, err)
 	assert.Equal(t, 5, response)
+	assert.Equal(t, 5, mhl.outputResponse)
+	source, _ := eventsource.FromContext(mhl.inputCTX)
+	assert.Equal(t, eventsource.APIGateway, source)
 }
 
 func TestWrapHandlerNonProxyEvent(t *testing.T) {
@@ -265,3 +275,161 @@ func TestWrapHandlerReturnsOriginalHandlerIfInvalid(t *testing.T) {
 	assert.Equal(t, reflect.ValueOf(handler).Pointer(), reflect.ValueOf(wrappedHandler).Pointer())
 
 }
+
+type (
+	// orderListener records the order listeners are called in, and panics when asked to
+	orderListener struct {
+		name          string
+		calls         *[]string
+		panicStarted  bool
+		panicFinished bool
+	}
+
+	orderContextKey struct{}
+)
+
+func (ol *orderListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	*ol.calls = append(*ol.calls, "start "+ol.name)
+	if ol.panicStarted {
+		panic("start failed")
+	}
+	return context.WithValue(ctx, orderContextKey{}, ol.name)
+}
+
+func (ol *orderListener) HandlerFinished(ctx context.Context, response interface{}, err error) {
+	*ol.calls = append(*ol.calls, "finish "+ol.name)
+	if ol.panicFinished {
+		panic("finish failed")
+	}
+}
+
+func TestWrapHandlerListenersOrder(t *testing.T) {
+	calls := []string{}
+	handler := func(ctx context.Context) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+	wrappedHandler := WrapHandlerWithListeners(handler,
+		&orderListener{name: "a", calls: &calls},
+		&orderListener{name: "b", calls: &calls},
+		&orderListener{name: "c", calls: &calls},
+	).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := wrappedHandler(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"start a", "start b", "start c", "handler", "finish c", "finish b", "finish a"}, calls)
+}
+
+func TestWrapHandlerListenerPanics(t *testing.T) {
+	calls := []string{}
+	var handlerCtx context.Context
+	handler := func(ctx context.Context) error {
+		handlerCtx = ctx
+		return nil
+	}
+	wrappedHandler := WrapHandlerWithListeners(handler,
+		&orderListener{name: "a", calls: &calls},
+		&orderListener{name: "b", calls: &calls, panicStarted: true, panicFinished: true},
+	).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := wrappedHandler(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"start a", "start b", "finish b", "finish a"}, calls)
+	// The context returned by the listener which started before the panic is kept
+	assert.Equal(t, "a", handlerCtx.Value(orderContextKey{}))
+}
+
+// timingListener reads the handler timing of the invocation when it starts and finishes
+type timingListener struct {
+	startedOK bool
+	duration  time.Duration
+}
+
+func (tl *timingListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	_, _, tl.startedOK = GetHandlerTiming(ctx)
+	time.Sleep(50 * time.Millisecond)
+	return ctx
+}
+
+func (tl *timingListener) HandlerFinished(ctx context.Context, response interface{}, err error) {
+	start, end, _ := GetHandlerTiming(ctx)
+	tl.duration = end.Sub(start)
+}
+
+func TestWrapHandlerTimesHandler(t *testing.T) {
+	handler := func(ctx context.Context) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	listener := &timingListener{}
+	wrappedHandler := WrapHandlerWithListeners(handler, listener).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := wrappedHandler(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.False(t, listener.startedOK)
+	// The time spent in the listener isn't counted
+	assert.True(t, listener.duration >= 5*time.Millisecond && listener.duration < 50*time.Millisecond, listener.duration)
+
+	_, _, ok := GetHandlerTiming(context.Background())
+	assert.False(t, ok)
+}
+
+func TestCurrentContextGoesBackToInvocationInProgress(t *testing.T) {
+	first := context.WithValue(context.Background(), "invocation", "first")
+	second := context.WithValue(context.Background(), "invocation", "second")
+
+	startContext(first)
+	startContext(second)
+	assert.Equal(t, second, CurrentContext())
+	finishContext(second)
+	assert.Equal(t, first, CurrentContext())
+	finishContext(first)
+	assert.Nil(t, CurrentContext())
+}
+
+func TestWrapHandlerColdStartOnce(t *testing.T) {
+	coldStarts := []bool{}
+	handler := func(ctx context.Context) error {
+		coldStarts = append(coldStarts, ctx.Value("cold_start").(bool))
+		return nil
+	}
+	wrapped := WrapHandlerWithListeners(handler).(func(context.Context, json.RawMessage) (interface{}, error))
+	wrapped(context.Background(), json.RawMessage("{}"))
+	wrapped(context.Background(), json.RawMessage("{}"))
+	assert.Equal(t, []bool{true, false}, coldStarts)
+}
+
+func TestWrapHandlerFinishesInvocation(t *testing.T) {
+	var invocationCtx context.Context
+	handler := func(ctx context.Context) error {
+		invocationCtx = ctx
+		assert.False(t, InvocationFinished(ctx))
+		return nil
+	}
+	wrapped := WrapHandlerWithListeners(handler).(func(context.Context, json.RawMessage) (interface{}, error))
+	wrapped(context.Background(), json.RawMessage("{}"))
+
+	assert.True(t, InvocationFinished(invocationCtx))
+	assert.False(t, InvocationFinished(context.Background()))
+}
+
+func TestWrapHandlerNestedRunsListenersOnce(t *testing.T) {
+	health.Reset()
+	defer health.Reset()
+	outerListener := mockHandlerListener{}
+	innerListener := mockHandlerListener{}
+	handler := func(ctx context.Context) (string, error) {
+		return "done", nil
+	}
+	inner := WrapHandlerWithListeners(handler, &innerListener)
+	outer := WrapHandlerWithListeners(inner, &outerListener).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	response, err := outer(context.Background(), json.RawMessage("{}"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "done", response)
+	assert.NotNil(t, outerListener.inputCTX)
+	assert.Nil(t, innerListener.inputCTX)
+	assert.Nil(t, innerListener.outputCTX)
+	assert.Equal(t, []health.Reason{health.ReasonWrappedTwice}, health.GetStatus().Warnings)
+}